@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/config"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+	"github.com/rs/zerolog"
+)
+
+const cliUsage = `Usage: easy-tunnel-lb-agent <command> [flags]
+
+Commands:
+  serve                   run the agent (the default without a command)
+  status                  show the status of an agent
+  tunnel list             list the tunnels
+  tunnel create           create a tunnel
+  tunnel remove <id>      remove a tunnel, or with --selector the tunnels matching it
+  tunnel pause <id>       withdraw the routes of a tunnel, keeping its client connected
+  tunnel resume <id>      route a paused tunnel again
+  routes                  show the routing table of the load balancer
+  dashboard               watch tunnels, health and traffic live in the terminal
+  client                  expose a local port through an agent
+  loadtest                drive load through synthetic tunnels and report latencies
+  config validate         check a configuration without starting the agent
+  config print            print the effective configuration, secrets redacted
+  secrets generate-key    generate a key for sealing stored secrets (SECRETS_KEYS)
+  version                 print the version
+
+The commands that call an agent take --api-url and --token, which default to
+EASY_TUNNEL_API_URL and EASY_TUNNEL_API_TOKEN. Run a command with -h to see
+its flags.
+`
+
+// runCommand runs a subcommand other than serve, writing its output to stdout
+func runCommand(args []string, stdout io.Writer) error {
+	err := dispatch(args, stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+func dispatch(args []string, stdout io.Writer) error {
+	switch args[0] {
+	case "status":
+		return runStatus(args[1:], stdout)
+	case "tunnel", "tunnels":
+		if len(args) < 2 {
+			return fmt.Errorf("tunnel needs a subcommand: list, create, remove, pause or resume")
+		}
+		switch args[1] {
+		case "list":
+			return runTunnelList(args[2:], stdout)
+		case "create":
+			return runTunnelCreate(args[2:], stdout)
+		case "remove":
+			return runTunnelRemove(args[2:], stdout)
+		case "pause", "resume":
+			return runTunnelPause(args[1], args[2:], stdout)
+		}
+		return fmt.Errorf("unknown tunnel subcommand %q", args[1])
+	case "routes":
+		return runRoutes(args[1:], stdout)
+	case "dashboard":
+		return runDashboard(args[1:], stdout)
+	case "client":
+		return runClient(args[1:], stdout)
+	case "loadtest":
+		return runLoadTest(args[1:], stdout)
+	case "config":
+		if len(args) < 2 {
+			return fmt.Errorf("config needs a subcommand: validate or print")
+		}
+		switch args[1] {
+		case "validate":
+			return runConfigValidate(args[2:], stdout)
+		case "print":
+			return runConfigPrint(args[2:], stdout)
+		}
+		return fmt.Errorf("unknown config subcommand %q", args[1])
+	case "secrets":
+		if len(args) < 2 || args[1] != "generate-key" {
+			return fmt.Errorf("secrets needs a subcommand: generate-key")
+		}
+		return runSecretsGenerateKey(args[2:], stdout)
+	case "version":
+		fmt.Fprintf(stdout, "easy-tunnel-lb-agent %s (commit %s, built %s)\n", version, commit, date)
+		return nil
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, cliUsage)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, run help for the list of commands", args[0])
+}
+
+// clientOptions are the flags of the commands that call the agent API
+type clientOptions struct {
+	apiURL   string
+	token    string
+	caCert   string
+	cert     string
+	key      string
+	insecure bool
+	timeout  time.Duration
+	output   string
+}
+
+func newFlagSet(name string, stdout io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	return flags
+}
+
+func addClientFlags(flags *flag.FlagSet) *clientOptions {
+	opts := &clientOptions{}
+	apiURL := os.Getenv("EASY_TUNNEL_API_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:8080"
+	}
+	flags.StringVar(&opts.apiURL, "api-url", apiURL, "base URL of the agent API")
+	flags.StringVar(&opts.token, "token", os.Getenv("EASY_TUNNEL_API_TOKEN"), "bearer token for the agent API")
+	flags.StringVar(&opts.caCert, "ca-cert", "", "PEM file of the CA that signed the agent's certificate")
+	flags.StringVar(&opts.cert, "cert", "", "PEM client certificate, for agents that require mTLS")
+	flags.StringVar(&opts.key, "key", "", "PEM key of the client certificate")
+	flags.BoolVar(&opts.insecure, "insecure", false, "skip verifying the agent's certificate")
+	flags.DurationVar(&opts.timeout, "timeout", 30*time.Second, "timeout of the API call")
+	flags.StringVar(&opts.output, "output", "table", "output format (table, json)")
+	return opts
+}
+
+// client builds an API client from the flags
+func (o *clientOptions) client() (*client.Client, error) {
+	if o.output != "table" && o.output != "json" {
+		return nil, fmt.Errorf("invalid output format %q, use table or json", o.output)
+	}
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	httpClient := &http.Client{Transport: transport, Timeout: o.timeout}
+	return client.New(o.apiURL, o.token).WithHTTPClient(httpClient), nil
+}
+
+// tlsConfig builds the TLS configuration for connections to the agent
+func (o *clientOptions) tlsConfig() (*tls.Config, error) {
+	if (o.cert == "") != (o.key == "") {
+		return nil, fmt.Errorf("--cert and --key must be set together")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.insecure}
+	if o.caCert != "" {
+		pem, err := os.ReadFile(o.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if o.cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func printJSON(stdout io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func runStatus(args []string, stdout io.Writer) error {
+	flags := newFlagSet("status", stdout)
+	opts := addClientFlags(flags)
+	verbose := flags.Bool("verbose", false, "include build, runtime, listener, WireGuard and persistence details (needs the admin scope)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	status, err := c.GetStatus(context.Background(), &client.GetStatusParams{Verbose: *verbose})
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(stdout, status)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Status:\t%s\n", status.Status)
+	fmt.Fprintf(w, "Version:\t%s\n", status.Version)
+	fmt.Fprintf(w, "Uptime:\t%s\n", status.Uptime)
+	fmt.Fprintf(w, "Tunnels:\t%d (%d degraded, %d stale handshakes)\n", status.NumTunnels, status.NumDegraded, status.NumStaleHandshakes)
+	fmt.Fprintf(w, "Requests:\t%d\n", status.Traffic.Requests)
+	fmt.Fprintf(w, "Connections:\t%d\n", status.Traffic.ActiveConnections)
+	for _, component := range status.Components {
+		line := component.Status
+		if component.Error != "" {
+			line += ": " + component.Error
+		}
+		fmt.Fprintf(w, "  %s:\t%s\n", component.Name, line)
+	}
+	if status.Details != nil {
+		printStatusDetails(w, status.Details)
+	}
+	return w.Flush()
+}
+
+func printStatusDetails(w io.Writer, details *client.StatusDetails) {
+	build := details.Build
+	fmt.Fprintf(w, "Build:\t%s (commit %s, built %s, %s)\n", build.Version, build.Commit, build.Date, build.GoVersion)
+	if details.ConfigChecksum != "" {
+		fmt.Fprintf(w, "Config checksum:\t%s\n", details.ConfigChecksum)
+	}
+	rt := details.Runtime
+	fmt.Fprintf(w, "Goroutines:\t%d (GOMAXPROCS %d)\n", rt.Goroutines, rt.Gomaxprocs)
+	fmt.Fprintf(w, "Heap:\t%d bytes allocated, %d bytes from the OS\n", rt.HeapAllocBytes, rt.HeapSysBytes)
+	fmt.Fprintf(w, "GC:\t%d cycles, %.3fs paused\n", rt.NumGc, rt.GcPauseTotalSeconds)
+	if len(details.Listeners) > 0 {
+		fmt.Fprintln(w, "Listeners:")
+		for _, l := range details.Listeners {
+			state := "listening"
+			if !l.Listening {
+				state = "stopped"
+			}
+			fmt.Fprintf(w, "  %s:\t%s://%s %s\n", l.Name, l.Protocol, l.Address, state)
+		}
+	}
+	if len(details.WireGuard) > 0 {
+		fmt.Fprintln(w, "WireGuard:")
+		for _, wg := range details.WireGuard {
+			line := fmt.Sprintf("port %d, %d peers, key %s", wg.ListenPort, wg.Peers, wg.PublicKey)
+			if wg.Error != "" {
+				line = fmt.Sprintf("port %d, %d peers: %s", wg.ListenPort, wg.Peers, wg.Error)
+			}
+			fmt.Fprintf(w, "  %s:\t%s\n", wg.Name, line)
+		}
+	}
+	if p := details.Persistence; p != nil {
+		line := "ok"
+		if !p.Healthy {
+			line = "failing: " + p.Error
+		}
+		if p.LastSaved != nil {
+			line += ", last saved " + p.LastSaved.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "Routes file:\t%s (%s)\n", p.RoutesFile, line)
+	}
+}
+
+func runTunnelList(args []string, stdout io.Writer) error {
+	flags := newFlagSet("tunnel list", stdout)
+	opts := addClientFlags(flags)
+	selector := flags.String("selector", "", "only list the tunnels whose labels match, e.g. env=staging,team!=core")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	tunnels, err := c.ListTunnels(context.Background(), &client.ListTunnelsParams{Selector: *selector})
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(stdout, tunnels)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tHOSTNAME\tTARGET PORT\tTRANSPORT\tSTATUS\tLAST ACTIVE")
+	for _, t := range tunnels.Tunnels {
+		transport := t.Transport
+		if transport == "" {
+			transport = "wireguard"
+		}
+		status := t.Status
+		if t.Maintenance {
+			status += " (maintenance)"
+		}
+		if t.Paused {
+			status += " (paused)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", t.TunnelID, strings.Join(tunnelHostnames(t), ","),
+			t.TargetPort, transport, status, t.LastActive.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func tunnelHostnames(t client.TunnelSummary) []string {
+	if len(t.Hostnames) > 0 {
+		return t.Hostnames
+	}
+	return []string{t.Hostname}
+}
+
+func runTunnelCreate(args []string, stdout io.Writer) error {
+	flags := newFlagSet("tunnel create", stdout)
+	opts := addClientFlags(flags)
+	id := flags.String("id", "", "tunnel ID (required)")
+	hostname := flags.String("hostname", "", "public hostname of the tunnel (required)")
+	targetPort := flags.Int("target-port", 0, "port of the service behind the tunnel (required)")
+	transport := flags.String("transport", "", "tunnel transport (wireguard, websocket, ssh)")
+	protocol := flags.String("protocol", "", "protocol the tunnel is routed by (http, tcp, tls, udp)")
+	listenPort := flags.Int("listen-port", 0, "public port of tcp and udp tunnels")
+	mirrorTo := flags.String("mirror-to", "", "ID of a tunnel receiving copies of the tunnel's requests")
+	mirrorPercent := flags.Int("mirror-percent", 0, "percentage of requests mirrored (all if zero)")
+	ttl := flags.Duration("ttl", 0, "remove the tunnel automatically after this long, e.g. 24h")
+	labels := flags.String("labels", "", "comma-separated labels of the tunnel, e.g. env=staging,team=web")
+	publicKey := flags.String("wg-public-key", "", "WireGuard public key of the client")
+	generateKeys := flags.Bool("generate-wg-keys", false, "have the agent generate the client's WireGuard keys")
+	idempotencyKey := flags.String("idempotency-key", "", "idempotency key, so that retrying the command creates the tunnel once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" || *hostname == "" || *targetPort == 0 {
+		return fmt.Errorf("--id, --hostname and --target-port are required")
+	}
+	labelMap, err := parseLabels(*labels)
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.CreateTunnel(context.Background(), &client.CreateTunnelParams{IdempotencyKey: *idempotencyKey}, &client.CreateTunnelRequest{
+		TunnelID:              *id,
+		Hostname:              *hostname,
+		TargetPort:            *targetPort,
+		Transport:             *transport,
+		Protocol:              *protocol,
+		ListenPort:            *listenPort,
+		MirrorTunnelID:        *mirrorTo,
+		MirrorPercent:         *mirrorPercent,
+		TTLSeconds:            int(*ttl / time.Second),
+		Labels:                labelMap,
+		WireGuardPublicKey:    *publicKey,
+		GenerateWireGuardKeys: *generateKeys,
+	})
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(stdout, resp)
+	}
+
+	fmt.Fprintf(stdout, "Created tunnel %s at %s\n", resp.TunnelID, strings.Join(resp.Resources.Hostnames, ", "))
+	printResources(stdout, resp.Resources)
+	if resp.WireGuardQuickConfig != "" {
+		fmt.Fprintf(stdout, "\nWireGuard configuration:\n%s\n", resp.WireGuardQuickConfig)
+	}
+	if resp.WebSocketConfig != nil {
+		fmt.Fprintf(stdout, "WebSocket URL: %s\nWebSocket token: %s\n", resp.WebSocketConfig.URL, resp.WebSocketConfig.Token)
+	}
+	if resp.SSHConfig != nil {
+		fmt.Fprintf(stdout, "SSH command: %s\nSSH password: %s\n", resp.SSHConfig.Command, resp.SSHConfig.Password)
+	}
+	return nil
+}
+
+// printResources prints the endpoints and DNS records of a created tunnel
+func printResources(stdout io.Writer, resources client.AssignedResources) {
+	for _, url := range resources.Urls {
+		fmt.Fprintf(stdout, "URL: %s\n", url)
+	}
+	for _, port := range resources.Ports {
+		fmt.Fprintf(stdout, "Port: %s/%d\n", port.Protocol, port.Port)
+	}
+	if resources.WireGuardEndpoint != "" {
+		fmt.Fprintf(stdout, "WireGuard endpoint: %s\n", resources.WireGuardEndpoint)
+	}
+	if len(resources.WireGuardAllowedIps) > 0 {
+		fmt.Fprintf(stdout, "WireGuard allowed IPs: %s\n", strings.Join(resources.WireGuardAllowedIps, ", "))
+	}
+	for _, record := range resources.DnsRecords {
+		line := record.State
+		if record.Error != "" {
+			line += ": " + record.Error
+		}
+		fmt.Fprintf(stdout, "DNS %s: %s\n", record.Hostname, line)
+	}
+}
+
+func runTunnelRemove(args []string, stdout io.Writer) error {
+	flags := newFlagSet("tunnel remove", stdout)
+	opts := addClientFlags(flags)
+	selector := flags.String("selector", "", "remove the tunnels whose labels match instead, e.g. env=staging")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (flags.NArg() == 1) == (*selector != "") || flags.NArg() > 1 {
+		return fmt.Errorf("tunnel remove takes the tunnel ID or --selector")
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.RemoveTunnel(context.Background(), &client.RemoveTunnelRequest{TunnelID: flags.Arg(0), Selector: *selector})
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(stdout, resp)
+	}
+	if *selector == "" {
+		fmt.Fprintf(stdout, "Removed tunnel %s\n", flags.Arg(0))
+		return nil
+	}
+	for _, id := range resp.RemovedTunnelIds {
+		fmt.Fprintf(stdout, "Removed tunnel %s\n", id)
+	}
+	fmt.Fprintf(stdout, "%d tunnels removed\n", len(resp.RemovedTunnelIds))
+	return nil
+}
+
+// parseLabels parses comma-separated key=value labels
+func parseLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid label %q, use key=value", pair)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// runTunnelPause pauses or resumes a tunnel, for subcommand pause or resume
+func runTunnelPause(subcommand string, args []string, stdout io.Writer) error {
+	flags := newFlagSet("tunnel "+subcommand, stdout)
+	opts := addClientFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("tunnel %s takes the tunnel ID", subcommand)
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	call := c.PauseTunnel
+	if subcommand == "resume" {
+		call = c.ResumeTunnel
+	}
+	resp, err := call(context.Background(), flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(stdout, resp)
+	}
+	if resp.Paused {
+		fmt.Fprintf(stdout, "Paused tunnel %s, closing %d connections\n", resp.TunnelID, resp.ClosedConnections)
+	} else {
+		fmt.Fprintf(stdout, "Resumed tunnel %s\n", resp.TunnelID)
+	}
+	return nil
+}
+
+func runRoutes(args []string, stdout io.Writer) error {
+	flags := newFlagSet("routes", stdout)
+	opts := addClientFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	routes, err := c.ListRoutes(context.Background())
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(stdout, routes)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MATCH\tPATH\tTUNNEL\tBACKEND")
+	for _, route := range routes.Routes {
+		match, path := routeColumns(route)
+		tunnel, backend := route.TunnelID, fmt.Sprintf("%s:%d", route.IP, route.Port)
+		if route.Redirect != nil || route.Response != nil {
+			tunnel, backend = "-", staticColumn(route)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", match, path, tunnel, backend)
+	}
+	return w.Flush()
+}
+
+// staticColumn describes what a static route answers with
+func staticColumn(route client.Route) string {
+	if route.Redirect != nil {
+		status := route.Redirect.Status
+		if status == 0 {
+			status = http.StatusMovedPermanently
+		}
+		return fmt.Sprintf("redirect %d %s", status, route.Redirect.URL)
+	}
+	status := route.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return fmt.Sprintf("response %d", status)
+}
+
+// routeColumns formats what a route matches: a hostname or TCP listen port,
+// prefixed by the protocol of TLS passthrough and UDP routes, and its path
+// if it has one
+func routeColumns(route client.Route) (match, path string) {
+	match = route.Hostname
+	if route.ListenPort != 0 {
+		match = ":" + strconv.Itoa(route.ListenPort)
+	}
+	if route.Protocol != "" {
+		match = route.Protocol + " " + match
+	}
+	path = "-"
+	if route.Path != "" {
+		path = route.PathType + " " + route.Path
+	}
+	return match, path
+}
+
+// configOptions are the flags of serve that the config commands resolve
+// the configuration with
+type configOptions struct {
+	configFile string
+	profile    string
+	logLevel   string
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configOptions {
+	opts := &configOptions{}
+	flags.StringVar(&opts.configFile, "config", "", "path to config file of KEY=VALUE lines (environment variables take precedence)")
+	flags.StringVar(&opts.profile, "profile", "", "profile of the config file to load, e.g. dev or prod")
+	flags.StringVar(&opts.logLevel, "log-level", "", "log level the agent is started with, overriding LOG_LEVEL")
+	return opts
+}
+
+// load resolves and validates the configuration as serve would
+func (o *configOptions) load() ([]config.Setting, error) {
+	if o.profile != "" && o.configFile == "" {
+		return nil, fmt.Errorf("--profile requires --config")
+	}
+	_, settings, err := config.LoadEffective(o.configFile, o.profile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if o.logLevel != "" {
+		if _, err := zerolog.ParseLevel(o.logLevel); err != nil {
+			return nil, fmt.Errorf("invalid --log-level: %v", err)
+		}
+		for i := range settings {
+			if settings[i].Key == "LOG_LEVEL" {
+				settings[i].Value, settings[i].Source = o.logLevel, "flag"
+			}
+		}
+	}
+	return settings, nil
+}
+
+func runConfigValidate(args []string, stdout io.Writer) error {
+	flags := newFlagSet("config validate", stdout)
+	opts := addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := opts.load(); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Configuration is valid")
+	return nil
+}
+
+func runConfigPrint(args []string, stdout io.Writer) error {
+	flags := newFlagSet("config print", stdout)
+	opts := addConfigFlags(flags)
+	output := flags.String("output", "yaml", "output format (yaml, json)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output != "yaml" && *output != "json" {
+		return fmt.Errorf("invalid output format %q, use yaml or json", *output)
+	}
+
+	settings, err := opts.load()
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		values := make(map[string]string, len(settings))
+		for _, setting := range settings {
+			values[setting.Key] = setting.Value
+		}
+		return printJSON(stdout, values)
+	}
+
+	// Go's quoted strings are valid double-quoted YAML scalars, which keep
+	// values such as "on" or "0755" strings
+	fmt.Fprintln(stdout, "# Effective configuration, with the source of each value")
+	for _, setting := range settings {
+		fmt.Fprintf(stdout, "%s: %s # %s\n", setting.Key, strconv.Quote(setting.Value), setting.Source)
+	}
+	return nil
+}
+
+func runSecretsGenerateKey(args []string, stdout io.Writer) error {
+	flags := newFlagSet("secrets generate-key", stdout)
+	id := flags.String("id", "key-"+time.Now().UTC().Format("20060102"), "ID of the key, recorded with the secrets it seals")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" || strings.HasPrefix(*id, "#") || strings.ContainsAny(*id, ":,\n") {
+		return fmt.Errorf("key ID must not be empty, start with # or contain colons, commas or newlines")
+	}
+
+	key, err := secrets.GenerateKey(*id)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, key)
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/config"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+func TestCommands(t *testing.T) {
+	handler := api.NewHandler(tunnel.NewManager(10), "test")
+	tokens, err := api.NewTokenStore([]api.APIToken{{Name: "operator", Token: "secret", Scopes: []string{api.ScopeAdmin}}})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	router := loadbalancer.NewRouter(&loadbalancer.Config{})
+	if err := router.AddTCPRoute("db", 15432, "10.0.0.3", 5432); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.AddStaticRoute(loadbalancer.Route{Hostname: "example.com", Redirect: &loadbalancer.Redirect{URL: "https://www.example.com"}}); err != nil {
+		t.Fatalf("Failed to add static route: %v", err)
+	}
+	handler.SetRouteTable(router)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	t.Setenv("EASY_TUNNEL_API_URL", server.URL)
+	t.Setenv("EASY_TUNNEL_API_TOKEN", "secret")
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectError    bool
+	}{
+		{name: "Create", args: []string{"tunnel", "create", "--id", "web", "--hostname", "web.example.com", "--target-port", "8080"}, expectedOutput: "Created tunnel web"},
+		{name: "Create without hostname", args: []string{"tunnel", "create", "--id", "api", "--target-port", "8080"}, expectError: true},
+		{name: "List", args: []string{"tunnel", "list"}, expectedOutput: "web.example.com"},
+		{name: "List as JSON", args: []string{"tunnel", "list", "--output", "json"}, expectedOutput: `"tunnel_id": "web"`},
+		{name: "Status", args: []string{"status"}, expectedOutput: "Tunnels:      1"},
+		{name: "Routes", args: []string{"routes"}, expectedOutput: ":15432"},
+		{name: "Static routes", args: []string{"routes"}, expectedOutput: "redirect 301 https://www.example.com"},
+		{name: "Pause", args: []string{"tunnel", "pause", "web"}, expectedOutput: "Paused tunnel web"},
+		{name: "List paused", args: []string{"tunnel", "list"}, expectedOutput: "active (paused)"},
+		{name: "Resume", args: []string{"tunnel", "resume", "web"}, expectedOutput: "Resumed tunnel web"},
+		{name: "Pause unknown tunnel", args: []string{"tunnel", "pause", "api"}, expectError: true},
+		{name: "Create with labels", args: []string{"tunnel", "create", "--id", "preview", "--hostname", "preview.example.com", "--target-port", "8080", "--labels", "env=preview,team=web"}, expectedOutput: "Created tunnel preview"},
+		{name: "Create with invalid labels", args: []string{"tunnel", "create", "--id", "api", "--hostname", "api.example.com", "--target-port", "8080", "--labels", "env"}, expectError: true},
+		{name: "List by selector", args: []string{"tunnel", "list", "--selector", "env=preview"}, expectedOutput: "preview.example.com"},
+		{name: "Remove by selector", args: []string{"tunnel", "remove", "--selector", "env=preview,team=web"}, expectedOutput: "1 tunnels removed"},
+		{name: "Remove without tunnel", args: []string{"tunnel", "remove"}, expectError: true},
+		{name: "Remove", args: []string{"tunnel", "remove", "web"}, expectedOutput: "Removed tunnel web"},
+		{name: "Remove unknown tunnel", args: []string{"tunnel", "remove", "web"}, expectError: true},
+		{name: "Invalid output", args: []string{"status", "--output", "yaml"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runCommand(tt.args, &out)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, got output %q", out.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !strings.Contains(out.String(), tt.expectedOutput) {
+				t.Errorf("Expected output containing %q, got %q", tt.expectedOutput, out.String())
+			}
+		})
+	}
+
+	if err := runCommand([]string{"tunnel", "list", "--token", ""}, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected unauthorized error without a token, got %v", err)
+	}
+	if err := runCommand([]string{"bogus"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an unknown command")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.env")
+	if err := os.WriteFile(valid, []byte("API_PORT=9000\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	invalid := filepath.Join(dir, "invalid.env")
+	if err := os.WriteFile(invalid, []byte("API_PORT=0\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"config", "validate", "--config", valid}, &out); err != nil {
+		t.Errorf("Expected valid configuration, got %v", err)
+	}
+	if !strings.Contains(out.String(), "Configuration is valid") {
+		t.Errorf("Expected confirmation, got %q", out.String())
+	}
+	if err := runCommand([]string{"config", "validate", "--config", invalid}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an invalid configuration")
+	}
+}
+
+func TestConfigPrint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.env")
+	if err := os.WriteFile(path, []byte("API_PORT=9000\nCLOUDFLARE_API_TOKEN=token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"config", "print", "--config", path, "--log-level", "debug"}, &out); err != nil {
+		t.Fatalf("Expected configuration, got %v", err)
+	}
+	for _, expected := range []string{
+		`API_PORT: "9000" # file`,
+		`LOG_LEVEL: "debug" # flag`,
+		`CLOUDFLARE_API_TOKEN: "<redacted>" # file`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output containing %q, got %q", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "token\"") {
+		t.Error("Expected secret to be redacted")
+	}
+
+	out.Reset()
+	if err := runCommand([]string{"config", "print", "--config", path, "--output", "json"}, &out); err != nil {
+		t.Fatalf("Expected configuration, got %v", err)
+	}
+	var values map[string]string
+	if err := json.Unmarshal(out.Bytes(), &values); err != nil {
+		t.Fatalf("Expected JSON output, got %q: %v", out.String(), err)
+	}
+	if values["API_PORT"] != "9000" || values["CLOUDFLARE_API_TOKEN"] != config.Redacted {
+		t.Errorf("Unexpected values %v", values)
+	}
+
+	if err := runCommand([]string{"config", "print", "--config", path, "--log-level", "loud"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an invalid log level")
+	}
+}
+
+func TestSecretsGenerateKey(t *testing.T) {
+	var out bytes.Buffer
+	if err := runCommand([]string{"secrets", "generate-key", "--id", "k1"}, &out); err != nil {
+		t.Fatalf("Expected a key, got %v", err)
+	}
+	if _, err := secrets.ParseKeyring(out.String()); err != nil || !strings.HasPrefix(out.String(), "k1:") {
+		t.Errorf("Expected a SECRETS_KEYS entry, got %q (%v)", out.String(), err)
+	}
+	if err := runCommand([]string{"secrets", "generate-key", "--id", "a:b"}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an invalid key ID")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnelclient"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+)
+
+// runClient runs the client end of a tunnel until interrupted
+func runClient(args []string, stdout io.Writer) error {
+	flags := newFlagSet("client", stdout)
+	opts := addClientFlags(flags)
+	var cfg tunnelclient.Config
+	flags.StringVar(&cfg.TunnelID, "id", "", "tunnel ID (required)")
+	flags.StringVar(&cfg.Hostname, "hostname", "", "public hostname of the tunnel; the agent generates one if empty")
+	flags.IntVar(&cfg.LocalPort, "local-port", 0, "port of the local service to expose (required)")
+	flags.StringVar(&cfg.LocalHost, "local-host", "127.0.0.1", "host of the local service, for the websocket transport")
+	flags.StringVar(&cfg.Transport, "transport", tunnelclient.TransportWireGuard, "tunnel transport (wireguard, websocket)")
+	flags.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", 30*time.Second, "how often to send heartbeats")
+	flags.StringVar(&cfg.WireGuardInterface, "wg-interface", "etl0", "name of the local WireGuard interface")
+	flags.StringVar(&cfg.WireGuardEndpoint, "wg-endpoint", "", "host[:port] of the agent's WireGuard listener (default the API host)")
+	flags.BoolVar(&cfg.KeepTunnel, "keep", false, "leave the tunnel on the agent on exit")
+	logLevel := flags.String("log-level", "info", "log level (debug, info, warn, error)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cfg.Version = version
+
+	api, err := opts.client()
+	if err != nil {
+		return err
+	}
+	if cfg.TLSConfig, err = opts.tlsConfig(); err != nil {
+		return err
+	}
+	c, err := tunnelclient.New(api, opts.apiURL, cfg)
+	if err != nil {
+		return fmt.Errorf("invalid client configuration: %v", err)
+	}
+
+	utils.InitLogger(*logLevel)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return c.Run(ctx)
+}
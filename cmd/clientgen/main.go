@@ -0,0 +1,307 @@
+// Command clientgen generates the typed Go API client in pkg/client from the
+// agent's OpenAPI document.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+)
+
+// wordCase spells words of JSON names in Go names, e.g. initialisms in upper case
+var wordCase = map[string]string{
+	"id": "ID", "ip": "IP", "url": "URL", "ha": "HA", "ttl": "TTL", "sha256": "SHA256", "api": "API",
+	"wireguard": "WireGuard", "websocket": "WebSocket", "qr": "QR", "ipv6": "IPv6", "ssh": "SSH",
+}
+
+func main() {
+	specPath := flag.String("spec", "", "OpenAPI document to generate from (default: the agent's built-in document)")
+	output := flag.String("o", "client_gen.go", "output file")
+	flag.Parse()
+
+	doc := api.OpenAPISpec("")
+	if *specPath != "" {
+		data, err := os.ReadFile(*specPath)
+		if err != nil {
+			fatal(err)
+		}
+		doc = &api.OpenAPIDocument{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			fatal(fmt.Errorf("failed to parse %s: %v", *specPath, err))
+		}
+	}
+
+	src, err := generate(doc)
+	if err != nil {
+		fatal(err)
+	}
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "clientgen:", err)
+	os.Exit(1)
+}
+
+type generator struct {
+	buf bytes.Buffer
+	doc *api.OpenAPIDocument
+
+	// imports used by the generated code besides context, net/http and net/url
+	time    bool
+	strconv bool
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// generate renders the client source for doc
+func generate(doc *api.OpenAPIDocument) ([]byte, error) {
+	g := &generator{doc: doc}
+
+	var body generator
+	body.doc = doc
+	body.writeTypes()
+	body.writeOperations()
+
+	g.printf("// Code generated by clientgen from the agent's OpenAPI document. DO NOT EDIT.\n\n")
+	g.printf("package client\n\n")
+	g.printf("import (\n\t\"context\"\n\t\"net/http\"\n\t\"net/url\"\n")
+	if body.strconv {
+		g.printf("\t\"strconv\"\n")
+	}
+	if body.time {
+		g.printf("\t\"time\"\n")
+	}
+	g.printf(")\n\n")
+	g.buf.Write(body.buf.Bytes())
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid Go: %v\n%s", err, g.buf.String())
+	}
+	return src, nil
+}
+
+func (g *generator) writeTypes() {
+	names := make([]string, 0, len(g.doc.Components.Schemas))
+	for name := range g.doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		schema := g.doc.Components.Schemas[name]
+		required := make(map[string]bool)
+		for _, r := range schema.Required {
+			required[r] = true
+		}
+
+		g.printf("// %s is the %s schema of the API\n", name, name)
+		g.printf("type %s struct {\n", name)
+		for _, prop := range sortedKeys(schema.Properties) {
+			tag := prop
+			if !required[prop] {
+				tag += ",omitempty"
+			}
+			g.printf("\t%s %s `json:\"%s\"`\n", goName(prop), g.goType(schema.Properties[prop], required[prop]), tag)
+		}
+		g.printf("}\n\n")
+	}
+}
+
+// goType returns the Go type of a schema; optional objects are pointers
+func (g *generator) goType(schema *api.Schema, required bool) string {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		if required {
+			return name
+		}
+		return "*" + name
+	}
+
+	switch schema.Type {
+	case "string":
+		if schema.Format == "date-time" {
+			g.time = true
+			if required {
+				return "time.Time"
+			}
+			return "*time.Time"
+		}
+		return "string"
+	case "boolean":
+		return "bool"
+	case "integer":
+		if schema.Format == "int64" {
+			return "int64"
+		}
+		return "int"
+	case "number":
+		return "float64"
+	case "array":
+		return "[]" + g.goType(schema.Items, true)
+	case "object":
+		if schema.AdditionalProperties != nil {
+			return "map[string]" + g.goType(schema.AdditionalProperties, true)
+		}
+	}
+	return "interface{}"
+}
+
+type operation struct {
+	method string
+	path   string
+	*api.Operation
+}
+
+func (g *generator) writeOperations() {
+	var ops []operation
+	for path, methods := range g.doc.Paths {
+		for method, op := range methods {
+			ops = append(ops, operation{method: strings.ToUpper(method), path: path, Operation: op})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].OperationID < ops[j].OperationID })
+
+	for _, op := range ops {
+		g.writeOperation(op)
+	}
+}
+
+func (g *generator) writeOperation(op operation) {
+	name := strings.ToUpper(op.OperationID[:1]) + op.OperationID[1:]
+
+	var pathParams, otherParams []api.Parameter
+	for _, p := range op.Parameters {
+		if p.In == "path" {
+			pathParams = append(pathParams, p)
+		} else {
+			otherParams = append(otherParams, p)
+		}
+	}
+
+	if len(otherParams) > 0 {
+		g.printf("// %sParams are the optional parameters of %s\n", name, name)
+		g.printf("type %sParams struct {\n", name)
+		for _, p := range otherParams {
+			g.printf("\t%s %s\n", goName(p.Name), g.goType(p.Schema, true))
+		}
+		g.printf("}\n\n")
+	}
+
+	// Signature
+	args := []string{"ctx context.Context"}
+	for _, p := range pathParams {
+		args = append(args, lowerFirst(goName(p.Name))+" string")
+	}
+	if len(otherParams) > 0 {
+		args = append(args, fmt.Sprintf("params *%sParams", name))
+	}
+	if op.RequestBody != nil {
+		args = append(args, "body *"+g.goType(op.RequestBody.Content["application/json"].Schema, true))
+	}
+	resultType := g.goType(successSchema(op.Operation), true)
+
+	summary := op.Summary
+	if summary == "" {
+		summary = op.method + " " + op.path
+	}
+	g.printf("// %s calls %s %s: %s\n", name, op.method, op.path, lowerFirst(summary))
+	if op.Deprecated {
+		g.printf("//\n// Deprecated: the endpoint is deprecated.\n")
+	}
+	g.printf("func (c *Client) %s(%s) (*%s, error) {\n", name, strings.Join(args, ", "), resultType)
+
+	// Path
+	path := fmt.Sprintf("%q", op.path)
+	for _, p := range pathParams {
+		path = strings.Replace(path, "{"+p.Name+"}", `" + url.PathEscape(`+lowerFirst(goName(p.Name))+`) + "`, 1)
+	}
+	path = strings.TrimSuffix(strings.TrimPrefix(path, `"" + `), ` + ""`)
+	g.printf("\tpath := %s\n", path)
+
+	// Query and header parameters
+	g.printf("\tquery := url.Values{}\n\theader := http.Header{}\n")
+	if len(otherParams) > 0 {
+		g.printf("\tif params != nil {\n")
+		for _, p := range otherParams {
+			field := "params." + goName(p.Name)
+			target := "query.Set"
+			if p.In == "header" {
+				target = "header.Set"
+			}
+			switch g.goType(p.Schema, true) {
+			case "int":
+				g.strconv = true
+				g.printf("\t\tif %s != 0 {\n\t\t\t%s(%q, strconv.Itoa(%s))\n\t\t}\n", field, target, p.Name, field)
+			case "bool":
+				g.printf("\t\tif %s {\n\t\t\t%s(%q, \"true\")\n\t\t}\n", field, target, p.Name)
+			case "time.Time":
+				g.printf("\t\tif !%s.IsZero() {\n\t\t\t%s(%q, %s.Format(time.RFC3339))\n\t\t}\n", field, target, p.Name, field)
+			default:
+				g.printf("\t\tif %s != \"\" {\n\t\t\t%s(%q, %s)\n\t\t}\n", field, target, p.Name, field)
+			}
+		}
+		g.printf("\t}\n")
+	}
+
+	in := "nil"
+	if op.RequestBody != nil {
+		in = "body"
+	}
+	g.printf("\tvar out %s\n", resultType)
+	g.printf("\tif err := c.do(ctx, %q, path, query, header, %s, &out); err != nil {\n\t\treturn nil, err\n\t}\n", op.method, in)
+	g.printf("\treturn &out, nil\n}\n\n")
+}
+
+// successSchema returns the schema of the operation's 2xx response
+func successSchema(op *api.Operation) *api.Schema {
+	for _, status := range sortedKeys(op.Responses) {
+		if strings.HasPrefix(status, "2") {
+			if content := op.Responses[status].Content["application/json"]; content != nil {
+				return content.Schema
+			}
+		}
+	}
+	return &api.Schema{}
+}
+
+// goName converts a snake_case name to an exported Go name
+func goName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' }) {
+		if word, ok := wordCase[strings.ToLower(part)]; ok {
+			b.WriteString(word)
+		} else {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+func lowerFirst(s string) string {
+	if strings.HasPrefix(s, "ID") {
+		return "id" + s[2:]
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+)
+
+// TestGeneratedClientUpToDate fails if the API changed without regenerating pkg/client
+func TestGeneratedClientUpToDate(t *testing.T) {
+	src, err := generate(api.OpenAPISpec(""))
+	if err != nil {
+		t.Fatalf("Failed to generate client: %v", err)
+	}
+	current, err := os.ReadFile("../../pkg/client/client_gen.go")
+	if err != nil {
+		t.Fatalf("Failed to read generated client: %v", err)
+	}
+	if !bytes.Equal(src, current) {
+		t.Error("pkg/client/client_gen.go is out of date; run go generate ./pkg/client")
+	}
+}
+
+func TestGoName(t *testing.T) {
+	tests := map[string]string{
+		"tunnel_id":            "TunnelID",
+		"wireguard_public_key": "WireGuardPublicKey",
+		"Idempotency-Key":      "IdempotencyKey",
+		"payload_sha256":       "PayloadSHA256",
+	}
+	for name, expected := range tests {
+		if got := goName(name); got != expected {
+			t.Errorf("goName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
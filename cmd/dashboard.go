@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+)
+
+// clearScreen moves the cursor home and clears the terminal
+const clearScreen = "\033[H\033[2J"
+
+// dashboard polls an agent and renders what it reports
+type dashboard struct {
+	client *client.Client
+
+	// Request counters of the previous poll, to compute rates
+	lastPoll     time.Time
+	lastRequests map[string]int64
+	lastTotal    int64
+}
+
+// dashboardTunnel is one row of the tunnel table
+type dashboardTunnel struct {
+	summary client.TunnelSummary
+	stats   *client.TunnelStatsResponse
+	rate    float64
+	hasRate bool
+}
+
+// dashboardFrame is everything one poll gathered
+type dashboardFrame struct {
+	time        time.Time
+	status      *client.StatusResponse
+	totalRate   float64
+	hasRate     bool
+	tunnels     []dashboardTunnel
+	routes      []client.Route
+	routesError error
+}
+
+func runDashboard(args []string, stdout io.Writer) error {
+	flags := newFlagSet("dashboard", stdout)
+	opts := addClientFlags(flags)
+	interval := flags.Duration("interval", 2*time.Second, "how often to poll the agent")
+	once := flags.Bool("once", false, "print one frame and exit instead of redrawing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	d := &dashboard{client: c, lastRequests: make(map[string]int64)}
+
+	if *once {
+		frame, err := d.poll(context.Background())
+		if err != nil {
+			return err
+		}
+		return frame.render(stdout)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		fmt.Fprint(stdout, clearScreen)
+		frame, err := d.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Keep polling; the agent may be restarting
+			fmt.Fprintf(stdout, "%s  failed to poll %s: %v\n", time.Now().Format(time.TimeOnly), opts.apiURL, err)
+		} else if err := frame.render(stdout); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll gathers a frame from the agent. The routing table needs the admin
+// scope, so failing to read it does not fail the frame.
+func (d *dashboard) poll(ctx context.Context) (*dashboardFrame, error) {
+	frame := &dashboardFrame{time: time.Now()}
+
+	status, err := d.client.GetStatus(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	frame.status = status
+
+	tunnels, err := d.client.ListTunnels(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := frame.time.Sub(d.lastPoll).Seconds()
+	requests := make(map[string]int64)
+	for _, summary := range tunnels.Tunnels {
+		row := dashboardTunnel{summary: summary}
+		stats, err := d.client.GetTunnelStats(ctx, summary.TunnelID)
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			// Removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		row.stats = stats
+		requests[summary.TunnelID] = stats.Requests
+		if last, ok := d.lastRequests[summary.TunnelID]; ok && elapsed > 0 {
+			row.rate = float64(stats.Requests-last) / elapsed
+			row.hasRate = true
+		}
+		frame.tunnels = append(frame.tunnels, row)
+	}
+	if !d.lastPoll.IsZero() && elapsed > 0 {
+		frame.totalRate = float64(status.Traffic.Requests-d.lastTotal) / elapsed
+		frame.hasRate = true
+	}
+	d.lastPoll = frame.time
+	d.lastRequests = requests
+	d.lastTotal = status.Traffic.Requests
+
+	routes, err := d.client.ListRoutes(ctx)
+	if err != nil {
+		frame.routesError = err
+	} else {
+		frame.routes = routes.Routes
+	}
+	return frame, nil
+}
+
+func (f *dashboardFrame) render(w io.Writer) error {
+	status := f.status
+	fmt.Fprintf(w, "easy-tunnel-lb-agent %s  %s  up %s  %s\n\n", status.Version, strings.ToUpper(status.Status),
+		status.Uptime, f.time.Format(time.TimeOnly))
+
+	fmt.Fprintf(w, "Tunnels %d (%d degraded, %d stale handshakes)  Connections %d  Requests %d (%s)\n",
+		status.NumTunnels, status.NumDegraded, status.NumStaleHandshakes,
+		status.Traffic.ActiveConnections, status.Traffic.Requests, formatRate(f.totalRate, f.hasRate))
+	for _, component := range status.Components {
+		line := component.Status
+		if component.Error != "" {
+			line += ": " + component.Error
+		}
+		fmt.Fprintf(w, "  %-14s %s\n", component.Name, line)
+	}
+
+	fmt.Fprintln(w)
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TUNNEL\tHOSTNAME\tSTATUS\tREQ/S\tCONNS\tIN\tOUT\tHANDSHAKE")
+	for _, t := range f.tunnels {
+		status := t.stats.Status
+		if t.summary.Maintenance {
+			status = "maintenance"
+		}
+		if t.summary.Paused {
+			status = "paused"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", t.summary.TunnelID,
+			strings.Join(tunnelHostnames(t.summary), ","), status, formatRate(t.rate, t.hasRate),
+			t.stats.ActiveConnections, formatBytes(t.stats.BytesReceived), formatBytes(t.stats.BytesSent),
+			formatHandshake(t.stats, f.time))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	if f.routesError != nil {
+		fmt.Fprintf(w, "Routes unavailable: %v\n", f.routesError)
+		return nil
+	}
+	table = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ROUTE\tPATH\tTUNNEL\tBACKEND")
+	for _, route := range f.routes {
+		match, path := routeColumns(route)
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s:%d\n", match, path, route.TunnelID, route.IP, route.Port)
+	}
+	return table.Flush()
+}
+
+// formatRate formats a per-second rate, or "-" before there are two polls
+func formatRate(rate float64, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return strconv.FormatFloat(rate, 'f', 1, 64) + "/s"
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatHandshake reports how long ago a WireGuard tunnel last completed a
+// handshake; other transports have none
+func formatHandshake(stats *client.TunnelStatsResponse, now time.Time) string {
+	if stats.LastHandshake == nil {
+		return "-"
+	}
+	age := now.Sub(*stats.LastHandshake).Round(time.Second).String() + " ago"
+	if stats.HandshakeStale {
+		age += " (stale)"
+	}
+	return age
+}
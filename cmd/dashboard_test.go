@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+)
+
+func TestDashboard(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	if _, err := tunnelManager.CreateTunnel("web", "web.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	handler := api.NewHandler(tunnelManager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"dashboard", "--once", "--api-url", server.URL}, &out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, expected := range []string{"Tunnels 1", "web.example.com", "Routes unavailable"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output containing %q, got %q", expected, out.String())
+		}
+	}
+
+	// Rates need two polls
+	d := &dashboard{client: client.New(server.URL, ""), lastRequests: make(map[string]int64)}
+	frame, err := d.poll(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to poll: %v", err)
+	}
+	if frame.hasRate || frame.tunnels[0].hasRate {
+		t.Error("Expected no rates after the first poll")
+	}
+	frame, err = d.poll(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to poll: %v", err)
+	}
+	if !frame.hasRate || !frame.tunnels[0].hasRate {
+		t.Error("Expected rates after the second poll")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes    int64
+		expected string
+	}{
+		{bytes: 0, expected: "0B"},
+		{bytes: 1023, expected: "1023B"},
+		{bytes: 1536, expected: "1.5KiB"},
+		{bytes: 5 * 1024 * 1024 * 1024, expected: "5.0GiB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatBytes(tt.bytes); got != tt.expected {
+			t.Errorf("Expected %s for %d bytes, got %s", tt.expected, tt.bytes, got)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadtest"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+)
+
+// runLoadTest creates synthetic tunnels to a built-in echo backend, drives
+// load through the agent's public listener and reports the latencies
+func runLoadTest(args []string, stdout io.Writer) error {
+	flags := newFlagSet("loadtest", stdout)
+	opts := addClientFlags(flags)
+	count := flags.Int("tunnels", 10, "number of synthetic tunnels")
+	prefix := flags.String("prefix", "loadtest", "prefix of the tunnel IDs")
+	domain := flags.String("domain", "loadtest.invalid", "domain of the tunnel hostnames")
+	readyTimeout := flags.Duration("ready-timeout", 30*time.Second, "how long to wait for the tunnels to serve traffic")
+	var load loadtest.Options
+	flags.StringVar(&load.PublicURL, "public-url", "", "URL of the agent's public HTTP listener (required)")
+	flags.StringVar(&load.Mode, "mode", loadtest.ModeHTTP, "load to send (http, tcp)")
+	flags.IntVar(&load.Concurrency, "concurrency", 50, "number of concurrent requests or connections")
+	flags.DurationVar(&load.Duration, "duration", 30*time.Second, "duration of the test")
+	flags.IntVar(&load.PayloadSize, "payload-size", 1024, "bytes sent per request or round trip")
+	logLevel := flags.String("log-level", "warn", "log level (debug, info, warn, error)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *count <= 0 {
+		return fmt.Errorf("--tunnels must be positive")
+	}
+	if load.PublicURL == "" {
+		return fmt.Errorf("--public-url is required")
+	}
+
+	api, err := opts.client()
+	if err != nil {
+		return err
+	}
+	if load.TLSConfig, err = opts.tlsConfig(); err != nil {
+		return err
+	}
+	// Hosts are only known once the tunnels exist
+	check := load
+	check.Hosts = []string{*domain}
+	if err := check.Validate(); err != nil {
+		return err
+	}
+
+	utils.InitLogger(*logLevel)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backend, err := loadtest.NewEchoBackend()
+	if err != nil {
+		return fmt.Errorf("failed to start echo backend: %v", err)
+	}
+	defer backend.Close()
+
+	tunnels, err := loadtest.StartTunnels(api, opts.apiURL, *count, *prefix, *domain, backend.Port(), load.TLSConfig)
+	if err != nil {
+		return err
+	}
+	defer tunnels.Close()
+	load.Hosts = tunnels.Hosts
+
+	readyCtx, cancel := context.WithTimeout(ctx, *readyTimeout)
+	defer cancel()
+	if err := loadtest.WaitReady(readyCtx, load); err != nil {
+		if tunnelErr := tunnels.Err(); tunnelErr != nil {
+			return fmt.Errorf("%v (%v)", err, tunnelErr)
+		}
+		return err
+	}
+
+	report, err := loadtest.Run(ctx, load)
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(stdout, report)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Mode:\t%s\n", report.Mode)
+	fmt.Fprintf(w, "Tunnels:\t%d\n", len(load.Hosts))
+	fmt.Fprintf(w, "Concurrency:\t%d\n", load.Concurrency)
+	fmt.Fprintf(w, "Duration:\t%s\n", report.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "Operations:\t%d (%.1f/s)\n", report.Operations, report.Throughput())
+	fmt.Fprintf(w, "Errors:\t%d\n", report.Errors)
+	fmt.Fprintf(w, "Latency p50:\t%s\n", report.P50)
+	fmt.Fprintf(w, "Latency p90:\t%s\n", report.P90)
+	fmt.Fprintf(w, "Latency p99:\t%s\n", report.P99)
+	fmt.Fprintf(w, "Latency max:\t%s\n", report.Max)
+	return w.Flush()
+}
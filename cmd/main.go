@@ -3,17 +3,40 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/cluster"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/config"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/debug"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/discovery"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/dns"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/docker"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/firewall"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/geoip"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/grpcapi"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ha"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/kubernetes"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ssh"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/systemd"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tracing"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ui"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/usage"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
 )
 
@@ -24,77 +47,763 @@ var (
 )
 
 func main() {
+	// Without a subcommand the agent serves, as before subcommands existed
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serve(args)
+		return
+	}
+	if args[0] == "serve" {
+		serve(args[1:])
+		return
+	}
+	if err := runCommand(args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the agent
+func serve(args []string) {
 	// Parse command line flags
-	configFile := flag.String("config", "", "path to config file (not implemented yet)")
-	logLevel := flag.String("log-level", "info", "log level (debug, info, warn, error)")
-	flag.Parse()
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to config file of KEY=VALUE lines (environment variables take precedence)")
+	logLevel := flags.String("log-level", "info", "log level (debug, info, warn, error)")
+	profile := flags.String("profile", "", "profile of the config file to load, e.g. dev or prod")
+	flags.Parse(args)
 
 	// Initialize logger
 	utils.InitLogger(*logLevel)
 	logger := utils.GetLogger()
 
-	// TODO: Implement config file loading
+	// Load configuration
+	var cfg *config.ServerConfig
+	var err error
 	if *configFile != "" {
-		logger.Warn().Str("config_file", *configFile).Msg("Config file loading not implemented yet, using environment variables")
+		cfg, err = config.LoadConfigProfile(*configFile, *profile)
+	} else if *profile != "" {
+		logger.Fatal().Msg("--profile requires --config")
+	} else {
+		cfg, err = config.LoadConfig()
 	}
-
-	// Load configuration
-	cfg, err := config.LoadConfig()
 	if err != nil {
 		logger.Fatal().Err(err).Msg("Failed to load configuration")
 	}
+	if *profile != "" {
+		logger.Info().Str("profile", *profile).Msg("Loaded configuration profile")
+	}
+
+	// Serve on the sockets systemd passed, if it socket-activated the agent
+	inherited, err := systemd.Listeners()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to inherit sockets from systemd")
+	}
+	for name := range inherited {
+		switch name {
+		case "api", "grpc", "http", "tcp":
+			logger.Info().Str("socket", name).Msg("Inherited socket from systemd")
+		default:
+			logger.Warn().Str("socket", name).Msg("Ignoring socket from systemd with unknown name")
+		}
+	}
+	if cfg.HAEnabled && (inherited["http"] != nil || inherited["tcp"] != nil) {
+		logger.Fatal().Msg("The public listeners cannot be socket-activated with HA_ENABLED")
+	}
+
+	// The configured log level applies unless --log-level was given explicitly
+	logLevelSet := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "log-level" {
+			logLevelSet = true
+		}
+	})
+	if !logLevelSet {
+		if err := utils.SetLevel(cfg.LogLevel); err != nil {
+			logger.Warn().Err(err).Str("log_level", cfg.LogLevel).Msg("Invalid log level, keeping default")
+		}
+	}
+	applyModuleLogLevels(cfg.ModuleLogLevels)
+	utils.SetExposePrivateKeys(cfg.ExposePrivateKeys)
+	if cfg.ExposePrivateKeys {
+		logger.Warn().Msg("Private keys are exposed in API responses and logs")
+	}
+
+	// Seal the secrets the agent stores with the configured keys
+	secretsBox, err := secrets.FromConfig(cfg.SecretsConfig())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load secrets keys")
+	}
+
+	// Background tasks run until shutdown
+	runCtx, stopRun := context.WithCancel(context.Background())
+	defer stopRun()
+
+	// Export traces of API requests, tunnel operations and proxied requests
+	if cfg.TracingOTLPEndpoint != "" {
+		shutdownTracing, err := tracing.Setup(runCtx, cfg.TracingOTLPEndpoint, cfg.TracingServiceName, cfg.TracingSampleRatio)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to set up tracing")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				logger.Warn().Err(err).Msg("Failed to flush traces")
+			}
+		}()
+	}
+
+	// Serve profiles and goroutine dumps to diagnose the running agent
+	var debugServer *http.Server
+	if cfg.DebugEnabled {
+		debugServer = debug.NewServer(cfg.DebugPort)
+		go func() {
+			logger.Info().
+				Str("address", debugServer.Addr).
+				Msg("Starting debug server")
+			if err := debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error().Err(err).Msg("Debug server failed")
+			}
+		}()
+	}
 
 	// Create tunnel manager
 	tunnelManager := tunnel.NewManager(cfg.MaxTunnels)
+	tunnelManager.SetBaseDomain(cfg.TunnelBaseDomain)
+	if cfg.WireGuardIPv6Prefix != "" {
+		if err := tunnelManager.SetWireGuardIPv6Prefix(cfg.WireGuardIPv6Prefix); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to set WireGuard IPv6 prefix")
+		}
+	}
+	wgInterfaces, _ := tunnel.ParseWireGuardInterfaces(cfg.WireGuardInterfaces)
+	for _, iface := range wgInterfaces {
+		if err := tunnelManager.AddWireGuardInterface(iface); err != nil {
+			logger.Fatal().Err(err).Str("interface", iface.Name).Msg("Failed to add WireGuard interface")
+		}
+	}
+	wireGuardStarted := true
+	if err := tunnelManager.StartWireGuard(cfg.WireGuardImplementation); err != nil {
+		logger.Warn().Err(err).Msg("WireGuard unavailable, only tunnels without WireGuard can be created")
+		wireGuardStarted = false
+	}
+	defer tunnelManager.StopWireGuard()
+	if err := tunnelManager.SetWireGuardDefaults(cfg.WireGuardKeepalive, cfg.WireGuardMTU); err != nil {
+		logger.Warn().Err(err).Msg("Failed to apply WireGuard interface settings")
+	}
+
+	// Install forwarding and NAT rules for WireGuard peers
+	fw, err := firewall.New(cfg.Firewall)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create firewall")
+	}
+	if fw != nil {
+		var fwInterfaces []firewall.Interface
+		for _, iface := range tunnelManager.WireGuardInterfaces() {
+			fwInterfaces = append(fwInterfaces, firewall.Interface{
+				Name: iface.Name,
+				Port: iface.Port,
+				IPv6: iface.Subnet6 != "",
+			})
+		}
+		if err := fw.Setup(fwInterfaces); err != nil {
+			logger.Fatal().Err(err).Str("backend", fw.Backend()).Msg("Failed to install firewall rules")
+		}
+		defer fw.Teardown()
+		tunnelManager.SetPeerFirewall(fw)
+	}
+
+	// Track tunnel liveness from client heartbeats
+	tunnelManager.StartLivenessMonitor(runCtx, cfg.HeartbeatTimeout)
+	tunnelManager.StartKeyRotation(runCtx, time.Minute)
+	tunnelManager.StartExpiryMonitor(runCtx)
+	tunnelManager.StartHandshakeMonitor(runCtx, cfg.WireGuardHandshakeTimeout, cfg.WireGuardDeadPeerTimeout)
+	tunnelManager.StartPathProber(runCtx, tunnel.NewICMPPinger(), cfg.WireGuardPathProbeInterval, cfg.WireGuardPathProbeTimeout)
+
+	// Limit the tunnels and traffic of each tenant
+	if cfg.TenantsFile != "" {
+		defaults, tenants, err := tunnel.LoadTenantLimits(cfg.TenantsFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load tenant limits")
+		}
+		tunnelManager.SetTenantLimits(defaults, tenants)
+		tunnelManager.StartBandwidthMonitor(runCtx)
+	}
+
+	// Let tunnel clients connect over WebSocket where UDP is blocked
+	var webSocket *tunnel.WebSocketTransport
+	if cfg.WebSocketEnabled {
+		webSocket = tunnel.NewWebSocketTransport()
+		if err := tunnelManager.AddTransport(webSocket); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to add WebSocket transport")
+		}
+	}
+
+	// Let tunnel clients expose services with SSH remote forwards
+	var sshTransport *tunnel.SSHTransport
+	var sshHostKey ed25519.PrivateKey
+	if cfg.SSHPort > 0 {
+		if cfg.SSHHostKeyPath != "" {
+			sshHostKey, err = ssh.LoadHostKey(cfg.SSHHostKeyPath, secretsBox)
+		} else {
+			logger.Warn().Msg("No SSH host key path configured, clients will see a new host key after every restart")
+			sshHostKey, err = ssh.GenerateHostKey()
+		}
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load SSH host key")
+		}
+		sshTransport = tunnel.NewSSHTransport(sshHostKey)
+		if err := tunnelManager.AddTransport(sshTransport); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to add SSH transport")
+		}
+		sshListener, err := net.Listen("tcp", net.JoinHostPort(cfg.PublicHost, strconv.Itoa(cfg.SSHPort)))
+		if err != nil {
+			logger.Fatal().Err(err).Int("port", cfg.SSHPort).Msg("Failed to listen for SSH tunnel clients")
+		}
+		defer sshListener.Close()
+		go func() {
+			if err := sshTransport.Serve(sshListener); err != nil {
+				logger.Error().Err(err).Msg("SSH server failed")
+			}
+		}()
+		logger.Info().
+			Int("port", cfg.SSHPort).
+			Str("host_key", ssh.HostKeyFingerprint(sshHostKey)).
+			Msg("Accepting SSH tunnel clients")
+	}
 
 	// Create router and load balancer
+	affinityMode, _ := loadbalancer.ParseAffinityMode(cfg.LBSessionAffinity)
+	listeners, _ := loadbalancer.ParseListeners(cfg.LBListeners)
+	tlsPolicy, _ := cfg.TLSPolicy()
+	var onDemand *loadbalancer.OnDemandTLS
+	if cfg.TLSOnDemand {
+		onDemand = &loadbalancer.OnDemandTLS{
+			Email:        cfg.TLSOnDemandEmail,
+			CacheDir:     cfg.TLSOnDemandCacheDir,
+			DirectoryURL: cfg.TLSOnDemandCAURL,
+		}
+	}
 	lbConfig := &loadbalancer.Config{
-		HTTPPort: cfg.PublicPort,
-		TCPPort:  cfg.PublicPort + 1,
+		Host:        cfg.PublicHost,
+		HTTPPort:    cfg.PublicPort,
+		TCPPort:     cfg.PublicPort + 1,
+		ReusePort:   cfg.LBReusePort,
+		AcceptLoops: cfg.LBAcceptLoops,
+		Listeners:   listeners,
 		TLSConfig: &loadbalancer.TLSConfig{
 			CertFile: cfg.TLSCertPath,
 			KeyFile:  cfg.TLSKeyPath,
+			HTTP3:    cfg.TLSHTTP3,
+			Policy:   tlsPolicy,
+			OnDemand: onDemand,
+		},
+		Affinity: loadbalancer.Affinity{
+			Mode:       affinityMode,
+			CookieName: cfg.LBAffinityCookie,
+			CookieTTL:  cfg.LBAffinityCookieTTL,
+		},
+		Retry: loadbalancer.RetryPolicy{
+			Attempts: cfg.LBRetryAttempts,
+			Backoff:  cfg.LBRetryBackoff,
+		},
+		CircuitBreaker: loadbalancer.CircuitBreakerPolicy{
+			Failures: cfg.LBCircuitBreakerFailures,
+			Cooldown: cfg.LBCircuitBreakerCooldown,
+		},
+		Timeouts: loadbalancer.Timeouts{
+			Dial:           cfg.LBDialTimeout,
+			ResponseHeader: cfg.LBResponseHeaderTimeout,
+			MaxRequest:     cfg.LBMaxRequestDuration,
+			ReadHeader:     cfg.LBReadHeaderTimeout,
+			Read:           cfg.LBReadTimeout,
+			Write:          cfg.LBWriteTimeout,
+			Idle:           cfg.LBIdleTimeout,
+		},
+		Transport: loadbalancer.TransportConfig{
+			MaxIdleConnsPerTarget: cfg.LBBackendMaxIdleConns,
+			IdleConnTimeout:       cfg.LBBackendIdleConnTimeout,
+			DisableKeepAlives:     !cfg.LBBackendKeepAlives,
+			CAFile:                cfg.LBBackendCAPath,
+		},
+		TCP: loadbalancer.TCPConfig{
+			KeepAlive:   cfg.LBTCPKeepAlive,
+			IdleTimeout: cfg.LBTCPIdleTimeout,
+		},
+		ErrorPagesDir: cfg.LBErrorPagesDir,
+		DefaultTunnel: cfg.LBDefaultTunnel,
+		Compression: loadbalancer.Compression{
+			Enabled: cfg.LBCompression,
+			MinSize: cfg.LBCompressionMinSize,
+		},
+		FlushInterval: cfg.LBFlushInterval,
+		Cache: loadbalancer.Cache{
+			Enabled:        cfg.LBCache,
+			MaxBytes:       cfg.LBCacheMaxBytes,
+			MaxObjectBytes: cfg.LBCacheMaxObjectBytes,
+			MaxTTL:         cfg.LBCacheMaxTTL,
+			Dir:            cfg.LBCacheDir,
+		},
+		EdgeAuthSecret: cfg.LBEdgeAuthSecret,
+		Limits: loadbalancer.Limits{
+			MaxRequestBody: cfg.LBMaxRequestBodyBytes,
+			MaxHeaderBytes: cfg.LBMaxHeaderBytes,
+		},
+		ClientLimits: loadbalancer.ClientLimits{
+			RequestsPerSecond: cfg.LBClientRequestsPerSecond,
+			Burst:             cfg.LBClientBurst,
+			MaxConnections:    cfg.LBClientMaxConnections,
 		},
 	}
 
 	router := loadbalancer.NewRouter(lbConfig)
-	lb := loadbalancer.NewLoadBalancer(router, lbConfig)
+	if cfg.LBRoutesFile != "" {
+		router.SetRoutesFile(cfg.LBRoutesFile)
+		n, err := router.LoadRoutes()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load routes")
+		}
+		logger.Info().Str("path", cfg.LBRoutesFile).Int("routes", n).Msg("Loaded routes")
+		if n > 0 && cfg.LBRestoredRoutesGrace > 0 {
+			router.ExpireRestoredRoutes(runCtx, cfg.LBRestoredRoutesGrace)
+		}
+	}
+	lb := loadbalancer.NewLoadBalancer(router, lbConfig, tunnelManager.Stats())
+	lb.SetDialer(tunnelManager.DialTunnel)
+	lb.SetListeners(inherited["http"], inherited["tcp"])
+	if cfg.GeoIPDatabasePath != "" {
+		db, err := geoip.Open(cfg.GeoIPDatabasePath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open GeoIP database")
+		}
+		lb.SetCountryLookup(db.Country)
+		logger.Info().Str("path", cfg.GeoIPDatabasePath).Str("type", db.Type).Msg("Loaded GeoIP database")
+	}
+	tunnelManager.SetOptionsFunc(func(tunnelID string, options *tunnel.TrafficOptions) {
+		if options == nil {
+			lb.SetTunnelOptions(tunnelID, nil)
+			return
+		}
+		lb.SetTunnelOptions(tunnelID, tunnelOptions(options))
+	})
+	tunnelManager.SetRouter(router)
+	tunnelManager.StartReconciler(runCtx, cfg.ReconcileInterval)
+
+	// Reload settings that are safe to change at runtime on SIGHUP or config file change
+	var clusterNode *cluster.Node
+	watcher := config.NewWatcher(*configFile, cfg, func(old, updated *config.ServerConfig, changes config.Changes) {
+		if updated.LogLevel != old.LogLevel {
+			if err := utils.SetLevel(updated.LogLevel); err != nil {
+				logger.Error().Err(err).Str("log_level", updated.LogLevel).Msg("Invalid log level")
+			}
+		}
+		if updated.ModuleLogLevels != old.ModuleLogLevels {
+			applyModuleLogLevels(updated.ModuleLogLevels)
+		}
+		tunnelManager.SetMaxTunnels(updated.MaxTunnels)
+		tunnelManager.SetHeartbeatTimeout(updated.HeartbeatTimeout)
+		if updated.TLSCertPath != old.TLSCertPath || updated.TLSKeyPath != old.TLSKeyPath {
+			if err := lb.ReloadTLSCertificate(updated.TLSCertPath, updated.TLSKeyPath); err != nil {
+				logger.Error().Err(err).Msg("Failed to apply new TLS certificate")
+			}
+		}
+		if updated.ClusterSecret != old.ClusterSecret && clusterNode != nil {
+			clusterNode.SetSecret(updated.ClusterSecret)
+		}
+		if updated.SecretsKMSToken != old.SecretsKMSToken {
+			secretsBox.SetKMSToken(updated.SecretsKMSToken)
+		}
+	})
+	watcher.SetProfile(*profile)
+	watcher.Start(runCtx)
+
+	// Kubernetes client for operator mode and the Lease HA lock
+	var kubeClient *kubernetes.Client
+	if cfg.KubernetesEnabled || (cfg.HAEnabled && cfg.HALock == config.HALockKubernetes) {
+		kubeClient, err = kubernetes.NewInClusterClient()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create Kubernetes client")
+		}
+	}
+
+	// Docker client for Docker mode
+	var dockerClient *docker.Client
+	if cfg.DockerEnabled {
+		dockerClient, err = docker.NewClient(cfg.DockerHost)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create Docker client")
+		}
+	}
+
+	// Point tunnel hostnames at this agent in DNS
+	var dnsManager *dns.Manager
+	if cfg.DNSProvider != "" {
+		provider, err := dns.NewProvider(dns.ProviderConfig{
+			Provider:            cfg.DNSProvider,
+			Zone:                cfg.DNSZone,
+			CloudflareAPIToken:  cfg.CloudflareAPIToken,
+			DigitalOceanToken:   cfg.DigitalOceanToken,
+			AWSAccessKeyID:      cfg.AWSAccessKeyID,
+			AWSSecretAccessKey:  cfg.AWSSecretAccessKey,
+			AWSSessionToken:     cfg.AWSSessionToken,
+			Route53HostedZoneID: cfg.Route53HostedZoneID,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create DNS provider")
+		}
+		dnsManager = dns.NewManager(provider, tunnelManager, cfg.DNSTarget, cfg.DNSZone, cfg.DNSTTL)
+	}
+
+	// Register the tunnels' public endpoints for service discovery
+	var discoveryManager *discovery.Manager
+	if cfg.DiscoveryBackend != "" {
+		registry, err := discovery.NewRegistry(discovery.RegistryConfig{
+			Backend:      cfg.DiscoveryBackend,
+			URL:          cfg.DiscoveryURL,
+			TTL:          cfg.DiscoveryTTL,
+			ConsulToken:  cfg.DiscoveryConsulToken,
+			EtcdPrefix:   cfg.DiscoveryEtcdPrefix,
+			EtcdUsername: cfg.DiscoveryEtcdUsername,
+			EtcdPassword: cfg.DiscoveryEtcdPassword,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create service registry")
+		}
+		discoveryManager = discovery.NewManager(registry, tunnelManager, cfg.PublicPort, cfg.DiscoveryTTL)
+	}
+
+	// Controllers change tunnels and external state, so only the leader runs them
+	startControllers := func(ctx context.Context) {
+		// Manage tunnels for annotated Kubernetes LoadBalancer Services and Gateway API routes
+		if cfg.KubernetesEnabled {
+			controller := kubernetes.NewController(kubeClient, tunnelManager, cfg.KubernetesNamespace)
+			go controller.Run(ctx)
+
+			// Register tunnels and routes for Gateway API routes
+			if cfg.KubernetesGatewayClass != "" {
+				gatewayController := kubernetes.NewGatewayController(kubeClient, tunnelManager, router, cfg.KubernetesNamespace, cfg.KubernetesGatewayClass)
+				go gatewayController.Run(ctx)
+			}
+		}
+
+		// Manage tunnels for labeled Docker containers
+		if dockerClient != nil {
+			dockerController := docker.NewController(dockerClient, tunnelManager, router)
+			go dockerController.Run(ctx)
+		}
+
+		if dnsManager != nil {
+			go dnsManager.Run(ctx)
+		}
+
+		if discoveryManager != nil {
+			go discoveryManager.Run(ctx)
+		}
+	}
 
 	// Create API handler
 	apiHandler := api.NewHandler(tunnelManager, version)
 	apiMux := http.NewServeMux()
 	apiHandler.RegisterRoutes(apiMux)
+	if cfg.APIUIEnabled {
+		ui.RegisterRoutes(apiMux)
+	}
+	apiHandler.SetConnectionTable(lb)
+	apiHandler.SetResponseCache(lb)
+	apiHandler.SetRouteTable(router)
+	if webSocket != nil {
+		apiHandler.SetWebSocketTransport(webSocket)
+	}
+	if sshTransport != nil {
+		apiHandler.SetSSHServer(cfg.SSHPort, ssh.HostKeyFingerprint(sshHostKey))
+	}
+
+	// Replicate tunnels between the nodes of a cluster
+	if cfg.ClusterEnabled {
+		clusterNode = cluster.NewNode(cfg.ClusterNodeName, cfg.ClusterAdvertiseURL, cfg.ClusterPeers, cfg.ClusterSecret, cfg.ClusterGossipInterval, tunnelManager)
+		clusterNode.RegisterRoutes(apiMux)
+		go clusterNode.Run(runCtx)
+	}
 
 	// Create API server
 	apiServer := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", cfg.APIHost, cfg.APIPort),
+		Addr:    net.JoinHostPort(cfg.APIHost, strconv.Itoa(cfg.APIPort)),
 		Handler: apiMux,
 	}
+	apiServer.RegisterOnShutdown(apiHandler.CloseEventStreams)
 
-	// Start the load balancer
-	if err := lb.Start(); err != nil {
-		logger.Fatal().Err(err).Msg("Failed to start load balancer")
+	// Serve the API over TLS, optionally authenticating clients by certificate
+	if cfg.APITLSCertPath != "" {
+		apiServer.TLSConfig, err = api.NewServerTLSConfig(cfg.APIClientCAPath, cfg.APIRequireClientCert)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to configure API TLS")
+		}
+	}
+	if cfg.APIClientCertPolicy != "" {
+		policy, err := api.ParseClientCertPolicy(cfg.APIClientCertPolicy)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Invalid client certificate policy")
+		}
+		apiHandler.SetClientCertPolicy(policy)
+	}
+	var ipLimiter, callerLimiter *api.RateLimiter
+	if cfg.APIRateLimitPerIP > 0 {
+		ipLimiter = api.NewRateLimiter(cfg.APIRateLimitPerIP, cfg.APIRateLimitBurst)
+	}
+	if cfg.APIRateLimitPerCaller > 0 {
+		callerLimiter = api.NewRateLimiter(cfg.APIRateLimitPerCaller, cfg.APIRateLimitBurst)
+	}
+	apiHandler.SetRateLimits(ipLimiter, callerLimiter)
+	if len(cfg.APICORSAllowedOrigins) > 0 {
+		cors, err := api.NewCORS(cfg.CORSConfig())
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Invalid API CORS configuration")
+		}
+		apiServer.Handler = cors.Wrap(apiMux)
+	}
+	apiHandler.SetPolicyLimits(api.PolicyLimits{
+		MaxTimeout:                 cfg.TunnelPolicyMaxTimeout,
+		MaxRequestBody:             cfg.TunnelPolicyMaxRequestBodyBytes,
+		MaxClientRequestsPerSecond: cfg.TunnelPolicyMaxClientRequestsPerSecond,
+		MaxClientConnections:       cfg.TunnelPolicyMaxClientConnections,
+		MaxRetryAttempts:           cfg.TunnelPolicyMaxRetryAttempts,
+	})
+	apiHandler.SetWireGuardEndpoint(cfg.WireGuardEndpoint)
+	apiHandler.SetPublicPorts(api.PublicPorts{
+		HTTPPort: cfg.PublicPort,
+		TLS:      (cfg.TLSCertPath != "" && cfg.TLSKeyPath != "") || cfg.TLSOnDemand,
+	})
+	if dnsManager != nil {
+		apiHandler.SetDNSRecords(dnsManager)
+	}
+	apiHandler.SetExposePrivateKeys(cfg.ExposePrivateKeys)
+	apiHandler.SetSecretsBox(secretsBox)
+	if cfg.APITokensFile != "" {
+		tokens, err := api.LoadTokenStore(cfg.APITokensFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load API tokens")
+		}
+		apiHandler.AddAuthenticator(tokens)
+		tokens.Watch(runCtx, 5*time.Second)
+	}
+	if cfg.APIJWTIssuer != "" {
+		apiHandler.AddAuthenticator(api.NewJWTAuthenticator(cfg.APIJWTIssuer, cfg.APIJWTAudience, cfg.APIJWTJWKSURL, cfg.APIJWTHostnamesClaim))
+	}
+
+	// Create gRPC server
+	grpcServer := grpcapi.NewServer(tunnelManager, apiHandler)
+	grpcServer.SetExposePrivateKeys(cfg.ExposePrivateKeys)
+
+	// Record control-plane actions
+	if cfg.AuditLogPath != "" {
+		auditLog, err := audit.Open(cfg.AuditLogPath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open audit log")
+		}
+		defer auditLog.Close()
+		apiHandler.SetAuditLog(auditLog)
+		grpcServer.SetAuditLog(auditLog)
+	}
+
+	// Account the traffic of tunnels for billing
+	if cfg.UsageFile != "" {
+		accountant, err := usage.Open(cfg.UsageFile, cfg.UsageBucket, func() []usage.Sample {
+			var samples []usage.Sample
+			for _, t := range tunnelManager.GetAllTunnels() {
+				snap := tunnelManager.Stats().Get(t.ID)
+				samples = append(samples, usage.Sample{
+					TunnelID:      t.ID,
+					Tenant:        t.Tenant,
+					BytesSent:     snap.BytesSent,
+					BytesReceived: snap.BytesReceived,
+					Requests:      snap.Requests,
+				})
+			}
+			return samples
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open usage file")
+		}
+		defer accountant.Close()
+		accountant.SetWebhook(cfg.UsageWebhookURL)
+		go accountant.Run(runCtx)
+		apiHandler.SetUsageAccountant(accountant)
+	}
+
+	// Start the load balancer, or leave it to whichever agent wins the election
+	var electionDone chan struct{}
+	isStandby := func() bool { return false }
+	if cfg.HAEnabled {
+		var lock ha.Lock = ha.NewFileLock(cfg.HALockPath)
+		if cfg.HALock == config.HALockKubernetes {
+			lock = kubernetes.NewLeaseLock(kubeClient, cfg.HALeaseNamespace, cfg.HALeaseName)
+		}
+		elector := ha.NewElector(lock, cfg.HAIdentity, cfg.HAAdvertiseURL, cfg.HALeaseDuration)
+		leaderCheck := func() (bool, string) {
+			return elector.IsLeader(), elector.Leader().Address
+		}
+		apiHandler.SetLeaderCheck(leaderCheck)
+		isStandby = func() bool { return !elector.IsLeader() }
+		grpcServer.SetLeaderCheck(leaderCheck)
+
+		// Standbys keep a copy of the leader's tunnels to take over quickly
+		go ha.NewStateSyncer(elector, tunnelManager).Run(runCtx)
+
+		electionDone = make(chan struct{})
+		go func() {
+			defer close(electionDone)
+			elector.Run(runCtx, func(ctx context.Context) {
+				if err := lb.Start(); err != nil {
+					logger.Error().Err(err).Msg("Failed to start load balancer")
+				}
+				startControllers(ctx)
+			}, func() {
+				if err := lb.Stop(); err != nil {
+					logger.Error().Err(err).Msg("Failed to stop load balancer")
+				}
+			})
+		}()
+	} else {
+		if err := lb.Start(); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start load balancer")
+		}
+		startControllers(runCtx)
+	}
+	lb.StartCertificateWatcher(runCtx, cfg.TLSReloadInterval)
+
+	// Readiness reflects the listeners, WireGuard and the routes file
+	apiHandler.AddHealthCheck("load_balancer", func() error {
+		// Standbys leave the public listeners to the leader
+		if isStandby() {
+			return nil
+		}
+		return lb.Listening()
+	})
+	if wireGuardStarted {
+		apiHandler.AddHealthCheck("wireguard", tunnelManager.CheckWireGuard)
+	}
+	if cfg.LBRoutesFile != "" {
+		apiHandler.AddHealthCheck("persistence", router.CheckRoutesFile)
+	}
+
+	// Verbose status describes the same subsystems in detail
+	statusSources := api.StatusSources{
+		Listeners: lb.ListenerStates,
+		ConfigChecksum: func() string {
+			return watcher.Current().Checksum()
+		},
+	}
+	if wireGuardStarted {
+		statusSources.WireGuard = tunnelManager.WireGuardStatus
+	}
+	if cfg.LBRoutesFile != "" {
+		statusSources.Persistence = router.RoutesFileStatus
 	}
+	apiHandler.SetStatusSources(statusSources)
+	apiHandler.SetBuildInfo(commit, date)
 
 	// Start API server
+	apiListener := inherited["api"]
+	if apiListener == nil {
+		if apiListener, err = net.Listen("tcp", apiServer.Addr); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to listen for the API")
+		}
+	}
 	go func() {
 		logger.Info().
-			Str("address", apiServer.Addr).
+			Str("address", apiListener.Addr().String()).
+			Bool("tls", apiServer.TLSConfig != nil).
 			Msg("Starting API server")
-		if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if apiServer.TLSConfig != nil {
+			err = apiServer.ServeTLS(apiListener, cfg.APITLSCertPath, cfg.APITLSKeyPath)
+		} else {
+			err = apiServer.Serve(apiListener)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal().Err(err).Msg("API server failed")
 		}
 	}()
 
-	// Wait for shutdown signal
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	// Start gRPC server. It is optional, so the agent keeps serving without
+	// it if it fails to start.
+	if grpcListener := inherited["grpc"]; grpcListener != nil || cfg.GRPCPort > 0 {
+		grpcAddr := net.JoinHostPort(cfg.APIHost, strconv.Itoa(cfg.GRPCPort))
+		if grpcListener != nil {
+			grpcAddr = grpcListener.Addr().String()
+		}
+		logger.Info().
+			Str("address", grpcAddr).
+			Msg("Starting gRPC server")
+		if err := startGRPCServer(grpcServer, grpcListener, grpcAddr, cfg); err != nil {
+			logger.Error().Err(err).Msg("Failed to start gRPC server")
+		}
+	}
+
+	// Tell systemd the agent is up and keep its watchdog fed
+	notify(systemd.StateReady + "\n" + systemd.Status("Serving"))
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-runCtx.Done():
+					return
+				case <-ticker.C:
+					notify(systemd.StateWatchdog)
+				}
+			}
+		}()
+	}
+
+	// Wait for shutdown signal, reloading configuration on SIGHUP
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		logger.Info().Msg("Received SIGHUP, reloading configuration")
+		notify(systemd.Reloading())
+		_ = watcher.Reload()
+		notify(systemd.StateReady)
+	}
+
+	current := watcher.Current()
+	logger.Info().Msg("Shutting down, draining traffic...")
+	notify(systemd.StateStopping + "\n" + systemd.Status("Draining"))
+
+	// Phase 1: fail readiness and withdraw the service registrations, so
+	// that load balancers in front of the agent stop sending it new traffic
+	// while it still serves
+	apiHandler.SetDraining()
+	if discoveryManager != nil {
+		discoveryManager.Withdraw()
+	}
+	logger.Info().
+		Dur("delay", current.DrainDelay).
+		Msg("Drain phase 1: failing readiness")
+	time.Sleep(current.DrainDelay)
+
+	// Phase 2: stop accepting public connections and wait for the open ones
+	logger.Info().
+		Dur("timeout", current.DrainTimeout).
+		Msg("Drain phase 2: waiting for open connections")
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), current.DrainTimeout)
+	if err := lb.Drain(drainCtx); err != nil {
+		logger.Warn().Err(err).Msg("Closed the connections still open after the drain timeout")
+	}
+	cancelDrain()
 
-	logger.Info().Msg("Shutting down servers...")
+	// Give up leadership so a standby can take over right away
+	if electionDone != nil {
+		stopRun()
+		<-electionDone
+	}
 
-	// Create shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	// Phase 3: stop the API servers
+	logger.Info().Msg("Drain phase 3: stopping API servers")
+	ctx, cancel := context.WithTimeout(context.Background(), current.ShutdownTimeout)
 	defer cancel()
 
 	// Shutdown API server
@@ -102,10 +811,132 @@ func main() {
 		logger.Error().Err(err).Msg("API server forced to shutdown")
 	}
 
-	// Stop load balancer
-	if err := lb.Stop(); err != nil {
-		logger.Error().Err(err).Msg("Failed to stop load balancer")
+	if debugServer != nil {
+		_ = debugServer.Close()
+	}
+
+	// Shutdown gRPC server
+	if err := grpcServer.Shutdown(ctx); err != nil {
+		logger.Error().Err(err).Msg("gRPC server forced to shutdown")
+	}
+
+	// Phase 4: remove the WireGuard peers, keeping the tunnels in the routes
+	// file and on standbys
+	if wireGuardStarted {
+		logger.Info().Msg("Drain phase 4: removing WireGuard peers")
+		removed, err := tunnelManager.RemoveWireGuardPeers()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to remove WireGuard peers")
+		}
+		logger.Info().Int("peers", removed).Msg("Removed WireGuard peers")
 	}
 
 	logger.Info().Msg("Servers stopped")
-} 
\ No newline at end of file
+} 
+
+// startGRPCServer serves gRPC on listener or, if it is nil, on addr. With a
+// certificate configured the server speaks TLS, verifying client
+// certificates like the API server for its client certificate policy.
+func startGRPCServer(server *grpcapi.Server, listener net.Listener, addr string, cfg *config.ServerConfig) error {
+	var tlsConfig *tls.Config
+	if cfg.GRPCTLSCertPath != "" {
+		var err error
+		if tlsConfig, err = api.NewServerTLSConfig(cfg.APIClientCAPath, cfg.APIRequireClientCert); err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.GRPCTLSCertPath, cfg.GRPCTLSKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load gRPC TLS certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if listener != nil {
+		return server.Serve(listener, tlsConfig)
+	}
+	return server.Start(addr, tlsConfig)
+}
+
+// notify sends state to systemd, if the agent runs under it
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		utils.GetLogger().Warn().Err(err).Msg("Failed to notify systemd")
+	}
+}
+
+// tunnelOptions converts the traffic options of a tunnel to the settings
+// the load balancer applies
+func tunnelOptions(o *tunnel.TrafficOptions) *loadbalancer.TunnelOptions {
+	t := o.ProxyTimeouts
+	options := &loadbalancer.TunnelOptions{
+		Timeouts:           loadbalancer.Timeouts{Dial: t.Dial, ResponseHeader: t.ResponseHeader, MaxRequest: t.MaxRequest},
+		ErrorPages:         o.ErrorPages,
+		Maintenance:        o.Maintenance,
+		Paused:             o.Paused,
+		HostRewrite:        loadbalancer.HostRewrite(o.HostRewrite),
+		Compression:        o.Compression.Enabled,
+		CompressionMinSize: o.Compression.MinSize,
+		Access:             accessLists(o.Access),
+		ClientLimits:       loadbalancer.ClientLimits(o.ClientLimits),
+		MaxRequestBody:     o.RequestPolicy.MaxRequestBody,
+		RetryAttempts:      o.RequestPolicy.RetryAttempts,
+		OverBandwidth:      o.OverBandwidth,
+		Cache:              o.Cache.Enabled,
+		CacheMaxBytes:      o.Cache.MaxBytes,
+		CacheMaxTTL:        o.Cache.MaxTTL,
+	}
+	if rules := o.HeaderRules; rules != nil {
+		options.HeaderRules = &loadbalancer.HeaderRules{
+			Request:  loadbalancer.HeaderRuleSet(rules.Request),
+			Response: loadbalancer.HeaderRuleSet(rules.Response),
+		}
+	}
+	for _, rule := range o.RequestFilters {
+		options.RequestFilters = append(options.RequestFilters, loadbalancer.FilterRule(rule))
+	}
+	if mirror := o.Mirror; mirror != nil {
+		options.Mirror = &loadbalancer.Mirror{TunnelID: mirror.TunnelID, Percent: mirror.Percent}
+	}
+	if auth := o.EdgeAuth; auth != nil {
+		options.EdgeAuth = &loadbalancer.EdgeAuth{BasicAuth: auth.BasicAuth, OIDC: (*loadbalancer.OIDCAuth)(auth.OIDC)}
+	}
+	if auth := o.ClientCertAuth; auth != nil {
+		options.ClientCertAuth = (*loadbalancer.ClientCertAuth)(auth)
+	}
+	if backendTLS := o.BackendTLS; backendTLS != nil {
+		options.BackendTLS = &loadbalancer.BackendTLS{
+			ServerName:         backendTLS.ServerName,
+			InsecureSkipVerify: backendTLS.InsecureSkipVerify,
+		}
+	}
+	return options
+}
+
+// accessLists parses the access lists of a tunnel; lists that fail to parse
+// deny every client rather than letting them all in
+func accessLists(access tunnel.AccessLists) loadbalancer.AccessLists {
+	allowed, err := loadbalancer.ParseCIDRs(access.AllowedIPs)
+	if err == nil {
+		var denied []*net.IPNet
+		if denied, err = loadbalancer.ParseCIDRs(access.DeniedIPs); err == nil {
+			return loadbalancer.AccessLists{
+				AllowedIPs:       allowed,
+				DeniedIPs:        denied,
+				AllowedCountries: access.AllowedCountries,
+				DeniedCountries:  access.DeniedCountries,
+			}
+		}
+	}
+	utils.GetLogger().Error().Err(err).Msg("Invalid access lists, denying all clients")
+	return loadbalancer.AccessLists{DenyAll: true}
+}
+
+// applyModuleLogLevels sets the per-module log levels from a LOG_LEVELS value
+func applyModuleLogLevels(spec string) {
+	levels, err := utils.ParseModuleLevels(spec)
+	if err != nil {
+		utils.GetLogger().Error().Err(err).Msg("Invalid module log levels")
+		return
+	}
+	utils.SetModuleLevels(levels)
+}
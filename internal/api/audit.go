@@ -0,0 +1,169 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+)
+
+// defaultAuditLimit is the number of events returned when no limit is given
+const defaultAuditLimit = 100
+
+// SetAuditLog records tunnel changes, admin actions and authentication
+// failures to log
+func (h *Handler) SetAuditLog(log *audit.Log) {
+	h.auditLog = log
+}
+
+// recordAudit fills in the caller and source of an event and records it
+func (h *Handler) recordAudit(r *http.Request, event audit.Event) {
+	if h.auditLog == nil {
+		return
+	}
+	event.Protocol = "http"
+	event.Caller = callerIdentity(r)
+	event.SourceIP = sourceIP(r)
+	if err := h.auditLog.Record(event); err != nil {
+		h.logger.Error().
+			Err(err).
+			Str("action", event.Action).
+			Msg("Failed to record audit event")
+	}
+}
+
+// audited wraps next to record its outcome as action. Reads are not recorded.
+func (h *Handler) audited(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.auditLog == nil || r.Method == http.MethodGet {
+			next(w, r)
+			return
+		}
+
+		body, ok := h.readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Create and remove requests name the tunnel in the body, tunnel
+		// actions in the path
+		var target struct {
+			TunnelID string `json:"tunnel_id"`
+		}
+		_ = json.Unmarshal(body, &target)
+		if target.TunnelID == "" {
+			if _, rest, found := strings.Cut(r.URL.Path, "/tunnels/"); found {
+				target.TunnelID, _, _ = strings.Cut(rest, "/")
+			}
+		}
+
+		recorder := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		event := audit.Event{
+			Action:        action,
+			TunnelID:      target.TunnelID,
+			PayloadSHA256: audit.HashPayload(body),
+			Success:       recorder.status < http.StatusBadRequest,
+			Status:        recorder.status,
+		}
+		if !event.Success {
+			var resp ErrorResponse
+			if json.Unmarshal(recorder.body.Bytes(), &resp) == nil {
+				event.Error = resp.Details
+			}
+		}
+		h.recordAudit(r, event)
+	}
+}
+
+// auditRecorder captures the status code and, for errors, the body of a response
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(b []byte) (int, error) {
+	if r.status >= http.StatusBadRequest && r.body.Len() < 4096 {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// callerIdentity names the caller by its credentials or client certificate
+func callerIdentity(r *http.Request) string {
+	if principal, ok := principalFrom(r); ok {
+		return principal.Name
+	}
+	if identities := clientIdentities(r); len(identities) > 0 {
+		return identities[0]
+	}
+	return ""
+}
+
+// sourceIP returns the IP address the request came from
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// handleAudit returns audit events, filtered by the action, caller,
+// tunnel_id, since (RFC 3339) and limit query parameters
+func (h *Handler) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.auditLog == nil {
+		h.sendError(w, "Audit log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	query := audit.Query{
+		Action:   params.Get("action"),
+		Caller:   params.Get("caller"),
+		TunnelID: params.Get("tunnel_id"),
+		Limit:    defaultAuditLimit,
+	}
+	if since := params.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			h.sendError(w, "Invalid since timestamp", http.StatusBadRequest)
+			return
+		}
+		query.Since = t
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			h.sendError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = n
+	}
+
+	events, err := h.auditLog.Query(query)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.sendJSON(w, AuditResponse{Events: events}, http.StatusOK)
+}
@@ -0,0 +1,312 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+)
+
+// API scopes granted to credentials
+const (
+	ScopeTunnelsCreate = "tunnels:create"
+	ScopeTunnelsDelete = "tunnels:delete"
+	ScopeTunnelsRead   = "tunnels:read"
+	ScopeAdmin         = "admin"
+)
+
+// validScopes are the scopes credentials may be granted
+var validScopes = map[string]bool{
+	ScopeTunnelsCreate: true,
+	ScopeTunnelsDelete: true,
+	ScopeTunnelsRead:   true,
+	ScopeAdmin:         true,
+}
+
+// Principal is an authenticated API caller
+type Principal struct {
+	// Name identifies the caller in logs
+	Name string
+
+	// Scopes are the operations the caller may perform; admin grants all
+	Scopes []string
+
+	// Hostnames are the hostname patterns the caller may manage tunnels
+	// for: exact hostnames, "*.domain" for its subdomains or "*" for all
+	Hostnames []string
+
+	// Tenant owns the tunnels the caller creates, whose limits they count
+	// against
+	Tenant string
+}
+
+// HasScope reports whether the caller was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsHostname reports whether the caller may manage tunnels for the hostname
+func (p *Principal) AllowsHostname(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, pattern := range p.Hostnames {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == hostname {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(hostname, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator identifies the caller of an API request
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// errUnknownToken is returned by TokenStore for tokens it did not issue, so
+// that other authenticators can be tried
+var errUnknownToken = errors.New("unknown API token")
+
+// bearerToken returns the bearer token of r
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", errors.New("missing bearer token")
+	}
+	return strings.TrimPrefix(header, "Bearer "), nil
+}
+
+// APIToken is a static API credential
+type APIToken struct {
+	Name string `json:"name"`
+
+	// Token is the secret itself; TokenSHA256 its hex-encoded SHA-256 hash,
+	// so the file need not contain the secret
+	Token       string `json:"token,omitempty"`
+	TokenSHA256 string `json:"token_sha256,omitempty"`
+
+	Scopes []string `json:"scopes"`
+
+	// Hostnames default to every hostname if empty
+	Hostnames []string `json:"hostnames,omitempty"`
+
+	// Tenant owning the tunnels created with the token, by default the
+	// token's name
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// TokenStore authenticates callers by static API tokens
+type TokenStore struct {
+	mu     sync.RWMutex
+	tokens []tokenEntry
+
+	// path is the file tokens were loaded from, if any, and modTime its
+	// modification time when it was last read
+	path    string
+	modTime time.Time
+}
+
+type tokenEntry struct {
+	hash      [sha256.Size]byte
+	principal *Principal
+}
+
+// NewTokenStore creates a store of the given tokens
+func NewTokenStore(tokens []APIToken) (*TokenStore, error) {
+	store := &TokenStore{}
+	names := make(map[string]bool)
+	for _, token := range tokens {
+		if token.Name == "" {
+			return nil, errors.New("API token without a name")
+		}
+		if names[token.Name] {
+			return nil, fmt.Errorf("duplicate API token name %s", token.Name)
+		}
+		names[token.Name] = true
+
+		var entry tokenEntry
+		switch {
+		case token.Token != "" && token.TokenSHA256 != "":
+			return nil, fmt.Errorf("API token %s has both token and token_sha256", token.Name)
+		case token.Token != "":
+			entry.hash = sha256.Sum256([]byte(token.Token))
+		case token.TokenSHA256 != "":
+			hash, err := hex.DecodeString(token.TokenSHA256)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("API token %s has an invalid token_sha256", token.Name)
+			}
+			copy(entry.hash[:], hash)
+		default:
+			return nil, fmt.Errorf("API token %s has no token", token.Name)
+		}
+
+		if len(token.Scopes) == 0 {
+			return nil, fmt.Errorf("API token %s has no scopes", token.Name)
+		}
+		for _, scope := range token.Scopes {
+			if !validScopes[scope] {
+				return nil, fmt.Errorf("API token %s has unknown scope %s", token.Name, scope)
+			}
+		}
+
+		hostnames := token.Hostnames
+		if len(hostnames) == 0 {
+			hostnames = []string{"*"}
+		}
+		tenant := token.Tenant
+		if tenant == "" {
+			tenant = token.Name
+		}
+		entry.principal = &Principal{Name: token.Name, Scopes: token.Scopes, Hostnames: hostnames, Tenant: tenant}
+		store.tokens = append(store.tokens, entry)
+	}
+	return store, nil
+}
+
+// LoadTokenStore reads tokens from a JSON file of the form {"tokens": [...]}
+func LoadTokenStore(path string) (*TokenStore, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API tokens: %v", err)
+	}
+	store, err := readTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	store.path = path
+	store.modTime = info.ModTime()
+	return store, nil
+}
+
+func readTokenFile(path string) (*TokenStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API tokens: %v", err)
+	}
+	var file struct {
+		Tokens []APIToken `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse API tokens: %v", err)
+	}
+	return NewTokenStore(file.Tokens)
+}
+
+// Reload re-reads the tokens file if it changed since it was last read, so
+// tokens can be added, rotated or revoked without a restart. It reports
+// whether the file changed; an invalid file leaves the current tokens in
+// effect.
+func (s *TokenStore) Reload() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		// A mounted secret being replaced may be missing for a moment
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info.ModTime().Equal(s.modTime) {
+		return false, nil
+	}
+	s.modTime = info.ModTime()
+	loaded, err := readTokenFile(s.path)
+	if err != nil {
+		return true, err
+	}
+	s.tokens = loaded.tokens
+	return true, nil
+}
+
+// Watch reloads the tokens file every interval until ctx is cancelled
+func (s *TokenStore) Watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	logger := utils.GetModuleLogger(utils.ModuleAPI)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				changed, err := s.Reload()
+				if err != nil {
+					logger.Error().Err(err).Str("file", s.path).Msg("Failed to reload API tokens, keeping current tokens")
+				} else if changed {
+					logger.Info().Str("file", s.path).Msg("Reloaded API tokens")
+				}
+			}
+		}
+	}()
+}
+
+// Authenticate looks up the bearer token of r
+func (s *TokenStore) Authenticate(r *http.Request) (*Principal, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *Principal
+	for _, entry := range s.tokens {
+		if subtle.ConstantTimeCompare(hash[:], entry.hash[:]) == 1 {
+			found = entry.principal
+		}
+	}
+	if found == nil {
+		return nil, errUnknownToken
+	}
+	return found, nil
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of r carrying the authenticated caller
+func withPrincipal(r *http.Request, principal *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+// tenantOf returns the tenant owning the tunnels the caller creates, empty
+// for callers without credentials
+func tenantOf(r *http.Request) string {
+	if principal, ok := principalFrom(r); ok {
+		return principal.Tenant
+	}
+	return ""
+}
+
+// principalFrom returns the authenticated caller, if authentication is enabled
+func principalFrom(r *http.Request) (*Principal, bool) {
+	principal, ok := r.Context().Value(principalKey{}).(*Principal)
+	return principal, ok
+}
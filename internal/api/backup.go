@@ -0,0 +1,391 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// SetSecretsBox seals the connect tokens and WireGuard private keys of
+// tunnels in exports with box, and opens those of imports. Without a box,
+// exports leave them out and imported tunnels get new ones.
+func (h *Handler) SetSecretsBox(box *secrets.Box) {
+	h.secretsBox = box
+}
+
+// handleExport returns the tunnels of the agent with their settings and
+// the static routes, for another agent to import
+func (h *Handler) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := AgentState{
+		Version:      h.version,
+		ExportedAt:   time.Now().UTC(),
+		Tunnels:      []ExportedTunnel{},
+		StaticRoutes: []Route{},
+	}
+	for _, t := range h.tunnelManager.GetAllTunnels() {
+		exported := ExportedTunnel{
+			HATunnel:     h.haTunnel(t),
+			Transport:    t.Transport,
+			Tenant:       t.Tenant,
+			SSHPublicKey: t.SSHPublicKey,
+		}
+		if t.ConnectToken != "" && h.secretsBox != nil {
+			sealed, err := h.secretsBox.Seal([]byte(t.ConnectToken))
+			if err != nil {
+				h.sendError(w, fmt.Sprintf("Failed to seal the connect token of tunnel %s: %v", t.ID, err), http.StatusInternalServerError)
+				return
+			}
+			exported.SealedConnectToken = string(sealed)
+		}
+		if t.WireGuardConfig != nil && h.secretsBox != nil {
+			sealed, err := h.secretsBox.Seal([]byte(t.WireGuardConfig.PrivateKey))
+			if err != nil {
+				h.sendError(w, fmt.Sprintf("Failed to seal the WireGuard private key of tunnel %s: %v", t.ID, err), http.StatusInternalServerError)
+				return
+			}
+			exported.SealedWireGuardPrivateKey = string(sealed)
+		}
+		state.Tunnels = append(state.Tunnels, exported)
+	}
+	if h.routes != nil {
+		for _, route := range h.routes.Snapshot() {
+			if route.TunnelID == "" {
+				state.StaticRoutes = append(state.StaticRoutes, apiRoute(route))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="easy-tunnel-export.json"`)
+	h.sendJSON(w, state, http.StatusOK)
+}
+
+// handleImport creates the tunnels and static routes of an export. Nothing
+// is imported if the settings of a tunnel are invalid. Tunnels whose ID is
+// taken are skipped, so an import can be repeated after fixing what failed.
+func (h *Handler) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rejectStandby(w) {
+		return
+	}
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+	var state AgentState
+	if err := json.Unmarshal(body, &state); err != nil {
+		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	imported := make(map[string]bool, len(state.Tunnels))
+	for _, t := range state.Tunnels {
+		imported[t.TunnelID] = true
+	}
+	for _, t := range state.Tunnels {
+		if err := h.validateImport(t, imported); err != nil {
+			h.sendError(w, fmt.Sprintf("Invalid tunnel %s: %v", t.TunnelID, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := ImportResponse{Imported: []string{}, Failed: []ImportFailure{}}
+	fail := func(tunnelID, hostname string, err error) {
+		resp.Failed = append(resp.Failed, ImportFailure{TunnelID: tunnelID, Hostname: hostname, Error: err.Error()})
+	}
+
+	// Create all tunnels before applying their settings, which may refer
+	// to other tunnels, such as the target of a mirror
+	var created []ExportedTunnel
+	for _, t := range state.Tunnels {
+		reissued, newKey, err := h.importTunnel(t)
+		if err != nil {
+			fail(t.TunnelID, "", err)
+			continue
+		}
+		if reissued {
+			resp.ReissuedConnectTokens = append(resp.ReissuedConnectTokens, t.TunnelID)
+		}
+		if newKey != "" {
+			if resp.NewWireGuardKeys == nil {
+				resp.NewWireGuardKeys = make(map[string]string)
+			}
+			resp.NewWireGuardKeys[t.TunnelID] = newKey
+		}
+		created = append(created, t)
+	}
+	for _, t := range created {
+		if err := ApplyTunnelOptions(h.tunnelManager, t.HATunnel); err != nil {
+			// Leave nothing half imported
+			h.tunnelManager.RemoveTunnel(t.TunnelID)
+			fail(t.TunnelID, "", err)
+			continue
+		}
+		resp.Imported = append(resp.Imported, t.TunnelID)
+	}
+
+	if len(state.StaticRoutes) > 0 {
+		static, ok := h.routes.(StaticRouteTable)
+		for _, route := range state.StaticRoutes {
+			if !ok {
+				fail("", route.Hostname, errors.New("static routes are not available"))
+				continue
+			}
+			added := loadbalancer.Route{Hostname: route.Hostname, Path: pathMatch(route.PathType, route.Path), Priority: route.Priority}
+			added.Redirect, added.Response = staticAnswer(route.Redirect, route.Response)
+			if err := static.AddStaticRoute(added); err != nil {
+				fail("", route.Hostname, err)
+				continue
+			}
+			resp.StaticRoutes++
+		}
+	}
+
+	h.logger.Info().
+		Str("exported_by", state.Version).
+		Int("tunnels", len(resp.Imported)).
+		Int("static_routes", resp.StaticRoutes).
+		Int("failed", len(resp.Failed)).
+		Msg("Imported agent state")
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// validateImport checks a tunnel of an export like a tunnel creation. Its
+// mirror may target a tunnel that exists or is imported with it.
+func (h *Handler) validateImport(t ExportedTunnel, imported map[string]bool) error {
+	if t.TunnelID == "" || t.Hostname == "" || t.TargetPort <= 0 {
+		return errors.New("missing required fields")
+	}
+	for _, hostname := range append([]string{t.Hostname}, t.Hostnames...) {
+		if _, err := loadbalancer.NormalizeHostname(hostname); err != nil {
+			return err
+		}
+	}
+	if t.Transport == "" || t.Transport == tunnel.TransportWireGuard {
+		opts := wireGuardOptions(t)
+		if err := opts.Validate(); err != nil {
+			return err
+		}
+		if !h.tunnelManager.HasWireGuardInterface(opts.Interface) {
+			return fmt.Errorf("unknown WireGuard interface %s", opts.Interface)
+		}
+	}
+
+	req := &CreateTunnelRequest{
+		TunnelID:                     t.TunnelID,
+		Hostname:                     t.Hostname,
+		Hostnames:                    t.Hostnames,
+		TargetPort:                   t.TargetPort,
+		WireGuardPublicKey:           t.WireGuardPublicKey,
+		Transport:                    t.Transport,
+		SSHPublicKey:                 t.SSHPublicKey,
+		Protocol:                     t.Protocol,
+		ListenPort:                   t.ListenPort,
+		DialTimeoutSeconds:           t.DialTimeoutSeconds,
+		ResponseHeaderTimeoutSeconds: t.ResponseHeaderTimeoutSeconds,
+		MaxRequestDurationSeconds:    t.MaxRequestDurationSeconds,
+		BackendTLS:                   t.BackendTLS,
+		BackendTLSServerName:         t.BackendTLSServerName,
+		BackendTLSInsecureSkipVerify: t.BackendTLSInsecureSkipVerify,
+		ErrorPages:                   t.ErrorPages,
+		HeaderRules:                  t.HeaderRules,
+		HostRewrite:                  t.HostRewrite,
+		OriginRewrite:                t.OriginRewrite,
+		Compression:                  t.Compression,
+		CompressionMinSize:           t.CompressionMinSize,
+		Cache:                        t.Cache,
+		CacheMaxBytes:                t.CacheMaxBytes,
+		CacheMaxTTLSeconds:           t.CacheMaxTTLSeconds,
+		AllowedIPs:                   t.AllowedIPs,
+		DeniedIPs:                    t.DeniedIPs,
+		AllowedCountries:             t.AllowedCountries,
+		DeniedCountries:              t.DeniedCountries,
+		RequestFilters:               t.RequestFilters,
+		ClientRequestsPerSecond:      t.ClientRequestsPerSecond,
+		ClientBurst:                  t.ClientBurst,
+		ClientMaxConnections:         t.ClientMaxConnections,
+		Policy:                       &TunnelPolicy{MaxRequestBodyBytes: t.MaxRequestBodyBytes, RetryAttempts: t.RetryAttempts},
+		MirrorTunnelID:               t.MirrorTunnelID,
+		MirrorPercent:                t.MirrorPercent,
+		EdgeAuth:                     t.EdgeAuth,
+		ClientCertAuth:               t.ClientCertAuth,
+		ExpiresAt:                    t.ExpiresAt,
+		TTLSeconds:                   t.TTLSeconds,
+		Labels:                       t.Labels,
+	}
+	if err := h.validateSettings(req); err != nil {
+		return err
+	}
+
+	if mirror := t.MirrorTunnelID; mirror != "" {
+		if mirror == t.TunnelID {
+			return errors.New("a tunnel cannot mirror its requests to itself")
+		}
+		if t.MirrorPercent < 0 || t.MirrorPercent > 100 {
+			return fmt.Errorf("invalid mirror percent: %d", t.MirrorPercent)
+		}
+		if _, err := h.tunnelManager.GetTunnel(mirror); err != nil && !imported[mirror] {
+			return fmt.Errorf("mirror tunnel %s not found", mirror)
+		}
+	}
+	return nil
+}
+
+// wireGuardOptions returns the WireGuard options of an exported tunnel,
+// without its private key
+func wireGuardOptions(t ExportedTunnel) tunnel.WireGuardOptions {
+	return tunnel.WireGuardOptions{
+		PersistentKeepalive: t.PersistentKeepalive,
+		MTU:                 t.MTU,
+		KeyRotationInterval: time.Duration(t.KeyRotationIntervalSeconds) * time.Second,
+		Interface:           t.WireGuardInterface,
+	}
+}
+
+// importTunnel creates a tunnel of an export on its transport, reporting
+// whether its client was issued a new connect token, or the new server
+// public key of a WireGuard tunnel, because the sealed secret could not be
+// opened
+func (h *Handler) importTunnel(t ExportedTunnel) (reissued bool, newKey string, err error) {
+	if _, err := h.tunnelManager.GetTunnel(t.TunnelID); err == nil {
+		return false, "", fmt.Errorf("tunnel with ID %s already exists", t.TunnelID)
+	}
+
+	if t.Transport == "" || t.Transport == tunnel.TransportWireGuard {
+		opts := wireGuardOptions(t)
+		if t.SealedWireGuardPrivateKey != "" && h.secretsBox != nil {
+			if key, err := h.secretsBox.Open([]byte(t.SealedWireGuardPrivateKey)); err == nil {
+				opts.PrivateKey = string(key)
+			}
+		}
+		info, err := h.tunnelManager.CreateTunnelForTenant(t.Tenant, t.TunnelID, t.Hostname, t.TargetPort, t.WireGuardPublicKey, t.Metadata, opts)
+		if err != nil {
+			return false, "", err
+		}
+		if info.WireGuardConfig != nil && opts.PrivateKey == "" {
+			newKey = strings.TrimSpace(info.WireGuardConfig.PublicKey)
+		}
+		return false, newKey, nil
+	}
+
+	opts := tunnel.TransportOptions{SSHPublicKey: t.SSHPublicKey}
+	if t.SealedConnectToken != "" && h.secretsBox != nil {
+		if token, err := h.secretsBox.Open([]byte(t.SealedConnectToken)); err == nil {
+			opts.ConnectToken = string(token)
+		}
+	}
+	if _, err := h.tunnelManager.CreateTunnelOnTransportForTenant(t.Tenant, t.Transport, t.TunnelID, t.Hostname, t.TargetPort, t.Metadata, opts); err != nil {
+		return false, "", err
+	}
+	return opts.ConnectToken == "", "", nil
+}
+
+// ApplyTunnelOptions sets the load balancer settings of a tunnel created
+// from its configuration in state, as copied by standby agents and
+// imported from exports. It applies all settings it can and returns the
+// errors of the others.
+func ApplyTunnelOptions(m *tunnel.Manager, t HATunnel) error {
+	var errs []error
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", setting, err))
+		}
+	}
+
+	if len(t.Hostnames) > 0 {
+		check("hostnames", m.SetHostnames(t.TunnelID, t.Hostnames))
+	}
+
+	timeouts := tunnel.ProxyTimeouts{
+		Dial:           time.Duration(t.DialTimeoutSeconds) * time.Second,
+		ResponseHeader: time.Duration(t.ResponseHeaderTimeoutSeconds) * time.Second,
+		MaxRequest:     time.Duration(t.MaxRequestDurationSeconds) * time.Second,
+	}
+	check("timeouts", m.SetProxyTimeouts(t.TunnelID, timeouts))
+
+	var backendTLS *tunnel.BackendTLS
+	if t.BackendTLS {
+		backendTLS = &tunnel.BackendTLS{ServerName: t.BackendTLSServerName, InsecureSkipVerify: t.BackendTLSInsecureSkipVerify}
+	}
+	check("backend TLS", m.SetBackendTLS(t.TunnelID, backendTLS))
+
+	check("error pages", m.SetErrorPages(t.TunnelID, t.ErrorPages))
+	check("maintenance mode", m.SetMaintenance(t.TunnelID, t.Maintenance))
+
+	var rules *tunnel.HeaderRules
+	if t.HeaderRules != nil {
+		rules = &tunnel.HeaderRules{
+			Request:  tunnel.HeaderRuleSet(t.HeaderRules.Request),
+			Response: tunnel.HeaderRuleSet(t.HeaderRules.Response),
+		}
+	}
+	check("header rules", m.SetHeaderRules(t.TunnelID, rules))
+	check("host rewrite", m.SetHostRewrite(t.TunnelID, tunnel.HostRewrite{Host: t.HostRewrite, Origin: t.OriginRewrite}))
+
+	compression := tunnel.Compression{Enabled: t.Compression, MinSize: t.CompressionMinSize}
+	check("compression", m.SetCompression(t.TunnelID, compression))
+
+	cache := tunnel.Cache{
+		Enabled:  t.Cache,
+		MaxBytes: t.CacheMaxBytes,
+		MaxTTL:   time.Duration(t.CacheMaxTTLSeconds) * time.Second,
+	}
+	check("cache settings", m.SetCache(t.TunnelID, cache))
+
+	access := tunnel.AccessLists{
+		AllowedIPs:       t.AllowedIPs,
+		DeniedIPs:        t.DeniedIPs,
+		AllowedCountries: t.AllowedCountries,
+		DeniedCountries:  t.DeniedCountries,
+	}
+	check("access lists", m.SetAccessLists(t.TunnelID, access))
+	check("request filters", m.SetRequestFilters(t.TunnelID, tunnelFilterRules(t.RequestFilters)))
+
+	limits := tunnel.ClientLimits{
+		RequestsPerSecond: t.ClientRequestsPerSecond,
+		Burst:             t.ClientBurst,
+		MaxConnections:    t.ClientMaxConnections,
+	}
+	check("client limits", m.SetClientLimits(t.TunnelID, limits))
+	policy := tunnel.RequestPolicy{MaxRequestBody: t.MaxRequestBodyBytes, RetryAttempts: t.RetryAttempts}
+	check("request policy", m.SetRequestPolicy(t.TunnelID, policy))
+
+	var mirror *tunnel.Mirror
+	if t.MirrorTunnelID != "" {
+		mirror = &tunnel.Mirror{TunnelID: t.MirrorTunnelID, Percent: t.MirrorPercent}
+	}
+	check("mirror", m.SetMirror(t.TunnelID, mirror))
+
+	var edgeAuth *tunnel.EdgeAuth
+	if t.EdgeAuth != nil {
+		edgeAuth = &tunnel.EdgeAuth{BasicAuth: t.EdgeAuth.BasicAuth, OIDC: (*tunnel.OIDCAuth)(t.EdgeAuth.OIDC)}
+	}
+	check("edge authentication", m.SetEdgeAuth(t.TunnelID, edgeAuth))
+	check("client certificate requirement", m.SetClientCertAuth(t.TunnelID, (*tunnel.ClientCertAuth)(t.ClientCertAuth)))
+	check("labels", m.SetLabels(t.TunnelID, t.Labels))
+	check("pause", m.SetPaused(t.TunnelID, t.Paused))
+
+	var expiresAt time.Time
+	if t.ExpiresAt != nil {
+		expiresAt = *t.ExpiresAt
+	}
+	check("expiry", m.SetExpiry(t.TunnelID, expiresAt, time.Duration(t.TTLSeconds)*time.Second))
+	check("protocol", m.SetProtocol(t.TunnelID, t.Protocol, t.ListenPort))
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// ResponseCache reports and purges the cached responses of tunnels
+type ResponseCache interface {
+	CacheStats(tunnelID string) loadbalancer.CacheStats
+	PurgeCache(tunnelID string) int
+}
+
+// SetResponseCache serves the cached responses of cache
+func (h *Handler) SetResponseCache(cache ResponseCache) {
+	h.cache = cache
+}
+
+// tunnelCache returns the cache overrides a tunnel creation requests
+func tunnelCache(enabled *bool, maxBytes int64, maxTTLSeconds int) tunnel.Cache {
+	return tunnel.Cache{
+		Enabled:  enabled,
+		MaxBytes: maxBytes,
+		MaxTTL:   time.Duration(maxTTLSeconds) * time.Second,
+	}
+}
+
+// handleCache reports the cached responses of a tunnel, or purges them
+func (h *Handler) handleCache(w http.ResponseWriter, r *http.Request, id string) {
+	if h.cache == nil {
+		h.sendError(w, "Response cache is not available", http.StatusNotFound)
+		return
+	}
+	if _, err := h.tunnelManager.GetTunnel(id); err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var purged int
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		purged = h.cache.PurgeCache(id)
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := h.cache.CacheStats(id)
+	h.sendJSON(w, CacheResponse{
+		TunnelID: id,
+		Entries:  stats.Entries,
+		Bytes:    stats.Bytes,
+		Hits:     stats.Hits,
+		Misses:   stats.Misses,
+		Purged:   purged,
+	}, http.StatusOK)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+)
+
+// Errors returned by AuthenticateCall, AuthorizeCall and CheckReservations
+var (
+	ErrUnauthenticated  = errors.New("invalid credentials")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrRateLimited      = errors.New("rate limit exceeded")
+)
+
+// AuthenticateCall identifies the caller of a call made over another
+// protocol, such as gRPC, with the authenticators, rate limits and scopes of
+// the REST endpoints. r carries the caller's Authorization header, address
+// and TLS state; the returned request also carries the caller, for
+// AuthorizeCall, CallerIdentity and CallerTenant.
+func (h *Handler) AuthenticateCall(r *http.Request, scope string) (*http.Request, error) {
+	if h.ipLimiter != nil {
+		if ok, _ := h.ipLimiter.Allow("ip:" + sourceIP(r)); !ok {
+			return nil, ErrRateLimited
+		}
+	}
+	if len(h.authenticators) == 0 {
+		return r, nil
+	}
+
+	var principal *Principal
+	var err error
+	for _, auth := range h.authenticators {
+		if principal, err = auth.Authenticate(r); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		h.logger.Warn().
+			Err(err).
+			Str("path", r.URL.Path).
+			Msg("Rejected API call with invalid credentials")
+		h.recordAudit(r, audit.Event{
+			Action: audit.ActionAuthFailure,
+			Status: http.StatusUnauthorized,
+			Error:  err.Error(),
+		})
+		return nil, ErrUnauthenticated
+	}
+
+	if h.callerLimiter != nil {
+		if ok, _ := h.callerLimiter.Allow("caller:" + principal.Name); !ok {
+			return nil, ErrRateLimited
+		}
+	}
+
+	if scope != "" && !principal.HasScope(scope) {
+		h.logger.Warn().
+			Str("caller", principal.Name).
+			Str("scope", scope).
+			Str("path", r.URL.Path).
+			Msg("API caller lacks required scope")
+		r = withPrincipal(r, principal)
+		h.recordAudit(r, audit.Event{
+			Action: audit.ActionAuthFailure,
+			Status: http.StatusForbidden,
+			Error:  "missing scope " + scope,
+		})
+		return nil, ErrPermissionDenied
+	}
+	return withPrincipal(r, principal), nil
+}
+
+// AuthorizeCall fails with ErrPermissionDenied if the caller of r, as
+// returned by AuthenticateCall, may not manage the tunnel by its client
+// certificate policy or credentials. hostname is the tunnel's requested
+// hostname, or empty for an existing tunnel.
+func (h *Handler) AuthorizeCall(r *http.Request, tunnelID, hostname string) error {
+	if !h.authorizeTunnel(r, tunnelID, hostname) {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// CheckReservations fails with ErrPermissionDenied if another caller
+// reserved one of the hostnames
+func (h *Handler) CheckReservations(r *http.Request, hostnames ...string) error {
+	if err := h.checkReservations(r, hostnames...); err != nil {
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	return nil
+}
+
+// CallerIdentity names the caller of r by its credentials or client
+// certificate, empty for anonymous callers
+func CallerIdentity(r *http.Request) string {
+	return callerIdentity(r)
+}
+
+// CallerTenant returns the tenant owning the tunnels the caller of r
+// creates, empty for callers without credentials
+func CallerTenant(r *http.Request) string {
+	return tenantOf(r)
+}
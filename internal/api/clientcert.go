@@ -0,0 +1,101 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ClientCertPolicy maps client certificate identities to the tunnel ID
+// prefixes they may manage. A prefix of "*" allows every tunnel.
+type ClientCertPolicy map[string][]string
+
+// ParseClientCertPolicy parses a policy of the form
+// "identity=prefix|prefix,identity=prefix", e.g. "operator=k8s.|gw.,ci=ci-"
+func ParseClientCertPolicy(spec string) (ClientCertPolicy, error) {
+	policy := make(ClientCertPolicy)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		identity, prefixes, found := strings.Cut(entry, "=")
+		identity = strings.TrimSpace(identity)
+		if !found || identity == "" {
+			return nil, fmt.Errorf("expected identity=prefix, got %q", entry)
+		}
+
+		for _, prefix := range strings.Split(prefixes, "|") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				policy[identity] = append(policy[identity], prefix)
+			}
+		}
+		if len(policy[identity]) == 0 {
+			return nil, fmt.Errorf("no tunnel ID prefixes for %s", identity)
+		}
+	}
+	return policy, nil
+}
+
+// Allows reports whether the client that sent r may manage the tunnel. The
+// client's identities are the common name and DNS and URI SANs of its
+// verified certificate.
+func (p ClientCertPolicy) Allows(r *http.Request, tunnelID string) bool {
+	for _, identity := range clientIdentities(r) {
+		for _, prefix := range p[identity] {
+			if prefix == "*" || strings.HasPrefix(tunnelID, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientIdentities returns the identities of the request's verified client certificate
+func clientIdentities(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	identities := []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+// NewServerTLSConfig returns the TLS configuration of the API server. If
+// clientCAFile is set, client certificates are verified against it and, if
+// requireClientCert is set, required.
+func NewServerTLSConfig(clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	caCert, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no CA certificates found in %s", clientCAFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
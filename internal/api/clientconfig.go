@@ -0,0 +1,149 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// clientPrivateKeyPlaceholder stands in for the private key of clients
+	// that supplied their own public key, which the agent never sees
+	clientPrivateKeyPlaceholder = "<private key for wireguard_public_key>"
+
+	// qrCodeScale is the size of a QR code module in pixels
+	qrCodeScale = 4
+)
+
+// SetWireGuardEndpoint sets the host, optionally with a port, that tunnel
+// clients connect to for WireGuard, enabling wg-quick configurations in
+// create responses. Without a port the WireGuard listen port is used.
+func (h *Handler) SetWireGuardEndpoint(endpoint string) {
+	h.wireGuardEndpoint = endpoint
+}
+
+// SetExposePrivateKeys includes the private keys of the server's side of
+// tunnels in WireGuard configurations. Clients never need them, so they are
+// redacted by default.
+func (h *Handler) SetExposePrivateKeys(expose bool) {
+	h.exposePrivateKeys = expose
+}
+
+// clientKeys resolves the client key options of a request, generating a key
+// pair if asked to. It returns the client's private key, if generated, and
+// public key, or an error with the status code to report it with.
+func clientKeys(publicKey string, generate, includeQRCode bool) (string, string, int, error) {
+	if !generate {
+		if includeQRCode {
+			return "", "", http.StatusBadRequest, errors.New("include_qr_code requires generate_wireguard_keys")
+		}
+		return "", publicKey, 0, nil
+	}
+	if publicKey != "" {
+		return "", "", http.StatusBadRequest, errors.New("generate_wireguard_keys and wireguard_public_key are mutually exclusive")
+	}
+	privateKey, publicKey, err := tunnel.GenerateKeyPair()
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	return privateKey, publicKey, 0, nil
+}
+
+// clientConfig builds the WireGuard configuration handed to a tunnel client,
+// with a wg-quick configuration if the WireGuard endpoint is known
+func (h *Handler) clientConfig(config *tunnel.WireGuardConfig, clientPrivateKey string, includeQRCode bool) (WireGuardClientConfig, error) {
+	var resp WireGuardClientConfig
+	if config == nil {
+		return resp, nil
+	}
+	resp.WireGuardConfig = &WireGuardConfig{
+		PublicKey:  config.PublicKey,
+		ServerIP:   config.ServerIP,
+		ClientIP:   config.ClientIP,
+		Port:       config.Port,
+		ServerIPv6: config.ServerIPv6,
+		ClientIPv6: config.ClientIPv6,
+
+		PersistentKeepalive: config.PersistentKeepalive,
+		MTU:                 config.MTU,
+		Interface:           config.Interface,
+	}
+	if h.exposePrivateKeys {
+		resp.WireGuardConfig.PrivateKey = config.PrivateKey
+	}
+
+	if h.wireGuardEndpoint != "" {
+		resp.WireGuardQuickConfig = wgQuickConfig(resp.WireGuardConfig, clientPrivateKey, h.wireGuardEndpoint)
+		if includeQRCode {
+			qr, err := qrCodePNG(resp.WireGuardQuickConfig)
+			if err != nil {
+				return resp, err
+			}
+			resp.WireGuardQRCode = qr
+		}
+	}
+	return resp, nil
+}
+
+// wgQuickConfig renders the client side wg-quick configuration of a tunnel.
+// If privateKey is empty the client fills in its own.
+func wgQuickConfig(config *WireGuardConfig, privateKey, endpoint string) string {
+	if privateKey == "" {
+		privateKey = clientPrivateKeyPlaceholder
+	}
+	endpoint = withPort(endpoint, config.Port)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(&b, "Address = %s\n", dualStack(config.ClientIP, config.ClientIPv6))
+	if config.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", config.MTU)
+	}
+	fmt.Fprintf(&b, "\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", strings.TrimSpace(config.PublicKey))
+	fmt.Fprintf(&b, "Endpoint = %s\n", endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", dualStack(config.ServerIP, config.ServerIPv6))
+	if config.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", config.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+// dualStack formats the host addresses of an IPv4 and optional IPv6 address
+// withPort returns endpoint, adding port unless it has one
+func withPort(endpoint string, port int) string {
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return net.JoinHostPort(strings.Trim(endpoint, "[]"), strconv.Itoa(port))
+	}
+	return endpoint
+}
+
+func dualStack(ipv4, ipv6 string) string {
+	if ipv6 == "" {
+		return ipv4 + "/32"
+	}
+	return ipv4 + "/32, " + ipv6 + "/128"
+}
+
+// qrCodePNG encodes text as a base64 PNG QR code
+func qrCodePNG(text string) (string, error) {
+	code, err := qrcode.New(text, qrcode.Low)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode QR code: %v", err)
+	}
+	// A negative size is the number of pixels per module
+	image, err := code.PNG(-qrCodeScale)
+	if err != nil {
+		return "", fmt.Errorf("failed to render QR code: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(image), nil
+}
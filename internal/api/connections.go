@@ -0,0 +1,97 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+)
+
+// ConnectionTable lists and kills the proxied connections of the load
+// balancer
+type ConnectionTable interface {
+	Connections() []loadbalancer.Connection
+	KillConnection(id string) error
+}
+
+// SetConnectionTable serves the connections of table
+func (h *Handler) SetConnectionTable(table ConnectionTable) {
+	h.connections = table
+}
+
+// handleConnections lists the open connections, filtered by the tunnel_id
+// query parameter
+func (h *Handler) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.connections == nil {
+		h.sendError(w, "Connection introspection is not available", http.StatusNotFound)
+		return
+	}
+
+	tunnelID := r.URL.Query().Get("tunnel_id")
+	now := time.Now()
+	resp := ConnectionsResponse{Connections: []Connection{}}
+	for _, conn := range h.connections.Connections() {
+		if tunnelID != "" && conn.TunnelID != tunnelID {
+			continue
+		}
+		resp.Connections = append(resp.Connections, toConnection(conn, now))
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// handleKillConnection closes the connection of DELETE
+// /api/v1/admin/connections/{id} and returns it
+func (h *Handler) handleKillConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.connections == nil {
+		h.sendError(w, "Connection introspection is not available", http.StatusNotFound)
+		return
+	}
+
+	_, id, _ := strings.Cut(r.URL.Path, "/admin/connections/")
+	if id == "" || strings.Contains(id, "/") {
+		h.sendError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	var killed Connection
+	for _, conn := range h.connections.Connections() {
+		if conn.ID == id {
+			killed = toConnection(conn, time.Now())
+		}
+	}
+	err := h.connections.KillConnection(id)
+	if errors.Is(err, loadbalancer.ErrConnectionNotFound) {
+		h.sendError(w, fmt.Sprintf("Connection %s not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.sendJSON(w, killed, http.StatusOK)
+}
+
+func toConnection(conn loadbalancer.Connection, now time.Time) Connection {
+	return Connection{
+		ID:            conn.ID,
+		TunnelID:      conn.TunnelID,
+		ClientAddr:    conn.ClientAddr,
+		BackendAddr:   conn.BackendAddr,
+		Protocol:      conn.Protocol,
+		BytesReceived: conn.BytesReceived,
+		BytesSent:     conn.BytesSent,
+		Started:       conn.Started,
+		AgeSeconds:    now.Sub(conn.Started).Seconds(),
+	}
+}
@@ -0,0 +1,174 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of CORSConfig, the methods and request headers the API uses
+var (
+	DefaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type", IdempotencyKeyHeader}
+)
+
+// corsExposedHeaders are the response headers of the API that scripts of
+// other origins may read
+var corsExposedHeaders = strings.Join([]string{
+	"Content-Disposition",
+	"Deprecation",
+	"Idempotent-Replayed",
+	"Link",
+	"Retry-After",
+	"WWW-Authenticate",
+	"X-Leader-Address",
+}, ", ")
+
+// CORSConfig configures which browser origins may call the API
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed, as scheme://host[:port], or
+	// "*" for any origin. Without origins no cross-origin request is
+	// allowed.
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are the methods and request headers
+	// cross-origin requests may use, DefaultCORSMethods and
+	// DefaultCORSHeaders if empty
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials lets requests carry cookies and client certificates,
+	// and cannot be combined with any origin
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the result of a preflight
+	// request
+	MaxAge time.Duration
+}
+
+// CORS answers preflight requests and adds the CORS headers to the
+// responses of allowed origins
+type CORS struct {
+	config    CORSConfig
+	anyOrigin bool
+	origins   map[string]bool
+	methods   map[string]bool
+	headers   map[string]bool
+}
+
+// NewCORS validates config and returns its CORS middleware
+func NewCORS(config CORSConfig) (*CORS, error) {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = DefaultCORSMethods
+	}
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = DefaultCORSHeaders
+	}
+	if config.MaxAge < 0 {
+		return nil, fmt.Errorf("max age must not be negative")
+	}
+
+	c := &CORS{
+		config:  config,
+		origins: make(map[string]bool),
+		methods: make(map[string]bool),
+		headers: make(map[string]bool),
+	}
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", origin)
+		}
+		c.origins[strings.ToLower(origin)] = true
+	}
+	if c.anyOrigin && config.AllowCredentials {
+		return nil, fmt.Errorf("credentials cannot be allowed for any origin")
+	}
+	for _, method := range config.AllowedMethods {
+		c.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range config.AllowedHeaders {
+		c.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	return c, nil
+}
+
+// Wrap returns next with CORS applied. Requests of origins that are not
+// allowed are served without CORS headers, so browsers withhold the
+// response from the calling script, and their preflight requests are
+// refused.
+func (c *CORS) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowsOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if preflight {
+			c.preflight(w, r, origin)
+			return
+		}
+		c.setOrigin(w, origin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers a preflight request of an allowed origin, refusing
+// methods and headers that are not allowed
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if !c.methods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !c.headers[http.CanonicalHeaderKey(header)] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	c.setOrigin(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.config.AllowedMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.config.AllowedHeaders, ", "))
+	if c.config.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.config.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CORS) setOrigin(w http.ResponseWriter, origin string) {
+	if c.anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.config.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *CORS) allowsOrigin(origin string) bool {
+	return c.anyOrigin || c.origins[strings.ToLower(origin)]
+}
@@ -0,0 +1,52 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// validateEdgeAuth checks the edge authentication a tunnel creation
+// requests
+func validateEdgeAuth(auth *EdgeAuth) error {
+	settings := loadbalancer.EdgeAuth{BasicAuth: auth.BasicAuth, OIDC: (*loadbalancer.OIDCAuth)(auth.OIDC)}
+	return settings.Validate()
+}
+
+// tunnelEdgeAuth returns the edge authentication of a request, nil if it
+// has none
+func tunnelEdgeAuth(auth *EdgeAuth) *tunnel.EdgeAuth {
+	if auth == nil {
+		return nil
+	}
+	return &tunnel.EdgeAuth{BasicAuth: auth.BasicAuth, OIDC: (*tunnel.OIDCAuth)(auth.OIDC)}
+}
+
+// apiEdgeAuth returns the edge authentication of a tunnel as an API model,
+// nil if it has none
+func apiEdgeAuth(auth *tunnel.EdgeAuth) *EdgeAuth {
+	if auth == nil {
+		return nil
+	}
+	return &EdgeAuth{BasicAuth: auth.BasicAuth, OIDC: (*OIDCAuth)(auth.OIDC)}
+}
+
+// validateClientCertAuth checks the client certificate requirement a
+// tunnel creation requests, whose hostnames must be the tunnel's own
+func validateClientCertAuth(req *CreateTunnelRequest) error {
+	auth := loadbalancer.ClientCertAuth(*req.ClientCertAuth)
+	if err := auth.Validate(); err != nil {
+		return fmt.Errorf("invalid client_cert_auth: %v", err)
+	}
+	hostnames := append([]string{req.Hostname}, req.Hostnames...)
+	for _, hostname := range auth.Hostnames {
+		if !slices.ContainsFunc(hostnames, func(h string) bool { return strings.EqualFold(h, hostname) }) {
+			return fmt.Errorf("invalid client_cert_auth: %s is not a hostname of the tunnel", hostname)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// Machine-readable codes of error responses, in the error_code field
+const (
+	ErrorCodeInvalidRequest   = "invalid_request"
+	ErrorCodeUnauthorized     = "unauthorized"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeConflict         = "conflict"
+	ErrorCodeTooLarge         = "too_large"
+	ErrorCodeLimitExceeded    = "limit_exceeded"
+	ErrorCodeRateLimited      = "rate_limited"
+	ErrorCodeUnavailable      = "unavailable"
+	ErrorCodeInternal         = "internal_error"
+)
+
+// statusErrorCodes are the codes of error responses by status
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            ErrorCodeInvalidRequest,
+	http.StatusUnauthorized:          ErrorCodeUnauthorized,
+	http.StatusForbidden:             ErrorCodeForbidden,
+	http.StatusNotFound:              ErrorCodeNotFound,
+	http.StatusMethodNotAllowed:      ErrorCodeMethodNotAllowed,
+	http.StatusConflict:              ErrorCodeConflict,
+	http.StatusRequestEntityTooLarge: ErrorCodeTooLarge,
+	http.StatusTooManyRequests:       ErrorCodeRateLimited,
+	http.StatusServiceUnavailable:    ErrorCodeUnavailable,
+}
+
+// errorStatus returns the status to report err with: 404 Not Found, 409
+// Conflict or 429 Too Many Requests for errors of those kinds from the
+// tunnel manager and router, fallback for others
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, tunnel.ErrNotFound), errors.Is(err, loadbalancer.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, tunnel.ErrConflict), errors.Is(err, loadbalancer.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, tunnel.ErrLimitExceeded):
+		return http.StatusTooManyRequests
+	}
+	return fallback
+}
+
+// errorCode returns the code of err reported with status. Limits of the
+// agent and tenants are told apart from the API's rate limit.
+func errorCode(err error, status int) string {
+	if status == http.StatusTooManyRequests && errors.Is(err, tunnel.ErrLimitExceeded) {
+		return ErrorCodeLimitExceeded
+	}
+	if code, ok := statusErrorCodes[status]; ok {
+		return code
+	}
+	if status < http.StatusInternalServerError {
+		return ErrorCodeInvalidRequest
+	}
+	return ErrorCodeInternal
+}
+
+// sendErrorFor reports err with the status of its kind, or fallback
+func (h *Handler) sendErrorFor(w http.ResponseWriter, err error, fallback int) {
+	status := errorStatus(err, fallback)
+	h.sendErrorCode(w, err.Error(), status, errorCode(err, status))
+}
@@ -0,0 +1,96 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventKeepaliveInterval is how often an idle event stream sends a comment,
+// so that proxies and browsers do not time it out
+const eventKeepaliveInterval = 15 * time.Second
+
+// eventStreams ends the open event streams when the API shuts down, which
+// would otherwise wait for them
+type eventStreams struct {
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newEventStreams() *eventStreams {
+	return &eventStreams{done: make(chan struct{})}
+}
+
+// CloseEventStreams ends the open event streams, for http.Server's
+// RegisterOnShutdown
+func (h *Handler) CloseEventStreams() {
+	h.events.closeOnce.Do(func() { close(h.events.done) })
+}
+
+// handleEvents streams the lifecycle events of the tunnels the caller may
+// manage as server-sent events, optionally of a single tunnel
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tunnelID := r.URL.Query().Get("tunnel_id")
+
+	events, cancel := h.tunnelManager.Subscribe(64)
+	defer cancel()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		h.logger.Error().Err(err).Msg("Event stream cannot be flushed")
+		return
+	}
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.events.done:
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if tunnelID != "" && event.TunnelID != tunnelID {
+				continue
+			}
+			if !h.authorizeTunnel(r, event.TunnelID, event.Hostname) {
+				continue
+			}
+			data, err := json.Marshal(TunnelEvent{
+				Type:      string(event.Type),
+				TunnelID:  event.TunnelID,
+				Hostname:  event.Hostname,
+				Hostnames: event.Hostnames,
+				Time:      event.Time,
+				Message:   event.Message,
+			})
+			if err != nil {
+				h.logger.Error().Err(err).Msg("Failed to encode tunnel event")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: tunnel\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// validateExpiry checks the expiry a tunnel creation requests
+func validateExpiry(req *CreateTunnelRequest) error {
+	if req.TTLSeconds < 0 {
+		return errors.New("ttl_seconds must not be negative")
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
+
+// expiresAt returns when a tunnel creation requests the tunnel to be
+// removed, zero for never
+func expiresAt(req *CreateTunnelRequest) time.Time {
+	switch {
+	case req.ExpiresAt != nil:
+		return *req.ExpiresAt
+	case req.TTLSeconds > 0:
+		return time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
+	}
+	return time.Time{}
+}
+
+// tunnelExpiry returns when a tunnel expires and the seconds left until
+// then, nil for tunnels that do not expire
+func tunnelExpiry(t *tunnel.TunnelInfo) (*time.Time, int) {
+	if t.ExpiresAt.IsZero() {
+		return nil, 0
+	}
+	expires := t.ExpiresAt
+	return &expires, int(t.Remaining(time.Now()).Round(time.Second) / time.Second)
+}
+
+// handleRefresh moves the expiry of a tunnel to its TTL, or the requested
+// one, from now
+func (h *Handler) handleRefresh(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rejectStandby(w) {
+		return
+	}
+
+	// An empty body refreshes by the tunnel's TTL
+	var req RefreshTunnelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.tunnelManager.RefreshExpiry(id, time.Duration(req.TTLSeconds)*time.Second)
+	if err != nil {
+		h.sendErrorFor(w, err, http.StatusBadRequest)
+		return
+	}
+
+	resp := RefreshTunnelResponse{
+		TunnelID:   id,
+		ExpiresAt:  t.ExpiresAt,
+		TTLSeconds: int(t.TTL / time.Second),
+	}
+	_, resp.ExpiresInSeconds = tunnelExpiry(t)
+	h.sendJSON(w, resp, http.StatusOK)
+}
@@ -0,0 +1,95 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// validateFilterRules checks the request filter rules of a tunnel
+func validateFilterRules(rules []FilterRule) error {
+	converted := make([]loadbalancer.FilterRule, len(rules))
+	for i, rule := range rules {
+		converted[i] = loadbalancer.FilterRule(rule)
+	}
+	return loadbalancer.ValidateFilterRules(converted)
+}
+
+// tunnelFilterRules returns the request filter rules to set on a tunnel,
+// nil for none
+func tunnelFilterRules(rules []FilterRule) []tunnel.FilterRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	converted := make([]tunnel.FilterRule, len(rules))
+	for i, rule := range rules {
+		converted[i] = tunnel.FilterRule(rule)
+	}
+	return converted
+}
+
+// apiFilterRules returns the request filter rules of a tunnel for a
+// response
+func apiFilterRules(rules []tunnel.FilterRule) []FilterRule {
+	converted := make([]FilterRule, len(rules))
+	for i, rule := range rules {
+		converted[i] = FilterRule(rule)
+	}
+	return converted
+}
+
+// handleFilters reports, replaces or removes the request filter rules of a
+// tunnel
+func (h *Handler) handleFilters(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := h.tunnelManager.GetTunnel(id)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if h.rejectStandby(w) {
+			return
+		}
+		var req FilterRulesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateFilterRules(req.Rules); err != nil {
+			h.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if t.Protocol != "" && t.Protocol != tunnel.ProtocolHTTP && len(req.Rules) > 0 {
+			h.sendError(w, fmt.Sprintf("HTTP options cannot be used with the %s protocol", t.Protocol), http.StatusBadRequest)
+			return
+		}
+		if err := h.tunnelManager.SetRequestFilters(id, tunnelFilterRules(req.Rules)); err != nil {
+			h.sendErrorFor(w, err, http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if h.rejectStandby(w) {
+			return
+		}
+		if err := h.tunnelManager.SetRequestFilters(id, nil); err != nil {
+			h.sendErrorFor(w, err, http.StatusInternalServerError)
+			return
+		}
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.sendJSON(w, FilterRulesResponse{
+		TunnelID: id,
+		Rules:    apiFilterRules(h.tunnelManager.RequestFilters(id)),
+		Blocked:  h.tunnelManager.Stats().Filtered(id),
+	}, http.StatusOK)
+}
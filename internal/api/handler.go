@@ -3,37 +3,484 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ssh"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/stats"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tracing"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/usage"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
 	"github.com/rs/zerolog"
 )
 
+// maxRequestBodyBytes is the largest API request body read; larger bodies
+// get 413 Request Entity Too Large
+const maxRequestBodyBytes = 1 << 20
+
 // Handler handles HTTP requests for the tunnel API
 type Handler struct {
 	tunnelManager *tunnel.Manager
 	logger        *zerolog.Logger
 	startTime     time.Time
 	version       string
+	idempotency   *idempotencyStore
+
+	// leaderCheck reports whether this agent may change tunnels and, if
+	// not, the address of the agent that may
+	leaderCheck func() (bool, string)
+
+	// clientCertPolicy restricts which tunnels each client certificate may manage
+	clientCertPolicy ClientCertPolicy
+
+	// authenticators, if any, identify callers; each endpoint then requires a scope
+	authenticators []Authenticator
+
+	// auditLog, if set, records control-plane actions
+	auditLog *audit.Log
+
+	// usage, if set, serves the usage records exported for billing
+	usage *usage.Accountant
+
+	// connections, if set, lists and kills the load balancer's connections
+	connections ConnectionTable
+
+	// cache, if set, reports and purges the load balancer's cached
+	// responses
+	cache ResponseCache
+
+	// ipLimiter and callerLimiter, if set, limit requests per source IP
+	// and per authenticated caller
+	ipLimiter     *RateLimiter
+	callerLimiter *RateLimiter
+
+	// wireGuardEndpoint is the host[:port] tunnel clients reach WireGuard
+	// on; without it no wg-quick configurations are returned
+	wireGuardEndpoint string
+	// exposePrivateKeys includes the server's private keys in WireGuard
+	// configurations, which omit them by default
+	exposePrivateKeys bool
+	// secretsBox, if set, seals the connect tokens of exported tunnels
+	secretsBox *secrets.Box
+
+	// webSocket, if set, accepts the connections of tunnel clients on the
+	// WebSocket transport
+	webSocket http.Handler
+
+	// sshPort and sshHostKeyFingerprint describe the SSH server tunnel
+	// clients on the SSH transport log in to
+	sshPort               int
+	sshHostKeyFingerprint string
+
+	// policyLimits bound the timeouts and limits of tunnel policies
+	policyLimits PolicyLimits
+
+	// routes, if set, serves the routing table of the load balancer
+	routes RouteTable
+
+	// publicPorts and dnsRecords, if set, describe the URLs and DNS
+	// records of created tunnels
+	publicPorts PublicPorts
+	dnsRecords  DNSRecords
+
+	// statusSources describe the subsystems in the verbose status, and
+	// commit and buildDate identify the build
+	statusSources StatusSources
+	commit        string
+	buildDate     string
+
+	// events ends the open event streams on shutdown
+	events *eventStreams
+
+	// healthChecks decide readiness and the status of each component
+	healthChecks []healthCheck
+	// draining is set once shutdown begins, failing readiness
+	draining atomic.Bool
 }
 
 // NewHandler creates a new API handler
 func NewHandler(tunnelManager *tunnel.Manager, version string) *Handler {
 	return &Handler{
 		tunnelManager: tunnelManager,
-		logger:        utils.GetLogger(),
+		logger:        utils.GetModuleLogger(utils.ModuleAPI),
 		startTime:     time.Now(),
-		version:      version,
+		version:       version,
+		idempotency:   newIdempotencyStore(idempotencyKeyTTL),
+		events:        newEventStreams(),
 	}
 }
 
 // RegisterRoutes registers the API routes with the given router
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("/api/new-tunnel", h.handleCreateTunnel)
-	mux.HandleFunc("/api/remove-tunnel", h.handleRemoveTunnel)
-	mux.HandleFunc("/api/status", h.handleStatus)
+	routes := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/new-tunnel", h.rateLimited(h.authenticate(ScopeTunnelsCreate, h.audited(audit.ActionTunnelCreate, h.handleCreateTunnel)))},
+		{"/remove-tunnel", h.rateLimited(h.authenticate(ScopeTunnelsDelete, h.audited(audit.ActionTunnelRemove, h.handleRemoveTunnel)))},
+		{"/status", h.rateLimited(h.handleStatus)},
+		{"/openapi.json", h.handleOpenAPI},
+		{"/tunnels", h.rateLimited(h.authenticate(ScopeTunnelsRead, h.handleListTunnels))},
+		{"/events", h.rateLimited(h.authenticate(ScopeTunnelsRead, h.handleEvents))},
+		{"/tunnels/", h.rateLimited(h.authenticate("", h.handleTunnelAction))},
+		{"/hostname-reservations", h.rateLimited(h.authenticate("", h.handleHostnameReservations))},
+		{"/tenants/", h.rateLimited(h.authenticate(ScopeTunnelsRead, h.handleTenantUsage))},
+		{"/admin/log-level", h.rateLimited(h.authenticate(ScopeAdmin, h.audited(audit.ActionLogLevel, h.handleLogLevel)))},
+		{"/admin/audit", h.rateLimited(h.authenticate(ScopeAdmin, h.handleAudit))},
+		{"/admin/usage", h.rateLimited(h.authenticate(ScopeAdmin, h.handleUsage))},
+		{"/admin/routes", h.rateLimited(h.authenticate(ScopeAdmin, h.audited(audit.ActionStaticRoute, h.handleRoutes)))},
+		{"/admin/routes/validate", h.rateLimited(h.authenticate(ScopeAdmin, h.handleValidateRoute))},
+		{"/admin/export", h.rateLimited(h.authenticate(ScopeAdmin, h.handleExport))},
+		{"/admin/import", h.rateLimited(h.authenticate(ScopeAdmin, h.audited(audit.ActionImport, h.handleImport)))},
+		{"/admin/connections", h.rateLimited(h.authenticate(ScopeAdmin, h.handleConnections))},
+		{"/admin/connections/", h.rateLimited(h.authenticate(ScopeAdmin, h.audited(audit.ActionKillConn, h.handleKillConnection)))},
+		{"/ha/state", h.handleHAState},
+		{"/connect", h.rateLimited(h.handleConnect)},
+	}
+
+	// Endpoints are served under /api/v1 and, for clients written before
+	// the API was versioned, under /api
+	for _, route := range routes {
+		handler := limitBody(route.handler)
+		mux.HandleFunc(VersionPath(route.path), traced(VersionPath(route.path), h.versioned(APIVersion, handler)))
+		mux.HandleFunc("/api"+route.path, traced("/api"+route.path, h.deprecatedAlias(handler)))
+	}
+	mux.HandleFunc("/api/versions", h.handleVersions)
+	mux.HandleFunc("/metrics", h.rateLimited(h.authenticate(ScopeTunnelsRead, h.handleMetrics)))
+	mux.HandleFunc("/healthz", h.handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+}
+
+// SetWebSocketTransport accepts the connections of WebSocket tunnel clients
+// with transport. Clients authenticate with their tunnel's connect token
+// instead of API credentials.
+func (h *Handler) SetWebSocketTransport(transport http.Handler) {
+	h.webSocket = transport
+}
+
+// SetSSHServer tells clients of SSH tunnels to log in to the SSH server on
+// port, presenting the host key with hostKeyFingerprint
+func (h *Handler) SetSSHServer(port int, hostKeyFingerprint string) {
+	h.sshPort = port
+	h.sshHostKeyFingerprint = hostKeyFingerprint
+}
+
+// limitBody makes reading more than maxRequestBodyBytes of a request body
+// fail, before any handler buffers it
+func limitBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+		next(w, r)
+	}
+}
+
+// readBody reads the whole request body, answering 413 if it exceeds the
+// limit and 400 if it cannot be read; ok is false if it answered
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) (body []byte, ok bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.sendError(w, fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		} else {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if h.webSocket == nil {
+		h.sendError(w, "WebSocket transport is not enabled", http.StatusNotFound)
+		return
+	}
+	h.webSocket.ServeHTTP(w, r)
+}
+
+// connectURL returns the URL WebSocket tunnel clients connect to, as
+// reached by the request
+func connectURL(r *http.Request) string {
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	return scheme + "://" + r.Host + VersionPath("/connect")
+}
+
+// sshConfig returns the login details of an SSH tunnel's client, with the
+// agent's host as reached by the request
+func (h *Handler) sshConfig(r *http.Request, tunnelInfo *tunnel.TunnelInfo) *SSHConfig {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	login := tunnelInfo.ID + "@" + host
+	if strings.Contains(host, ":") {
+		login = tunnelInfo.ID + "@[" + host + "]"
+	}
+	return &SSHConfig{
+		Host:               host,
+		Port:               h.sshPort,
+		User:               tunnelInfo.ID,
+		Password:           tunnelInfo.ConnectToken,
+		HostKeyFingerprint: h.sshHostKeyFingerprint,
+		Command:            fmt.Sprintf("ssh -N -p %d -R 0:localhost:%d %s", h.sshPort, tunnelInfo.TargetPort, login),
+	}
+}
+
+// SetLeaderCheck makes the handler reject tunnel changes while check reports
+// that this agent is a standby
+func (h *Handler) SetLeaderCheck(check func() (bool, string)) {
+	h.leaderCheck = check
+}
+
+// SetClientCertPolicy restricts the tunnels clients may manage by the
+// identity of their TLS client certificate
+func (h *Handler) SetClientCertPolicy(policy ClientCertPolicy) {
+	h.clientCertPolicy = policy
+}
+
+// AddAuthenticator requires callers of the tunnel and admin endpoints to
+// authenticate. Authenticators are tried in the order they were added.
+func (h *Handler) AddAuthenticator(auth Authenticator) {
+	h.authenticators = append(h.authenticators, auth)
+}
+
+// authenticate wraps next to identify the caller and check that it was
+// granted scope, if authentication is enabled. An empty scope leaves the
+// check to next.
+func (h *Handler) authenticate(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(h.authenticators) == 0 {
+			next(w, r)
+			return
+		}
+
+		var principal *Principal
+		var err error
+		for _, auth := range h.authenticators {
+			if principal, err = auth.Authenticate(r); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			h.logger.Warn().
+				Err(err).
+				Str("path", r.URL.Path).
+				Msg("Rejected API request with invalid credentials")
+			h.recordAudit(r, audit.Event{
+				Action: audit.ActionAuthFailure,
+				Status: http.StatusUnauthorized,
+				Error:  err.Error(),
+			})
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			h.sendError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if h.callerLimiter != nil && !h.allow(w, r, h.callerLimiter, "caller:"+principal.Name) {
+			return
+		}
+
+		r = withPrincipal(r, principal)
+		if scope != "" && !h.requireScope(w, r, scope) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireScope responds with 403 and reports false if the caller was not granted scope
+func (h *Handler) requireScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	principal, ok := principalFrom(r)
+	if !ok || principal.HasScope(scope) {
+		return true
+	}
+	h.logger.Warn().
+		Str("caller", principal.Name).
+		Str("scope", scope).
+		Str("path", r.URL.Path).
+		Msg("API caller lacks required scope")
+	h.recordAudit(r, audit.Event{
+		Action: audit.ActionAuthFailure,
+		Status: http.StatusForbidden,
+		Error:  fmt.Sprintf("missing scope %s", scope),
+	})
+	h.sendError(w, fmt.Sprintf("Missing scope %s", scope), http.StatusForbidden)
+	return false
+}
+
+// authorizeTunnel reports whether the client may manage the tunnel. hostname
+// is the tunnel's requested hostname, or empty for an existing tunnel.
+func (h *Handler) authorizeTunnel(r *http.Request, tunnelID, hostname string) bool {
+	if len(h.clientCertPolicy) > 0 && !h.clientCertPolicy.Allows(r, tunnelID) {
+		h.logger.Warn().
+			Str("tunnel_id", tunnelID).
+			Strs("client_identities", clientIdentities(r)).
+			Msg("Client certificate not allowed to manage tunnel")
+		return false
+	}
+
+	principal, ok := principalFrom(r)
+	if !ok {
+		return true
+	}
+	if hostname == "" {
+		tunnelInfo, err := h.tunnelManager.GetTunnel(tunnelID)
+		if err != nil {
+			// Unknown tunnels are reported as such by the caller
+			return true
+		}
+		hostname = tunnelInfo.Hostname
+	}
+	if !principal.AllowsHostname(hostname) {
+		h.logger.Warn().
+			Str("tunnel_id", tunnelID).
+			Str("hostname", hostname).
+			Str("caller", principal.Name).
+			Msg("API caller not allowed to manage hostname")
+		return false
+	}
+	return true
+}
+
+// rejectStandby responds with 503 and reports true if this agent is a standby
+func (h *Handler) rejectStandby(w http.ResponseWriter) bool {
+	if h.leaderCheck == nil {
+		return false
+	}
+	isLeader, leaderAddress := h.leaderCheck()
+	if isLeader {
+		return false
+	}
+	if leaderAddress != "" {
+		w.Header().Set("X-Leader-Address", leaderAddress)
+	}
+	h.sendError(w, fmt.Sprintf("This agent is a standby; send requests to the leader at %s", leaderAddress), http.StatusServiceUnavailable)
+	return true
+}
+
+// handleTunnelAction dispatches /api/v1/tunnels/{id}/{action} requests
+func (h *Handler) handleTunnelAction(w http.ResponseWriter, r *http.Request) {
+	_, rest, _ := strings.Cut(r.URL.Path, "/tunnels/")
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[0] == "" {
+		h.sendError(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	id, action := parts[0], parts[1]
+	if !h.authorizeTunnel(r, id, "") {
+		h.sendError(w, "Not allowed to manage this tunnel", http.StatusForbidden)
+		return
+	}
+
+	switch action {
+	case "heartbeat":
+		// Heartbeats come from the clients that created the tunnel
+		if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.handleHeartbeat(w, r, id)
+		}
+	case "stats":
+		if h.requireScope(w, r, ScopeTunnelsRead) {
+			h.handleTunnelStats(w, r, id)
+		}
+	case "maintenance":
+		if r.Method == http.MethodGet {
+			if h.requireScope(w, r, ScopeTunnelsRead) {
+				h.handleMaintenance(w, r, id)
+			}
+		} else if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionMaintenance, func(w http.ResponseWriter, r *http.Request) {
+				h.handleMaintenance(w, r, id)
+			})(w, r)
+		}
+	case "hostnames":
+		if r.Method == http.MethodGet {
+			if h.requireScope(w, r, ScopeTunnelsRead) {
+				h.handleHostnames(w, r, id)
+			}
+		} else if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionHostnames, func(w http.ResponseWriter, r *http.Request) {
+				h.handleHostnames(w, r, id)
+			})(w, r)
+		}
+	case "mirror":
+		if r.Method == http.MethodGet {
+			if h.requireScope(w, r, ScopeTunnelsRead) {
+				h.handleMirror(w, r, id)
+			}
+		} else if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionMirror, func(w http.ResponseWriter, r *http.Request) {
+				h.handleMirror(w, r, id)
+			})(w, r)
+		}
+	case "filters":
+		if r.Method == http.MethodGet {
+			if h.requireScope(w, r, ScopeTunnelsRead) {
+				h.handleFilters(w, r, id)
+			}
+		} else if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionFilters, func(w http.ResponseWriter, r *http.Request) {
+				h.handleFilters(w, r, id)
+			})(w, r)
+		}
+	case "policy":
+		if r.Method == http.MethodGet {
+			if h.requireScope(w, r, ScopeTunnelsRead) {
+				h.handlePolicy(w, r, id)
+			}
+		} else if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionPolicy, func(w http.ResponseWriter, r *http.Request) {
+				h.handlePolicy(w, r, id)
+			})(w, r)
+		}
+	case "cache":
+		if r.Method == http.MethodGet {
+			if h.requireScope(w, r, ScopeTunnelsRead) {
+				h.handleCache(w, r, id)
+			}
+		} else if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionCachePurge, func(w http.ResponseWriter, r *http.Request) {
+				h.handleCache(w, r, id)
+			})(w, r)
+		}
+	case "pause", "resume":
+		if h.requireScope(w, r, ScopeTunnelsCreate) {
+			action := audit.ActionTunnelPause
+			if parts[1] == "resume" {
+				action = audit.ActionTunnelResume
+			}
+			h.audited(action, func(w http.ResponseWriter, r *http.Request) {
+				h.handlePause(w, r, id, parts[1] == "pause")
+			})(w, r)
+		}
+	case "refresh":
+		if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionTunnelRefresh, func(w http.ResponseWriter, r *http.Request) {
+				h.handleRefresh(w, r, id)
+			})(w, r)
+		}
+	case "rotate-keys":
+		if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionKeyRotate, func(w http.ResponseWriter, r *http.Request) {
+				h.handleRotateKeys(w, r, id)
+			})(w, r)
+		}
+	default:
+		h.sendError(w, "Not found", http.StatusNotFound)
+	}
 }
 
 func (h *Handler) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
@@ -41,30 +488,149 @@ func (h *Handler) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if h.rejectStandby(w) {
+		return
+	}
 
-	var req CreateTunnelRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+	body, ok := h.readBody(w, r)
+	if !ok {
 		return
 	}
 
-	// Validate request
-	if req.TunnelID == "" || req.Hostname == "" || req.TargetPort <= 0 {
-		h.sendError(w, "Missing required fields", http.StatusBadRequest)
+	// Replay the stored response if this Idempotency-Key was already used
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+	if idempotencyKey != "" {
+		stored, ok := h.idempotency.begin(idempotencyKey, body)
+		if !ok {
+			h.sendError(w, "Idempotency-Key is in use by another request", http.StatusConflict)
+			return
+		}
+		if stored != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			h.sendJSON(w, stored.body, stored.status)
+			return
+		}
+	}
+
+	resp, status, err := h.createTunnel(r, body)
+	if err != nil {
+		if idempotencyKey != "" {
+			h.idempotency.release(idempotencyKey)
+		}
+		h.sendErrorCode(w, err.Error(), status, errorCode(err, status))
 		return
 	}
 
+	if idempotencyKey != "" {
+		h.idempotency.complete(idempotencyKey, status, resp)
+	}
+	h.sendJSON(w, resp, status)
+}
+
+// createTunnel creates a tunnel from a request body and returns the response
+// with its status code, or an error with the status code to report it with
+func (h *Handler) createTunnel(r *http.Request, body []byte) (*CreateTunnelResponse, int, error) {
+	var req CreateTunnelRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid request body")
+	}
+
+	// Validate request
+	if req.Hostname == "" && len(req.Hostnames) > 0 {
+		req.Hostname, req.Hostnames = req.Hostnames[0], req.Hostnames[1:]
+	}
+	// Without a hostname the tunnel gets a subdomain of the base domain
+	baseDomain := h.tunnelManager.BaseDomain()
+	if req.TunnelID == "" || (req.Hostname == "" && baseDomain == "") || req.TargetPort <= 0 {
+		return nil, http.StatusBadRequest, errors.New("Missing required fields")
+	}
+	requested := []string{"*." + baseDomain}
+	if req.Hostname != "" {
+		hostname, err := loadbalancer.NormalizeHostname(req.Hostname)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		req.Hostname = hostname
+		requested = []string{hostname}
+	}
+	for i, hostname := range req.Hostnames {
+		var err error
+		if req.Hostnames[i], err = loadbalancer.NormalizeHostname(hostname); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	for _, hostname := range append(requested, req.Hostnames...) {
+		if !h.authorizeTunnel(r, req.TunnelID, hostname) {
+			return nil, http.StatusForbidden, errors.New("Not allowed to manage this tunnel")
+		}
+	}
+	if err := h.checkReservations(r, append([]string{req.Hostname}, req.Hostnames...)...); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	if err := h.validateSettings(&req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if req.MirrorTunnelID != "" {
+		if status, err := h.checkMirror(r, req.TunnelID, req.MirrorTunnelID, req.MirrorPercent); err != nil {
+			return nil, status, err
+		}
+	}
+
+	if req.Hostname == "" {
+		hostname, err := h.tunnelManager.GenerateHostname(req.TunnelID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		req.Hostname = hostname
+	}
+
+	switch req.Transport {
+	case "":
+	case tunnel.TransportWireGuard:
+		if req.WireGuardPublicKey == "" && !req.GenerateWireGuardKeys {
+			return nil, http.StatusBadRequest, errors.New("wireguard transport requires wireguard_public_key or generate_wireguard_keys")
+		}
+	default:
+		return h.createTransportTunnel(r, &req)
+	}
+
+	wgOptions := tunnel.WireGuardOptions{
+		PersistentKeepalive: req.PersistentKeepalive,
+		MTU:                 req.MTU,
+		KeyRotationInterval: time.Duration(req.KeyRotationIntervalSeconds) * time.Second,
+		Interface:           req.WireGuardInterface,
+	}
+	if err := wgOptions.Validate(); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if !h.tunnelManager.HasWireGuardInterface(wgOptions.Interface) {
+		return nil, http.StatusBadRequest, fmt.Errorf("unknown WireGuard interface %s", wgOptions.Interface)
+	}
+
+	clientPrivateKey, publicKey, status, err := clientKeys(req.WireGuardPublicKey, req.GenerateWireGuardKeys, req.IncludeQRCode)
+	if err != nil {
+		return nil, status, err
+	}
+
 	// Create the tunnel
-	tunnelInfo, err := h.tunnelManager.CreateTunnel(
+	span := managerSpan(r, "CreateTunnel", req.TunnelID)
+	tunnelInfo, err := h.tunnelManager.CreateTunnelForTenant(
+		tenantOf(r),
 		req.TunnelID,
 		req.Hostname,
 		req.TargetPort,
-		req.WireGuardPublicKey,
+		publicKey,
 		req.Metadata,
+		wgOptions,
 	)
+	if err == nil {
+		err = h.setProxyOptions(tunnelInfo.ID, &req)
+	}
+	tracing.End(span, err)
 	if err != nil {
-		h.sendError(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, errorStatus(err, http.StatusInternalServerError), err
 	}
 
 	// Prepare response
@@ -72,19 +638,228 @@ func (h *Handler) handleCreateTunnel(w http.ResponseWriter, r *http.Request) {
 		TunnelID:       tunnelInfo.ID,
 		PublicEndpoint: tunnelInfo.PublicEndpoint,
 	}
+	resp.WireGuardClientConfig, err = h.clientConfig(tunnelInfo.WireGuardConfig, clientPrivateKey, req.IncludeQRCode)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	resp.Resources = h.assignedResources(tunnelInfo)
+
+	return &resp, http.StatusCreated, nil
+}
+
+// validateSettings checks the settings of a tunnel creation that depend
+// neither on the caller nor on other tunnels
+func (h *Handler) validateSettings(req *CreateTunnelRequest) error {
+	if req.SSHPublicKey != "" && req.Transport != tunnel.TransportSSH {
+		return errors.New("ssh_public_key requires the ssh transport")
+	}
+	if err := validateProtocol(req); err != nil {
+		return err
+	}
+	if err := h.validatePolicy(requestedPolicy(req)); err != nil {
+		return err
+	}
+	if !req.BackendTLS && (req.BackendTLSServerName != "" || req.BackendTLSInsecureSkipVerify) {
+		return errors.New("backend TLS options require backend_tls")
+	}
+	if _, err := loadbalancer.ParseErrorPages(req.ErrorPages); err != nil {
+		return err
+	}
+	if req.HeaderRules != nil {
+		rules := loadbalancer.HeaderRules{
+			Request:  loadbalancer.HeaderRuleSet(req.HeaderRules.Request),
+			Response: loadbalancer.HeaderRuleSet(req.HeaderRules.Response),
+		}
+		if err := rules.Validate(); err != nil {
+			return err
+		}
+	}
+	rewrite := loadbalancer.HostRewrite{Host: req.HostRewrite, Origin: req.OriginRewrite}
+	if err := rewrite.Validate(); err != nil {
+		return err
+	}
+	if req.CompressionMinSize < 0 {
+		return fmt.Errorf("invalid compression minimum size: %d", req.CompressionMinSize)
+	}
+	if req.CacheMaxBytes < 0 || req.CacheMaxTTLSeconds < 0 {
+		return errors.New("cache limits must not be negative")
+	}
+	if _, err := loadbalancer.ParseCIDRs(req.AllowedIPs); err != nil {
+		return fmt.Errorf("invalid allowed_ips: %v", err)
+	}
+	if _, err := loadbalancer.ParseCIDRs(req.DeniedIPs); err != nil {
+		return fmt.Errorf("invalid denied_ips: %v", err)
+	}
+	if _, err := loadbalancer.ParseCountries(req.AllowedCountries); err != nil {
+		return fmt.Errorf("invalid allowed_countries: %v", err)
+	}
+	if _, err := loadbalancer.ParseCountries(req.DeniedCountries); err != nil {
+		return fmt.Errorf("invalid denied_countries: %v", err)
+	}
+	if err := validateFilterRules(req.RequestFilters); err != nil {
+		return err
+	}
+	if req.MirrorTunnelID == "" && req.MirrorPercent != 0 {
+		return errors.New("mirror_percent requires mirror_tunnel_id")
+	}
+	if req.EdgeAuth != nil {
+		if err := validateEdgeAuth(req.EdgeAuth); err != nil {
+			return err
+		}
+	}
+	if req.ClientCertAuth != nil {
+		if err := validateClientCertAuth(req); err != nil {
+			return err
+		}
+	}
+	if err := validateExpiry(req); err != nil {
+		return err
+	}
+	return tunnel.ValidateLabels(req.Labels)
+}
+
+// createTransportTunnel creates a tunnel on a transport other than WireGuard
+func (h *Handler) createTransportTunnel(r *http.Request, req *CreateTunnelRequest) (*CreateTunnelResponse, int, error) {
+	if req.WireGuardPublicKey != "" || req.GenerateWireGuardKeys || req.IncludeQRCode ||
+		req.PersistentKeepalive != 0 || req.MTU != 0 || req.KeyRotationIntervalSeconds != 0 || req.WireGuardInterface != "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("WireGuard options cannot be used with the %s transport", req.Transport)
+	}
+	if !h.tunnelManager.HasTransport(req.Transport) {
+		return nil, http.StatusBadRequest, fmt.Errorf("unknown transport %s", req.Transport)
+	}
 
-	// Add WireGuard config if available
-	if tunnelInfo.WireGuardConfig != nil {
-		resp.WireGuardConfig = &WireGuardConfig{
-			PublicKey:  tunnelInfo.WireGuardConfig.PublicKey,
-			PrivateKey: tunnelInfo.WireGuardConfig.PrivateKey,
-			ServerIP:   tunnelInfo.WireGuardConfig.ServerIP,
-			ClientIP:   tunnelInfo.WireGuardConfig.ClientIP,
-			Port:       tunnelInfo.WireGuardConfig.Port,
+	if req.SSHPublicKey != "" {
+		if _, err := ssh.ParseAuthorizedKey(req.SSHPublicKey); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid ssh_public_key: %v", err)
 		}
 	}
 
-	h.sendJSON(w, resp, http.StatusCreated)
+	span := managerSpan(r, "CreateTunnelOnTransport", req.TunnelID)
+	tunnelInfo, err := h.tunnelManager.CreateTunnelOnTransportForTenant(tenantOf(r), req.Transport, req.TunnelID, req.Hostname, req.TargetPort, req.Metadata,
+		tunnel.TransportOptions{SSHPublicKey: req.SSHPublicKey})
+	if err == nil {
+		err = h.setProxyOptions(tunnelInfo.ID, req)
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, errorStatus(err, http.StatusInternalServerError), err
+	}
+
+	resp := CreateTunnelResponse{
+		TunnelID:       tunnelInfo.ID,
+		PublicEndpoint: tunnelInfo.PublicEndpoint,
+	}
+	switch tunnelInfo.Transport {
+	case tunnel.TransportWebSocket:
+		resp.WebSocketConfig = &WebSocketConfig{URL: connectURL(r), Token: tunnelInfo.ConnectToken}
+	case tunnel.TransportSSH:
+		resp.SSHConfig = h.sshConfig(r, tunnelInfo)
+	}
+	resp.Resources = h.assignedResources(tunnelInfo)
+	return &resp, http.StatusCreated, nil
+}
+
+// validateProtocol checks the protocol a tunnel creation requests against
+// its transport and the options that only apply to HTTP
+func validateProtocol(req *CreateTunnelRequest) error {
+	transport := req.Transport
+	if transport == "" && (req.WireGuardPublicKey != "" || req.GenerateWireGuardKeys) {
+		transport = tunnel.TransportWireGuard
+	}
+	if err := tunnel.ValidateProtocol(req.Protocol, req.ListenPort, transport); err != nil {
+		return err
+	}
+	if req.Protocol == "" || req.Protocol == tunnel.ProtocolHTTP {
+		return nil
+	}
+	if req.BackendTLS || req.HeaderRules != nil || req.HostRewrite != "" || req.OriginRewrite != "" ||
+		req.Compression != nil || req.CompressionMinSize != 0 ||
+		len(req.ErrorPages) > 0 || requestedPolicy(req).httpOnly() ||
+		req.MirrorTunnelID != "" || req.Cache != nil || req.CacheMaxBytes != 0 || req.CacheMaxTTLSeconds != 0 ||
+		req.EdgeAuth != nil || req.ClientCertAuth != nil || len(req.RequestFilters) > 0 {
+		return fmt.Errorf("HTTP options cannot be used with the %s protocol", req.Protocol)
+	}
+	return nil
+}
+
+// backendTLS returns the HTTPS settings of the target a tunnel creation
+// requests, nil for plain HTTP
+func backendTLS(req *CreateTunnelRequest) *tunnel.BackendTLS {
+	if !req.BackendTLS {
+		return nil
+	}
+	return &tunnel.BackendTLS{
+		ServerName:         req.BackendTLSServerName,
+		InsecureSkipVerify: req.BackendTLSInsecureSkipVerify,
+	}
+}
+
+// setProxyOptions applies the load balancer settings a tunnel creation
+// requests to the created tunnel
+func (h *Handler) setProxyOptions(id string, req *CreateTunnelRequest) error {
+	if err := h.tunnelManager.SetInitialHostnames(id, append([]string{req.Hostname}, req.Hostnames...)); err != nil {
+		return err
+	}
+	if err := h.setPolicy(id, requestedPolicy(req)); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetBackendTLS(id, backendTLS(req)); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetErrorPages(id, req.ErrorPages); err != nil {
+		return err
+	}
+	var rules *tunnel.HeaderRules
+	if req.HeaderRules != nil {
+		rules = &tunnel.HeaderRules{
+			Request:  tunnel.HeaderRuleSet(req.HeaderRules.Request),
+			Response: tunnel.HeaderRuleSet(req.HeaderRules.Response),
+		}
+	}
+	if err := h.tunnelManager.SetHeaderRules(id, rules); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetHostRewrite(id, tunnel.HostRewrite{Host: req.HostRewrite, Origin: req.OriginRewrite}); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetCompression(id, tunnel.Compression{Enabled: req.Compression, MinSize: req.CompressionMinSize}); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetCache(id, tunnelCache(req.Cache, req.CacheMaxBytes, req.CacheMaxTTLSeconds)); err != nil {
+		return err
+	}
+	access := tunnel.AccessLists{AllowedIPs: req.AllowedIPs, DeniedIPs: req.DeniedIPs}
+	if len(req.AllowedCountries) > 0 {
+		access.AllowedCountries, _ = loadbalancer.ParseCountries(req.AllowedCountries)
+	}
+	if len(req.DeniedCountries) > 0 {
+		access.DeniedCountries, _ = loadbalancer.ParseCountries(req.DeniedCountries)
+	}
+	if err := h.tunnelManager.SetAccessLists(id, access); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetRequestFilters(id, tunnelFilterRules(req.RequestFilters)); err != nil {
+		return err
+	}
+	if req.MirrorTunnelID != "" {
+		if err := h.tunnelManager.SetMirror(id, &tunnel.Mirror{TunnelID: req.MirrorTunnelID, Percent: req.MirrorPercent}); err != nil {
+			return err
+		}
+	}
+	if err := h.tunnelManager.SetEdgeAuth(id, tunnelEdgeAuth(req.EdgeAuth)); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetClientCertAuth(id, (*tunnel.ClientCertAuth)(req.ClientCertAuth)); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetExpiry(id, expiresAt(req), time.Duration(req.TTLSeconds)*time.Second); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetLabels(id, req.Labels); err != nil {
+		return err
+	}
+	// Last, so the tunnel is only routed once its options are in place
+	return h.tunnelManager.SetProtocol(id, req.Protocol, req.ListenPort)
 }
 
 func (h *Handler) handleRemoveTunnel(w http.ResponseWriter, r *http.Request) {
@@ -92,6 +867,9 @@ func (h *Handler) handleRemoveTunnel(w http.ResponseWriter, r *http.Request) {
 		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if h.rejectStandby(w) {
+		return
+	}
 
 	var req RemoveTunnelRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -99,13 +877,29 @@ func (h *Handler) handleRemoveTunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.TunnelID == "" && req.Selector != "" {
+		h.removeSelectedTunnels(w, r, req.Selector)
+		return
+	}
 	if req.TunnelID == "" {
 		h.sendError(w, "Missing tunnel ID", http.StatusBadRequest)
 		return
 	}
+	if req.Selector != "" {
+		h.sendError(w, "Only one of tunnel_id and selector may be set", http.StatusBadRequest)
+		return
+	}
 
-	if err := h.tunnelManager.RemoveTunnel(req.TunnelID); err != nil {
-		h.sendError(w, err.Error(), http.StatusInternalServerError)
+	if !h.authorizeTunnel(r, req.TunnelID, "") {
+		h.sendError(w, "Not allowed to manage this tunnel", http.StatusForbidden)
+		return
+	}
+
+	span := managerSpan(r, "RemoveTunnel", req.TunnelID)
+	err := h.tunnelManager.RemoveTunnel(req.TunnelID)
+	tracing.End(span, err)
+	if err != nil {
+		h.sendErrorFor(w, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -115,6 +909,294 @@ func (h *Handler) handleRemoveTunnel(w http.ResponseWriter, r *http.Request) {
 	}, http.StatusOK)
 }
 
+func (h *Handler) handleHeartbeat(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rejectStandby(w) {
+		return
+	}
+
+	// An empty body is a valid heartbeat
+	var req HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	span := managerSpan(r, "Heartbeat", id)
+	tunnelInfo, err := h.tunnelManager.Heartbeat(id, req.Health, req.Version)
+	tracing.End(span, err)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp := HeartbeatResponse{
+		TunnelID:       tunnelInfo.ID,
+		Status:         string(tunnelInfo.Status),
+		TimeoutSeconds: int(h.tunnelManager.HeartbeatTimeout().Seconds()),
+	}
+	if config := tunnelInfo.WireGuardConfig; config != nil {
+		resp.WireGuardPublicKey = strings.TrimSpace(config.PublicKey)
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+func (h *Handler) handleRotateKeys(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rejectStandby(w) {
+		return
+	}
+
+	// An empty body rotates only the server keys
+	var req RotateKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.tunnelManager.GetTunnel(id)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if existing.WireGuardConfig == nil {
+		h.sendError(w, "Tunnel does not use WireGuard", http.StatusBadRequest)
+		return
+	}
+
+	clientPrivateKey, publicKey, status, err := clientKeys(req.WireGuardPublicKey, req.GenerateWireGuardKeys, req.IncludeQRCode)
+	if err != nil {
+		h.sendError(w, err.Error(), status)
+		return
+	}
+
+	span := managerSpan(r, "RotateKeys", id)
+	tunnelInfo, err := h.tunnelManager.RotateKeys(id, publicKey)
+	tracing.End(span, err)
+	if err != nil {
+		h.sendErrorFor(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := RotateKeysResponse{TunnelID: tunnelInfo.ID}
+	resp.WireGuardClientConfig, err = h.clientConfig(tunnelInfo.WireGuardConfig, clientPrivateKey, req.IncludeQRCode)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// handleMaintenance reports or changes a tunnel's maintenance mode
+func (h *Handler) handleMaintenance(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if h.rejectStandby(w) {
+			return
+		}
+		var req MaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := h.tunnelManager.SetMaintenance(id, req.Enabled); err != nil {
+			h.sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := h.tunnelManager.GetTunnel(id); err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.sendJSON(w, MaintenanceResponse{TunnelID: id, Enabled: h.tunnelManager.Maintenance(id)}, http.StatusOK)
+}
+
+// handleMirror reports, sets or removes the tunnel receiving copies of a
+// tunnel's requests
+func (h *Handler) handleMirror(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.tunnelManager.GetTunnel(id); err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if h.rejectStandby(w) {
+			return
+		}
+		var req MirrorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if status, err := h.checkMirror(r, id, req.MirrorTunnelID, req.Percent); err != nil {
+			h.sendError(w, err.Error(), status)
+			return
+		}
+		if err := h.tunnelManager.SetMirror(id, &tunnel.Mirror{TunnelID: req.MirrorTunnelID, Percent: req.Percent}); err != nil {
+			h.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if h.rejectStandby(w) {
+			return
+		}
+		if err := h.tunnelManager.SetMirror(id, nil); err != nil {
+			h.sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := MirrorResponse{TunnelID: id}
+	if mirror := h.tunnelManager.Mirror(id); mirror != nil {
+		resp.MirrorTunnelID = mirror.TunnelID
+		resp.Percent = mirror.Percent
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// checkMirror checks that a tunnel's requests may be mirrored to another
+// existing tunnel the caller may manage, returning the status code to
+// report the error with
+func (h *Handler) checkMirror(r *http.Request, id, mirrorID string, percent int) (int, error) {
+	if mirrorID == "" {
+		return http.StatusBadRequest, errors.New("mirror_tunnel_id is required")
+	}
+	if mirrorID == id {
+		return http.StatusBadRequest, errors.New("a tunnel cannot mirror its requests to itself")
+	}
+	if percent < 0 || percent > 100 {
+		return http.StatusBadRequest, fmt.Errorf("invalid mirror percent: %d", percent)
+	}
+	if _, err := h.tunnelManager.GetTunnel(mirrorID); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("mirror tunnel %s not found", mirrorID)
+	}
+	if !h.authorizeTunnel(r, mirrorID, "") {
+		return http.StatusForbidden, errors.New("Not allowed to mirror to this tunnel")
+	}
+	return http.StatusOK, nil
+}
+
+func (h *Handler) handleHostnames(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		if h.rejectStandby(w) {
+			return
+		}
+		var req HostnameRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		hostname, err := loadbalancer.NormalizeHostname(req.Hostname)
+		if err != nil {
+			h.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := h.tunnelManager.GetTunnel(id); err != nil {
+			h.sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !h.authorizeTunnel(r, id, hostname) {
+			h.sendError(w, "Not allowed to manage this hostname", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost {
+			if err := h.checkReservations(r, hostname); err != nil {
+				h.sendError(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			span := managerSpan(r, "AddHostname", id)
+			err = h.tunnelManager.AddHostname(id, hostname)
+			tracing.End(span, err)
+		} else {
+			span := managerSpan(r, "RemoveHostname", id)
+			err = h.tunnelManager.RemoveHostname(id, hostname)
+			tracing.End(span, err)
+		}
+		if err != nil {
+			h.sendErrorFor(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := h.tunnelManager.GetTunnel(id); err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.sendJSON(w, HostnamesResponse{TunnelID: id, Hostnames: h.tunnelManager.Hostnames(id)}, http.StatusOK)
+}
+
+func (h *Handler) handleTunnelStats(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunnelInfo, err := h.tunnelManager.GetTunnel(id)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp := TunnelStatsResponse{
+		TunnelID:     id,
+		TrafficStats: toTrafficStats(h.tunnelManager.Stats().Get(id)),
+
+		Status:         string(tunnelInfo.Status),
+		DegradedReason: tunnelInfo.DegradedReason,
+		HandshakeStale: tunnelInfo.HandshakeStale,
+
+		WireGuardBytesReceived: tunnelInfo.Peer.ReceivedBytes,
+		WireGuardBytesSent:     tunnelInfo.Peer.SentBytes,
+	}
+	resp.ExpiresAt, resp.ExpiresInSeconds = tunnelExpiry(tunnelInfo)
+	if filtered := h.tunnelManager.Stats().Filtered(id); len(filtered) > 0 {
+		resp.Filtered = filtered
+	}
+	if path := tunnelInfo.Path; !path.LastProbe.IsZero() {
+		resp.Path = &PathStats{
+			Probes:         path.Sent,
+			Lost:           path.Lost,
+			LossRatio:      path.LossRatio(),
+			RTTSeconds:     path.RTT.Seconds(),
+			LastRTTSeconds: path.LastRTT.Seconds(),
+			LastProbe:      path.LastProbe,
+		}
+	}
+
+	handshake, err := h.tunnelManager.LastHandshake(id)
+	if err != nil {
+		h.logger.Warn().
+			Err(err).
+			Str("tunnel_id", id).
+			Msg("Failed to read WireGuard handshake")
+	} else if !handshake.IsZero() {
+		resp.LastHandshake = &handshake
+	}
+
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
 func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -122,17 +1204,210 @@ func (h *Handler) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tunnels := h.tunnelManager.GetAllTunnels()
-	
-	h.sendJSON(w, StatusResponse{
-		Status:     "healthy",
-		Version:    h.version,
-		Uptime:     time.Since(h.startTime).String(),
-		NumTunnels: len(tunnels),
+
+	numDegraded, numStale := 0, 0
+	for _, t := range tunnels {
+		if t.Status == tunnel.StatusDegraded {
+			numDegraded++
+		}
+		if t.HandshakeStale {
+			numStale++
+		}
+	}
+
+	verbose, ok := h.verboseStatus(w, r)
+	if !ok {
+		return
+	}
+
+	components, healthy := h.checkComponents()
+	status := "healthy"
+	if !healthy {
+		status = "unhealthy"
+	}
+	if h.draining.Load() {
+		status = "draining"
+	}
+
+	resp := StatusResponse{
+		Status:             status,
+		Version:            h.version,
+		Uptime:             time.Since(h.startTime).String(),
+		NumTunnels:         len(tunnels),
+		NumDegraded:        numDegraded,
+		NumStaleHandshakes: numStale,
+		Traffic:            toTrafficStats(h.tunnelManager.Stats().Totals()),
+		Components:         components,
+	}
+	if verbose {
+		resp.Details = h.statusDetails()
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// handleHAState returns the configuration of all tunnels for standby agents to mirror
+func (h *Handler) handleHAState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := HAStateResponse{Tunnels: []HATunnel{}}
+	for _, t := range h.tunnelManager.GetAllTunnels() {
+		resp.Tunnels = append(resp.Tunnels, h.haTunnel(t))
+	}
+
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// haTunnel returns the configuration of a tunnel as passed to CreateTunnel
+// and the per-tunnel settings
+func (h *Handler) haTunnel(t *tunnel.TunnelInfo) HATunnel {
+	state := HATunnel{
+		TunnelID:           t.ID,
+		Hostname:           t.Hostname,
+		TargetPort:         t.TargetPort,
+		WireGuardPublicKey: t.ClientPublicKey,
+		Metadata:           t.Metadata,
+
+		PersistentKeepalive:        t.WireGuardOptions.PersistentKeepalive,
+		MTU:                        t.WireGuardOptions.MTU,
+		KeyRotationIntervalSeconds: int(t.WireGuardOptions.KeyRotationInterval / time.Second),
+		WireGuardInterface:         t.WireGuardOptions.Interface,
+
+		DialTimeoutSeconds:           int(t.ProxyTimeouts.Dial / time.Second),
+		ResponseHeaderTimeoutSeconds: int(t.ProxyTimeouts.ResponseHeader / time.Second),
+		MaxRequestDurationSeconds:    int(t.ProxyTimeouts.MaxRequest / time.Second),
+	}
+	if t.BackendTLS != nil {
+		state.BackendTLS = true
+		state.BackendTLSServerName = t.BackendTLS.ServerName
+		state.BackendTLSInsecureSkipVerify = t.BackendTLS.InsecureSkipVerify
+	}
+	state.ErrorPages = h.tunnelManager.ErrorPages(t.ID)
+	state.Maintenance = h.tunnelManager.Maintenance(t.ID)
+	state.Paused = t.Paused
+	state.Labels = t.Labels
+	state.Hostnames = t.Hostnames
+	state.Protocol = t.Protocol
+	state.ListenPort = t.ListenPort
+	if mirror := h.tunnelManager.Mirror(t.ID); mirror != nil {
+		state.MirrorTunnelID = mirror.TunnelID
+		state.MirrorPercent = mirror.Percent
+	}
+	state.EdgeAuth = apiEdgeAuth(h.tunnelManager.EdgeAuth(t.ID))
+	state.ClientCertAuth = (*ClientCertAuth)(h.tunnelManager.ClientCertAuth(t.ID))
+	if rules := h.tunnelManager.HeaderRules(t.ID); rules != nil {
+		state.HeaderRules = &HeaderRules{
+			Request:  HeaderRuleSet(rules.Request),
+			Response: HeaderRuleSet(rules.Response),
+		}
+	}
+	state.HostRewrite = t.HostRewrite.Host
+	state.OriginRewrite = t.HostRewrite.Origin
+	state.Compression = t.Compression.Enabled
+	state.CompressionMinSize = t.Compression.MinSize
+	state.Cache = t.Cache.Enabled
+	state.CacheMaxBytes = t.Cache.MaxBytes
+	state.CacheMaxTTLSeconds = int(t.Cache.MaxTTL / time.Second)
+	state.AllowedIPs = t.Access.AllowedIPs
+	state.DeniedIPs = t.Access.DeniedIPs
+	state.AllowedCountries = t.Access.AllowedCountries
+	state.DeniedCountries = t.Access.DeniedCountries
+	if len(t.RequestFilters) > 0 {
+		state.RequestFilters = apiFilterRules(t.RequestFilters)
+	}
+	state.ClientRequestsPerSecond = t.ClientLimits.RequestsPerSecond
+	state.ClientBurst = t.ClientLimits.Burst
+	state.ClientMaxConnections = t.ClientLimits.MaxConnections
+	state.MaxRequestBodyBytes = t.RequestPolicy.MaxRequestBody
+	state.RetryAttempts = t.RequestPolicy.RetryAttempts
+	if !t.ExpiresAt.IsZero() {
+		expires := t.ExpiresAt
+		state.ExpiresAt = &expires
+		state.TTLSeconds = int(t.TTL / time.Second)
+	}
+	return state
+}
+
+func (h *Handler) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Validate everything before applying so a bad entry changes nothing
+		if req.Level != "" {
+			if _, err := zerolog.ParseLevel(req.Level); err != nil {
+				h.sendError(w, fmt.Sprintf("Invalid log level: %s", req.Level), http.StatusBadRequest)
+				return
+			}
+		}
+		for module, level := range req.Modules {
+			if !utils.IsModule(module) {
+				h.sendError(w, fmt.Sprintf("Unknown log module: %s", module), http.StatusBadRequest)
+				return
+			}
+			if level == "" {
+				continue
+			}
+			if _, err := zerolog.ParseLevel(level); err != nil {
+				h.sendError(w, fmt.Sprintf("Invalid log level for module %s: %s", module, level), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.Level != "" {
+			_ = utils.SetLevel(req.Level)
+		}
+		for module, level := range req.Modules {
+			_ = utils.SetModuleLevel(module, level)
+		}
+
+		h.logger.Info().
+			Str("level", req.Level).
+			Interface("modules", req.Modules).
+			Msg("Log levels changed")
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	level, modules := utils.Levels()
+	h.sendJSON(w, LogLevelResponse{
+		Level:   level,
+		Modules: modules,
 	}, http.StatusOK)
 }
 
 // Helper functions for sending responses
 
+func toTrafficStats(snap stats.Snapshot) TrafficStats {
+	traffic := TrafficStats{
+		BytesSent:         snap.BytesSent,
+		BytesReceived:     snap.BytesReceived,
+		Requests:          snap.Requests,
+		ActiveConnections: snap.ActiveConnections,
+		Retries:           snap.Retries,
+		Denied:            snap.Denied,
+		RateLimited:       snap.RateLimited,
+	}
+	if snap.TCPAccepted > 0 {
+		traffic.TCP = &TCPStats{
+			Accepted:     snap.TCPAccepted,
+			Active:       snap.TCPActive,
+			BytesIn:      snap.TCPBytesIn,
+			BytesOut:     snap.TCPBytesOut,
+			DialFailures: snap.TCPDialFailures,
+		}
+	}
+	return traffic
+}
+
 func (h *Handler) sendJSON(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -142,9 +1417,15 @@ func (h *Handler) sendJSON(w http.ResponseWriter, data interface{}, status int)
 }
 
 func (h *Handler) sendError(w http.ResponseWriter, message string, status int) {
+	h.sendErrorCode(w, message, status, errorCode(nil, status))
+}
+
+// sendErrorCode sends an error response with a machine-readable code
+func (h *Handler) sendErrorCode(w http.ResponseWriter, message string, status int, code string) {
 	h.sendJSON(w, ErrorResponse{
-		Error:   http.StatusText(status),
-		Code:    status,
-		Details: message,
+		Error:     http.StatusText(status),
+		Code:      status,
+		ErrorCode: code,
+		Details:   message,
 	}, status)
-} 
\ No newline at end of file
+}
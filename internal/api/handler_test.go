@@ -1,13 +1,44 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/dns"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ssh"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/usage"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestNewHandler(t *testing.T) {
@@ -159,14 +190,14 @@ func TestHandleRemoveTunnel(t *testing.T) {
 			requestBody: RemoveTunnelRequest{
 				TunnelID: "non-existent",
 			},
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusNotFound,
 			validateResponse: func(t *testing.T, w *httptest.ResponseRecorder) {
 				var resp ErrorResponse
 				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
 					t.Fatalf("Failed to decode response: %v", err)
 				}
-				if resp.Code != http.StatusInternalServerError {
-					t.Errorf("Expected error code %d, got %d", http.StatusInternalServerError, resp.Code)
+				if resp.Code != http.StatusNotFound || resp.ErrorCode != ErrorCodeNotFound {
+					t.Errorf("Expected error code %d %s, got %d %s", http.StatusNotFound, ErrorCodeNotFound, resp.Code, resp.ErrorCode)
 				}
 			},
 		},
@@ -273,4 +304,3649 @@ func TestHandleStatus(t *testing.T) {
 			}
 		})
 	}
-} 
\ No newline at end of file
+} 
+func TestVerboseStatus(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	handler.SetBuildInfo("abc123", "2024-01-01")
+	saved := time.Now()
+	handler.SetStatusSources(StatusSources{
+		Listeners: func() []loadbalancer.ListenerState {
+			return []loadbalancer.ListenerState{{Name: "http", Protocol: "https", Address: ":443", Listening: true}}
+		},
+		WireGuard: func() []tunnel.WireGuardInterfaceStatus {
+			return []tunnel.WireGuardInterfaceStatus{{Name: "wg0", PublicKey: "cHVi", ListenPort: 51820, Peers: 2}}
+		},
+		Persistence: func() loadbalancer.RoutesFileStatus {
+			return loadbalancer.RoutesFileStatus{Path: "/var/lib/routes.json", LastSaved: saved}
+		},
+		ConfigChecksum: func() string { return "c0ffee" },
+	})
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsRead}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// The plain status stays public and without details
+	w := get("/api/v1/status", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"details"`) {
+		t.Errorf("Expected the status without details, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := get("/api/v1/status?verbose=false", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected verbose=false to be public, got %d", w.Code)
+	}
+	if w := get("/api/v1/status?verbose=yes", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid flag, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// The details need the admin scope
+	if w := get("/api/v1/status?verbose=true", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d without credentials, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := get("/api/v1/status?verbose=true", "ci-secret"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d without the admin scope, got %d", http.StatusForbidden, w.Code)
+	}
+
+	w = get("/api/v1/status?verbose=true", "ops-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var status StatusResponse
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	details := status.Details
+	if details == nil {
+		t.Fatal("Expected details in the verbose status")
+	}
+	if details.Build.Commit != "abc123" || details.Build.Date != "2024-01-01" || details.Build.GoVersion == "" {
+		t.Errorf("Unexpected build info %+v", details.Build)
+	}
+	if details.Runtime.Goroutines == 0 || details.Runtime.GOMAXPROCS == 0 {
+		t.Errorf("Expected runtime statistics, got %+v", details.Runtime)
+	}
+	if details.ConfigChecksum != "c0ffee" {
+		t.Errorf("Expected config checksum c0ffee, got %q", details.ConfigChecksum)
+	}
+	if len(details.Listeners) != 1 || !details.Listeners[0].Listening {
+		t.Errorf("Unexpected listeners %+v", details.Listeners)
+	}
+	if len(details.WireGuard) != 1 || details.WireGuard[0].PublicKey != "cHVi" || details.WireGuard[0].Peers != 2 {
+		t.Errorf("Unexpected WireGuard interfaces %+v", details.WireGuard)
+	}
+	if p := details.Persistence; p == nil || !p.Healthy || p.LastSaved == nil || !p.LastSaved.Equal(saved) {
+		t.Errorf("Unexpected persistence status %+v", p)
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	var wireGuardErr error
+	handler.AddHealthCheck("load_balancer", func() error { return nil })
+	handler.AddHealthCheck("wireguard", func() error { return wireGuardErr })
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := get("/readyz"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"ready"`) {
+		t.Errorf("Expected the agent to be ready, got %d: %s", w.Code, w.Body.String())
+	}
+
+	wireGuardErr = errors.New("WireGuard interface wg0 is down")
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Expected the agent to stay live, got %d", w.Code)
+	}
+	w := get("/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	var ready HealthResponse
+	if err := json.NewDecoder(w.Body).Decode(&ready); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := []ComponentStatus{
+		{Name: "load_balancer", Status: ComponentOK},
+		{Name: "wireguard", Status: ComponentFailing, Error: "WireGuard interface wg0 is down"},
+	}
+	if !reflect.DeepEqual(ready.Components, expected) {
+		t.Errorf("Expected components %+v, got %+v", expected, ready.Components)
+	}
+
+	var status StatusResponse
+	if err := json.NewDecoder(get("/api/v1/status").Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if status.Status != "unhealthy" || !reflect.DeepEqual(status.Components, expected) {
+		t.Errorf("Expected an unhealthy status with the failing component, got %+v", status)
+	}
+
+	// Draining fails readiness even with all components working
+	wireGuardErr = nil
+	handler.SetDraining()
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"status":"draining"`) {
+		t.Errorf("Expected the draining agent not to be ready, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := get("/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Expected the draining agent to stay live, got %d", w.Code)
+	}
+}
+
+func TestHandleHeartbeat(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	_, err := tunnelManager.CreateTunnel("test-1", "test.example.com", 8080, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		requestBody    interface{}
+		expectedStatus int
+	}{
+		{
+			name:           "Valid heartbeat",
+			method:         http.MethodPost,
+			path:           "/api/tunnels/test-1/heartbeat",
+			requestBody:    HeartbeatRequest{Health: "healthy", Version: "v1.0.0"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Empty heartbeat body",
+			method:         http.MethodPost,
+			path:           "/api/tunnels/test-1/heartbeat",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Non-existent tunnel",
+			method:         http.MethodPost,
+			path:           "/api/tunnels/non-existent/heartbeat",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Invalid method",
+			method:         http.MethodGet,
+			path:           "/api/tunnels/test-1/heartbeat",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "Unknown action",
+			method:         http.MethodPost,
+			path:           "/api/tunnels/test-1/unknown",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			if tt.requestBody != nil {
+				if err := json.NewEncoder(&body).Encode(tt.requestBody); err != nil {
+					t.Fatalf("Failed to encode request body: %v", err)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, &body)
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+
+	tunnelInfo, err := tunnelManager.GetTunnel("test-1")
+	if err != nil {
+		t.Fatalf("Failed to get test tunnel: %v", err)
+	}
+	if tunnelInfo.LastHeartbeat.IsZero() {
+		t.Error("Expected heartbeat to be recorded")
+	}
+}
+
+func TestHandleTunnelStats(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	_, err := tunnelManager.CreateTunnel("test-1", "test.example.com", 8080, "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	tunnelStats := tunnelManager.Stats().Tunnel("test-1")
+	tunnelStats.IncRequests()
+	tunnelStats.AddBytesReceived(10)
+	tunnelStats.AddBytesSent(20)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/tunnels/test-1/stats", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var resp TunnelStatsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Requests != 1 || resp.BytesReceived != 10 || resp.BytesSent != 20 {
+		t.Errorf("Unexpected stats: %+v", resp.TrafficStats)
+	}
+	if resp.LastHandshake != nil {
+		t.Error("Expected no handshake for tunnel without WireGuard")
+	}
+	if resp.Status != string(tunnel.StatusActive) || resp.HandshakeStale {
+		t.Errorf("Expected active tunnel without stale handshake, got %+v", resp)
+	}
+	if resp.Path != nil {
+		t.Errorf("Expected no path statistics for an unprobed tunnel, got %+v", resp.Path)
+	}
+
+	// Totals are reported in the status endpoint
+	req = httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var status StatusResponse
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if status.Traffic.Requests != 1 {
+		t.Errorf("Expected 1 total request, got %d", status.Traffic.Requests)
+	}
+
+	// Unknown tunnels are not found
+	req = httptest.NewRequest(http.MethodGet, "/api/tunnels/non-existent/stats", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	if _, err := tunnelManager.CreateTunnel("test-1", "test.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	tunnelStats := tunnelManager.Stats().Tunnel("test-1")
+	tunnelStats.IncRequests()
+	tunnelStats.AddBytesSent(20)
+	tunnelStats.IncProxyError("connection_refused")
+
+	if _, err := tunnelManager.CreateTunnel("db-1", "db.example.com", 5432, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	if err := tunnelManager.SetProtocol("db-1", tunnel.ProtocolTCP, 15432); err != nil {
+		t.Fatalf("Failed to set protocol: %v", err)
+	}
+	dbStats := tunnelManager.Stats().Tunnel("db-1")
+	dbStats.IncTCPAccepted()
+	dbStats.AddTCPBytesIn(64)
+	dbStats.ObserveTCPDuration(30 * time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected text/plain content type, got %s", ct)
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE easy_tunnel_tunnels gauge",
+		`easy_tunnel_tunnels{status="active"} 2`,
+		`easy_tunnel_tunnels{status="degraded"} 0`,
+		`easy_tunnel_reconcile_runs_total 0`,
+		`easy_tunnel_reconcile_drift_total{kind="missing_peer"} 0`,
+		`easy_tunnel_up{tunnel_id="test-1",hostname="test.example.com"} 1`,
+		`easy_tunnel_requests_total{tunnel_id="test-1",hostname="test.example.com"} 1`,
+		`easy_tunnel_sent_bytes_total{tunnel_id="test-1",hostname="test.example.com"} 20`,
+		`easy_tunnel_proxy_errors_total{tunnel_id="test-1",hostname="test.example.com",cause="connection_refused"} 1`,
+		`easy_tunnel_tcp_connections_total{tunnel_id="db-1",hostname="db.example.com"} 1`,
+		`easy_tunnel_tcp_received_bytes_total{tunnel_id="db-1",hostname="db.example.com"} 64`,
+		`easy_tunnel_tcp_connection_duration_seconds_bucket{tunnel_id="db-1",hostname="db.example.com",le="10"} 0`,
+		`easy_tunnel_tcp_connection_duration_seconds_bucket{tunnel_id="db-1",hostname="db.example.com",le="60"} 1`,
+		`easy_tunnel_tcp_connection_duration_seconds_bucket{tunnel_id="db-1",hostname="db.example.com",le="+Inf"} 1`,
+		`easy_tunnel_tcp_connection_duration_seconds_sum{tunnel_id="db-1",hostname="db.example.com"} 30`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "easy_tunnel_wireguard_handshake_stale{") {
+		t.Error("Expected no WireGuard samples for tunnel without WireGuard")
+	}
+	if strings.Contains(body, `easy_tunnel_tcp_connections_total{tunnel_id="test-1"`) {
+		t.Error("Expected no TCP samples for an HTTP tunnel")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/metrics", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tunnelManager := tunnel.NewManager(1)
+	if _, err := tunnelManager.CreateTunnel("app-1", "app.example.com", 8000, "", nil); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	handler := NewHandler(tunnelManager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	send := func(path string, body interface{}) ErrorResponse {
+		t.Helper()
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(body)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, &buf))
+		var resp ErrorResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp.Code != w.Code {
+			t.Errorf("Expected code %d to match the status, got %d", w.Code, resp.Code)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		body      interface{}
+		status    int
+		errorCode string
+	}{
+		{name: "Conflict", path: "/api/new-tunnel", body: CreateTunnelRequest{TunnelID: "app-1", Hostname: "other.example.com", TargetPort: 8000}, status: http.StatusConflict, errorCode: ErrorCodeConflict},
+		{name: "Limit exceeded", path: "/api/new-tunnel", body: CreateTunnelRequest{TunnelID: "app-2", Hostname: "app2.example.com", TargetPort: 8000}, status: http.StatusTooManyRequests, errorCode: ErrorCodeLimitExceeded},
+		{name: "Not found", path: "/api/remove-tunnel", body: RemoveTunnelRequest{TunnelID: "missing"}, status: http.StatusNotFound, errorCode: ErrorCodeNotFound},
+		{name: "Invalid request", path: "/api/new-tunnel", body: CreateTunnelRequest{TunnelID: "app-3"}, status: http.StatusBadRequest, errorCode: ErrorCodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		resp := send(tt.path, tt.body)
+		if resp.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, resp.Code)
+		}
+		if resp.ErrorCode != tt.errorCode {
+			t.Errorf("%s: expected error code %q, got %q", tt.name, tt.errorCode, resp.ErrorCode)
+		}
+	}
+}
+
+func TestHandleCreateTunnelIdempotency(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+
+	send := func(key string, body CreateTunnelRequest) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("Failed to encode request body: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/new-tunnel", &buf)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		handler.handleCreateTunnel(w, req)
+		return w
+	}
+
+	request := CreateTunnelRequest{
+		TunnelID:   "test-1",
+		Hostname:   "test.example.com",
+		TargetPort: 8080,
+	}
+
+	// First request creates the tunnel
+	w := send("key-1", request)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	// Retrying with the same key replays the stored response
+	w = send("key-1", request)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected replayed status code %d, got %d", http.StatusCreated, w.Code)
+	}
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected Idempotent-Replayed header on replay")
+	}
+	var resp CreateTunnelResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.TunnelID != "test-1" {
+		t.Errorf("Expected tunnel ID test-1, got %s", resp.TunnelID)
+	}
+
+	// Reusing the key for a different payload is rejected
+	different := request
+	different.Hostname = "other.example.com"
+	if w = send("key-1", different); w.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d for key reuse, got %d", http.StatusConflict, w.Code)
+	}
+
+	// An identical payload without a key also succeeds
+	if w = send("", request); w.Code != http.StatusCreated {
+		t.Errorf("Expected status code %d for identical create, got %d", http.StatusCreated, w.Code)
+	}
+
+	// A conflicting payload without a key still fails
+	if w = send("", different); w.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d for conflicting create, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Failed requests release their key so they can be retried
+	if w = send("key-2", CreateTunnelRequest{TunnelID: "test-2"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w = send("key-2", CreateTunnelRequest{TunnelID: "test-2", Hostname: "test2.example.com", TargetPort: 8081}); w.Code != http.StatusCreated {
+		t.Errorf("Expected status code %d after releasing key, got %d", http.StatusCreated, w.Code)
+	}
+}
+
+func TestHandleLogLevel(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	// Restore the default levels after the test
+	defer func() {
+		_ = utils.SetLevel("info")
+		utils.SetModuleLevels(nil)
+	}()
+
+	tests := []struct {
+		name           string
+		method         string
+		requestBody    interface{}
+		expectedStatus int
+		expectedLevel  string
+		expectedWG     string
+	}{
+		{
+			name:           "Set global and module levels",
+			method:         http.MethodPut,
+			requestBody:    LogLevelRequest{Level: "debug", Modules: map[string]string{"wireguard": "warn"}},
+			expectedStatus: http.StatusOK,
+			expectedLevel:  "debug",
+			expectedWG:     "warn",
+		},
+		{
+			name:           "Unknown module changes nothing",
+			method:         http.MethodPut,
+			requestBody:    LogLevelRequest{Level: "error", Modules: map[string]string{"proxy": "debug"}},
+			expectedStatus: http.StatusBadRequest,
+			expectedLevel:  "debug",
+			expectedWG:     "warn",
+		},
+		{
+			name:           "Invalid level",
+			method:         http.MethodPut,
+			requestBody:    LogLevelRequest{Level: "loud"},
+			expectedStatus: http.StatusBadRequest,
+			expectedLevel:  "debug",
+			expectedWG:     "warn",
+		},
+		{
+			name:           "Reset module level",
+			method:         http.MethodPut,
+			requestBody:    LogLevelRequest{Modules: map[string]string{"wireguard": ""}},
+			expectedStatus: http.StatusOK,
+			expectedLevel:  "debug",
+			expectedWG:     "",
+		},
+		{
+			name:           "Get current levels",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusOK,
+			expectedLevel:  "debug",
+			expectedWG:     "",
+		},
+		{
+			name:           "Invalid method",
+			method:         http.MethodPost,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedLevel:  "debug",
+			expectedWG:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			if tt.requestBody != nil {
+				if err := json.NewEncoder(&body).Encode(tt.requestBody); err != nil {
+					t.Fatalf("Failed to encode request body: %v", err)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, "/api/admin/log-level", &body)
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			level, modules := utils.Levels()
+			if level != tt.expectedLevel {
+				t.Errorf("Expected global level %s, got %s", tt.expectedLevel, level)
+			}
+			if modules["wireguard"] != tt.expectedWG {
+				t.Errorf("Expected wireguard level %q, got %q", tt.expectedWG, modules["wireguard"])
+			}
+		})
+	}
+}
+
+func TestStandbyMode(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	_, err := tunnelManager.CreateTunnel("test-1", "test.example.com", 8080, "", map[string]string{"team": "a"})
+	if err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	isLeader := false
+	handler.SetLeaderCheck(func() (bool, string) {
+		return isLeader, "http://10.0.0.1:8080"
+	})
+
+	// Standbys reject tunnel changes and point at the leader
+	body := bytes.NewBufferString(`{"tunnel_id":"test-2","hostname":"test2.example.com","target_port":8080}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/new-tunnel", body)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if leader := w.Header().Get("X-Leader-Address"); leader != "http://10.0.0.1:8080" {
+		t.Errorf("Expected leader address header, got %q", leader)
+	}
+
+	// The state endpoint works on any agent
+	req = httptest.NewRequest(http.MethodGet, "/api/ha/state", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var state HAStateResponse
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(state.Tunnels) != 1 || state.Tunnels[0].TunnelID != "test-1" || state.Tunnels[0].Metadata["team"] != "a" {
+		t.Errorf("Unexpected state %+v", state.Tunnels)
+	}
+
+	// The leader accepts tunnel changes
+	isLeader = true
+	body = bytes.NewBufferString(`{"tunnel_id":"test-2","hostname":"test2.example.com","target_port":8080}`)
+	req = httptest.NewRequest(http.MethodPost, "/api/new-tunnel", body)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+}
+
+func TestParseClientCertPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        string
+		expected    ClientCertPolicy
+		shouldError bool
+	}{
+		{
+			name:     "Single identity",
+			spec:     "operator=k8s.",
+			expected: ClientCertPolicy{"operator": {"k8s."}},
+		},
+		{
+			name:     "Multiple identities and prefixes",
+			spec:     "operator=k8s.|gw., ci=ci-",
+			expected: ClientCertPolicy{"operator": {"k8s.", "gw."}, "ci": {"ci-"}},
+		},
+		{
+			name:        "Missing prefix",
+			spec:        "operator=",
+			shouldError: true,
+		},
+		{
+			name:        "Missing identity",
+			spec:        "=k8s.",
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParseClientCertPolicy(tt.spec)
+			if tt.shouldError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(policy, tt.expected) {
+				t.Errorf("Expected policy %v, got %v", tt.expected, policy)
+			}
+		})
+	}
+}
+
+func TestClientCertPolicy(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	handler.SetClientCertPolicy(ClientCertPolicy{"operator": {"k8s."}})
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	withCert := func(req *http.Request, commonName string) *http.Request {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	tests := []struct {
+		name           string
+		commonName     string
+		tunnelID       string
+		expectedStatus int
+	}{
+		{
+			name:           "Allowed prefix",
+			commonName:     "operator",
+			tunnelID:       "k8s.web",
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Disallowed prefix",
+			commonName:     "operator",
+			tunnelID:       "ci-web",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Unknown identity",
+			commonName:     "intruder",
+			tunnelID:       "k8s.api",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.NewBufferString(`{"tunnel_id":"` + tt.tunnelID + `","hostname":"` + tt.tunnelID + `.example.com","target_port":8080}`)
+			req := withCert(httptest.NewRequest(http.MethodPost, "/api/new-tunnel", body), tt.commonName)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+
+	// Removal is scoped the same way
+	req := withCert(httptest.NewRequest(http.MethodPost, "/api/remove-tunnel", bytes.NewBufferString(`{"tunnel_id":"k8s.web"}`)), "intruder")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if _, err := tunnelManager.GetTunnel("k8s.web"); err != nil {
+		t.Error("Expected tunnel to be kept")
+	}
+}
+
+// signJWT creates an ES256 token with the given claims
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	jwksRequests := 0
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{"jwks_uri": "http://" + r.Host + "/jwks"})
+		case "/jwks":
+			jwksRequests++
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "EC",
+					"kid": "key-1",
+					"use": "sig",
+					"crv": "P-256",
+					"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+					"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+				}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	handler.AddAuthenticator(NewJWTAuthenticator(idp.URL, "easy-tunnel", "", "tunnel_hostnames"))
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":              idp.URL,
+			"aud":              []string{"easy-tunnel", "other"},
+			"sub":              "team-a",
+			"scope":            "tunnels:create tunnels:delete",
+			"exp":              time.Now().Add(time.Hour).Unix(),
+			"tunnel_hostnames": []string{"*.team-a.example.com"},
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		tunnelID       string
+		hostname       string
+		expectedStatus int
+	}{
+		{
+			name:           "Valid token for permitted hostname",
+			token:          signJWT(t, key, "key-1", claims(nil)),
+			tunnelID:       "web",
+			hostname:       "web.team-a.example.com",
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Hostname outside token scope",
+			token:          signJWT(t, key, "key-1", claims(nil)),
+			tunnelID:       "other",
+			hostname:       "web.team-b.example.com",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Missing token",
+			tunnelID:       "missing",
+			hostname:       "missing.team-a.example.com",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Expired token",
+			token:          signJWT(t, key, "key-1", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+			tunnelID:       "expired",
+			hostname:       "expired.team-a.example.com",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Wrong audience",
+			token:          signJWT(t, key, "key-1", claims(map[string]interface{}{"aud": "other"})),
+			tunnelID:       "audience",
+			hostname:       "audience.team-a.example.com",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Tampered token",
+			token:          signJWT(t, key, "key-1", claims(nil)) + "AA",
+			tunnelID:       "tampered",
+			hostname:       "tampered.team-a.example.com",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.NewBufferString(`{"tunnel_id":"` + tt.tunnelID + `","hostname":"` + tt.hostname + `","target_port":8080}`)
+			req := httptest.NewRequest(http.MethodPost, "/api/new-tunnel", body)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// Existing tunnels are scoped by their hostname
+	if _, err := tunnelManager.CreateTunnel("team-b", "api.team-b.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/remove-tunnel", bytes.NewBufferString(`{"tunnel_id":"team-b"}`))
+	req.Header.Set("Authorization", "Bearer "+signJWT(t, key, "key-1", claims(nil)))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// The keys are cached between requests
+	if jwksRequests != 1 {
+		t.Errorf("Expected the JWKS to be fetched once, got %d", jwksRequests)
+	}
+}
+
+func TestJWTAlgorithmMustMatchKey(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// An ES256 token signed with a P-384 key over a SHA-256 digest
+	header, _ := json.Marshal(map[string]string{"alg": "ES256"})
+	signed := base64.RawURLEncoding.EncodeToString(header) + ".e30"
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, p384, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	signature := make([]byte, 96)
+	r.FillBytes(signature[:48])
+	s.FillBytes(signature[48:])
+
+	if err := verifySignature("ES256", &p384.PublicKey, signed, signature); err == nil {
+		t.Error("Expected ES256 signature by a P-384 key to be rejected")
+	}
+	if err := verifySignature("RS256", &p384.PublicKey, signed, signature); err == nil {
+		t.Error("Expected RS256 signature by an EC key to be rejected")
+	}
+}
+
+func TestJWKSFetchedOnce(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	var mu sync.Mutex
+	jwksRequests := 0
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		jwksRequests++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": "key-1",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	}))
+	defer idp.Close()
+
+	auth := NewJWTAuthenticator("https://idp.example.com", "easy-tunnel", idp.URL, "")
+	token := signJWT(t, key, "key-1", map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": "easy-tunnel",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	// Concurrent requests share a single fetch of the keys
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := auth.Verify(context.Background(), token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Verify failed: %v", err)
+		}
+	}
+	if jwksRequests != 1 {
+		t.Errorf("Expected the JWKS to be fetched once, got %d", jwksRequests)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsCreate, ScopeTunnelsRead}, Hostnames: []string{"*.preview.example.com"}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	if _, err := tunnelManager.CreateTunnel("prod", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "CI creates preview tunnel",
+			token:          "ci-secret",
+			method:         http.MethodPost,
+			path:           "/api/new-tunnel",
+			body:           `{"tunnel_id":"pr-1","hostname":"pr-1.preview.example.com","target_port":8080}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "CI cannot create production tunnel",
+			token:          "ci-secret",
+			method:         http.MethodPost,
+			path:           "/api/new-tunnel",
+			body:           `{"tunnel_id":"www","hostname":"www.example.com","target_port":8080}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "CI adds preview hostname",
+			token:          "ci-secret",
+			method:         http.MethodPost,
+			path:           "/api/tunnels/pr-1/hostnames",
+			body:           `{"hostname":"pr-1b.preview.example.com"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "CI cannot add production hostname",
+			token:          "ci-secret",
+			method:         http.MethodPost,
+			path:           "/api/tunnels/pr-1/hostnames",
+			body:           `{"hostname":"www.example.com"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Admin adds production hostname",
+			token:          "ops-secret",
+			method:         http.MethodPost,
+			path:           "/api/tunnels/pr-1/hostnames",
+			body:           `{"hostname":"www.example.com"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "CI cannot remove production hostname",
+			token:          "ci-secret",
+			method:         http.MethodDelete,
+			path:           "/api/tunnels/pr-1/hostnames",
+			body:           `{"hostname":"www.example.com"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "CI cannot delete tunnels",
+			token:          "ci-secret",
+			method:         http.MethodPost,
+			path:           "/api/remove-tunnel",
+			body:           `{"tunnel_id":"prod"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "CI reads preview tunnel stats",
+			token:          "ci-secret",
+			method:         http.MethodGet,
+			path:           "/api/tunnels/pr-1/stats",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "CI cannot change log levels",
+			token:          "ci-secret",
+			method:         http.MethodGet,
+			path:           "/api/admin/log-level",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Unknown token",
+			token:          "guess",
+			method:         http.MethodPost,
+			path:           "/api/remove-tunnel",
+			body:           `{"tunnel_id":"prod"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Admin deletes production tunnel",
+			token:          "ops-secret",
+			method:         http.MethodPost,
+			path:           "/api/remove-tunnel",
+			body:           `{"tunnel_id":"prod"}`,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewTokenStore(t *testing.T) {
+	tests := []struct {
+		name        string
+		tokens      []APIToken
+		shouldError bool
+	}{
+		{
+			name:   "Token hash",
+			tokens: []APIToken{{Name: "ci", TokenSHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", Scopes: []string{ScopeTunnelsRead}}},
+		},
+		{
+			name:        "Unknown scope",
+			tokens:      []APIToken{{Name: "ci", Token: "secret", Scopes: []string{"tunnels:write"}}},
+			shouldError: true,
+		},
+		{
+			name:        "Missing scopes",
+			tokens:      []APIToken{{Name: "ci", Token: "secret"}},
+			shouldError: true,
+		},
+		{
+			name:        "Invalid hash",
+			tokens:      []APIToken{{Name: "ci", TokenSHA256: "abc", Scopes: []string{ScopeAdmin}}},
+			shouldError: true,
+		},
+		{
+			name: "Duplicate name",
+			tokens: []APIToken{
+				{Name: "ci", Token: "a", Scopes: []string{ScopeAdmin}},
+				{Name: "ci", Token: "b", Scopes: []string{ScopeAdmin}},
+			},
+			shouldError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTokenStore(tt.tokens)
+			if tt.shouldError && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tt.shouldError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestTokenStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	write := func(content string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write tokens: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+	authenticate := func(store *TokenStore, token string) error {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/tunnels", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := store.Authenticate(req)
+		return err
+	}
+
+	now := time.Now()
+	write(`{"tokens": [{"name": "ci", "token": "old", "scopes": ["admin"]}]}`, now.Add(-time.Minute))
+	store, err := LoadTokenStore(path)
+	if err != nil {
+		t.Fatalf("LoadTokenStore() error = %v", err)
+	}
+	if changed, err := store.Reload(); changed || err != nil {
+		t.Errorf("Expected an unchanged file not to be reloaded, got %v %v", changed, err)
+	}
+
+	write(`{"tokens": [{"name": "ci", "token": "new", "scopes": ["admin"]}]}`, now)
+	if changed, err := store.Reload(); !changed || err != nil {
+		t.Fatalf("Expected the rotated file to be reloaded, got %v %v", changed, err)
+	}
+	if authenticate(store, "old") == nil || authenticate(store, "new") != nil {
+		t.Error("Expected only the rotated token to authenticate")
+	}
+
+	write(`{"tokens": [`, now.Add(time.Minute))
+	if _, err := store.Reload(); err == nil {
+		t.Error("Expected an invalid file to fail to reload")
+	}
+	if authenticate(store, "new") != nil {
+		t.Error("Expected an invalid file to keep the current tokens")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsCreate}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	handler.SetAuditLog(auditLog)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	send := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	createBody := `{"tunnel_id":"web","hostname":"web.example.com","target_port":8080}`
+	send(http.MethodPost, "/api/new-tunnel", "ci-secret", createBody)
+	send(http.MethodPost, "/api/new-tunnel", "ci-secret", `{"tunnel_id":"web","hostname":"other.example.com","target_port":9090}`)
+	send(http.MethodPost, "/api/remove-tunnel", "ci-secret", `{"tunnel_id":"web"}`)
+	send(http.MethodPost, "/api/remove-tunnel", "", `{"tunnel_id":"web"}`)
+
+	// Only admins may read the audit log
+	if w := send(http.MethodGet, "/api/admin/audit", "ci-secret", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	w := send(http.MethodGet, "/api/admin/audit", "ops-secret", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp AuditResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	expected := []struct {
+		action  string
+		caller  string
+		success bool
+	}{
+		{audit.ActionTunnelCreate, "ci", true},
+		{audit.ActionTunnelCreate, "ci", false},
+		{audit.ActionAuthFailure, "ci", false},
+		{audit.ActionAuthFailure, "", false},
+		{audit.ActionAuthFailure, "ci", false},
+	}
+	if len(resp.Events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), resp.Events)
+	}
+	for i, e := range expected {
+		event := resp.Events[i]
+		if event.Action != e.action || event.Caller != e.caller || event.Success != e.success {
+			t.Errorf("Event %d: expected %+v, got %+v", i, e, event)
+		}
+	}
+
+	created := resp.Events[0]
+	if created.TunnelID != "web" || created.SourceIP != "192.0.2.1" || created.PayloadSHA256 != audit.HashPayload([]byte(createBody)) {
+		t.Errorf("Unexpected create event %+v", created)
+	}
+	if resp.Events[1].Error == "" {
+		t.Error("Expected failed create to record its error")
+	}
+
+	w = send(http.MethodGet, "/api/admin/audit?action=tunnel.create&limit=1", "ops-secret", "")
+	resp = AuditResponse{}
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Events) != 1 || resp.Events[0].Success {
+		t.Errorf("Expected the latest create event, got %+v", resp.Events)
+	}
+}
+
+func TestUsageExport(t *testing.T) {
+	accountant, err := usage.Open(filepath.Join(t.TempDir(), "usage.log"), time.Hour, func() []usage.Sample {
+		return []usage.Sample{
+			{TunnelID: "web", Tenant: "acme", BytesSent: 300, BytesReceived: 30, Requests: 3},
+			{TunnelID: "api", Tenant: "other", BytesSent: 50},
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to open usage file: %v", err)
+	}
+	// Closing records the current bucket
+	if err := accountant.Close(); err != nil {
+		t.Fatalf("Failed to close usage file: %v", err)
+	}
+
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsRead}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	handler.SetUsageAccountant(accountant)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		token          string
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Only admins may export usage", token: "ci-secret", expectedStatus: http.StatusForbidden},
+		{name: "JSON", token: "ops-secret", expectedStatus: http.StatusOK, expectedBody: `"tunnel_id":"api"`},
+		{name: "By tenant", token: "ops-secret", query: "?tenant=acme&format=csv", expectedStatus: http.StatusOK, expectedBody: ",web,acme,300,30,3\n"},
+		{name: "Until excludes later buckets", token: "ops-secret", query: "?until=2000-01-01T00:00:00Z", expectedStatus: http.StatusOK, expectedBody: `{"records":[]}`},
+		{name: "Invalid since", token: "ops-secret", query: "?since=yesterday", expectedStatus: http.StatusBadRequest},
+		{name: "Invalid format", token: "ops-secret", query: "?format=xml", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/usage"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body containing %q, got %q", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+// fakeConnections is a connection table for tests
+type fakeConnections struct {
+	conns  []loadbalancer.Connection
+	killed []string
+}
+
+func (f *fakeConnections) Connections() []loadbalancer.Connection {
+	return f.conns
+}
+
+func (f *fakeConnections) KillConnection(id string) error {
+	for i, conn := range f.conns {
+		if conn.ID == id {
+			f.conns = append(f.conns[:i], f.conns[i+1:]...)
+			f.killed = append(f.killed, id)
+			return nil
+		}
+	}
+	return loadbalancer.ErrConnectionNotFound
+}
+
+func TestConnections(t *testing.T) {
+	table := &fakeConnections{conns: []loadbalancer.Connection{
+		{ID: "1", TunnelID: "web", ClientAddr: "203.0.113.5:40000", BackendAddr: "10.0.0.2:8080", Protocol: "websocket", BytesSent: 300, Started: time.Now()},
+		{ID: "2", TunnelID: "db", ClientAddr: "203.0.113.6:40001", BackendAddr: "10.0.0.3:5432", Protocol: "tcp", BytesReceived: 10, Started: time.Now()},
+	}}
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsRead}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	handler.SetConnectionTable(table)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		token          string
+		method         string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Only admins may list connections", token: "ci-secret", method: http.MethodGet, path: "/api/v1/admin/connections", expectedStatus: http.StatusForbidden},
+		{name: "List", token: "ops-secret", method: http.MethodGet, path: "/api/v1/admin/connections", expectedStatus: http.StatusOK, expectedBody: `"protocol":"tcp"`},
+		{name: "By tunnel", token: "ops-secret", method: http.MethodGet, path: "/api/v1/admin/connections?tunnel_id=web", expectedStatus: http.StatusOK, expectedBody: `"backend_addr":"10.0.0.2:8080"`},
+		{name: "Unknown tunnel", token: "ops-secret", method: http.MethodGet, path: "/api/v1/admin/connections?tunnel_id=api", expectedStatus: http.StatusOK, expectedBody: `{"connections":[]}`},
+		{name: "Wrong method", token: "ops-secret", method: http.MethodPost, path: "/api/v1/admin/connections", expectedStatus: http.StatusMethodNotAllowed},
+		{name: "Only admins may kill connections", token: "ci-secret", method: http.MethodDelete, path: "/api/v1/admin/connections/2", expectedStatus: http.StatusForbidden},
+		{name: "Kill", token: "ops-secret", method: http.MethodDelete, path: "/api/v1/admin/connections/2", expectedStatus: http.StatusOK, expectedBody: `"tunnel_id":"db"`},
+		{name: "Kill closed connection", token: "ops-secret", method: http.MethodDelete, path: "/api/v1/admin/connections/2", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body containing %q, got %q", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(table.killed, []string{"2"}) {
+		t.Errorf("Expected connection 2 to be killed, got %v", table.killed)
+	}
+}
+
+// fakeRoutes is a routing table for tests
+type fakeRoutes []loadbalancer.Route
+
+func (f fakeRoutes) Snapshot() []loadbalancer.Route {
+	return f
+}
+
+func TestListTunnelsAndRoutes(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	if _, err := tunnelManager.CreateTunnel("web", "web.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	if _, err := tunnelManager.CreateTunnel("api", "api.example.com", 9090, "", nil); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	handler := NewHandler(tunnelManager, "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsRead}},
+		{Name: "web", Token: "web-secret", Scopes: []string{ScopeTunnelsRead}, Hostnames: []string{"web.example.com"}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		token          string
+		path           string
+		routes         RouteTable
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "List", token: "ci-secret", path: "/api/v1/tunnels", expectedStatus: http.StatusOK, expectedBody: `{"tunnels":[{"tunnel_id":"api","hostname":"api.example.com"`},
+		{name: "List by hostname", token: "web-secret", path: "/api/v1/tunnels", expectedStatus: http.StatusOK, expectedBody: `{"tunnels":[{"tunnel_id":"web"`},
+		{name: "Only admins may list routes", token: "ci-secret", path: "/api/v1/admin/routes", routes: fakeRoutes{}, expectedStatus: http.StatusForbidden},
+		{name: "No routing table", token: "ops-secret", path: "/api/v1/admin/routes", expectedStatus: http.StatusNotFound},
+		{
+			name: "Routes", token: "ops-secret", path: "/api/v1/admin/routes",
+			routes: fakeRoutes{
+				{TunnelID: "web", Hostname: "web.example.com", IP: "10.0.0.2", Port: 8080,
+					Path: &loadbalancer.PathMatch{Type: loadbalancer.PathMatchPrefix, Value: "/app"}},
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"tunnel_id":"web","hostname":"web.example.com","path_type":"PathPrefix","path":"/app","ip":"10.0.0.2","port":8080}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.routes = tt.routes
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body containing %q, got %q", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStaticRoutes(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	send := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/admin/routes", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	handler.SetRouteTable(fakeRoutes{})
+	if w := send(http.MethodPost, `{"hostname": "example.com", "response": {}}`); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d without static routes, got %d", http.StatusNotFound, w.Code)
+	}
+	handler.SetRouteTable(loadbalancer.NewRouter(&loadbalancer.Config{}))
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name: "Redirect", method: http.MethodPost,
+			body:           `{"hostname": "example.com", "redirect": {"url": "https://www.example.com", "preserve_path": true}}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"redirect":{"url":"https://www.example.com","preserve_path":true}`,
+		},
+		{
+			name: "Response on a path", method: http.MethodPost,
+			body:           `{"hostname": "example.com", "path_type": "Exact", "path": "/healthz", "response": {"content_type": "application/json", "body": "{}"}}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"path":"/healthz","ip":"","port":0,"response":{"content_type":"application/json","body":"{}"}`,
+		},
+		{name: "Invalid redirect", method: http.MethodPost, body: `{"hostname": "old.example.com", "redirect": {"url": "www.example.com"}}`, expectedStatus: http.StatusBadRequest},
+		{name: "Invalid path", method: http.MethodPost, body: `{"hostname": "old.example.com", "path_type": "Regex", "path": "/", "response": {}}`, expectedStatus: http.StatusBadRequest},
+		{name: "Invalid body", method: http.MethodPost, body: `{`, expectedStatus: http.StatusBadRequest},
+		{name: "Remove", method: http.MethodDelete, body: `{"hostname": "example.com"}`, expectedStatus: http.StatusOK, expectedBody: `{"routes":[{"tunnel_id":"","hostname":"example.com","path_type":"Exact"`},
+		{name: "Remove missing", method: http.MethodDelete, body: `{"hostname": "example.com"}`, expectedStatus: http.StatusNotFound},
+		{name: "Method not allowed", method: http.MethodPatch, expectedStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.method, tt.body)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body containing %q, got %q", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateRoute(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	handler.SetRouteTable(fakeRoutes{})
+	if w := send("/api/v1/admin/routes/validate", `{"hostname": "example.com", "response": {}}`); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d without route validation, got %d", http.StatusNotFound, w.Code)
+	}
+
+	router := loadbalancer.NewRouter(&loadbalancer.Config{})
+	if err := router.AddRoute("app", "app.example.com", "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	handler.SetRouteTable(router)
+	if w := send("/api/v1/admin/routes", `{"hostname": "*.example.com", "path_type": "PathPrefix", "path": "/maintenance", "priority": 5, "response": {"status": 503}}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to add a wildcard static route: %d %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Wildcard behind a hostname",
+			body:           `{"tunnel_id": "web", "hostname": "*.example.com"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"valid":true,"overlaps":[{"route":{"tunnel_id":"app","hostname":"app.example.com","ip":"10.0.0.1","port":80},"outcome":"existing"},{"route":{"tunnel_id":"","hostname":"*.example.com","path_type":"PathPrefix","path":"/maintenance","priority":5,"ip":"","port":0,"response":{"status":503}},"outcome":"existing"}]}`,
+		},
+		{
+			name:           "Same path and priority",
+			body:           `{"tunnel_id": "web", "hostname": "*.example.com", "path_type": "PathPrefix", "path": "/maintenance", "priority": 5}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"valid":false,"error":"path /maintenance on hostname *.example.com is already in use with priority 5"`,
+		},
+		{
+			name:           "Higher priority",
+			body:           `{"tunnel_id": "web", "hostname": "*.example.com", "path_type": "PathPrefix", "path": "/maintenance", "priority": 6}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"priority":5,"ip":"","port":0,"response":{"status":503}},"outcome":"new"}`,
+		},
+		{
+			name:           "No overlaps",
+			body:           `{"tunnel_id": "web", "hostname": "web.example.org"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"valid":true,"overlaps":[]}`,
+		},
+		{name: "Invalid body", body: `{`, expectedStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send("/api/v1/admin/routes/validate", tt.body)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body containing %q, got %q", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+
+	if routes := router.Snapshot(); len(routes) != 3 {
+		t.Errorf("Expected validation to add no routes, got %+v", routes)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel",
+		bytes.NewBufferString(`{"tunnel_id":"web","hostname":"web.example.com","target_port":8080}`))
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	spans := recorder.Ended()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+		if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected span %s to continue the caller's trace", span.Name())
+		}
+	}
+	expected := []string{"tunnel.Manager.CreateTunnel", "POST /api/v1/new-tunnel"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected spans %v, got %v", expected, names)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(60, 2)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("Expected request %d within the burst to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := limiter.Allow("a")
+	if ok {
+		t.Fatal("Expected request beyond the burst to be limited")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("Expected retry within a second, got %v", retryAfter)
+	}
+
+	// Keys have their own buckets
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("Expected other key to be allowed")
+	}
+
+	// One token is added per second
+	now = now.Add(time.Second)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("Expected request to be allowed after refill")
+	}
+}
+
+func TestRateLimitedHandler(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsRead}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeTunnelsRead}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	handler.SetRateLimits(NewRateLimiter(60, 3), NewRateLimiter(60, 1))
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	send := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/tunnels/web/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// The first request of each caller gets through to the handler
+	if w := send("ci-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+	w := send("ci-secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", retryAfter)
+	}
+	if w := send("ops-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// The source IP has used its burst of 3
+	if w := send("ops-secret"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var doc OpenAPIDocument
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatalf("Failed to decode document: %v", err)
+	}
+	if doc.Info.Version != "test" {
+		t.Errorf("Expected version test, got %s", doc.Info.Version)
+	}
+
+	create := doc.Paths["/api/v1/new-tunnel"]["post"]
+	if create == nil || create.Responses["201"] == nil {
+		t.Fatal("Expected createTunnel operation with a 201 response")
+	}
+
+	request := doc.Components.Schemas["CreateTunnelRequest"]
+	if !reflect.DeepEqual(request.Required, []string{"tunnel_id", "hostname", "target_port"}) {
+		t.Errorf("Unexpected required fields %v", request.Required)
+	}
+	if request.Properties["metadata"].AdditionalProperties == nil {
+		t.Error("Expected metadata to be a string map")
+	}
+
+	// Embedded structs are flattened
+	stats := doc.Components.Schemas["TunnelStatsResponse"]
+	if stats.Properties["bytes_sent"] == nil || stats.Properties["last_handshake"].Format != "date-time" {
+		t.Errorf("Unexpected stats schema %+v", stats.Properties)
+	}
+	if doc.Components.Schemas["AuditEvent"] == nil {
+		t.Error("Expected audit events to be documented")
+	}
+}
+
+func TestAPIVersioning(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name              string
+		path              string
+		version           string
+		expectedStatus    int
+		expectDeprecation bool
+	}{
+		{
+			name:           "Versioned path",
+			path:           "/api/v1/status",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:              "Deprecated alias",
+			path:              "/api/status",
+			expectedStatus:    http.StatusOK,
+			expectDeprecation: true,
+		},
+		{
+			name:              "Alias with requested version",
+			path:              "/api/status",
+			version:           "v1",
+			expectedStatus:    http.StatusOK,
+			expectDeprecation: true,
+		},
+		{
+			name:           "Unsupported version on alias",
+			path:           "/api/status",
+			version:        "v9",
+			expectedStatus: http.StatusNotAcceptable,
+		},
+		{
+			name:           "Version header conflicting with path",
+			path:           "/api/v1/status",
+			version:        "v2",
+			expectedStatus: http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.version != "" {
+				req.Header.Set(APIVersionHeader, tt.version)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if version := w.Header().Get(APIVersionHeader); version != "v1" {
+				t.Errorf("Expected API version v1, got %q", version)
+			}
+			deprecated := w.Header().Get("Deprecation") == "true"
+			if deprecated != tt.expectDeprecation {
+				t.Errorf("Expected deprecation %v, got %v", tt.expectDeprecation, deprecated)
+			}
+			if deprecated && w.Header().Get("Link") != `</api/v1/status>; rel="successor-version"` {
+				t.Errorf("Unexpected successor link %q", w.Header().Get("Link"))
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/versions", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var versions VersionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&versions); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if versions.Current != "v1" || len(versions.Supported) != 1 {
+		t.Errorf("Unexpected versions %+v", versions)
+	}
+}
+
+func TestWGQuickConfig(t *testing.T) {
+	config := &WireGuardConfig{
+		PublicKey: "c2VydmVyLWtleQ==\n",
+		ServerIP:  "10.10.0.1",
+		ClientIP:  "10.10.0.2",
+		Port:      51820,
+
+		PersistentKeepalive: 25,
+	}
+
+	tests := []struct {
+		name       string
+		privateKey string
+		endpoint   string
+		mtu        int
+		ipv6       bool
+		expected   []string
+	}{
+		{
+			name:       "Generated key",
+			privateKey: "Y2xpZW50LWtleQ==",
+			endpoint:   "vpn.example.com",
+			expected: []string{
+				"[Interface]\nPrivateKey = Y2xpZW50LWtleQ==\nAddress = 10.10.0.2/32\n",
+				"[Peer]\nPublicKey = c2VydmVyLWtleQ==\nEndpoint = vpn.example.com:51820\nAllowedIPs = 10.10.0.1/32\nPersistentKeepalive = 25\n",
+			},
+		},
+		{
+			name:     "Client supplied key and endpoint port",
+			endpoint: "203.0.113.7:443",
+			expected: []string{"PrivateKey = " + clientPrivateKeyPlaceholder + "\n", "Endpoint = 203.0.113.7:443\n"},
+		},
+		{
+			name:     "IPv6 endpoint",
+			endpoint: "[2001:db8::1]",
+			expected: []string{"Endpoint = [2001:db8::1]:51820\n"},
+		},
+		{
+			name:     "Dual-stack addresses",
+			endpoint: "vpn.example.com",
+			ipv6:     true,
+			expected: []string{
+				"Address = 10.10.0.2/32, fd00:10::2/128\n",
+				"AllowedIPs = 10.10.0.1/32, fd00:10::1/128\n",
+			},
+		},
+		{
+			name:     "MTU",
+			endpoint: "vpn.example.com",
+			mtu:      1380,
+			expected: []string{"Address = 10.10.0.2/32\nMTU = 1380\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := *config
+			config.MTU = tt.mtu
+			if tt.ipv6 {
+				config.ServerIPv6, config.ClientIPv6 = "fd00:10::1", "fd00:10::2"
+			}
+			got := wgQuickConfig(&config, tt.privateKey, tt.endpoint)
+			for _, want := range tt.expected {
+				if !strings.Contains(got, want) {
+					t.Errorf("Expected config to contain %q, got:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestClientConfigRedactsServerPrivateKey(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	config := &tunnel.WireGuardConfig{
+		PublicKey:  "c2VydmVyLWtleQ==",
+		PrivateKey: "c2VydmVyLXByaXZhdGU=",
+		ServerIP:   "10.10.0.1",
+		ClientIP:   "10.10.0.2",
+		Port:       51820,
+	}
+
+	resp, err := handler.clientConfig(config, "", false)
+	if err != nil {
+		t.Fatalf("clientConfig() error = %v", err)
+	}
+	if resp.WireGuardConfig.PrivateKey != "" {
+		t.Errorf("Expected the server private key to be redacted, got %q", resp.WireGuardConfig.PrivateKey)
+	}
+
+	handler.SetExposePrivateKeys(true)
+	resp, err = handler.clientConfig(config, "", false)
+	if err != nil {
+		t.Fatalf("clientConfig() error = %v", err)
+	}
+	if resp.WireGuardConfig.PrivateKey != config.PrivateKey {
+		t.Errorf("Expected the server private key when exposed, got %q", resp.WireGuardConfig.PrivateKey)
+	}
+}
+
+// fakeDNSRecords reports fixed record states by hostname
+type fakeDNSRecords map[string]dns.RecordState
+
+func (f fakeDNSRecords) RecordState(hostname string) dns.RecordState {
+	return f[hostname]
+}
+
+func TestCreateTunnelResources(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	handler.SetPublicPorts(PublicPorts{HTTPPort: 8443, TLS: true})
+	handler.SetDNSRecords(fakeDNSRecords{
+		"app.example.com": {State: dns.RecordCreated, Records: []dns.Record{{Name: "app.example.com", Type: "A", Value: "203.0.113.10", TTL: 300}}},
+		"www.example.org": {State: dns.RecordUnmanaged},
+	})
+
+	body, _ := json.Marshal(CreateTunnelRequest{
+		TunnelID: "app", Hostnames: []string{"app.example.com", "www.example.org"}, TargetPort: 8080,
+	})
+	w := httptest.NewRecorder()
+	handler.handleCreateTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", bytes.NewBuffer(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var resp CreateTunnelResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := AssignedResources{
+		Hostnames: []string{"app.example.com", "www.example.org"},
+		URLs:      []string{"https://app.example.com:8443", "https://www.example.org:8443"},
+		DNSRecords: []DNSRecordStatus{
+			{Hostname: "app.example.com", State: dns.RecordCreated, Records: []DNSRecord{{Type: "A", Value: "203.0.113.10", TTL: 300}}},
+			{Hostname: "www.example.org", State: dns.RecordUnmanaged},
+		},
+	}
+	if !reflect.DeepEqual(resp.Resources, expected) {
+		t.Errorf("Expected resources %+v, got %+v", expected, resp.Resources)
+	}
+
+	// A TCP tunnel over WireGuard gets its port and the client's peer
+	// settings instead of URLs
+	handler.SetWireGuardEndpoint("vpn.example.com")
+	resources := handler.assignedResources(&tunnel.TunnelInfo{
+		ID: "db", Protocol: tunnel.ProtocolTCP, ListenPort: 15432,
+		WireGuardConfig: &tunnel.WireGuardConfig{ServerIP: "10.10.0.1", ServerIPv6: "fd00:10::1", Port: 51821},
+	})
+	expected = AssignedResources{
+		Ports:               []PortAssignment{{Protocol: tunnel.ProtocolTCP, Port: 15432}},
+		WireGuardEndpoint:   "vpn.example.com:51821",
+		WireGuardAllowedIPs: []string{"10.10.0.1/32", "fd00:10::1/128"},
+	}
+	if !reflect.DeepEqual(resources, expected) {
+		t.Errorf("Expected resources %+v, got %+v", expected, resources)
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	tests := []struct {
+		ports    PublicPorts
+		expected string
+	}{
+		{PublicPorts{HTTPPort: 443, TLS: true}, "https://app.example.com"},
+		{PublicPorts{HTTPPort: 80}, "http://app.example.com"},
+		{PublicPorts{HTTPPort: 443}, "http://app.example.com:443"},
+		{PublicPorts{HTTPPort: 8080}, "http://app.example.com:8080"},
+	}
+	for _, tt := range tests {
+		if got := publicURL("app.example.com", tt.ports); got != tt.expected {
+			t.Errorf("publicURL(%+v) = %s, expected %s", tt.ports, got, tt.expected)
+		}
+	}
+}
+
+func TestQRCodePNG(t *testing.T) {
+	encoded, err := qrCodePNG("[Interface]\nAddress = 10.10.0.2/32\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("QR code is not base64: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("QR code is not a PNG: %v", err)
+	}
+
+	// The top left finder pattern starts after a quiet zone of four modules
+	if r, _, _, _ := img.At(15, 15).RGBA(); r == 0 {
+		t.Error("Expected light quiet zone")
+	}
+	if r, _, _, _ := img.At(16, 16).RGBA(); r != 0 {
+		t.Error("Expected dark finder pattern")
+	}
+}
+
+func TestCreateTunnelClientConfigOptions(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	handler.SetWireGuardEndpoint("vpn.example.com")
+
+	tests := []struct {
+		name    string
+		request CreateTunnelRequest
+	}{
+		{
+			name: "QR code without generated keys",
+			request: CreateTunnelRequest{
+				TunnelID: "qr-1", Hostname: "qr.example.com", TargetPort: 80,
+				WireGuardPublicKey: "a2V5", IncludeQRCode: true,
+			},
+		},
+		{
+			name: "Keepalive out of range",
+			request: CreateTunnelRequest{
+				TunnelID: "qr-3", Hostname: "qr.example.com", TargetPort: 80,
+				WireGuardPublicKey: "a2V5", PersistentKeepalive: 70000,
+			},
+		},
+		{
+			name: "MTU too small",
+			request: CreateTunnelRequest{
+				TunnelID: "qr-4", Hostname: "qr.example.com", TargetPort: 80,
+				WireGuardPublicKey: "a2V5", MTU: 576,
+			},
+		},
+		{
+			name: "Generated keys with a public key",
+			request: CreateTunnelRequest{
+				TunnelID: "qr-2", Hostname: "qr.example.com", TargetPort: 80,
+				WireGuardPublicKey: "a2V5", GenerateWireGuardKeys: true,
+			},
+		},
+		{
+			name: "Unknown WireGuard interface",
+			request: CreateTunnelRequest{
+				TunnelID: "qr-5", Hostname: "qr.example.com", TargetPort: 80,
+				WireGuardPublicKey: "a2V5", WireGuardInterface: "wg9",
+			},
+		},
+		{
+			name: "WireGuard transport without a key",
+			request: CreateTunnelRequest{
+				TunnelID: "qr-6", Hostname: "qr.example.com", TargetPort: 80,
+				Transport: tunnel.TransportWireGuard,
+			},
+		},
+		{
+			name: "Unknown transport",
+			request: CreateTunnelRequest{
+				TunnelID: "qr-7", Hostname: "qr.example.com", TargetPort: 80,
+				Transport: "carrier-pigeon",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+			handler.handleCreateTunnel(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleRotateKeys(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	if _, err := tunnelManager.CreateTunnel("plain", "plain.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{"Invalid method", http.MethodGet, "/api/v1/tunnels/plain/rotate-keys", "", http.StatusMethodNotAllowed},
+		{"Unknown tunnel", http.MethodPost, "/api/v1/tunnels/missing/rotate-keys", "", http.StatusNotFound},
+		{"Tunnel without WireGuard", http.MethodPost, "/api/v1/tunnels/plain/rotate-keys", "", http.StatusBadRequest},
+		{"Invalid body", http.MethodPost, "/api/v1/tunnels/plain/rotate-keys", "{", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateWebSocketTunnel(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	transport := tunnel.NewWebSocketTransport()
+	if err := manager.AddTransport(transport); err != nil {
+		t.Fatalf("Unexpected error adding transport: %v", err)
+	}
+	handler := NewHandler(manager, "test")
+	handler.SetWebSocketTransport(transport)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		request        CreateTunnelRequest
+		expectedStatus int
+	}{
+		{
+			name: "WebSocket tunnel",
+			request: CreateTunnelRequest{
+				TunnelID: "ws-1", Hostname: "ws.example.com", TargetPort: 80,
+				Transport: tunnel.TransportWebSocket,
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "WebSocket tunnel with WireGuard options",
+			request: CreateTunnelRequest{
+				TunnelID: "ws-2", Hostname: "ws.example.com", TargetPort: 80,
+				Transport: tunnel.TransportWebSocket, WireGuardPublicKey: "a2V5",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusCreated {
+				return
+			}
+
+			var resp CreateTunnelResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp.WebSocketConfig == nil || resp.WebSocketConfig.Token == "" {
+				t.Fatalf("Expected WebSocket config with token, got %+v", resp.WebSocketConfig)
+			}
+			if resp.WebSocketConfig.URL != "ws://example.com/api/v1/connect" {
+				t.Errorf("Expected connect URL ws://example.com/api/v1/connect, got %s", resp.WebSocketConfig.URL)
+			}
+			if resp.WireGuardConfig != nil {
+				t.Error("Expected no WireGuard config for a WebSocket tunnel")
+			}
+		})
+	}
+
+	// The connect endpoint rejects unknown tokens
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/connect", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an invalid token, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestCreateSSHTunnel(t *testing.T) {
+	hostKey, err := ssh.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := tunnel.NewManager(10)
+	if err := manager.AddTransport(tunnel.NewSSHTransport(hostKey)); err != nil {
+		t.Fatalf("Unexpected error adding transport: %v", err)
+	}
+	handler := NewHandler(manager, "test")
+	handler.SetSSHServer(2222, ssh.HostKeyFingerprint(hostKey))
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	const authorizedKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKcddRAveBqgwRWzTW4EGQ450rLLf8Bgehjfy2nUam2f test"
+
+	tests := []struct {
+		name           string
+		request        CreateTunnelRequest
+		expectedStatus int
+	}{
+		{
+			name: "SSH tunnel",
+			request: CreateTunnelRequest{
+				TunnelID: "ssh-1", Hostname: "ssh.example.com", TargetPort: 8000,
+				Transport: tunnel.TransportSSH,
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "SSH tunnel with public key",
+			request: CreateTunnelRequest{
+				TunnelID: "ssh-2", Hostname: "ssh.example.com", TargetPort: 8000,
+				Transport: tunnel.TransportSSH, SSHPublicKey: authorizedKey,
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Invalid public key",
+			request: CreateTunnelRequest{
+				TunnelID: "ssh-3", Hostname: "ssh.example.com", TargetPort: 8000,
+				Transport: tunnel.TransportSSH, SSHPublicKey: "ssh-ed25519 !!!",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Public key without the SSH transport",
+			request: CreateTunnelRequest{
+				TunnelID: "ssh-4", Hostname: "ssh.example.com", TargetPort: 8000,
+				SSHPublicKey: authorizedKey,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusCreated {
+				return
+			}
+
+			var resp CreateTunnelResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp.SSHConfig == nil || resp.SSHConfig.Password == "" {
+				t.Fatalf("Expected SSH config with password, got %+v", resp.SSHConfig)
+			}
+			if resp.SSHConfig.HostKeyFingerprint != ssh.HostKeyFingerprint(hostKey) {
+				t.Errorf("Expected host key fingerprint %s, got %s", ssh.HostKeyFingerprint(hostKey), resp.SSHConfig.HostKeyFingerprint)
+			}
+			want := "ssh -N -p 2222 -R 0:localhost:8000 " + tt.request.TunnelID + "@example.com"
+			if resp.SSHConfig.Command != want {
+				t.Errorf("Expected command %q, got %q", want, resp.SSHConfig.Command)
+			}
+		})
+	}
+}
+
+func TestCreateTunnelProxyOptions(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		request        CreateTunnelRequest
+		expectedStatus int
+		expected       tunnel.ProxyTimeouts
+		expectedTLS    *tunnel.BackendTLS
+	}{
+		{
+			name: "Timeout overrides",
+			request: CreateTunnelRequest{
+				TunnelID: "slow-1", Hostname: "slow.example.com", TargetPort: 8000,
+				DialTimeoutSeconds: 5, ResponseHeaderTimeoutSeconds: 300, MaxRequestDurationSeconds: 600,
+			},
+			expectedStatus: http.StatusCreated,
+			expected:       tunnel.ProxyTimeouts{Dial: 5 * time.Second, ResponseHeader: 300 * time.Second, MaxRequest: 600 * time.Second},
+		},
+		{
+			name: "Negative timeout",
+			request: CreateTunnelRequest{
+				TunnelID: "slow-2", Hostname: "slow.example.com", TargetPort: 8000,
+				ResponseHeaderTimeoutSeconds: -1,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "HTTPS target",
+			request: CreateTunnelRequest{
+				TunnelID: "https-1", Hostname: "secure.example.com", TargetPort: 8443,
+				BackendTLS: true,
+			},
+			expectedStatus: http.StatusCreated,
+			expectedTLS:    &tunnel.BackendTLS{ServerName: "secure.example.com"},
+		},
+		{
+			name: "Invalid error page",
+			request: CreateTunnelRequest{
+				TunnelID: "pages-1", Hostname: "pages.example.com", TargetPort: 8000,
+				ErrorPages: map[string]string{"502": "{{.Host"},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid header rule",
+			request: CreateTunnelRequest{
+				TunnelID: "headers-1", Hostname: "headers.example.com", TargetPort: 8000,
+				HeaderRules: &HeaderRules{Response: HeaderRuleSet{Set: map[string]string{"Bad Header": "1"}}},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Origin rewrite with a path",
+			request: CreateTunnelRequest{
+				TunnelID: "origin-1", Hostname: "origin.example.com", TargetPort: 8000,
+				HostRewrite: "app.internal:8080", OriginRewrite: "http://app.internal:8080/",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Negative compression minimum size",
+			request: CreateTunnelRequest{
+				TunnelID: "gzip-1", Hostname: "gzip.example.com", TargetPort: 8000,
+				CompressionMinSize: -1,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Edge auth with an invalid hash",
+			request: CreateTunnelRequest{
+				TunnelID: "auth-1", Hostname: "auth.example.com", TargetPort: 8000,
+				EdgeAuth: &EdgeAuth{BasicAuth: map[string]string{"alice": "secret"}},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Edge auth with an http issuer",
+			request: CreateTunnelRequest{
+				TunnelID: "auth-2", Hostname: "auth.example.com", TargetPort: 8000,
+				EdgeAuth: &EdgeAuth{OIDC: &OIDCAuth{Issuer: "http://idp.example.com", ClientID: "app"}},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "OIDC edge auth",
+			request: CreateTunnelRequest{
+				TunnelID: "auth-3", Hostname: "auth.example.com", TargetPort: 8000,
+				EdgeAuth: &EdgeAuth{OIDC: &OIDCAuth{Issuer: "https://idp.example.com", ClientID: "app"}},
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Client certificate auth without a CA",
+			request: CreateTunnelRequest{
+				TunnelID: "mtls-1", Hostname: "mtls.example.com", TargetPort: 8000,
+				ClientCertAuth: &ClientCertAuth{CA: "not a certificate"},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid hostname",
+			request: CreateTunnelRequest{
+				TunnelID: "host-1", Hostname: "bad_host.example.com", TargetPort: 8000,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid allowed CIDR",
+			request: CreateTunnelRequest{
+				TunnelID: "acl-1", Hostname: "acl.example.com", TargetPort: 8000,
+				AllowedIPs: []string{"10.0.0.0/40"},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid country code",
+			request: CreateTunnelRequest{
+				TunnelID: "acl-2", Hostname: "acl.example.com", TargetPort: 8000,
+				DeniedCountries: []string{"Germany"},
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Negative client rate limit",
+			request: CreateTunnelRequest{
+				TunnelID: "limits-1", Hostname: "limits.example.com", TargetPort: 8000,
+				ClientRequestsPerSecond: -1,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Backend TLS options without backend_tls",
+			request: CreateTunnelRequest{
+				TunnelID: "https-2", Hostname: "secure.example.com", TargetPort: 8443,
+				BackendTLSInsecureSkipVerify: true,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "TCP protocol",
+			request: CreateTunnelRequest{
+				TunnelID: "db-1", Hostname: "db.example.com", TargetPort: 5432,
+				Protocol: tunnel.ProtocolTCP, ListenPort: 5432,
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "TCP protocol without listen port",
+			request: CreateTunnelRequest{
+				TunnelID: "db-2", Hostname: "db.example.com", TargetPort: 5432,
+				Protocol: tunnel.ProtocolTCP,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "UDP protocol over WebSocket",
+			request: CreateTunnelRequest{
+				TunnelID: "dns-1", Hostname: "dns.example.com", TargetPort: 53,
+				Transport: tunnel.TransportWebSocket, Protocol: tunnel.ProtocolUDP, ListenPort: 53,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "HTTP options with TLS passthrough",
+			request: CreateTunnelRequest{
+				TunnelID: "mail-1", Hostname: "mail.example.com", TargetPort: 993,
+				Protocol: tunnel.ProtocolTLS, BackendTLS: true,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Mirror to another tunnel",
+			request: CreateTunnelRequest{
+				TunnelID: "mirror-1", Hostname: "mirror.example.com", TargetPort: 8000,
+				MirrorTunnelID: "slow-1", MirrorPercent: 50,
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "Mirror to an unknown tunnel",
+			request: CreateTunnelRequest{
+				TunnelID: "mirror-2", Hostname: "mirror.example.com", TargetPort: 8000,
+				MirrorTunnelID: "missing",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Mirror percent without mirror tunnel",
+			request: CreateTunnelRequest{
+				TunnelID: "mirror-3", Hostname: "mirror.example.com", TargetPort: 8000,
+				MirrorPercent: 10,
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", bytes.NewBuffer(body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if got := manager.ProxyTimeouts(tt.request.TunnelID); got != tt.expected {
+				t.Errorf("Expected timeouts %+v, got %+v", tt.expected, got)
+			}
+			if got := manager.BackendTLS(tt.request.TunnelID); (got == nil) != (tt.expectedTLS == nil) || got != nil && *got != *tt.expectedTLS {
+				t.Errorf("Expected backend TLS %+v, got %+v", tt.expectedTLS, got)
+			}
+		})
+	}
+}
+
+func TestHostnames(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	body := `{"tunnel_id": "app-1", "hostnames": ["Example.com", "www.example.com."], "target_port": 8000}`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		tunnelID       string
+		body           string
+		expectedStatus int
+		expected       []string
+	}{
+		{name: "Created with hostnames", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK, expected: []string{"example.com", "www.example.com"}},
+		{name: "Add", method: http.MethodPost, tunnelID: "app-1", body: `{"hostname": "Shop.Example.org"}`, expectedStatus: http.StatusOK, expected: []string{"example.com", "www.example.com", "shop.example.org"}},
+		{name: "Remove", method: http.MethodDelete, tunnelID: "app-1", body: `{"hostname": "www.example.com"}`, expectedStatus: http.StatusOK, expected: []string{"example.com", "shop.example.org"}},
+		{name: "Remove unknown", method: http.MethodDelete, tunnelID: "app-1", body: `{"hostname": "www.example.com"}`, expectedStatus: http.StatusNotFound},
+		{name: "Invalid hostname", method: http.MethodPost, tunnelID: "app-1", body: `{"hostname": "bad host"}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown tunnel", method: http.MethodPost, tunnelID: "missing", body: `{"hostname": "example.net"}`, expectedStatus: http.StatusNotFound},
+		{name: "Invalid body", method: http.MethodPost, tunnelID: "app-1", body: `{`, expectedStatus: http.StatusBadRequest},
+		{name: "Method not allowed", method: http.MethodPut, tunnelID: "app-1", body: `{"hostname": "example.net"}`, expectedStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/tunnels/"+tt.tunnelID+"/hostnames", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp HostnamesResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if !reflect.DeepEqual(resp.Hostnames, tt.expected) {
+				t.Errorf("Expected hostnames %v, got %v", tt.expected, resp.Hostnames)
+			}
+		})
+	}
+
+	// Retrying the create keeps the hostnames added since
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d on retry, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if hostnames := manager.Hostnames("app-1"); !reflect.DeepEqual(hostnames, []string{"example.com", "shop.example.org"}) {
+		t.Errorf("Expected hostnames to be kept on retry, got %v", hostnames)
+	}
+
+	// A create with other hostnames conflicts and changes nothing
+	body = `{"tunnel_id": "app-1", "hostnames": ["example.com", "api.example.com"], "target_port": 8000}`
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	if hostnames := manager.Hostnames("app-1"); !reflect.DeepEqual(hostnames, []string{"example.com", "shop.example.org"}) {
+		t.Errorf("Expected hostnames to be unchanged, got %v", hostnames)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	if _, err := manager.CreateTunnel("app-1", "app.example.com", 8000, "", nil); err != nil {
+		t.Fatalf("Unexpected error creating tunnel: %v", err)
+	}
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		method         string
+		tunnelID       string
+		body           string
+		expectedStatus int
+		expected       bool
+	}{
+		{name: "Disabled by default", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK},
+		{name: "Enable", method: http.MethodPut, tunnelID: "app-1", body: `{"enabled": true}`, expectedStatus: http.StatusOK, expected: true},
+		{name: "Stays enabled", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK, expected: true},
+		{name: "Disable", method: http.MethodPut, tunnelID: "app-1", body: `{"enabled": false}`, expectedStatus: http.StatusOK},
+		{name: "Unknown tunnel", method: http.MethodPut, tunnelID: "missing", body: `{"enabled": true}`, expectedStatus: http.StatusNotFound},
+		{name: "Invalid body", method: http.MethodPut, tunnelID: "app-1", body: `{`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/tunnels/"+tt.tunnelID+"/maintenance", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp MaintenanceResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp.Enabled != tt.expected || manager.Maintenance(tt.tunnelID) != tt.expected {
+				t.Errorf("Expected maintenance %v, got %v", tt.expected, resp.Enabled)
+			}
+		})
+	}
+}
+
+func TestPause(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	if _, err := manager.CreateTunnel("web", "web.example.com", 8000, "", nil); err != nil {
+		t.Fatalf("Unexpected error creating tunnel: %v", err)
+	}
+	table := &fakeConnections{conns: []loadbalancer.Connection{
+		{ID: "1", TunnelID: "db", Protocol: "tcp"},
+		{ID: "2", TunnelID: "web", Protocol: "websocket"},
+	}}
+	handler := NewHandler(manager, "test")
+	handler.SetConnectionTable(table)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		method         string
+		tunnelID       string
+		action         string
+		expectedStatus int
+		expected       bool
+		expectedClosed int
+	}{
+		{name: "Pause", method: http.MethodPost, tunnelID: "web", action: "pause", expectedStatus: http.StatusOK, expected: true, expectedClosed: 1},
+		{name: "Pause again", method: http.MethodPost, tunnelID: "web", action: "pause", expectedStatus: http.StatusOK, expected: true},
+		{name: "Resume", method: http.MethodPost, tunnelID: "web", action: "resume", expectedStatus: http.StatusOK},
+		{name: "Unknown tunnel", method: http.MethodPost, tunnelID: "missing", action: "pause", expectedStatus: http.StatusNotFound},
+		{name: "Wrong method", method: http.MethodGet, tunnelID: "web", action: "pause", expectedStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/tunnels/"+tt.tunnelID+"/"+tt.action, nil)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp PauseResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp.Paused != tt.expected || manager.Paused(tt.tunnelID) != tt.expected {
+				t.Errorf("Expected paused %v, got %v", tt.expected, resp.Paused)
+			}
+			if resp.ClosedConnections != tt.expectedClosed {
+				t.Errorf("Expected %d closed connections, got %d", tt.expectedClosed, resp.ClosedConnections)
+			}
+		})
+	}
+	if len(table.conns) != 1 || table.conns[0].TunnelID != "db" {
+		t.Errorf("Expected only the connection of another tunnel to stay open, got %v", table.conns)
+	}
+}
+
+func TestTunnelExpiry(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	if w := create(`{"tunnel_id": "bad", "hostname": "bad.example.com", "target_port": 8000, "ttl_seconds": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a negative TTL, got %d", w.Code)
+	}
+	if w := create(`{"tunnel_id": "bad", "hostname": "bad.example.com", "target_port": 8000, "expires_at": "2000-01-01T00:00:00Z"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a past expiry, got %d", w.Code)
+	}
+	if w := create(`{"tunnel_id": "preview", "hostname": "preview.example.com", "target_port": 8000, "ttl_seconds": 600}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := create(`{"tunnel_id": "app", "hostname": "app.example.com", "target_port": 8000}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/tunnels", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var list TunnelsResponse
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Tunnels) != 2 {
+		t.Fatalf("Expected 2 tunnels, got %d", len(list.Tunnels))
+	}
+	if app := list.Tunnels[0]; app.ExpiresAt != nil || app.ExpiresInSeconds != 0 {
+		t.Errorf("Expected no expiry for app, got %v", app.ExpiresAt)
+	}
+	if preview := list.Tunnels[1]; preview.ExpiresAt == nil || preview.ExpiresInSeconds < 590 || preview.ExpiresInSeconds > 600 {
+		t.Errorf("Expected preview to expire in about 600 seconds, got %d", preview.ExpiresInSeconds)
+	}
+
+	tests := []struct {
+		name           string
+		tunnelID       string
+		body           string
+		expectedStatus int
+		expectedTTL    int
+	}{
+		{name: "Refresh by TTL", tunnelID: "preview", expectedStatus: http.StatusOK, expectedTTL: 600},
+		{name: "Refresh by new TTL", tunnelID: "preview", body: `{"ttl_seconds": 3600}`, expectedStatus: http.StatusOK, expectedTTL: 3600},
+		{name: "New TTL is kept", tunnelID: "preview", expectedStatus: http.StatusOK, expectedTTL: 3600},
+		{name: "No TTL", tunnelID: "app", expectedStatus: http.StatusBadRequest},
+		{name: "Negative TTL", tunnelID: "preview", body: `{"ttl_seconds": -5}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown tunnel", tunnelID: "missing", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/tunnels/"+tt.tunnelID+"/refresh", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp RefreshTunnelResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp.TTLSeconds != tt.expectedTTL || resp.ExpiresInSeconds < tt.expectedTTL-1 || resp.ExpiresInSeconds > tt.expectedTTL {
+				t.Errorf("Expected TTL %d, got %d expiring in %d seconds", tt.expectedTTL, resp.TTLSeconds, resp.ExpiresInSeconds)
+			}
+		})
+	}
+}
+
+func TestMirror(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	for _, id := range []string{"app-1", "app-2"} {
+		if _, err := manager.CreateTunnel(id, id+".example.com", 8000, "", nil); err != nil {
+			t.Fatalf("Unexpected error creating tunnel: %v", err)
+		}
+	}
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		method         string
+		tunnelID       string
+		body           string
+		expectedStatus int
+		expected       string
+	}{
+		{name: "None by default", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK},
+		{name: "Set", method: http.MethodPut, tunnelID: "app-1", body: `{"mirror_tunnel_id": "app-2", "percent": 10}`, expectedStatus: http.StatusOK, expected: "app-2"},
+		{name: "Stays set", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK, expected: "app-2"},
+		{name: "Itself", method: http.MethodPut, tunnelID: "app-1", body: `{"mirror_tunnel_id": "app-1"}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown mirror tunnel", method: http.MethodPut, tunnelID: "app-1", body: `{"mirror_tunnel_id": "missing"}`, expectedStatus: http.StatusBadRequest},
+		{name: "Invalid percent", method: http.MethodPut, tunnelID: "app-1", body: `{"mirror_tunnel_id": "app-2", "percent": 101}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown tunnel", method: http.MethodPut, tunnelID: "missing", body: `{"mirror_tunnel_id": "app-2"}`, expectedStatus: http.StatusNotFound},
+		{name: "Remove", method: http.MethodDelete, tunnelID: "app-1", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/tunnels/"+tt.tunnelID+"/mirror", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp MirrorResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp.MirrorTunnelID != tt.expected {
+				t.Errorf("Expected mirror tunnel %q, got %q", tt.expected, resp.MirrorTunnelID)
+			}
+		})
+	}
+}
+
+func TestTunnelPolicy(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	handler.SetPolicyLimits(PolicyLimits{MaxTimeout: 600 * time.Second, MaxRequestBody: 1 << 20})
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPost, "/api/v1/new-tunnel", `{"tunnel_id": "app-1", "hostname": "app.example.com", "target_port": 8000,
+		"dial_timeout_seconds": 5, "client_burst": 10,
+		"policy": {"dial_timeout_seconds": 10, "max_request_body_bytes": 1024, "retry_attempts": 0}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	timeouts := manager.ProxyTimeouts("app-1")
+	policy := manager.RequestPolicy("app-1")
+	if timeouts.Dial != 10*time.Second || manager.ClientLimits("app-1").Burst != 10 ||
+		policy.MaxRequestBody != 1024 || policy.RetryAttempts == nil || *policy.RetryAttempts != 0 {
+		t.Errorf("Expected the policy block to override the top-level fields, got %+v, %+v", timeouts, policy)
+	}
+
+	w = send(http.MethodPost, "/api/v1/new-tunnel", `{"tunnel_id": "app-2", "hostname": "app2.example.com", "target_port": 8000,
+		"policy": {"max_request_body_bytes": 2097152}}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "max_request_body_bytes exceeds the maximum") {
+		t.Errorf("Expected a policy over the maximums to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	w = send(http.MethodPost, "/api/v1/new-tunnel", `{"tunnel_id": "app-3", "hostname": "app3.example.com", "target_port": 8000,
+		"max_request_duration_seconds": 3600}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected top-level timeouts over the maximum to be rejected, got %d", w.Code)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		tunnelID       string
+		body           string
+		expectedStatus int
+		expected       TunnelPolicy
+	}{
+		{
+			name: "Get", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK,
+			expected: TunnelPolicy{DialTimeoutSeconds: 10, ClientBurst: 10, MaxRequestBodyBytes: 1024, RetryAttempts: new(int)},
+		},
+		{
+			name: "Replace", method: http.MethodPut, tunnelID: "app-1", body: `{"response_header_timeout_seconds": 300}`,
+			expectedStatus: http.StatusOK, expected: TunnelPolicy{ResponseHeaderTimeoutSeconds: 300},
+		},
+		{name: "Over the maximum", method: http.MethodPut, tunnelID: "app-1", body: `{"dial_timeout_seconds": 601}`, expectedStatus: http.StatusBadRequest},
+		{name: "Negative", method: http.MethodPut, tunnelID: "app-1", body: `{"retry_attempts": -1}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown tunnel", method: http.MethodGet, tunnelID: "missing", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.method, "/api/v1/tunnels/"+tt.tunnelID+"/policy", tt.body)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp TunnelPolicyResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if !reflect.DeepEqual(resp.Policy, tt.expected) {
+				t.Errorf("Expected policy %+v, got %+v", tt.expected, resp.Policy)
+			}
+		})
+	}
+}
+
+func TestRequestFilters(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPost, "/api/v1/new-tunnel", `{"tunnel_id": "app-1", "hostname": "app.example.com", "target_port": 8000,
+		"request_filters": [{"name": "dotfiles", "path": "^/\\.env"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if rules := manager.RequestFilters("app-1"); len(rules) != 1 || rules[0].Path != `^/\.env` {
+		t.Errorf("Expected the dotfiles rule, got %+v", rules)
+	}
+	w = send(http.MethodPost, "/api/v1/new-tunnel", `{"tunnel_id": "app-2", "hostname": "app2.example.com", "target_port": 8000,
+		"request_filters": [{"name": "bad", "path": "("}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid pattern to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	w = send(http.MethodPost, "/api/v1/new-tunnel", `{"tunnel_id": "app-3", "hostname": "app3.example.com", "target_port": 8000,
+		"protocol": "tls", "request_filters": [{"name": "wp", "path": "^/wp-"}]}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "HTTP options") {
+		t.Errorf("Expected filters of a TLS tunnel to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+
+	manager.Stats().Tunnel("app-1").IncFiltered("dotfiles")
+
+	tests := []struct {
+		name            string
+		method          string
+		tunnelID        string
+		body            string
+		expectedStatus  int
+		expectedRules   []string
+		expectedBlocked int64
+	}{
+		{name: "Get", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK, expectedRules: []string{"dotfiles"}, expectedBlocked: 1},
+		{
+			name: "Replace", method: http.MethodPut, tunnelID: "app-1",
+			body:           `{"rules": [{"name": "scanners", "user_agent": "(?i)nikto"}, {"name": "no-trace", "methods": ["TRACE"]}]}`,
+			expectedStatus: http.StatusOK, expectedRules: []string{"scanners", "no-trace"}, expectedBlocked: 1,
+		},
+		{name: "No conditions", method: http.MethodPut, tunnelID: "app-1", body: `{"rules": [{"name": "all"}]}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown tunnel", method: http.MethodGet, tunnelID: "missing", expectedStatus: http.StatusNotFound},
+		{name: "Remove", method: http.MethodDelete, tunnelID: "app-1", expectedStatus: http.StatusOK, expectedRules: []string{}, expectedBlocked: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.method, "/api/v1/tunnels/"+tt.tunnelID+"/filters", tt.body)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp FilterRulesResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			names := []string{}
+			for _, rule := range resp.Rules {
+				names = append(names, rule.Name)
+			}
+			if !reflect.DeepEqual(names, tt.expectedRules) {
+				t.Errorf("Expected rules %v, got %v", tt.expectedRules, names)
+			}
+			if resp.Blocked["dotfiles"] != tt.expectedBlocked {
+				t.Errorf("Expected %d requests blocked by dotfiles, got %v", tt.expectedBlocked, resp.Blocked)
+			}
+		})
+	}
+}
+
+func TestCreateTunnelGeneratedHostname(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/new-tunnel", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := create(`{"tunnel_id": "gen-1", "target_port": 8000}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d without a base domain, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+
+	manager.SetBaseDomain("*.tunnels.example.com")
+	w := create(`{"tunnel_id": "gen-1", "target_port": 8000}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var resp CreateTunnelResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if !strings.HasSuffix(resp.PublicEndpoint, ".tunnels.example.com") {
+		t.Fatalf("Expected a public endpoint under tunnels.example.com, got %q", resp.PublicEndpoint)
+	}
+	if hostnames := manager.Hostnames("gen-1"); !reflect.DeepEqual(hostnames, []string{resp.PublicEndpoint}) {
+		t.Errorf("Expected hostnames [%s], got %v", resp.PublicEndpoint, hostnames)
+	}
+
+	// Retrying returns the same hostname
+	w = create(`{"tunnel_id": "gen-1", "target_port": 8000}`)
+	var again CreateTunnelResponse
+	json.NewDecoder(w.Body).Decode(&again)
+	if w.Code != http.StatusCreated || again.PublicEndpoint != resp.PublicEndpoint {
+		t.Errorf("Expected public endpoint %s on retry, got %d %q", resp.PublicEndpoint, w.Code, again.PublicEndpoint)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	body := `{"tunnel_id": "big", "hostname": "big.example.com", "target_port": 8080, "metadata": {"padding": "` +
+		strings.Repeat("x", maxRequestBodyBytes) + `"}}`
+	for _, path := range []string{"/api/v1/new-tunnel", "/api/new-tunnel"} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d for %s, got %d: %s", http.StatusRequestEntityTooLarge, path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHostnameReservations(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := NewHandler(tunnelManager, "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "alice", Token: "alice-secret", Scopes: []string{ScopeTunnelsCreate, ScopeTunnelsRead}},
+		{Name: "mallory", Token: "mallory-secret", Scopes: []string{ScopeTunnelsCreate, ScopeTunnelsRead}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		token          string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Alice reserves hostname",
+			token:          "alice-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/hostname-reservations",
+			body:           `{"hostname":"App.example.com"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Mallory cannot reserve it",
+			token:          "mallory-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/hostname-reservations",
+			body:           `{"hostname":"app.example.com"}`,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Mallory cannot create a tunnel for it",
+			token:          "mallory-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/new-tunnel",
+			body:           `{"tunnel_id":"evil","hostname":"app.example.com","target_port":8080}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Mallory creates another tunnel",
+			token:          "mallory-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/new-tunnel",
+			body:           `{"tunnel_id":"evil","hostname":"evil.example.com","target_port":8080}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Mallory cannot add it to another tunnel",
+			token:          "mallory-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/tunnels/evil/hostnames",
+			body:           `{"hostname":"app.example.com"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Alice creates a tunnel for it",
+			token:          "alice-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/new-tunnel",
+			body:           `{"tunnel_id":"app","hostname":"app.example.com","target_port":8080}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Mallory cannot release it",
+			token:          "mallory-secret",
+			method:         http.MethodDelete,
+			path:           "/api/v1/hostname-reservations",
+			body:           `{"hostname":"app.example.com"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Admin releases it",
+			token:          "ops-secret",
+			method:         http.MethodDelete,
+			path:           "/api/v1/hostname-reservations",
+			body:           `{"hostname":"app.example.com"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Releasing an unreserved hostname",
+			token:          "alice-secret",
+			method:         http.MethodDelete,
+			path:           "/api/v1/hostname-reservations",
+			body:           `{"hostname":"app.example.com"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if _, err := tunnelManager.ReserveHostname("www.example.com", "alice"); err != nil {
+		t.Fatalf("Failed to reserve hostname: %v", err)
+	}
+	for token, expected := range map[string]int{"alice-secret": 1, "mallory-secret": 0, "ops-secret": 1} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/hostname-reservations", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		var resp HostnameReservationsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(resp.Reservations) != expected {
+			t.Errorf("Expected %d reservations for %s, got %+v", expected, token, resp.Reservations)
+		}
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	tunnelManager.SetTenantLimits(tunnel.TenantLimits{Tunnels: 1}, nil)
+	handler := NewHandler(tunnelManager, "test")
+	tokens, err := NewTokenStore([]APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{ScopeTunnelsCreate, ScopeTunnelsRead}, Tenant: "acme"},
+		{Name: "dev", Token: "dev-secret", Scopes: []string{ScopeTunnelsCreate, ScopeTunnelsRead}},
+		{Name: "ops", Token: "ops-secret", Scopes: []string{ScopeAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	tests := []struct {
+		name           string
+		token          string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Tenant creates its first tunnel",
+			token:          "ci-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/new-tunnel",
+			body:           `{"tunnel_id":"one","hostname":"one.example.com","target_port":8080}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Tenant over its tunnel limit",
+			token:          "ci-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/new-tunnel",
+			body:           `{"tunnel_id":"two","hostname":"two.example.com","target_port":8080}`,
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:           "Token named tenant creates a tunnel",
+			token:          "dev-secret",
+			method:         http.MethodPost,
+			path:           "/api/v1/new-tunnel",
+			body:           `{"tunnel_id":"two","hostname":"two.example.com","target_port":8080}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Tenant reads its usage",
+			token:          "ci-secret",
+			method:         http.MethodGet,
+			path:           "/api/v1/tenants/acme/usage",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Other tenant cannot read its usage",
+			token:          "dev-secret",
+			method:         http.MethodGet,
+			path:           "/api/v1/tenants/acme/usage",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Admin reads its usage",
+			token:          "ops-secret",
+			method:         http.MethodGet,
+			path:           "/api/v1/tenants/acme/usage",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Unknown tenant action",
+			token:          "ops-secret",
+			method:         http.MethodGet,
+			path:           "/api/v1/tenants/acme/bill",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/tenants/acme/usage", nil)
+	req.Header.Set("Authorization", "Bearer ci-secret")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var resp TenantUsageResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Tenant != "acme" || resp.Tunnels != 1 || resp.Hostnames != 1 || resp.Limits.MaxTunnels != 1 {
+		t.Errorf("Unexpected usage %+v", resp)
+	}
+}
+
+type fakeCache map[string]int
+
+func (c fakeCache) CacheStats(tunnelID string) loadbalancer.CacheStats {
+	return loadbalancer.CacheStats{Entries: c[tunnelID]}
+}
+
+func (c fakeCache) PurgeCache(tunnelID string) int {
+	purged := c[tunnelID]
+	delete(c, tunnelID)
+	return purged
+}
+
+func TestCache(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	if _, err := manager.CreateTunnel("app-1", "app-1.example.com", 8000, "", nil); err != nil {
+		t.Fatalf("Unexpected error creating tunnel: %v", err)
+	}
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	get := func(method, id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/api/v1/tunnels/"+id+"/cache", nil))
+		return w
+	}
+	if w := get(http.MethodGet, "app-1"); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d without a cache, got %d", http.StatusNotFound, w.Code)
+	}
+
+	handler.SetResponseCache(fakeCache{"app-1": 3})
+	tests := []struct {
+		name           string
+		method         string
+		tunnelID       string
+		expectedStatus int
+		expected       CacheResponse
+	}{
+		{name: "Stats", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK, expected: CacheResponse{TunnelID: "app-1", Entries: 3}},
+		{name: "Purge", method: http.MethodDelete, tunnelID: "app-1", expectedStatus: http.StatusOK, expected: CacheResponse{TunnelID: "app-1", Purged: 3}},
+		{name: "Empty after purging", method: http.MethodGet, tunnelID: "app-1", expectedStatus: http.StatusOK, expected: CacheResponse{TunnelID: "app-1"}},
+		{name: "Unknown tunnel", method: http.MethodDelete, tunnelID: "missing", expectedStatus: http.StatusNotFound},
+		{name: "Method not allowed", method: http.MethodPost, tunnelID: "app-1", expectedStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.method, tt.tunnelID)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp CacheResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, resp)
+			}
+		})
+	}
+}
+
+func TestTunnelLabels(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	if w := do(http.MethodPost, "/api/v1/new-tunnel", `{"tunnel_id": "bad", "hostname": "bad.example.com", "target_port": 8000, "labels": {"bad key": "x"}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid label, got %d", w.Code)
+	}
+	for _, body := range []string{
+		`{"tunnel_id": "web", "hostname": "web.example.com", "target_port": 8000, "labels": {"env": "staging", "team": "web"}}`,
+		`{"tunnel_id": "api", "hostname": "api.example.com", "target_port": 8000, "labels": {"env": "staging", "team": "core"}}`,
+		`{"tunnel_id": "prod", "hostname": "prod.example.com", "target_port": 8000, "labels": {"env": "production", "example.com/team": "web"}}`,
+	} {
+		if w := do(http.MethodPost, "/api/v1/new-tunnel", body); w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	w := do(http.MethodGet, "/api/v1/tunnels?selector="+url.QueryEscape("env=staging,team!=core"), "")
+	var list TunnelsResponse
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Tunnels) != 1 || list.Tunnels[0].TunnelID != "web" || list.Tunnels[0].Labels["team"] != "web" {
+		t.Errorf("Expected only web to match, got %+v", list.Tunnels)
+	}
+	if w := do(http.MethodGet, "/api/v1/tunnels?selector="+url.QueryEscape("env in staging"), ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid selector, got %d", w.Code)
+	}
+
+	w = do(http.MethodGet, "/metrics", "")
+	for _, expected := range []string{
+		`easy_tunnel_labels{tunnel_id="prod",hostname="prod.example.com",label_env="production",label_example_com_team="web"} 1`,
+		`easy_tunnel_labels{tunnel_id="web",hostname="web.example.com",label_env="staging",label_team="web"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected metrics to contain %s", expected)
+		}
+	}
+
+	if w := do(http.MethodPost, "/api/v1/remove-tunnel", `{"selector": " "}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a blank selector, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/api/v1/remove-tunnel", `{"tunnel_id": "web", "selector": "env=staging"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for both a tunnel ID and a selector, got %d", w.Code)
+	}
+	w = do(http.MethodPost, "/api/v1/remove-tunnel", `{"selector": "env=staging"}`)
+	var removed RemoveTunnelResponse
+	json.NewDecoder(w.Body).Decode(&removed)
+	if w.Code != http.StatusOK || !reflect.DeepEqual(removed.RemovedTunnelIDs, []string{"api", "web"}) {
+		t.Errorf("Expected api and web to be removed, got %d: %v", w.Code, removed.RemovedTunnelIDs)
+	}
+	if remaining := manager.GetAllTunnels(); len(remaining) != 1 || remaining[0].ID != "prod" {
+		t.Errorf("Expected only prod to remain, got %d tunnels", len(remaining))
+	}
+}
+
+func TestCORS(t *testing.T) {
+	handler := NewHandler(tunnel.NewManager(10), "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	cors, err := NewCORS(CORSConfig{
+		AllowedOrigins:   []string{"https://dashboard.example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create CORS: %v", err)
+	}
+	server := cors.Wrap(mux)
+
+	do := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/tunnels", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodOptions, "https://dashboard.example.com", map[string]string{
+		"Access-Control-Request-Method":  "DELETE",
+		"Access-Control-Request-Headers": "authorization, idempotency-key",
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204 for an allowed preflight, got %d", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("Unexpected preflight headers %v", w.Header())
+	}
+
+	w = do(http.MethodOptions, "https://dashboard.example.com", map[string]string{
+		"Access-Control-Request-Method":  "GET",
+		"Access-Control-Request-Headers": "X-Custom",
+	})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a header that is not allowed, got %d", w.Code)
+	}
+	if w := do(http.MethodOptions, "https://evil.example.com", map[string]string{"Access-Control-Request-Method": "GET"}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for an origin that is not allowed, got %d", w.Code)
+	}
+
+	w = do(http.MethodGet, "https://dashboard.example.com", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" {
+		t.Errorf("Expected CORS headers for an allowed origin, got %d: %v", w.Code, w.Header())
+	}
+	w = do(http.MethodGet, "https://evil.example.com", nil)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Vary") != "Origin" {
+		t.Errorf("Expected no CORS headers for an origin that is not allowed, got %v", w.Header())
+	}
+	if w := do(http.MethodGet, "", nil); w.Header().Get("Vary") != "" {
+		t.Errorf("Expected same-origin requests to be served unchanged, got %v", w.Header())
+	}
+
+	if _, err := NewCORS(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}); err == nil {
+		t.Error("Expected an error for credentials with any origin")
+	}
+	if _, err := NewCORS(CORSConfig{AllowedOrigins: []string{"dashboard.example.com"}}); err == nil {
+		t.Error("Expected an error for an origin without a scheme")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	handler := NewHandler(manager, "test")
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/events?tunnel_id=web")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// The stream subscribed before its headers were sent
+	if _, err := manager.CreateTunnel("api", "api.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	if _, err := manager.CreateTunnel("web", "web.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: tunnel" || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("Expected a tunnel event, got %q", lines)
+	}
+	var event TunnelEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if event.Type != "created" || event.TunnelID != "web" || event.Hostname != "web.example.com" {
+		t.Errorf("Expected the creation of web only, got %+v", event)
+	}
+
+	handler.CloseEventStreams()
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Errorf("Expected the stream to end on shutdown, got %v", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	keyring, err := secrets.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, secrets.KeySize)))
+	if err != nil {
+		t.Fatalf("Failed to parse keyring: %v", err)
+	}
+	box := secrets.NewBox(keyring)
+
+	// newAgent returns the API of an agent with the WebSocket transport
+	newAgent := func(box *secrets.Box) (*tunnel.Manager, *loadbalancer.Router, func(method, path, body string) *httptest.ResponseRecorder) {
+		manager := tunnel.NewManager(10)
+		if err := manager.AddTransport(tunnel.NewWebSocketTransport()); err != nil {
+			t.Fatalf("Failed to add transport: %v", err)
+		}
+		router := loadbalancer.NewRouter(&loadbalancer.Config{})
+		handler := NewHandler(manager, "test")
+		handler.SetRouteTable(router)
+		handler.SetSecretsBox(box)
+		mux := http.NewServeMux()
+		handler.RegisterRoutes(mux)
+		return manager, router, func(method, path, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			return w
+		}
+	}
+
+	source, _, send := newAgent(box)
+	for _, body := range []string{
+		`{"tunnel_id": "web", "hostname": "web.example.com", "target_port": 8080, "labels": {"env": "prod"},
+			"request_filters": [{"name": "dotfiles", "path": "^/\\.env"}]}`,
+		`{"tunnel_id": "ws", "hostname": "ws.example.com", "target_port": 3000, "transport": "websocket"}`,
+	} {
+		if w := send(http.MethodPost, "/api/v1/new-tunnel", body); w.Code != http.StatusCreated {
+			t.Fatalf("Failed to create tunnel: %d %s", w.Code, w.Body.String())
+		}
+	}
+	if w := send(http.MethodPut, "/api/v1/tunnels/web/mirror", `{"mirror_tunnel_id": "ws", "percent": 10}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to set mirror: %d %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/api/v1/admin/routes", `{"hostname": "example.com", "redirect": {"url": "https://web.example.com"}}`); w.Code != http.StatusOK {
+		t.Fatalf("Failed to add static route: %d %s", w.Code, w.Body.String())
+	}
+	wsTunnel, _ := source.GetTunnel("ws")
+
+	w := send(http.MethodGet, "/api/v1/admin/export", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	export := w.Body.String()
+	if strings.Contains(export, wsTunnel.ConnectToken) {
+		t.Error("Expected the connect token to be sealed in the export")
+	}
+	var state AgentState
+	if err := json.Unmarshal([]byte(export), &state); err != nil {
+		t.Fatalf("Failed to decode export: %v", err)
+	}
+	if len(state.Tunnels) != 2 || len(state.StaticRoutes) != 1 {
+		t.Fatalf("Expected 2 tunnels and 1 static route, got %+v", state)
+	}
+
+	// A tunnel with invalid settings rejects the whole import
+	invalid := state
+	invalid.Tunnels = append([]ExportedTunnel(nil), state.Tunnels...)
+	for i, t := range invalid.Tunnels {
+		if t.TunnelID == "ws" {
+			invalid.Tunnels[i].AllowedIPs = []string{"10.0.0.0/33"}
+		}
+	}
+	body, _ := json.Marshal(invalid)
+	target, _, send := newAgent(box)
+	if w := send(http.MethodPost, "/api/v1/admin/import", string(body)); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "ws") {
+		t.Errorf("Expected status 400 naming the invalid tunnel, got %d: %s", w.Code, w.Body.String())
+	}
+	if tunnels := target.GetAllTunnels(); len(tunnels) != 0 {
+		t.Errorf("Expected nothing to be imported, got %d tunnels", len(tunnels))
+	}
+
+	// An agent with the same secrets key restores everything, including
+	// the connect token
+	target, router, send := newAgent(box)
+	if w := send(http.MethodPut, "/api/v1/admin/import", export); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+	w = send(http.MethodPost, "/api/v1/admin/import", export)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ImportResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Imported) != 2 || resp.StaticRoutes != 1 || len(resp.Failed) != 0 || len(resp.ReissuedConnectTokens) != 0 {
+		t.Fatalf("Unexpected import result: %+v", resp)
+	}
+	imported, err := target.GetTunnel("ws")
+	if err != nil || imported.ConnectToken != wsTunnel.ConnectToken {
+		t.Errorf("Expected the connect token to be restored, got %+v (%v)", imported, err)
+	}
+	if mirror := target.Mirror("web"); mirror == nil || mirror.TunnelID != "ws" || mirror.Percent != 10 {
+		t.Errorf("Expected the mirror to be restored, got %+v", mirror)
+	}
+	if rules := target.RequestFilters("web"); len(rules) != 1 || rules[0].Name != "dotfiles" {
+		t.Errorf("Expected the request filters to be restored, got %+v", rules)
+	}
+	if web, _ := target.GetTunnel("web"); web == nil || web.Labels["env"] != "prod" {
+		t.Errorf("Expected the labels to be restored, got %+v", web)
+	}
+	if target, err := router.Route("example.com", "/"); err != nil || target.ID != "" {
+		t.Errorf("Expected the static route to be restored, got %+v (%v)", target, err)
+	}
+
+	// Importing again skips the existing tunnels
+	w = send(http.MethodPost, "/api/v1/admin/import", export)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Imported) != 0 || len(resp.Failed) != 2 || !strings.Contains(resp.Failed[0].Error, "already exists") {
+		t.Errorf("Expected the existing tunnels to be skipped, got %+v", resp)
+	}
+
+	// Without the secrets key the client gets a new connect token
+	target, _, send = newAgent(nil)
+	w = send(http.MethodPost, "/api/v1/admin/import", export)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Imported) != 2 || !reflect.DeepEqual(resp.ReissuedConnectTokens, []string{"ws"}) {
+		t.Errorf("Expected the connect token to be reissued, got %+v", resp)
+	}
+	if imported, _ := target.GetTunnel("ws"); imported == nil || imported.ConnectToken == "" || imported.ConnectToken == wsTunnel.ConnectToken {
+		t.Errorf("Expected a new connect token, got %+v", imported)
+	}
+}
@@ -0,0 +1,83 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"net/http"
+)
+
+// Component states reported by the health checks
+const (
+	ComponentOK      = "ok"
+	ComponentFailing = "failing"
+)
+
+// HealthCheck returns an error if a component of the agent does not work
+type HealthCheck func() error
+
+// healthCheck is a named component check
+type healthCheck struct {
+	component string
+	check     HealthCheck
+}
+
+// AddHealthCheck makes the agent ready only while check passes, reporting
+// its result as component in /readyz and the status endpoint
+func (h *Handler) AddHealthCheck(component string, check HealthCheck) {
+	h.healthChecks = append(h.healthChecks, healthCheck{component: component, check: check})
+}
+
+// SetDraining makes the agent report that it is draining, failing
+// readiness so that traffic moves elsewhere before it shuts down
+func (h *Handler) SetDraining() {
+	h.draining.Store(true)
+}
+
+// checkComponents runs the health checks, returning their results in the
+// order they were added and whether all passed
+func (h *Handler) checkComponents() ([]ComponentStatus, bool) {
+	components := make([]ComponentStatus, 0, len(h.healthChecks))
+	healthy := true
+	for _, hc := range h.healthChecks {
+		status := ComponentStatus{Name: hc.component, Status: ComponentOK}
+		if err := hc.check(); err != nil {
+			status.Status = ComponentFailing
+			status.Error = err.Error()
+			healthy = false
+		}
+		components = append(components, status)
+	}
+	return components, healthy
+}
+
+// handleHealthz answers as long as the process serves requests, for
+// liveness probes
+func (h *Handler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.sendJSON(w, HealthResponse{Status: "ok"}, http.StatusOK)
+}
+
+// handleReadyz answers 503 while any component is failing, for readiness
+// probes
+func (h *Handler) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	components, ready := h.checkComponents()
+	if h.draining.Load() {
+		h.sendJSON(w, HealthResponse{Status: "draining", Components: components}, http.StatusServiceUnavailable)
+		return
+	}
+	if !ready {
+		h.logger.Warn().
+			Interface("components", components).
+			Msg("Agent is not ready")
+		h.sendJSON(w, HealthResponse{Status: "not ready", Components: components}, http.StatusServiceUnavailable)
+		return
+	}
+	h.sendJSON(w, HealthResponse{Status: "ready", Components: components}, http.StatusOK)
+}
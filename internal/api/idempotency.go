@@ -0,0 +1,89 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header clients use to make retries safe
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyKeyTTL is how long a stored response can be replayed
+const idempotencyKeyTTL = 24 * time.Hour
+
+// idempotentResponse is a stored response for an Idempotency-Key
+type idempotentResponse struct {
+	fingerprint [32]byte
+	status      int
+	body        interface{}
+	created     time.Time
+	done        bool
+}
+
+// idempotencyStore remembers responses to requests carrying an Idempotency-Key
+type idempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	ttl       time.Duration
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		responses: make(map[string]*idempotentResponse),
+		ttl:       ttl,
+	}
+}
+
+// begin claims a key for a request with the given body. It returns the stored
+// response if the key was already used for a completed request, or ok=false
+// if the key is in use by a different or still in-flight request.
+func (s *idempotencyStore) begin(key string, body []byte) (stored *idempotentResponse, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+
+	fingerprint := sha256.Sum256(body)
+	if existing, exists := s.responses[key]; exists {
+		if existing.fingerprint != fingerprint || !existing.done {
+			return nil, false
+		}
+		return existing, true
+	}
+
+	s.responses[key] = &idempotentResponse{
+		fingerprint: fingerprint,
+		created:     time.Now(),
+	}
+	return nil, true
+}
+
+// complete stores the response for a key so it can be replayed
+func (s *idempotencyStore) complete(key string, status int, body interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, exists := s.responses[key]; exists {
+		entry.status = status
+		entry.body = body
+		entry.done = true
+	}
+}
+
+// release forgets a key whose request failed, so the client can retry it
+func (s *idempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.responses, key)
+}
+
+func (s *idempotencyStore) prune(now time.Time) {
+	for key, entry := range s.responses {
+		if entry.done && now.Sub(entry.created) > s.ttl {
+			delete(s.responses, key)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for RS256 and ES256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksCacheTTL is how long fetched signing keys are used before refetching
+	jwksCacheTTL = time.Hour
+
+	// jwksMinRefresh limits refetches triggered by unknown key IDs
+	jwksMinRefresh = time.Minute
+
+	// jwtLeeway tolerates clock skew when checking exp and nbf
+	jwtLeeway = time.Minute
+)
+
+// Claims are the verified claims of a JWT
+type Claims map[string]interface{}
+
+// Subject returns the sub claim
+func (c Claims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// strings returns a claim holding a string or a list of strings
+func (c Claims) strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// JWTAuthenticator validates bearer tokens issued by an OpenID Connect
+// provider, verifying their signatures with keys from the provider's JWKS
+type JWTAuthenticator struct {
+	issuer         string
+	audience       string
+	jwksURL        string
+	hostnamesClaim string
+	client         *http.Client
+
+	// refresh lets concurrent requests share a single JWKS fetch
+	refresh singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWTAuthenticator creates an authenticator for tokens issued by issuer to
+// audience. If jwksURL is empty it is discovered from the issuer's OpenID
+// configuration. If hostnamesClaim is set, callers may only manage tunnels for
+// the hostname patterns listed in that claim.
+func NewJWTAuthenticator(issuer, audience, jwksURL, hostnamesClaim string) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		issuer:         issuer,
+		audience:       audience,
+		jwksURL:        jwksURL,
+		hostnamesClaim: hostnamesClaim,
+		client:         &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Authenticate verifies the bearer token of r. The caller is granted the
+// scopes of the token's scope (or scp) claim and, if a hostnames claim is
+// configured, the hostname patterns it lists. Its tenant is the token's
+// tenant claim, or its subject.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := a.Verify(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := claims.strings("scope")
+	if len(scopes) == 0 {
+		scopes = claims.strings("scp")
+	}
+	hostnames := []string{"*"}
+	if a.hostnamesClaim != "" {
+		hostnames = claims.strings(a.hostnamesClaim)
+	}
+	tenant, _ := claims["tenant"].(string)
+	if tenant == "" {
+		tenant = claims.Subject()
+	}
+	return &Principal{Name: claims.Subject(), Scopes: scopes, Hostnames: hostnames, Tenant: tenant}, nil
+}
+
+// Verify checks the token's signature, issuer, audience and validity period
+// and returns its claims
+func (a *JWTAuthenticator) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+	if err := a.validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// validateClaims checks the registered claims of a token
+func (a *JWTAuthenticator) validateClaims(claims Claims, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+
+	audienceFound := false
+	for _, aud := range claims.strings("aud") {
+		if aud == a.audience {
+			audienceFound = true
+			break
+		}
+	}
+	if !audienceFound {
+		return errors.New("token not issued for this audience")
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+	return nil
+}
+
+// key returns the signing key with the given ID, fetching the JWKS if the
+// cache is stale or does not know the key. The JWKS is fetched without
+// holding the lock, so requests whose key is cached are not held up by it.
+func (a *JWTAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	age := time.Since(a.fetchedAt)
+	key, known := a.lookupKey(kid)
+	stale := a.keys == nil || age > jwksCacheTTL || (!known && age > jwksMinRefresh)
+	a.mu.Unlock()
+
+	if stale {
+		// The fetch is shared, so it must not end with the request that started it
+		_, err, _ := a.refresh.Do("jwks", func() (interface{}, error) {
+			return nil, a.refreshKeys(context.WithoutCancel(ctx))
+		})
+		if err != nil {
+			if known {
+				// Keep using the cached keys while the provider is unreachable
+				return key, nil
+			}
+			return nil, fmt.Errorf("failed to fetch signing keys: %v", err)
+		}
+
+		a.mu.Lock()
+		key, known = a.lookupKey(kid)
+		a.mu.Unlock()
+	}
+
+	if !known {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// lookupKey finds a cached key; tokens without a key ID match a sole key.
+// Must be called with a.mu held.
+func (a *JWTAuthenticator) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+// refreshKeys replaces the cached keys with the provider's current JWKS
+func (a *JWTAuthenticator) refreshKeys(ctx context.Context) error {
+	keys, err := a.fetchKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	return nil
+}
+
+// fetchKeys downloads the provider's JWKS
+func (a *JWTAuthenticator) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := a.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(ctx, strings.TrimSuffix(a.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("OpenID configuration has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Providers may publish key types this agent does not support
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (a *JWTAuthenticator) getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jsonWebKey is a public key of a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// jwsAlgorithm is a supported JWS signing algorithm
+type jwsAlgorithm struct {
+	hash crypto.Hash
+	// curve is the curve of ECDSA keys, or nil for RSA
+	curve elliptic.Curve
+}
+
+var jwsAlgorithms = map[string]jwsAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+// verifySignature checks a JWS signature for the RS* and ES* algorithms. The
+// algorithm must match the key: RS* needs an RSA key and each ES* algorithm
+// an EC key on its own curve.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	algorithm, ok := jwsAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	hash := algorithm.hash
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm.curve != nil {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if algorithm.curve != key.Curve {
+			return fmt.Errorf("algorithm %s does not match %s key", alg, key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return errors.New("unsupported signing key")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,49 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tracing"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// removeSelectedTunnels removes the tunnels the caller may manage whose
+// labels match selector. Tunnels removed concurrently are skipped.
+func (h *Handler) removeSelectedTunnels(w http.ResponseWriter, r *http.Request, selector string) {
+	sel, err := tunnel.ParseSelector(selector)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sel.Empty() {
+		// Removing every tunnel takes more than a blank selector
+		h.sendError(w, "Selector must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	removed := []string{}
+	for _, t := range h.tunnelManager.SelectTunnels(sel) {
+		if !h.authorizeTunnel(r, t.ID, t.Hostname) {
+			continue
+		}
+		span := managerSpan(r, "RemoveTunnel", t.ID)
+		err := h.tunnelManager.RemoveTunnel(t.ID)
+		tracing.End(span, err)
+		if err != nil {
+			continue
+		}
+		removed = append(removed, t.ID)
+	}
+
+	h.logger.Info().
+		Str("selector", selector).
+		Strs("tunnel_ids", removed).
+		Msg("Removed selected tunnels")
+	h.sendJSON(w, RemoveTunnelResponse{
+		Success:          true,
+		Message:          fmt.Sprintf("%d tunnels removed", len(removed)),
+		RemovedTunnelIDs: removed,
+	}, http.StatusOK)
+}
@@ -0,0 +1,267 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// family starts a metric family
+func (m *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample with label name/value pairs
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, "%s=%q", labels[i], labels[i+1])
+		}
+		m.w.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// labelName returns the metric label exporting a tunnel label, its key
+// with the characters Prometheus does not allow replaced by underscores
+func labelName(key string) string {
+	return "label_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// handleMetrics serves tunnel and WireGuard metrics for Prometheus. Callers
+// only see the tunnels they may manage and, with the selector query
+// parameter, only those whose labels match it.
+func (h *Handler) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	selector, err := tunnel.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var tunnels []*tunnel.TunnelInfo
+	for _, t := range h.tunnelManager.SelectTunnels(selector) {
+		if h.authorizeTunnel(r, t.ID, t.Hostname) {
+			tunnels = append(tunnels, t)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+	defer m.w.Flush()
+
+	counts := map[tunnel.TunnelStatus]int{tunnel.StatusActive: 0, tunnel.StatusDegraded: 0}
+	for _, t := range tunnels {
+		counts[t.Status]++
+	}
+	m.family("easy_tunnel_tunnels", "gauge", "Number of tunnels by status.")
+	for _, status := range []tunnel.TunnelStatus{tunnel.StatusActive, tunnel.StatusDegraded} {
+		m.sample("easy_tunnel_tunnels", float64(counts[status]), "status", string(status))
+	}
+
+	drift := h.tunnelManager.Drift()
+	m.family("easy_tunnel_reconcile_runs_total", "counter", "Reconciliations of the tunnels with their WireGuard peers and routes.")
+	m.sample("easy_tunnel_reconcile_runs_total", float64(drift.Runs))
+	m.family("easy_tunnel_reconcile_errors_total", "counter", "Reconciliations that failed to read or repair some state.")
+	m.sample("easy_tunnel_reconcile_errors_total", float64(drift.Errors))
+	m.family("easy_tunnel_reconcile_drift_total", "counter", "Drift repaired by reconciliation, by kind.")
+	for _, d := range []struct {
+		kind  string
+		count int64
+	}{
+		{"missing_peer", drift.MissingPeers},
+		{"orphaned_peer", drift.OrphanedPeers},
+		{"missing_route", drift.MissingRoutes},
+		{"orphaned_route", drift.OrphanedRoutes},
+	} {
+		m.sample("easy_tunnel_reconcile_drift_total", float64(d.count), "kind", d.kind)
+	}
+
+	type tunnelMetric struct {
+		name, kind, help string
+		value            func(*tunnel.TunnelInfo) (float64, bool)
+	}
+	traffic := func(t *tunnel.TunnelInfo) TrafficStats { return toTrafficStats(h.tunnelManager.Stats().Get(t.ID)) }
+	isWireGuard := func(t *tunnel.TunnelInfo) bool { return t.Transport == tunnel.TransportWireGuard }
+	// TCP metrics are exported for tunnels with a TCP or TLS passthrough
+	// listener, or that had one
+	tcpTraffic := func(t *tunnel.TunnelInfo) (TCPStats, bool) {
+		if tcp := traffic(t).TCP; tcp != nil {
+			return *tcp, true
+		}
+		return TCPStats{}, t.Protocol == tunnel.ProtocolTCP || t.Protocol == tunnel.ProtocolTLS
+	}
+	tcpCounter := func(value func(TCPStats) int64) func(*tunnel.TunnelInfo) (float64, bool) {
+		return func(t *tunnel.TunnelInfo) (float64, bool) {
+			tcp, ok := tcpTraffic(t)
+			return float64(value(tcp)), ok
+		}
+	}
+	metrics := []tunnelMetric{
+		{"easy_tunnel_up", "gauge", "Whether the tunnel is active (1) or degraded (0).",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return boolValue(t.Status == tunnel.StatusActive), true }},
+		{"easy_tunnel_sent_bytes_total", "counter", "Bytes sent to public clients through the tunnel.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(traffic(t).BytesSent), true }},
+		{"easy_tunnel_received_bytes_total", "counter", "Bytes received from public clients for the tunnel.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(traffic(t).BytesReceived), true }},
+		{"easy_tunnel_requests_total", "counter", "Requests and connections routed to the tunnel.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(traffic(t).Requests), true }},
+		{"easy_tunnel_active_connections", "gauge", "Open connections routed to the tunnel.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(traffic(t).ActiveConnections), true }},
+		{"easy_tunnel_retries_total", "counter", "Proxied requests retried after the tunnel could not be reached.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(traffic(t).Retries), true }},
+		{"easy_tunnel_denied_total", "counter", "Requests and connections refused by the tunnel's access lists.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(traffic(t).Denied), true }},
+		{"easy_tunnel_rate_limited_total", "counter", "Requests and connections refused because their client was over its limits.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(traffic(t).RateLimited), true }},
+		{"easy_tunnel_tcp_connections_total", "counter", "TCP connections accepted for the tunnel.",
+			tcpCounter(func(tcp TCPStats) int64 { return tcp.Accepted })},
+		{"easy_tunnel_tcp_active_connections", "gauge", "Open TCP connections proxied to the tunnel.",
+			tcpCounter(func(tcp TCPStats) int64 { return tcp.Active })},
+		{"easy_tunnel_tcp_received_bytes_total", "counter", "Bytes of TCP connections received from clients.",
+			tcpCounter(func(tcp TCPStats) int64 { return tcp.BytesIn })},
+		{"easy_tunnel_tcp_sent_bytes_total", "counter", "Bytes of TCP connections sent to clients.",
+			tcpCounter(func(tcp TCPStats) int64 { return tcp.BytesOut })},
+		{"easy_tunnel_tcp_dial_failures_total", "counter", "TCP connections closed because the tunnel could not be dialed.",
+			tcpCounter(func(tcp TCPStats) int64 { return tcp.DialFailures })},
+		{"easy_tunnel_wireguard_last_handshake_timestamp_seconds", "gauge", "Unix time of the latest WireGuard handshake, 0 if none.",
+			func(t *tunnel.TunnelInfo) (float64, bool) {
+				if t.Peer.LatestHandshake.IsZero() {
+					return 0, isWireGuard(t)
+				}
+				return float64(t.Peer.LatestHandshake.Unix()), isWireGuard(t)
+			}},
+		{"easy_tunnel_wireguard_handshake_stale", "gauge", "Whether the WireGuard handshakes of the tunnel stopped.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return boolValue(t.HandshakeStale), isWireGuard(t) }},
+		{"easy_tunnel_wireguard_received_bytes_total", "counter", "Bytes received from the WireGuard peer.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(t.Peer.ReceivedBytes), isWireGuard(t) }},
+		{"easy_tunnel_wireguard_sent_bytes_total", "counter", "Bytes sent to the WireGuard peer.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return float64(t.Peer.SentBytes), isWireGuard(t) }},
+		{"easy_tunnel_path_rtt_seconds", "gauge", "Average round-trip time of the latest answered path probes to the WireGuard peer.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return t.Path.RTT.Seconds(), t.Path.Sent > t.Path.Lost }},
+		{"easy_tunnel_path_loss_ratio", "gauge", "Share of the latest path probes to the WireGuard peer that were lost.",
+			func(t *tunnel.TunnelInfo) (float64, bool) { return t.Path.LossRatio(), !t.Path.LastProbe.IsZero() }},
+	}
+
+	for _, metric := range metrics {
+		m.family(metric.name, metric.kind, metric.help)
+		for _, t := range tunnels {
+			if value, ok := metric.value(t); ok {
+				m.sample(metric.name, value, "tunnel_id", t.ID, "hostname", strings.ToLower(t.Hostname))
+			}
+		}
+	}
+
+	// Labels go on one info metric to join the others on tunnel_id
+	m.family("easy_tunnel_labels", "gauge", "Labels of the tunnel as label_<key> metric labels, always 1.")
+	for _, t := range tunnels {
+		keys := make([]string, 0, len(t.Labels))
+		for key := range t.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		labels := []string{"tunnel_id", t.ID, "hostname", strings.ToLower(t.Hostname)}
+		seen := make(map[string]bool)
+		for _, key := range keys {
+			// Keys such as a.b and a_b map to the same metric label
+			name := labelName(key)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			labels = append(labels, name, t.Labels[key])
+		}
+		m.sample("easy_tunnel_labels", 1, labels...)
+	}
+
+	// Causes tell a broken tunnel (unreachable) from a broken backend
+	m.family("easy_tunnel_proxy_errors_total", "counter", "Requests that could not be proxied to the tunnel by cause.")
+	for _, t := range tunnels {
+		errors := h.tunnelManager.Stats().ProxyErrors(t.ID)
+		causes := make([]string, 0, len(errors))
+		for cause := range errors {
+			causes = append(causes, cause)
+		}
+		sort.Strings(causes)
+		for _, cause := range causes {
+			m.sample("easy_tunnel_proxy_errors_total", float64(errors[cause]),
+				"tunnel_id", t.ID, "hostname", strings.ToLower(t.Hostname), "cause", cause)
+		}
+	}
+
+	m.family("easy_tunnel_filtered_requests_total", "counter", "Requests to the tunnel blocked by request filter rules by rule.")
+	for _, t := range tunnels {
+		filtered := h.tunnelManager.Stats().Filtered(t.ID)
+		rules := make([]string, 0, len(filtered))
+		for rule := range filtered {
+			rules = append(rules, rule)
+		}
+		sort.Strings(rules)
+		for _, rule := range rules {
+			m.sample("easy_tunnel_filtered_requests_total", float64(filtered[rule]),
+				"tunnel_id", t.ID, "hostname", strings.ToLower(t.Hostname), "rule", rule)
+		}
+	}
+
+	// Client countries are only known with a GeoIP database
+	m.family("easy_tunnel_country_requests_total", "counter", "Requests and connections routed to the tunnel by client country.")
+	for _, t := range tunnels {
+		countries := h.tunnelManager.Stats().Countries(t.ID)
+		codes := make([]string, 0, len(countries))
+		for code := range countries {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			m.sample("easy_tunnel_country_requests_total", float64(countries[code]),
+				"tunnel_id", t.ID, "hostname", strings.ToLower(t.Hostname), "country", code)
+		}
+	}
+
+	m.family("easy_tunnel_tcp_connection_duration_seconds", "histogram", "How long TCP connections proxied to the tunnel were open.")
+	for _, t := range tunnels {
+		if _, ok := tcpTraffic(t); !ok {
+			continue
+		}
+		durations := h.tunnelManager.Stats().TCPDurations(t.ID)
+		labels := []string{"tunnel_id", t.ID, "hostname", strings.ToLower(t.Hostname)}
+		for i, bound := range durations.Bounds {
+			m.sample("easy_tunnel_tcp_connection_duration_seconds_bucket", float64(durations.Buckets[i]),
+				append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+		}
+		m.sample("easy_tunnel_tcp_connection_duration_seconds_bucket", float64(durations.Count), append(labels, "le", "+Inf")...)
+		m.sample("easy_tunnel_tcp_connection_duration_seconds_sum", durations.Sum, labels...)
+		m.sample("easy_tunnel_tcp_connection_duration_seconds_count", float64(durations.Count), labels...)
+	}
+}
@@ -1,6 +1,13 @@
 // Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
 package api
 
+import (
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/usage"
+)
+
 // CreateTunnelRequest represents the request payload for creating a new tunnel
 type CreateTunnelRequest struct {
 	// Unique identifier for the tunnel
@@ -8,12 +15,147 @@ type CreateTunnelRequest struct {
 	
 	// The hostname to route traffic to (e.g., service.example.com)
 	Hostname string `json:"hostname"`
+
+	// Optional: more hostnames routed to the same target, e.g. the apex
+	// domain, www and a custom domain; the first is the primary hostname
+	// if hostname is empty
+	Hostnames []string `json:"hostnames,omitempty"`
 	
 	// The target port on the tunnel endpoint
 	TargetPort int `json:"target_port"`
 	
 	// Optional: WireGuard public key if using WireGuard tunnels
 	WireGuardPublicKey string `json:"wireguard_public_key,omitempty"`
+
+	// Optional: have the agent generate the client's WireGuard key pair
+	// instead of supplying a public key; the private key is only returned
+	// in the response's wg-quick configuration
+	GenerateWireGuardKeys bool `json:"generate_wireguard_keys,omitempty"`
+
+	// Optional: also return the wg-quick configuration as a QR code;
+	// requires generate_wireguard_keys
+	IncludeQRCode bool `json:"include_qr_code,omitempty"`
+
+	// Optional: WireGuard keepalive interval in seconds and client MTU,
+	// defaulting to the agent's configuration
+	PersistentKeepalive int `json:"persistent_keepalive,omitempty"`
+	MTU                 int `json:"mtu,omitempty"`
+
+	// Optional: rotate the WireGuard server keys automatically at this
+	// interval in seconds
+	KeyRotationIntervalSeconds int `json:"key_rotation_interval_seconds,omitempty"`
+
+	// Optional: WireGuard interface to add the peer to, isolating tunnel
+	// groups from each other; defaults to the agent's default interface
+	WireGuardInterface string `json:"wireguard_interface,omitempty"`
+
+	// Optional: transport the client connects over, wireguard, websocket
+	// or ssh. Defaults to wireguard if a WireGuard key is supplied or
+	// generated, otherwise the agent reaches the target directly.
+	Transport string `json:"transport,omitempty"`
+
+	// Optional: public key in the authorized_keys format the client of an
+	// ssh tunnel may log in with instead of the connect token
+	SSHPublicKey string `json:"ssh_public_key,omitempty"`
+
+	// Optional: how the load balancer routes the tunnel's traffic: http
+	// terminates HTTP(S) and routes requests by hostname, tls passes TLS
+	// connections through by SNI, and tcp and udp forward what arrives on
+	// listen_port. Without it, the tunnel's hostnames are routed for HTTP.
+	// udp requires the wireguard transport or a directly reached target.
+	Protocol   string `json:"protocol,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+
+	// Optional: override the agent's timeouts in seconds for connecting to
+	// the target, waiting for its response headers and whole requests
+	DialTimeoutSeconds           int `json:"dial_timeout_seconds,omitempty"`
+	ResponseHeaderTimeoutSeconds int `json:"response_header_timeout_seconds,omitempty"`
+	MaxRequestDurationSeconds    int `json:"max_request_duration_seconds,omitempty"`
+
+	// Optional: connect to the target over HTTPS, verifying its
+	// certificate for backend_tls_server_name (defaulting to the hostname)
+	// unless backend_tls_insecure_skip_verify is set
+	BackendTLS                   bool   `json:"backend_tls,omitempty"`
+	BackendTLSServerName         string `json:"backend_tls_server_name,omitempty"`
+	BackendTLSInsecureSkipVerify bool   `json:"backend_tls_insecure_skip_verify,omitempty"`
+
+	// Optional: HTML templates replacing the agent's error pages, keyed by
+	// "401", "403", "404", "413", "429", "502", "503", "504" or "maintenance"
+	ErrorPages map[string]string `json:"error_pages,omitempty"`
+
+	// Optional: rules changing the headers of requests to the target and
+	// of its responses
+	HeaderRules *HeaderRules `json:"header_rules,omitempty"`
+
+	// Optional: the Host header sent to the target instead of the public
+	// hostname, such as the name the backend serves, and the Origin header
+	// replacing that of requests carrying one. Access-Control-Allow-Origin
+	// headers naming origin_rewrite are changed back to the client's origin.
+	HostRewrite   string `json:"host_rewrite,omitempty"`
+	OriginRewrite string `json:"origin_rewrite,omitempty"`
+
+	// Optional: turns gzip compression of the tunnel's responses on or off,
+	// and the smallest response compressed in bytes, overriding the agent's
+	Compression        *bool `json:"compression,omitempty"`
+	CompressionMinSize int   `json:"compression_min_size,omitempty"`
+
+	// Optional: turns caching of the tunnel's responses that Cache-Control
+	// or Expires mark cacheable on or off, overriding the agent's, with
+	// the most bytes the tunnel's cached responses may take and a cap in
+	// seconds on how long they are served from the cache
+	Cache              *bool `json:"cache,omitempty"`
+	CacheMaxBytes      int64 `json:"cache_max_bytes,omitempty"`
+	CacheMaxTTLSeconds int   `json:"cache_max_ttl_seconds,omitempty"`
+
+	// Optional: client CIDRs or IP addresses, and ISO 3166-1 country codes,
+	// that may reach the tunnel (all if empty) and that may not; denied
+	// clients get 403 Forbidden and their TCP connections are closed.
+	// Countries need the agent's GeoIP database.
+	AllowedIPs       []string `json:"allowed_ips,omitempty"`
+	DeniedIPs        []string `json:"denied_ips,omitempty"`
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	DeniedCountries  []string `json:"denied_countries,omitempty"`
+
+	// Optional: rules blocking the tunnel's HTTP requests that match all
+	// of a rule's conditions with 403 Forbidden, such as scanners probing
+	// for well-known paths, before they reach the tunnel
+	RequestFilters []FilterRule `json:"request_filters,omitempty"`
+
+	// Optional: limits on each client address, overriding the agent's:
+	// HTTP requests and TCP connections per second with bursts, and
+	// concurrent requests and connections. Clients over a limit get 429
+	// Too Many Requests and their TCP connections are reset.
+	ClientRequestsPerSecond int `json:"client_requests_per_second,omitempty"`
+	ClientBurst             int `json:"client_burst,omitempty"`
+	ClientMaxConnections    int `json:"client_max_connections,omitempty"`
+
+	// Optional: the tunnel's timeouts and limits in one block, whose
+	// non-zero fields take precedence over the top-level fields of the
+	// same name. Values above the maximums the agent allows are rejected.
+	Policy *TunnelPolicy `json:"policy,omitempty"`
+
+	// Optional: send copies of a percentage of the tunnel's HTTP requests
+	// (all if zero) to another tunnel, discarding its responses, e.g. to
+	// try a new version of a service against production traffic
+	MirrorTunnelID string `json:"mirror_tunnel_id,omitempty"`
+	MirrorPercent  int    `json:"mirror_percent,omitempty"`
+
+	// Optional: make the agent authenticate the tunnel's clients before
+	// proxying their requests, with basic auth or an OIDC login
+	EdgeAuth *EdgeAuth `json:"edge_auth,omitempty"`
+
+	// Optional: require clients to present a certificate signed by one of
+	// the given CAs during the TLS handshake
+	ClientCertAuth *ClientCertAuth `json:"client_cert_auth,omitempty"`
+
+	// Optional: remove the tunnel automatically at expires_at, or
+	// ttl_seconds after its creation. Refreshing the tunnel moves its
+	// expiry to ttl_seconds from then.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds int        `json:"ttl_seconds,omitempty"`
+
+	// Optional: labels to select the tunnel by, e.g. env=staging
+	Labels map[string]string `json:"labels,omitempty"`
 	
 	// Optional: Additional metadata for the tunnel
 	Metadata map[string]string `json:"metadata,omitempty"`
@@ -28,27 +170,660 @@ type CreateTunnelResponse struct {
 	PublicEndpoint string `json:"public_endpoint"`
 	
 	// WireGuard configuration if applicable
+	WireGuardClientConfig
+
+	// WebSocket connection details for tunnels on the websocket transport
+	WebSocketConfig *WebSocketConfig `json:"websocket_config,omitempty"`
+
+	// SSH connection details for tunnels on the ssh transport
+	SSHConfig *SSHConfig `json:"ssh_config,omitempty"`
+
+	// Resources are the endpoints and records allocated to the tunnel
+	Resources AssignedResources `json:"resources"`
+}
+
+// AssignedResources are the resources allocated to a tunnel, so that
+// clients need not infer its endpoints from the agent's configuration
+type AssignedResources struct {
+	// Hostnames routed to the tunnel, starting with the primary one
+	Hostnames []string `json:"hostnames,omitempty"`
+
+	// URLs the hostnames of HTTP tunnels are served at
+	URLs []string `json:"urls,omitempty"`
+
+	// Ports are the public ports TCP and UDP tunnels listen on
+	Ports []PortAssignment `json:"ports,omitempty"`
+
+	// WireGuardEndpoint is the host:port the tunnel client connects to,
+	// if the agent's WireGuard endpoint is known, and WireGuardAllowedIPs
+	// the addresses it routes through the tunnel
+	WireGuardEndpoint   string   `json:"wireguard_endpoint,omitempty"`
+	WireGuardAllowedIPs []string `json:"wireguard_allowed_ips,omitempty"`
+
+	// DNSRecords are the states of the hostnames' records, if the agent
+	// manages DNS
+	DNSRecords []DNSRecordStatus `json:"dns_records,omitempty"`
+}
+
+// PortAssignment is a public port of a tunnel
+type PortAssignment struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+// DNSRecordStatus is the state of the DNS records of a hostname
+type DNSRecordStatus struct {
+	Hostname string `json:"hostname"`
+	// State is created, pending, failed or unmanaged for hostnames
+	// outside the agent's zone
+	State   string      `json:"state"`
+	Records []DNSRecord `json:"records,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// DNSRecord is a DNS record pointing a hostname at the agent
+type DNSRecord struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   int    `json:"ttl"`
+}
+
+// HeaderRules change the headers of a tunnel's requests on their way to
+// the target and of its responses on their way back
+type HeaderRules struct {
+	Request  HeaderRuleSet `json:"request"`
+	Response HeaderRuleSet `json:"response"`
+}
+
+// HeaderRuleSet removes the headers in remove, then replaces the values of
+// the headers in set and appends the values in add
+type HeaderRuleSet struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// FilterRule blocks the requests of a tunnel matching all of its set
+// conditions
+type FilterRule struct {
+	// Name identifies the rule in logs and counters: letters, digits,
+	// '_', '.' and '-'
+	Name string `json:"name"`
+
+	// Optional: the methods of the requests the rule matches
+	Methods []string `json:"methods,omitempty"`
+
+	// Optional: regular expressions matching the request path and the
+	// User-Agent header
+	Path      string `json:"path,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// Optional: regular expressions keyed by header name matching one of
+	// the header's values; the header must be present, with any value if
+	// the expression is empty
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// EdgeAuth authenticates the clients of a tunnel at the agent. Exactly
+// one of BasicAuth and OIDC is set.
+type EdgeAuth struct {
+	// BasicAuth maps user names to bcrypt hashes of their passwords
+	BasicAuth map[string]string `json:"basic_auth,omitempty"`
+	OIDC      *OIDCAuth         `json:"oidc,omitempty"`
+}
+
+// OIDCAuth signs the clients of a tunnel in with an OpenID Connect
+// provider. The provider must accept
+// https://<hostname>/.easy-tunnel/oidc/callback as redirect URI.
+type OIDCAuth struct {
+	// Issuer is the provider's https URL
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// AllowedEmails and AllowedDomains, if set, only let users with these
+	// email addresses, or addresses in these domains, in
+	AllowedEmails  []string `json:"allowed_emails,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+}
+
+// ClientCertAuth requires the clients of a tunnel to present a certificate
+// signed by one of its CAs. The certificate's subject and SHA-256
+// fingerprint reach the target in the X-Client-Cert-Subject and
+// X-Client-Cert-Fingerprint headers.
+type ClientCertAuth struct {
+	// CA is a PEM bundle of the CA certificates
+	CA string `json:"ca"`
+	// Hostnames of the tunnel requiring client certificates; empty
+	// requires them on all of its hostnames
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+// WebSocketConfig tells a tunnel client where and how to connect over the
+// WebSocket transport
+type WebSocketConfig struct {
+	// URL the client opens the WebSocket connection to
+	URL string `json:"url"`
+
+	// Token the client presents as a bearer token; it is only returned
+	// when the tunnel is created
+	Token string `json:"token"`
+}
+
+// SSHConfig tells a tunnel client how to log in to the agent's SSH server
+// and forward its service
+type SSHConfig struct {
+	// Host and port of the agent's SSH server
+	Host string `json:"host"`
+	Port int    `json:"port"`
+
+	// User the client logs in as, the tunnel ID
+	User string `json:"user"`
+
+	// Password the client logs in with if it has no authorized key; it is
+	// only returned when the tunnel is created
+	Password string `json:"password"`
+
+	// HostKeyFingerprint is the SHA256 fingerprint of the agent's host key
+	// as shown by ssh on first connection
+	HostKeyFingerprint string `json:"host_key_fingerprint"`
+
+	// Command is an OpenSSH command line exposing the tunnel's target port
+	Command string `json:"command"`
+}
+
+// WireGuardClientConfig is the WireGuard configuration handed to a tunnel client
+type WireGuardClientConfig struct {
 	WireGuardConfig *WireGuardConfig `json:"wireguard_config,omitempty"`
+
+	// Ready-to-use wg-quick configuration for the client, if the agent's
+	// WireGuard endpoint is known
+	WireGuardQuickConfig string `json:"wireguard_quick_config,omitempty"`
+
+	// The wg-quick configuration as a base64-encoded PNG QR code, if requested
+	WireGuardQRCode string `json:"wireguard_qr_code,omitempty"`
+}
+
+// RotateKeysRequest represents the request payload for rotating a tunnel's
+// WireGuard keys. The server keys are always rotated; the client key only if
+// a new one is supplied or generated.
+type RotateKeysRequest struct {
+	// Optional: the client's new WireGuard public key
+	WireGuardPublicKey string `json:"wireguard_public_key,omitempty"`
+
+	// Optional: have the agent generate the client's new key pair
+	GenerateWireGuardKeys bool `json:"generate_wireguard_keys,omitempty"`
+
+	// Optional: also return the wg-quick configuration as a QR code;
+	// requires generate_wireguard_keys
+	IncludeQRCode bool `json:"include_qr_code,omitempty"`
+}
+
+// RotateKeysResponse represents the response for a key rotation
+type RotateKeysResponse struct {
+	TunnelID string `json:"tunnel_id"`
+
+	// The new WireGuard configuration
+	WireGuardClientConfig
 }
 
 // WireGuardConfig contains WireGuard-specific configuration
 type WireGuardConfig struct {
-	PublicKey  string `json:"public_key"`
+	PublicKey string `json:"public_key"`
+	// PrivateKey is the server's private key, omitted unless the agent
+	// runs with EXPOSE_PRIVATE_KEYS
 	PrivateKey string `json:"private_key,omitempty"`
 	ServerIP   string `json:"server_ip"`
 	ClientIP   string `json:"client_ip"`
 	Port       int    `json:"port"`
+
+	// IPv6 addresses, present if the interface has an IPv6 prefix
+	ServerIPv6 string `json:"server_ipv6,omitempty"`
+	ClientIPv6 string `json:"client_ipv6,omitempty"`
+
+	// Keepalive interval in seconds and client MTU in effect, omitted if unset
+	PersistentKeepalive int `json:"persistent_keepalive,omitempty"`
+	MTU                 int `json:"mtu,omitempty"`
+
+	// Interface is the agent's WireGuard interface holding the peer
+	Interface string `json:"interface,omitempty"`
 }
 
 // RemoveTunnelRequest represents the request payload for removing a tunnel
 type RemoveTunnelRequest struct {
-	TunnelID string `json:"tunnel_id"`
+	TunnelID string `json:"tunnel_id,omitempty"`
+
+	// Selector, instead of a tunnel ID, removes all tunnels the caller
+	// may manage whose labels match it, e.g. env=staging,team!=core
+	Selector string `json:"selector,omitempty"`
 }
 
 // RemoveTunnelResponse represents the response for a successful tunnel removal
 type RemoveTunnelResponse struct {
 	Success  bool   `json:"success"`
 	Message  string `json:"message,omitempty"`
+
+	// RemovedTunnelIDs are the tunnels a selector removed
+	RemovedTunnelIDs []string `json:"removed_tunnel_ids,omitempty"`
+}
+
+// HeartbeatRequest represents the payload a tunnel client sends periodically
+type HeartbeatRequest struct {
+	// Optional: the client's view of its local health (e.g., "healthy")
+	Health string `json:"health,omitempty"`
+
+	// Optional: the client software version
+	Version string `json:"version,omitempty"`
+}
+
+// HeartbeatResponse represents the response for a recorded heartbeat
+type HeartbeatResponse struct {
+	TunnelID string `json:"tunnel_id"`
+	Status   string `json:"status"`
+
+	// Clients are marked degraded if no heartbeat arrives within this window
+	TimeoutSeconds int `json:"timeout_seconds"`
+
+	// The tunnel's current WireGuard server public key, so clients notice
+	// scheduled key rotations
+	WireGuardPublicKey string `json:"wireguard_public_key,omitempty"`
+}
+
+// RefreshTunnelRequest extends the expiry of a tunnel
+type RefreshTunnelRequest struct {
+	// Optional: seconds from now the tunnel expires, defaulting to its
+	// ttl_seconds; it also replaces them for later refreshes
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+// RefreshTunnelResponse reports the new expiry of a tunnel
+type RefreshTunnelResponse struct {
+	TunnelID         string    `json:"tunnel_id"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	ExpiresInSeconds int       `json:"expires_in_seconds"`
+	TTLSeconds       int       `json:"ttl_seconds"`
+}
+
+// MaintenanceRequest turns a tunnel's maintenance mode on or off
+type MaintenanceRequest struct {
+	// While enabled, the tunnel's requests are answered with its
+	// maintenance page instead of being proxied
+	Enabled bool `json:"enabled"`
+}
+
+// MaintenanceResponse reports a tunnel's maintenance mode
+type MaintenanceResponse struct {
+	TunnelID string `json:"tunnel_id"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// TunnelEvent is a change in a tunnel's lifecycle, sent on the event stream
+type TunnelEvent struct {
+	// Type is created, removed, degraded, recovered, keys_rotated,
+	// hostnames_changed, paused or resumed
+	Type      string    `json:"type"`
+	TunnelID  string    `json:"tunnel_id"`
+	Hostname  string    `json:"hostname"`
+	Hostnames []string  `json:"hostnames,omitempty"`
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// PauseResponse reports whether a tunnel is paused, and after pausing it
+// how many of its open connections were closed
+type PauseResponse struct {
+	TunnelID          string `json:"tunnel_id"`
+	Paused            bool   `json:"paused"`
+	ClosedConnections int    `json:"closed_connections,omitempty"`
+}
+
+// MirrorRequest sets the tunnel receiving copies of a tunnel's HTTP
+// requests
+type MirrorRequest struct {
+	// The shadow tunnel; its responses are discarded
+	MirrorTunnelID string `json:"mirror_tunnel_id"`
+
+	// Percentage of requests mirrored, 1 to 100; all if zero
+	Percent int `json:"percent,omitempty"`
+}
+
+// TunnelPolicy overrides the agent's timeouts and limits for one tunnel;
+// zero fields keep the agent's. All but the dial timeout and the client
+// limits only apply to HTTP tunnels.
+type TunnelPolicy struct {
+	// Timeouts in seconds for connecting to the target, waiting for its
+	// response headers and whole requests
+	DialTimeoutSeconds           int `json:"dial_timeout_seconds,omitempty"`
+	ResponseHeaderTimeoutSeconds int `json:"response_header_timeout_seconds,omitempty"`
+	MaxRequestDurationSeconds    int `json:"max_request_duration_seconds,omitempty"`
+
+	// The largest request body accepted in bytes; larger requests get 413
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes,omitempty"`
+
+	// Limits on each client address: requests and TCP connections per
+	// second with bursts, and concurrent requests and connections
+	ClientRequestsPerSecond int `json:"client_requests_per_second,omitempty"`
+	ClientBurst             int `json:"client_burst,omitempty"`
+	ClientMaxConnections    int `json:"client_max_connections,omitempty"`
+
+	// How often a request that failed to reach the target is retried; 0
+	// disables retries
+	RetryAttempts *int `json:"retry_attempts,omitempty"`
+}
+
+// TunnelPolicyResponse reports the policy of a tunnel
+type TunnelPolicyResponse struct {
+	TunnelID string       `json:"tunnel_id"`
+	Policy   TunnelPolicy `json:"policy"`
+}
+
+// MirrorResponse reports the tunnel a tunnel's requests are mirrored to,
+// if any
+type MirrorResponse struct {
+	TunnelID       string `json:"tunnel_id"`
+	MirrorTunnelID string `json:"mirror_tunnel_id,omitempty"`
+	Percent        int    `json:"percent,omitempty"`
+}
+
+// CacheResponse reports the cached responses of a tunnel, and after a
+// purge how many were dropped
+type CacheResponse struct {
+	TunnelID string `json:"tunnel_id"`
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	Hits     int64  `json:"hits"`
+	Misses   int64  `json:"misses"`
+	Purged   int    `json:"purged,omitempty"`
+}
+
+// FilterRulesRequest replaces the request filter rules of a tunnel
+type FilterRulesRequest struct {
+	Rules []FilterRule `json:"rules"`
+}
+
+// FilterRulesResponse reports the request filter rules of a tunnel and
+// the requests each has blocked
+type FilterRulesResponse struct {
+	TunnelID string           `json:"tunnel_id"`
+	Rules    []FilterRule     `json:"rules"`
+	Blocked  map[string]int64 `json:"blocked"`
+}
+
+// HostnameRequest adds a hostname to or removes one from a tunnel
+type HostnameRequest struct {
+	Hostname string `json:"hostname"`
+}
+
+// HostnamesResponse lists the hostnames routed to a tunnel, starting with
+// its primary hostname
+type HostnamesResponse struct {
+	TunnelID  string   `json:"tunnel_id"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// HostnameReservationRequest reserves or releases a hostname
+type HostnameReservationRequest struct {
+	Hostname string `json:"hostname"`
+}
+
+// HostnameReservation is a hostname only its owner may create tunnels for
+type HostnameReservation struct {
+	Hostname string    `json:"hostname"`
+	Owner    string    `json:"owner"`
+	Created  time.Time `json:"created"`
+}
+
+// HostnameReservationsResponse lists hostname reservations
+type HostnameReservationsResponse struct {
+	Reservations []HostnameReservation `json:"reservations"`
+}
+
+// TenantLimits bound the resources of a tenant's tunnels; zero values are
+// unlimited
+type TenantLimits struct {
+	MaxTunnels        int   `json:"max_tunnels"`
+	MaxHostnames      int   `json:"max_hostnames"`
+	MaxPorts          int   `json:"max_ports"`
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second"`
+}
+
+// TenantUsageResponse is what a tenant's tunnels use, against its limits
+type TenantUsageResponse struct {
+	Tenant         string       `json:"tenant"`
+	Tunnels        int          `json:"tunnels"`
+	Hostnames      int          `json:"hostnames"`
+	Ports          int          `json:"ports"`
+	BytesSent      int64        `json:"bytes_sent"`
+	BytesReceived  int64        `json:"bytes_received"`
+	BytesPerSecond int64        `json:"bytes_per_second"`
+	OverBandwidth  bool         `json:"over_bandwidth"`
+	Limits         TenantLimits `json:"limits"`
+}
+
+// TrafficStats contains traffic counters for one tunnel or all tunnels.
+// Received bytes flow from public clients into tunnels; sent bytes flow back.
+type TrafficStats struct {
+	BytesSent         int64 `json:"bytes_sent"`
+	BytesReceived     int64 `json:"bytes_received"`
+	Requests          int64 `json:"requests"`
+	ActiveConnections int64 `json:"active_connections"`
+	Retries           int64 `json:"retries"`
+	Denied            int64 `json:"denied"`
+	RateLimited       int64 `json:"rate_limited"`
+
+	// Connections of the TCP and TLS passthrough listeners, omitted if
+	// there were none
+	TCP *TCPStats `json:"tcp,omitempty"`
+}
+
+// TCPStats contains the counters of TCP connections: accepted, open,
+// bytes from and to clients, and those whose target could not be dialed
+type TCPStats struct {
+	Accepted     int64 `json:"accepted"`
+	Active       int64 `json:"active"`
+	BytesIn      int64 `json:"bytes_in"`
+	BytesOut     int64 `json:"bytes_out"`
+	DialFailures int64 `json:"dial_failures"`
+}
+
+// TunnelStatsResponse represents the response for the tunnel stats endpoint
+type TunnelStatsResponse struct {
+	TunnelID string `json:"tunnel_id"`
+	TrafficStats
+
+	// Latest WireGuard handshake, omitted if none has happened yet
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+
+	// Liveness of the tunnel; degraded_reason names heartbeat and/or
+	// handshake timeouts
+	Status         string `json:"status"`
+	DegradedReason string `json:"degraded_reason,omitempty"`
+	HandshakeStale bool   `json:"handshake_stale,omitempty"`
+
+	// WireGuard transfer counters as of the handshake monitor's last poll
+	WireGuardBytesReceived int64 `json:"wireguard_bytes_received,omitempty"`
+	WireGuardBytesSent     int64 `json:"wireguard_bytes_sent,omitempty"`
+
+	// When the tunnel expires and the seconds left until then, omitted
+	// for tunnels that do not expire
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	ExpiresInSeconds int        `json:"expires_in_seconds,omitempty"`
+
+	// Requests blocked by the tunnel's request filter rules by rule name
+	Filtered map[string]int64 `json:"filtered,omitempty"`
+
+	// Quality of the network path to the WireGuard peer, omitted until it
+	// has been probed
+	Path *PathStats `json:"path,omitempty"`
+}
+
+// PathStats describe the network path of a tunnel as measured by pinging
+// its WireGuard peer over the tunnel, over the latest probes. Lost probes
+// point at the tunnel rather than the backend.
+type PathStats struct {
+	Probes    int     `json:"probes"`
+	Lost      int     `json:"lost"`
+	LossRatio float64 `json:"loss_ratio"`
+
+	// Average round-trip time of the answered probes and that of the
+	// latest answered probe, omitted if none was answered
+	RTTSeconds     float64 `json:"rtt_seconds,omitempty"`
+	LastRTTSeconds float64 `json:"last_rtt_seconds,omitempty"`
+
+	LastProbe time.Time `json:"last_probe"`
+}
+
+// LogLevelRequest represents the payload for changing log levels at runtime
+type LogLevelRequest struct {
+	// Optional: the global log level (trace, debug, info, warn, error)
+	Level string `json:"level,omitempty"`
+
+	// Optional: per-module levels keyed by module (api, loadbalancer, tunnel,
+	// wireguard). An empty level makes the module follow the global level.
+	Modules map[string]string `json:"modules,omitempty"`
+}
+
+// LogLevelResponse represents the log levels currently in effect
+type LogLevelResponse struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+// Connection is a proxied TCP connection or HTTP request in progress
+type Connection struct {
+	ID            string    `json:"id"`
+	TunnelID      string    `json:"tunnel_id"`
+	ClientAddr    string    `json:"client_addr"`
+	BackendAddr   string    `json:"backend_addr"`
+	Protocol      string    `json:"protocol"`
+	BytesReceived int64     `json:"bytes_received"`
+	BytesSent     int64     `json:"bytes_sent"`
+	Started       time.Time `json:"started"`
+	AgeSeconds    float64   `json:"age_seconds"`
+}
+
+// ConnectionsResponse lists the open connections of the load balancer
+type ConnectionsResponse struct {
+	Connections []Connection `json:"connections"`
+}
+
+// TunnelSummary describes a tunnel in the tunnel list
+type TunnelSummary struct {
+	TunnelID    string    `json:"tunnel_id"`
+	Hostname    string    `json:"hostname"`
+	Hostnames   []string  `json:"hostnames,omitempty"`
+	TargetPort  int       `json:"target_port"`
+	Transport   string    `json:"transport,omitempty"`
+	Endpoint    string    `json:"endpoint,omitempty"`
+	Protocol    string    `json:"protocol,omitempty"`
+	ListenPort  int       `json:"listen_port,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Status      string    `json:"status"`
+	Maintenance bool      `json:"maintenance,omitempty"`
+	Paused      bool      `json:"paused,omitempty"`
+	Created     time.Time `json:"created"`
+	LastActive  time.Time `json:"last_active"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// When the tunnel expires and the seconds left until then, omitted
+	// for tunnels that do not expire
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	ExpiresInSeconds int        `json:"expires_in_seconds,omitempty"`
+}
+
+// TunnelsResponse lists the tunnels
+type TunnelsResponse struct {
+	Tunnels []TunnelSummary `json:"tunnels"`
+}
+
+// Route is an entry of the load balancer's routing table: a hostname,
+// optionally restricted to a path, or a TCP listen port, and the target.
+// Static routes have no tunnel and answer with their redirect or response.
+type Route struct {
+	TunnelID string `json:"tunnel_id"`
+	// Protocol is tls for TLS passthrough by hostname and udp for UDP
+	// listen ports, empty for HTTP and TCP routes
+	Protocol string `json:"protocol,omitempty"`
+	// Hostname of HTTP routes may be a wildcard, *.domain or *
+	Hostname string `json:"hostname,omitempty"`
+	// PathType is PathPrefix or Exact for routes restricted to Path
+	PathType   string `json:"path_type,omitempty"`
+	Path       string `json:"path,omitempty"`
+	// Priority orders path routes matching the same requests, higher first
+	Priority   int    `json:"priority,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+	IP         string `json:"ip"`
+	Port       int    `json:"port"`
+	Redirect   *RouteRedirect `json:"redirect,omitempty"`
+	Response   *RouteResponse `json:"response,omitempty"`
+}
+
+// RoutesResponse lists the routing table
+type RoutesResponse struct {
+	Routes []Route `json:"routes"`
+}
+
+// RouteRedirect redirects the requests of a static route
+type RouteRedirect struct {
+	URL string `json:"url"`
+	// Status is 301, 302, 303, 307 or 308; 301 if not set
+	Status int `json:"status,omitempty"`
+	// PreservePath appends the path and query of requests to URL
+	PreservePath bool `json:"preserve_path,omitempty"`
+}
+
+// RouteResponse is the fixed response of a static route
+type RouteResponse struct {
+	// Status is 200 if not set
+	Status int `json:"status,omitempty"`
+	// ContentType is text/plain if not set
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// StaticRouteRequest adds a static route for a hostname, optionally
+// restricted to a path, or removes it. Adding needs either a redirect or a
+// response.
+type StaticRouteRequest struct {
+	Hostname string         `json:"hostname"`
+	PathType string         `json:"path_type,omitempty"`
+	Path     string         `json:"path,omitempty"`
+	Priority int            `json:"priority,omitempty"`
+	Redirect *RouteRedirect `json:"redirect,omitempty"`
+	Response *RouteResponse `json:"response,omitempty"`
+}
+
+// RouteValidationRequest is a route to check against the routing table
+// without adding it: a route of the tunnel with TunnelID or, with a
+// redirect or a response, a static route
+type RouteValidationRequest struct {
+	TunnelID   string         `json:"tunnel_id,omitempty"`
+	Protocol   string         `json:"protocol,omitempty"`
+	Hostname   string         `json:"hostname,omitempty"`
+	PathType   string         `json:"path_type,omitempty"`
+	Path       string         `json:"path,omitempty"`
+	Priority   int            `json:"priority,omitempty"`
+	ListenPort int            `json:"listen_port,omitempty"`
+	Redirect   *RouteRedirect `json:"redirect,omitempty"`
+	Response   *RouteResponse `json:"response,omitempty"`
+}
+
+// RouteValidationResponse reports whether a route can be added and which
+// routes match some of the same requests
+type RouteValidationResponse struct {
+	Valid bool `json:"valid"`
+	// Error is why the route cannot be added
+	Error    string         `json:"error,omitempty"`
+	Overlaps []RouteOverlap `json:"overlaps"`
+}
+
+// RouteOverlap is a route of the routing table matching some of the
+// requests of a checked route. Outcome is existing if the route keeps
+// them, new if the checked route takes them over, shared if both are
+// tunnels of the same hostname and conflict if neither takes precedence.
+type RouteOverlap struct {
+	Route   Route  `json:"route"`
+	Outcome string `json:"outcome"`
 }
 
 // StatusResponse represents the response for the status endpoint
@@ -57,11 +832,230 @@ type StatusResponse struct {
 	Version   string `json:"version"`
 	Uptime    string `json:"uptime"`
 	NumTunnels int   `json:"num_tunnels"`
+	NumDegraded int  `json:"num_degraded"`
+	// Tunnels whose WireGuard handshakes stopped
+	NumStaleHandshakes int `json:"num_stale_handshakes"`
+	Traffic   TrafficStats `json:"traffic"`
+	// Components are the results of the readiness checks; the status is
+	// unhealthy while any is failing
+	Components []ComponentStatus `json:"components"`
+	// Details describe each subsystem, only with ?verbose=true
+	Details *StatusDetails `json:"details,omitempty"`
+}
+
+// StatusDetails are the per-subsystem details of the verbose status
+type StatusDetails struct {
+	Build   BuildInfo    `json:"build"`
+	Runtime RuntimeStats `json:"runtime"`
+	// ConfigChecksum is a hash of the effective configuration, equal on
+	// agents with the same settings
+	ConfigChecksum string                     `json:"config_checksum,omitempty"`
+	Listeners      []ListenerStatus           `json:"listeners,omitempty"`
+	WireGuard      []WireGuardInterfaceStatus `json:"wireguard,omitempty"`
+	// Persistence is the state of the routes file, if one is configured
+	Persistence *PersistenceStatus `json:"persistence,omitempty"`
+}
+
+// BuildInfo identifies the build of the agent
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// RuntimeStats are the goroutine and memory statistics of the agent
+type RuntimeStats struct {
+	Goroutines          int        `json:"goroutines"`
+	GOMAXPROCS          int        `json:"gomaxprocs"`
+	HeapAllocBytes      int64      `json:"heap_alloc_bytes"`
+	HeapSysBytes        int64      `json:"heap_sys_bytes"`
+	NumGC               int64      `json:"num_gc"`
+	GCPauseTotalSeconds float64    `json:"gc_pause_total_seconds"`
+	LastGC              *time.Time `json:"last_gc,omitempty"`
+}
+
+// ListenerStatus is the state of a port the load balancer serves
+type ListenerStatus struct {
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	Address   string `json:"address"`
+	Listening bool   `json:"listening"`
+}
+
+// WireGuardInterfaceStatus is the state of a WireGuard interface
+type WireGuardInterfaceStatus struct {
+	Name       string `json:"name"`
+	PublicKey  string `json:"public_key,omitempty"`
+	ListenPort int    `json:"listen_port"`
+	Peers      int    `json:"peers"`
+	Error      string `json:"error,omitempty"`
+}
+
+// PersistenceStatus is the state of the routes file
+type PersistenceStatus struct {
+	RoutesFile string     `json:"routes_file"`
+	LastSaved  *time.Time `json:"last_saved,omitempty"`
+	Healthy    bool       `json:"healthy"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// ComponentStatus is the result of the health check of a component
+type ComponentStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // ok or failing
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthResponse is the response of the /healthz and /readyz probes
+type HealthResponse struct {
+	Status     string            `json:"status"`
+	Components []ComponentStatus `json:"components,omitempty"`
 }
 
 // ErrorResponse represents an error response from the API
 type ErrorResponse struct {
 	Error   string `json:"error"`
 	Code    int    `json:"code"`
+	// ErrorCode tells errors apart for programs: not_found, conflict,
+	// limit_exceeded, rate_limited, invalid_request, forbidden and others
+	ErrorCode string `json:"error_code"`
 	Details string `json:"details,omitempty"`
-} 
\ No newline at end of file
+} 
+// HAStateResponse is the tunnel state a standby agent mirrors from the leader
+type HAStateResponse struct {
+	Tunnels []HATunnel `json:"tunnels"`
+}
+
+// HATunnel is the configuration of one tunnel, as passed to CreateTunnel
+type HATunnel struct {
+	TunnelID           string            `json:"tunnel_id"`
+	Hostname           string            `json:"hostname"`
+	TargetPort         int               `json:"target_port"`
+	WireGuardPublicKey string            `json:"wireguard_public_key,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+
+	Hostnames []string `json:"hostnames,omitempty"`
+
+	Protocol   string `json:"protocol,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+
+	PersistentKeepalive        int    `json:"persistent_keepalive,omitempty"`
+	MTU                        int    `json:"mtu,omitempty"`
+	KeyRotationIntervalSeconds int    `json:"key_rotation_interval_seconds,omitempty"`
+	WireGuardInterface         string `json:"wireguard_interface,omitempty"`
+
+	DialTimeoutSeconds           int `json:"dial_timeout_seconds,omitempty"`
+	ResponseHeaderTimeoutSeconds int `json:"response_header_timeout_seconds,omitempty"`
+	MaxRequestDurationSeconds    int `json:"max_request_duration_seconds,omitempty"`
+
+	BackendTLS                   bool   `json:"backend_tls,omitempty"`
+	BackendTLSServerName         string `json:"backend_tls_server_name,omitempty"`
+	BackendTLSInsecureSkipVerify bool   `json:"backend_tls_insecure_skip_verify,omitempty"`
+
+	ErrorPages  map[string]string `json:"error_pages,omitempty"`
+	Maintenance bool              `json:"maintenance,omitempty"`
+	Paused      bool              `json:"paused,omitempty"`
+	HeaderRules *HeaderRules      `json:"header_rules,omitempty"`
+
+	HostRewrite   string `json:"host_rewrite,omitempty"`
+	OriginRewrite string `json:"origin_rewrite,omitempty"`
+
+	Compression        *bool `json:"compression,omitempty"`
+	CompressionMinSize int   `json:"compression_min_size,omitempty"`
+
+	Cache              *bool `json:"cache,omitempty"`
+	CacheMaxBytes      int64 `json:"cache_max_bytes,omitempty"`
+	CacheMaxTTLSeconds int   `json:"cache_max_ttl_seconds,omitempty"`
+
+	AllowedIPs       []string `json:"allowed_ips,omitempty"`
+	DeniedIPs        []string `json:"denied_ips,omitempty"`
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	DeniedCountries  []string `json:"denied_countries,omitempty"`
+
+	RequestFilters []FilterRule `json:"request_filters,omitempty"`
+
+	ClientRequestsPerSecond int `json:"client_requests_per_second,omitempty"`
+	ClientBurst             int `json:"client_burst,omitempty"`
+	ClientMaxConnections    int `json:"client_max_connections,omitempty"`
+
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes,omitempty"`
+	RetryAttempts       *int  `json:"retry_attempts,omitempty"`
+
+	MirrorTunnelID string `json:"mirror_tunnel_id,omitempty"`
+	MirrorPercent  int    `json:"mirror_percent,omitempty"`
+
+	EdgeAuth *EdgeAuth `json:"edge_auth,omitempty"`
+
+	ClientCertAuth *ClientCertAuth `json:"client_cert_auth,omitempty"`
+
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds int        `json:"ttl_seconds,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// AgentState is an export of the tunnels and static routes of an agent,
+// for another agent to import
+type AgentState struct {
+	// Version of the agent that exported the state
+	Version      string           `json:"version"`
+	ExportedAt   time.Time        `json:"exported_at"`
+	Tunnels      []ExportedTunnel `json:"tunnels"`
+	StaticRoutes []Route          `json:"static_routes"`
+}
+
+// ExportedTunnel is the configuration of a tunnel in an export. The
+// connect token of the tunnel's client and the private key of its
+// WireGuard peer are sealed with the agent's secrets key, and left out
+// without one.
+type ExportedTunnel struct {
+	HATunnel
+
+	Transport    string `json:"transport,omitempty"`
+	Tenant       string `json:"tenant,omitempty"`
+	SSHPublicKey string `json:"ssh_public_key,omitempty"`
+
+	SealedConnectToken        string `json:"sealed_connect_token,omitempty"`
+	SealedWireGuardPrivateKey string `json:"sealed_wireguard_private_key,omitempty"`
+}
+
+// ImportResponse reports the tunnels and static routes an import created
+type ImportResponse struct {
+	Imported     []string        `json:"imported"`
+	StaticRoutes int             `json:"static_routes"`
+	Failed       []ImportFailure `json:"failed"`
+
+	// ReissuedConnectTokens are the tunnels whose clients got a new
+	// connect token, because the export had none or it could not be opened
+	ReissuedConnectTokens []string `json:"reissued_connect_tokens,omitempty"`
+
+	// NewWireGuardKeys are the new server public keys of WireGuard tunnels
+	// by tunnel ID, because the export had no private key or it could not
+	// be opened; their clients need the new key
+	NewWireGuardKeys map[string]string `json:"new_wireguard_keys,omitempty"`
+}
+
+// ImportFailure is a tunnel, or the static route of a hostname, that could
+// not be imported
+type ImportFailure struct {
+	TunnelID string `json:"tunnel_id,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Error    string `json:"error"`
+}
+
+// AuditResponse is the response for audit log queries
+type AuditResponse struct {
+	Events []audit.Event `json:"events"`
+}
+
+// UsageResponse is the response for usage exports
+type UsageResponse struct {
+	Records []usage.Record `json:"records"`
+}
+
+// VersionsResponse lists the API versions the agent serves
+type VersionsResponse struct {
+	Current   string   `json:"current"`
+	Supported []string `json:"supported"`
+}
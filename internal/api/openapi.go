@@ -0,0 +1,519 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPIDocument is an OpenAPI 3 document
+type OpenAPIDocument struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+// OpenAPIInfo describes the API
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// Operation is one method on one path
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter is a path, query or header parameter
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody is a JSON request body
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response is a JSON response
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema of a body
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the named schemas and security schemes
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+// SecurityScheme describes how callers authenticate
+type SecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+// Schema is a JSON schema
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// apiOperation describes an endpoint for the OpenAPI document
+type apiOperation struct {
+	method      string
+	path        string
+	operationID string
+	summary     string
+	params      []Parameter
+	request     interface{}
+	response    interface{}
+	status      int
+	public      bool
+}
+
+var tunnelIDParam = Parameter{Name: "tunnel_id", In: "path", Required: true, Schema: &Schema{Type: "string"}}
+
+// apiOperations lists the documented endpoints
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/api/versions", operationID: "getVersions",
+		summary:  "List the API versions the agent serves",
+		response: VersionsResponse{}, public: true,
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/new-tunnel"), operationID: "createTunnel",
+		summary:  "Create a tunnel",
+		params:   []Parameter{{Name: IdempotencyKeyHeader, In: "header", Schema: &Schema{Type: "string"}}},
+		request:  CreateTunnelRequest{},
+		response: CreateTunnelResponse{}, status: http.StatusCreated,
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/remove-tunnel"), operationID: "removeTunnel",
+		summary:  "Remove a tunnel, or the tunnels matching a label selector",
+		request:  RemoveTunnelRequest{},
+		response: RemoveTunnelResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/status"), operationID: "getStatus",
+		summary: "Get the agent status",
+		// Verbose status needs the admin scope when callers authenticate
+		params:   []Parameter{{Name: "verbose", In: "query", Schema: &Schema{Type: "boolean"}}},
+		response: StatusResponse{}, public: true,
+	},
+	{
+		method: http.MethodGet, path: "/healthz", operationID: "getHealth",
+		summary:  "Check that the agent process is alive",
+		response: HealthResponse{}, public: true,
+	},
+	{
+		method: http.MethodGet, path: "/readyz", operationID: "getReadiness",
+		summary:  "Check that the agent is ready to serve traffic",
+		response: HealthResponse{}, public: true,
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels"), operationID: "listTunnels",
+		summary:  "List the tunnels",
+		params:   []Parameter{{Name: "selector", In: "query", Schema: &Schema{Type: "string"}}},
+		response: TunnelsResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/tunnels/{tunnel_id}/heartbeat"), operationID: "heartbeat",
+		summary:  "Report that a tunnel client is alive",
+		params:   []Parameter{tunnelIDParam},
+		request:  HeartbeatRequest{},
+		response: HeartbeatResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/tunnels/{tunnel_id}/refresh"), operationID: "refreshTunnel",
+		summary:  "Extend the expiry of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		request:  RefreshTunnelRequest{},
+		response: RefreshTunnelResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/tunnels/{tunnel_id}/rotate-keys"), operationID: "rotateKeys",
+		summary:  "Rotate the WireGuard keys of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		request:  RotateKeysRequest{},
+		response: RotateKeysResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels/{tunnel_id}/stats"), operationID: "getTunnelStats",
+		summary:  "Get the traffic statistics of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		response: TunnelStatsResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels/{tunnel_id}/maintenance"), operationID: "getMaintenance",
+		summary:  "Get the maintenance mode of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		response: MaintenanceResponse{},
+	},
+	{
+		method: http.MethodPut, path: VersionPath("/tunnels/{tunnel_id}/maintenance"), operationID: "setMaintenance",
+		summary:  "Turn the maintenance mode of a tunnel on or off",
+		params:   []Parameter{tunnelIDParam},
+		request:  MaintenanceRequest{},
+		response: MaintenanceResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/tunnels/{tunnel_id}/pause"), operationID: "pauseTunnel",
+		summary:  "Withdraw the routes of a tunnel, keeping its client connected",
+		params:   []Parameter{tunnelIDParam},
+		response: PauseResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/tunnels/{tunnel_id}/resume"), operationID: "resumeTunnel",
+		summary:  "Route a paused tunnel again",
+		params:   []Parameter{tunnelIDParam},
+		response: PauseResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels/{tunnel_id}/mirror"), operationID: "getMirror",
+		summary:  "Get the tunnel a tunnel's requests are mirrored to",
+		params:   []Parameter{tunnelIDParam},
+		response: MirrorResponse{},
+	},
+	{
+		method: http.MethodPut, path: VersionPath("/tunnels/{tunnel_id}/mirror"), operationID: "setMirror",
+		summary:  "Mirror copies of a tunnel's requests to another tunnel",
+		params:   []Parameter{tunnelIDParam},
+		request:  MirrorRequest{},
+		response: MirrorResponse{},
+	},
+	{
+		method: http.MethodDelete, path: VersionPath("/tunnels/{tunnel_id}/mirror"), operationID: "removeMirror",
+		summary:  "Stop mirroring a tunnel's requests",
+		params:   []Parameter{tunnelIDParam},
+		response: MirrorResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels/{tunnel_id}/filters"), operationID: "getFilters",
+		summary:  "Get the request filter rules of a tunnel and the requests they blocked",
+		params:   []Parameter{tunnelIDParam},
+		response: FilterRulesResponse{},
+	},
+	{
+		method: http.MethodPut, path: VersionPath("/tunnels/{tunnel_id}/filters"), operationID: "setFilters",
+		summary:  "Replace the request filter rules of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		request:  FilterRulesRequest{},
+		response: FilterRulesResponse{},
+	},
+	{
+		method: http.MethodDelete, path: VersionPath("/tunnels/{tunnel_id}/filters"), operationID: "removeFilters",
+		summary:  "Remove the request filter rules of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		response: FilterRulesResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels/{tunnel_id}/policy"), operationID: "getPolicy",
+		summary:  "Get the timeouts and limits of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		response: TunnelPolicyResponse{},
+	},
+	{
+		method: http.MethodPut, path: VersionPath("/tunnels/{tunnel_id}/policy"), operationID: "setPolicy",
+		summary:  "Replace the timeouts and limits of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		request:  TunnelPolicy{},
+		response: TunnelPolicyResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels/{tunnel_id}/cache"), operationID: "getCache",
+		summary:  "Get the cached responses of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		response: CacheResponse{},
+	},
+	{
+		method: http.MethodDelete, path: VersionPath("/tunnels/{tunnel_id}/cache"), operationID: "purgeCache",
+		summary:  "Purge the cached responses of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		response: CacheResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tunnels/{tunnel_id}/hostnames"), operationID: "getHostnames",
+		summary:  "List the hostnames of a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		response: HostnamesResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/tunnels/{tunnel_id}/hostnames"), operationID: "addHostname",
+		summary:  "Route another hostname to a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		request:  HostnameRequest{},
+		response: HostnamesResponse{},
+	},
+	{
+		method: http.MethodDelete, path: VersionPath("/tunnels/{tunnel_id}/hostnames"), operationID: "removeHostname",
+		summary:  "Stop routing a hostname to a tunnel",
+		params:   []Parameter{tunnelIDParam},
+		request:  HostnameRequest{},
+		response: HostnamesResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/hostname-reservations"), operationID: "listHostnameReservations",
+		summary:  "List the hostnames reserved by the caller",
+		response: HostnameReservationsResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/hostname-reservations"), operationID: "reserveHostname",
+		summary:  "Reserve a hostname for the caller",
+		request:  HostnameReservationRequest{},
+		response: HostnameReservation{},
+	},
+	{
+		method: http.MethodDelete, path: VersionPath("/hostname-reservations"), operationID: "releaseHostname",
+		summary:  "Release a hostname reservation",
+		request:  HostnameReservationRequest{},
+		response: HostnameReservation{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/tenants/{tenant_id}/usage"), operationID: "getTenantUsage",
+		summary:  "Get what the tunnels of a tenant use, against its limits",
+		params:   []Parameter{{Name: "tenant_id", In: "path", Required: true, Schema: &Schema{Type: "string"}}},
+		response: TenantUsageResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/admin/log-level"), operationID: "getLogLevel",
+		summary:  "Get the log levels in effect",
+		response: LogLevelResponse{},
+	},
+	{
+		method: http.MethodPut, path: VersionPath("/admin/log-level"), operationID: "setLogLevel",
+		summary:  "Change log levels",
+		request:  LogLevelRequest{},
+		response: LogLevelResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/admin/audit"), operationID: "queryAudit",
+		summary: "Query the audit log",
+		params: []Parameter{
+			{Name: "action", In: "query", Schema: &Schema{Type: "string"}},
+			{Name: "caller", In: "query", Schema: &Schema{Type: "string"}},
+			{Name: "tunnel_id", In: "query", Schema: &Schema{Type: "string"}},
+			{Name: "since", In: "query", Schema: &Schema{Type: "string", Format: "date-time"}},
+			{Name: "limit", In: "query", Schema: &Schema{Type: "integer"}},
+		},
+		response: AuditResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/admin/usage"), operationID: "exportUsage",
+		summary: "Export the traffic of tunnels per bucket, as JSON or CSV",
+		params: []Parameter{
+			{Name: "tenant", In: "query", Schema: &Schema{Type: "string"}},
+			{Name: "tunnel_id", In: "query", Schema: &Schema{Type: "string"}},
+			{Name: "since", In: "query", Schema: &Schema{Type: "string", Format: "date-time"}},
+			{Name: "until", In: "query", Schema: &Schema{Type: "string", Format: "date-time"}},
+			{Name: "format", In: "query", Schema: &Schema{Type: "string"}},
+		},
+		response: UsageResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/admin/routes"), operationID: "listRoutes",
+		summary:  "List the routing table of the load balancer",
+		response: RoutesResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/admin/routes"), operationID: "addStaticRoute",
+		summary:  "Answer requests to a hostname with a redirect or a fixed response",
+		request:  StaticRouteRequest{},
+		response: RoutesResponse{},
+	},
+	{
+		method: http.MethodDelete, path: VersionPath("/admin/routes"), operationID: "removeStaticRoute",
+		summary:  "Remove a static route",
+		request:  StaticRouteRequest{},
+		response: RoutesResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/admin/export"), operationID: "exportState",
+		summary:  "Export the tunnels and static routes of the agent",
+		response: AgentState{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/admin/import"), operationID: "importState",
+		summary:  "Create the tunnels and static routes of an export",
+		request:  AgentState{},
+		response: ImportResponse{},
+	},
+	{
+		method: http.MethodPost, path: VersionPath("/admin/routes/validate"), operationID: "validateRoute",
+		summary:  "Check a route against the routing table without adding it",
+		request:  RouteValidationRequest{},
+		response: RouteValidationResponse{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/admin/connections"), operationID: "listConnections",
+		summary:  "List the open proxied connections",
+		params:   []Parameter{{Name: "tunnel_id", In: "query", Schema: &Schema{Type: "string"}}},
+		response: ConnectionsResponse{},
+	},
+	{
+		method: http.MethodDelete, path: VersionPath("/admin/connections/{connection_id}"), operationID: "killConnection",
+		summary:  "Close a proxied connection",
+		params:   []Parameter{{Name: "connection_id", In: "path", Required: true, Schema: &Schema{Type: "string"}}},
+		response: Connection{},
+	},
+	{
+		method: http.MethodGet, path: VersionPath("/ha/state"), operationID: "getHAState",
+		summary:  "Get the tunnels for standby agents to mirror",
+		response: HAStateResponse{}, public: true,
+	},
+}
+
+// OpenAPISpec builds the OpenAPI document of the API, deriving the schemas
+// from the request and response models
+func OpenAPISpec(version string) *OpenAPIDocument {
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "Easy Tunnel LB Agent API", Version: version},
+		Paths:   make(map[string]map[string]*Operation),
+		Components: Components{
+			Schemas:         make(map[string]*Schema),
+			SecuritySchemes: map[string]*SecurityScheme{"bearerAuth": {Type: "http", Scheme: "bearer"}},
+		},
+	}
+	errorSchema := doc.schemaFor(reflect.TypeOf(ErrorResponse{}))
+
+	for _, op := range apiOperations {
+		operation := &Operation{
+			OperationID: op.operationID,
+			Summary:     op.summary,
+			Parameters:  op.params,
+			Responses: map[string]*Response{
+				"default": {Description: "Error", Content: jsonContent(errorSchema)},
+			},
+		}
+		if op.request != nil {
+			operation.RequestBody = &RequestBody{
+				Required: true,
+				Content:  jsonContent(doc.schemaFor(reflect.TypeOf(op.request))),
+			}
+		}
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		operation.Responses[strconv.Itoa(status)] = &Response{
+			Description: http.StatusText(status),
+			Content:     jsonContent(doc.schemaFor(reflect.TypeOf(op.response))),
+		}
+		if !op.public {
+			operation.Security = []map[string][]string{{"bearerAuth": {}}}
+		}
+
+		if doc.Paths[op.path] == nil {
+			doc.Paths[op.path] = make(map[string]*Operation)
+		}
+		doc.Paths[op.path][strings.ToLower(op.method)] = operation
+	}
+	return doc
+}
+
+func jsonContent(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: schema}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns the schema of t, adding structs to the components and
+// referencing them
+func (doc *OpenAPIDocument) schemaFor(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice:
+		return &Schema{Type: "array", Items: doc.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: doc.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, exists := doc.Components.Schemas[name]; !exists {
+			schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+			doc.Components.Schemas[name] = schema
+			doc.addFields(schema, t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+// addFields adds the JSON fields of struct t, including embedded ones, to schema
+func (doc *OpenAPIDocument) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			doc.addFields(schema, field.Type)
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = doc.schemaFor(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+// schemaName names the component for a struct; models from other packages
+// are prefixed with their package name
+func schemaName(t reflect.Type) string {
+	if t.PkgPath() == reflect.TypeOf(Handler{}).PkgPath() {
+		return t.Name()
+	}
+	pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+	return strings.ToUpper(pkg[:1]) + pkg[1:] + t.Name()
+}
+
+func (h *Handler) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.sendJSON(w, OpenAPISpec(h.version), http.StatusOK)
+}
@@ -0,0 +1,38 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"net/http"
+)
+
+// handlePause pauses or resumes a tunnel. Pausing also closes the open
+// connections of the tunnel, which the load balancer would otherwise keep
+// proxying.
+func (h *Handler) handlePause(w http.ResponseWriter, r *http.Request, id string, paused bool) {
+	if r.Method != http.MethodPost {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rejectStandby(w) {
+		return
+	}
+
+	if err := h.tunnelManager.SetPaused(id, paused); err != nil {
+		h.sendErrorFor(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := PauseResponse{TunnelID: id, Paused: paused}
+	if paused && h.connections != nil {
+		for _, conn := range h.connections.Connections() {
+			if conn.TunnelID != id {
+				continue
+			}
+			// Connections may close by themselves in the meantime
+			if err := h.connections.KillConnection(conn.ID); err == nil {
+				resp.ClosedConnections++
+			}
+		}
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
@@ -0,0 +1,203 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// PolicyLimits are the largest values tunnel policies may set; zero leaves
+// a setting unbounded
+type PolicyLimits struct {
+	// MaxTimeout bounds each of the timeouts
+	MaxTimeout time.Duration
+
+	// MaxRequestBody bounds the request body limit in bytes
+	MaxRequestBody int64
+
+	// MaxClientRequestsPerSecond bounds the client request rate and burst,
+	// and MaxClientConnections the concurrent connections of a client
+	MaxClientRequestsPerSecond int
+	MaxClientConnections       int
+
+	// MaxRetryAttempts bounds the retries of a request
+	MaxRetryAttempts int
+}
+
+// SetPolicyLimits bounds the timeouts and limits tunnels may set
+func (h *Handler) SetPolicyLimits(limits PolicyLimits) {
+	h.policyLimits = limits
+}
+
+// requestedPolicy returns the policy a tunnel creation requests: the
+// top-level fields, overridden by the non-zero fields of the policy block
+func requestedPolicy(req *CreateTunnelRequest) TunnelPolicy {
+	policy := TunnelPolicy{
+		DialTimeoutSeconds:           req.DialTimeoutSeconds,
+		ResponseHeaderTimeoutSeconds: req.ResponseHeaderTimeoutSeconds,
+		MaxRequestDurationSeconds:    req.MaxRequestDurationSeconds,
+		ClientRequestsPerSecond:      req.ClientRequestsPerSecond,
+		ClientBurst:                  req.ClientBurst,
+		ClientMaxConnections:         req.ClientMaxConnections,
+	}
+	block := req.Policy
+	if block == nil {
+		return policy
+	}
+	for _, field := range []struct{ value, override *int }{
+		{&policy.DialTimeoutSeconds, &block.DialTimeoutSeconds},
+		{&policy.ResponseHeaderTimeoutSeconds, &block.ResponseHeaderTimeoutSeconds},
+		{&policy.MaxRequestDurationSeconds, &block.MaxRequestDurationSeconds},
+		{&policy.ClientRequestsPerSecond, &block.ClientRequestsPerSecond},
+		{&policy.ClientBurst, &block.ClientBurst},
+		{&policy.ClientMaxConnections, &block.ClientMaxConnections},
+	} {
+		if *field.override != 0 {
+			*field.value = *field.override
+		}
+	}
+	policy.MaxRequestBodyBytes = block.MaxRequestBodyBytes
+	policy.RetryAttempts = block.RetryAttempts
+	return policy
+}
+
+// timeouts returns the proxy timeouts of a policy
+func (p TunnelPolicy) timeouts() tunnel.ProxyTimeouts {
+	return tunnel.ProxyTimeouts{
+		Dial:           time.Duration(p.DialTimeoutSeconds) * time.Second,
+		ResponseHeader: time.Duration(p.ResponseHeaderTimeoutSeconds) * time.Second,
+		MaxRequest:     time.Duration(p.MaxRequestDurationSeconds) * time.Second,
+	}
+}
+
+// clientLimits returns the per-client limits of a policy
+func (p TunnelPolicy) clientLimits() loadbalancer.ClientLimits {
+	return loadbalancer.ClientLimits{
+		RequestsPerSecond: p.ClientRequestsPerSecond,
+		Burst:             p.ClientBurst,
+		MaxConnections:    p.ClientMaxConnections,
+	}
+}
+
+// httpOnly reports whether a policy sets options that only apply to HTTP
+// tunnels
+func (p TunnelPolicy) httpOnly() bool {
+	return p.ResponseHeaderTimeoutSeconds != 0 || p.MaxRequestDurationSeconds != 0 ||
+		p.MaxRequestBodyBytes != 0 || p.RetryAttempts != nil
+}
+
+// validatePolicy checks that a policy sets no negative values and none
+// above the limits
+func (h *Handler) validatePolicy(p TunnelPolicy) error {
+	if err := p.timeouts().Validate(); err != nil {
+		return err
+	}
+	if err := p.clientLimits().Validate(); err != nil {
+		return err
+	}
+	if p.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("invalid max request body size: %d", p.MaxRequestBodyBytes)
+	}
+	if p.RetryAttempts != nil && *p.RetryAttempts < 0 {
+		return fmt.Errorf("invalid retry attempts: %d", *p.RetryAttempts)
+	}
+
+	limits := h.policyLimits
+	exceeds := func(name string, value, max int64) error {
+		if max > 0 && value > max {
+			return fmt.Errorf("%s exceeds the maximum of %d", name, max)
+		}
+		return nil
+	}
+	maxTimeout := int64(limits.MaxTimeout / time.Second)
+	retries := 0
+	if p.RetryAttempts != nil {
+		retries = *p.RetryAttempts
+	}
+	return errors.Join(
+		exceeds("dial_timeout_seconds", int64(p.DialTimeoutSeconds), maxTimeout),
+		exceeds("response_header_timeout_seconds", int64(p.ResponseHeaderTimeoutSeconds), maxTimeout),
+		exceeds("max_request_duration_seconds", int64(p.MaxRequestDurationSeconds), maxTimeout),
+		exceeds("max_request_body_bytes", p.MaxRequestBodyBytes, limits.MaxRequestBody),
+		exceeds("client_requests_per_second", int64(p.ClientRequestsPerSecond), int64(limits.MaxClientRequestsPerSecond)),
+		exceeds("client_burst", int64(p.ClientBurst), int64(limits.MaxClientRequestsPerSecond)),
+		exceeds("client_max_connections", int64(p.ClientMaxConnections), int64(limits.MaxClientConnections)),
+		exceeds("retry_attempts", int64(retries), int64(limits.MaxRetryAttempts)),
+	)
+}
+
+// setPolicy applies a validated policy to a tunnel
+func (h *Handler) setPolicy(id string, p TunnelPolicy) error {
+	if err := h.tunnelManager.SetProxyTimeouts(id, p.timeouts()); err != nil {
+		return err
+	}
+	if err := h.tunnelManager.SetClientLimits(id, tunnel.ClientLimits(p.clientLimits())); err != nil {
+		return err
+	}
+	return h.tunnelManager.SetRequestPolicy(id, tunnel.RequestPolicy{
+		MaxRequestBody: p.MaxRequestBodyBytes,
+		RetryAttempts:  p.RetryAttempts,
+	})
+}
+
+// tunnelPolicy returns the policy of a tunnel
+func tunnelPolicy(t *tunnel.TunnelInfo) TunnelPolicy {
+	return TunnelPolicy{
+		DialTimeoutSeconds:           int(t.ProxyTimeouts.Dial / time.Second),
+		ResponseHeaderTimeoutSeconds: int(t.ProxyTimeouts.ResponseHeader / time.Second),
+		MaxRequestDurationSeconds:    int(t.ProxyTimeouts.MaxRequest / time.Second),
+		MaxRequestBodyBytes:          t.RequestPolicy.MaxRequestBody,
+		ClientRequestsPerSecond:      t.ClientLimits.RequestsPerSecond,
+		ClientBurst:                  t.ClientLimits.Burst,
+		ClientMaxConnections:         t.ClientLimits.MaxConnections,
+		RetryAttempts:                t.RequestPolicy.RetryAttempts,
+	}
+}
+
+// handlePolicy reports or replaces the timeouts and limits of a tunnel
+func (h *Handler) handlePolicy(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := h.tunnelManager.GetTunnel(id)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if h.rejectStandby(w) {
+			return
+		}
+		var policy TunnelPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := h.validatePolicy(policy); err != nil {
+			h.sendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if t.Protocol != "" && t.Protocol != tunnel.ProtocolHTTP && policy.httpOnly() {
+			h.sendError(w, fmt.Sprintf("HTTP options cannot be used with the %s protocol", t.Protocol), http.StatusBadRequest)
+			return
+		}
+		if err := h.setPolicy(id, policy); err != nil {
+			h.sendErrorFor(w, err, http.StatusInternalServerError)
+			return
+		}
+		if t, err = h.tunnelManager.GetTunnel(id); err != nil {
+			h.sendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.sendJSON(w, TunnelPolicyResponse{TunnelID: id, Policy: tunnelPolicy(t)}, http.StatusOK)
+}
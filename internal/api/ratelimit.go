@@ -0,0 +1,107 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiterIdleTTL is how long an unused bucket is kept; by then it has refilled
+const rateLimiterIdleTTL = 10 * time.Minute
+
+// RateLimiter limits requests per key with token buckets
+type RateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing perMinute requests per key on
+// average, with bursts of up to burst requests
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the key's bucket. If the bucket is empty it
+// returns false and how long until a token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > rateLimiterIdleTTL {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > rateLimiterIdleTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// SetRateLimits limits API requests per source IP and per authenticated
+// caller; either limiter may be nil
+func (h *Handler) SetRateLimits(perIP, perCaller *RateLimiter) {
+	h.ipLimiter = perIP
+	h.callerLimiter = perCaller
+}
+
+// rateLimited wraps next to limit requests per source IP
+func (h *Handler) rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.ipLimiter != nil && !h.allow(w, r, h.ipLimiter, "ip:"+sourceIP(r)) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allow responds with 429 and reports false if key is over its limit
+func (h *Handler) allow(w http.ResponseWriter, r *http.Request, limiter *RateLimiter, key string) bool {
+	ok, retryAfter := limiter.Allow(key)
+	if ok {
+		return true
+	}
+	h.logger.Warn().
+		Str("key", key).
+		Str("path", r.URL.Path).
+		Dur("retry_after", retryAfter).
+		Msg("API request rate limited")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	h.sendError(w, "Rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,153 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// handleHostnameReservations lists, makes and releases the hostname
+// reservations of the caller. Reservations are bound to the caller's
+// identity, so they require authentication or a client certificate.
+func (h *Handler) handleHostnameReservations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if h.requireScope(w, r, ScopeTunnelsRead) {
+			h.listHostnameReservations(w, r)
+		}
+	case http.MethodPost:
+		if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionHostnameReserve, h.reserveHostname)(w, r)
+		}
+	case http.MethodDelete:
+		if h.requireScope(w, r, ScopeTunnelsCreate) {
+			h.audited(audit.ActionHostnameRelease, h.releaseHostname)(w, r)
+		}
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listHostnameReservations returns the caller's reservations, or all of
+// them for admins
+func (h *Handler) listHostnameReservations(w http.ResponseWriter, r *http.Request) {
+	owner := callerIdentity(r)
+	if owner == "" {
+		h.sendError(w, "Hostname reservations require an authenticated caller", http.StatusBadRequest)
+		return
+	}
+
+	resp := HostnameReservationsResponse{Reservations: []HostnameReservation{}}
+	for _, reservation := range h.tunnelManager.HostnameReservations() {
+		if reservation.Owner == owner || isAdmin(r) {
+			resp.Reservations = append(resp.Reservations, toHostnameReservation(reservation))
+		}
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+func (h *Handler) reserveHostname(w http.ResponseWriter, r *http.Request) {
+	if h.rejectStandby(w) {
+		return
+	}
+	owner := callerIdentity(r)
+	if owner == "" {
+		h.sendError(w, "Hostname reservations require an authenticated caller", http.StatusBadRequest)
+		return
+	}
+	hostname, ok := h.reservationHostname(w, r)
+	if !ok {
+		return
+	}
+	if principal, ok := principalFrom(r); ok && !principal.AllowsHostname(hostname) {
+		h.sendError(w, "Not allowed to manage this hostname", http.StatusForbidden)
+		return
+	}
+
+	reservation, err := h.tunnelManager.ReserveHostname(hostname, owner)
+	if errors.Is(err, tunnel.ErrHostnameReserved) {
+		h.sendError(w, fmt.Sprintf("Hostname %s is reserved by another caller", hostname), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.sendJSON(w, toHostnameReservation(reservation), http.StatusOK)
+}
+
+func (h *Handler) releaseHostname(w http.ResponseWriter, r *http.Request) {
+	if h.rejectStandby(w) {
+		return
+	}
+	hostname, ok := h.reservationHostname(w, r)
+	if !ok {
+		return
+	}
+
+	reservation, exists := h.tunnelManager.HostnameReservation(hostname)
+	if !exists {
+		h.sendError(w, fmt.Sprintf("Hostname %s is not reserved", hostname), http.StatusNotFound)
+		return
+	}
+	if reservation.Owner != callerIdentity(r) && !isAdmin(r) {
+		h.sendError(w, fmt.Sprintf("Hostname %s is reserved by another caller", hostname), http.StatusForbidden)
+		return
+	}
+	if err := h.tunnelManager.ReleaseHostname(hostname); err != nil {
+		h.sendError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.sendJSON(w, toHostnameReservation(reservation), http.StatusOK)
+}
+
+// reservationHostname reads the normalized hostname of a reservation
+// request; ok is false if it answered
+func (h *Handler) reservationHostname(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req HostnameReservationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+	hostname, err := loadbalancer.NormalizeHostname(req.Hostname)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return hostname, true
+}
+
+// checkReservations fails if another caller reserved one of the hostnames
+func (h *Handler) checkReservations(r *http.Request, hostnames ...string) error {
+	owner := callerIdentity(r)
+	for _, hostname := range hostnames {
+		if err := h.tunnelManager.CheckHostnameOwner(hostname, owner); err != nil {
+			h.logger.Warn().
+				Str("hostname", hostname).
+				Str("caller", owner).
+				Msg("API caller tried to use a hostname reserved by another caller")
+			return fmt.Errorf("Hostname %s is reserved by another caller", hostname)
+		}
+	}
+	return nil
+}
+
+// isAdmin reports whether the caller was granted the admin scope
+func isAdmin(r *http.Request) bool {
+	principal, ok := principalFrom(r)
+	return ok && principal.HasScope(ScopeAdmin)
+}
+
+func toHostnameReservation(reservation tunnel.Reservation) HostnameReservation {
+	return HostnameReservation{
+		Hostname: reservation.Hostname,
+		Owner:    reservation.Owner,
+		Created:  reservation.Created,
+	}
+}
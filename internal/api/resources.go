@@ -0,0 +1,104 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/dns"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// PublicPorts describe the port clients reach the hostnames of HTTP
+// tunnels on
+type PublicPorts struct {
+	HTTPPort int
+	// TLS is set if the port serves HTTPS
+	TLS bool
+}
+
+// DNSRecords reports the state of the DNS records of tunnel hostnames
+type DNSRecords interface {
+	RecordState(hostname string) dns.RecordState
+}
+
+// SetPublicPorts returns the URLs of tunnels served on ports in create
+// responses
+func (h *Handler) SetPublicPorts(ports PublicPorts) {
+	h.publicPorts = ports
+}
+
+// SetDNSRecords returns the state of the DNS records of tunnel hostnames in
+// create responses
+func (h *Handler) SetDNSRecords(records DNSRecords) {
+	h.dnsRecords = records
+}
+
+// assignedResources returns the resources allocated to a tunnel
+func (h *Handler) assignedResources(t *tunnel.TunnelInfo) AssignedResources {
+	// Hostnames and options are set after the tunnel is created
+	if current, err := h.tunnelManager.GetTunnel(t.ID); err == nil {
+		t = current
+	}
+
+	var resources AssignedResources
+	for _, hostname := range t.Hostnames {
+		if hostname != "" {
+			resources.Hostnames = append(resources.Hostnames, hostname)
+		}
+	}
+	if len(resources.Hostnames) == 0 && t.Hostname != "" {
+		resources.Hostnames = []string{t.Hostname}
+	}
+
+	switch t.Protocol {
+	case "", tunnel.ProtocolHTTP:
+		if h.publicPorts.HTTPPort > 0 {
+			for _, hostname := range resources.Hostnames {
+				resources.URLs = append(resources.URLs, publicURL(hostname, h.publicPorts))
+			}
+		}
+	case tunnel.ProtocolTCP, tunnel.ProtocolUDP:
+		if t.ListenPort > 0 {
+			resources.Ports = []PortAssignment{{Protocol: t.Protocol, Port: t.ListenPort}}
+		}
+	}
+
+	if config := t.WireGuardConfig; config != nil {
+		if h.wireGuardEndpoint != "" {
+			resources.WireGuardEndpoint = withPort(h.wireGuardEndpoint, config.Port)
+		}
+		resources.WireGuardAllowedIPs = strings.Split(dualStack(config.ServerIP, config.ServerIPv6), ", ")
+	}
+
+	if h.dnsRecords != nil {
+		for _, hostname := range resources.Hostnames {
+			resources.DNSRecords = append(resources.DNSRecords, toDNSRecordStatus(hostname, h.dnsRecords.RecordState(hostname)))
+		}
+	}
+	return resources
+}
+
+// publicURL returns the URL of hostname on the HTTP port, leaving out the
+// default port of the scheme
+func publicURL(hostname string, ports PublicPorts) string {
+	scheme, defaultPort := "http", 80
+	if ports.TLS {
+		scheme, defaultPort = "https", 443
+	}
+	if ports.HTTPPort == defaultPort {
+		return scheme + "://" + hostname
+	}
+	return scheme + "://" + hostname + ":" + strconv.Itoa(ports.HTTPPort)
+}
+
+func toDNSRecordStatus(hostname string, state dns.RecordState) DNSRecordStatus {
+	status := DNSRecordStatus{Hostname: hostname, State: state.State}
+	for _, record := range state.Records {
+		status.Records = append(status.Records, DNSRecord{Type: record.Type, Value: record.Value, TTL: record.TTL})
+	}
+	if state.Error != nil {
+		status.Error = state.Error.Error()
+	}
+	return status
+}
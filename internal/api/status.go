@@ -0,0 +1,130 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// StatusSources describe the subsystems of the agent in the verbose
+// status; subsystems whose source is nil are left out
+type StatusSources struct {
+	Listeners      func() []loadbalancer.ListenerState
+	WireGuard      func() []tunnel.WireGuardInterfaceStatus
+	Persistence    func() loadbalancer.RoutesFileStatus
+	ConfigChecksum func() string
+}
+
+// SetStatusSources describes the subsystems of sources in the verbose
+// status
+func (h *Handler) SetStatusSources(sources StatusSources) {
+	h.statusSources = sources
+}
+
+// SetBuildInfo sets the commit and date of the build reported in the
+// verbose status
+func (h *Handler) SetBuildInfo(commit, date string) {
+	h.commit = commit
+	h.buildDate = date
+}
+
+// verboseStatus parses the verbose query parameter of a status request.
+// Verbose status reveals the agent's internals, so it needs the admin scope
+// when callers authenticate. It returns false after answering requests
+// that cannot have it.
+func (h *Handler) verboseStatus(w http.ResponseWriter, r *http.Request) (verbose bool, ok bool) {
+	value := r.URL.Query().Get("verbose")
+	if value == "" {
+		return false, true
+	}
+	verbose, err := strconv.ParseBool(value)
+	if err != nil {
+		h.sendError(w, fmt.Sprintf("Invalid verbose parameter %q", value), http.StatusBadRequest)
+		return false, false
+	}
+	if !verbose {
+		return false, true
+	}
+
+	h.authenticate(ScopeAdmin, func(http.ResponseWriter, *http.Request) {
+		ok = true
+	})(w, r)
+	return true, ok
+}
+
+// statusDetails collects the details of the verbose status
+func (h *Handler) statusDetails() *StatusDetails {
+	details := &StatusDetails{
+		Build: BuildInfo{
+			Version:   h.version,
+			Commit:    h.commit,
+			Date:      h.buildDate,
+			GoVersion: runtime.Version(),
+		},
+		Runtime: runtimeStats(),
+	}
+
+	sources := h.statusSources
+	if sources.ConfigChecksum != nil {
+		details.ConfigChecksum = sources.ConfigChecksum()
+	}
+	if sources.Listeners != nil {
+		for _, l := range sources.Listeners() {
+			details.Listeners = append(details.Listeners, ListenerStatus{
+				Name:      l.Name,
+				Protocol:  l.Protocol,
+				Address:   l.Address,
+				Listening: l.Listening,
+			})
+		}
+	}
+	if sources.WireGuard != nil {
+		for _, wg := range sources.WireGuard() {
+			details.WireGuard = append(details.WireGuard, WireGuardInterfaceStatus{
+				Name:       wg.Name,
+				PublicKey:  wg.PublicKey,
+				ListenPort: wg.ListenPort,
+				Peers:      wg.Peers,
+				Error:      wg.Error,
+			})
+		}
+	}
+	if sources.Persistence != nil {
+		file := sources.Persistence()
+		persistence := &PersistenceStatus{RoutesFile: file.Path, Healthy: file.Error == nil}
+		if !file.LastSaved.IsZero() {
+			persistence.LastSaved = &file.LastSaved
+		}
+		if file.Error != nil {
+			persistence.Error = file.Error.Error()
+		}
+		details.Persistence = persistence
+	}
+	return details
+}
+
+// runtimeStats reads the goroutine count and memory statistics
+func runtimeStats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := RuntimeStats{
+		Goroutines:          runtime.NumGoroutine(),
+		GOMAXPROCS:          runtime.GOMAXPROCS(0),
+		HeapAllocBytes:      int64(mem.HeapAlloc),
+		HeapSysBytes:        int64(mem.HeapSys),
+		NumGC:               int64(mem.NumGC),
+		GCPauseTotalSeconds: time.Duration(mem.PauseTotalNs).Seconds(),
+	}
+	if mem.LastGC != 0 {
+		lastGC := time.Unix(0, int64(mem.LastGC)).UTC()
+		stats.LastGC = &lastGC
+	}
+	return stats
+}
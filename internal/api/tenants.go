@@ -0,0 +1,44 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// handleTenantUsage serves /api/v1/tenants/{id}/usage. Callers may see the
+// usage of their own tenant; admins that of any tenant.
+func (h *Handler) handleTenantUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, rest, _ := strings.Cut(r.URL.Path, "/tenants/")
+	tenant, action, ok := strings.Cut(rest, "/")
+	if !ok || tenant == "" || action != "usage" {
+		h.sendError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if principal, ok := principalFrom(r); ok && principal.Tenant != tenant && !principal.HasScope(ScopeAdmin) {
+		h.sendError(w, "Not allowed to view this tenant", http.StatusForbidden)
+		return
+	}
+
+	usage := h.tunnelManager.TenantUsage(tenant)
+	h.sendJSON(w, TenantUsageResponse{
+		Tenant:         usage.Tenant,
+		Tunnels:        usage.Tunnels,
+		Hostnames:      usage.Hostnames,
+		Ports:          usage.Ports,
+		BytesSent:      usage.BytesSent,
+		BytesReceived:  usage.BytesReceived,
+		BytesPerSecond: usage.BytesPerSecond,
+		OverBandwidth:  usage.OverBandwidth,
+		Limits: TenantLimits{
+			MaxTunnels:        usage.Limits.Tunnels,
+			MaxHostnames:      usage.Limits.Hostnames,
+			MaxPorts:          usage.Limits.Ports,
+			MaxBytesPerSecond: usage.Limits.BytesPerSecond,
+		},
+	}, http.StatusOK)
+}
@@ -0,0 +1,58 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traced wraps next in a server span named after the method and route,
+// continuing the caller's trace
+func traced(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.StartServer(r, r.Method+" "+route, semconv.HTTPRoute(route))
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(ctx))
+		tracing.EndHTTP(span, recorder.status)
+	}
+}
+
+// managerSpan starts a span for a tunnel manager operation made on behalf
+// of r; end it with tracing.End
+func managerSpan(r *http.Request, operation, tunnelID string) trace.Span {
+	_, span := tracing.Start(r.Context(), "tunnel.Manager."+operation, attribute.String("tunnel.id", tunnelID))
+	return span
+}
+
+// statusRecorder captures the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController flush event streams
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack lets WebSocket connections of tunnel clients through
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
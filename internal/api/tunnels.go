@@ -0,0 +1,216 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// RouteTable returns the routing table of the load balancer
+type RouteTable interface {
+	Snapshot() []loadbalancer.Route
+}
+
+// StaticRouteTable is a routing table that also holds static routes,
+// which answer requests with a redirect or a fixed response instead of
+// routing them to a tunnel
+type StaticRouteTable interface {
+	RouteTable
+	AddStaticRoute(route loadbalancer.Route) error
+	RemoveStaticRoute(hostname string, path *loadbalancer.PathMatch) error
+}
+
+// RouteValidator is a routing table that can check routes before they are
+// added
+type RouteValidator interface {
+	RouteTable
+	CheckRoute(route loadbalancer.Route) loadbalancer.RouteCheck
+}
+
+// SetRouteTable serves the routing table of table
+func (h *Handler) SetRouteTable(table RouteTable) {
+	h.routes = table
+}
+
+// handleListTunnels lists the tunnels the caller may manage, by ID, only
+// those matching the label selector of the selector query parameter if set
+func (h *Handler) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	selector, err := tunnel.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tunnels := h.tunnelManager.SelectTunnels(selector)
+
+	resp := TunnelsResponse{Tunnels: []TunnelSummary{}}
+	for _, t := range tunnels {
+		if !h.authorizeTunnel(r, t.ID, t.Hostname) {
+			continue
+		}
+		summary := TunnelSummary{
+			TunnelID:    t.ID,
+			Hostname:    t.Hostname,
+			Hostnames:   t.Hostnames,
+			TargetPort:  t.TargetPort,
+			Transport:   t.Transport,
+			Endpoint:    t.Endpoint,
+			Protocol:    t.Protocol,
+			ListenPort:  t.ListenPort,
+			Tenant:      t.Tenant,
+			Status:      string(t.Status),
+			Maintenance: t.Maintenance,
+			Paused:      t.Paused,
+			Created:     t.Created,
+			LastActive:  t.LastActive,
+			Labels:      t.Labels,
+		}
+		summary.ExpiresAt, summary.ExpiresInSeconds = tunnelExpiry(t)
+		resp.Tunnels = append(resp.Tunnels, summary)
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// handleRoutes returns the routing table of the load balancer, or adds or
+// removes a static route
+func (h *Handler) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if h.routes == nil {
+		h.sendError(w, "Routing table is not available", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		static, ok := h.routes.(StaticRouteTable)
+		if !ok {
+			h.sendError(w, "Static routes are not available", http.StatusNotFound)
+			return
+		}
+		var req StaticRouteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		path := pathMatch(req.PathType, req.Path)
+
+		var err error
+		if r.Method == http.MethodPost {
+			route := loadbalancer.Route{Hostname: req.Hostname, Path: path, Priority: req.Priority}
+			route.Redirect, route.Response = staticAnswer(req.Redirect, req.Response)
+			err = static.AddStaticRoute(route)
+		} else {
+			err = static.RemoveStaticRoute(req.Hostname, path)
+		}
+		if err != nil {
+			h.sendErrorFor(w, err, http.StatusBadRequest)
+			return
+		}
+		h.logger.Info().
+			Str("method", r.Method).
+			Str("hostname", req.Hostname).
+			Str("path", req.Path).
+			Msg("Changed static route")
+	default:
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := RoutesResponse{Routes: []Route{}}
+	for _, route := range h.routes.Snapshot() {
+		resp.Routes = append(resp.Routes, apiRoute(route))
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// handleValidateRoute checks a route against the routing table without
+// adding it, reporting whether it could be added and the routes it would
+// overlap
+func (h *Handler) handleValidateRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	validator, ok := h.routes.(RouteValidator)
+	if !ok {
+		h.sendError(w, "Route validation is not available", http.StatusNotFound)
+		return
+	}
+	var req RouteValidationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	route := loadbalancer.Route{
+		TunnelID:   req.TunnelID,
+		Protocol:   req.Protocol,
+		Hostname:   req.Hostname,
+		Path:       pathMatch(req.PathType, req.Path),
+		Priority:   req.Priority,
+		ListenPort: req.ListenPort,
+	}
+	route.Redirect, route.Response = staticAnswer(req.Redirect, req.Response)
+	check := validator.CheckRoute(route)
+
+	resp := RouteValidationResponse{Valid: check.Err == nil, Overlaps: []RouteOverlap{}}
+	if check.Err != nil {
+		resp.Error = check.Err.Error()
+	}
+	for _, overlap := range check.Overlaps {
+		resp.Overlaps = append(resp.Overlaps, RouteOverlap{Route: apiRoute(overlap.Route), Outcome: string(overlap.Outcome)})
+	}
+	h.sendJSON(w, resp, http.StatusOK)
+}
+
+// pathMatch returns the path match of a request, nil if it has none
+func pathMatch(pathType, path string) *loadbalancer.PathMatch {
+	if pathType == "" && path == "" {
+		return nil
+	}
+	return &loadbalancer.PathMatch{Type: loadbalancer.PathMatchType(pathType), Value: path}
+}
+
+// staticAnswer converts the redirect or response of a static route
+func staticAnswer(redirect *RouteRedirect, response *RouteResponse) (*loadbalancer.Redirect, *loadbalancer.StaticResponse) {
+	var r *loadbalancer.Redirect
+	if redirect != nil {
+		r = &loadbalancer.Redirect{URL: redirect.URL, Status: redirect.Status, PreservePath: redirect.PreservePath}
+	}
+	var s *loadbalancer.StaticResponse
+	if response != nil {
+		s = &loadbalancer.StaticResponse{Status: response.Status, ContentType: response.ContentType, Body: response.Body}
+	}
+	return r, s
+}
+
+// apiRoute converts an entry of the routing table for a response
+func apiRoute(route loadbalancer.Route) Route {
+	item := Route{
+		TunnelID:   route.TunnelID,
+		Protocol:   route.Protocol,
+		Hostname:   route.Hostname,
+		Priority:   route.Priority,
+		ListenPort: route.ListenPort,
+		IP:         route.IP,
+		Port:       route.Port,
+	}
+	if route.Path != nil {
+		item.PathType = string(route.Path.Type)
+		item.Path = route.Path.Value
+	}
+	if route.Redirect != nil {
+		item.Redirect = &RouteRedirect{URL: route.Redirect.URL, Status: route.Redirect.Status, PreservePath: route.Redirect.PreservePath}
+	}
+	if route.Response != nil {
+		item.Response = &RouteResponse{Status: route.Response.Status, ContentType: route.Response.ContentType, Body: route.Response.Body}
+	}
+	return item
+}
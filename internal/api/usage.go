@@ -0,0 +1,64 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/usage"
+)
+
+// SetUsageAccountant serves the usage records of accountant
+func (h *Handler) SetUsageAccountant(accountant *usage.Accountant) {
+	h.usage = accountant
+}
+
+// handleUsage exports usage records, filtered by the tenant, tunnel_id,
+// since and until (RFC 3339) query parameters, as JSON or, with
+// format=csv, as CSV
+func (h *Handler) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.usage == nil {
+		h.sendError(w, "Usage accounting is not enabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	query := usage.Query{
+		Tenant:   params.Get("tenant"),
+		TunnelID: params.Get("tunnel_id"),
+	}
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				h.sendError(w, "Invalid "+name+" timestamp", http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	format := params.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		h.sendError(w, "Invalid format; use json or csv", http.StatusBadRequest)
+		return
+	}
+
+	records, err := h.usage.Query(query)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		if err := usage.WriteCSV(w, records); err != nil {
+			h.logger.Error().Err(err).Msg("Failed to write usage CSV")
+		}
+		return
+	}
+	h.sendJSON(w, UsageResponse{Records: records}, http.StatusOK)
+}
@@ -0,0 +1,87 @@
+// Package api provides the HTTP API handlers and models for the easy-tunnel-lb-agent.
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIVersion is the current version of the HTTP API
+const APIVersion = "v1"
+
+// APIVersionHeader carries the API version. Clients may send it to request a
+// version on the unversioned paths; the agent sets it on every response.
+const APIVersionHeader = "API-Version"
+
+// SupportedAPIVersions are the API versions the agent serves, oldest first
+var SupportedAPIVersions = []string{"v1"}
+
+// VersionPath returns the path of an endpoint in the current API version,
+// e.g. VersionPath("/status") is "/api/v1/status"
+func VersionPath(path string) string {
+	return "/api/" + APIVersion + path
+}
+
+func isSupportedVersion(version string) bool {
+	for _, v := range SupportedAPIVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// versioned wraps the handler of a versioned path, rejecting requests for
+// another version
+func (h *Handler) versioned(version string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requested := r.Header.Get(APIVersionHeader); requested != "" && requested != version {
+			h.rejectVersion(w, requested)
+			return
+		}
+		w.Header().Set(APIVersionHeader, version)
+		next(w, r)
+	}
+}
+
+// deprecatedAlias wraps next to serve a pre-versioning path. Clients may
+// select the version with the API-Version header; the response points them at
+// the versioned path.
+func (h *Handler) deprecatedAlias(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get(APIVersionHeader)
+		if version == "" {
+			version = SupportedAPIVersions[0]
+		}
+		if !isSupportedVersion(version) {
+			h.rejectVersion(w, version)
+			return
+		}
+
+		successor := "/api/" + version + strings.TrimPrefix(r.URL.Path, "/api")
+		h.logger.Debug().
+			Str("path", r.URL.Path).
+			Str("successor", successor).
+			Msg("Request to deprecated API path")
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		w.Header().Set(APIVersionHeader, version)
+		next(w, r)
+	}
+}
+
+func (h *Handler) rejectVersion(w http.ResponseWriter, version string) {
+	h.sendError(w, fmt.Sprintf("Unsupported API version %s; supported versions are %s", version, strings.Join(SupportedAPIVersions, ", ")), http.StatusNotAcceptable)
+}
+
+func (h *Handler) handleVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.sendJSON(w, VersionsResponse{
+		Current:   APIVersion,
+		Supported: SupportedAPIVersions,
+	}, http.StatusOK)
+}
@@ -0,0 +1,156 @@
+// Package audit records control-plane actions to an append-only log.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	ActionTunnelCreate  = "tunnel.create"
+	ActionTunnelRemove  = "tunnel.remove"
+	ActionTunnelRefresh = "tunnel.refresh"
+	ActionTunnelPause   = "tunnel.pause"
+	ActionTunnelResume  = "tunnel.resume"
+	ActionKeyRotate     = "tunnel.rotate_keys"
+	ActionMaintenance   = "tunnel.maintenance"
+	ActionHostnames     = "tunnel.hostnames"
+	ActionMirror        = "tunnel.mirror"
+	ActionCachePurge    = "tunnel.cache_purge"
+	ActionPolicy        = "tunnel.policy"
+	ActionFilters       = "tunnel.filters"
+	ActionLogLevel      = "admin.log_level"
+	ActionKillConn      = "admin.kill_connection"
+	ActionStaticRoute   = "admin.static_route"
+	ActionImport        = "admin.import"
+	ActionAuthFailure   = "auth.failure"
+
+	ActionHostnameReserve = "hostname.reserve"
+	ActionHostnameRelease = "hostname.release"
+)
+
+// Event is one audited action
+type Event struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Protocol string    `json:"protocol"` // http or grpc
+	Caller   string    `json:"caller,omitempty"`
+	SourceIP string    `json:"source_ip,omitempty"`
+	TunnelID string    `json:"tunnel_id,omitempty"`
+
+	// PayloadSHA256 is the hex SHA-256 of the request body, which is not
+	// stored as it may contain keys
+	PayloadSHA256 string `json:"payload_sha256,omitempty"`
+
+	Success bool   `json:"success"`
+	Status  int    `json:"status,omitempty"` // HTTP status code
+	Error   string `json:"error,omitempty"`
+}
+
+// HashPayload returns the hex SHA-256 of a request payload
+func HashPayload(payload []byte) string {
+	if len(payload) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// Query selects events; empty fields match every event
+type Query struct {
+	Action   string
+	Caller   string
+	TunnelID string
+	Since    time.Time
+
+	// Limit keeps only the most recent matching events, if positive
+	Limit int
+}
+
+func (q *Query) matches(e *Event) bool {
+	return (q.Action == "" || e.Action == q.Action) &&
+		(q.Caller == "" || e.Caller == q.Caller) &&
+		(q.TunnelID == "" || e.TunnelID == q.TunnelID) &&
+		!e.Time.Before(q.Since)
+}
+
+// Log appends events as JSON lines to a file
+type Log struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the audit log at path, creating it if needed
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	return &Log{path: path, file: file}, nil
+}
+
+// Record appends an event, setting its time if unset
+func (l *Log) Record(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit event: %v", err)
+	}
+	return nil
+}
+
+// Query returns the matching events, oldest first
+func (l *Log) Query(q Query) ([]Event, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// Skip a line torn by a crash mid-write
+			continue
+		}
+		if !q.matches(&event) {
+			continue
+		}
+		events = append(events, event)
+		if q.Limit > 0 && len(events) > q.Limit {
+			events = events[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	return events, nil
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
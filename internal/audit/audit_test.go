@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer log.Close()
+
+	start := time.Now().UTC()
+	events := []Event{
+		{Time: start.Add(-time.Hour), Action: ActionTunnelCreate, Caller: "ci", TunnelID: "old", Success: true},
+		{Time: start, Action: ActionTunnelCreate, Caller: "ci", TunnelID: "web", Success: true},
+		{Time: start.Add(time.Second), Action: ActionTunnelRemove, Caller: "ops", TunnelID: "web", Success: true},
+		{Time: start.Add(2 * time.Second), Action: ActionAuthFailure, Status: 401},
+	}
+	for _, event := range events {
+		if err := log.Record(event); err != nil {
+			t.Fatalf("Failed to record event: %v", err)
+		}
+	}
+
+	// A line torn by a crash is skipped
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	_, _ = file.WriteString(`{"time":"` + "\n")
+	file.Close()
+
+	tests := []struct {
+		name     string
+		query    Query
+		expected []string
+	}{
+		{
+			name:     "All events",
+			query:    Query{},
+			expected: []string{ActionTunnelCreate, ActionTunnelCreate, ActionTunnelRemove, ActionAuthFailure},
+		},
+		{
+			name:     "By action",
+			query:    Query{Action: ActionTunnelCreate},
+			expected: []string{ActionTunnelCreate, ActionTunnelCreate},
+		},
+		{
+			name:     "By caller and tunnel",
+			query:    Query{Caller: "ops", TunnelID: "web"},
+			expected: []string{ActionTunnelRemove},
+		},
+		{
+			name:     "Since",
+			query:    Query{Since: start},
+			expected: []string{ActionTunnelCreate, ActionTunnelRemove, ActionAuthFailure},
+		},
+		{
+			name:     "Limit keeps the most recent",
+			query:    Query{Limit: 2},
+			expected: []string{ActionTunnelRemove, ActionAuthFailure},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := log.Query(tt.query)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			if len(result) != len(tt.expected) {
+				t.Fatalf("Expected %d events, got %d", len(tt.expected), len(result))
+			}
+			for i, event := range result {
+				if event.Action != tt.expected[i] {
+					t.Errorf("Event %d: expected action %s, got %s", i, tt.expected[i], event.Action)
+				}
+			}
+		})
+	}
+}
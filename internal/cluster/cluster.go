@@ -0,0 +1,452 @@
+// Package cluster replicates tunnels between easy-tunnel-lb-agent nodes.
+package cluster
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// tombstoneTTL is how long removed tunnels are remembered, so that nodes
+// which were unreachable when a tunnel was removed do not bring it back
+const tombstoneTTL = 24 * time.Hour
+
+// Entry is the replicated state of one tunnel. Entries are merged by version,
+// with the name of the node that made the change breaking ties.
+type Entry struct {
+	TunnelID           string            `json:"tunnel_id"`
+	Hostname           string            `json:"hostname"`
+	TargetPort         int               `json:"target_port"`
+	WireGuardPublicKey string            `json:"wireguard_public_key,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+
+	// Hostnames are all hostnames of the tunnel, starting with Hostname;
+	// entries of older nodes only have Hostname
+	Hostnames []string `json:"hostnames,omitempty"`
+
+	// Owner is the node the tunnel was created on
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+
+	Version int64  `json:"version"`
+	Origin  string `json:"origin"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// newerThan reports whether e replaces other when merging
+func (e *Entry) newerThan(other *Entry) bool {
+	if e.Version != other.Version {
+		return e.Version > other.Version
+	}
+	return e.Origin > other.Origin
+}
+
+// hostnames returns all hostnames of the entry's tunnel
+func (e *Entry) hostnames() []string {
+	if len(e.Hostnames) > 0 {
+		return e.Hostnames
+	}
+	if e.Hostname == "" {
+		return nil
+	}
+	return []string{e.Hostname}
+}
+
+// tunnelHostnames returns all hostnames of a tunnel, nil for port-only
+// tunnels
+func tunnelHostnames(t *tunnel.TunnelInfo) []string {
+	var hostnames []string
+	for _, hostname := range t.Hostnames {
+		if hostname != "" {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return hostnames
+}
+
+// matches reports whether the entry describes the tunnel's configuration
+func (e *Entry) matches(t *tunnel.TunnelInfo) bool {
+	return e.matchesTarget(t) && equalStrings(e.hostnames(), tunnelHostnames(t))
+}
+
+// matchesTarget reports whether the entry describes the tunnel's
+// configuration apart from its hostnames, which can change in place
+func (e *Entry) matchesTarget(t *tunnel.TunnelInfo) bool {
+	if e.TargetPort != t.TargetPort || e.WireGuardPublicKey != t.ClientPublicKey {
+		return false
+	}
+	if len(e.Metadata) != len(t.Metadata) {
+		return false
+	}
+	for k, v := range e.Metadata {
+		if t.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// beats reports whether e wins a hostname conflict with other: the tunnel
+// created first keeps the hostname
+func (e *Entry) beats(other *Entry) bool {
+	if !e.Created.Equal(other.Created) {
+		return e.Created.Before(other.Created)
+	}
+	if e.Owner != other.Owner {
+		return e.Owner < other.Owner
+	}
+	return e.TunnelID < other.TunnelID
+}
+
+// Conflict describes tunnels on different nodes registered for the same hostname
+type Conflict struct {
+	Hostname string   `json:"hostname"`
+	Winner   string   `json:"winner"`
+	Losers   []string `json:"losers"`
+}
+
+// Node replicates the local tunnels to the other nodes of the cluster and
+// creates their tunnels locally
+type Node struct {
+	name          string
+	advertiseURL  string
+	secret        atomic.Value // string
+	interval      time.Duration
+	tunnelManager *tunnel.Manager
+	logger        *zerolog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	clock   int64
+	members map[string]*Member // by URL
+}
+
+// NewNode creates a cluster node named name, reachable by the other nodes at
+// advertiseURL, that exchanges state with peers every interval
+func NewNode(name, advertiseURL string, peers []string, secret string, interval time.Duration, tunnelManager *tunnel.Manager) *Node {
+	n := &Node{
+		name:          name,
+		advertiseURL:  advertiseURL,
+		interval:      interval,
+		tunnelManager: tunnelManager,
+		logger:        utils.GetLogger(),
+		entries:       make(map[string]*Entry),
+		members:       make(map[string]*Member),
+	}
+	n.secret.Store(secret)
+	for _, peer := range peers {
+		if peer != "" && peer != advertiseURL {
+			n.members[peer] = &Member{URL: peer}
+		}
+	}
+	return n
+}
+
+// SetSecret replaces the shared secret nodes authenticate with, such as
+// after the secret file was rotated
+func (n *Node) SetSecret(secret string) {
+	n.secret.Store(secret)
+}
+
+// sharedSecret returns the shared secret, empty if none is configured
+func (n *Node) sharedSecret() string {
+	return n.secret.Load().(string)
+}
+
+// Name returns the name of the node
+func (n *Node) Name() string {
+	return n.name
+}
+
+// Run replicates tunnel changes until ctx is cancelled
+func (n *Node) Run(ctx context.Context) {
+	events, cancel := n.tunnelManager.Subscribe(256)
+	defer cancel()
+
+	n.logger.Info().
+		Str("node", n.name).
+		Int("peers", len(n.Members())).
+		Msg("Starting cluster node")
+
+	// Tunnels created before the node started
+	n.mu.Lock()
+	for _, t := range n.tunnelManager.GetAllTunnels() {
+		n.recordLocal(t)
+	}
+	n.mu.Unlock()
+
+	n.gossip(ctx)
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.gossip(ctx)
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			n.handleEvent(event)
+		}
+	}
+}
+
+// handleEvent records tunnel changes made through this node
+func (n *Node) handleEvent(event tunnel.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	current, err := n.tunnelManager.GetTunnel(event.TunnelID)
+	entry := n.entries[event.TunnelID]
+
+	switch event.Type {
+	case tunnel.EventTunnelCreated:
+		if err == nil && (entry == nil || entry.Deleted || !entry.matches(current)) {
+			n.recordLocal(current)
+		}
+	case tunnel.EventHostnamesChanged:
+		if err == nil && entry != nil && !entry.Deleted && !entry.matches(current) {
+			n.recordHostnames(entry, current)
+		}
+	case tunnel.EventTunnelRemoved:
+		// Removals made while applying replicated state are not changes;
+		// neither are removals immediately followed by a re-create
+		if err == nil || entry == nil || entry.Deleted || !n.wanted(entry, n.winners()) {
+			return
+		}
+		tombstone := *entry
+		tombstone.Deleted = true
+		tombstone.Version = n.tick()
+		tombstone.Origin = n.name
+		n.entries[entry.TunnelID] = &tombstone
+	}
+}
+
+// recordLocal records a tunnel created through this node. Must be called
+// with n.mu held.
+func (n *Node) recordLocal(t *tunnel.TunnelInfo) {
+	entry := n.entries[t.ID]
+	if entry != nil && !entry.Deleted && entry.matches(t) {
+		return
+	}
+
+	n.entries[t.ID] = &Entry{
+		TunnelID:           t.ID,
+		Hostname:           t.Hostname,
+		Hostnames:          tunnelHostnames(t),
+		TargetPort:         t.TargetPort,
+		WireGuardPublicKey: t.ClientPublicKey,
+		Metadata:           t.Metadata,
+		Owner:              n.name,
+		Created:            t.Created,
+		Version:            n.tick(),
+		Origin:             n.name,
+	}
+}
+
+// recordHostnames records hostnames added to or removed from a tunnel
+// through this node, keeping the tunnel's owner. Must be called with n.mu
+// held.
+func (n *Node) recordHostnames(entry *Entry, t *tunnel.TunnelInfo) {
+	updated := *entry
+	updated.Hostname = t.Hostname
+	updated.Hostnames = tunnelHostnames(t)
+	updated.Version = n.tick()
+	updated.Origin = n.name
+	n.entries[t.ID] = &updated
+}
+
+// tick advances the node's logical clock, which follows wall-clock time so
+// versions from different nodes are roughly comparable. Must be called with
+// n.mu held.
+func (n *Node) tick() int64 {
+	n.clock++
+	if now := time.Now().UnixNano(); now > n.clock {
+		n.clock = now
+	}
+	return n.clock
+}
+
+// Entries returns a copy of the replicated state
+func (n *Node) Entries() []Entry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entries := make([]Entry, 0, len(n.entries))
+	for _, entry := range n.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TunnelID < entries[j].TunnelID })
+	return entries
+}
+
+// Merge applies entries received from another node and updates the local
+// tunnels to match
+func (n *Node) Merge(entries []Entry) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	changed := false
+	for i := range entries {
+		entry := entries[i]
+		if entry.Version > n.clock {
+			n.clock = entry.Version
+		}
+		if current, exists := n.entries[entry.TunnelID]; exists && !entry.newerThan(current) {
+			continue
+		}
+		n.entries[entry.TunnelID] = &entry
+		changed = true
+	}
+
+	if changed {
+		n.apply()
+	}
+	n.expireTombstones()
+}
+
+// expireTombstones forgets removed tunnels after tombstoneTTL. Must be called
+// with n.mu held.
+func (n *Node) expireTombstones() {
+	cutoff := time.Now().Add(-tombstoneTTL).UnixNano()
+	for id, entry := range n.entries {
+		if entry.Deleted && entry.Version < cutoff {
+			delete(n.entries, id)
+		}
+	}
+}
+
+// winners returns the entry holding each hostname. Must be called with n.mu held.
+func (n *Node) winners() map[string]*Entry {
+	winners := make(map[string]*Entry)
+	for _, entry := range n.entries {
+		if entry.Deleted {
+			continue
+		}
+		for _, hostname := range entry.hostnames() {
+			if winner, exists := winners[hostname]; !exists || entry.beats(winner) {
+				winners[hostname] = entry
+			}
+		}
+	}
+	return winners
+}
+
+// wanted reports whether the entry's tunnel should exist on this node:
+// tunnels created here are kept even if they lose a hostname conflict, while
+// other nodes' tunnels losing any of their hostnames are not created
+func (n *Node) wanted(entry *Entry, winners map[string]*Entry) bool {
+	if entry.Deleted {
+		return false
+	}
+	if entry.Owner == n.name {
+		return true
+	}
+	for _, hostname := range entry.hostnames() {
+		if winners[hostname] != entry {
+			return false
+		}
+	}
+	return true
+}
+
+// apply makes the local tunnels match the entries. Must be called with n.mu held.
+func (n *Node) apply() {
+	winners := n.winners()
+	for _, entry := range n.entries {
+		current, err := n.tunnelManager.GetTunnel(entry.TunnelID)
+		exists := err == nil
+
+		if !n.wanted(entry, winners) {
+			if exists {
+				if err := n.tunnelManager.RemoveTunnel(entry.TunnelID); err != nil {
+					n.logger.Error().Err(err).Str("tunnel_id", entry.TunnelID).Msg("Failed to remove replicated tunnel")
+				}
+			}
+			continue
+		}
+
+		if exists && entry.matchesTarget(current) {
+			if !entry.matches(current) {
+				n.setHostnames(entry)
+			}
+			continue
+		}
+		if exists {
+			if err := n.tunnelManager.RemoveTunnel(entry.TunnelID); err != nil {
+				n.logger.Error().Err(err).Str("tunnel_id", entry.TunnelID).Msg("Failed to replace replicated tunnel")
+				continue
+			}
+		}
+		if _, err := n.tunnelManager.CreateTunnel(entry.TunnelID, entry.Hostname, entry.TargetPort, entry.WireGuardPublicKey, entry.Metadata); err != nil {
+			n.logger.Error().Err(err).Str("tunnel_id", entry.TunnelID).Msg("Failed to create replicated tunnel")
+			continue
+		}
+		if len(entry.hostnames()) > 1 {
+			n.setHostnames(entry)
+		}
+	}
+}
+
+// setHostnames gives the entry's local tunnel the entry's hostnames
+func (n *Node) setHostnames(entry *Entry) {
+	if err := n.tunnelManager.SetHostnames(entry.TunnelID, entry.hostnames()); err != nil {
+		n.logger.Error().Err(err).Str("tunnel_id", entry.TunnelID).Msg("Failed to set hostnames of replicated tunnel")
+	}
+}
+
+// Conflicts returns the hostnames registered by tunnels on more than one node
+func (n *Node) Conflicts() []Conflict {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	winners := n.winners()
+	byHostname := make(map[string]*Conflict)
+	for _, entry := range n.entries {
+		if entry.Deleted {
+			continue
+		}
+		for _, hostname := range entry.hostnames() {
+			winner := winners[hostname]
+			if winner == entry {
+				continue
+			}
+			conflict, exists := byHostname[hostname]
+			if !exists {
+				conflict = &Conflict{Hostname: hostname, Winner: winner.TunnelID}
+				byHostname[hostname] = conflict
+			}
+			conflict.Losers = append(conflict.Losers, entry.TunnelID)
+		}
+	}
+
+	conflicts := make([]Conflict, 0, len(byHostname))
+	for _, conflict := range byHostname {
+		sort.Strings(conflict.Losers)
+		conflicts = append(conflicts, *conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Hostname < conflicts[j].Hostname })
+	return conflicts
+}
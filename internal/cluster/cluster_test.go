@@ -0,0 +1,242 @@
+package cluster
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+func newTestNode(t *testing.T, name string) (*Node, *tunnel.Manager) {
+	t.Helper()
+	manager := tunnel.NewManager(10)
+	return NewNode(name, "", nil, "", time.Second, manager), manager
+}
+
+func TestMerge(t *testing.T) {
+	created := time.Now()
+
+	tests := []struct {
+		name         string
+		entries      []Entry
+		expectedPort int
+		expectExists bool
+	}{
+		{
+			name: "Create replicated tunnel",
+			entries: []Entry{
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 8080, Owner: "b", Created: created, Version: 1, Origin: "b"},
+			},
+			expectedPort: 8080,
+			expectExists: true,
+		},
+		{
+			name: "Newer version replaces older",
+			entries: []Entry{
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 8080, Owner: "b", Created: created, Version: 1, Origin: "b"},
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 9090, Owner: "b", Created: created, Version: 2, Origin: "c"},
+			},
+			expectedPort: 9090,
+			expectExists: true,
+		},
+		{
+			name: "Older version is ignored",
+			entries: []Entry{
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 9090, Owner: "b", Created: created, Version: 2, Origin: "b"},
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 8080, Owner: "b", Created: created, Version: 1, Origin: "b"},
+			},
+			expectedPort: 9090,
+			expectExists: true,
+		},
+		{
+			name: "Equal versions are ordered by origin",
+			entries: []Entry{
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 9090, Owner: "b", Created: created, Version: 1, Origin: "c"},
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 8080, Owner: "b", Created: created, Version: 1, Origin: "b"},
+			},
+			expectedPort: 9090,
+			expectExists: true,
+		},
+		{
+			name: "Tombstone removes tunnel",
+			entries: []Entry{
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 8080, Owner: "b", Created: created, Version: 1, Origin: "b"},
+				{TunnelID: "web", Hostname: "web.example.com", TargetPort: 8080, Owner: "b", Created: created, Version: 2, Origin: "c", Deleted: true},
+			},
+			expectExists: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, manager := newTestNode(t, "a")
+			for _, entry := range tt.entries {
+				node.Merge([]Entry{entry})
+			}
+
+			tunnelInfo, err := manager.GetTunnel("web")
+			if !tt.expectExists {
+				if err == nil {
+					t.Error("Expected tunnel to be removed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected tunnel: %v", err)
+			}
+			if tunnelInfo.TargetPort != tt.expectedPort {
+				t.Errorf("Expected port %d, got %d", tt.expectedPort, tunnelInfo.TargetPort)
+			}
+		})
+	}
+}
+
+func TestHostnameConflict(t *testing.T) {
+	node, manager := newTestNode(t, "a")
+	created := time.Now()
+
+	// The local tunnel was created after the remote one
+	if _, err := manager.CreateTunnel("local", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	node.mu.Lock()
+	for _, tunnelInfo := range manager.GetAllTunnels() {
+		node.recordLocal(tunnelInfo)
+	}
+	node.mu.Unlock()
+
+	node.Merge([]Entry{
+		{TunnelID: "first", Hostname: "app.example.com", TargetPort: 8080, Owner: "b", Created: created.Add(-time.Minute), Version: 1, Origin: "b"},
+		{TunnelID: "late", Hostname: "app.example.com", TargetPort: 8080, Owner: "c", Created: created.Add(time.Minute), Version: 1, Origin: "c"},
+	})
+
+	// The oldest tunnel wins; the losing remote tunnel is not created, while
+	// the losing local tunnel keeps serving on its own node
+	if _, err := manager.GetTunnel("first"); err != nil {
+		t.Error("Expected winning tunnel to be created")
+	}
+	if _, err := manager.GetTunnel("late"); err == nil {
+		t.Error("Expected losing remote tunnel not to be created")
+	}
+	if _, err := manager.GetTunnel("local"); err != nil {
+		t.Error("Expected losing local tunnel to be kept")
+	}
+
+	conflicts := node.Conflicts()
+	if len(conflicts) != 1 {
+		t.Fatalf("Expected 1 conflict, got %d", len(conflicts))
+	}
+	if conflicts[0].Winner != "first" || len(conflicts[0].Losers) != 2 {
+		t.Errorf("Unexpected conflict %+v", conflicts[0])
+	}
+}
+
+func TestSecondaryHostnameConflict(t *testing.T) {
+	node, manager := newTestNode(t, "a")
+	created := time.Now()
+
+	node.Merge([]Entry{
+		{TunnelID: "first", Hostname: "app.example.com", Hostnames: []string{"app.example.com", "www.example.com"}, TargetPort: 8080, Owner: "b", Created: created.Add(-time.Minute), Version: 1, Origin: "b"},
+		{TunnelID: "late", Hostname: "other.example.com", Hostnames: []string{"other.example.com", "www.example.com"}, TargetPort: 8080, Owner: "c", Created: created, Version: 1, Origin: "c"},
+	})
+
+	if hostnames := manager.Hostnames("first"); !equalStrings(hostnames, []string{"app.example.com", "www.example.com"}) {
+		t.Errorf("Expected the winning tunnel with all hostnames, got %v", hostnames)
+	}
+	if _, err := manager.GetTunnel("late"); err == nil {
+		t.Error("Expected the tunnel losing a secondary hostname not to be created")
+	}
+	conflicts := node.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Hostname != "www.example.com" || conflicts[0].Winner != "first" {
+		t.Errorf("Unexpected conflicts %+v", conflicts)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	managerA, managerB := tunnel.NewManager(10), tunnel.NewManager(10)
+
+	// Node B is only known to A once B contacts it
+	muxA := http.NewServeMux()
+	serverA := httptest.NewServer(muxA)
+	defer serverA.Close()
+	nodeA := NewNode("a", serverA.URL, nil, "secret", 50*time.Millisecond, managerA)
+	nodeA.RegisterRoutes(muxA)
+
+	muxB := http.NewServeMux()
+	serverB := httptest.NewServer(muxB)
+	defer serverB.Close()
+	nodeB := NewNode("b", serverB.URL, []string{serverA.URL}, "secret", 50*time.Millisecond, managerB)
+	nodeB.RegisterRoutes(muxB)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go nodeA.Run(ctx)
+	go nodeB.Run(ctx)
+
+	waitFor := func(condition func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for replication")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	exists := func(manager *tunnel.Manager, id string) func() bool {
+		return func() bool {
+			_, err := manager.GetTunnel(id)
+			return err == nil
+		}
+	}
+
+	if _, err := managerA.CreateTunnel("web", "web.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	waitFor(exists(managerB, "web"))
+
+	if _, err := managerB.CreateTunnel("api", "api.example.com", 9090, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	waitFor(exists(managerA, "api"))
+
+	// Hostnames added and removed on any node reach the others
+	if err := managerB.AddHostname("web", "www.example.com"); err != nil {
+		t.Fatalf("Failed to add hostname: %v", err)
+	}
+	hostnames := func(manager *tunnel.Manager, id string, expected ...string) func() bool {
+		return func() bool {
+			return equalStrings(manager.Hostnames(id), expected)
+		}
+	}
+	waitFor(hostnames(managerA, "web", "web.example.com", "www.example.com"))
+	if err := managerA.RemoveHostname("web", "web.example.com"); err != nil {
+		t.Fatalf("Failed to remove hostname: %v", err)
+	}
+	waitFor(hostnames(managerB, "web", "www.example.com"))
+
+	// Any node can remove any tunnel
+	if err := managerB.RemoveTunnel("web"); err != nil {
+		t.Fatalf("Failed to remove test tunnel: %v", err)
+	}
+	waitFor(func() bool { return !exists(managerA, "web")() })
+
+	if members := nodeA.Members(); len(members) != 1 || members[0].Name != "b" {
+		t.Errorf("Expected A to discover B, got %+v", members)
+	}
+
+	// Nodes without the secret are rejected
+	intruder := NewNode("x", "", nil, "wrong", time.Second, tunnel.NewManager(10))
+	if _, err := intruder.send(context.Background(), serverA.URL); err == nil {
+		t.Error("Expected sync with the wrong secret to fail")
+	}
+
+	// A rotated secret applies without restarting the node
+	nodeA.SetSecret("wrong")
+	if _, err := intruder.send(context.Background(), serverA.URL); err != nil {
+		t.Errorf("Expected sync with the rotated secret to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Package cluster replicates tunnels between easy-tunnel-lb-agent nodes.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncMessage is exchanged by nodes to replicate their state. The receiver
+// merges the sender's entries and replies with its own.
+type SyncMessage struct {
+	Node    string  `json:"node"`
+	URL     string  `json:"url"`
+	Entries []Entry `json:"entries"`
+}
+
+// Member is another node of the cluster
+type Member struct {
+	Name      string    `json:"name,omitempty"`
+	URL       string    `json:"url"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// StatusResponse describes the node's view of the cluster
+type StatusResponse struct {
+	Node      string     `json:"node"`
+	Members   []Member   `json:"members"`
+	Tunnels   int        `json:"tunnels"`
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// Members returns the other nodes of the cluster
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	members := make([]Member, 0, len(n.members))
+	for _, member := range n.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].URL < members[j].URL })
+	return members
+}
+
+// gossip exchanges state with every known member
+func (n *Node) gossip(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, member := range n.Members() {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			n.exchange(ctx, url)
+		}(member.URL)
+	}
+	wg.Wait()
+}
+
+// exchange sends this node's state to the member at url and merges its reply
+func (n *Node) exchange(ctx context.Context, url string) {
+	ctx, cancel := context.WithTimeout(ctx, n.interval)
+	defer cancel()
+
+	reply, err := n.send(ctx, url)
+
+	n.mu.Lock()
+	member, exists := n.members[url]
+	if exists {
+		if err != nil {
+			member.LastError = err.Error()
+		} else {
+			member.Name = reply.Node
+			member.LastSeen = time.Now()
+			member.LastError = ""
+		}
+	}
+	n.mu.Unlock()
+
+	if err != nil {
+		n.logger.Debug().
+			Err(err).
+			Str("peer", url).
+			Msg("Failed to sync with cluster peer")
+		return
+	}
+
+	n.learn(reply.URL, reply.Node)
+	n.Merge(reply.Entries)
+}
+
+func (n *Node) send(ctx context.Context, url string) (*SyncMessage, error) {
+	body, err := json.Marshal(SyncMessage{Node: n.name, URL: n.advertiseURL, Entries: n.Entries()})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(url, "/")+"/api/cluster/sync", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := n.sharedSecret(); secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var reply SyncMessage
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("failed to decode sync reply: %v", err)
+	}
+	return &reply, nil
+}
+
+// learn adds a node that contacted this one to the members, so every node
+// only needs to know one peer to join
+func (n *Node) learn(url, name string) {
+	if url == "" || url == n.advertiseURL {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	member, exists := n.members[url]
+	if !exists {
+		n.logger.Info().
+			Str("peer", url).
+			Str("node", name).
+			Msg("Discovered cluster peer")
+		member = &Member{URL: url}
+		n.members[url] = member
+	}
+	member.Name = name
+	member.LastSeen = time.Now()
+}
+
+// RegisterRoutes registers the cluster endpoints with the given router
+func (n *Node) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/cluster/sync", n.handleSync)
+	mux.HandleFunc("/api/cluster/status", n.handleStatus)
+}
+
+func (n *Node) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !n.authorized(r) {
+		sendError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var msg SyncMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		sendError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	n.learn(msg.URL, msg.Node)
+	n.Merge(msg.Entries)
+
+	sendJSON(w, SyncMessage{Node: n.name, URL: n.advertiseURL, Entries: n.Entries()}, http.StatusOK)
+}
+
+func (n *Node) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tunnels := 0
+	for _, entry := range n.Entries() {
+		if !entry.Deleted {
+			tunnels++
+		}
+	}
+
+	sendJSON(w, StatusResponse{
+		Node:      n.name,
+		Members:   n.Members(),
+		Tunnels:   tunnels,
+		Conflicts: n.Conflicts(),
+	}, http.StatusOK)
+}
+
+// authorized checks the shared cluster secret, if one is configured
+func (n *Node) authorized(r *http.Request) bool {
+	secret := n.sharedSecret()
+	if secret == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func sendJSON(w http.ResponseWriter, data interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func sendError(w http.ResponseWriter, message string, status int) {
+	sendJSON(w, map[string]string{"error": message}, status)
+}
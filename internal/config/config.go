@@ -2,10 +2,32 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/discovery"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/dns"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/docker"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/firewall"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+)
+
+// Supported HA locks
+const (
+	HALockFile       = "file"
+	HALockKubernetes = "kubernetes"
 )
 
 // ServerConfig holds all configuration for the server agent
@@ -15,37 +37,559 @@ type ServerConfig struct {
 	APIHost     string
 	APIBasePath string
 
-	// Public Load Balancer settings
+	// API TLS settings: with a client CA bundle, clients authenticate with
+	// certificates whose identities APIClientCertPolicy maps to the tunnel ID
+	// prefixes they may manage ("identity=prefix|prefix,...")
+	APITLSCertPath       string
+	APITLSKeyPath        string
+	APIClientCAPath      string
+	APIRequireClientCert bool
+	APIClientCertPolicy  string
+
+	// APITokensFile is a JSON file of static API tokens with their scopes
+	// and hostname restrictions
+	APITokensFile string
+
+	// TenantsFile is a JSON file of the limits of the tenants owning
+	// tunnels created with API credentials
+	TenantsFile string
+
+	// API rate limits in requests per minute per source IP and per
+	// authenticated caller (0 disables), with bursts of up to APIRateLimitBurst
+	APIRateLimitPerIP     int
+	APIRateLimitPerCaller int
+	APIRateLimitBurst     int
+
+	// CORS of the API for browser-based tools: the origins allowed to call
+	// it (none by default), the methods and request headers they may use,
+	// whether they may send credentials, and how long browsers may cache
+	// preflight results
+	APICORSAllowedOrigins   []string
+	APICORSAllowedMethods   []string
+	APICORSAllowedHeaders   []string
+	APICORSAllowCredentials bool
+	APICORSMaxAge           time.Duration
+
+	// APIUIEnabled serves the web dashboard at /ui on the API port
+	APIUIEnabled bool
+
+	// AuditLogPath is the append-only file control-plane actions are recorded to
+	AuditLogPath string
+
+	// UsageFile is the append-only file the traffic of tunnels is recorded
+	// to for billing, in buckets of UsageBucket. UsageWebhookURL, if set,
+	// receives the records of each bucket.
+	UsageFile       string
+	UsageBucket     time.Duration
+	UsageWebhookURL string
+
+	// TracingOTLPEndpoint, if set, is the OTLP/HTTP collector URL spans of
+	// API requests, tunnel operations and proxied requests are exported to,
+	// for TracingSampleRatio of new traces
+	TracingOTLPEndpoint string
+	TracingServiceName  string
+	TracingSampleRatio  float64
+
+	// DebugEnabled serves pprof profiles, GC statistics and goroutine
+	// dumps on DebugPort of the loopback interface
+	DebugEnabled bool
+	DebugPort    int
+
+	// JWT authentication: with an issuer set, API callers must present a
+	// token from that OpenID Connect provider issued to APIJWTAudience
+	APIJWTIssuer         string
+	APIJWTAudience       string
+	APIJWTJWKSURL        string
+	APIJWTHostnamesClaim string
+
+	// gRPC Server settings (port 0 disables the gRPC server)
+	GRPCPort        int
+	GRPCTLSCertPath string
+	GRPCTLSKeyPath  string
+
+	// Public Load Balancer settings; an empty host listens on all IPv4 and
+	// IPv6 addresses
 	PublicPort int
 	PublicHost string
+	// Public ports are bound with SO_REUSEPORT when LBReusePort is set, so
+	// that several agent processes can share them, and LBAcceptLoops
+	// sockets per port, each with its own accept loop, spread connections
+	// over the cores of one process
+	LBReusePort   bool
+	LBAcceptLoops int
+	// Public addresses served in addition to PublicPort and the TCP port,
+	// as name=protocol://host:port entries (see loadbalancer.ParseListeners)
+	LBListeners string
 	
-	// TLS Configuration
+	// Session affinity of hostnames with several tunnels: none spreads
+	// requests round robin, client_ip hashes the client IP and cookie
+	// remembers the tunnel in LBAffinityCookie for LBAffinityCookieTTL
+	// (zero makes it a session cookie)
+	LBSessionAffinity   string
+	LBAffinityCookie    string
+	LBAffinityCookieTTL time.Duration
+	// Idempotent HTTP requests that cannot reach their tunnel are retried
+	// this many times (zero disables retries) on the hostname's other
+	// tunnels, or on the same tunnel after a backoff doubled every retry
+	LBRetryAttempts int
+	LBRetryBackoff  time.Duration
+	// Tunnels failing this many connections in a row are skipped for the
+	// cooldown before a single probe may close their circuit again (zero
+	// disables circuit breaking)
+	LBCircuitBreakerFailures int
+	LBCircuitBreakerCooldown time.Duration
+	// Proxy timeouts (zero disables each): dialing a tunnel, waiting for
+	// its response headers and the whole of a request may be overridden
+	// per tunnel; the read header, read, write and idle timeouts of the
+	// public HTTP server apply to all tunnels
+	LBDialTimeout           time.Duration
+	LBResponseHeaderTimeout time.Duration
+	LBMaxRequestDuration    time.Duration
+	LBReadHeaderTimeout     time.Duration
+	LBReadTimeout           time.Duration
+	LBWriteTimeout          time.Duration
+	LBIdleTimeout           time.Duration
+	// Connection pools to tunnels: idle keep-alive connections kept per
+	// tunnel and closed after LBBackendIdleConnTimeout, and the CA bundle
+	// verifying tunnels served over HTTPS (the system's roots if empty)
+	LBBackendMaxIdleConns    int
+	LBBackendIdleConnTimeout time.Duration
+	LBBackendKeepAlives      bool
+	LBBackendCAPath          string
+	// Connections to the TCP listener: the interval of keep-alive probes on
+	// their client and tunnel legs (zero disables them), and how long they
+	// may go without traffic before they are closed (zero keeps them open)
+	LBTCPKeepAlive   time.Duration
+	LBTCPIdleTimeout time.Duration
+	// Directory of templates replacing the load balancer's default error
+	// pages, named 403.html, 404.html, 413.html, 429.html, 502.html,
+	// 503.html, 504.html and maintenance.html
+	LBErrorPagesDir string
+	// ID of the tunnel serving requests for hostnames without a route;
+	// unmatched hostnames get the not found page if empty
+	LBDefaultTunnel string
+	// Gzip compression of proxied responses for clients accepting it, and
+	// the smallest response compressed in bytes; tunnels may override both
+	LBCompression        bool
+	LBCompressionMinSize int
+	// How often proxied responses are flushed to clients while they are
+	// copied (-1 after every write); event streams and responses of
+	// unknown length are always flushed after every write
+	LBFlushInterval time.Duration
+	// Caching of responses marked cacheable by Cache-Control or Expires;
+	// tunnels may override whether their responses are cached. The cache
+	// holds up to LBCacheMaxBytes of bodies of at most
+	// LBCacheMaxObjectBytes each, fresh for at most LBCacheMaxTTL (zero
+	// leaves it to the tunnels), in memory or in files in LBCacheDir.
+	LBCache               bool
+	LBCacheMaxBytes       int64
+	LBCacheMaxObjectBytes int64
+	LBCacheMaxTTL         time.Duration
+	LBCacheDir            string
+	// Key signing the sessions of clients signed in to tunnels with OIDC
+	// edge authentication; random if empty, so sessions end on restart.
+	// Agents sharing hostnames need the same key.
+	LBEdgeAuthSecret string
+	// Largest request body accepted by the public HTTP listener in bytes
+	// (zero is unlimited) and the most bytes of request line and headers
+	LBMaxRequestBodyBytes int64
+	LBMaxHeaderBytes      int
+	// Limits on each public client address per tunnel: HTTP requests and
+	// TCP connections per second, their burst, and concurrent requests and
+	// connections (zero disables a limit); tunnels may override them
+	LBClientRequestsPerSecond int
+	LBClientBurst             int
+	LBClientMaxConnections    int
+	// Largest timeout in seconds, request body in bytes, client request
+	// rate and burst, client connections and retries a tunnel's policy may
+	// set (zero leaves a setting unbounded)
+	TunnelPolicyMaxTimeout                 time.Duration
+	TunnelPolicyMaxRequestBodyBytes        int64
+	TunnelPolicyMaxClientRequestsPerSecond int
+	TunnelPolicyMaxClientConnections       int
+	TunnelPolicyMaxRetryAttempts           int
+	// MaxMind DB file (e.g. GeoLite2 Country) looking up the countries of
+	// public clients for access lists, logs and metrics; optional
+	GeoIPDatabasePath string
+	// File the routing table is saved to after every change and restored
+	// from on startup; optional. Restored routes of tunnels not registered
+	// again within LBRestoredRoutesGrace are removed (zero keeps them).
+	LBRoutesFile          string
+	LBRestoredRoutesGrace time.Duration
+
+	// TLS Configuration; TLSHTTP3 also serves HTTP/3 on the public port
 	TLSCertPath string
 	TLSKeyPath  string
+	TLSHTTP3    bool
+	// How often the certificate files of the public port and listeners are
+	// checked for renewals to serve (zero disables)
+	TLSReloadInterval time.Duration
+	// TLS policy of the public port and HTTPS listeners: the minimum
+	// version (1.2 or 1.3), the TLS 1.2 cipher suites, curves and ALPN
+	// protocols as comma-separated lists (see loadbalancer.ParseTLSPolicy),
+	// and whether OCSP responses are stapled to handshakes
+	TLSMinVersion   string
+	TLSCipherSuites string
+	TLSCurves       string
+	TLSALPN         string
+	TLSOCSPStapling bool
+	// On-demand TLS: obtain certificates from the ACME CA at
+	// TLSOnDemandCAURL (Let's Encrypt if empty) during the first handshake
+	// for routed hostnames the configured certificate does not cover,
+	// storing them in TLSOnDemandCacheDir
+	TLSOnDemand         bool
+	TLSOnDemandEmail    string
+	TLSOnDemandCacheDir string
+	TLSOnDemandCAURL    string
+
+	// WireGuard implementation of the agent's interface (auto, kernel or
+	// userspace, the embedded wireguard-go)
+	WireGuardImplementation string
+	// Additional WireGuard interfaces as name=subnet[+ipv6prefix]:port
+	// entries, e.g. "wg1=10.11.0.0/16:51821", that tunnels can select to
+	// isolate groups
+	WireGuardInterfaces string
+	// IPv6 prefix (ULA or GUA) of the default interface; peers get an IPv6
+	// address from it in addition to IPv4 (empty disables IPv6)
+	WireGuardIPv6Prefix string
+
+	// WireGuard endpoint (host or host:port) tunnel clients connect to,
+	// used to return ready-to-use wg-quick configurations
+	WireGuardEndpoint string
+	// Default persistent keepalive interval of WireGuard peers in seconds
+	// (zero disables keepalives) and MTU of the WireGuard interface and
+	// clients (zero leaves it unset)
+	WireGuardKeepalive int
+	WireGuardMTU       int
+	// WireGuard peers without a handshake for this long mark their tunnel
+	// degraded (zero disables handshake monitoring), and are removed along
+	// with their tunnel after the dead peer timeout (zero keeps them)
+	WireGuardHandshakeTimeout time.Duration
+	WireGuardDeadPeerTimeout  time.Duration
+	// How often the WireGuard peer of each tunnel is pinged over the
+	// tunnel to measure its path's round-trip time and loss (zero disables
+	// probing), and how long to wait for each reply
+	WireGuardPathProbeInterval time.Duration
+	WireGuardPathProbeTimeout  time.Duration
+	// How often the tunnels are compared with the actual WireGuard peers
+	// and routes, repairing drift (zero disables reconciliation)
+	ReconcileInterval time.Duration
+	// Firewall backend (none, auto, nftables or iptables) installing the
+	// forwarding and NAT rules of WireGuard peers; none leaves the host
+	// firewall to be configured manually
+	Firewall string
+
+	// WebSocketEnabled lets tunnel clients connect over WebSocket to the
+	// API server, for networks where WireGuard's UDP is blocked
+	WebSocketEnabled bool
+
+	// SSHPort lets tunnel clients connect with SSH remote forwards (zero
+	// disables SSH), presenting the ed25519 host key at SSHHostKeyPath; a
+	// missing key file is generated, and without a path the key changes
+	// on every start
+	SSHPort        int
+	SSHHostKeyPath string
+
+	// Secrets the agent stores, such as the SSH host key, are sealed with
+	// the key encryption keys in SecretsKeys (id:key entries, the first one
+	// current) or with the transit key SecretsKMSKey of the KMS at
+	// SecretsKMSURL; without any they are stored in plaintext
+	SecretsKeys     string
+	SecretsKMSURL   string
+	SecretsKMSKey   string
+	SecretsKMSToken string
+	// ExposePrivateKeys includes the server's WireGuard private keys in API
+	// responses and private keys in logs, which are redacted by default
+	ExposePrivateKeys bool
 
 	// Tunnel settings
 	MaxTunnels int
+	// Tunnels that stop sending heartbeats for this long are marked degraded
+	// (zero disables liveness tracking)
+	HeartbeatTimeout time.Duration
+	// Domain (e.g. "*.tunnels.example.com") of the random subdomains given
+	// to tunnels created without a hostname; empty requires a hostname
+	TunnelBaseDomain string
+
+	// Kubernetes operator mode: manage tunnels for annotated LoadBalancer
+	// Services (an empty namespace watches all namespaces) and, if a gateway
+	// class is set, for Gateway API routes attached to Gateways of that class
+	KubernetesEnabled      bool
+	KubernetesNamespace    string
+	KubernetesGatewayClass string
+
+	// Docker mode: manage tunnels for the containers of the daemon at
+	// DockerHost (a unix:// socket or tcp:// address) carrying the
+	// easy-tunnel-lb.hostname label
+	DockerEnabled bool
+	DockerHost    string
+
+	// DNS record management: point tunnel hostnames within DNSZone at
+	// DNSTarget (an IP address or hostname, or an IPv4 and an IPv6 address
+	// separated by a comma) using DNSProvider
+	DNSProvider string
+	DNSTarget   string
+	DNSZone     string
+	DNSTTL      int
+
+	// DNS provider credentials
+	CloudflareAPIToken  string
+	DigitalOceanToken   string
+	AWSAccessKeyID      string
+	AWSSecretAccessKey  string
+	AWSSessionToken     string
+	Route53HostedZoneID string
+
+	// Service discovery: register the public endpoint of every tunnel with
+	// DiscoveryBackend (consul or etcd) at DiscoveryURL, refreshing each
+	// within DiscoveryTTL, after which the registry marks it failing
+	// (Consul) or deletes it (etcd)
+	DiscoveryBackend      string
+	DiscoveryURL          string
+	DiscoveryTTL          time.Duration
+	DiscoveryConsulToken  string
+	DiscoveryEtcdPrefix   string
+	DiscoveryEtcdUsername string
+	DiscoveryEtcdPassword string
+
+	// High availability: agents sharing HALock elect a leader that serves
+	// public traffic while the others stand by with a copy of its tunnels.
+	// HAAdvertiseURL is the API URL other agents use to reach this one.
+	HAEnabled        bool
+	HALock           string
+	HALockPath       string
+	HALeaseName      string
+	HALeaseNamespace string
+	HAIdentity       string
+	HAAdvertiseURL   string
+	HALeaseDuration  time.Duration
+
+	// Clustering: nodes replicate their tunnels to each other by exchanging
+	// state with ClusterPeers (API URLs of other nodes) every gossip interval.
+	// ClusterAdvertiseURL is the API URL other nodes use to reach this one.
+	ClusterEnabled        bool
+	ClusterNodeName       string
+	ClusterAdvertiseURL   string
+	ClusterPeers          []string
+	ClusterSecret         string
+	ClusterGossipInterval time.Duration
 
 	// Logging
 	LogLevel string
+	// Per-module log levels, e.g. "wireguard=warn,loadbalancer=debug"
+	ModuleLogLevels string
 
 	// Server shutdown timeout
 	ShutdownTimeout time.Duration
+
+	// On SIGTERM the agent fails readiness for DrainDelay before it stops
+	// accepting connections, then waits up to DrainTimeout for open
+	// connections to finish
+	DrainDelay   time.Duration
+	DrainTimeout time.Duration
+
+	// SecretFiles maps the keys read from files with the KEY_FILE
+	// convention of Docker and Kubernetes secrets to those files, which the
+	// watcher re-reads when they change
+	SecretFiles map[string]string
 }
 
 // LoadConfig loads configuration from environment variables
 func LoadConfig() (*ServerConfig, error) {
+	return load(values{})
+}
+
+// LoadConfigFile loads configuration from a file of KEY=VALUE lines using the
+// same keys as the environment variables. Environment variables take
+// precedence over values in the file.
+func LoadConfigFile(path string) (*ServerConfig, error) {
+	return LoadConfigProfile(path, "")
+}
+
+// LoadConfigProfile loads configuration from a config file as LoadConfigFile
+// does, with the values of the named profile and the profiles it inherits
+// from overriding those outside profiles. An empty profile loads only the
+// values outside profiles.
+func LoadConfigProfile(path, profile string) (*ServerConfig, error) {
+	file, err := readConfigFile(path, profile)
+	if err != nil {
+		return nil, err
+	}
+	return load(values{file: file})
+}
+
+func load(v values) (*ServerConfig, error) {
+	v.secretFiles = make(map[string]string)
+	v.fileErrors = make(map[string]error)
+
 	config := &ServerConfig{
-		APIPort:     getEnvInt("API_PORT", 8080),
-		APIHost:     getEnvStr("API_HOST", "0.0.0.0"),
-		APIBasePath: getEnvStr("API_BASE_PATH", "/api"),
-		PublicPort:  getEnvInt("PUBLIC_PORT", 443),
-		PublicHost:  getEnvStr("PUBLIC_HOST", "0.0.0.0"),
-		TLSCertPath: getEnvStr("TLS_CERT_PATH", ""),
-		TLSKeyPath:  getEnvStr("TLS_KEY_PATH", ""),
-		MaxTunnels:  getEnvInt("MAX_TUNNELS", 100),
-		LogLevel:    getEnvStr("LOG_LEVEL", "info"),
-		ShutdownTimeout: time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 30)) * time.Second,
+		APIPort:     v.getInt("API_PORT", 8080),
+		APIHost:     v.getStr("API_HOST", "0.0.0.0"),
+		APIBasePath: v.getStr("API_BASE_PATH", "/api"),
+		APITLSCertPath:       v.getStr("API_TLS_CERT_PATH", ""),
+		APITLSKeyPath:        v.getStr("API_TLS_KEY_PATH", ""),
+		APIClientCAPath:      v.getStr("API_CLIENT_CA_PATH", ""),
+		APIRequireClientCert: v.getBool("API_REQUIRE_CLIENT_CERT", true),
+		APIClientCertPolicy:  v.getStr("API_CLIENT_CERT_POLICY", ""),
+		APITokensFile:        v.getStr("API_TOKENS_FILE", ""),
+		TenantsFile:          v.getStr("TENANTS_FILE", ""),
+		AuditLogPath:         v.getStr("AUDIT_LOG_PATH", ""),
+		UsageFile:            v.getStr("USAGE_FILE", ""),
+		UsageBucket:          time.Duration(v.getInt("USAGE_BUCKET_SECONDS", 3600)) * time.Second,
+		UsageWebhookURL:      v.getStr("USAGE_WEBHOOK_URL", ""),
+		TracingOTLPEndpoint:  v.getStr("TRACING_OTLP_ENDPOINT", ""),
+		TracingServiceName:   v.getStr("TRACING_SERVICE_NAME", "easy-tunnel-lb-agent"),
+		TracingSampleRatio:   v.getFloat("TRACING_SAMPLE_RATIO", 1),
+		DebugEnabled:         v.getBool("DEBUG_ENABLED", false),
+		DebugPort:            v.getInt("DEBUG_PORT", 6060),
+		APIRateLimitPerIP:     v.getInt("API_RATE_LIMIT_PER_IP", 0),
+		APIRateLimitPerCaller: v.getInt("API_RATE_LIMIT_PER_CALLER", 0),
+		APIRateLimitBurst:     v.getInt("API_RATE_LIMIT_BURST", 20),
+		APICORSAllowedOrigins:   splitList(v.getStr("API_CORS_ALLOWED_ORIGINS", "")),
+		APICORSAllowedMethods:   splitList(v.getStr("API_CORS_ALLOWED_METHODS", strings.Join(api.DefaultCORSMethods, ","))),
+		APICORSAllowedHeaders:   splitList(v.getStr("API_CORS_ALLOWED_HEADERS", strings.Join(api.DefaultCORSHeaders, ","))),
+		APICORSAllowCredentials: v.getBool("API_CORS_ALLOW_CREDENTIALS", false),
+		APICORSMaxAge:           time.Duration(v.getInt("API_CORS_MAX_AGE_SECONDS", 600)) * time.Second,
+		APIUIEnabled:            v.getBool("API_UI_ENABLED", true),
+		APIJWTIssuer:         v.getStr("API_JWT_ISSUER", ""),
+		APIJWTAudience:       v.getStr("API_JWT_AUDIENCE", ""),
+		APIJWTJWKSURL:        v.getStr("API_JWT_JWKS_URL", ""),
+		APIJWTHostnamesClaim: v.getStr("API_JWT_HOSTNAMES_CLAIM", ""),
+		GRPCPort:        v.getInt("GRPC_PORT", 0),
+		GRPCTLSCertPath: v.getStr("GRPC_TLS_CERT_PATH", ""),
+		GRPCTLSKeyPath:  v.getStr("GRPC_TLS_KEY_PATH", ""),
+		PublicPort:  v.getInt("PUBLIC_PORT", 443),
+		PublicHost:  v.getStr("PUBLIC_HOST", ""),
+		LBReusePort:   v.getBool("LB_REUSE_PORT", false),
+		LBAcceptLoops: v.getInt("LB_ACCEPT_LOOPS", 1),
+		LBListeners:   v.getStr("LB_LISTENERS", ""),
+		LBSessionAffinity:   v.getStr("LB_SESSION_AFFINITY", string(loadbalancer.AffinityNone)),
+		LBAffinityCookie:    v.getStr("LB_AFFINITY_COOKIE", loadbalancer.DefaultAffinityCookie),
+		LBAffinityCookieTTL: time.Duration(v.getInt("LB_AFFINITY_COOKIE_TTL_SECONDS", 0)) * time.Second,
+		LBRetryAttempts:     v.getInt("LB_RETRY_ATTEMPTS", 2),
+		LBRetryBackoff:      time.Duration(v.getInt("LB_RETRY_BACKOFF_MS", 100)) * time.Millisecond,
+		LBCircuitBreakerFailures: v.getInt("LB_CIRCUIT_BREAKER_FAILURES", 5),
+		LBCircuitBreakerCooldown: time.Duration(v.getInt("LB_CIRCUIT_BREAKER_COOLDOWN_SECONDS", 30)) * time.Second,
+		LBDialTimeout:           time.Duration(v.getInt("LB_DIAL_TIMEOUT_SECONDS", 10)) * time.Second,
+		LBResponseHeaderTimeout: time.Duration(v.getInt("LB_RESPONSE_HEADER_TIMEOUT_SECONDS", 60)) * time.Second,
+		LBMaxRequestDuration:    time.Duration(v.getInt("LB_MAX_REQUEST_DURATION_SECONDS", 0)) * time.Second,
+		LBReadHeaderTimeout:     time.Duration(v.getInt("LB_READ_HEADER_TIMEOUT_SECONDS", 10)) * time.Second,
+		LBReadTimeout:           time.Duration(v.getInt("LB_READ_TIMEOUT_SECONDS", 0)) * time.Second,
+		LBWriteTimeout:          time.Duration(v.getInt("LB_WRITE_TIMEOUT_SECONDS", 0)) * time.Second,
+		LBIdleTimeout:           time.Duration(v.getInt("LB_IDLE_TIMEOUT_SECONDS", 120)) * time.Second,
+		LBBackendMaxIdleConns:    v.getInt("LB_BACKEND_MAX_IDLE_CONNS", loadbalancer.DefaultMaxIdleConnsPerTarget),
+		LBBackendIdleConnTimeout: time.Duration(v.getInt("LB_BACKEND_IDLE_CONN_TIMEOUT_SECONDS", 90)) * time.Second,
+		LBBackendKeepAlives:      v.getBool("LB_BACKEND_KEEPALIVES", true),
+		LBBackendCAPath:          v.getStr("LB_BACKEND_CA_PATH", ""),
+		LBTCPKeepAlive:           time.Duration(v.getInt("LB_TCP_KEEPALIVE_SECONDS", 15)) * time.Second,
+		LBTCPIdleTimeout:         time.Duration(v.getInt("LB_TCP_IDLE_TIMEOUT_SECONDS", 0)) * time.Second,
+		LBErrorPagesDir:          v.getStr("LB_ERROR_PAGES_DIR", ""),
+		LBDefaultTunnel:          v.getStr("LB_DEFAULT_TUNNEL", ""),
+		LBCompression:            v.getBool("LB_COMPRESSION", false),
+		LBCompressionMinSize:     v.getInt("LB_COMPRESSION_MIN_SIZE", loadbalancer.DefaultCompressionMinSize),
+		LBFlushInterval:          flushInterval(v.getInt("LB_FLUSH_INTERVAL_MS", 0)),
+		LBCache:                  v.getBool("LB_CACHE", false),
+		LBCacheMaxBytes:          int64(v.getInt("LB_CACHE_MAX_BYTES", loadbalancer.DefaultCacheMaxBytes)),
+		LBCacheMaxObjectBytes:    int64(v.getInt("LB_CACHE_MAX_OBJECT_BYTES", loadbalancer.DefaultCacheMaxObjectBytes)),
+		LBCacheMaxTTL:            time.Duration(v.getInt("LB_CACHE_MAX_TTL_SECONDS", 0)) * time.Second,
+		LBCacheDir:               v.getStr("LB_CACHE_DIR", ""),
+		LBEdgeAuthSecret:         v.getStr("LB_EDGE_AUTH_SECRET", ""),
+		LBMaxRequestBodyBytes:    int64(v.getInt("LB_MAX_REQUEST_BODY_BYTES", 0)),
+		LBMaxHeaderBytes:         v.getInt("LB_MAX_HEADER_BYTES", loadbalancer.DefaultMaxHeaderBytes),
+		GeoIPDatabasePath:        v.getStr("GEOIP_DATABASE_PATH", ""),
+		LBRoutesFile:             v.getStr("LB_ROUTES_FILE", ""),
+		LBRestoredRoutesGrace:    time.Duration(v.getInt("LB_RESTORED_ROUTES_GRACE_SECONDS", 300)) * time.Second,
+		LBClientRequestsPerSecond: v.getInt("LB_CLIENT_REQUESTS_PER_SECOND", 0),
+		LBClientBurst:             v.getInt("LB_CLIENT_BURST", 0),
+		LBClientMaxConnections:    v.getInt("LB_CLIENT_MAX_CONNECTIONS", 0),
+		TunnelPolicyMaxTimeout:                 time.Duration(v.getInt("TUNNEL_POLICY_MAX_TIMEOUT_SECONDS", 0)) * time.Second,
+		TunnelPolicyMaxRequestBodyBytes:        int64(v.getInt("TUNNEL_POLICY_MAX_REQUEST_BODY_BYTES", 0)),
+		TunnelPolicyMaxClientRequestsPerSecond: v.getInt("TUNNEL_POLICY_MAX_CLIENT_REQUESTS_PER_SECOND", 0),
+		TunnelPolicyMaxClientConnections:       v.getInt("TUNNEL_POLICY_MAX_CLIENT_CONNECTIONS", 0),
+		TunnelPolicyMaxRetryAttempts:           v.getInt("TUNNEL_POLICY_MAX_RETRY_ATTEMPTS", 0),
+		TLSCertPath: v.getStr("TLS_CERT_PATH", ""),
+		TLSKeyPath:  v.getStr("TLS_KEY_PATH", ""),
+		TLSHTTP3:    v.getBool("TLS_HTTP3", false),
+		TLSReloadInterval: time.Duration(v.getInt("TLS_RELOAD_INTERVAL_SECONDS", 60)) * time.Second,
+		TLSMinVersion:     v.getStr("TLS_MIN_VERSION", "1.2"),
+		TLSCipherSuites:   v.getStr("TLS_CIPHER_SUITES", ""),
+		TLSCurves:         v.getStr("TLS_CURVES", ""),
+		TLSALPN:           v.getStr("TLS_ALPN", "h2,http/1.1"),
+		TLSOCSPStapling:   v.getBool("TLS_OCSP_STAPLING", false),
+		TLSOnDemand:         v.getBool("TLS_ON_DEMAND", false),
+		TLSOnDemandEmail:    v.getStr("TLS_ON_DEMAND_EMAIL", ""),
+		TLSOnDemandCacheDir: v.getStr("TLS_ON_DEMAND_CACHE_DIR", ""),
+		TLSOnDemandCAURL:    v.getStr("TLS_ON_DEMAND_CA_URL", ""),
+		WireGuardImplementation: v.getStr("WG_IMPLEMENTATION", tunnel.WireGuardAuto),
+		WireGuardInterfaces:     v.getStr("WG_INTERFACES", ""),
+		WireGuardIPv6Prefix:     v.getStr("WG_IPV6_PREFIX", ""),
+		WireGuardEndpoint: v.getStr("WG_ENDPOINT", ""),
+		WireGuardKeepalive: v.getInt("WG_PERSISTENT_KEEPALIVE_SECONDS", 25),
+		WireGuardMTU:       v.getInt("WG_MTU", 0),
+		WireGuardHandshakeTimeout: time.Duration(v.getInt("WG_HANDSHAKE_TIMEOUT_SECONDS", 180)) * time.Second,
+		WireGuardDeadPeerTimeout:  time.Duration(v.getInt("WG_DEAD_PEER_TIMEOUT_SECONDS", 0)) * time.Second,
+		WireGuardPathProbeInterval: time.Duration(v.getInt("WG_PATH_PROBE_INTERVAL_SECONDS", 0)) * time.Second,
+		WireGuardPathProbeTimeout:  time.Duration(v.getInt("WG_PATH_PROBE_TIMEOUT_SECONDS", 2)) * time.Second,
+		ReconcileInterval:         time.Duration(v.getInt("RECONCILE_INTERVAL_SECONDS", 60)) * time.Second,
+		Firewall:                  v.getStr("FIREWALL", firewall.BackendNone),
+		WebSocketEnabled:          v.getBool("WEBSOCKET_ENABLED", false),
+		SSHPort:                   v.getInt("SSH_PORT", 0),
+		SSHHostKeyPath:            v.getStr("SSH_HOST_KEY_PATH", ""),
+		SecretsKeys:       v.getStr("SECRETS_KEYS", ""),
+		SecretsKMSURL:     v.getStr("SECRETS_KMS_URL", ""),
+		SecretsKMSKey:     v.getStr("SECRETS_KMS_KEY", ""),
+		SecretsKMSToken:   v.getStr("SECRETS_KMS_TOKEN", ""),
+		ExposePrivateKeys: v.getBool("EXPOSE_PRIVATE_KEYS", false),
+		MaxTunnels:  v.getInt("MAX_TUNNELS", 100),
+		HeartbeatTimeout: time.Duration(v.getInt("HEARTBEAT_TIMEOUT_SECONDS", 90)) * time.Second,
+		TunnelBaseDomain: v.getStr("TUNNEL_BASE_DOMAIN", ""),
+		KubernetesEnabled:   v.getBool("KUBERNETES_ENABLED", false),
+		KubernetesNamespace: v.getStr("KUBERNETES_NAMESPACE", ""),
+		KubernetesGatewayClass: v.getStr("KUBERNETES_GATEWAY_CLASS", ""),
+		DockerEnabled: v.getBool("DOCKER_ENABLED", false),
+		DockerHost:    v.getStr("DOCKER_HOST", docker.DefaultHost),
+		DNSProvider: v.getStr("DNS_PROVIDER", ""),
+		DNSTarget:   v.getStr("DNS_TARGET", ""),
+		DNSZone:     v.getStr("DNS_ZONE", ""),
+		DNSTTL:      v.getInt("DNS_TTL", 300),
+		CloudflareAPIToken:  v.getStr("CLOUDFLARE_API_TOKEN", ""),
+		DigitalOceanToken:   v.getStr("DIGITALOCEAN_TOKEN", ""),
+		AWSAccessKeyID:      v.getStr("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey:  v.getStr("AWS_SECRET_ACCESS_KEY", ""),
+		AWSSessionToken:     v.getStr("AWS_SESSION_TOKEN", ""),
+		Route53HostedZoneID: v.getStr("ROUTE53_HOSTED_ZONE_ID", ""),
+		DiscoveryBackend:      v.getStr("DISCOVERY_BACKEND", ""),
+		DiscoveryURL:          v.getStr("DISCOVERY_URL", ""),
+		DiscoveryTTL:          time.Duration(v.getInt("DISCOVERY_TTL_SECONDS", 30)) * time.Second,
+		DiscoveryConsulToken:  v.getStr("DISCOVERY_CONSUL_TOKEN", ""),
+		DiscoveryEtcdPrefix:   v.getStr("DISCOVERY_ETCD_PREFIX", "/services/"),
+		DiscoveryEtcdUsername: v.getStr("DISCOVERY_ETCD_USERNAME", ""),
+		DiscoveryEtcdPassword: v.getStr("DISCOVERY_ETCD_PASSWORD", ""),
+		HAEnabled:        v.getBool("HA_ENABLED", false),
+		HALock:           v.getStr("HA_LOCK", HALockFile),
+		HALockPath:       v.getStr("HA_LOCK_PATH", ""),
+		HALeaseName:      v.getStr("HA_LEASE_NAME", "easy-tunnel-lb-agent"),
+		HALeaseNamespace: v.getStr("HA_LEASE_NAMESPACE", "default"),
+		HAIdentity:       v.getStr("HA_IDENTITY", defaultIdentity()),
+		HAAdvertiseURL:   v.getStr("HA_ADVERTISE_URL", ""),
+		HALeaseDuration:  time.Duration(v.getInt("HA_LEASE_DURATION_SECONDS", 15)) * time.Second,
+		ClusterEnabled:        v.getBool("CLUSTER_ENABLED", false),
+		ClusterNodeName:       v.getStr("CLUSTER_NODE_NAME", defaultIdentity()),
+		ClusterAdvertiseURL:   v.getStr("CLUSTER_ADVERTISE_URL", ""),
+		ClusterPeers:          splitList(v.getStr("CLUSTER_PEERS", "")),
+		ClusterSecret:         v.getStr("CLUSTER_SECRET", ""),
+		ClusterGossipInterval: time.Duration(v.getInt("CLUSTER_GOSSIP_INTERVAL_SECONDS", 5)) * time.Second,
+		LogLevel:    v.getStr("LOG_LEVEL", "info"),
+		ModuleLogLevels: v.getStr("LOG_LEVELS", ""),
+		ShutdownTimeout: time.Duration(v.getInt("SHUTDOWN_TIMEOUT_SECONDS", 30)) * time.Second,
+		DrainDelay:      time.Duration(v.getInt("DRAIN_DELAY_SECONDS", 0)) * time.Second,
+		DrainTimeout:    time.Duration(v.getInt("DRAIN_TIMEOUT_SECONDS", 30)) * time.Second,
+	}
+	if err := v.fileError(); err != nil {
+		return nil, err
+	}
+	if len(v.secretFiles) > 0 {
+		config.SecretFiles = v.secretFiles
 	}
 
 	// Validate configuration
@@ -62,31 +606,603 @@ func (c *ServerConfig) validate() error {
 		return fmt.Errorf("invalid API port: %d", c.APIPort)
 	}
 
+	if c.GRPCPort < 0 || c.GRPCPort > 65535 {
+		return fmt.Errorf("invalid gRPC port: %d", c.GRPCPort)
+	}
+
 	if c.PublicPort <= 0 || c.PublicPort > 65535 {
 		return fmt.Errorf("invalid public port: %d", c.PublicPort)
 	}
 
+	if c.LBAcceptLoops < 0 {
+		return fmt.Errorf("invalid accept loops: %d", c.LBAcceptLoops)
+	}
+
+	listeners, err := loadbalancer.ParseListeners(c.LBListeners)
+	if err != nil {
+		return fmt.Errorf("invalid LB_LISTENERS: %v", err)
+	}
+	for _, l := range listeners {
+		if l.Protocol == loadbalancer.ListenerHTTPS && l.TLS == nil && (c.TLSCertPath == "" || c.TLSKeyPath == "") && !c.TLSOnDemand {
+			return fmt.Errorf("invalid LB_LISTENERS: listener %s needs a certificate, TLS_CERT_PATH and TLS_KEY_PATH, or TLS_ON_DEMAND", l.Name)
+		}
+	}
+
+	if c.SSHPort < 0 || c.SSHPort > 65535 {
+		return fmt.Errorf("invalid SSH port: %d", c.SSHPort)
+	}
+
+	if _, err := loadbalancer.ParseAffinityMode(c.LBSessionAffinity); err != nil {
+		return fmt.Errorf("invalid LB_SESSION_AFFINITY: %v", err)
+	}
+	if c.LBAffinityCookieTTL < 0 {
+		return fmt.Errorf("invalid affinity cookie TTL: %v", c.LBAffinityCookieTTL)
+	}
+	retry := loadbalancer.RetryPolicy{Attempts: c.LBRetryAttempts, Backoff: c.LBRetryBackoff}
+	if err := retry.Validate(); err != nil {
+		return err
+	}
+	breaker := loadbalancer.CircuitBreakerPolicy{Failures: c.LBCircuitBreakerFailures, Cooldown: c.LBCircuitBreakerCooldown}
+	if err := breaker.Validate(); err != nil {
+		return err
+	}
+	timeouts := loadbalancer.Timeouts{
+		Dial:           c.LBDialTimeout,
+		ResponseHeader: c.LBResponseHeaderTimeout,
+		MaxRequest:     c.LBMaxRequestDuration,
+		ReadHeader:     c.LBReadHeaderTimeout,
+		Read:           c.LBReadTimeout,
+		Write:          c.LBWriteTimeout,
+		Idle:           c.LBIdleTimeout,
+	}
+	if err := timeouts.Validate(); err != nil {
+		return err
+	}
+	transport := loadbalancer.TransportConfig{MaxIdleConnsPerTarget: c.LBBackendMaxIdleConns, IdleConnTimeout: c.LBBackendIdleConnTimeout}
+	if err := transport.Validate(); err != nil {
+		return err
+	}
+	tcp := loadbalancer.TCPConfig{KeepAlive: c.LBTCPKeepAlive, IdleTimeout: c.LBTCPIdleTimeout}
+	if err := tcp.Validate(); err != nil {
+		return err
+	}
+
+	compression := loadbalancer.Compression{Enabled: c.LBCompression, MinSize: c.LBCompressionMinSize}
+	if err := compression.Validate(); err != nil {
+		return err
+	}
+	if err := loadbalancer.ValidateFlushInterval(c.LBFlushInterval); err != nil {
+		return err
+	}
+
+	cache := loadbalancer.Cache{MaxBytes: c.LBCacheMaxBytes, MaxObjectBytes: c.LBCacheMaxObjectBytes, MaxTTL: c.LBCacheMaxTTL}
+	if err := cache.Validate(); err != nil {
+		return err
+	}
+
+	limits := loadbalancer.Limits{MaxRequestBody: c.LBMaxRequestBodyBytes, MaxHeaderBytes: c.LBMaxHeaderBytes}
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	clientLimits := loadbalancer.ClientLimits{
+		RequestsPerSecond: c.LBClientRequestsPerSecond,
+		Burst:             c.LBClientBurst,
+		MaxConnections:    c.LBClientMaxConnections,
+	}
+	if err := clientLimits.Validate(); err != nil {
+		return err
+	}
+
+	if c.TunnelPolicyMaxTimeout < 0 || c.TunnelPolicyMaxRequestBodyBytes < 0 || c.TunnelPolicyMaxClientRequestsPerSecond < 0 ||
+		c.TunnelPolicyMaxClientConnections < 0 || c.TunnelPolicyMaxRetryAttempts < 0 {
+		return fmt.Errorf("tunnel policy maximums must not be negative")
+	}
+
+	if c.LBRestoredRoutesGrace < 0 {
+		return fmt.Errorf("invalid restored routes grace period: %v", c.LBRestoredRoutesGrace)
+	}
+
+	if c.HeartbeatTimeout < 0 {
+		return fmt.Errorf("invalid heartbeat timeout: %v", c.HeartbeatTimeout)
+	}
+
+	if c.TunnelBaseDomain != "" {
+		if _, err := loadbalancer.NormalizeHostname(strings.TrimPrefix(c.TunnelBaseDomain, "*.")); err != nil {
+			return fmt.Errorf("invalid TUNNEL_BASE_DOMAIN: %v", err)
+		}
+	}
+
+	if c.WireGuardImplementation != "" {
+		if err := tunnel.ValidateWireGuardImplementation(c.WireGuardImplementation); err != nil {
+			return fmt.Errorf("invalid WG_IMPLEMENTATION: %v", err)
+		}
+	}
+
+	wgInterfaces, err := tunnel.ParseWireGuardInterfaces(c.WireGuardInterfaces)
+	if err != nil {
+		return fmt.Errorf("invalid WG_INTERFACES: %v", err)
+	}
+	if c.WireGuardIPv6Prefix != "" {
+		defaultInterface := tunnel.WireGuardInterface{
+			Name:    tunnel.DefaultWireGuardInterface,
+			Subnet:  tunnel.DefaultWireGuardSubnet,
+			Subnet6: c.WireGuardIPv6Prefix,
+			Port:    tunnel.DefaultWireGuardPort,
+		}
+		if err := defaultInterface.Validate(); err != nil {
+			return fmt.Errorf("invalid WG_IPV6_PREFIX: %v", err)
+		}
+		for _, iface := range wgInterfaces {
+			if err := defaultInterface.Conflicts(iface); err != nil {
+				return fmt.Errorf("invalid WG_IPV6_PREFIX: %v", err)
+			}
+		}
+	}
+
+	if err := firewall.ValidateBackend(c.Firewall); err != nil {
+		return fmt.Errorf("invalid FIREWALL: %v", err)
+	}
+
+	wgDefaults := tunnel.WireGuardOptions{PersistentKeepalive: c.WireGuardKeepalive, MTU: c.WireGuardMTU}
+	if err := wgDefaults.Validate(); err != nil {
+		return fmt.Errorf("invalid WireGuard defaults: %v", err)
+	}
+
+	if c.WireGuardHandshakeTimeout < 0 || c.WireGuardDeadPeerTimeout < 0 {
+		return fmt.Errorf("WireGuard handshake timeouts must not be negative")
+	}
+	if c.WireGuardDeadPeerTimeout > 0 && c.WireGuardDeadPeerTimeout < c.WireGuardHandshakeTimeout {
+		return fmt.Errorf("WG_DEAD_PEER_TIMEOUT_SECONDS must not be shorter than WG_HANDSHAKE_TIMEOUT_SECONDS")
+	}
+	if c.WireGuardPathProbeInterval < 0 {
+		return fmt.Errorf("WG_PATH_PROBE_INTERVAL_SECONDS must not be negative")
+	}
+	if c.WireGuardPathProbeInterval > 0 && (c.WireGuardPathProbeTimeout <= 0 || c.WireGuardPathProbeTimeout > c.WireGuardPathProbeInterval) {
+		return fmt.Errorf("WG_PATH_PROBE_TIMEOUT_SECONDS must be positive and not longer than WG_PATH_PROBE_INTERVAL_SECONDS")
+	}
+	if c.ReconcileInterval < 0 {
+		return fmt.Errorf("RECONCILE_INTERVAL_SECONDS must not be negative")
+	}
+
+	if err := c.validateSecrets(); err != nil {
+		return err
+	}
+
 	// If TLS is configured, both cert and key must be provided
 	if (c.TLSCertPath != "" && c.TLSKeyPath == "") || (c.TLSCertPath == "" && c.TLSKeyPath != "") {
 		return fmt.Errorf("both TLS certificate and key must be provided")
 	}
+	if c.TLSReloadInterval < 0 {
+		return fmt.Errorf("TLS_RELOAD_INTERVAL_SECONDS must not be negative")
+	}
+	if c.TLSHTTP3 && c.TLSCertPath == "" && !c.TLSOnDemand {
+		return fmt.Errorf("TLS_HTTP3 requires TLS_CERT_PATH and TLS_KEY_PATH, or TLS_ON_DEMAND")
+	}
+	if c.TLSOnDemand {
+		if c.TLSOnDemandCacheDir == "" {
+			return fmt.Errorf("TLS_ON_DEMAND requires TLS_ON_DEMAND_CACHE_DIR")
+		}
+		if c.TLSOnDemandCAURL != "" {
+			if u, err := url.Parse(c.TLSOnDemandCAURL); err != nil || u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("invalid TLS_ON_DEMAND_CA_URL: %q", c.TLSOnDemandCAURL)
+			}
+		}
+	}
+	if _, err := c.TLSPolicy(); err != nil {
+		return err
+	}
+	if c.TLSOCSPStapling && c.TLSReloadInterval == 0 {
+		return fmt.Errorf("TLS_OCSP_STAPLING requires TLS_RELOAD_INTERVAL_SECONDS to refresh the staples")
+	}
+
+	if (c.GRPCTLSCertPath != "") != (c.GRPCTLSKeyPath != "") {
+		return fmt.Errorf("both gRPC TLS certificate and key must be provided")
+	}
+
+	if (c.APITLSCertPath != "") != (c.APITLSKeyPath != "") {
+		return fmt.Errorf("both API TLS certificate and key must be provided")
+	}
+	if c.APIClientCAPath != "" && c.APITLSCertPath == "" {
+		return fmt.Errorf("API_CLIENT_CA_PATH requires API TLS to be configured")
+	}
+	if c.APIClientCertPolicy != "" {
+		if c.APIClientCAPath == "" {
+			return fmt.Errorf("API_CLIENT_CERT_POLICY requires API_CLIENT_CA_PATH")
+		}
+		if _, err := api.ParseClientCertPolicy(c.APIClientCertPolicy); err != nil {
+			return fmt.Errorf("invalid API_CLIENT_CERT_POLICY: %v", err)
+		}
+	}
+
+	if c.APIRateLimitPerIP < 0 || c.APIRateLimitPerCaller < 0 {
+		return fmt.Errorf("API rate limits must not be negative")
+	}
+	if (c.APIRateLimitPerIP > 0 || c.APIRateLimitPerCaller > 0) && c.APIRateLimitBurst < 1 {
+		return fmt.Errorf("API_RATE_LIMIT_BURST must be at least 1")
+	}
+	if _, err := api.NewCORS(c.CORSConfig()); err != nil {
+		return fmt.Errorf("invalid API CORS configuration: %v", err)
+	}
+
+	if c.UsageFile != "" && c.UsageBucket < time.Minute {
+		return fmt.Errorf("USAGE_BUCKET_SECONDS must be at least 60")
+	}
+	if c.UsageWebhookURL != "" && c.UsageFile == "" {
+		return fmt.Errorf("USAGE_FILE is required with USAGE_WEBHOOK_URL")
+	}
+
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		return fmt.Errorf("TRACING_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	if c.DrainDelay < 0 || c.DrainTimeout < 0 {
+		return fmt.Errorf("DRAIN_DELAY_SECONDS and DRAIN_TIMEOUT_SECONDS must not be negative")
+	}
+
+	if c.DebugEnabled && (c.DebugPort <= 0 || c.DebugPort > 65535) {
+		return fmt.Errorf("invalid debug port: %d", c.DebugPort)
+	}
+
+	if c.APIJWTIssuer != "" && c.APIJWTAudience == "" {
+		return fmt.Errorf("API_JWT_AUDIENCE is required with API_JWT_ISSUER")
+	}
+	if c.APIJWTIssuer == "" && (c.APIJWTAudience != "" || c.APIJWTJWKSURL != "" || c.APIJWTHostnamesClaim != "") {
+		return fmt.Errorf("API_JWT_ISSUER is required for JWT authentication")
+	}
+
+	if _, err := utils.ParseModuleLevels(c.ModuleLogLevels); err != nil {
+		return fmt.Errorf("invalid LOG_LEVELS: %v", err)
+	}
+
+	if c.DockerEnabled {
+		if _, err := docker.NewClient(c.DockerHost); err != nil {
+			return err
+		}
+	}
+
+	if c.DNSProvider != "" {
+		if err := c.validateDNS(); err != nil {
+			return err
+		}
+	}
+
+	if c.DiscoveryBackend != "" {
+		if err := c.validateDiscovery(); err != nil {
+			return err
+		}
+	}
+
+	if c.HAEnabled {
+		if err := c.validateHA(); err != nil {
+			return err
+		}
+	}
+
+	if c.ClusterEnabled {
+		if c.HAEnabled {
+			return fmt.Errorf("HA standby mode and clustering cannot both be enabled")
+		}
+		if c.ClusterNodeName == "" || c.ClusterAdvertiseURL == "" {
+			return fmt.Errorf("CLUSTER_NODE_NAME and CLUSTER_ADVERTISE_URL are required when clustering is enabled")
+		}
+		if c.ClusterGossipInterval <= 0 {
+			return fmt.Errorf("invalid cluster gossip interval: %v", c.ClusterGossipInterval)
+		}
+	}
 
 	return nil
 }
 
-// Helper functions to get environment variables
-func getEnvStr(key string, defaultVal string) string {
+// validateHA checks the leader election settings
+func (c *ServerConfig) validateHA() error {
+	switch c.HALock {
+	case HALockFile:
+		if c.HALockPath == "" {
+			return fmt.Errorf("HA_LOCK_PATH is required for the file HA lock")
+		}
+	case HALockKubernetes:
+		if c.HALeaseName == "" || c.HALeaseNamespace == "" {
+			return fmt.Errorf("HA_LEASE_NAME and HA_LEASE_NAMESPACE are required for the kubernetes HA lock")
+		}
+	default:
+		return fmt.Errorf("unknown HA lock: %s", c.HALock)
+	}
+
+	if c.HAIdentity == "" {
+		return fmt.Errorf("HA_IDENTITY is required when HA is enabled")
+	}
+	if c.HAAdvertiseURL == "" {
+		return fmt.Errorf("HA_ADVERTISE_URL is required when HA is enabled")
+	}
+	if c.HALeaseDuration < 3*time.Second {
+		return fmt.Errorf("invalid HA lease duration: %v", c.HALeaseDuration)
+	}
+	return nil
+}
+
+// SecretsConfig returns the keys stored secrets are sealed with
+func (c *ServerConfig) SecretsConfig() secrets.Config {
+	return secrets.Config{
+		Keys:     c.SecretsKeys,
+		KMSURL:   c.SecretsKMSURL,
+		KMSKey:   c.SecretsKMSKey,
+		KMSToken: c.SecretsKMSToken,
+	}
+}
+
+// CORSConfig returns the CORS configuration of the API
+func (c *ServerConfig) CORSConfig() api.CORSConfig {
+	return api.CORSConfig{
+		AllowedOrigins:   c.APICORSAllowedOrigins,
+		AllowedMethods:   c.APICORSAllowedMethods,
+		AllowedHeaders:   c.APICORSAllowedHeaders,
+		AllowCredentials: c.APICORSAllowCredentials,
+		MaxAge:           c.APICORSMaxAge,
+	}
+}
+
+// TLSPolicy returns the TLS policy of the public port and HTTPS listeners
+func (c *ServerConfig) TLSPolicy() (loadbalancer.TLSPolicy, error) {
+	policy, err := loadbalancer.ParseTLSPolicy(c.TLSMinVersion, c.TLSCipherSuites, c.TLSCurves, c.TLSALPN)
+	if err != nil {
+		return policy, fmt.Errorf("invalid TLS policy: %v", err)
+	}
+	policy.OCSPStapling = c.TLSOCSPStapling
+	return policy, nil
+}
+
+// Checksum returns a hash of the configuration, which differs between
+// agents or reloads with different settings without revealing them
+func (c *ServerConfig) Checksum() string {
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validateSecrets checks that at most one source of secrets keys is set
+func (c *ServerConfig) validateSecrets() error {
+	if c.SecretsKeys != "" && c.SecretsKMSURL != "" {
+		return fmt.Errorf("only one of SECRETS_KEYS and SECRETS_KMS_URL may be set")
+	}
+	if (c.SecretsKMSURL == "") != (c.SecretsKMSKey == "") {
+		return fmt.Errorf("SECRETS_KMS_URL and SECRETS_KMS_KEY must be set together")
+	}
+	if c.SecretsKeys != "" {
+		if _, err := secrets.ParseKeyring(c.SecretsKeys); err != nil {
+			return fmt.Errorf("invalid SECRETS_KEYS: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// flushInterval converts LB_FLUSH_INTERVAL_MS, keeping -1 (flush after
+// every write) as it is
+func flushInterval(ms int) time.Duration {
+	if ms < 0 {
+		return time.Duration(ms)
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// defaultIdentity identifies the agent by its hostname
+func defaultIdentity() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// validateDNS checks that the selected DNS provider has what it needs
+func (c *ServerConfig) validateDNS() error {
+	if c.DNSTarget == "" || c.DNSZone == "" {
+		return fmt.Errorf("DNS_TARGET and DNS_ZONE are required when DNS_PROVIDER is set")
+	}
+	if err := dns.ValidateTargets(c.DNSTarget); err != nil {
+		return fmt.Errorf("invalid DNS_TARGET: %v", err)
+	}
+	if c.DNSTTL <= 0 {
+		return fmt.Errorf("invalid DNS TTL: %d", c.DNSTTL)
+	}
+
+	switch c.DNSProvider {
+	case dns.ProviderCloudflare:
+		if c.CloudflareAPIToken == "" {
+			return fmt.Errorf("CLOUDFLARE_API_TOKEN is required for the cloudflare DNS provider")
+		}
+	case dns.ProviderDigitalOcean:
+		if c.DigitalOceanToken == "" {
+			return fmt.Errorf("DIGITALOCEAN_TOKEN is required for the digitalocean DNS provider")
+		}
+	case dns.ProviderRoute53:
+		if c.Route53HostedZoneID == "" {
+			return fmt.Errorf("ROUTE53_HOSTED_ZONE_ID is required for the route53 DNS provider")
+		}
+		if (c.AWSAccessKeyID == "") != (c.AWSSecretAccessKey == "") {
+			return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set together")
+		}
+	default:
+		return fmt.Errorf("unknown DNS provider: %s", c.DNSProvider)
+	}
+	return nil
+}
+
+// validateDiscovery checks the service discovery settings
+func (c *ServerConfig) validateDiscovery() error {
+	switch c.DiscoveryBackend {
+	case discovery.BackendConsul, discovery.BackendEtcd:
+	default:
+		return fmt.Errorf("unknown service discovery backend: %s", c.DiscoveryBackend)
+	}
+	if c.DiscoveryURL != "" {
+		if u, err := url.Parse(c.DiscoveryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid DISCOVERY_URL: %q", c.DiscoveryURL)
+		}
+	}
+	if c.DiscoveryTTL < 3*time.Second {
+		return fmt.Errorf("invalid discovery TTL: %v, must be at least 3 seconds", c.DiscoveryTTL)
+	}
+	if c.DiscoveryBackend == discovery.BackendEtcd && !strings.HasPrefix(c.DiscoveryEtcdPrefix, "/") {
+		return fmt.Errorf("invalid DISCOVERY_ETCD_PREFIX: %q, must start with /", c.DiscoveryEtcdPrefix)
+	}
+	return nil
+}
+
+// values resolves configuration keys from the environment, falling back to
+// values read from a config file and then to files named by KEY_FILE
+type values struct {
+	file map[string]string
+
+	// secretFiles records the keys read from KEY_FILE files and fileErrors
+	// the files that could not be read, if set
+	secretFiles map[string]string
+	fileErrors  map[string]error
+
+	// settings, if set, records the effective value of every key read
+	settings map[string]Setting
+}
+
+func (v values) lookup(key string) (string, bool) {
 	if value, exists := os.LookupEnv(key); exists {
+		return value, true
+	}
+	if value, exists := v.file[key]; exists {
+		return value, true
+	}
+	return v.lookupFile(key)
+}
+
+// lookupFile reads the value of key from the file named by KEY_FILE, the
+// convention of Docker and Kubernetes secrets, without trailing newlines
+func (v values) lookupFile(key string) (string, bool) {
+	path, exists := os.LookupEnv(key + "_FILE")
+	if !exists {
+		path, exists = v.file[key+"_FILE"]
+	}
+	if !exists || path == "" {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if v.fileErrors != nil {
+			v.fileErrors[key] = err
+		}
+		return "", false
+	}
+	if v.secretFiles != nil {
+		v.secretFiles[key] = path
+	}
+	return strings.TrimRight(string(data), "\r\n"), true
+}
+
+// fileError returns an error for the first KEY_FILE that could not be read
+func (v values) fileError() error {
+	keys := make([]string, 0, len(v.fileErrors))
+	for key := range v.fileErrors {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("failed to read %s_FILE: %v", keys[0], v.fileErrors[keys[0]])
+}
+
+func (v values) getStr(key string, defaultVal string) string {
+	if value, exists := v.lookup(key); exists {
+		v.record(key, value, true)
 		return value
 	}
+	v.record(key, defaultVal, false)
 	return defaultVal
 }
 
-func getEnvInt(key string, defaultVal int) int {
-	if value, exists := os.LookupEnv(key); exists {
+func (v values) getInt(key string, defaultVal int) int {
+	if value, exists := v.lookup(key); exists {
 		if intVal, err := strconv.Atoi(value); err == nil {
+			v.record(key, value, true)
 			return intVal
 		}
 	}
+	v.record(key, strconv.Itoa(defaultVal), false)
 	return defaultVal
-} 
\ No newline at end of file
+}
+
+func (v values) getFloat(key string, defaultVal float64) float64 {
+	if value, exists := v.lookup(key); exists {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			v.record(key, value, true)
+			return floatVal
+		}
+	}
+	v.record(key, strconv.FormatFloat(defaultVal, 'g', -1, 64), false)
+	return defaultVal
+}
+
+func (v values) getBool(key string, defaultVal bool) bool {
+	if value, exists := v.lookup(key); exists {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			v.record(key, value, true)
+			return boolVal
+		}
+	}
+	v.record(key, strconv.FormatBool(defaultVal), false)
+	return defaultVal
+}
+
+// readConfigFile parses a config file of KEY=VALUE lines and returns the
+// values of profile. Blank lines and lines starting with # are ignored, an
+// optional "export " prefix is allowed and values may be wrapped in single
+// or double quotes. A [name] or [name : parent] line starts a profile.
+func readConfigFile(path, profile string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	file := make(map[string]string)
+	profiles := make(map[string]*fileProfile)
+	section := file
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			p, err := parseProfileHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+			}
+			if _, exists := profiles[p.name]; exists {
+				return nil, fmt.Errorf("%s:%d: duplicate profile %q", path, i+1, p.name)
+			}
+			profiles[p.name] = p
+			section = p.values
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		section[key] = value
+	}
+
+	return resolveProfile(file, profiles, profile)
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"crypto/tls"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,13 +16,160 @@ func TestLoadConfig(t *testing.T) {
 		"API_PORT",
 		"API_HOST",
 		"API_BASE_PATH",
+		"API_TLS_CERT_PATH",
+		"API_TLS_KEY_PATH",
+		"API_CLIENT_CA_PATH",
+		"API_REQUIRE_CLIENT_CERT",
+		"API_CLIENT_CERT_POLICY",
+		"API_TOKENS_FILE",
+		"TENANTS_FILE",
+		"AUDIT_LOG_PATH",
+		"USAGE_FILE",
+		"USAGE_BUCKET_SECONDS",
+		"USAGE_WEBHOOK_URL",
+		"TRACING_OTLP_ENDPOINT",
+		"TRACING_SERVICE_NAME",
+		"TRACING_SAMPLE_RATIO",
+		"DEBUG_ENABLED",
+		"DEBUG_PORT",
+		"API_RATE_LIMIT_PER_IP",
+		"API_RATE_LIMIT_PER_CALLER",
+		"API_RATE_LIMIT_BURST",
+		"API_CORS_ALLOWED_ORIGINS",
+		"API_CORS_ALLOW_CREDENTIALS",
+		"API_UI_ENABLED",
+		"API_JWT_ISSUER",
+		"API_JWT_AUDIENCE",
+		"API_JWT_JWKS_URL",
+		"API_JWT_HOSTNAMES_CLAIM",
+		"GRPC_PORT",
+		"GRPC_TLS_CERT_PATH",
+		"GRPC_TLS_KEY_PATH",
 		"PUBLIC_PORT",
 		"PUBLIC_HOST",
+		"LB_REUSE_PORT",
+		"LB_ACCEPT_LOOPS",
+		"LB_LISTENERS",
 		"TLS_CERT_PATH",
 		"TLS_KEY_PATH",
+		"TLS_RELOAD_INTERVAL_SECONDS",
+		"TLS_MIN_VERSION",
+		"TLS_CIPHER_SUITES",
+		"TLS_CURVES",
+		"TLS_ALPN",
+		"TLS_OCSP_STAPLING",
+		"TLS_ON_DEMAND",
+		"TLS_ON_DEMAND_EMAIL",
+		"TLS_ON_DEMAND_CACHE_DIR",
+		"TLS_ON_DEMAND_CA_URL",
+		"WG_IMPLEMENTATION",
+		"WG_INTERFACES",
+		"WG_IPV6_PREFIX",
+		"WG_ENDPOINT",
+		"WG_PERSISTENT_KEEPALIVE_SECONDS",
+		"WG_MTU",
+		"WG_HANDSHAKE_TIMEOUT_SECONDS",
+		"WG_DEAD_PEER_TIMEOUT_SECONDS",
+		"WG_PATH_PROBE_INTERVAL_SECONDS",
+		"WG_PATH_PROBE_TIMEOUT_SECONDS",
+		"RECONCILE_INTERVAL_SECONDS",
+		"FIREWALL",
+		"WEBSOCKET_ENABLED",
+		"SSH_PORT",
+		"SSH_HOST_KEY_PATH",
+		"SECRETS_KEYS",
+		"SECRETS_KMS_URL",
+		"SECRETS_KMS_KEY",
+		"SECRETS_KMS_TOKEN",
+		"EXPOSE_PRIVATE_KEYS",
+		"LB_SESSION_AFFINITY",
+		"LB_AFFINITY_COOKIE",
+		"LB_AFFINITY_COOKIE_TTL_SECONDS",
+		"LB_RETRY_ATTEMPTS",
+		"LB_RETRY_BACKOFF_MS",
+		"LB_CIRCUIT_BREAKER_FAILURES",
+		"LB_CIRCUIT_BREAKER_COOLDOWN_SECONDS",
+		"LB_DIAL_TIMEOUT_SECONDS",
+		"LB_RESPONSE_HEADER_TIMEOUT_SECONDS",
+		"LB_MAX_REQUEST_DURATION_SECONDS",
+		"LB_READ_HEADER_TIMEOUT_SECONDS",
+		"LB_READ_TIMEOUT_SECONDS",
+		"LB_WRITE_TIMEOUT_SECONDS",
+		"LB_IDLE_TIMEOUT_SECONDS",
+		"LB_BACKEND_MAX_IDLE_CONNS",
+		"LB_BACKEND_IDLE_CONN_TIMEOUT_SECONDS",
+		"LB_BACKEND_KEEPALIVES",
+		"LB_BACKEND_CA_PATH",
+		"LB_TCP_KEEPALIVE_SECONDS",
+		"LB_TCP_IDLE_TIMEOUT_SECONDS",
+		"LB_ERROR_PAGES_DIR",
+		"LB_DEFAULT_TUNNEL",
+		"TUNNEL_BASE_DOMAIN",
+		"LB_COMPRESSION",
+		"LB_COMPRESSION_MIN_SIZE",
+		"LB_FLUSH_INTERVAL_MS",
+		"LB_CACHE",
+		"LB_CACHE_MAX_BYTES",
+		"LB_CACHE_MAX_OBJECT_BYTES",
+		"LB_CACHE_MAX_TTL_SECONDS",
+		"LB_CACHE_DIR",
+		"LB_EDGE_AUTH_SECRET",
+		"LB_MAX_REQUEST_BODY_BYTES",
+		"LB_MAX_HEADER_BYTES",
+		"GEOIP_DATABASE_PATH",
+		"LB_ROUTES_FILE",
+		"LB_RESTORED_ROUTES_GRACE_SECONDS",
+		"LB_CLIENT_REQUESTS_PER_SECOND",
+		"LB_CLIENT_BURST",
+		"LB_CLIENT_MAX_CONNECTIONS",
+		"TUNNEL_POLICY_MAX_TIMEOUT_SECONDS",
+		"TUNNEL_POLICY_MAX_REQUEST_BODY_BYTES",
+		"TUNNEL_POLICY_MAX_CLIENT_REQUESTS_PER_SECOND",
+		"TUNNEL_POLICY_MAX_CLIENT_CONNECTIONS",
+		"TUNNEL_POLICY_MAX_RETRY_ATTEMPTS",
 		"MAX_TUNNELS",
+		"HEARTBEAT_TIMEOUT_SECONDS",
+		"KUBERNETES_ENABLED",
+		"KUBERNETES_NAMESPACE",
+		"KUBERNETES_GATEWAY_CLASS",
+		"DOCKER_ENABLED",
+		"DOCKER_HOST",
+		"DNS_PROVIDER",
+		"DNS_TARGET",
+		"DNS_ZONE",
+		"DNS_TTL",
+		"CLOUDFLARE_API_TOKEN",
+		"DIGITALOCEAN_TOKEN",
+		"AWS_ACCESS_KEY_ID",
+		"AWS_SECRET_ACCESS_KEY",
+		"AWS_SESSION_TOKEN",
+		"ROUTE53_HOSTED_ZONE_ID",
+		"DISCOVERY_BACKEND",
+		"DISCOVERY_URL",
+		"DISCOVERY_TTL_SECONDS",
+		"DISCOVERY_CONSUL_TOKEN",
+		"DISCOVERY_ETCD_PREFIX",
+		"DISCOVERY_ETCD_USERNAME",
+		"DISCOVERY_ETCD_PASSWORD",
+		"HA_ENABLED",
+		"HA_LOCK",
+		"HA_LOCK_PATH",
+		"HA_LEASE_NAME",
+		"HA_LEASE_NAMESPACE",
+		"HA_IDENTITY",
+		"HA_ADVERTISE_URL",
+		"HA_LEASE_DURATION_SECONDS",
+		"CLUSTER_ENABLED",
+		"CLUSTER_NODE_NAME",
+		"CLUSTER_ADVERTISE_URL",
+		"CLUSTER_PEERS",
+		"CLUSTER_SECRET",
+		"CLUSTER_GOSSIP_INTERVAL_SECONDS",
 		"LOG_LEVEL",
+		"LOG_LEVELS",
 		"SHUTDOWN_TIMEOUT_SECONDS",
+		"DRAIN_DELAY_SECONDS",
+		"DRAIN_TIMEOUT_SECONDS",
 	}
 
 	for _, env := range envVars {
@@ -53,18 +203,129 @@ func TestLoadConfig(t *testing.T) {
 		if config.APIBasePath != "/api" {
 			t.Errorf("Expected default API base path /api, got %s", config.APIBasePath)
 		}
+		if config.GRPCPort != 0 {
+			t.Errorf("Expected the gRPC server to be disabled by default, got port %d", config.GRPCPort)
+		}
 		if config.PublicPort != 443 {
 			t.Errorf("Expected default public port 443, got %d", config.PublicPort)
 		}
 		if config.MaxTunnels != 100 {
 			t.Errorf("Expected default max tunnels 100, got %d", config.MaxTunnels)
 		}
+		if config.HeartbeatTimeout != 90*time.Second {
+			t.Errorf("Expected default heartbeat timeout 90s, got %v", config.HeartbeatTimeout)
+		}
+		if config.WireGuardKeepalive != 25 || config.WireGuardMTU != 0 {
+			t.Errorf("Expected default WireGuard keepalive 25 and MTU 0, got %d and %d", config.WireGuardKeepalive, config.WireGuardMTU)
+		}
+		if config.WireGuardImplementation != "auto" {
+			t.Errorf("Expected default WireGuard implementation auto, got %s", config.WireGuardImplementation)
+		}
+		if config.WebSocketEnabled {
+			t.Error("Expected WebSocket transport disabled by default")
+		}
+		if config.SSHPort != 0 || config.SSHHostKeyPath != "" {
+			t.Errorf("Expected SSH transport disabled by default, got port %d and host key %q", config.SSHPort, config.SSHHostKeyPath)
+		}
+		if config.SecretsKeys != "" || config.SecretsKMSURL != "" || config.ExposePrivateKeys {
+			t.Error("Expected plaintext secrets with private keys redacted by default")
+		}
+		if config.LBSessionAffinity != "none" || config.LBAffinityCookie != "easy_tunnel_affinity" || config.LBAffinityCookieTTL != 0 {
+			t.Errorf("Expected no session affinity by default, got %s with cookie %s for %v", config.LBSessionAffinity, config.LBAffinityCookie, config.LBAffinityCookieTTL)
+		}
+		if len(config.APICORSAllowedOrigins) != 0 || config.APICORSAllowCredentials || len(config.APICORSAllowedMethods) != 5 {
+			t.Errorf("Expected no CORS origins with the default methods by default, got %v with %v", config.APICORSAllowedOrigins, config.APICORSAllowedMethods)
+		}
+		if !config.APIUIEnabled {
+			t.Error("Expected the web dashboard enabled by default")
+		}
+		if config.LBRetryAttempts != 2 || config.LBRetryBackoff != 100*time.Millisecond {
+			t.Errorf("Expected 2 retries with 100ms backoff by default, got %d with %v", config.LBRetryAttempts, config.LBRetryBackoff)
+		}
+		if config.LBCircuitBreakerFailures != 5 || config.LBCircuitBreakerCooldown != 30*time.Second {
+			t.Errorf("Expected circuits opening after 5 failures for 30s by default, got %d for %v", config.LBCircuitBreakerFailures, config.LBCircuitBreakerCooldown)
+		}
+		if config.LBDialTimeout != 10*time.Second || config.LBResponseHeaderTimeout != time.Minute || config.LBMaxRequestDuration != 0 {
+			t.Errorf("Expected 10s dial and 60s response header timeouts by default, got %v, %v and %v", config.LBDialTimeout, config.LBResponseHeaderTimeout, config.LBMaxRequestDuration)
+		}
+		if config.LBReadHeaderTimeout != 10*time.Second || config.LBReadTimeout != 0 || config.LBWriteTimeout != 0 || config.LBIdleTimeout != 120*time.Second {
+			t.Errorf("Expected 10s read header and 120s idle timeouts by default, got %v, %v, %v and %v", config.LBReadHeaderTimeout, config.LBReadTimeout, config.LBWriteTimeout, config.LBIdleTimeout)
+		}
+		if config.LBBackendMaxIdleConns != 32 || config.LBBackendIdleConnTimeout != 90*time.Second || !config.LBBackendKeepAlives || config.LBBackendCAPath != "" {
+			t.Errorf("Expected 32 idle keep-alive connections per tunnel for 90s by default, got %d for %v (keep-alives %v, CA %q)", config.LBBackendMaxIdleConns, config.LBBackendIdleConnTimeout, config.LBBackendKeepAlives, config.LBBackendCAPath)
+		}
+		if config.LBTCPKeepAlive != 15*time.Second || config.LBTCPIdleTimeout != 0 {
+			t.Errorf("Expected 15s TCP keep-alives without idle timeout by default, got %v and %v", config.LBTCPKeepAlive, config.LBTCPIdleTimeout)
+		}
+		if config.LBCompression || config.LBCompressionMinSize != 1024 {
+			t.Errorf("Expected compression off with a 1024 byte minimum by default, got %v and %d", config.LBCompression, config.LBCompressionMinSize)
+		}
+		if config.LBFlushInterval != 0 {
+			t.Errorf("Expected no periodic flushing by default, got %v", config.LBFlushInterval)
+		}
+		if config.LBCache || config.LBCacheMaxBytes != 64<<20 || config.LBCacheMaxObjectBytes != 1<<20 || config.LBCacheMaxTTL != 0 || config.LBCacheDir != "" {
+			t.Errorf("Expected caching off with a 64 MB in-memory cache of up to 1 MB responses by default, got %v, %d, %d, %v and %q", config.LBCache, config.LBCacheMaxBytes, config.LBCacheMaxObjectBytes, config.LBCacheMaxTTL, config.LBCacheDir)
+		}
+		if config.LBMaxRequestBodyBytes != 0 || config.LBMaxHeaderBytes != 1<<20 {
+			t.Errorf("Expected unlimited request bodies and 1 MB of headers by default, got %d and %d", config.LBMaxRequestBodyBytes, config.LBMaxHeaderBytes)
+		}
+		if config.LBClientRequestsPerSecond != 0 || config.LBClientBurst != 0 || config.LBClientMaxConnections != 0 {
+			t.Errorf("Expected no client limits by default, got %d/s, burst %d and %d connections", config.LBClientRequestsPerSecond, config.LBClientBurst, config.LBClientMaxConnections)
+		}
+		if config.TunnelPolicyMaxTimeout != 0 || config.TunnelPolicyMaxRequestBodyBytes != 0 || config.TunnelPolicyMaxRetryAttempts != 0 {
+			t.Errorf("Expected tunnel policies to be unbounded by default, got %v, %d and %d", config.TunnelPolicyMaxTimeout, config.TunnelPolicyMaxRequestBodyBytes, config.TunnelPolicyMaxRetryAttempts)
+		}
+		if config.LBDefaultTunnel != "" {
+			t.Errorf("Expected no default tunnel by default, got %q", config.LBDefaultTunnel)
+		}
+		if config.DiscoveryBackend != "" || config.DiscoveryTTL != 30*time.Second || config.DiscoveryEtcdPrefix != "/services/" {
+			t.Errorf("Expected no service discovery with a 30s TTL by default, got %q, %v and %q", config.DiscoveryBackend, config.DiscoveryTTL, config.DiscoveryEtcdPrefix)
+		}
+		if config.DockerEnabled || config.DockerHost != "unix:///var/run/docker.sock" {
+			t.Errorf("Expected Docker mode disabled with the local socket by default, got %v and %q", config.DockerEnabled, config.DockerHost)
+		}
+		if config.TunnelBaseDomain != "" {
+			t.Errorf("Expected no tunnel base domain by default, got %q", config.TunnelBaseDomain)
+		}
+		if config.LBRoutesFile != "" {
+			t.Errorf("Expected no routes file by default, got %q", config.LBRoutesFile)
+		}
+		if config.LBRestoredRoutesGrace != 5*time.Minute {
+			t.Errorf("Expected default restored routes grace period 5m, got %v", config.LBRestoredRoutesGrace)
+		}
+		if config.UsageFile != "" || config.UsageBucket != time.Hour {
+			t.Errorf("Expected no usage file and hourly buckets by default, got %q and %v", config.UsageFile, config.UsageBucket)
+		}
+		if config.Firewall != "none" {
+			t.Errorf("Expected default firewall none, got %s", config.Firewall)
+		}
+		if config.WireGuardHandshakeTimeout != 180*time.Second || config.WireGuardDeadPeerTimeout != 0 {
+			t.Errorf("Expected default handshake timeout 180s and no dead peer timeout, got %v and %v", config.WireGuardHandshakeTimeout, config.WireGuardDeadPeerTimeout)
+		}
+		if config.WireGuardPathProbeInterval != 0 || config.WireGuardPathProbeTimeout != 2*time.Second {
+			t.Errorf("Expected no path probing and a 2s probe timeout by default, got %v and %v", config.WireGuardPathProbeInterval, config.WireGuardPathProbeTimeout)
+		}
+		if config.ReconcileInterval != time.Minute {
+			t.Errorf("Expected default reconcile interval 1m, got %v", config.ReconcileInterval)
+		}
+		if config.TLSReloadInterval != time.Minute {
+			t.Errorf("Expected default TLS reload interval 1m, got %v", config.TLSReloadInterval)
+		}
+		if config.TLSOnDemand {
+			t.Error("Expected on-demand TLS to be disabled by default")
+		}
+		if policy, err := config.TLSPolicy(); err != nil || policy.MinVersion != tls.VersionTLS12 || len(policy.ALPN) != 2 || policy.OCSPStapling {
+			t.Errorf("Expected a TLS 1.2 policy negotiating h2 and http/1.1 by default, got %+v, %v", policy, err)
+		}
 		if config.LogLevel != "info" {
 			t.Errorf("Expected default log level info, got %s", config.LogLevel)
 		}
 		if config.ShutdownTimeout != 30*time.Second {
 			t.Errorf("Expected default shutdown timeout 30s, got %v", config.ShutdownTimeout)
 		}
+		if config.DrainDelay != 0 || config.DrainTimeout != 30*time.Second {
+			t.Errorf("Expected no drain delay and a 30s drain timeout, got %v and %v", config.DrainDelay, config.DrainTimeout)
+		}
 	})
 
 	// Test custom configuration
@@ -73,11 +334,23 @@ func TestLoadConfig(t *testing.T) {
 			"API_PORT":                 "9090",
 			"API_HOST":                 "127.0.0.1",
 			"API_BASE_PATH":            "/custom",
+			"GRPC_PORT":                "9091",
 			"PUBLIC_PORT":              "8443",
 			"PUBLIC_HOST":              "example.com",
+			"LB_REUSE_PORT":            "true",
+			"LB_ACCEPT_LOOPS":          "4",
+			"LB_LISTENERS":             "private=http://10.0.0.5:8080",
 			"TLS_CERT_PATH":            "/path/to/cert.pem",
 			"TLS_KEY_PATH":             "/path/to/key.pem",
+			"WG_ENDPOINT":              "vpn.example.com:51820",
 			"MAX_TUNNELS":              "50",
+			"HEARTBEAT_TIMEOUT_SECONDS": "45",
+			"KUBERNETES_ENABLED":       "true",
+			"KUBERNETES_NAMESPACE":     "edge",
+			"KUBERNETES_GATEWAY_CLASS": "easy-tunnel-lb",
+			"CLUSTER_ENABLED":          "true",
+			"CLUSTER_ADVERTISE_URL":    "http://10.0.0.1:8080",
+			"CLUSTER_PEERS":            "http://10.0.0.2:8080, http://10.0.0.3:8080,",
 			"LOG_LEVEL":                "debug",
 			"SHUTDOWN_TIMEOUT_SECONDS": "60",
 		}
@@ -102,21 +375,48 @@ func TestLoadConfig(t *testing.T) {
 		if config.APIBasePath != "/custom" {
 			t.Errorf("Expected API base path /custom, got %s", config.APIBasePath)
 		}
+		if config.GRPCPort != 9091 {
+			t.Errorf("Expected gRPC port 9091, got %d", config.GRPCPort)
+		}
 		if config.PublicPort != 8443 {
 			t.Errorf("Expected public port 8443, got %d", config.PublicPort)
 		}
 		if config.PublicHost != "example.com" {
 			t.Errorf("Expected public host example.com, got %s", config.PublicHost)
 		}
+		if !config.LBReusePort || config.LBAcceptLoops != 4 {
+			t.Errorf("Expected SO_REUSEPORT with 4 accept loops, got %v with %d", config.LBReusePort, config.LBAcceptLoops)
+		}
+		if config.LBListeners != "private=http://10.0.0.5:8080" {
+			t.Errorf("Expected the private listener, got %q", config.LBListeners)
+		}
 		if config.TLSCertPath != "/path/to/cert.pem" {
 			t.Errorf("Expected TLS cert path /path/to/cert.pem, got %s", config.TLSCertPath)
 		}
 		if config.TLSKeyPath != "/path/to/key.pem" {
 			t.Errorf("Expected TLS key path /path/to/key.pem, got %s", config.TLSKeyPath)
 		}
+		if config.WireGuardEndpoint != "vpn.example.com:51820" {
+			t.Errorf("Expected WireGuard endpoint vpn.example.com:51820, got %s", config.WireGuardEndpoint)
+		}
 		if config.MaxTunnels != 50 {
 			t.Errorf("Expected max tunnels 50, got %d", config.MaxTunnels)
 		}
+		if config.HeartbeatTimeout != 45*time.Second {
+			t.Errorf("Expected heartbeat timeout 45s, got %v", config.HeartbeatTimeout)
+		}
+		if !config.KubernetesEnabled {
+			t.Error("Expected Kubernetes mode to be enabled")
+		}
+		if config.KubernetesNamespace != "edge" {
+			t.Errorf("Expected Kubernetes namespace edge, got %s", config.KubernetesNamespace)
+		}
+		if !config.ClusterEnabled || len(config.ClusterPeers) != 2 || config.ClusterPeers[1] != "http://10.0.0.3:8080" {
+			t.Errorf("Unexpected cluster peers %v", config.ClusterPeers)
+		}
+		if config.KubernetesGatewayClass != "easy-tunnel-lb" {
+			t.Errorf("Expected Kubernetes gateway class easy-tunnel-lb, got %s", config.KubernetesGatewayClass)
+		}
 		if config.LogLevel != "debug" {
 			t.Errorf("Expected log level debug, got %s", config.LogLevel)
 		}
@@ -163,99 +463,1184 @@ func TestConfigValidation(t *testing.T) {
 			shouldError: true,
 		},
 		{
-			name: "Missing TLS key",
+			name: "Invalid gRPC port",
 			config: &ServerConfig{
 				APIPort:     8080,
+				GRPCPort:    -1,
 				PublicPort:  443,
 				MaxTunnels:  100,
 				LogLevel:    "info",
-				TLSCertPath: "/path/to/cert.pem",
 			},
 			shouldError: true,
 		},
 		{
-			name: "Missing TLS cert",
+			name: "Missing gRPC TLS key",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				GRPCTLSCertPath: "/path/to/cert.pem",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Unknown log module",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				ModuleLogLevels: "proxy=debug",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid module log levels",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				ModuleLogLevels: "wireguard=warn, loadbalancer=debug",
+			},
+			shouldError: false,
+		},
+		{
+			name: "Unknown DNS provider",
 			config: &ServerConfig{
 				APIPort:     8080,
 				PublicPort:  443,
 				MaxTunnels:  100,
 				LogLevel:    "info",
-				TLSKeyPath:  "/path/to/key.pem",
+				DNSProvider: "bind",
+				DNSTarget:   "203.0.113.10",
+				DNSZone:     "example.com",
+				DNSTTL:      300,
 			},
 			shouldError: true,
 		},
 		{
-			name: "Valid TLS configuration",
+			name: "Missing DNS provider credentials",
 			config: &ServerConfig{
 				APIPort:     8080,
 				PublicPort:  443,
 				MaxTunnels:  100,
 				LogLevel:    "info",
-				TLSCertPath: "/path/to/cert.pem",
-				TLSKeyPath:  "/path/to/key.pem",
+				DNSProvider: "route53",
+				DNSTarget:   "203.0.113.10",
+				DNSZone:     "example.com",
+				DNSTTL:      300,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid DNS configuration",
+			config: &ServerConfig{
+				APIPort:            8080,
+				PublicPort:         443,
+				MaxTunnels:         100,
+				LogLevel:           "info",
+				DNSProvider:        "cloudflare",
+				DNSTarget:          "lb.example.net",
+				DNSZone:            "example.com",
+				DNSTTL:             300,
+				CloudflareAPIToken: "token",
 			},
 			shouldError: false,
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			err := tt.config.validate()
-			if tt.shouldError {
-				if err == nil {
-					t.Error("Expected validation error but got none")
-				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected validation error: %v", err)
-				}
-			}
-		})
-	}
-}
-
-func TestGetEnvHelpers(t *testing.T) {
-	// Test getEnvStr
-	t.Run("getEnvStr", func(t *testing.T) {
-		key := "TEST_ENV_STR"
-		defaultVal := "default"
-		customVal := "custom"
-
-		// Test default value
-		if val := getEnvStr(key, defaultVal); val != defaultVal {
-			t.Errorf("Expected default value %s, got %s", defaultVal, val)
-		}
-
-		// Test custom value
-		os.Setenv(key, customVal)
-		if val := getEnvStr(key, defaultVal); val != customVal {
-			t.Errorf("Expected custom value %s, got %s", customVal, val)
-		}
-		os.Unsetenv(key)
-	})
-
-	// Test getEnvInt
-	t.Run("getEnvInt", func(t *testing.T) {
-		key := "TEST_ENV_INT"
-		defaultVal := 123
-		customVal := 456
-
-		// Test default value
-		if val := getEnvInt(key, defaultVal); val != defaultVal {
-			t.Errorf("Expected default value %d, got %d", defaultVal, val)
-		}
-
-		// Test custom value
-		os.Setenv(key, "456")
-		if val := getEnvInt(key, defaultVal); val != customVal {
-			t.Errorf("Expected custom value %d, got %d", customVal, val)
-		}
-
-		// Test invalid value
-		os.Setenv(key, "invalid")
-		if val := getEnvInt(key, defaultVal); val != defaultVal {
-			t.Errorf("Expected default value %d for invalid input, got %d", defaultVal, val)
-		}
-		os.Unsetenv(key)
-	})
-} 
\ No newline at end of file
+		{
+			name: "Route 53 with the default credential chain",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				DNSProvider:         "route53",
+				DNSTarget:           "203.0.113.10",
+				DNSZone:             "example.com",
+				DNSTTL:              300,
+				Route53HostedZoneID: "Z123",
+			},
+			shouldError: false,
+		},
+		{
+			name: "AWS access key without secret",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				DNSProvider:         "route53",
+				DNSTarget:           "203.0.113.10",
+				DNSZone:             "example.com",
+				DNSTTL:              300,
+				AWSAccessKeyID:      "AKID",
+				Route53HostedZoneID: "Z123",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Unknown service discovery backend",
+			config: &ServerConfig{
+				APIPort:          8080,
+				PublicPort:       443,
+				MaxTunnels:       100,
+				LogLevel:         "info",
+				DiscoveryBackend: "zookeeper",
+				DiscoveryTTL:     30 * time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid service discovery URL",
+			config: &ServerConfig{
+				APIPort:          8080,
+				PublicPort:       443,
+				MaxTunnels:       100,
+				LogLevel:         "info",
+				DiscoveryBackend: "consul",
+				DiscoveryURL:     "127.0.0.1:8500",
+				DiscoveryTTL:     30 * time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Service discovery TTL too short",
+			config: &ServerConfig{
+				APIPort:          8080,
+				PublicPort:       443,
+				MaxTunnels:       100,
+				LogLevel:         "info",
+				DiscoveryBackend: "consul",
+				DiscoveryTTL:     time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid etcd service discovery",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				DiscoveryBackend:    "etcd",
+				DiscoveryURL:        "https://etcd.internal:2379",
+				DiscoveryTTL:        30 * time.Second,
+				DiscoveryEtcdPrefix: "/services/",
+			},
+			shouldError: false,
+		},
+		{
+			name: "Unsupported Docker host",
+			config: &ServerConfig{
+				APIPort:       8080,
+				PublicPort:    443,
+				MaxTunnels:    100,
+				LogLevel:      "info",
+				DockerEnabled: true,
+				DockerHost:    "ssh://docker@homelab",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid Docker host",
+			config: &ServerConfig{
+				APIPort:       8080,
+				PublicPort:    443,
+				MaxTunnels:    100,
+				LogLevel:      "info",
+				DockerEnabled: true,
+				DockerHost:    "tcp://127.0.0.1:2375",
+			},
+			shouldError: false,
+		},
+		{
+			name: "HA without advertise URL",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				HAEnabled:       true,
+				HALock:          HALockFile,
+				HALockPath:      "/shared/agent.lease",
+				HAIdentity:      "agent-a",
+				HALeaseDuration: 15 * time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid HA configuration",
+			config: &ServerConfig{
+				APIPort:          8080,
+				PublicPort:       443,
+				MaxTunnels:       100,
+				LogLevel:         "info",
+				HAEnabled:        true,
+				HALock:           HALockKubernetes,
+				HALeaseName:      "easy-tunnel-lb-agent",
+				HALeaseNamespace: "default",
+				HAIdentity:       "agent-a",
+				HAAdvertiseURL:   "http://10.0.0.1:8080",
+				HALeaseDuration:  15 * time.Second,
+			},
+			shouldError: false,
+		},
+		{
+			name: "Clustering with HA",
+			config: &ServerConfig{
+				APIPort:               8080,
+				PublicPort:            443,
+				MaxTunnels:            100,
+				LogLevel:              "info",
+				HAEnabled:             true,
+				HALock:                HALockFile,
+				HALockPath:            "/shared/agent.lease",
+				HAIdentity:            "agent-a",
+				HAAdvertiseURL:        "http://10.0.0.1:8080",
+				HALeaseDuration:       15 * time.Second,
+				ClusterEnabled:        true,
+				ClusterNodeName:       "agent-a",
+				ClusterAdvertiseURL:   "http://10.0.0.1:8080",
+				ClusterGossipInterval: 5 * time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Client CA without API TLS",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				APIClientCAPath: "/path/to/ca.pem",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid client certificate policy",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				APITLSCertPath:      "/path/to/cert.pem",
+				APITLSKeyPath:       "/path/to/key.pem",
+				APIClientCAPath:     "/path/to/ca.pem",
+				APIClientCertPolicy: "operator",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid API mTLS configuration",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				APITLSCertPath:      "/path/to/cert.pem",
+				APITLSKeyPath:       "/path/to/key.pem",
+				APIClientCAPath:     "/path/to/ca.pem",
+				APIClientCertPolicy: "operator=k8s.|gw.",
+			},
+			shouldError: false,
+		},
+		{
+			name: "Rate limit without burst",
+			config: &ServerConfig{
+				APIPort:           8080,
+				PublicPort:        443,
+				MaxTunnels:        100,
+				LogLevel:          "info",
+				APIRateLimitPerIP: 60,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Credentials allowed for any CORS origin",
+			config: &ServerConfig{
+				APIPort:                 8080,
+				PublicPort:              443,
+				MaxTunnels:              100,
+				LogLevel:                "info",
+				APICORSAllowedOrigins:   []string{"*"},
+				APICORSAllowCredentials: true,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid CORS origin",
+			config: &ServerConfig{
+				APIPort:               8080,
+				PublicPort:            443,
+				MaxTunnels:            100,
+				LogLevel:              "info",
+				APICORSAllowedOrigins: []string{"https://dashboard.example.com/app"},
+			},
+			shouldError: true,
+		},
+		{
+			name: "Usage bucket too short",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				UsageFile:   "/var/lib/easy-tunnel/usage.log",
+				UsageBucket: time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Usage webhook without usage file",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				UsageWebhookURL: "https://billing.example.com/usage",
+			},
+			shouldError: true,
+		},
+		{
+			name: "WireGuard MTU too small",
+			config: &ServerConfig{
+				APIPort:      8080,
+				PublicPort:   443,
+				MaxTunnels:   100,
+				LogLevel:     "info",
+				WireGuardMTU: 1000,
+			},
+			shouldError: true,
+		},
+		{
+			name: "WireGuard interface overlapping the default subnet",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				WireGuardInterfaces: "wg1=10.10.128.0/17:51821",
+			},
+			shouldError: true,
+		},
+		{
+			name: "IPv4 network as WireGuard IPv6 prefix",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				WireGuardIPv6Prefix: "10.20.0.0/16",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Dual-stack DNS targets",
+			config: &ServerConfig{
+				APIPort:            8080,
+				PublicPort:         443,
+				MaxTunnels:         100,
+				LogLevel:           "info",
+				DNSProvider:        "cloudflare",
+				DNSTarget:          "203.0.113.10,2001:db8::10",
+				DNSZone:            "example.com",
+				DNSTTL:             300,
+				CloudflareAPIToken: "token",
+			},
+			shouldError: false,
+		},
+		{
+			name: "Unknown WireGuard implementation",
+			config: &ServerConfig{
+				APIPort:                 8080,
+				PublicPort:              443,
+				MaxTunnels:              100,
+				LogLevel:                "info",
+				WireGuardImplementation: "boringtun",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Unknown firewall backend",
+			config: &ServerConfig{
+				APIPort:    8080,
+				PublicPort: 443,
+				MaxTunnels: 100,
+				LogLevel:   "info",
+				Firewall:   "pf",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid SSH port",
+			config: &ServerConfig{
+				APIPort:    8080,
+				PublicPort: 443,
+				MaxTunnels: 100,
+				LogLevel:   "info",
+				SSHPort:    70000,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative drain timeout",
+			config: &ServerConfig{
+				APIPort:      8080,
+				PublicPort:   443,
+				MaxTunnels:   100,
+				LogLevel:     "info",
+				DrainTimeout: -time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid debug port",
+			config: &ServerConfig{
+				APIPort:      8080,
+				PublicPort:   443,
+				MaxTunnels:   100,
+				LogLevel:     "info",
+				DebugEnabled: true,
+				DebugPort:    0,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Unknown session affinity",
+			config: &ServerConfig{
+				APIPort:           8080,
+				PublicPort:        443,
+				MaxTunnels:        100,
+				LogLevel:          "info",
+				LBSessionAffinity: "source_port",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative retry attempts",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				LBRetryAttempts: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Circuit breaker without cooldown",
+			config: &ServerConfig{
+				APIPort:                  8080,
+				PublicPort:               443,
+				MaxTunnels:               100,
+				LogLevel:                 "info",
+				LBCircuitBreakerFailures: 5,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative dial timeout",
+			config: &ServerConfig{
+				APIPort:       8080,
+				PublicPort:    443,
+				MaxTunnels:    100,
+				LogLevel:      "info",
+				LBDialTimeout: -time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative backend idle connections",
+			config: &ServerConfig{
+				APIPort:               8080,
+				PublicPort:            443,
+				MaxTunnels:            100,
+				LogLevel:              "info",
+				LBBackendMaxIdleConns: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative accept loops",
+			config: &ServerConfig{
+				APIPort:       8080,
+				PublicPort:    443,
+				MaxTunnels:    100,
+				LogLevel:      "info",
+				LBAcceptLoops: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid listener",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				LBListeners: "private=sctp://10.0.0.5:8080",
+			},
+			shouldError: true,
+		},
+		{
+			name: "HTTPS listener without certificate",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				LBListeners: "partner=https://192.0.2.10:8443",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative TCP idle timeout",
+			config: &ServerConfig{
+				APIPort:          8080,
+				PublicPort:       443,
+				MaxTunnels:       100,
+				LogLevel:         "info",
+				LBTCPIdleTimeout: -time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative compression minimum size",
+			config: &ServerConfig{
+				APIPort:              8080,
+				PublicPort:           443,
+				MaxTunnels:           100,
+				LogLevel:             "info",
+				LBCompressionMinSize: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid flush interval",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				LBFlushInterval: -2,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative cache size",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				LBCacheMaxBytes: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative max request body size",
+			config: &ServerConfig{
+				APIPort:               8080,
+				PublicPort:            443,
+				MaxTunnels:            100,
+				LogLevel:              "info",
+				LBMaxRequestBodyBytes: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative client max connections",
+			config: &ServerConfig{
+				APIPort:                8080,
+				PublicPort:             443,
+				MaxTunnels:             100,
+				LogLevel:               "info",
+				LBClientMaxConnections: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative tunnel policy maximum",
+			config: &ServerConfig{
+				APIPort:                      8080,
+				PublicPort:                   443,
+				MaxTunnels:                   100,
+				LogLevel:                     "info",
+				TunnelPolicyMaxRetryAttempts: -1,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Dead peer timeout shorter than handshake timeout",
+			config: &ServerConfig{
+				APIPort:                   8080,
+				PublicPort:                443,
+				MaxTunnels:                100,
+				LogLevel:                  "info",
+				WireGuardHandshakeTimeout: 180 * time.Second,
+				WireGuardDeadPeerTimeout:  time.Minute,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Path probe timeout longer than interval",
+			config: &ServerConfig{
+				APIPort:                    8080,
+				PublicPort:                 443,
+				MaxTunnels:                 100,
+				LogLevel:                   "info",
+				WireGuardPathProbeInterval: 5 * time.Second,
+				WireGuardPathProbeTimeout:  10 * time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative TLS reload interval",
+			config: &ServerConfig{
+				APIPort:           8080,
+				PublicPort:        443,
+				MaxTunnels:        100,
+				LogLevel:          "info",
+				TLSReloadInterval: -time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Negative reconcile interval",
+			config: &ServerConfig{
+				APIPort:           8080,
+				PublicPort:        443,
+				MaxTunnels:        100,
+				LogLevel:          "info",
+				ReconcileInterval: -time.Second,
+			},
+			shouldError: true,
+		},
+		{
+			name: "Secrets keys and KMS",
+			config: &ServerConfig{
+				APIPort:       8080,
+				PublicPort:    443,
+				MaxTunnels:    100,
+				LogLevel:      "info",
+				SecretsKeys:   "k1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+				SecretsKMSURL: "https://vault.example.com/v1/transit",
+				SecretsKMSKey: "agent",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Secrets KMS without key",
+			config: &ServerConfig{
+				APIPort:       8080,
+				PublicPort:    443,
+				MaxTunnels:    100,
+				LogLevel:      "info",
+				SecretsKMSURL: "https://vault.example.com/v1/transit",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Invalid secrets key",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				SecretsKeys: "k1:c2hvcnQ=",
+			},
+			shouldError: true,
+		},
+		{
+			name: "JWT issuer without audience",
+			config: &ServerConfig{
+				APIPort:      8080,
+				PublicPort:   443,
+				MaxTunnels:   100,
+				LogLevel:     "info",
+				APIJWTIssuer: "https://idp.example.com",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid JWT configuration",
+			config: &ServerConfig{
+				APIPort:              8080,
+				PublicPort:           443,
+				MaxTunnels:           100,
+				LogLevel:             "info",
+				APIJWTIssuer:         "https://idp.example.com",
+				APIJWTAudience:       "easy-tunnel",
+				APIJWTHostnamesClaim: "tunnel_hostnames",
+			},
+			shouldError: false,
+		},
+		{
+			name: "Missing TLS key",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				TLSCertPath: "/path/to/cert.pem",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Missing TLS cert",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				TLSKeyPath:  "/path/to/key.pem",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Unsupported minimum TLS version",
+			config: &ServerConfig{
+				APIPort:       8080,
+				PublicPort:    443,
+				MaxTunnels:    100,
+				LogLevel:      "info",
+				TLSMinVersion: "1.1",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Insecure TLS cipher suite",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				TLSCipherSuites: "TLS_RSA_WITH_RC4_128_SHA",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Unknown ALPN protocol",
+			config: &ServerConfig{
+				APIPort:    8080,
+				PublicPort: 443,
+				MaxTunnels: 100,
+				LogLevel:   "info",
+				TLSALPN:    "h3",
+			},
+			shouldError: true,
+		},
+		{
+			name: "OCSP stapling without certificate checks",
+			config: &ServerConfig{
+				APIPort:         8080,
+				PublicPort:      443,
+				MaxTunnels:      100,
+				LogLevel:        "info",
+				TLSOCSPStapling: true,
+			},
+			shouldError: true,
+		},
+		{
+			name: "HTTP/3 without TLS",
+			config: &ServerConfig{
+				APIPort:    8080,
+				PublicPort: 443,
+				MaxTunnels: 100,
+				LogLevel:   "info",
+				TLSHTTP3:   true,
+			},
+			shouldError: true,
+		},
+		{
+			name: "On-demand TLS without cache directory",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				TLSOnDemand: true,
+			},
+			shouldError: true,
+		},
+		{
+			name: "On-demand TLS with plain HTTP CA",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				TLSOnDemand:         true,
+				TLSOnDemandCacheDir: "/var/lib/easy-tunnel/acme",
+				TLSOnDemandCAURL:    "http://acme.internal/directory",
+			},
+			shouldError: true,
+		},
+		{
+			name: "HTTP/3 with on-demand TLS",
+			config: &ServerConfig{
+				APIPort:             8080,
+				PublicPort:          443,
+				MaxTunnels:          100,
+				LogLevel:            "info",
+				TLSHTTP3:            true,
+				TLSOnDemand:         true,
+				TLSOnDemandCacheDir: "/var/lib/easy-tunnel/acme",
+			},
+			shouldError: false,
+		},
+		{
+			name: "Invalid tunnel base domain",
+			config: &ServerConfig{
+				APIPort:          8080,
+				PublicPort:       443,
+				MaxTunnels:       100,
+				LogLevel:         "info",
+				TunnelBaseDomain: "*.tunnels_example.com",
+			},
+			shouldError: true,
+		},
+		{
+			name: "Valid TLS configuration",
+			config: &ServerConfig{
+				APIPort:     8080,
+				PublicPort:  443,
+				MaxTunnels:  100,
+				LogLevel:    "info",
+				TLSCertPath: "/path/to/cert.pem",
+				TLSKeyPath:  "/path/to/key.pem",
+			},
+			shouldError: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.shouldError {
+				if err == nil {
+					t.Error("Expected validation error but got none")
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Unexpected validation error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestValueHelpers(t *testing.T) {
+	// Test getStr
+	t.Run("getStr", func(t *testing.T) {
+		env := values{}
+		key := "TEST_ENV_STR"
+		defaultVal := "default"
+		customVal := "custom"
+
+		// Test default value
+		if val := env.getStr(key, defaultVal); val != defaultVal {
+			t.Errorf("Expected default value %s, got %s", defaultVal, val)
+		}
+
+		// Test custom value
+		os.Setenv(key, customVal)
+		if val := env.getStr(key, defaultVal); val != customVal {
+			t.Errorf("Expected custom value %s, got %s", customVal, val)
+		}
+		os.Unsetenv(key)
+	})
+
+	// Test getInt
+	t.Run("getInt", func(t *testing.T) {
+		env := values{}
+		key := "TEST_ENV_INT"
+		defaultVal := 123
+		customVal := 456
+
+		// Test default value
+		if val := env.getInt(key, defaultVal); val != defaultVal {
+			t.Errorf("Expected default value %d, got %d", defaultVal, val)
+		}
+
+		// Test custom value
+		os.Setenv(key, "456")
+		if val := env.getInt(key, defaultVal); val != customVal {
+			t.Errorf("Expected custom value %d, got %d", customVal, val)
+		}
+
+		// Test invalid value
+		os.Setenv(key, "invalid")
+		if val := env.getInt(key, defaultVal); val != defaultVal {
+			t.Errorf("Expected default value %d for invalid input, got %d", defaultVal, val)
+		}
+		os.Unsetenv(key)
+	})
+
+	// Test getBool
+	t.Run("getBool", func(t *testing.T) {
+		env := values{}
+		key := "TEST_ENV_BOOL"
+
+		// Test default value
+		if val := env.getBool(key, false); val {
+			t.Error("Expected default value false, got true")
+		}
+
+		// Test custom value
+		os.Setenv(key, "true")
+		if val := env.getBool(key, false); !val {
+			t.Error("Expected custom value true, got false")
+		}
+
+		// Test invalid value
+		os.Setenv(key, "invalid")
+		if val := env.getBool(key, true); !val {
+			t.Error("Expected default value true for invalid input, got false")
+		}
+		os.Unsetenv(key)
+	})
+} 
+func TestLoadConfigFile(t *testing.T) {
+	for _, env := range []string{"API_PORT", "LOG_LEVEL", "MAX_TUNNELS", "API_HOST"} {
+		if value, exists := os.LookupEnv(env); exists {
+			os.Unsetenv(env)
+			defer os.Setenv(env, value)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "agent.env")
+	content := `# Agent configuration
+API_PORT=9000
+export LOG_LEVEL="debug"
+MAX_TUNNELS = '25'
+
+API_HOST=127.0.0.1
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	// Environment variables override the file
+	os.Setenv("API_HOST", "10.0.0.1")
+	defer os.Unsetenv("API_HOST")
+
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load config file: %v", err)
+	}
+
+	if config.APIPort != 9000 {
+		t.Errorf("Expected API port 9000, got %d", config.APIPort)
+	}
+	if config.LogLevel != "debug" {
+		t.Errorf("Expected log level debug, got %s", config.LogLevel)
+	}
+	if config.MaxTunnels != 25 {
+		t.Errorf("Expected max tunnels 25, got %d", config.MaxTunnels)
+	}
+	if config.APIHost != "10.0.0.1" {
+		t.Errorf("Expected API host from environment 10.0.0.1, got %s", config.APIHost)
+	}
+	// Malformed lines are rejected
+	if err := os.WriteFile(path, []byte("API_PORT\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if _, err := LoadConfigFile(path); err == nil {
+		t.Error("Expected error for malformed config file, got nil")
+	}
+
+	// Missing files are rejected
+	if _, err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Error("Expected error for missing config file, got nil")
+	}
+}
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	for _, env := range []string{"CLUSTER_SECRET", "CLUSTER_SECRET_FILE", "CLOUDFLARE_API_TOKEN", "CLOUDFLARE_API_TOKEN_FILE"} {
+		if value, exists := os.LookupEnv(env); exists {
+			os.Unsetenv(env)
+			defer os.Setenv(env, value)
+		}
+	}
+
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "cluster-secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+	path := filepath.Join(dir, "agent.env")
+	if err := os.WriteFile(path, []byte("CLUSTER_SECRET_FILE="+secret+"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load config file: %v", err)
+	}
+	if config.ClusterSecret != "s3cret" {
+		t.Errorf("Expected the secret read from its file without the newline, got %q", config.ClusterSecret)
+	}
+	if config.SecretFiles["CLUSTER_SECRET"] != secret {
+		t.Errorf("Expected the secret file to be recorded, got %v", config.SecretFiles)
+	}
+
+	// The value itself takes precedence over its file
+	os.Setenv("CLUSTER_SECRET", "direct")
+	defer os.Unsetenv("CLUSTER_SECRET")
+	if config, err := LoadConfigFile(path); err != nil || config.ClusterSecret != "direct" || config.SecretFiles != nil {
+		t.Errorf("Expected the secret from the environment, got %q with %v (%v)", config.ClusterSecret, config.SecretFiles, err)
+	}
+
+	// Files that cannot be read are rejected
+	os.Setenv("CLOUDFLARE_API_TOKEN_FILE", filepath.Join(dir, "missing"))
+	defer os.Unsetenv("CLOUDFLARE_API_TOKEN_FILE")
+	if _, err := LoadConfigFile(path); err == nil || !strings.Contains(err.Error(), "CLOUDFLARE_API_TOKEN_FILE") {
+		t.Errorf("Expected an error naming the missing file, got %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	a := &ServerConfig{APIPort: 8080, LogLevel: "info"}
+	b := &ServerConfig{APIPort: 8080, LogLevel: "info"}
+	if a.Checksum() != b.Checksum() {
+		t.Error("Expected equal configurations to have the same checksum")
+	}
+	b.LogLevel = "debug"
+	if a.Checksum() == b.Checksum() {
+		t.Error("Expected different configurations to have different checksums")
+	}
+}
+
+func TestLoadEffective(t *testing.T) {
+	for _, env := range []string{"API_PORT", "API_HOST", "LOG_LEVEL", "MAX_TUNNELS", "CLUSTER_SECRET", "HA_IDENTITY", "HA_IDENTITY_FILE"} {
+		if value, exists := os.LookupEnv(env); exists {
+			os.Unsetenv(env)
+			defer os.Setenv(env, value)
+		}
+	}
+
+	dir := t.TempDir()
+	identity := filepath.Join(dir, "identity")
+	if err := os.WriteFile(identity, []byte("agent-1\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+	path := filepath.Join(dir, "agent.env")
+	content := "API_PORT=9000\nMAX_TUNNELS=many\nCLUSTER_SECRET=s3cret\nHA_IDENTITY_FILE=" + identity + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	os.Setenv("API_HOST", "127.0.0.1")
+	defer os.Unsetenv("API_HOST")
+
+	config, settings, err := LoadEffective(path, "")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if config.APIPort != 9000 {
+		t.Errorf("Expected API port 9000, got %d", config.APIPort)
+	}
+
+	byKey := make(map[string]Setting)
+	for i, setting := range settings {
+		if i > 0 && settings[i-1].Key >= setting.Key {
+			t.Errorf("Expected settings sorted by key, got %s after %s", setting.Key, settings[i-1].Key)
+		}
+		byKey[setting.Key] = setting
+	}
+	expected := []Setting{
+		{Key: "API_PORT", Value: "9000", Source: SourceFile},
+		{Key: "API_HOST", Value: "127.0.0.1", Source: SourceEnv},
+		{Key: "LOG_LEVEL", Value: "info", Source: SourceDefault},
+		// Values that cannot be parsed fall back to the default
+		{Key: "MAX_TUNNELS", Value: "100", Source: SourceDefault},
+		{Key: "CLUSTER_SECRET", Value: Redacted, Source: SourceFile, Secret: true},
+		{Key: "HA_IDENTITY", Value: Redacted, Source: SourceSecretFile, Secret: true},
+		{Key: "DNS_PROVIDER", Value: "", Source: SourceDefault},
+	}
+	for _, want := range expected {
+		if got := byKey[want.Key]; got != want {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+
+	os.WriteFile(path, []byte("API_PORT=0\n"), 0o600)
+	if _, _, err := LoadEffective(path, ""); err == nil {
+		t.Error("Expected an error for an invalid configuration")
+	}
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	for _, env := range []string{"API_PORT", "LOG_LEVEL", "MAX_TUNNELS", "API_HOST"} {
+		if value, exists := os.LookupEnv(env); exists {
+			os.Unsetenv(env)
+			defer os.Setenv(env, value)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "agent.env")
+	content := `API_PORT=9000
+MAX_TUNNELS=100
+
+[prod]
+LOG_LEVEL=warn
+MAX_TUNNELS=500
+
+# Staging runs as prod, with more logging
+[staging : prod]
+LOG_LEVEL=debug
+
+[dev]
+MAX_TUNNELS=5
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	tests := []struct {
+		profile            string
+		expectedLogLevel   string
+		expectedMaxTunnels int
+	}{
+		{"", "info", 100},
+		{"prod", "warn", 500},
+		{"staging", "debug", 500},
+		{"dev", "info", 5},
+	}
+	for _, tt := range tests {
+		config, err := LoadConfigProfile(path, tt.profile)
+		if err != nil {
+			t.Errorf("Failed to load profile %q: %v", tt.profile, err)
+			continue
+		}
+		if config.APIPort != 9000 || config.LogLevel != tt.expectedLogLevel || config.MaxTunnels != tt.expectedMaxTunnels {
+			t.Errorf("Profile %q: expected port 9000, log level %s and %d tunnels, got %d, %s and %d",
+				tt.profile, tt.expectedLogLevel, tt.expectedMaxTunnels, config.APIPort, config.LogLevel, config.MaxTunnels)
+		}
+	}
+
+	if _, err := LoadConfigProfile(path, "qa"); err == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+
+	invalid := map[string]string{
+		"unknown parent":    "[staging : prod]\n",
+		"cycle":             "[a : b]\n[b : a]\n",
+		"duplicate profile": "[a]\n[a]\n",
+		"invalid header":    "[a b]\n",
+	}
+	for name, content := range invalid {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		profile := "a"
+		if name == "unknown parent" {
+			profile = "staging"
+		}
+		if _, err := LoadConfigProfile(path, profile); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
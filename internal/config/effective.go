@@ -0,0 +1,98 @@
+// Package config provides configuration management for the easy-tunnel-lb-agent.
+package config
+
+import (
+	"os"
+	"sort"
+)
+
+// Sources of effective configuration values
+const (
+	SourceEnv        = "env"
+	SourceFile       = "file"
+	SourceSecretFile = "secret file"
+	SourceDefault    = "default"
+)
+
+// Redacted replaces the values of secrets in the effective configuration
+const Redacted = "<redacted>"
+
+// secretKeys are the keys holding credentials, whose values are never
+// printed. Keys read from KEY_FILE files are treated as secrets too.
+var secretKeys = map[string]bool{
+	"LB_EDGE_AUTH_SECRET":     true,
+	"SECRETS_KEYS":            true,
+	"SECRETS_KMS_TOKEN":       true,
+	"CLOUDFLARE_API_TOKEN":    true,
+	"DIGITALOCEAN_TOKEN":      true,
+	"AWS_SECRET_ACCESS_KEY":   true,
+	"AWS_SESSION_TOKEN":       true,
+	"DISCOVERY_CONSUL_TOKEN":  true,
+	"DISCOVERY_ETCD_PASSWORD": true,
+	"CLUSTER_SECRET":          true,
+}
+
+// Setting is the effective value of a configuration key
+type Setting struct {
+	Key   string
+	Value string
+	// Source is where the value came from: env, file, secret file or
+	// default. Values that could not be parsed fall back to the default.
+	Source string
+	// Secret is set for credentials, whose value is Redacted unless empty
+	Secret bool
+}
+
+// LoadEffective loads and validates the configuration as LoadConfigProfile
+// does, or as LoadConfig does without a path, and returns the effective
+// value of every key sorted by key, with secrets redacted
+func LoadEffective(path, profile string) (*ServerConfig, []Setting, error) {
+	v := values{settings: make(map[string]Setting)}
+	if path != "" {
+		file, err := readConfigFile(path, profile)
+		if err != nil {
+			return nil, nil, err
+		}
+		v.file = file
+	}
+
+	config, err := load(v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settings := make([]Setting, 0, len(v.settings))
+	for _, setting := range v.settings {
+		settings = append(settings, setting)
+	}
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].Key < settings[j].Key
+	})
+	return config, settings, nil
+}
+
+// record sets the effective value of key, if settings are recorded
+func (v values) record(key, value string, found bool) {
+	if v.settings == nil {
+		return
+	}
+
+	setting := Setting{Key: key, Value: value, Source: SourceDefault, Secret: secretKeys[key]}
+	if found {
+		_, inEnv := os.LookupEnv(key)
+		_, inFile := v.file[key]
+		switch {
+		case inEnv:
+			setting.Source = SourceEnv
+		case inFile:
+			setting.Source = SourceFile
+		default:
+			setting.Source = SourceSecretFile
+			setting.Secret = true
+		}
+	}
+	if setting.Secret && setting.Value != "" {
+		setting.Value = Redacted
+	}
+	v.settings[key] = setting
+}
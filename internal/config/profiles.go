@@ -0,0 +1,81 @@
+// Package config provides configuration management for the easy-tunnel-lb-agent.
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// profileName matches the names of config file profiles
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// fileProfile is a named section of a config file
+type fileProfile struct {
+	name string
+	// parent is the profile whose values this one inherits, if set
+	parent string
+	values map[string]string
+}
+
+// parseProfileHeader parses a [name] or [name : parent] line
+func parseProfileHeader(line string) (*fileProfile, error) {
+	if !strings.HasSuffix(line, "]") {
+		return nil, fmt.Errorf("expected [profile] or [profile : parent]")
+	}
+	header := strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+
+	name, parent, inherits := strings.Cut(header, ":")
+	p := &fileProfile{
+		name:   strings.TrimSpace(name),
+		parent: strings.TrimSpace(parent),
+		values: make(map[string]string),
+	}
+	if !profileName.MatchString(p.name) {
+		return nil, fmt.Errorf("invalid profile name %q", p.name)
+	}
+	if inherits && !profileName.MatchString(p.parent) {
+		return nil, fmt.Errorf("invalid parent profile name %q", p.parent)
+	}
+	if p.parent == p.name {
+		return nil, fmt.Errorf("profile %q inherits from itself", p.name)
+	}
+	return p, nil
+}
+
+// resolveProfile returns the values outside profiles overridden by those of
+// profile and its ancestors, the closest profile winning
+func resolveProfile(base map[string]string, profiles map[string]*fileProfile, profile string) (map[string]string, error) {
+	if profile == "" {
+		return base, nil
+	}
+
+	var chain []*fileProfile
+	seen := make(map[string]bool)
+	for name := profile; name != ""; {
+		p, exists := profiles[name]
+		if !exists {
+			if name == profile {
+				return nil, fmt.Errorf("unknown profile %q", name)
+			}
+			return nil, fmt.Errorf("profile %q inherits from unknown profile %q", chain[len(chain)-1].name, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("profile %q inherits from itself through %q", name, chain[len(chain)-1].name)
+		}
+		seen[name] = true
+		chain = append(chain, p)
+		name = p.parent
+	}
+
+	resolved := make(map[string]string, len(base))
+	for key, value := range base {
+		resolved[key] = value
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for key, value := range chain[i].values {
+			resolved[key] = value
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,230 @@
+// Package config provides configuration management for the easy-tunnel-lb-agent.
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// reloadableFields lists the ServerConfig fields that can be applied to a
+// running agent. Changes to any other field require a restart.
+var reloadableFields = map[string]bool{
+	"LogLevel":         true,
+	"ModuleLogLevels":  true,
+	"MaxTunnels":       true,
+	"HeartbeatTimeout": true,
+	"ShutdownTimeout":  true,
+	"DrainDelay":       true,
+	"DrainTimeout":     true,
+	"TLSCertPath":      true,
+	"TLSKeyPath":       true,
+	"ClusterSecret":    true,
+	"SecretsKMSToken":  true,
+}
+
+// Changes lists the fields that differ between two configurations
+type Changes struct {
+	Reloadable      []string
+	RequiresRestart []string
+}
+
+// Empty reports whether no fields changed
+func (c Changes) Empty() bool {
+	return len(c.Reloadable) == 0 && len(c.RequiresRestart) == 0
+}
+
+// Diff compares two configurations field by field
+func Diff(old, updated *ServerConfig) Changes {
+	var changes Changes
+
+	oldVal := reflect.ValueOf(old).Elem()
+	newVal := reflect.ValueOf(updated).Elem()
+	for i := 0; i < oldVal.NumField(); i++ {
+		name := oldVal.Type().Field(i).Name
+		if reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			continue
+		}
+		if reloadableFields[name] {
+			changes.Reloadable = append(changes.Reloadable, name)
+		} else {
+			changes.RequiresRestart = append(changes.RequiresRestart, name)
+		}
+	}
+
+	return changes
+}
+
+// ReloadFunc applies a reloaded configuration to the running agent. It
+// receives the previous configuration and the new effective configuration.
+type ReloadFunc func(old, updated *ServerConfig, changes Changes)
+
+// Watcher reloads the configuration when its file changes or Reload is called
+type Watcher struct {
+	path     string
+	profile  string
+	interval time.Duration
+	onReload ReloadFunc
+	logger   *zerolog.Logger
+
+	mu      sync.RWMutex
+	current *ServerConfig
+	// modTimes are the modification times of the config file and the
+	// secret files when they were last read
+	modTimes map[string]time.Time
+}
+
+// NewWatcher creates a watcher for the given config file. An empty path
+// reloads from environment variables only.
+func NewWatcher(path string, current *ServerConfig, onReload ReloadFunc) *Watcher {
+	w := &Watcher{
+		path:     path,
+		interval: 5 * time.Second,
+		onReload: onReload,
+		logger:   utils.GetLogger(),
+		current:  current,
+	}
+	w.modTimes = w.fileModTimes()
+	return w
+}
+
+// SetProfile sets the profile of the config file to reload, which must be
+// the one current was loaded with
+func (w *Watcher) SetProfile(profile string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.profile = profile
+}
+
+// Current returns the configuration currently in effect
+func (w *Watcher) Current() *ServerConfig {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.current
+}
+
+// Reload re-reads the configuration and applies the fields that can change
+// at runtime. Fields that require a restart keep their current values.
+// If the new configuration is invalid the current one stays in effect.
+func (w *Watcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var loaded *ServerConfig
+	var err error
+	if w.path != "" {
+		loaded, err = LoadConfigProfile(w.path, w.profile)
+	} else {
+		loaded, err = LoadConfig()
+	}
+	if err != nil {
+		w.logger.Error().Err(err).Msg("Failed to reload configuration, keeping current settings")
+		return err
+	}
+
+	changes := Diff(w.current, loaded)
+	if changes.Empty() {
+		w.logger.Debug().Msg("Configuration unchanged")
+		return nil
+	}
+
+	if len(changes.RequiresRestart) > 0 {
+		w.logger.Warn().
+			Strs("fields", changes.RequiresRestart).
+			Msg("Configuration changes require a restart to take effect")
+	}
+
+	if len(changes.Reloadable) > 0 {
+		// Only copy over the fields that can be applied live
+		updated := *w.current
+		updatedVal := reflect.ValueOf(&updated).Elem()
+		loadedVal := reflect.ValueOf(loaded).Elem()
+		for _, name := range changes.Reloadable {
+			updatedVal.FieldByName(name).Set(loadedVal.FieldByName(name))
+		}
+
+		old := w.current
+		w.current = &updated
+		if w.onReload != nil {
+			w.onReload(old, &updated, changes)
+		}
+
+		w.logger.Info().
+			Strs("fields", changes.Reloadable).
+			Msg("Applied configuration changes")
+	}
+
+	return nil
+}
+
+// Start polls the config file and the files secrets are read from for
+// changes until ctx is cancelled
+func (w *Watcher) Start(ctx context.Context) {
+	if len(w.files()) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				changed := w.changedFiles()
+				if len(changed) == 0 {
+					continue
+				}
+				w.logger.Info().
+					Strs("files", changed).
+					Msg("Configuration files changed, reloading")
+				_ = w.Reload()
+			}
+		}
+	}()
+}
+
+// files returns the config file and the files secrets are read from
+func (w *Watcher) files() []string {
+	var files []string
+	if w.path != "" {
+		files = append(files, w.path)
+	}
+	for _, path := range w.Current().SecretFiles {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// changedFiles returns the files modified since they were last read. Files
+// that cannot be read, such as secrets being replaced, count as unchanged.
+func (w *Watcher) changedFiles() []string {
+	var changed []string
+	for path, modTime := range w.fileModTimes() {
+		if !modTime.Equal(w.modTimes[path]) {
+			w.modTimes[path] = modTime
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func (w *Watcher) fileModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range w.files() {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
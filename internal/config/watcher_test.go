@@ -0,0 +1,139 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	old := &ServerConfig{APIPort: 8080, LogLevel: "info", MaxTunnels: 100}
+	updated := &ServerConfig{APIPort: 9090, LogLevel: "debug", MaxTunnels: 100}
+
+	changes := Diff(old, updated)
+
+	if len(changes.Reloadable) != 1 || changes.Reloadable[0] != "LogLevel" {
+		t.Errorf("Expected LogLevel to be reloadable, got %v", changes.Reloadable)
+	}
+	if len(changes.RequiresRestart) != 1 || changes.RequiresRestart[0] != "APIPort" {
+		t.Errorf("Expected APIPort to require a restart, got %v", changes.RequiresRestart)
+	}
+
+	if !Diff(old, old).Empty() {
+		t.Error("Expected no changes comparing a config with itself")
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	for _, env := range []string{"API_PORT", "LOG_LEVEL", "MAX_TUNNELS", "SHUTDOWN_TIMEOUT_SECONDS"} {
+		if value, exists := os.LookupEnv(env); exists {
+			os.Unsetenv(env)
+			defer os.Setenv(env, value)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "agent.env")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+	}
+
+	write("API_PORT=9000\nLOG_LEVEL=info\nMAX_TUNNELS=10\n")
+	initial, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load config file: %v", err)
+	}
+
+	var applied *ServerConfig
+	var appliedChanges Changes
+	watcher := NewWatcher(path, initial, func(old, updated *ServerConfig, changes Changes) {
+		applied = updated
+		appliedChanges = changes
+	})
+
+	write("API_PORT=9001\nLOG_LEVEL=debug\nMAX_TUNNELS=20\nSHUTDOWN_TIMEOUT_SECONDS=5\n")
+	if err := watcher.Reload(); err != nil {
+		t.Fatalf("Unexpected reload error: %v", err)
+	}
+
+	if applied == nil {
+		t.Fatal("Expected reload callback to be called")
+	}
+	if len(appliedChanges.Reloadable) != 3 {
+		t.Errorf("Expected 3 reloadable changes, got %v", appliedChanges.Reloadable)
+	}
+
+	current := watcher.Current()
+	if current.LogLevel != "debug" {
+		t.Errorf("Expected log level debug, got %s", current.LogLevel)
+	}
+	if current.MaxTunnels != 20 {
+		t.Errorf("Expected max tunnels 20, got %d", current.MaxTunnels)
+	}
+	if current.ShutdownTimeout != 5*time.Second {
+		t.Errorf("Expected shutdown timeout 5s, got %v", current.ShutdownTimeout)
+	}
+	if current.APIPort != 9000 {
+		t.Errorf("Expected API port to stay 9000 until restart, got %d", current.APIPort)
+	}
+
+	// Invalid configuration keeps the current settings
+	write("API_PORT=-1\nLOG_LEVEL=warn\n")
+	if err := watcher.Reload(); err == nil {
+		t.Error("Expected error reloading invalid config, got nil")
+	}
+	if watcher.Current().LogLevel != "debug" {
+		t.Errorf("Expected log level to stay debug, got %s", watcher.Current().LogLevel)
+	}
+}
+
+func TestWatcherSecretFiles(t *testing.T) {
+	for _, env := range []string{"CLUSTER_SECRET", "CLUSTER_SECRET_FILE"} {
+		if value, exists := os.LookupEnv(env); exists {
+			os.Unsetenv(env)
+			defer os.Setenv(env, value)
+		}
+	}
+
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "cluster-secret")
+	writeSecret := func(content string, modTime time.Time) {
+		if err := os.WriteFile(secret, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write secret: %v", err)
+		}
+		if err := os.Chtimes(secret, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+	path := filepath.Join(dir, "agent.env")
+	if err := os.WriteFile(path, []byte("CLUSTER_SECRET_FILE="+secret+"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	now := time.Now()
+	writeSecret("old", now.Add(-time.Minute))
+	initial, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load config file: %v", err)
+	}
+	var applied *ServerConfig
+	watcher := NewWatcher(path, initial, func(old, updated *ServerConfig, changes Changes) {
+		applied = updated
+	})
+	if changed := watcher.changedFiles(); len(changed) != 0 {
+		t.Errorf("Expected no changed files, got %v", changed)
+	}
+
+	writeSecret("new", now)
+	if changed := watcher.changedFiles(); len(changed) != 1 || changed[0] != secret {
+		t.Fatalf("Expected the secret file to change, got %v", changed)
+	}
+	if err := watcher.Reload(); err != nil {
+		t.Fatalf("Unexpected reload error: %v", err)
+	}
+	if applied == nil || applied.ClusterSecret != "new" {
+		t.Errorf("Expected the rotated secret to be applied, got %+v", applied)
+	}
+}
@@ -0,0 +1,117 @@
+// Package debug serves runtime diagnostics of the easy-tunnel-lb-agent.
+package debug
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// loopbackHost is the only address the debug server listens on, because
+// profiles and goroutine dumps expose the internals of the process
+const loopbackHost = "127.0.0.1"
+
+// GCStats summarizes the garbage collector and heap of the process
+type GCStats struct {
+	NumGC         int64     `json:"num_gc"`
+	LastGC        time.Time `json:"last_gc"`
+	PauseTotal    float64   `json:"pause_total_seconds"`
+	RecentPauses  []float64 `json:"recent_pauses_seconds"`
+	HeapAlloc     uint64    `json:"heap_alloc_bytes"`
+	HeapInuse     uint64    `json:"heap_inuse_bytes"`
+	HeapObjects   uint64    `json:"heap_objects"`
+	Sys           uint64    `json:"sys_bytes"`
+	NextGC        uint64    `json:"next_gc_bytes"`
+	GCCPUFraction float64   `json:"gc_cpu_fraction"`
+	NumGoroutine  int       `json:"goroutines"`
+	GOMAXPROCS    int       `json:"gomaxprocs"`
+	MemoryLimit   int64     `json:"memory_limit_bytes"`
+}
+
+// NewServer returns a server on the loopback port serving the pprof
+// profiles under /debug/pprof/, GC statistics at /debug/gc and a dump of
+// all goroutine stacks at /debug/goroutines
+func NewServer(port int) *http.Server {
+	return &http.Server{
+		Addr:    net.JoinHostPort(loopbackHost, strconv.Itoa(port)),
+		Handler: NewHandler(),
+	}
+}
+
+// NewHandler returns the handler of the debug endpoints
+func NewHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/gc", handleGC)
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+	return mux
+}
+
+// handleGC returns the GC statistics; POST runs a collection first
+func handleGC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		runtime.GC()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ReadGCStats())
+}
+
+// handleGoroutines writes the stacks of all goroutines as text, in the
+// format of an unrecovered panic
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(buf)
+}
+
+// ReadGCStats returns the current GC statistics
+func ReadGCStats() GCStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	stats := GCStats{
+		NumGC:         gc.NumGC,
+		LastGC:        gc.LastGC,
+		PauseTotal:    gc.PauseTotal.Seconds(),
+		RecentPauses:  []float64{},
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		NextGC:        mem.NextGC,
+		GCCPUFraction: mem.GCCPUFraction,
+		NumGoroutine:  runtime.NumGoroutine(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		MemoryLimit:   debug.SetMemoryLimit(-1),
+	}
+	// The most recent pauses come first
+	for i := 0; i < len(gc.Pause) && i < 10; i++ {
+		stats.RecentPauses = append(stats.RecentPauses, gc.Pause[i].Seconds())
+	}
+	return stats
+}
@@ -0,0 +1,65 @@
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewServerListensOnLoopback(t *testing.T) {
+	server := NewServer(6060)
+	if server.Addr != "127.0.0.1:6060" {
+		t.Errorf("Expected the debug server on 127.0.0.1:6060, got %s", server.Addr)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := NewHandler()
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Profile index", method: http.MethodGet, path: "/debug/pprof/", expectedStatus: http.StatusOK, expectedBody: "goroutine"},
+		{name: "Heap profile", method: http.MethodGet, path: "/debug/pprof/heap?debug=1", expectedStatus: http.StatusOK, expectedBody: "heap profile"},
+		{name: "Goroutine dump", method: http.MethodGet, path: "/debug/goroutines", expectedStatus: http.StatusOK, expectedBody: "goroutine "},
+		{name: "GC stats", method: http.MethodGet, path: "/debug/gc", expectedStatus: http.StatusOK, expectedBody: `"num_gc"`},
+		{name: "Forced GC", method: http.MethodPost, path: "/debug/gc", expectedStatus: http.StatusOK, expectedBody: `"heap_alloc_bytes"`},
+		{name: "Wrong method", method: http.MethodDelete, path: "/debug/gc", expectedStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body containing %q, got %q", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestForcedGCIsCounted(t *testing.T) {
+	before := ReadGCStats().NumGC
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/gc", nil))
+
+	var stats GCStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode GC stats: %v", err)
+	}
+	if stats.NumGC <= before {
+		t.Errorf("Expected more than %d collections, got %d", before, stats.NumGC)
+	}
+	if stats.NumGoroutine == 0 || stats.GOMAXPROCS == 0 {
+		t.Errorf("Expected runtime figures, got %+v", stats)
+	}
+}
@@ -0,0 +1,148 @@
+// Package discovery registers the public endpoints of tunnels with service
+// discovery systems for the easy-tunnel-lb-agent.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// consulAgent is the address of the local Consul agent
+const consulAgent = "http://127.0.0.1:8500"
+
+// ConsulRegistry registers services with the local Consul agent, each with
+// a TTL check reporting the tunnel's health
+type ConsulRegistry struct {
+	baseURL    string
+	token      string
+	ttl        time.Duration
+	httpClient *http.Client
+}
+
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   consulCheck       `json:"Check"`
+}
+
+type consulCheck struct {
+	CheckID string `json:"CheckID"`
+	Name    string `json:"Name"`
+	TTL     string `json:"TTL"`
+	Status  string `json:"Status,omitempty"`
+	Output  string `json:"Output,omitempty"`
+}
+
+// NewConsulRegistry creates a registry for the Consul agent at baseURL,
+// the local agent if empty, authenticating with an ACL token if set
+func NewConsulRegistry(baseURL, token string, ttl time.Duration) *ConsulRegistry {
+	if baseURL == "" {
+		baseURL = consulAgent
+	}
+	return &ConsulRegistry{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		ttl:        ttl,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Register registers the service and sets the status of its check, which
+// turns critical if not set again within the TTL
+func (r *ConsulRegistry) Register(ctx context.Context, service Service) error {
+	status, output := "critical", "Tunnel is not active"
+	if service.Healthy {
+		status, output = "passing", "Tunnel is active"
+	}
+
+	// Labels become key=value tags, as Consul restricts meta keys
+	tags := []string{service.Protocol}
+	keys := make([]string, 0, len(service.Labels))
+	for key := range service.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags = append(tags, key+"="+service.Labels[key])
+	}
+
+	checkID := consulCheckID(service.ID)
+	body := consulService{
+		ID:      service.ID,
+		Name:    service.Name,
+		Address: service.Address,
+		Port:    service.Port,
+		Tags:    tags,
+		Meta: map[string]string{
+			"tunnel_id": service.Name,
+			"protocol":  service.Protocol,
+			"hostnames": strings.Join(service.Hostnames, ","),
+		},
+		Check: consulCheck{
+			CheckID: checkID,
+			Name:    "Tunnel health",
+			TTL:     r.ttl.String(),
+			Status:  status,
+		},
+	}
+	if err := r.do(ctx, "/v1/agent/service/register", body); err != nil {
+		return err
+	}
+
+	// Registering keeps the status of an existing check, so update it
+	return r.do(ctx, "/v1/agent/check/update/"+url.PathEscape(checkID), consulCheck{Status: status, Output: output})
+}
+
+// Deregister removes the service and its check from the agent
+func (r *ConsulRegistry) Deregister(ctx context.Context, serviceID string) error {
+	return r.do(ctx, "/v1/agent/service/deregister/"+url.PathEscape(serviceID), nil)
+}
+
+// consulCheckID returns the ID of a service's TTL check
+func consulCheckID(serviceID string) string {
+	return "service:" + serviceID
+}
+
+func (r *ConsulRegistry) do(ctx context.Context, path string, body interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if r.token != "" {
+		req.Header.Set("X-Consul-Token", r.token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("consul request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("consul API error (%d): %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
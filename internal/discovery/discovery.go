@@ -0,0 +1,290 @@
+// Package discovery registers the public endpoints of tunnels with service
+// discovery systems for the easy-tunnel-lb-agent.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// Supported service registries
+const (
+	BackendConsul = "consul"
+	BackendEtcd   = "etcd"
+)
+
+// serviceIDPrefix starts the IDs of the services the agent registers, so
+// that they do not clash with services registered by others
+const serviceIDPrefix = "easy-tunnel-"
+
+// deregisterTimeout bounds the deregistration of all services when the
+// agent stops serving them
+const deregisterTimeout = 5 * time.Second
+
+// Service is the public endpoint of a tunnel
+type Service struct {
+	// ID identifies the service in the registry and Name is the tunnel ID
+	ID   string
+	Name string
+
+	// Address and Port clients reach the tunnel at: its hostname and the
+	// public port, or the listen port of TCP and UDP tunnels
+	Address string
+	Port    int
+
+	Protocol  string
+	Hostnames []string
+	Labels    map[string]string
+
+	// Healthy is set for active tunnels that are not paused
+	Healthy bool
+}
+
+// Registry registers and deregisters services
+type Registry interface {
+	// Register creates or updates the service and refreshes its health,
+	// which the registry considers failing unless refreshed within its TTL
+	Register(ctx context.Context, service Service) error
+	// Deregister removes the service if the agent registered it
+	Deregister(ctx context.Context, serviceID string) error
+}
+
+// RegistryConfig holds the address and credentials of a registry
+type RegistryConfig struct {
+	Backend string
+	// URL of the Consul agent or etcd server
+	URL string
+	// TTL after which a registry fails or forgets services that are not
+	// refreshed, such as those of a crashed agent
+	TTL time.Duration
+
+	// ConsulToken is the ACL token for Consul
+	ConsulToken string
+
+	// EtcdPrefix starts the keys of services in etcd, and EtcdUsername and
+	// EtcdPassword authenticate to etcd if set
+	EtcdPrefix   string
+	EtcdUsername string
+	EtcdPassword string
+}
+
+// NewRegistry creates the registry selected by config
+func NewRegistry(config RegistryConfig) (Registry, error) {
+	switch config.Backend {
+	case BackendConsul:
+		return NewConsulRegistry(config.URL, config.ConsulToken, config.TTL), nil
+	case BackendEtcd:
+		return NewEtcdRegistry(config.URL, config.EtcdPrefix, config.EtcdUsername, config.EtcdPassword, config.TTL), nil
+	default:
+		return nil, fmt.Errorf("unknown service discovery backend: %s", config.Backend)
+	}
+}
+
+// Manager keeps the services in a registry in sync with the tunnels
+type Manager struct {
+	registry      Registry
+	tunnelManager *tunnel.Manager
+	publicPort    int
+	ttl           time.Duration
+	logger        *zerolog.Logger
+
+	mu         sync.Mutex
+	registered map[string]Service // tunnel ID -> service registered
+	withdrawn  bool
+}
+
+// NewManager creates a manager registering the tunnels' endpoints, HTTP and
+// TLS passthrough tunnels at publicPort, refreshing them well within ttl
+func NewManager(registry Registry, tunnelManager *tunnel.Manager, publicPort int, ttl time.Duration) *Manager {
+	return &Manager{
+		registry:      registry,
+		tunnelManager: tunnelManager,
+		publicPort:    publicPort,
+		ttl:           ttl,
+		logger:        utils.GetLogger(),
+		registered:    make(map[string]Service),
+	}
+}
+
+// Run registers and deregisters services as tunnels come and go until ctx
+// is cancelled, then deregisters all of them
+func (m *Manager) Run(ctx context.Context) {
+	events, cancel := m.tunnelManager.Subscribe(64)
+	defer cancel()
+
+	m.logger.Info().
+		Dur("ttl", m.ttl).
+		Msg("Starting service registration")
+
+	m.sync(ctx)
+
+	// Refreshing three times per TTL survives a failed refresh
+	ticker := time.NewTicker(m.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			deregisterCtx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+			m.deregisterAll(deregisterCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			m.sync(ctx)
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case tunnel.EventTunnelRemoved:
+				m.deregister(ctx, event.TunnelID)
+			case tunnel.EventTunnelCreated, tunnel.EventTunnelDegraded, tunnel.EventTunnelRecovered,
+				tunnel.EventTunnelPaused, tunnel.EventTunnelResumed, tunnel.EventHostnamesChanged:
+				if t, err := m.tunnelManager.GetTunnel(event.TunnelID); err == nil {
+					m.register(ctx, t)
+				}
+			}
+		}
+	}
+}
+
+// NewService returns the service of a tunnel, reachable at port unless it
+// listens on a port of its own
+func NewService(t *tunnel.TunnelInfo, port int) Service {
+	hostnames := t.Hostnames
+	if len(hostnames) == 0 {
+		hostnames = []string{t.Hostname}
+	}
+	protocol := t.Protocol
+	if protocol == "" {
+		protocol = tunnel.ProtocolHTTP
+	}
+	if (protocol == tunnel.ProtocolTCP || protocol == tunnel.ProtocolUDP) && t.ListenPort > 0 {
+		port = t.ListenPort
+	}
+	return Service{
+		ID:        serviceIDPrefix + t.ID,
+		Name:      t.ID,
+		Address:   t.Hostname,
+		Port:      port,
+		Protocol:  protocol,
+		Hostnames: append([]string(nil), hostnames...),
+		Labels:    t.Labels,
+		Healthy:   t.Status == tunnel.StatusActive && !t.Paused,
+	}
+}
+
+// sync registers all current tunnels, which refreshes their health, and
+// deregisters the services of tunnels that are gone
+func (m *Manager) sync(ctx context.Context) {
+	current := make(map[string]bool)
+	for _, t := range m.tunnelManager.GetAllTunnels() {
+		current[t.ID] = true
+		m.register(ctx, t)
+	}
+
+	m.mu.Lock()
+	var stale []string
+	for id := range m.registered {
+		if !current[id] {
+			stale = append(stale, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range stale {
+		m.deregister(ctx, id)
+	}
+}
+
+func (m *Manager) register(ctx context.Context, t *tunnel.TunnelInfo) {
+	m.mu.Lock()
+	withdrawn := m.withdrawn
+	m.mu.Unlock()
+	if withdrawn {
+		return
+	}
+
+	service := NewService(t, m.publicPort)
+	if err := m.registry.Register(ctx, service); err != nil {
+		m.logger.Error().
+			Err(err).
+			Str("tunnel_id", t.ID).
+			Msg("Failed to register service")
+		return
+	}
+
+	m.mu.Lock()
+	previous, existed := m.registered[t.ID]
+	m.registered[t.ID] = service
+	m.mu.Unlock()
+
+	if !existed || previous.Healthy != service.Healthy {
+		m.logger.Info().
+			Str("tunnel_id", t.ID).
+			Str("address", service.Address).
+			Int("port", service.Port).
+			Bool("healthy", service.Healthy).
+			Msg("Registered service")
+	}
+}
+
+func (m *Manager) deregister(ctx context.Context, tunnelID string) {
+	m.mu.Lock()
+	service, exists := m.registered[tunnelID]
+	m.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	if err := m.registry.Deregister(ctx, service.ID); err != nil {
+		m.logger.Error().
+			Err(err).
+			Str("tunnel_id", tunnelID).
+			Msg("Failed to deregister service")
+		return
+	}
+
+	m.mu.Lock()
+	delete(m.registered, tunnelID)
+	m.mu.Unlock()
+
+	m.logger.Info().
+		Str("tunnel_id", tunnelID).
+		Msg("Deregistered service")
+}
+
+// Withdraw deregisters the services of all tunnels and stops registering
+// them, as the agent is shutting down
+func (m *Manager) Withdraw() {
+	m.mu.Lock()
+	m.withdrawn = true
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+	m.deregisterAll(ctx)
+}
+
+// deregisterAll deregisters the services of all tunnels, as the agent stops
+// serving them
+func (m *Manager) deregisterAll(ctx context.Context) {
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.registered))
+	for id := range m.registered {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		m.deregister(ctx, id)
+	}
+}
@@ -0,0 +1,364 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// fakeRegistry records the services it holds by ID
+type fakeRegistry struct {
+	mu       sync.Mutex
+	services map[string]Service
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{services: make(map[string]Service)}
+}
+
+func (r *fakeRegistry) Register(ctx context.Context, service Service) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.services[service.ID] = service
+	return nil
+}
+
+func (r *fakeRegistry) Deregister(ctx context.Context, serviceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.services, serviceID)
+	return nil
+}
+
+func (r *fakeRegistry) get(serviceID string) (Service, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	service, exists := r.services[serviceID]
+	return service, exists
+}
+
+func TestNewService(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	if _, err := tunnelManager.CreateTunnel("web", "web.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	if _, err := tunnelManager.CreateTunnel("db", "db.example.com", 5432, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	if err := tunnelManager.SetProtocol("db", tunnel.ProtocolTCP, 15432); err != nil {
+		t.Fatalf("Failed to set protocol: %v", err)
+	}
+	if err := tunnelManager.SetPaused("db", true); err != nil {
+		t.Fatalf("Failed to pause tunnel: %v", err)
+	}
+
+	web, _ := tunnelManager.GetTunnel("web")
+	service := NewService(web, 443)
+	if service.ID != "easy-tunnel-web" || service.Name != "web" || service.Address != "web.example.com" ||
+		service.Port != 443 || service.Protocol != tunnel.ProtocolHTTP || !service.Healthy {
+		t.Errorf("Unexpected service of an HTTP tunnel: %+v", service)
+	}
+
+	db, _ := tunnelManager.GetTunnel("db")
+	service = NewService(db, 443)
+	if service.Port != 15432 || service.Protocol != tunnel.ProtocolTCP {
+		t.Errorf("Expected the listen port of a TCP tunnel, got %+v", service)
+	}
+	if service.Healthy {
+		t.Error("Expected a paused tunnel to be unhealthy")
+	}
+}
+
+func TestManagerRun(t *testing.T) {
+	registry := newFakeRegistry()
+	tunnelManager := tunnel.NewManager(10)
+	manager := NewManager(registry, tunnelManager, 443, 30*time.Second)
+
+	// Created before Run, so picked up by the initial sync
+	if _, err := tunnelManager.CreateTunnel("app", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(done)
+	}()
+
+	waitFor := func(serviceID string, check func(Service, bool) bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if check(registry.get(serviceID)) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for service %s", serviceID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	registered := func(healthy bool) func(Service, bool) bool {
+		return func(service Service, exists bool) bool { return exists && service.Healthy == healthy }
+	}
+	deregistered := func(service Service, exists bool) bool { return !exists }
+
+	waitFor("easy-tunnel-app", registered(true))
+
+	if _, err := tunnelManager.CreateTunnel("api", "api.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	waitFor("easy-tunnel-api", registered(true))
+
+	if err := tunnelManager.SetPaused("api", true); err != nil {
+		t.Fatalf("Failed to pause tunnel: %v", err)
+	}
+	waitFor("easy-tunnel-api", registered(false))
+	if err := tunnelManager.SetPaused("api", false); err != nil {
+		t.Fatalf("Failed to resume tunnel: %v", err)
+	}
+	waitFor("easy-tunnel-api", registered(true))
+
+	if err := tunnelManager.RemoveTunnel("app"); err != nil {
+		t.Fatalf("Failed to remove test tunnel: %v", err)
+	}
+	waitFor("easy-tunnel-app", deregistered)
+
+	// Shutting down withdraws the services and keeps them withdrawn
+	manager.Withdraw()
+	waitFor("easy-tunnel-api", deregistered)
+	manager.sync(ctx)
+	if _, exists := registry.get("easy-tunnel-api"); exists {
+		t.Error("Expected no services to be registered once withdrawn")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestConsulRegistry(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	var registered consulService
+	var updated consulCheck
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Header.Get("X-Consul-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("ACL not found"))
+			return
+		}
+		switch {
+		case r.URL.Path == "/v1/agent/service/register":
+			json.NewDecoder(r.Body).Decode(&registered)
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+			json.NewDecoder(r.Body).Decode(&updated)
+		}
+	}))
+	defer server.Close()
+
+	registry := NewConsulRegistry(server.URL, "token", 30*time.Second)
+	ctx := context.Background()
+	service := Service{
+		ID:        "easy-tunnel-app",
+		Name:      "app",
+		Address:   "app.example.com",
+		Port:      443,
+		Protocol:  tunnel.ProtocolHTTP,
+		Hostnames: []string{"app.example.com", "www.example.com"},
+		Labels:    map[string]string{"team": "web", "env": "prod"},
+	}
+	if err := registry.Register(ctx, service); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if registered.ID != "easy-tunnel-app" || registered.Address != "app.example.com" || registered.Port != 443 {
+		t.Errorf("Unexpected registration %+v", registered)
+	}
+	if strings.Join(registered.Tags, " ") != "http env=prod team=web" || registered.Meta["hostnames"] != "app.example.com,www.example.com" {
+		t.Errorf("Unexpected tags and meta %v %v", registered.Tags, registered.Meta)
+	}
+	if registered.Check.TTL != "30s" || registered.Check.CheckID != "service:easy-tunnel-app" {
+		t.Errorf("Unexpected check %+v", registered.Check)
+	}
+	if updated.Status != "critical" {
+		t.Errorf("Expected the unhealthy tunnel's check to be critical, got %q", updated.Status)
+	}
+
+	service.Healthy = true
+	if err := registry.Register(ctx, service); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if updated.Status != "passing" {
+		t.Errorf("Expected the healthy tunnel's check to pass, got %q", updated.Status)
+	}
+
+	if err := registry.Deregister(ctx, "easy-tunnel-app"); err != nil {
+		t.Fatalf("Deregister failed: %v", err)
+	}
+	if last := requests[len(requests)-1]; last != "PUT /v1/agent/service/deregister/easy-tunnel-app" {
+		t.Errorf("Expected the service to be deregistered, got %s", last)
+	}
+
+	registry = NewConsulRegistry(server.URL, "wrong", 30*time.Second)
+	if err := registry.Register(ctx, service); err == nil || !strings.Contains(err.Error(), "ACL not found") {
+		t.Errorf("Expected the Consul error, got %v", err)
+	}
+}
+
+// fakeEtcd implements the parts of the etcd v3 JSON API the registry uses
+type fakeEtcd struct {
+	mu            sync.Mutex
+	keys          map[string]string // key -> lease
+	values        map[string][]byte
+	leases        map[string]bool
+	nextLease     int
+	token         string
+	authenticated int
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	var req map[string]json.RawMessage
+	json.Unmarshal(body, &req)
+	str := func(field string) string {
+		var s string
+		json.Unmarshal(req[field], &s)
+		return s
+	}
+	decode := func(s string) string {
+		data, _ := base64.StdEncoding.DecodeString(s)
+		return string(data)
+	}
+
+	if r.URL.Path == "/v3/auth/authenticate" {
+		if str("name") != "agent" || str("password") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"message": "authentication failed, invalid user ID or password"})
+			return
+		}
+		e.authenticated++
+		e.token = "token-" + string(rune('0'+e.authenticated))
+		json.NewEncoder(w).Encode(map[string]string{"token": e.token})
+		return
+	}
+	if r.Header.Get("Authorization") != e.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "invalid auth token"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		e.nextLease++
+		id := string(rune('0' + e.nextLease))
+		e.leases[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id, "TTL": "30"})
+	case "/v3/lease/keepalive":
+		result := map[string]string{"ID": str("ID")}
+		if e.leases[str("ID")] {
+			result["TTL"] = "30"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result})
+	case "/v3/kv/put":
+		key := decode(str("key"))
+		e.keys[key] = str("lease")
+		e.values[key], _ = base64.StdEncoding.DecodeString(str("value"))
+		w.Write([]byte("{}"))
+	case "/v3/kv/txn":
+		var txn struct {
+			Compare []struct{ Key, Lease string }
+		}
+		json.Unmarshal(body, &txn)
+		key := decode(txn.Compare[0].Key)
+		if e.keys[key] == txn.Compare[0].Lease {
+			delete(e.keys, key)
+			delete(e.values, key)
+		}
+		w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// expire expires all leases and deletes their keys, as etcd does
+func (e *fakeEtcd) expire() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leases = make(map[string]bool)
+	e.keys = make(map[string]string)
+	e.values = make(map[string][]byte)
+}
+
+func TestEtcdRegistry(t *testing.T) {
+	etcd := &fakeEtcd{keys: make(map[string]string), values: make(map[string][]byte), leases: make(map[string]bool)}
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	registry := NewEtcdRegistry(server.URL, "/services/", "agent", "secret", 30*time.Second)
+	ctx := context.Background()
+	service := Service{ID: "easy-tunnel-app", Name: "app", Address: "app.example.com", Port: 443, Protocol: "http", Healthy: true}
+	if err := registry.Register(ctx, service); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	var value etcdValue
+	if err := json.Unmarshal(etcd.values["/services/easy-tunnel-app"], &value); err != nil {
+		t.Fatalf("Expected the service stored as JSON, got %v", err)
+	}
+	if value.Address != "app.example.com" || value.Port != 443 || !value.Healthy {
+		t.Errorf("Unexpected stored service %+v", value)
+	}
+	if etcd.keys["/services/easy-tunnel-app"] != "1" {
+		t.Errorf("Expected the key attached to the lease, got lease %q", etcd.keys["/services/easy-tunnel-app"])
+	}
+
+	// An expired lease is replaced, and an expired token renewed
+	etcd.expire()
+	etcd.token = "expired"
+	registry.keptAlive = time.Time{}
+	if err := registry.Register(ctx, service); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if etcd.keys["/services/easy-tunnel-app"] != "2" || etcd.authenticated != 2 {
+		t.Errorf("Expected a new lease and token, got lease %q after %d authentications", etcd.keys["/services/easy-tunnel-app"], etcd.authenticated)
+	}
+
+	// Services registered since by another agent are left alone
+	other := NewEtcdRegistry(server.URL, "/services/", "agent", "secret", 30*time.Second)
+	if err := other.Register(ctx, service); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := registry.Deregister(ctx, "easy-tunnel-app"); err != nil {
+		t.Fatalf("Deregister failed: %v", err)
+	}
+	if _, exists := etcd.keys["/services/easy-tunnel-app"]; !exists {
+		t.Error("Expected the service of another agent to be kept")
+	}
+	if err := other.Deregister(ctx, "easy-tunnel-app"); err != nil {
+		t.Fatalf("Deregister failed: %v", err)
+	}
+	if _, exists := etcd.keys["/services/easy-tunnel-app"]; exists {
+		t.Error("Expected the service to be deleted")
+	}
+
+	wrong := NewEtcdRegistry(server.URL, "/services/", "agent", "wrong", 30*time.Second)
+	if err := wrong.Register(ctx, service); err == nil || !strings.Contains(err.Error(), "invalid user ID or password") {
+		t.Errorf("Expected the authentication error, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+// Package discovery registers the public endpoints of tunnels with service
+// discovery systems for the easy-tunnel-lb-agent.
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etcdServer is the address of a local etcd server
+const etcdServer = "http://127.0.0.1:2379"
+
+// defaultEtcdPrefix starts the keys of services unless configured
+const defaultEtcdPrefix = "/services/"
+
+// EtcdRegistry stores services as JSON values under a key prefix through
+// the etcd v3 JSON API. The keys are attached to a lease the registry keeps
+// alive, so etcd deletes them if the agent stops refreshing them.
+type EtcdRegistry struct {
+	baseURL    string
+	prefix     string
+	username   string
+	password   string
+	ttl        time.Duration
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	token     string
+	leaseID   int64
+	keptAlive time.Time
+}
+
+// etcdValue is the value stored for a service
+type etcdValue struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Address   string            `json:"address"`
+	Port      int               `json:"port"`
+	Protocol  string            `json:"protocol"`
+	Hostnames []string          `json:"hostnames"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Healthy   bool              `json:"healthy"`
+}
+
+// etcdLease is a lease as the JSON API returns it, with int64 values as
+// strings
+type etcdLease struct {
+	ID  string `json:"ID"`
+	TTL string `json:"TTL"`
+}
+
+// etcdAuthError is returned for requests etcd does not authenticate, such
+// as those with an expired token
+type etcdAuthError struct{ message string }
+
+func (e etcdAuthError) Error() string {
+	return "etcd authentication failed: " + e.message
+}
+
+// NewEtcdRegistry creates a registry for the etcd server at baseURL, a
+// local server if empty, storing services under prefix and authenticating
+// as username if set
+func NewEtcdRegistry(baseURL, prefix, username, password string, ttl time.Duration) *EtcdRegistry {
+	if baseURL == "" {
+		baseURL = etcdServer
+	}
+	if prefix == "" {
+		prefix = defaultEtcdPrefix
+	}
+	return &EtcdRegistry{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		prefix:     prefix,
+		username:   username,
+		password:   password,
+		ttl:        ttl,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Register stores the service under the registry's lease, keeping the
+// lease alive
+func (r *EtcdRegistry) Register(ctx context.Context, service Service) error {
+	leaseID, err := r.lease(ctx)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(etcdValue{
+		ID:        service.ID,
+		Name:      service.Name,
+		Address:   service.Address,
+		Port:      service.Port,
+		Protocol:  service.Protocol,
+		Hostnames: service.Hostnames,
+		Labels:    service.Labels,
+		Healthy:   service.Healthy,
+	})
+	if err != nil {
+		return err
+	}
+	return r.do(ctx, "/v3/kv/put", map[string]string{
+		"key":   r.key(service.ID),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": strconv.FormatInt(leaseID, 10),
+	}, nil)
+}
+
+// Deregister deletes the service if it is still attached to the registry's
+// lease, leaving it to another agent that registered it since
+func (r *EtcdRegistry) Deregister(ctx context.Context, serviceID string) error {
+	r.mu.Lock()
+	leaseID := r.leaseID
+	r.mu.Unlock()
+	if leaseID == 0 {
+		return nil
+	}
+
+	key := r.key(serviceID)
+	return r.do(ctx, "/v3/kv/txn", map[string]interface{}{
+		"compare": []map[string]string{{
+			"key":    key,
+			"target": "LEASE",
+			"result": "EQUAL",
+			"lease":  strconv.FormatInt(leaseID, 10),
+		}},
+		"success": []map[string]interface{}{{
+			"request_delete_range": map[string]string{"key": key},
+		}},
+	}, nil)
+}
+
+// key returns the base64 encoded key of a service
+func (r *EtcdRegistry) key(serviceID string) string {
+	return base64.StdEncoding.EncodeToString([]byte(r.prefix + serviceID))
+}
+
+// lease returns the registry's lease, granting one if there is none or it
+// expired and keeping it alive a few times per TTL
+func (r *EtcdRegistry) lease(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	leaseID, keptAlive := r.leaseID, r.keptAlive
+	r.mu.Unlock()
+
+	if leaseID != 0 && time.Since(keptAlive) < r.ttl/3 {
+		return leaseID, nil
+	}
+	now := time.Now()
+	if leaseID != 0 {
+		var resp struct {
+			Result etcdLease `json:"result"`
+		}
+		if err := r.do(ctx, "/v3/lease/keepalive", map[string]string{"ID": strconv.FormatInt(leaseID, 10)}, &resp); err != nil {
+			return 0, err
+		}
+		// An expired lease has no TTL left, and its keys are gone
+		if ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); ttl > 0 {
+			r.setLease(leaseID, now)
+			return leaseID, nil
+		}
+	}
+
+	var granted etcdLease
+	if err := r.do(ctx, "/v3/lease/grant", map[string]int64{"TTL": int64(r.ttl / time.Second)}, &granted); err != nil {
+		return 0, err
+	}
+	leaseID, err := strconv.ParseInt(granted.ID, 10, 64)
+	if err != nil || leaseID == 0 {
+		return 0, fmt.Errorf("invalid etcd lease ID %q", granted.ID)
+	}
+	r.setLease(leaseID, now)
+	return leaseID, nil
+}
+
+func (r *EtcdRegistry) setLease(leaseID int64, keptAlive time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leaseID = leaseID
+	r.keptAlive = keptAlive
+}
+
+// authenticate returns a token for the registry's user, empty without one
+func (r *EtcdRegistry) authenticate(ctx context.Context, renew bool) (string, error) {
+	if r.username == "" {
+		return "", nil
+	}
+	r.mu.Lock()
+	token := r.token
+	r.mu.Unlock()
+	if token != "" && !renew {
+		return token, nil
+	}
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	body := map[string]string{"name": r.username, "password": r.password}
+	if err := r.post(ctx, "/v3/auth/authenticate", "", body, &resp); err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.token = resp.Token
+	r.mu.Unlock()
+	return resp.Token, nil
+}
+
+// do sends a request authenticated as the registry's user, authenticating
+// again once if the token expired
+func (r *EtcdRegistry) do(ctx context.Context, path string, body interface{}, out interface{}) error {
+	token, err := r.authenticate(ctx, false)
+	if err != nil {
+		return err
+	}
+	err = r.post(ctx, path, token, body, out)
+	if _, expired := err.(etcdAuthError); expired && r.username != "" {
+		if token, err = r.authenticate(ctx, true); err != nil {
+			return err
+		}
+		err = r.post(ctx, path, token, body, out)
+	}
+	return err
+}
+
+func (r *EtcdRegistry) post(ctx context.Context, path, token string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("etcd request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&apiErr)
+		if resp.StatusCode == http.StatusUnauthorized {
+			return etcdAuthError{message: apiErr.Message}
+		}
+		return fmt.Errorf("etcd API error (%d): %s", resp.StatusCode, apiErr.Message)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode etcd response: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Package dns manages DNS records for tunnel hostnames for the easy-tunnel-lb-agent.
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare v4 API
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// CloudflareProvider manages records through the Cloudflare API
+type CloudflareProvider struct {
+	baseURL    string
+	token      string
+	zone       string
+	httpClient *http.Client
+
+	mu     sync.Mutex
+	zoneID string
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// NewCloudflareProvider creates a provider for the zone using an API token
+// with DNS edit permission
+func NewCloudflareProvider(token, zone string) *CloudflareProvider {
+	return &CloudflareProvider{
+		baseURL:    cloudflareAPI,
+		token:      token,
+		zone:       zone,
+		httpClient: &http.Client{},
+	}
+}
+
+// UpsertRecord creates the record or updates an existing record of the same name and type
+func (p *CloudflareProvider) UpsertRecord(ctx context.Context, record Record) error {
+	zoneID, err := p.getZoneID(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing, err := p.findRecords(ctx, zoneID, record)
+	if err != nil {
+		return err
+	}
+
+	body := cloudflareRecord{Type: record.Type, Name: record.Name, Content: record.Value, TTL: record.TTL}
+	if len(existing) == 0 {
+		return p.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", body, nil)
+	}
+
+	current := existing[0]
+	if current.Content == record.Value && current.TTL == record.TTL {
+		return nil
+	}
+	return p.do(ctx, http.MethodPut, "/zones/"+zoneID+"/dns_records/"+current.ID, body, nil)
+}
+
+// DeleteRecord deletes the record if it still has the given value
+func (p *CloudflareProvider) DeleteRecord(ctx context.Context, record Record) error {
+	zoneID, err := p.getZoneID(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing, err := p.findRecords(ctx, zoneID, record)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range existing {
+		if r.Content != record.Value {
+			continue
+		}
+		if err := p.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *CloudflareProvider) findRecords(ctx context.Context, zoneID string, record Record) ([]cloudflareRecord, error) {
+	query := url.Values{}
+	query.Set("type", record.Type)
+	query.Set("name", record.Name)
+
+	var records []cloudflareRecord
+	if err := p.do(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// getZoneID looks up and caches the ID of the zone
+func (p *CloudflareProvider) getZoneID(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.zoneID != "" {
+		return p.zoneID, nil
+	}
+
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if err := p.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(p.zone), nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("cloudflare zone %s not found", p.zone)
+	}
+
+	p.zoneID = zones[0].ID
+	return p.zoneID, nil
+}
+
+func (p *CloudflareProvider) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloudflare request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode cloudflare response (%d): %v", resp.StatusCode, err)
+	}
+	if !result.Success {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("cloudflare API error %d: %s", result.Errors[0].Code, result.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare API error (%d)", resp.StatusCode)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(result.Result, out); err != nil {
+			return fmt.Errorf("failed to decode cloudflare result: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Package dns manages DNS records for tunnel hostnames for the easy-tunnel-lb-agent.
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// digitalOceanAPI is the base URL of the DigitalOcean v2 API
+const digitalOceanAPI = "https://api.digitalocean.com/v2"
+
+// DigitalOceanProvider manages records through the DigitalOcean Domains API
+type DigitalOceanProvider struct {
+	baseURL    string
+	token      string
+	domain     string
+	httpClient *http.Client
+}
+
+type digitalOceanRecord struct {
+	ID   int    `json:"id,omitempty"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Data string `json:"data"`
+	TTL  int    `json:"ttl"`
+}
+
+// NewDigitalOceanProvider creates a provider for the domain using a personal
+// access token with write scope
+func NewDigitalOceanProvider(token, domain string) *DigitalOceanProvider {
+	return &DigitalOceanProvider{
+		baseURL:    digitalOceanAPI,
+		token:      token,
+		domain:     strings.TrimSuffix(domain, "."),
+		httpClient: &http.Client{},
+	}
+}
+
+// UpsertRecord creates the record or updates an existing record of the same name and type
+func (p *DigitalOceanProvider) UpsertRecord(ctx context.Context, record Record) error {
+	existing, err := p.findRecords(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	body := digitalOceanRecord{
+		Type: record.Type,
+		Name: p.relativeName(record.Name),
+		Data: p.data(record),
+		TTL:  record.TTL,
+	}
+	if len(existing) == 0 {
+		return p.do(ctx, http.MethodPost, p.recordsPath(), body, nil)
+	}
+
+	current := existing[0]
+	if current.Data == body.Data && current.TTL == body.TTL {
+		return nil
+	}
+	return p.do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", p.recordsPath(), current.ID), body, nil)
+}
+
+// DeleteRecord deletes the record if it still has the given value
+func (p *DigitalOceanProvider) DeleteRecord(ctx context.Context, record Record) error {
+	existing, err := p.findRecords(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	data := p.data(record)
+	for _, r := range existing {
+		if r.Data != data {
+			continue
+		}
+		if err := p.do(ctx, http.MethodDelete, fmt.Sprintf("%s/%d", p.recordsPath(), r.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *DigitalOceanProvider) findRecords(ctx context.Context, record Record) ([]digitalOceanRecord, error) {
+	query := url.Values{}
+	query.Set("type", record.Type)
+	query.Set("name", strings.TrimSuffix(record.Name, "."))
+
+	var resp struct {
+		DomainRecords []digitalOceanRecord `json:"domain_records"`
+	}
+	if err := p.do(ctx, http.MethodGet, p.recordsPath()+"?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.DomainRecords, nil
+}
+
+func (p *DigitalOceanProvider) recordsPath() string {
+	return "/domains/" + url.PathEscape(p.domain) + "/records"
+}
+
+// relativeName returns the record name relative to the domain, as the API
+// expects when creating records ("@" is the domain apex)
+func (p *DigitalOceanProvider) relativeName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if name == p.domain {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+p.domain)
+}
+
+// data returns the record value as stored by DigitalOcean, which keeps a
+// trailing dot on CNAME targets
+func (p *DigitalOceanProvider) data(record Record) string {
+	if record.Type == "CNAME" && !strings.HasSuffix(record.Value, ".") {
+		return record.Value + "."
+	}
+	return record.Value
+}
+
+func (p *DigitalOceanProvider) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("digitalocean request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("digitalocean API error (%d): %s", resp.StatusCode, apiErr.Message)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode digitalocean response: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+// Package dns manages DNS records for tunnel hostnames for the easy-tunnel-lb-agent.
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// Supported DNS providers
+const (
+	ProviderCloudflare   = "cloudflare"
+	ProviderRoute53      = "route53"
+	ProviderDigitalOcean = "digitalocean"
+)
+
+// resyncInterval is how often all records are reconciled, catching up on
+// events dropped while a provider call was slow
+const resyncInterval = 5 * time.Minute
+
+// States of the records of a hostname
+const (
+	// RecordCreated records point the hostname at the agent
+	RecordCreated = "created"
+	// RecordPending records are yet to be created
+	RecordPending = "pending"
+	// RecordFailed records could not be created and are retried with the
+	// next resync
+	RecordFailed = "failed"
+	// RecordUnmanaged hostnames are outside the zone, so their records are
+	// left to the user
+	RecordUnmanaged = "unmanaged"
+)
+
+// Record is a DNS record pointing a tunnel hostname at the agent
+type Record struct {
+	Name  string
+	Type  string
+	Value string
+	TTL   int
+}
+
+// Provider creates and deletes DNS records
+type Provider interface {
+	// UpsertRecord creates the record or updates an existing record of the
+	// same name and type
+	UpsertRecord(ctx context.Context, record Record) error
+	// DeleteRecord deletes the record if it still has the given value.
+	// Records changed to point elsewhere are left alone.
+	DeleteRecord(ctx context.Context, record Record) error
+}
+
+// ProviderConfig holds the settings and credentials of a DNS provider
+type ProviderConfig struct {
+	Provider string
+	Zone     string
+
+	CloudflareAPIToken string
+	DigitalOceanToken  string
+
+	AWSAccessKeyID      string
+	AWSSecretAccessKey  string
+	AWSSessionToken     string
+	Route53HostedZoneID string
+}
+
+// NewProvider creates the provider selected by config
+func NewProvider(config ProviderConfig) (Provider, error) {
+	switch config.Provider {
+	case ProviderCloudflare:
+		return NewCloudflareProvider(config.CloudflareAPIToken, config.Zone), nil
+	case ProviderDigitalOcean:
+		return NewDigitalOceanProvider(config.DigitalOceanToken, config.Zone), nil
+	case ProviderRoute53:
+		return NewRoute53Provider(config.AWSAccessKeyID, config.AWSSecretAccessKey, config.AWSSessionToken, config.Route53HostedZoneID)
+	default:
+		return nil, fmt.Errorf("unknown DNS provider: %s", config.Provider)
+	}
+}
+
+// NewRecord returns the record pointing hostname at target: an A or AAAA
+// record if target is an IP address, otherwise a CNAME record
+func NewRecord(hostname, target string, ttl int) Record {
+	record := Record{Name: hostname, Type: "CNAME", Value: target, TTL: ttl}
+	if ip := net.ParseIP(target); ip != nil {
+		record.Type = "AAAA"
+		if ip.To4() != nil {
+			record.Type = "A"
+		}
+	}
+	return record
+}
+
+// NewRecords returns the records pointing hostname at a comma-separated
+// list of targets, e.g. an IPv4 and an IPv6 address for a dual-stack agent
+func NewRecords(hostname, targets string, ttl int) []Record {
+	var records []Record
+	for _, target := range strings.Split(targets, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			records = append(records, NewRecord(hostname, target, ttl))
+		}
+	}
+	return records
+}
+
+// ValidateTargets checks a comma-separated list of record targets: at most
+// one IPv4 and one IPv6 address, or a single hostname, as providers keep one
+// record per name and type and CNAME records cannot be combined with others
+func ValidateTargets(targets string) error {
+	types := make(map[string]bool)
+	records := NewRecords("", targets, 0)
+	if len(records) == 0 {
+		return fmt.Errorf("no DNS target")
+	}
+	for _, record := range records {
+		if types[record.Type] {
+			return fmt.Errorf("more than one %s target", record.Type)
+		}
+		types[record.Type] = true
+	}
+	if types["CNAME"] && len(records) > 1 {
+		return fmt.Errorf("a hostname target cannot be combined with other targets")
+	}
+	return nil
+}
+
+// InZone reports whether hostname is the zone apex or a name within the zone
+func InZone(hostname, zone string) bool {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	zone = strings.TrimSuffix(strings.ToLower(zone), ".")
+	return hostname == zone || strings.HasSuffix(hostname, "."+zone)
+}
+
+// Manager keeps DNS records in sync with the tunnels' hostnames
+type Manager struct {
+	provider      Provider
+	tunnelManager *tunnel.Manager
+	target        string
+	zone          string
+	ttl           int
+	logger        *zerolog.Logger
+
+	mu      sync.Mutex
+	managed map[string][]Record // hostname -> records created by the manager
+	failed  map[string]error    // hostname -> why creating a record failed
+}
+
+// RecordState is the state of the records of a hostname
+type RecordState struct {
+	State string
+	// Records are the records created for the hostname
+	Records []Record
+	// Error is why creating a record failed, if it did
+	Error error
+}
+
+// NewManager creates a DNS manager pointing tunnel hostnames within zone at
+// target, which may list an IPv4 and an IPv6 address separated by a comma
+func NewManager(provider Provider, tunnelManager *tunnel.Manager, target, zone string, ttl int) *Manager {
+	return &Manager{
+		provider:      provider,
+		tunnelManager: tunnelManager,
+		target:        target,
+		zone:          zone,
+		ttl:           ttl,
+		logger:        utils.GetLogger(),
+		managed:       make(map[string][]Record),
+		failed:        make(map[string]error),
+	}
+}
+
+// RecordState returns the state of the records of hostname
+func (m *Manager) RecordState(hostname string) RecordState {
+	if !InZone(hostname, m.zone) {
+		return RecordState{State: RecordUnmanaged}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := RecordState{State: RecordPending, Records: m.managed[hostname], Error: m.failed[hostname]}
+	switch {
+	case state.Error != nil:
+		state.State = RecordFailed
+	case len(state.Records) > 0:
+		state.State = RecordCreated
+	}
+	return state
+}
+
+// Run creates and deletes records as tunnels come and go until ctx is cancelled
+func (m *Manager) Run(ctx context.Context) {
+	events, cancel := m.tunnelManager.Subscribe(64)
+	defer cancel()
+
+	m.logger.Info().
+		Str("zone", m.zone).
+		Str("target", m.target).
+		Msg("Starting DNS record management")
+
+	m.sync(ctx)
+
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.sync(ctx)
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case tunnel.EventTunnelCreated:
+				for _, hostname := range eventHostnames(event) {
+					m.ensure(ctx, hostname)
+				}
+			case tunnel.EventTunnelRemoved:
+				for _, hostname := range eventHostnames(event) {
+					if !m.hostnameInUse(hostname) {
+						m.remove(ctx, hostname)
+					}
+				}
+			case tunnel.EventHostnamesChanged:
+				m.sync(ctx)
+			}
+		}
+	}
+}
+
+// eventHostnames returns the hostnames of the tunnel an event is about
+func eventHostnames(event tunnel.Event) []string {
+	if len(event.Hostnames) > 0 {
+		return event.Hostnames
+	}
+	return []string{event.Hostname}
+}
+
+// sync creates records for all current tunnels and deletes records for
+// hostnames no tunnel uses anymore
+func (m *Manager) sync(ctx context.Context) {
+	inUse := make(map[string]bool)
+	for _, t := range m.tunnelManager.GetAllTunnels() {
+		for _, hostname := range tunnelHostnames(t) {
+			inUse[hostname] = true
+			m.ensure(ctx, hostname)
+		}
+	}
+
+	m.mu.Lock()
+	var stale []string
+	for hostname := range m.managed {
+		if !inUse[hostname] {
+			stale = append(stale, hostname)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, hostname := range stale {
+		m.remove(ctx, hostname)
+	}
+}
+
+func (m *Manager) ensure(ctx context.Context, hostname string) {
+	if hostname == "" || !InZone(hostname, m.zone) {
+		return
+	}
+
+	m.mu.Lock()
+	existing := m.managed[hostname]
+	m.mu.Unlock()
+
+	var created []Record
+	var failed error
+	for _, record := range NewRecords(hostname, m.target, m.ttl) {
+		if containsRecord(existing, record) {
+			created = append(created, record)
+			continue
+		}
+		if err := m.provider.UpsertRecord(ctx, record); err != nil {
+			failed = err
+			m.logger.Error().
+				Err(err).
+				Str("hostname", hostname).
+				Str("type", record.Type).
+				Msg("Failed to create DNS record")
+			continue
+		}
+		created = append(created, record)
+
+		m.logger.Info().
+			Str("hostname", hostname).
+			Str("type", record.Type).
+			Str("value", record.Value).
+			Msg("Created DNS record")
+	}
+
+	m.mu.Lock()
+	if len(created) > 0 {
+		m.managed[hostname] = created
+	}
+	if failed != nil {
+		m.failed[hostname] = failed
+	} else {
+		delete(m.failed, hostname)
+	}
+	m.mu.Unlock()
+}
+
+func (m *Manager) remove(ctx context.Context, hostname string) {
+	m.mu.Lock()
+	records, exists := m.managed[hostname]
+	delete(m.failed, hostname)
+	m.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	var kept []Record
+	for _, record := range records {
+		if err := m.provider.DeleteRecord(ctx, record); err != nil {
+			m.logger.Error().
+				Err(err).
+				Str("hostname", hostname).
+				Str("type", record.Type).
+				Msg("Failed to delete DNS record")
+			kept = append(kept, record)
+		}
+	}
+
+	m.mu.Lock()
+	if len(kept) > 0 {
+		m.managed[hostname] = kept
+	} else {
+		delete(m.managed, hostname)
+	}
+	m.mu.Unlock()
+
+	if len(kept) == 0 {
+		m.logger.Info().
+			Str("hostname", hostname).
+			Msg("Deleted DNS records")
+	}
+}
+
+func containsRecord(records []Record, record Record) bool {
+	for _, r := range records {
+		if r == record {
+			return true
+		}
+	}
+	return false
+}
+
+// hostnameInUse reports whether another tunnel still uses the hostname
+func (m *Manager) hostnameInUse(hostname string) bool {
+	for _, t := range m.tunnelManager.GetAllTunnels() {
+		for _, h := range tunnelHostnames(t) {
+			if h == hostname {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnelHostnames returns all hostnames of a tunnel
+func tunnelHostnames(t *tunnel.TunnelInfo) []string {
+	if len(t.Hostnames) > 0 {
+		return t.Hostnames
+	}
+	return []string{t.Hostname}
+}
@@ -0,0 +1,484 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// fakeProvider records the records it holds by name and type, failing
+// upserts with upsertErr if set
+type fakeProvider struct {
+	mu        sync.Mutex
+	records   map[string]Record
+	upsertErr error
+}
+
+func recordKey(name, recordType string) string {
+	return name + " " + recordType
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{records: make(map[string]Record)}
+}
+
+func (p *fakeProvider) UpsertRecord(ctx context.Context, record Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.upsertErr != nil {
+		return p.upsertErr
+	}
+	p.records[recordKey(record.Name, record.Type)] = record
+	return nil
+}
+
+func (p *fakeProvider) DeleteRecord(ctx context.Context, record Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := recordKey(record.Name, record.Type)
+	if p.records[key].Value == record.Value {
+		delete(p.records, key)
+	}
+	return nil
+}
+
+func (p *fakeProvider) get(name string) (Record, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, record := range p.records {
+		if record.Name == name {
+			return record, true
+		}
+	}
+	return Record{}, false
+}
+
+func (p *fakeProvider) getType(name, recordType string) (Record, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	record, exists := p.records[recordKey(name, recordType)]
+	return record, exists
+}
+
+func TestNewRecord(t *testing.T) {
+	tests := []struct {
+		name         string
+		target       string
+		expectedType string
+	}{
+		{name: "IPv4 target", target: "203.0.113.10", expectedType: "A"},
+		{name: "IPv6 target", target: "2001:db8::10", expectedType: "AAAA"},
+		{name: "Hostname target", target: "lb.example.net", expectedType: "CNAME"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := NewRecord("app.example.com", tt.target, 300)
+			if record.Type != tt.expectedType {
+				t.Errorf("Expected type %s, got %s", tt.expectedType, record.Type)
+			}
+			if record.Value != tt.target || record.TTL != 300 {
+				t.Errorf("Unexpected record %+v", record)
+			}
+		})
+	}
+}
+
+func TestValidateTargets(t *testing.T) {
+	tests := []struct {
+		targets string
+		wantErr bool
+	}{
+		{targets: "203.0.113.10", wantErr: false},
+		{targets: "203.0.113.10, 2001:db8::10", wantErr: false},
+		{targets: "lb.example.net", wantErr: false},
+		{targets: "", wantErr: true},
+		{targets: "203.0.113.10,203.0.113.11", wantErr: true},
+		{targets: "lb.example.net,2001:db8::10", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateTargets(tt.targets); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateTargets(%q): expected error %v, got %v", tt.targets, tt.wantErr, err)
+		}
+	}
+}
+
+func TestManagerDualStack(t *testing.T) {
+	provider := newFakeProvider()
+	tunnelManager := tunnel.NewManager(10)
+	manager := NewManager(provider, tunnelManager, "203.0.113.10,2001:db8::10", "example.com", 300)
+
+	if _, err := tunnelManager.CreateTunnel("app", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	manager.sync(context.Background())
+
+	if record, exists := provider.getType("app.example.com", "A"); !exists || record.Value != "203.0.113.10" {
+		t.Errorf("Expected A record, got %+v", record)
+	}
+	if record, exists := provider.getType("app.example.com", "AAAA"); !exists || record.Value != "2001:db8::10" {
+		t.Errorf("Expected AAAA record, got %+v", record)
+	}
+
+	if err := tunnelManager.RemoveTunnel("app"); err != nil {
+		t.Fatalf("Failed to remove test tunnel: %v", err)
+	}
+	manager.sync(context.Background())
+
+	if _, exists := provider.get("app.example.com"); exists {
+		t.Error("Expected records of removed tunnel to be deleted")
+	}
+}
+
+func TestInZone(t *testing.T) {
+	tests := []struct {
+		hostname string
+		zone     string
+		expected bool
+	}{
+		{hostname: "app.example.com", zone: "example.com", expected: true},
+		{hostname: "example.com", zone: "example.com.", expected: true},
+		{hostname: "App.Example.com", zone: "example.com", expected: true},
+		{hostname: "app.notexample.com", zone: "example.com", expected: false},
+		{hostname: "app.example.org", zone: "example.com", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			if got := InZone(tt.hostname, tt.zone); got != tt.expected {
+				t.Errorf("InZone(%s, %s) = %v, expected %v", tt.hostname, tt.zone, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestManagerSync(t *testing.T) {
+	provider := newFakeProvider()
+	tunnelManager := tunnel.NewManager(10)
+	manager := NewManager(provider, tunnelManager, "203.0.113.10", "example.com", 300)
+
+	for id, hostname := range map[string]string{
+		"app":   "app.example.com",
+		"api":   "api.example.com",
+		"other": "app.example.org",
+	} {
+		if _, err := tunnelManager.CreateTunnel(id, hostname, 8080, "", nil); err != nil {
+			t.Fatalf("Failed to create test tunnel: %v", err)
+		}
+	}
+
+	manager.sync(context.Background())
+
+	for _, hostname := range []string{"app.example.com", "api.example.com"} {
+		record, exists := provider.get(hostname)
+		if !exists {
+			t.Fatalf("Expected record for %s", hostname)
+		}
+		if record.Type != "A" || record.Value != "203.0.113.10" {
+			t.Errorf("Unexpected record %+v", record)
+		}
+	}
+	if _, exists := provider.get("app.example.org"); exists {
+		t.Error("Expected no record outside the zone")
+	}
+
+	if err := tunnelManager.RemoveTunnel("api"); err != nil {
+		t.Fatalf("Failed to remove test tunnel: %v", err)
+	}
+	manager.sync(context.Background())
+
+	if _, exists := provider.get("api.example.com"); exists {
+		t.Error("Expected record of removed tunnel to be deleted")
+	}
+	if _, exists := provider.get("app.example.com"); !exists {
+		t.Error("Expected record of remaining tunnel to be kept")
+	}
+}
+
+func TestManagerRecordState(t *testing.T) {
+	provider := newFakeProvider()
+	tunnelManager := tunnel.NewManager(10)
+	manager := NewManager(provider, tunnelManager, "203.0.113.10", "example.com", 300)
+	ctx := context.Background()
+
+	if state := manager.RecordState("app.example.org"); state.State != RecordUnmanaged {
+		t.Errorf("Expected hostname outside the zone to be unmanaged, got %s", state.State)
+	}
+	if state := manager.RecordState("app.example.com"); state.State != RecordPending {
+		t.Errorf("Expected record not created yet to be pending, got %s", state.State)
+	}
+
+	provider.upsertErr = errors.New("rate limited")
+	manager.ensure(ctx, "app.example.com")
+	if state := manager.RecordState("app.example.com"); state.State != RecordFailed || state.Error == nil {
+		t.Errorf("Expected failed record, got %+v", state)
+	}
+
+	provider.upsertErr = nil
+	manager.ensure(ctx, "app.example.com")
+	state := manager.RecordState("app.example.com")
+	if state.State != RecordCreated || state.Error != nil || len(state.Records) != 1 || state.Records[0].Value != "203.0.113.10" {
+		t.Errorf("Expected created record, got %+v", state)
+	}
+
+	manager.remove(ctx, "app.example.com")
+	if state := manager.RecordState("app.example.com"); state.State != RecordPending {
+		t.Errorf("Expected removed record to be pending, got %s", state.State)
+	}
+}
+
+func TestManagerRun(t *testing.T) {
+	provider := newFakeProvider()
+	tunnelManager := tunnel.NewManager(10)
+	manager := NewManager(provider, tunnelManager, "lb.example.net", "example.com", 60)
+
+	// Created before Run, so picked up by the initial sync
+	if _, err := tunnelManager.CreateTunnel("app", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(done)
+	}()
+
+	waitFor := func(hostname string, exists bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			record, found := provider.get(hostname)
+			if found == exists && (!found || record.Type == "CNAME") {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for record %s (exists=%v)", hostname, exists)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("app.example.com", true)
+
+	if _, err := tunnelManager.CreateTunnel("api", "api.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	waitFor("api.example.com", true)
+
+	if err := tunnelManager.AddHostname("api", "www.example.com"); err != nil {
+		t.Fatalf("Failed to add hostname: %v", err)
+	}
+	waitFor("www.example.com", true)
+	if err := tunnelManager.RemoveHostname("api", "www.example.com"); err != nil {
+		t.Fatalf("Failed to remove hostname: %v", err)
+	}
+	waitFor("www.example.com", false)
+	waitFor("api.example.com", true)
+
+	if err := tunnelManager.RemoveTunnel("app"); err != nil {
+		t.Fatalf("Failed to remove test tunnel: %v", err)
+	}
+	waitFor("app.example.com", false)
+
+	cancel()
+	<-done
+}
+
+func TestCloudflareProvider(t *testing.T) {
+	var mu sync.Mutex
+	records := map[string]cloudflareRecord{
+		"1": {ID: "1", Type: "A", Name: "app.example.com", Content: "198.51.100.1", TTL: 300},
+	}
+	nextID := 2
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`))
+			return
+		}
+
+		var result interface{}
+		switch {
+		case r.URL.Path == "/zones":
+			result = []map[string]string{{"id": "zone1"}}
+		case r.URL.Path == "/zones/zone1/dns_records" && r.Method == http.MethodGet:
+			matches := []cloudflareRecord{}
+			for _, record := range records {
+				if record.Name == r.URL.Query().Get("name") && record.Type == r.URL.Query().Get("type") {
+					matches = append(matches, record)
+				}
+			}
+			result = matches
+		case r.URL.Path == "/zones/zone1/dns_records" && r.Method == http.MethodPost:
+			var record cloudflareRecord
+			_ = json.NewDecoder(r.Body).Decode(&record)
+			record.ID = strconv.Itoa(nextID)
+			nextID++
+			records[record.ID] = record
+		case strings.HasPrefix(r.URL.Path, "/zones/zone1/dns_records/"):
+			id := strings.TrimPrefix(r.URL.Path, "/zones/zone1/dns_records/")
+			if r.Method == http.MethodDelete {
+				delete(records, id)
+				break
+			}
+			var record cloudflareRecord
+			_ = json.NewDecoder(r.Body).Decode(&record)
+			record.ID = id
+			records[id] = record
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false}`))
+			return
+		}
+		data, _ := json.Marshal(result)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": json.RawMessage(data)})
+	}))
+	defer server.Close()
+
+	provider := NewCloudflareProvider("token", "example.com")
+	provider.baseURL = server.URL
+	ctx := context.Background()
+
+	// Updates the existing record in place
+	if err := provider.UpsertRecord(ctx, NewRecord("app.example.com", "203.0.113.10", 300)); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	if records["1"].Content != "203.0.113.10" {
+		t.Errorf("Expected record 1 to be updated, got %+v", records["1"])
+	}
+
+	if err := provider.UpsertRecord(ctx, NewRecord("api.example.com", "203.0.113.10", 300)); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected a new record to be created, got %d records", len(records))
+	}
+
+	// Records pointing elsewhere are not deleted
+	if err := provider.DeleteRecord(ctx, NewRecord("app.example.com", "198.51.100.1", 300)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, exists := records["1"]; !exists {
+		t.Error("Expected record with a different value to be kept")
+	}
+
+	if err := provider.DeleteRecord(ctx, NewRecord("app.example.com", "203.0.113.10", 300)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, exists := records["1"]; exists {
+		t.Error("Expected record to be deleted")
+	}
+
+	provider = NewCloudflareProvider("wrong", "example.com")
+	provider.baseURL = server.URL
+	if err := provider.UpsertRecord(ctx, NewRecord("app.example.com", "203.0.113.10", 300)); err == nil {
+		t.Error("Expected error for invalid token")
+	}
+}
+
+func TestDigitalOceanProvider(t *testing.T) {
+	var requests []string
+	var created digitalOceanRecord
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			records := []digitalOceanRecord{}
+			if r.URL.Query().Get("name") == "old.example.com" {
+				records = append(records, digitalOceanRecord{ID: 7, Type: "CNAME", Name: "old", Data: "lb.example.net.", TTL: 300})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"domain_records": records})
+		case http.MethodPost:
+			_ = json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("{}"))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	provider := NewDigitalOceanProvider("token", "example.com")
+	provider.baseURL = server.URL
+	ctx := context.Background()
+
+	if err := provider.UpsertRecord(ctx, NewRecord("app.example.com", "lb.example.net", 300)); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	if created.Name != "app" || created.Data != "lb.example.net." {
+		t.Errorf("Unexpected created record %+v", created)
+	}
+
+	if err := provider.DeleteRecord(ctx, NewRecord("old.example.com", "lb.example.net", 300)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if last := requests[len(requests)-1]; last != "DELETE /domains/example.com/records/7" {
+		t.Errorf("Expected record 7 to be deleted, got %s", last)
+	}
+}
+
+func TestRoute53Provider(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2013-04-01/hostedzone/Z123/rrset" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if strings.Contains(string(body), "<Action>DELETE</Action>") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<ErrorResponse><Error><Code>InvalidChangeBatch</Code><Message>not found</Message></Error></ErrorResponse>`))
+			return
+		}
+		w.Write([]byte(`<ChangeResourceRecordSetsResponse/>`))
+	}))
+	defer server.Close()
+
+	provider := newRoute53Provider(aws.Config{
+		Region:      route53Region,
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "secret", ""),
+	}, "/hostedzone/Z123", func(o *route53.Options) {
+		o.BaseEndpoint = aws.String(server.URL)
+	})
+	ctx := context.Background()
+
+	if err := provider.UpsertRecord(ctx, NewRecord("app.example.com", "203.0.113.10", 300)); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	for _, expected := range []string{"<Action>UPSERT</Action>", "<Name>app.example.com</Name>", "<Type>A</Type>", "<Value>203.0.113.10</Value>"} {
+		if !strings.Contains(bodies[0], expected) {
+			t.Errorf("Expected change batch to contain %s, got %s", expected, bodies[0])
+		}
+	}
+
+	// Deleting a record that no longer matches is not an error
+	if err := provider.DeleteRecord(ctx, NewRecord("app.example.com", "203.0.113.10", 300)); err != nil {
+		t.Errorf("Expected delete of a changed record to succeed, got %v", err)
+	}
+}
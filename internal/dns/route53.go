@@ -0,0 +1,88 @@
+// Package dns manages DNS records for tunnel hostnames for the easy-tunnel-lb-agent.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+)
+
+// route53Region is the region the global Route 53 API is signed for
+const route53Region = "us-east-1"
+
+// Route53Provider manages records in a Route 53 hosted zone
+type Route53Provider struct {
+	client       *route53.Client
+	hostedZoneID string
+}
+
+// NewRoute53Provider creates a provider for a hosted zone. Static credentials
+// are used if accessKeyID is set; otherwise they come from the default AWS
+// credential chain, such as the environment, a shared profile, a web
+// identity token or the instance role.
+func NewRoute53Provider(accessKeyID, secretKey, sessionToken, hostedZoneID string) (*Route53Provider, error) {
+	options := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(route53Region)}
+	if accessKeyID != "" {
+		options = append(options, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKeyID, secretKey, sessionToken)))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %v", err)
+	}
+	return newRoute53Provider(cfg, hostedZoneID), nil
+}
+
+func newRoute53Provider(cfg aws.Config, hostedZoneID string, optFns ...func(*route53.Options)) *Route53Provider {
+	return &Route53Provider{
+		client:       route53.NewFromConfig(cfg, optFns...),
+		hostedZoneID: strings.TrimPrefix(hostedZoneID, "/hostedzone/"),
+	}
+}
+
+// UpsertRecord creates the record or updates an existing record of the same name and type
+func (p *Route53Provider) UpsertRecord(ctx context.Context, record Record) error {
+	return p.change(ctx, types.ChangeActionUpsert, record)
+}
+
+// DeleteRecord deletes the record if it still has the given value. Route 53
+// only deletes record sets that match exactly, so records changed to point
+// elsewhere are rejected and left alone.
+func (p *Route53Provider) DeleteRecord(ctx context.Context, record Record) error {
+	err := p.change(ctx, types.ChangeActionDelete, record)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidChangeBatch" {
+		return nil
+	}
+	return err
+}
+
+func (p *Route53Provider) change(ctx context.Context, action types.ChangeAction, record Record) error {
+	_, err := p.client.ChangeResourceRecordSets(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(p.hostedZoneID),
+		ChangeBatch: &types.ChangeBatch{
+			Changes: []types.Change{{
+				Action: action,
+				ResourceRecordSet: &types.ResourceRecordSet{
+					Name:            aws.String(record.Name),
+					Type:            types.RRType(record.Type),
+					TTL:             aws.Int64(int64(record.TTL)),
+					ResourceRecords: []types.ResourceRecord{{Value: aws.String(record.Value)}},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("route53 request failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Package docker provides the Docker integration mode for the easy-tunnel-lb-agent.
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultHost is the address of the local Docker daemon
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// APIError is an error response from the Docker daemon
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("docker API error (%d): %s", e.StatusCode, e.Message)
+}
+
+// Container is the part of a container's inspection the controller uses
+type Container struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Labels       map[string]string   `json:"Labels"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	} `json:"Config"`
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+	HostConfig struct {
+		NetworkMode string `json:"NetworkMode"`
+	} `json:"HostConfig"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// Event is a container event of the daemon's event stream
+type Event struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// Client is a minimal client for the Docker Engine API
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the daemon at host, a unix:// socket path
+// or a tcp:// address
+func NewClient(host string) (*Client, error) {
+	if host == "" {
+		host = DefaultHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Docker host %q: %v", host, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		if socket == "" {
+			return nil, fmt.Errorf("invalid Docker host %q: missing socket path", host)
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		// The host is ignored when dialing the socket
+		return &Client{baseURL: "http://docker", httpClient: &http.Client{Transport: transport}}, nil
+	case "tcp", "http":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid Docker host %q: missing address", host)
+		}
+		return &Client{baseURL: "http://" + u.Host, httpClient: &http.Client{Transport: transport}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported Docker host %q, use unix:// or tcp://", host)
+	}
+}
+
+// ListContainers returns the IDs of the running containers carrying label
+func (c *Client) ListContainers(ctx context.Context, label string) ([]string, error) {
+	filters, _ := json.Marshal(map[string][]string{"label": {label}})
+	resp, err := c.get(ctx, "/containers/json?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to decode containers: %v", err)
+	}
+	ids := make([]string, 0, len(containers))
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	return ids, nil
+}
+
+// InspectContainer returns a container by ID or name
+func (c *Client) InspectContainer(ctx context.Context, id string) (*Container, error) {
+	resp, err := c.get(ctx, "/containers/"+url.PathEscape(id)+"/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var container Container
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return nil, fmt.Errorf("failed to decode container: %v", err)
+	}
+	return &container, nil
+}
+
+// WatchEvents streams the start, stop and removal events of containers
+// carrying label to handle until the stream ends, ctx is cancelled or
+// handle returns an error
+func (c *Client) WatchEvents(ctx context.Context, label string, handle func(Event) error) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "destroy"},
+		"label": {label},
+	})
+	resp, err := c.get(ctx, "/events?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event Event
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to decode event: %v", err)
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+}
+
+// get sends a GET request to the daemon and returns the response if it
+// succeeded, or an APIError otherwise
+func (c *Client) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Message != "" {
+			apiErr.Message = strings.TrimSpace(body.Message)
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// IsNotFound reports whether err means a container does not exist
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
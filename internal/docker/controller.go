@@ -0,0 +1,309 @@
+// Package docker provides the Docker integration mode for the easy-tunnel-lb-agent.
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// Labels that opt a container into easy-tunnel-lb
+const (
+	// LabelHostname is the public hostname to route to the container
+	// (required)
+	LabelHostname = "easy-tunnel-lb.hostname"
+	// LabelPort is the container port to route to (defaults to the only
+	// exposed TCP port)
+	LabelPort = "easy-tunnel-lb.port"
+	// LabelNetwork is the Docker network the agent reaches the container on
+	// (defaults to the first network by name)
+	LabelNetwork = "easy-tunnel-lb.network"
+)
+
+// Metadata keys set on tunnels created for containers
+const (
+	metadataSource      = "source"
+	metadataContainer   = "docker.container"
+	metadataContainerID = "docker.container_id"
+	sourceDocker        = "docker"
+)
+
+// networkModeHost is the network mode of containers sharing the host's
+// network, which are reached on the loopback address
+const networkModeHost = "host"
+
+// retryInterval is how long to wait before listing again after a failure
+const retryInterval = 5 * time.Second
+
+// Controller keeps tunnels in sync with the labeled containers of a Docker
+// daemon
+type Controller struct {
+	client        *Client
+	tunnelManager *tunnel.Manager
+	router        *loadbalancer.Router
+	logger        *zerolog.Logger
+}
+
+// NewController creates a controller routing the hostnames of labeled
+// containers through router
+func NewController(client *Client, tunnelManager *tunnel.Manager, router *loadbalancer.Router) *Controller {
+	return &Controller{
+		client:        client,
+		tunnelManager: tunnelManager,
+		router:        router,
+		logger:        utils.GetLogger(),
+	}
+}
+
+// Run lists and watches containers until ctx is cancelled
+func (c *Controller) Run(ctx context.Context) {
+	c.logger.Info().Msg("Starting Docker container controller")
+
+	for {
+		err := c.sync(ctx)
+		if err == nil {
+			err = c.client.WatchEvents(ctx, LabelHostname, func(event Event) error {
+				c.handleEvent(ctx, event)
+				return nil
+			})
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			c.logger.Error().Err(err).Msg("Docker event stream failed, retrying")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// sync reconciles every labeled container and removes the tunnels of
+// containers that stopped while the controller was not watching
+func (c *Controller) sync(ctx context.Context) error {
+	ids, err := c.client.ListContainers(ctx, LabelHostname)
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		container, err := c.client.InspectContainer(ctx, id)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("failed to inspect container %s: %v", id, err)
+		}
+		if c.reconcile(container) {
+			seen[TunnelID(containerName(container))] = true
+		}
+	}
+
+	for _, t := range c.tunnelManager.GetAllTunnels() {
+		if owns(t) && !seen[t.ID] {
+			c.removeTunnel(t.ID, "")
+		}
+	}
+	return nil
+}
+
+func (c *Controller) handleEvent(ctx context.Context, event Event) {
+	switch event.Action {
+	case "start":
+		container, err := c.client.InspectContainer(ctx, event.Actor.ID)
+		if err != nil {
+			c.logger.Error().
+				Err(err).
+				Str("container", event.Actor.Attributes["name"]).
+				Msg("Failed to inspect started container")
+			return
+		}
+		c.reconcile(container)
+	case "die", "destroy":
+		c.removeTunnel(TunnelID(event.Actor.Attributes["name"]), event.Actor.ID)
+	}
+}
+
+// reconcile creates or replaces the tunnel and route of a container,
+// reporting whether the container should have them
+func (c *Controller) reconcile(container *Container) bool {
+	name := containerName(container)
+	id := TunnelID(name)
+	hostname := container.Config.Labels[LabelHostname]
+	if !container.State.Running || hostname == "" {
+		c.removeTunnel(id, container.ID)
+		return false
+	}
+
+	if err := c.route(id, name, container, hostname); err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("container", name).
+			Msg("Failed to create tunnel for container")
+	}
+	return true
+}
+
+// route creates the tunnel of a container, replacing an existing one if
+// the container changed, and routes hostname to the container's address
+func (c *Controller) route(id, name string, container *Container, hostname string) error {
+	port, err := containerPort(container)
+	if err != nil {
+		return err
+	}
+	ip, err := containerIP(container)
+	if err != nil {
+		return err
+	}
+
+	metadata := map[string]string{
+		metadataSource:      sourceDocker,
+		metadataContainer:   name,
+		metadataContainerID: container.ID,
+	}
+	if _, err := c.tunnelManager.CreateTunnel(id, hostname, port, "", metadata); err != nil {
+		// The tunnel exists with an outdated configuration, so replace it
+		existing, getErr := c.tunnelManager.GetTunnel(id)
+		if getErr != nil || !owns(existing) {
+			return err
+		}
+		c.router.RemoveRoute(id)
+		if err := c.tunnelManager.RemoveTunnel(id); err != nil {
+			return err
+		}
+		if _, err := c.tunnelManager.CreateTunnel(id, hostname, port, "", metadata); err != nil {
+			return err
+		}
+	}
+
+	routes := []loadbalancer.Route{{Hostname: hostname, IP: ip, Port: port}}
+	if err := c.router.ReplaceTunnelRoutes(id, routes); err != nil {
+		c.router.RemoveRoute(id)
+		return err
+	}
+
+	c.logger.Info().
+		Str("container", name).
+		Str("tunnel_id", id).
+		Str("hostname", hostname).
+		Str("target", ip+":"+strconv.Itoa(port)).
+		Msg("Routed container")
+	return nil
+}
+
+// removeTunnel removes the tunnel and route of a container if the
+// controller created them, for the container with containerID if set
+func (c *Controller) removeTunnel(id, containerID string) {
+	t, err := c.tunnelManager.GetTunnel(id)
+	if err != nil || !owns(t) {
+		return
+	}
+	if containerID != "" && t.Metadata[metadataContainerID] != containerID {
+		// A newer container of the same name owns the tunnel
+		return
+	}
+
+	c.router.RemoveRoute(id)
+	if err := c.tunnelManager.RemoveTunnel(id); err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("tunnel_id", id).
+			Msg("Failed to remove tunnel for container")
+		return
+	}
+	c.logger.Info().
+		Str("container", t.Metadata[metadataContainer]).
+		Str("tunnel_id", id).
+		Msg("Removed tunnel of stopped container")
+}
+
+// owns reports whether a tunnel was created by a Docker controller
+func owns(t *tunnel.TunnelInfo) bool {
+	return t.Metadata[metadataSource] == sourceDocker
+}
+
+// TunnelID returns the ID of the tunnel created for a container. Container
+// names are unique on a daemon and survive recreating the container.
+func TunnelID(name string) string {
+	return "docker." + name
+}
+
+// containerName returns the name of a container without its leading slash
+func containerName(container *Container) string {
+	return strings.TrimPrefix(container.Name, "/")
+}
+
+// containerPort returns the port selected by LabelPort, or the only TCP
+// port the container exposes
+func containerPort(container *Container) (int, error) {
+	if label := container.Config.Labels[LabelPort]; label != "" {
+		port, err := strconv.Atoi(label)
+		if err != nil || port <= 0 || port > 65535 {
+			return 0, fmt.Errorf("invalid %s label %q", LabelPort, label)
+		}
+		return port, nil
+	}
+
+	var ports []int
+	for exposed := range container.Config.ExposedPorts {
+		number, protocol, _ := strings.Cut(exposed, "/")
+		if protocol != "" && protocol != "tcp" {
+			continue
+		}
+		if port, err := strconv.Atoi(number); err == nil {
+			ports = append(ports, port)
+		}
+	}
+	switch len(ports) {
+	case 0:
+		return 0, fmt.Errorf("container exposes no TCP port, set the %s label", LabelPort)
+	case 1:
+		return ports[0], nil
+	default:
+		sort.Ints(ports)
+		return 0, fmt.Errorf("container exposes several TCP ports %v, set the %s label", ports, LabelPort)
+	}
+}
+
+// containerIP returns the address of a container on the network selected
+// by LabelNetwork, or on the first of its networks by name
+func containerIP(container *Container) (string, error) {
+	if container.HostConfig.NetworkMode == networkModeHost {
+		return "127.0.0.1", nil
+	}
+
+	networks := container.NetworkSettings.Networks
+	if label := container.Config.Labels[LabelNetwork]; label != "" {
+		network, ok := networks[label]
+		if !ok || network.IPAddress == "" {
+			return "", fmt.Errorf("container has no address on network %q", label)
+		}
+		return network.IPAddress, nil
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("container has no network address")
+}
@@ -0,0 +1,288 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+// fakeDaemon serves fixed containers and streams fixed events
+type fakeDaemon struct {
+	mu         sync.Mutex
+	containers map[string]*Container
+	events     []Event
+}
+
+func (f *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/containers/json":
+		list := []map[string]string{}
+		for id, container := range f.containers {
+			if container.State.Running {
+				list = append(list, map[string]string{"Id": id})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	case r.URL.Path == "/events":
+		encoder := json.NewEncoder(w)
+		for _, event := range f.events {
+			_ = encoder.Encode(event)
+		}
+	case strings.HasPrefix(r.URL.Path, "/containers/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		container, exists := f.containers[id]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message": "No such container: ` + id + `"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(container)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newContainer(id, name string, labels map[string]string, ip string) *Container {
+	container := &Container{ID: id, Name: "/" + name}
+	container.Config.Labels = labels
+	container.Config.ExposedPorts = map[string]struct{}{"8080/tcp": {}}
+	container.State.Running = true
+	container.HostConfig.NetworkMode = "bridge"
+	container.NetworkSettings.Networks = map[string]struct {
+		IPAddress string `json:"IPAddress"`
+	}{"bridge": {IPAddress: ip}}
+	return container
+}
+
+func newEvent(action, id, name string) Event {
+	event := Event{Type: "container", Action: action}
+	event.Actor.ID = id
+	event.Actor.Attributes = map[string]string{"name": name}
+	return event
+}
+
+func newTestController(t *testing.T, daemon *fakeDaemon) (*Controller, *tunnel.Manager, *loadbalancer.Router) {
+	t.Helper()
+
+	server := httptest.NewServer(daemon)
+	t.Cleanup(server.Close)
+
+	client, err := NewClient("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	manager := tunnel.NewManager(10)
+	router := loadbalancer.NewRouter(&loadbalancer.Config{HTTPPort: 8443, TCPPort: 8444})
+	return NewController(client, manager, router), manager, router
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		host        string
+		expectedURL string
+		expectError bool
+	}{
+		{"", "http://docker", false},
+		{"unix:///run/user/1000/docker.sock", "http://docker", false},
+		{"tcp://10.0.0.5:2375", "http://10.0.0.5:2375", false},
+		{"ssh://docker@host", "", true},
+	}
+
+	for _, tt := range tests {
+		client, err := NewClient(tt.host)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("Expected error for host %q, got nil", tt.host)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for host %q: %v", tt.host, err)
+			continue
+		}
+		if client.baseURL != tt.expectedURL {
+			t.Errorf("Expected base URL %s for host %q, got %s", tt.expectedURL, tt.host, client.baseURL)
+		}
+	}
+}
+
+func TestContainerPort(t *testing.T) {
+	tests := []struct {
+		name         string
+		labels       map[string]string
+		exposed      []string
+		expectedPort int
+		expectError  bool
+	}{
+		{"single exposed port", nil, []string{"8080/tcp"}, 8080, false},
+		{"UDP ports ignored", nil, []string{"53/udp", "8080/tcp"}, 8080, false},
+		{"port label", map[string]string{LabelPort: "9000"}, []string{"8080/tcp", "9000/tcp"}, 9000, false},
+		{"several exposed ports", nil, []string{"8080/tcp", "9000/tcp"}, 0, true},
+		{"no exposed port", nil, nil, 0, true},
+		{"invalid port label", map[string]string{LabelPort: "http"}, nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := &Container{}
+			container.Config.Labels = tt.labels
+			container.Config.ExposedPorts = make(map[string]struct{})
+			for _, port := range tt.exposed {
+				container.Config.ExposedPorts[port] = struct{}{}
+			}
+
+			port, err := containerPort(container)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got port %d", port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if port != tt.expectedPort {
+				t.Errorf("Expected port %d, got %d", tt.expectedPort, port)
+			}
+		})
+	}
+}
+
+func TestContainerIP(t *testing.T) {
+	container := newContainer("c1", "web", map[string]string{}, "")
+	container.NetworkSettings.Networks["proxy"] = struct {
+		IPAddress string `json:"IPAddress"`
+	}{IPAddress: "172.20.0.5"}
+	container.NetworkSettings.Networks["backend"] = struct {
+		IPAddress string `json:"IPAddress"`
+	}{IPAddress: "172.21.0.5"}
+
+	if ip, err := containerIP(container); err != nil || ip != "172.21.0.5" {
+		t.Errorf("Expected first network by name, got %q (%v)", ip, err)
+	}
+
+	container.Config.Labels[LabelNetwork] = "proxy"
+	if ip, err := containerIP(container); err != nil || ip != "172.20.0.5" {
+		t.Errorf("Expected labeled network, got %q (%v)", ip, err)
+	}
+
+	container.Config.Labels[LabelNetwork] = "bridge"
+	if _, err := containerIP(container); err == nil {
+		t.Error("Expected error for a network without an address, got nil")
+	}
+
+	container.HostConfig.NetworkMode = networkModeHost
+	if ip, err := containerIP(container); err != nil || ip != "127.0.0.1" {
+		t.Errorf("Expected loopback address for host networking, got %q (%v)", ip, err)
+	}
+}
+
+func TestControllerSync(t *testing.T) {
+	daemon := &fakeDaemon{
+		containers: map[string]*Container{
+			"c1": newContainer("c1", "web", map[string]string{LabelHostname: "web.example.com"}, "172.17.0.2"),
+		},
+	}
+	controller, manager, router := newTestController(t, daemon)
+
+	// A tunnel of a container that stopped while the agent was not watching
+	if _, err := manager.CreateTunnel(TunnelID("old"), "old.example.com", 80, "", map[string]string{
+		metadataSource:      sourceDocker,
+		metadataContainer:   "old",
+		metadataContainerID: "c0",
+	}); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	// A tunnel created through the API
+	if _, err := manager.CreateTunnel("manual", "manual.example.com", 80, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	if err := controller.sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	target, err := router.Route("web.example.com", "/")
+	if err != nil {
+		t.Fatalf("Expected route for container: %v", err)
+	}
+	if target.ID != TunnelID("web") || target.IP != "172.17.0.2" || target.Port != 8080 {
+		t.Errorf("Unexpected target %s via %s:%d", target.ID, target.IP, target.Port)
+	}
+	if _, err := manager.GetTunnel(TunnelID("old")); err == nil {
+		t.Error("Expected tunnel of stopped container to be removed")
+	}
+	if _, err := manager.GetTunnel("manual"); err != nil {
+		t.Error("Expected tunnel not created by the controller to be kept")
+	}
+}
+
+func TestControllerEvents(t *testing.T) {
+	daemon := &fakeDaemon{
+		containers: map[string]*Container{
+			"c1": newContainer("c1", "web", map[string]string{LabelHostname: "web.example.com"}, "172.17.0.2"),
+			"c2": newContainer("c2", "web", map[string]string{LabelHostname: "web.example.com"}, "172.17.0.3"),
+		},
+	}
+	controller, manager, router := newTestController(t, daemon)
+	ctx := context.Background()
+
+	controller.handleEvent(ctx, newEvent("start", "c1", "web"))
+	if _, err := router.Route("web.example.com", "/"); err != nil {
+		t.Fatalf("Expected route after start: %v", err)
+	}
+
+	// The container was recreated under the same name
+	controller.handleEvent(ctx, newEvent("start", "c2", "web"))
+	target, err := router.Route("web.example.com", "/")
+	if err != nil || target.IP != "172.17.0.3" {
+		t.Fatalf("Expected route to the new container, got %+v (%v)", target, err)
+	}
+
+	// The old container's late die event must not remove the new tunnel
+	controller.handleEvent(ctx, newEvent("die", "c1", "web"))
+	if _, err := manager.GetTunnel(TunnelID("web")); err != nil {
+		t.Fatal("Expected tunnel of the new container to be kept")
+	}
+
+	controller.handleEvent(ctx, newEvent("die", "c2", "web"))
+	if _, err := manager.GetTunnel(TunnelID("web")); err == nil {
+		t.Error("Expected tunnel to be removed when the container stops")
+	}
+	if _, err := router.Route("web.example.com", "/"); err == nil {
+		t.Error("Expected route to be removed when the container stops")
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	daemon := &fakeDaemon{
+		events: []Event{newEvent("start", "c1", "web"), newEvent("die", "c1", "web")},
+	}
+	controller, _, _ := newTestController(t, daemon)
+
+	var actions []string
+	err := controller.client.WatchEvents(context.Background(), LabelHostname, func(event Event) error {
+		actions = append(actions, event.Action)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WatchEvents failed: %v", err)
+	}
+	if strings.Join(actions, ",") != "start,die" {
+		t.Errorf("Expected start and die events, got %v", actions)
+	}
+
+	if _, err := controller.client.InspectContainer(context.Background(), "missing"); !IsNotFound(err) {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+// Package firewall manages host firewall rules for tunnel traffic for the easy-tunnel-lb-agent.
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// Supported firewall backends
+const (
+	// BackendNone leaves the host firewall alone
+	BackendNone = "none"
+	// BackendAuto uses nftables if the nft tool is installed, else iptables
+	BackendAuto     = "auto"
+	BackendNftables = "nftables"
+	BackendIptables = "iptables"
+)
+
+// Interface is a WireGuard interface whose traffic the firewall manages
+type Interface struct {
+	Name string
+	Port int
+	// IPv6 is set if peers on the interface have IPv6 addresses
+	IPv6 bool
+}
+
+// Peer is a WireGuard peer with its host addresses on an interface
+type Peer struct {
+	Interface string
+	Addresses []string
+}
+
+// backend generates the commands that implement the rules
+type backend interface {
+	// setup creates the base rules: WireGuard's listen ports are accepted,
+	// and traffic on the interfaces is dropped unless a peer rule allows it
+	setup(interfaces []Interface) [][]string
+	// addPeer and removePeer accept traffic from the peer's addresses to
+	// the agent, forward it to other networks and masquerade it there
+	addPeer(peer Peer) [][]string
+	removePeer(peer Peer) [][]string
+	// teardown removes all rules
+	teardown() [][]string
+}
+
+// Firewall installs forwarding and NAT rules for WireGuard peers
+type Firewall struct {
+	mu      sync.Mutex
+	name    string
+	backend backend
+	logger  *zerolog.Logger
+	run     func(args []string) error
+}
+
+// ValidateBackend checks name is a supported backend
+func ValidateBackend(name string) error {
+	switch name {
+	case "", BackendNone, BackendAuto, BackendNftables, BackendIptables:
+		return nil
+	}
+	return fmt.Errorf("unknown firewall backend %q (want %s, %s, %s or %s)",
+		name, BackendNone, BackendAuto, BackendNftables, BackendIptables)
+}
+
+// New creates a firewall with the named backend, or returns nil if name is
+// empty or none
+func New(name string) (*Firewall, error) {
+	if err := ValidateBackend(name); err != nil {
+		return nil, err
+	}
+	if name == "" || name == BackendNone {
+		return nil, nil
+	}
+	if name == BackendAuto {
+		name = BackendIptables
+		if _, err := exec.LookPath("nft"); err == nil {
+			name = BackendNftables
+		}
+	}
+
+	f := &Firewall{
+		name:   name,
+		logger: utils.GetModuleLogger(utils.ModuleWireGuard),
+		run:    runCommand,
+	}
+	if name == BackendNftables {
+		f.backend = nftables{}
+	} else {
+		f.backend = iptables{}
+	}
+	return f, nil
+}
+
+// Backend returns the name of the backend in use
+func (f *Firewall) Backend() string {
+	return f.name
+}
+
+// Setup enables IP forwarding and installs the base rules for the
+// interfaces, replacing rules left over from a previous run
+func (f *Firewall) Setup(interfaces []Interface) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.runAll(f.backend.teardown(), true)
+	if err := enableForwarding(usesIPv6(interfaces)); err != nil {
+		return err
+	}
+	if err := f.runAll(f.backend.setup(interfaces), false); err != nil {
+		return err
+	}
+
+	f.logger.Info().
+		Str("backend", f.name).
+		Int("interfaces", len(interfaces)).
+		Msg("Installed firewall rules")
+	return nil
+}
+
+// AddPeer installs the rules of a WireGuard peer
+func (f *Firewall) AddPeer(iface string, addresses []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	peer := Peer{Interface: iface, Addresses: hostAddresses(addresses)}
+	if err := f.runAll(f.backend.addPeer(peer), false); err != nil {
+		return err
+	}
+
+	f.logger.Debug().
+		Str("interface", iface).
+		Strs("addresses", peer.Addresses).
+		Msg("Added firewall rules for peer")
+	return nil
+}
+
+// RemovePeer removes the rules of a WireGuard peer
+func (f *Firewall) RemovePeer(iface string, addresses []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	peer := Peer{Interface: iface, Addresses: hostAddresses(addresses)}
+	if err := f.runAll(f.backend.removePeer(peer), false); err != nil {
+		return err
+	}
+
+	f.logger.Debug().
+		Str("interface", iface).
+		Strs("addresses", peer.Addresses).
+		Msg("Removed firewall rules for peer")
+	return nil
+}
+
+// Teardown removes all rules installed by the firewall
+func (f *Firewall) Teardown() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.runAll(f.backend.teardown(), true)
+	f.logger.Info().
+		Str("backend", f.name).
+		Msg("Removed firewall rules")
+}
+
+// runAll runs the commands in order, stopping at the first failure unless
+// ignoreErrors is set
+func (f *Firewall) runAll(commands [][]string, ignoreErrors bool) error {
+	for _, args := range commands {
+		if err := f.run(args); err != nil && !ignoreErrors {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCommand(args []string) error {
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Sysctls enabling routing between the WireGuard interfaces and other
+// networks. IPv6 forwarding stops the host from accepting router
+// advertisements by default, so it is only enabled when peers use IPv6.
+const (
+	ipv4ForwardingSysctl = "/proc/sys/net/ipv4/ip_forward"
+	ipv6ForwardingSysctl = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+func enableForwarding(ipv6 bool) error {
+	paths := []string{ipv4ForwardingSysctl}
+	if ipv6 {
+		paths = append(paths, ipv6ForwardingSysctl)
+	}
+	for _, path := range paths {
+		if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
+			return fmt.Errorf("failed to enable IP forwarding: %v", err)
+		}
+	}
+	return nil
+}
+
+func usesIPv6(interfaces []Interface) bool {
+	for _, iface := range interfaces {
+		if iface.IPv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAddresses strips prefix lengths, e.g. from WireGuard allowed IPs
+func hostAddresses(addresses []string) []string {
+	hosts := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if ip, _, err := net.ParseCIDR(address); err == nil {
+			address = ip.String()
+		}
+		hosts = append(hosts, address)
+	}
+	return hosts
+}
+
+// isIPv6 reports whether address is an IPv6 address
+func isIPv6(address string) bool {
+	return strings.Contains(address, ":")
+}
@@ -0,0 +1,192 @@
+package firewall
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingFirewall returns a firewall whose commands are recorded instead
+// of run, failing any command that starts with failPrefix
+func recordingFirewall(b backend, failPrefix string) (*Firewall, *[]string) {
+	var commands []string
+	f, _ := New(BackendIptables)
+	f.backend = b
+	f.run = func(args []string) error {
+		command := strings.Join(args, " ")
+		commands = append(commands, command)
+		if failPrefix != "" && strings.HasPrefix(command, failPrefix) {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	return f, &commands
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name        string
+		backend     string
+		wantNil     bool
+		shouldError bool
+	}{
+		{name: "Empty", backend: "", wantNil: true},
+		{name: "None", backend: BackendNone, wantNil: true},
+		{name: "Nftables", backend: BackendNftables},
+		{name: "Iptables", backend: BackendIptables},
+		{name: "Unknown", backend: "pf", wantNil: true, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.backend)
+			if (err != nil) != tt.shouldError {
+				t.Fatalf("New() error = %v, shouldError %v", err, tt.shouldError)
+			}
+			if (f == nil) != tt.wantNil {
+				t.Fatalf("New() = %v, wantNil %v", f, tt.wantNil)
+			}
+			if f != nil && f.Backend() != tt.backend {
+				t.Errorf("Backend() = %s, want %s", f.Backend(), tt.backend)
+			}
+		})
+	}
+}
+
+func TestPeerCommands(t *testing.T) {
+	addresses := []string{"10.10.0.2/32", "fd00::2/128"}
+
+	tests := []struct {
+		name       string
+		backend    backend
+		failPrefix string
+		add        bool
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name:    "Nftables add",
+			backend: nftables{},
+			add:     true,
+			want: []string{
+				"nft add element inet easy_tunnel peers4 { wg0 . 10.10.0.2 }",
+				"nft add element inet easy_tunnel peers6 { wg0 . fd00::2 }",
+			},
+		},
+		{
+			name:    "Nftables remove",
+			backend: nftables{},
+			want: []string{
+				"nft delete element inet easy_tunnel peers4 { wg0 . 10.10.0.2 }",
+				"nft delete element inet easy_tunnel peers6 { wg0 . fd00::2 }",
+			},
+		},
+		{
+			name:    "Iptables add",
+			backend: iptables{},
+			add:     true,
+			want: []string{
+				"iptables -A EASY-TUNNEL-INPUT-PEERS -i wg0 -s 10.10.0.2 -j ACCEPT",
+				"iptables -A EASY-TUNNEL-FORWARD-PEERS -i wg0 -s 10.10.0.2 -j ACCEPT",
+				"iptables -t nat -A EASY-TUNNEL-POSTROUTING -s 10.10.0.2 ! -o wg0 -j MASQUERADE",
+				"ip6tables -A EASY-TUNNEL-INPUT-PEERS -i wg0 -s fd00::2 -j ACCEPT",
+				"ip6tables -A EASY-TUNNEL-FORWARD-PEERS -i wg0 -s fd00::2 -j ACCEPT",
+				"ip6tables -t nat -A EASY-TUNNEL-POSTROUTING -s fd00::2 ! -o wg0 -j MASQUERADE",
+			},
+		},
+		{
+			name:       "Failure stops at the failing command",
+			backend:    iptables{},
+			failPrefix: "iptables -A EASY-TUNNEL-FORWARD-PEERS",
+			add:        true,
+			want: []string{
+				"iptables -A EASY-TUNNEL-INPUT-PEERS -i wg0 -s 10.10.0.2 -j ACCEPT",
+				"iptables -A EASY-TUNNEL-FORWARD-PEERS -i wg0 -s 10.10.0.2 -j ACCEPT",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, commands := recordingFirewall(tt.backend, tt.failPrefix)
+			var err error
+			if tt.add {
+				err = f.AddPeer("wg0", addresses)
+			} else {
+				err = f.RemovePeer("wg0", addresses)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(*commands, tt.want) {
+				t.Errorf("commands = %q, want %q", *commands, tt.want)
+			}
+		})
+	}
+}
+
+func TestIptablesSetup(t *testing.T) {
+	tests := []struct {
+		name       string
+		interfaces []Interface
+		wantIPv6   bool
+	}{
+		{
+			name:       "IPv4 only",
+			interfaces: []Interface{{Name: "wg0", Port: 51820}},
+		},
+		{
+			name:       "Dual-stack",
+			interfaces: []Interface{{Name: "wg0", Port: 51820}, {Name: "wg1", Port: 51821, IPv6: true}},
+			wantIPv6:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands := iptables{}.setup(tt.interfaces)
+
+			hasIPv6 := false
+			for _, args := range commands {
+				if args[0] == "ip6tables" {
+					hasIPv6 = true
+				}
+			}
+			if hasIPv6 != tt.wantIPv6 {
+				t.Errorf("ip6tables rules = %v, want %v", hasIPv6, tt.wantIPv6)
+			}
+
+			// The jumps to the agent's chains come last, once the chains
+			// are complete
+			last := strings.Join(commands[len(commands)-1], " ")
+			if !strings.Contains(last, "-I POSTROUTING 1 -j "+chainPostrouting) {
+				t.Errorf("last command = %q, want the POSTROUTING jump", last)
+			}
+			for _, iface := range tt.interfaces {
+				drop := []string{"iptables", "-A", chainForward, "-i", iface.Name, "-j", "DROP"}
+				if !containsCommand(commands, drop) {
+					t.Errorf("missing %q", drop)
+				}
+			}
+		})
+	}
+}
+
+func containsCommand(commands [][]string, want []string) bool {
+	for _, args := range commands {
+		if reflect.DeepEqual(args, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHostAddresses(t *testing.T) {
+	got := hostAddresses([]string{"10.10.0.2/32", "fd00::2/128", "10.10.0.3"})
+	want := []string{"10.10.0.2", "fd00::2", "10.10.0.3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("hostAddresses() = %q, want %q", got, want)
+	}
+}
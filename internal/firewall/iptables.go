@@ -0,0 +1,103 @@
+// Package firewall manages host firewall rules for tunnel traffic for the easy-tunnel-lb-agent.
+package firewall
+
+import "strconv"
+
+// Chains of the agent, jumped to from the start of the built-in chains.
+// Peer rules live in chains of their own, evaluated after traffic to the
+// WireGuard interfaces has been restricted to replies, so they can be
+// appended and deleted in any order.
+const (
+	chainInput       = "EASY-TUNNEL-INPUT"
+	chainInputPeers  = "EASY-TUNNEL-INPUT-PEERS"
+	chainForward     = "EASY-TUNNEL-FORWARD"
+	chainFwdPeers    = "EASY-TUNNEL-FORWARD-PEERS"
+	chainPostrouting = "EASY-TUNNEL-POSTROUTING"
+)
+
+// iptables installs the rules with iptables and, for IPv6 peers, ip6tables
+type iptables struct{}
+
+func (iptables) setup(interfaces []Interface) [][]string {
+	tools := []string{"iptables"}
+	if usesIPv6(interfaces) {
+		tools = append(tools, "ip6tables")
+	}
+
+	var commands [][]string
+	for _, tool := range tools {
+		commands = append(commands,
+			[]string{tool, "-N", chainInput},
+			[]string{tool, "-N", chainInputPeers},
+			[]string{tool, "-N", chainForward},
+			[]string{tool, "-N", chainFwdPeers},
+			[]string{tool, "-t", "nat", "-N", chainPostrouting},
+		)
+		for _, iface := range interfaces {
+			commands = append(commands,
+				[]string{tool, "-A", chainInput, "-p", "udp", "--dport", strconv.Itoa(iface.Port), "-j", "ACCEPT"},
+				[]string{tool, "-A", chainForward, "-o", iface.Name, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+				[]string{tool, "-A", chainForward, "-o", iface.Name, "-j", "DROP"},
+			)
+		}
+		commands = append(commands,
+			[]string{tool, "-A", chainInput, "-j", chainInputPeers},
+			[]string{tool, "-A", chainForward, "-j", chainFwdPeers},
+		)
+		for _, iface := range interfaces {
+			commands = append(commands,
+				[]string{tool, "-A", chainInput, "-i", iface.Name, "-j", "DROP"},
+				[]string{tool, "-A", chainForward, "-i", iface.Name, "-j", "DROP"},
+			)
+		}
+		commands = append(commands,
+			[]string{tool, "-I", "INPUT", "1", "-j", chainInput},
+			[]string{tool, "-I", "FORWARD", "1", "-j", chainForward},
+			[]string{tool, "-t", "nat", "-I", "POSTROUTING", "1", "-j", chainPostrouting},
+		)
+	}
+	return commands
+}
+
+func (i iptables) addPeer(peer Peer) [][]string {
+	return i.peerRules("-A", peer)
+}
+
+func (i iptables) removePeer(peer Peer) [][]string {
+	return i.peerRules("-D", peer)
+}
+
+func (iptables) peerRules(action string, peer Peer) [][]string {
+	var commands [][]string
+	for _, address := range peer.Addresses {
+		tool := "iptables"
+		if isIPv6(address) {
+			tool = "ip6tables"
+		}
+		commands = append(commands,
+			[]string{tool, action, chainInputPeers, "-i", peer.Interface, "-s", address, "-j", "ACCEPT"},
+			[]string{tool, action, chainFwdPeers, "-i", peer.Interface, "-s", address, "-j", "ACCEPT"},
+			[]string{tool, "-t", "nat", action, chainPostrouting, "-s", address, "!", "-o", peer.Interface, "-j", "MASQUERADE"},
+		)
+	}
+	return commands
+}
+
+func (iptables) teardown() [][]string {
+	var commands [][]string
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		commands = append(commands,
+			[]string{tool, "-D", "INPUT", "-j", chainInput},
+			[]string{tool, "-D", "FORWARD", "-j", chainForward},
+			[]string{tool, "-t", "nat", "-D", "POSTROUTING", "-j", chainPostrouting},
+		)
+		for _, chain := range []string{chainInput, chainInputPeers, chainForward, chainFwdPeers} {
+			commands = append(commands, []string{tool, "-F", chain}, []string{tool, "-X", chain})
+		}
+		commands = append(commands,
+			[]string{tool, "-t", "nat", "-F", chainPostrouting},
+			[]string{tool, "-t", "nat", "-X", chainPostrouting},
+		)
+	}
+	return commands
+}
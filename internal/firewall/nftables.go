@@ -0,0 +1,71 @@
+// Package firewall manages host firewall rules for tunnel traffic for the easy-tunnel-lb-agent.
+package firewall
+
+import "strconv"
+
+// nftablesTable holds all rules of the agent, so they are removed at once
+const nftablesTable = "easy_tunnel"
+
+// nftables keeps the rules in a table of its own. Peers are elements of
+// sets matched by fixed rules, so adding and removing them never reorders
+// rules. Note that a drop verdict in another table still applies.
+type nftables struct{}
+
+func nft(args ...string) []string {
+	return append([]string{"nft"}, args...)
+}
+
+func (nftables) setup(interfaces []Interface) [][]string {
+	table := []string{"inet", nftablesTable}
+	commands := [][]string{
+		nft(append([]string{"add", "table"}, table...)...),
+		nft("add", "set", "inet", nftablesTable, "wg_ifaces", "{", "type", "ifname", ";", "}"),
+		nft("add", "set", "inet", nftablesTable, "peers4", "{", "type", "ifname", ".", "ipv4_addr", ";", "}"),
+		nft("add", "set", "inet", nftablesTable, "peers6", "{", "type", "ifname", ".", "ipv6_addr", ";", "}"),
+		nft("add", "chain", "inet", nftablesTable, "input", "{", "type", "filter", "hook", "input", "priority", "0", ";", "policy", "accept", ";", "}"),
+		nft("add", "chain", "inet", nftablesTable, "forward", "{", "type", "filter", "hook", "forward", "priority", "0", ";", "policy", "accept", ";", "}"),
+		nft("add", "chain", "inet", nftablesTable, "postrouting", "{", "type", "nat", "hook", "postrouting", "priority", "100", ";", "policy", "accept", ";", "}"),
+	}
+	for _, iface := range interfaces {
+		commands = append(commands,
+			nft("add", "element", "inet", nftablesTable, "wg_ifaces", "{", iface.Name, "}"),
+			nft("add", "rule", "inet", nftablesTable, "input", "udp", "dport", strconv.Itoa(iface.Port), "accept"),
+		)
+	}
+	return append(commands,
+		nft("add", "rule", "inet", nftablesTable, "input", "iifname", ".", "ip", "saddr", "@peers4", "accept"),
+		nft("add", "rule", "inet", nftablesTable, "input", "iifname", ".", "ip6", "saddr", "@peers6", "accept"),
+		nft("add", "rule", "inet", nftablesTable, "input", "iifname", "@wg_ifaces", "drop"),
+		nft("add", "rule", "inet", nftablesTable, "forward", "oifname", "@wg_ifaces", "ct", "state", "established,related", "accept"),
+		nft("add", "rule", "inet", nftablesTable, "forward", "oifname", "@wg_ifaces", "drop"),
+		nft("add", "rule", "inet", nftablesTable, "forward", "iifname", ".", "ip", "saddr", "@peers4", "accept"),
+		nft("add", "rule", "inet", nftablesTable, "forward", "iifname", ".", "ip6", "saddr", "@peers6", "accept"),
+		nft("add", "rule", "inet", nftablesTable, "forward", "iifname", "@wg_ifaces", "drop"),
+		nft("add", "rule", "inet", nftablesTable, "postrouting", "iifname", ".", "ip", "saddr", "@peers4", "masquerade"),
+		nft("add", "rule", "inet", nftablesTable, "postrouting", "iifname", ".", "ip6", "saddr", "@peers6", "masquerade"),
+	)
+}
+
+func (n nftables) addPeer(peer Peer) [][]string {
+	return n.peerElements("add", peer)
+}
+
+func (n nftables) removePeer(peer Peer) [][]string {
+	return n.peerElements("delete", peer)
+}
+
+func (nftables) peerElements(verb string, peer Peer) [][]string {
+	var commands [][]string
+	for _, address := range peer.Addresses {
+		set := "peers4"
+		if isIPv6(address) {
+			set = "peers6"
+		}
+		commands = append(commands, nft(verb, "element", "inet", nftablesTable, set, "{", peer.Interface, ".", address, "}"))
+	}
+	return commands
+}
+
+func (nftables) teardown() [][]string {
+	return [][]string{nft("delete", "table", "inet", nftablesTable)}
+}
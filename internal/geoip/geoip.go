@@ -0,0 +1,68 @@
+// Package geoip looks up the countries of client addresses for the easy-tunnel-lb-agent.
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Database is a MaxMind DB file mapping addresses to countries, such as
+// GeoLite2 Country or GeoIP2 City. It is safe for concurrent use.
+type Database struct {
+	reader *maxminddb.Reader
+
+	// Type is the database type from its metadata, e.g. GeoLite2-Country
+	Type string
+}
+
+// countryRecord holds the fields of a database record Country reads
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Open opens a MaxMind DB file
+func Open(path string) (*Database, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database %s: %v", path, err)
+	}
+	return &Database{reader: reader, Type: reader.Metadata.DatabaseType}, nil
+}
+
+// New parses a MaxMind DB held in memory
+func New(buf []byte) (*Database, error) {
+	reader, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database: %v", err)
+	}
+	return &Database{reader: reader, Type: reader.Metadata.DatabaseType}, nil
+}
+
+// Country returns the ISO 3166-1 code of the country an address is in, or
+// registered to, and "" if it is unknown
+func (db *Database) Country(addr netip.Addr) string {
+	var record countryRecord
+	if err := db.reader.Lookup(net.IP(addr.Unmap().AsSlice()), &record); err != nil {
+		return ""
+	}
+	for _, code := range []string{record.Country.ISOCode, record.RegisteredCountry.ISOCode} {
+		if code != "" {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+// Close releases the database
+func (db *Database) Close() error {
+	return db.reader.Close()
+}
@@ -0,0 +1,187 @@
+package geoip
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// metadataMarker precedes the metadata at the end of a MaxMind DB
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparator is the size of the zeros between the search tree
+// and the data section
+const dataSectionSeparator = 16
+
+// MaxMind DB data types encode writes
+const (
+	typeString = 2
+	typeUint16 = 5
+	typeUint32 = 6
+	typeMap    = 7
+	typeBool   = 14
+)
+
+// encode writes a value in the MaxMind DB data format
+func encode(buf *bytes.Buffer, value interface{}) {
+	control := func(typ, size int) {
+		if typ > 7 {
+			buf.WriteByte(byte(size))
+			buf.WriteByte(byte(typ - 7))
+			return
+		}
+		buf.WriteByte(byte(typ<<5 | size))
+	}
+	switch v := value.(type) {
+	case string:
+		control(typeString, len(v))
+		buf.WriteString(v)
+	case uint16:
+		control(typeUint16, 2)
+		buf.Write([]byte{byte(v >> 8), byte(v)})
+	case uint32:
+		control(typeUint32, 4)
+		buf.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		control(typeBool, n)
+	case map[string]interface{}:
+		control(typeMap, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encode(buf, key)
+			encode(buf, v[key])
+		}
+	}
+}
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": code}}
+}
+
+// buildDatabase builds a database mapping 0.0.0.0/2 to US and 64.0.0.0/2
+// to DE, using records of recordSize bits and, for IPv6 databases, the
+// IPv4 subtree under ::/96
+func buildDatabase(t *testing.T, recordSize, ipVersion int) []byte {
+	t.Helper()
+
+	var data bytes.Buffer
+	usOffset := data.Len()
+	encode(&data, country("US"))
+	deOffset := data.Len()
+	encode(&data, map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "de"}, "is_anycast": true})
+
+	// Nodes: a chain of zero bits for IPv6 databases, then the IPv4 nodes
+	prefixNodes := 0
+	if ipVersion == 6 {
+		prefixNodes = 96
+	}
+	nodeCount := prefixNodes + 2
+	empty := nodeCount
+	dataRecord := func(offset int) int { return nodeCount + dataSectionSeparator + offset }
+
+	var records [][2]int
+	for i := 0; i < prefixNodes; i++ {
+		records = append(records, [2]int{i + 1, empty})
+	}
+	records = append(records, [2]int{prefixNodes + 1, empty})
+	records = append(records, [2]int{dataRecord(usOffset), dataRecord(deOffset)})
+
+	var tree bytes.Buffer
+	for _, r := range records {
+		l, rr := r[0], r[1]
+		switch recordSize {
+		case 24:
+			tree.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(rr >> 16), byte(rr >> 8), byte(rr)})
+		case 28:
+			tree.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>20&0xf0 | rr>>24&0x0f), byte(rr >> 16), byte(rr >> 8), byte(rr)})
+		case 32:
+			tree.Write([]byte{byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l), byte(rr >> 24), byte(rr >> 16), byte(rr >> 8), byte(rr)})
+		}
+	}
+
+	var db bytes.Buffer
+	db.Write(tree.Bytes())
+	db.Write(make([]byte, dataSectionSeparator))
+	db.Write(data.Bytes())
+	db.Write(metadataMarker)
+	encode(&db, map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test-Country",
+	})
+	return db.Bytes()
+}
+
+func TestCountry(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordSize int
+		ipVersion  int
+	}{
+		{name: "IPv4 database with 24-bit records", recordSize: 24, ipVersion: 4},
+		{name: "IPv4 database with 28-bit records", recordSize: 28, ipVersion: 4},
+		{name: "IPv6 database with 32-bit records", recordSize: 32, ipVersion: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := New(buildDatabase(t, tt.recordSize, tt.ipVersion))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if db.Type != "Test-Country" {
+				t.Errorf("Expected type Test-Country, got %q", db.Type)
+			}
+
+			for addr, expected := range map[string]string{
+				"10.0.0.1":         "US",
+				"::ffff:10.0.0.1":  "US",
+				"100.64.0.1":       "DE",
+				"192.0.2.1":        "",
+				"2001:db8::1":      "",
+				"63.255.255.255":   "US",
+				"64.0.0.0":         "DE",
+				"127.255.255.255":  "DE",
+				"128.0.0.0":        "",
+				"255.255.255.255":  "",
+				"fe80::1":          "",
+				"2606:4700::1111":  "",
+				"::ffff:192.0.2.1": "",
+			} {
+				if got := db.Country(netip.MustParseAddr(addr)); got != expected {
+					t.Errorf("Expected country %q for %s, got %q", expected, addr, got)
+				}
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, buildDatabase(t, 24, 6), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	if _, err := Open(path); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.mmdb")
+	if err := os.WriteFile(invalid, []byte("not a database"), 0o644); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+	if _, err := Open(invalid); err == nil {
+		t.Error("Expected an error for a file without metadata")
+	}
+}
@@ -0,0 +1,475 @@
+// Package grpcapi provides the gRPC control-plane API for the easy-tunnel-lb-agent.
+package grpcapi
+
+//go:generate protoc -I ../../proto/tunnel/v1 --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tunnel.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/audit"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Authorizer authenticates and authorizes callers. *api.Handler implements
+// it, so gRPC callers need the same credentials as REST callers and are
+// subject to the same client certificate policy, tenants and hostname
+// reservations.
+type Authorizer interface {
+	AuthenticateCall(r *http.Request, scope string) (*http.Request, error)
+	AuthorizeCall(r *http.Request, tunnelID, hostname string) error
+	CheckReservations(r *http.Request, hostnames ...string) error
+}
+
+// methodScopes are the scopes callers need for each method
+var methodScopes = map[string]string{
+	TunnelService_CreateTunnel_FullMethodName: api.ScopeTunnelsCreate,
+	TunnelService_RemoveTunnel_FullMethodName: api.ScopeTunnelsDelete,
+	TunnelService_ListTunnels_FullMethodName:  api.ScopeTunnelsRead,
+	TunnelService_WatchEvents_FullMethodName:  api.ScopeTunnelsRead,
+}
+
+// Server serves the TunnelService over gRPC
+type Server struct {
+	UnimplementedTunnelServiceServer
+
+	tunnelManager *tunnel.Manager
+	authorizer    Authorizer
+	logger        *zerolog.Logger
+	grpcServer    *grpc.Server
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	// leaderCheck reports whether this agent may change tunnels and, if
+	// not, the address of the agent that may
+	leaderCheck func() (bool, string)
+
+	// auditLog, if set, records tunnel changes
+	auditLog *audit.Log
+
+	// exposePrivateKeys includes the server's private keys in WireGuard
+	// configurations, which omit them by default
+	exposePrivateKeys bool
+}
+
+// NewServer creates a new gRPC server for the given tunnel manager,
+// authorizing callers with authorizer
+func NewServer(tunnelManager *tunnel.Manager, authorizer Authorizer) *Server {
+	return &Server{
+		tunnelManager: tunnelManager,
+		authorizer:    authorizer,
+		logger:        utils.GetModuleLogger(utils.ModuleAPI),
+		done:          make(chan struct{}),
+	}
+}
+
+// SetLeaderCheck makes the server reject tunnel changes while check reports
+// that this agent is a standby
+func (s *Server) SetLeaderCheck(check func() (bool, string)) {
+	s.leaderCheck = check
+}
+
+// SetAuditLog records tunnel changes made through the server to log
+func (s *Server) SetAuditLog(log *audit.Log) {
+	s.auditLog = log
+}
+
+// SetExposePrivateKeys includes the server's private keys in WireGuard
+// configurations
+func (s *Server) SetExposePrivateKeys(expose bool) {
+	s.exposePrivateKeys = expose
+}
+
+// recordAudit records the outcome of a tunnel change
+func (s *Server) recordAudit(r *http.Request, action, tunnelID string, req proto.Message, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	event := audit.Event{
+		Action:        action,
+		Protocol:      "grpc",
+		Caller:        api.CallerIdentity(r),
+		TunnelID:      tunnelID,
+		PayloadSHA256: audit.HashPayload(marshalDeterministic(req)),
+		Success:       err == nil,
+	}
+	if host, _, splitErr := net.SplitHostPort(r.RemoteAddr); splitErr == nil {
+		event.SourceIP = host
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if recordErr := s.auditLog.Record(event); recordErr != nil {
+		s.logger.Error().
+			Err(recordErr).
+			Str("action", action).
+			Msg("Failed to record audit event")
+	}
+}
+
+// checkLeader returns an UNAVAILABLE error if this agent is a standby
+func (s *Server) checkLeader() error {
+	if s.leaderCheck == nil {
+		return nil
+	}
+	if isLeader, leaderAddress := s.leaderCheck(); !isLeader {
+		return status.Error(codes.Unavailable, "This agent is a standby; send requests to the leader at "+leaderAddress)
+	}
+	return nil
+}
+
+// Start starts serving gRPC on the given address. If tlsConfig is nil the
+// server speaks HTTP/2 over cleartext TCP.
+func (s *Server) Start(addr string, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener, tlsConfig)
+}
+
+// Serve starts serving gRPC on listener, like Start
+func (s *Server) Serve(listener net.Listener, tlsConfig *tls.Config) error {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.interceptUnary),
+		grpc.StreamInterceptor(s.interceptStream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s.grpcServer = grpc.NewServer(opts...)
+	RegisterTunnelServiceServer(s.grpcServer, s)
+
+	go func() {
+		if err := s.grpcServer.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			s.logger.Error().Err(err).Msg("gRPC server error")
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown gracefully stops the server, ending any open event streams. Calls
+// still running when ctx ends are cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.done) })
+	if s.grpcServer == nil {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+type callerKey struct{}
+
+// authenticate identifies the caller of method, returning a context carrying
+// the caller
+func (s *Server) authenticate(ctx context.Context, method string) (context.Context, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md.Get("authorization") {
+			r.Header.Add("Authorization", value)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+
+	r, err = s.authorizer.AuthenticateCall(r, methodScopes[method])
+	if err != nil {
+		return nil, authStatus(err)
+	}
+	return context.WithValue(ctx, callerKey{}, r), nil
+}
+
+// callerFrom returns the request describing the caller, as built by authenticate
+func callerFrom(ctx context.Context) *http.Request {
+	return ctx.Value(callerKey{}).(*http.Request)
+}
+
+// authorize fails if the caller may not manage the tunnel; see
+// Authorizer.AuthorizeCall
+func (s *Server) authorize(r *http.Request, tunnelID, hostname string) error {
+	if err := s.authorizer.AuthorizeCall(r, tunnelID, hostname); err != nil {
+		s.logger.Warn().
+			Str("tunnel_id", tunnelID).
+			Str("caller", api.CallerIdentity(r)).
+			Msg("gRPC caller not allowed to manage tunnel")
+		return authStatus(err)
+	}
+	return nil
+}
+
+// interceptUnary authenticates the callers of unary methods and logs failed calls
+func (s *Server) interceptUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err == nil {
+		var resp any
+		if resp, err = handler(ctx, req); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, s.callFailed(info.FullMethod, err)
+}
+
+// interceptStream authenticates the callers of streaming methods and logs failed calls
+func (s *Server) interceptStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context(), info.FullMethod)
+	if err == nil {
+		if err = handler(srv, &callerStream{ServerStream: stream, ctx: ctx}); err == nil {
+			return nil
+		}
+	}
+	return s.callFailed(info.FullMethod, err)
+}
+
+// callerStream is a server stream whose context carries the caller
+type callerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (c *callerStream) Context() context.Context {
+	return c.ctx
+}
+
+// callFailed logs the error of a call, returning it as a status error
+func (s *Server) callFailed(method string, err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.New(errorCode(err), err.Error())
+	}
+	s.logger.Error().
+		Err(err).
+		Str("method", method).
+		Str("grpc_code", st.Code().String()).
+		Msg("gRPC call failed")
+	return st.Err()
+}
+
+// CreateTunnel registers a new tunnel owned by the caller's tenant
+func (s *Server) CreateTunnel(ctx context.Context, req *CreateTunnelRequest) (*CreateTunnelResponse, error) {
+	r := callerFrom(ctx)
+	resp, err := s.createTunnel(r, req)
+	s.recordAudit(r, audit.ActionTunnelCreate, req.TunnelId, req, err)
+	return resp, err
+}
+
+func (s *Server) createTunnel(r *http.Request, req *CreateTunnelRequest) (*CreateTunnelResponse, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	// Without a hostname the tunnel gets a subdomain of the base domain
+	baseDomain := s.tunnelManager.BaseDomain()
+	if req.TunnelId == "" || (req.Hostname == "" && baseDomain == "") || req.TargetPort <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Missing required fields")
+	}
+	requested, hostname := "*."+baseDomain, ""
+	if req.Hostname != "" {
+		var err error
+		if hostname, err = loadbalancer.NormalizeHostname(req.Hostname); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		requested = hostname
+	}
+	if err := s.authorize(r, req.TunnelId, requested); err != nil {
+		return nil, err
+	}
+	if err := s.authorizer.CheckReservations(r, hostname); err != nil {
+		return nil, authStatus(err)
+	}
+
+	tunnelInfo, err := s.tunnelManager.CreateTunnelForTenant(
+		api.CallerTenant(r),
+		req.TunnelId,
+		hostname,
+		int(req.TargetPort),
+		req.WireguardPublicKey,
+		req.Metadata,
+		tunnel.WireGuardOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CreateTunnelResponse{
+		TunnelId:       tunnelInfo.ID,
+		PublicEndpoint: tunnelInfo.PublicEndpoint,
+	}
+	if tunnelInfo.WireGuardConfig != nil {
+		resp.WireguardConfig = &WireGuardConfig{
+			PublicKey:  tunnelInfo.WireGuardConfig.PublicKey,
+			ServerIp:   tunnelInfo.WireGuardConfig.ServerIP,
+			ClientIp:   tunnelInfo.WireGuardConfig.ClientIP,
+			Port:       int32(tunnelInfo.WireGuardConfig.Port),
+			ServerIpv6: tunnelInfo.WireGuardConfig.ServerIPv6,
+			ClientIpv6: tunnelInfo.WireGuardConfig.ClientIPv6,
+		}
+		if s.exposePrivateKeys {
+			resp.WireguardConfig.PrivateKey = tunnelInfo.WireGuardConfig.PrivateKey
+		}
+	}
+
+	return resp, nil
+}
+
+// RemoveTunnel removes an existing tunnel
+func (s *Server) RemoveTunnel(ctx context.Context, req *RemoveTunnelRequest) (*RemoveTunnelResponse, error) {
+	r := callerFrom(ctx)
+	resp, err := s.removeTunnel(r, req)
+	s.recordAudit(r, audit.ActionTunnelRemove, req.TunnelId, req, err)
+	return resp, err
+}
+
+func (s *Server) removeTunnel(r *http.Request, req *RemoveTunnelRequest) (*RemoveTunnelResponse, error) {
+	if err := s.checkLeader(); err != nil {
+		return nil, err
+	}
+	if req.TunnelId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing tunnel ID")
+	}
+	if err := s.authorize(r, req.TunnelId, ""); err != nil {
+		return nil, err
+	}
+
+	if err := s.tunnelManager.RemoveTunnel(req.TunnelId); err != nil {
+		return nil, err
+	}
+
+	return &RemoveTunnelResponse{
+		Success: true,
+		Message: "Tunnel removed successfully",
+	}, nil
+}
+
+// ListTunnels returns the tunnels the caller may manage
+func (s *Server) ListTunnels(ctx context.Context, req *ListTunnelsRequest) (*ListTunnelsResponse, error) {
+	r := callerFrom(ctx)
+	resp := &ListTunnelsResponse{}
+	for _, t := range s.tunnelManager.GetAllTunnels() {
+		if s.authorizer.AuthorizeCall(r, t.ID, t.Hostname) != nil {
+			continue
+		}
+		resp.Tunnels = append(resp.Tunnels, &Tunnel{
+			TunnelId:       t.ID,
+			Hostname:       t.Hostname,
+			TargetPort:     int32(t.TargetPort),
+			PublicEndpoint: t.PublicEndpoint,
+			Created:        t.Created.Unix(),
+			LastActive:     t.LastActive.Unix(),
+			Metadata:       t.Metadata,
+		})
+	}
+	return resp, nil
+}
+
+// WatchEvents streams the events of the tunnels the caller may manage until
+// the client disconnects
+func (s *Server) WatchEvents(req *WatchEventsRequest, stream grpc.ServerStreamingServer[TunnelEvent]) error {
+	ctx := stream.Context()
+	r := callerFrom(ctx)
+	events, cancel := s.tunnelManager.Subscribe(64)
+	defer cancel()
+
+	// Send the headers, so the client knows the stream is open
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if req.TunnelId != "" && event.TunnelID != req.TunnelId {
+				continue
+			}
+			if s.authorizer.AuthorizeCall(r, event.TunnelID, event.Hostname) != nil {
+				continue
+			}
+
+			msg := &TunnelEvent{
+				Type:      string(event.Type),
+				TunnelId:  event.TunnelID,
+				Hostname:  event.Hostname,
+				Timestamp: event.Time.UnixNano(),
+				Message:   event.Message,
+			}
+			if err := stream.Send(msg); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// authStatus returns the status of an error of the authorizer
+func authStatus(err error) error {
+	switch {
+	case errors.Is(err, api.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, "Unauthorized")
+	case errors.Is(err, api.ErrRateLimited):
+		return status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+	case errors.Is(err, api.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// errorCode returns the status code of an error of the tunnel manager or
+// router
+func errorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, tunnel.ErrNotFound), errors.Is(err, loadbalancer.ErrNotFound):
+		return codes.NotFound
+	case errors.Is(err, tunnel.ErrConflict), errors.Is(err, loadbalancer.ErrConflict):
+		return codes.AlreadyExists
+	case errors.Is(err, tunnel.ErrLimitExceeded):
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
+
+// marshalDeterministic encodes msg with sorted map keys, so that equal
+// requests have the same audit payload hash
+func marshalDeterministic(msg proto.Message) []byte {
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	return data
+}
@@ -0,0 +1,302 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// startServer serves server over an in-memory listener, returning a client
+// connected to it
+func startServer(t *testing.T, server *Server) TunnelServiceClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	if err := server.Serve(listener, nil); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewTunnelServiceClient(conn)
+}
+
+// newTestServer creates a server for manager whose callers are authorized by
+// an API handler with authenticators
+func newTestServer(manager *tunnel.Manager, authenticators ...api.Authenticator) *Server {
+	handler := api.NewHandler(manager, "test")
+	for _, auth := range authenticators {
+		handler.AddAuthenticator(auth)
+	}
+	return NewServer(manager, handler)
+}
+
+// withToken returns a context sending token as the caller's credentials
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	original := &CreateTunnelRequest{
+		TunnelId:           "test-1",
+		Hostname:           "test.example.com",
+		TargetPort:         8080,
+		WireguardPublicKey: "pubkey",
+		Metadata:           map[string]string{"env": "test", "team": "core"},
+	}
+
+	data, err := proto.Marshal(original)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	decoded := &CreateTunnelRequest{}
+	if err := proto.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	if decoded.TunnelId != original.TunnelId {
+		t.Errorf("Expected tunnel ID %s, got %s", original.TunnelId, decoded.TunnelId)
+	}
+	if decoded.Hostname != original.Hostname {
+		t.Errorf("Expected hostname %s, got %s", original.Hostname, decoded.Hostname)
+	}
+	if decoded.TargetPort != original.TargetPort {
+		t.Errorf("Expected target port %d, got %d", original.TargetPort, decoded.TargetPort)
+	}
+	if decoded.WireguardPublicKey != original.WireguardPublicKey {
+		t.Errorf("Expected public key %s, got %s", original.WireguardPublicKey, decoded.WireguardPublicKey)
+	}
+	for k, v := range original.Metadata {
+		if decoded.Metadata[k] != v {
+			t.Errorf("Expected metadata %s=%s, got %s", k, v, decoded.Metadata[k])
+		}
+	}
+
+	// Truncated input must be rejected
+	if err := proto.Unmarshal(data[:5], &CreateTunnelRequest{}); err == nil {
+		t.Error("Expected error decoding truncated message, got nil")
+	}
+}
+
+func TestCreateAndListTunnels(t *testing.T) {
+	client := startServer(t, newTestServer(tunnel.NewManager(10)))
+
+	created, err := client.CreateTunnel(context.Background(), &CreateTunnelRequest{
+		TunnelId:   "test-1",
+		Hostname:   "test.example.com",
+		TargetPort: 8080,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	if created.TunnelId != "test-1" {
+		t.Errorf("Expected tunnel ID test-1, got %s", created.TunnelId)
+	}
+
+	list, err := client.ListTunnels(context.Background(), &ListTunnelsRequest{})
+	if err != nil {
+		t.Fatalf("Failed to list tunnels: %v", err)
+	}
+	if len(list.Tunnels) != 1 {
+		t.Fatalf("Expected 1 tunnel, got %d", len(list.Tunnels))
+	}
+	if list.Tunnels[0].Hostname != "test.example.com" {
+		t.Errorf("Expected hostname test.example.com, got %s", list.Tunnels[0].Hostname)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	client := startServer(t, newTestServer(tunnel.NewManager(10)))
+
+	tests := []struct {
+		name         string
+		call         func() error
+		expectedCode codes.Code
+	}{
+		{
+			name: "Missing required fields",
+			call: func() error {
+				_, err := client.CreateTunnel(context.Background(), &CreateTunnelRequest{TunnelId: "test-1"})
+				return err
+			},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "Non-existent tunnel",
+			call: func() error {
+				_, err := client.RemoveTunnel(context.Background(), &RemoveTunnelRequest{TunnelId: "non-existent"})
+				return err
+			},
+			expectedCode: codes.NotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status.Code(tt.call()); code != tt.expectedCode {
+				t.Errorf("Expected code %s, got %s", tt.expectedCode, code)
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	tokens, err := api.NewTokenStore([]api.APIToken{
+		{Name: "ci", Token: "ci-secret", Scopes: []string{api.ScopeTunnelsCreate, api.ScopeTunnelsRead}, Hostnames: []string{"*.ci.example.com"}, Tenant: "team-a"},
+		{Name: "reader", Token: "reader-secret", Scopes: []string{api.ScopeTunnelsRead}},
+		{Name: "other", Token: "other-secret", Scopes: []string{api.ScopeTunnelsCreate}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	client := startServer(t, newTestServer(manager, tokens))
+
+	create := func(ctx context.Context, id, hostname string) error {
+		_, err := client.CreateTunnel(ctx, &CreateTunnelRequest{TunnelId: id, Hostname: hostname, TargetPort: 8080})
+		return err
+	}
+
+	tests := []struct {
+		name         string
+		call         func() error
+		expectedCode codes.Code
+	}{
+		{
+			name:         "No credentials",
+			call:         func() error { return create(context.Background(), "t1", "a.ci.example.com") },
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name:         "Unknown token",
+			call:         func() error { return create(withToken("nope"), "t1", "a.ci.example.com") },
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name:         "Missing scope",
+			call:         func() error { return create(withToken("reader-secret"), "t1", "a.ci.example.com") },
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name:         "Hostname outside the token's hostnames",
+			call:         func() error { return create(withToken("ci-secret"), "t1", "a.prod.example.com") },
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name:         "Allowed",
+			call:         func() error { return create(withToken("ci-secret"), "t1", "a.ci.example.com") },
+			expectedCode: codes.OK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status.Code(tt.call()); code != tt.expectedCode {
+				t.Errorf("Expected code %s, got %s", tt.expectedCode, code)
+			}
+		})
+	}
+
+	// Tunnels belong to the tenant of the caller's credentials
+	info, err := manager.GetTunnel("t1")
+	if err != nil {
+		t.Fatalf("Expected tunnel t1 to exist: %v", err)
+	}
+	if info.Tenant != "team-a" {
+		t.Errorf("Expected tenant team-a, got %q", info.Tenant)
+	}
+
+	// Callers only list the tunnels they may manage
+	list, err := client.ListTunnels(withToken("ci-secret"), &ListTunnelsRequest{})
+	if err != nil {
+		t.Fatalf("Failed to list tunnels: %v", err)
+	}
+	if len(list.Tunnels) != 1 {
+		t.Errorf("Expected 1 tunnel, got %d", len(list.Tunnels))
+	}
+
+	// Hostnames reserved by other callers are off limits
+	if _, err := manager.ReserveHostname("b.ci.example.com", "other"); err != nil {
+		t.Fatalf("Failed to reserve hostname: %v", err)
+	}
+	if code := status.Code(create(withToken("ci-secret"), "t2", "b.ci.example.com")); code != codes.PermissionDenied {
+		t.Errorf("Expected code %s for a reserved hostname, got %s", codes.PermissionDenied, code)
+	}
+	if err := create(withToken("other-secret"), "t2", "b.ci.example.com"); err != nil {
+		t.Errorf("Expected the owner of the reservation to create the tunnel, got %v", err)
+	}
+}
+
+func TestStandbyRejectsChanges(t *testing.T) {
+	server := newTestServer(tunnel.NewManager(10))
+	server.SetLeaderCheck(func() (bool, string) { return false, "http://10.0.0.1:8080" })
+	client := startServer(t, server)
+
+	_, err := client.CreateTunnel(context.Background(), &CreateTunnelRequest{
+		TunnelId:   "test-1",
+		Hostname:   "test.example.com",
+		TargetPort: 8080,
+	})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("Expected code %s, got %s", codes.Unavailable, code)
+	}
+
+	// Reads are served by standbys
+	if _, err := client.ListTunnels(context.Background(), &ListTunnelsRequest{}); err != nil {
+		t.Errorf("Expected list to succeed, got %v", err)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	client := startServer(t, newTestServer(manager))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.WatchEvents(ctx, &WatchEventsRequest{TunnelId: "test-2"})
+	if err != nil {
+		t.Fatalf("Failed to watch events: %v", err)
+	}
+	// The server sends its headers once it has subscribed
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	if _, err := manager.CreateTunnel("test-1", "test1.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	if _, err := manager.CreateTunnel("test-2", "test2.example.com", 8081, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive event: %v", err)
+	}
+	if event.TunnelId != "test-2" {
+		t.Errorf("Expected event for tunnel test-2, got %s", event.TunnelId)
+	}
+	if event.Type != string(tunnel.EventTunnelCreated) {
+		t.Errorf("Expected event type %s, got %s", tunnel.EventTunnelCreated, event.Type)
+	}
+}
@@ -0,0 +1,147 @@
+// Package ha provides leader election and standby mode for the easy-tunnel-lb-agent.
+package ha
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// releaseTimeout bounds giving up the lease on shutdown
+const releaseTimeout = 5 * time.Second
+
+// Elector campaigns for the leader lock and keeps renewing it while leading
+type Elector struct {
+	lock          Lock
+	identity      string
+	address       string
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+	renewDeadline time.Duration
+	logger        *zerolog.Logger
+
+	mu       sync.RWMutex
+	leader   LeaderRecord
+	isLeader bool
+}
+
+// NewElector creates an elector for the agent identified by identity whose
+// API is reachable by other agents at address
+func NewElector(lock Lock, identity, address string, leaseDuration time.Duration) *Elector {
+	return &Elector{
+		lock:          lock,
+		identity:      identity,
+		address:       address,
+		leaseDuration: leaseDuration,
+		retryPeriod:   leaseDuration / 3,
+		renewDeadline: leaseDuration * 2 / 3,
+		logger:        utils.GetLogger(),
+	}
+}
+
+// IsLeader reports whether this agent currently holds the lock
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.isLeader
+}
+
+// Leader returns the last known leader
+func (e *Elector) Leader() LeaderRecord {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// Run campaigns until ctx is cancelled. onStartedLeading is called when this
+// agent becomes leader, with a context cancelled when leadership is lost;
+// onStoppedLeading is called after losing leadership.
+func (e *Elector) Run(ctx context.Context, onStartedLeading func(ctx context.Context), onStoppedLeading func()) {
+	e.logger.Info().
+		Str("identity", e.identity).
+		Dur("lease_duration", e.leaseDuration).
+		Msg("Starting leader election")
+
+	stopLeading := func() {}
+	var lastRenew time.Time
+
+	stepDown := func() {
+		stopLeading()
+		e.setLeader(e.Leader(), false)
+		onStoppedLeading()
+	}
+
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		leading := e.IsLeader()
+		record, err := e.lock.TryAcquire(ctx, LeaderRecord{
+			HolderIdentity: e.identity,
+			Address:        e.address,
+			AcquireTime:    now,
+			RenewTime:      now,
+			LeaseDuration:  e.leaseDuration,
+		})
+
+		switch {
+		case err != nil:
+			e.logger.Warn().Err(err).Msg("Failed to acquire or renew leader lock")
+			// Keep leading until the lease could have expired for the others
+			if leading && now.Sub(lastRenew) > e.renewDeadline {
+				e.logger.Error().Msg("Failed to renew leader lock in time, stepping down")
+				stepDown()
+			}
+		case record.HolderIdentity == e.identity:
+			lastRenew = now
+			if !leading {
+				e.logger.Info().Str("identity", e.identity).Msg("Became leader")
+				e.setLeader(record, true)
+				leaderCtx, cancel := context.WithCancel(ctx)
+				stopLeading = cancel
+				onStartedLeading(leaderCtx)
+			} else {
+				e.setLeader(record, true)
+			}
+		default:
+			if leading {
+				e.logger.Warn().Str("leader", record.HolderIdentity).Msg("Lost leader lock, stepping down")
+				stepDown()
+				e.setLeader(record, false)
+			} else {
+				if previous := e.Leader(); previous.HolderIdentity != record.HolderIdentity {
+					e.logger.Info().
+						Str("leader", record.HolderIdentity).
+						Str("address", record.Address).
+						Msg("Following leader")
+				}
+				e.setLeader(record, false)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if e.IsLeader() {
+				stepDown()
+				releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+				if err := e.lock.Release(releaseCtx, e.identity); err != nil {
+					e.logger.Error().Err(err).Msg("Failed to release leader lock")
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) setLeader(record LeaderRecord, isLeader bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leader = record
+	e.isLeader = isLeader
+}
@@ -0,0 +1,156 @@
+package ha
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	lock := NewFileLock(filepath.Join(t.TempDir(), "agent.lease"))
+	ctx := context.Background()
+	now := time.Now()
+
+	candidate := func(identity string, at time.Time) LeaderRecord {
+		return LeaderRecord{
+			HolderIdentity: identity,
+			Address:        "http://" + identity + ":8080",
+			AcquireTime:    at,
+			RenewTime:      at,
+			LeaseDuration:  10 * time.Second,
+		}
+	}
+
+	tests := []struct {
+		name           string
+		identity       string
+		at             time.Time
+		expectedHolder string
+	}{
+		{name: "Acquire free lock", identity: "a", at: now, expectedHolder: "a"},
+		{name: "Held by another agent", identity: "b", at: now.Add(5 * time.Second), expectedHolder: "a"},
+		{name: "Renew own lock", identity: "a", at: now.Add(8 * time.Second), expectedHolder: "a"},
+		{name: "Still held after renewal", identity: "b", at: now.Add(15 * time.Second), expectedHolder: "a"},
+		{name: "Take over expired lock", identity: "b", at: now.Add(30 * time.Second), expectedHolder: "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := lock.TryAcquire(ctx, candidate(tt.identity, tt.at))
+			if err != nil {
+				t.Fatalf("TryAcquire failed: %v", err)
+			}
+			if record.HolderIdentity != tt.expectedHolder {
+				t.Errorf("Expected holder %s, got %s", tt.expectedHolder, record.HolderIdentity)
+			}
+		})
+	}
+
+	// Renewing keeps the original acquire time
+	record, err := lock.TryAcquire(ctx, candidate("b", now.Add(35*time.Second)))
+	if err != nil {
+		t.Fatalf("TryAcquire failed: %v", err)
+	}
+	if !record.AcquireTime.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("Expected acquire time to be kept, got %v", record.AcquireTime)
+	}
+
+	// Releasing as a non-holder does nothing
+	if err := lock.Release(ctx, "a"); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if record, _ := lock.TryAcquire(ctx, candidate("a", now.Add(36*time.Second))); record.HolderIdentity != "b" {
+		t.Errorf("Expected lock to stay with b, got %s", record.HolderIdentity)
+	}
+
+	if err := lock.Release(ctx, "b"); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if record, _ := lock.TryAcquire(ctx, candidate("a", now.Add(37*time.Second))); record.HolderIdentity != "a" {
+		t.Errorf("Expected released lock to be acquired by a, got %s", record.HolderIdentity)
+	}
+}
+
+// electorState records the leadership callbacks of an elector
+type electorState struct {
+	mu      sync.Mutex
+	leading bool
+	started int
+}
+
+func (s *electorState) isLeading() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leading
+}
+
+func runElector(ctx context.Context, elector *Elector, state *electorState, done chan struct{}) {
+	elector.Run(ctx, func(ctx context.Context) {
+		state.mu.Lock()
+		state.leading = true
+		state.started++
+		state.mu.Unlock()
+	}, func() {
+		state.mu.Lock()
+		state.leading = false
+		state.mu.Unlock()
+	})
+	close(done)
+}
+
+func waitUntil(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for leadership change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestElectorFailover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.lease")
+	leaseDuration := 300 * time.Millisecond
+
+	electorA := NewElector(NewFileLock(path), "a", "http://a:8080", leaseDuration)
+	electorB := NewElector(NewFileLock(path), "b", "http://b:8080", leaseDuration)
+	stateA, stateB := &electorState{}, &electorState{}
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	defer stopA()
+	doneA := make(chan struct{})
+	go runElector(ctxA, electorA, stateA, doneA)
+	waitUntil(t, stateA.isLeading)
+
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	doneB := make(chan struct{})
+	go runElector(ctxB, electorB, stateB, doneB)
+
+	// The standby follows the leader without taking over
+	waitUntil(t, func() bool { return electorB.Leader().HolderIdentity == "a" })
+	time.Sleep(2 * leaseDuration)
+	if stateB.isLeading() || electorB.IsLeader() {
+		t.Fatal("Expected b to stay standby while a renews the lock")
+	}
+	if address := electorB.Leader().Address; address != "http://a:8080" {
+		t.Errorf("Expected leader address http://a:8080, got %s", address)
+	}
+
+	// Stopping the leader releases the lock and the standby takes over
+	stopA()
+	<-doneA
+	if stateA.isLeading() || electorA.IsLeader() {
+		t.Error("Expected a to step down on shutdown")
+	}
+	waitUntil(t, stateB.isLeading)
+	if !electorB.IsLeader() {
+		t.Error("Expected b to report leadership")
+	}
+
+	stopB()
+	<-doneB
+}
@@ -0,0 +1,143 @@
+// Package ha provides leader election and standby mode for the easy-tunnel-lb-agent.
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// LeaderRecord describes the agent holding the leader lock
+type LeaderRecord struct {
+	HolderIdentity string        `json:"holder_identity"`
+	Address        string        `json:"address"`
+	AcquireTime    time.Time     `json:"acquire_time"`
+	RenewTime      time.Time     `json:"renew_time"`
+	LeaseDuration  time.Duration `json:"lease_duration"`
+}
+
+// Expired reports whether the holder failed to renew the lease in time
+func (r *LeaderRecord) Expired(now time.Time) bool {
+	return r.HolderIdentity == "" || now.After(r.RenewTime.Add(r.LeaseDuration))
+}
+
+// Lock is a lease shared by all agents of an HA pair
+type Lock interface {
+	// TryAcquire takes or renews the lease for candidate if it is free,
+	// expired or already held by candidate, and returns the resulting holder
+	TryAcquire(ctx context.Context, candidate LeaderRecord) (LeaderRecord, error)
+	// Release gives up the lease if it is held by identity
+	Release(ctx context.Context, identity string) error
+}
+
+// FileLock is a lease stored in a file on storage shared by the agents
+type FileLock struct {
+	path string
+}
+
+// NewFileLock creates a lease stored at path
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// TryAcquire takes or renews the lease for candidate
+func (l *FileLock) TryAcquire(ctx context.Context, candidate LeaderRecord) (LeaderRecord, error) {
+	unlock, err := l.lock()
+	if err != nil {
+		return LeaderRecord{}, err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil {
+		return LeaderRecord{}, err
+	}
+
+	if current != nil && current.HolderIdentity == candidate.HolderIdentity {
+		candidate.AcquireTime = current.AcquireTime
+	} else if current != nil && !current.Expired(candidate.RenewTime) {
+		return *current, nil
+	}
+
+	if err := l.write(&candidate); err != nil {
+		return LeaderRecord{}, err
+	}
+	return candidate, nil
+}
+
+// Release gives up the lease if it is held by identity
+func (l *FileLock) Release(ctx context.Context, identity string) error {
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := l.read()
+	if err != nil || current == nil || current.HolderIdentity != identity {
+		return err
+	}
+	return l.write(&LeaderRecord{})
+}
+
+// lock serializes access to the lease file between processes
+func (l *FileLock) lock() (func(), error) {
+	file, err := os.OpenFile(l.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock lock file: %v", err)
+	}
+	return func() {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+func (l *FileLock) read() (*LeaderRecord, error) {
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease file: %v", err)
+	}
+
+	var record LeaderRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode lease file: %v", err)
+	}
+	return &record, nil
+}
+
+// write replaces the lease file atomically
+func (l *FileLock) write(record *LeaderRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write lease file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write lease file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write lease file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("failed to write lease file: %v", err)
+	}
+	return nil
+}
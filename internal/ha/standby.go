@@ -0,0 +1,165 @@
+// Package ha provides leader election and standby mode for the easy-tunnel-lb-agent.
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// stateSyncInterval is how often a standby copies the leader's tunnels
+const stateSyncInterval = 2 * time.Second
+
+// StateSyncer keeps a warm copy of the leader's tunnels on a standby agent so
+// it can take over without clients re-registering
+type StateSyncer struct {
+	elector       *Elector
+	tunnelManager *tunnel.Manager
+	httpClient    *http.Client
+	logger        *zerolog.Logger
+}
+
+// NewStateSyncer creates a syncer copying tunnels into tunnelManager while
+// elector reports that this agent is a standby
+func NewStateSyncer(elector *Elector, tunnelManager *tunnel.Manager) *StateSyncer {
+	return &StateSyncer{
+		elector:       elector,
+		tunnelManager: tunnelManager,
+		httpClient:    &http.Client{Timeout: stateSyncInterval},
+		logger:        utils.GetLogger(),
+	}
+}
+
+// Run copies the leader's tunnels until ctx is cancelled
+func (s *StateSyncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(stateSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		leader := s.elector.Leader()
+		if s.elector.IsLeader() || leader.Address == "" {
+			continue
+		}
+
+		state, err := s.fetch(ctx, leader.Address)
+		if err != nil {
+			s.logger.Warn().
+				Err(err).
+				Str("leader", leader.HolderIdentity).
+				Msg("Failed to fetch tunnel state from leader")
+			continue
+		}
+
+		// Leadership may have changed while fetching
+		if !s.elector.IsLeader() {
+			s.apply(state)
+		}
+	}
+}
+
+// fetch gets the leader's tunnels, falling back to the pre-versioning path
+// for leaders that do not serve the current API version yet
+func (s *StateSyncer) fetch(ctx context.Context, address string) (*api.HAStateResponse, error) {
+	var err error
+	for _, path := range []string{api.VersionPath("/ha/state"), "/api/ha/state"} {
+		var state *api.HAStateResponse
+		state, err = s.fetchPath(ctx, strings.TrimSuffix(address, "/")+path)
+		if err != errNotFound {
+			return state, err
+		}
+	}
+	return nil, err
+}
+
+// errNotFound is returned by fetchPath if the leader does not serve the path
+var errNotFound = errors.New("tunnel state endpoint not found")
+
+func (s *StateSyncer) fetchPath(ctx context.Context, url string) (*api.HAStateResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var state api.HAStateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode tunnel state: %v", err)
+	}
+	return &state, nil
+}
+
+// apply makes the local tunnels match the leader's
+func (s *StateSyncer) apply(state *api.HAStateResponse) {
+	wanted := make(map[string]bool, len(state.Tunnels))
+	for _, t := range state.Tunnels {
+		wanted[t.TunnelID] = true
+
+		opts := tunnel.WireGuardOptions{
+			PersistentKeepalive: t.PersistentKeepalive,
+			MTU:                 t.MTU,
+			KeyRotationInterval: time.Duration(t.KeyRotationIntervalSeconds) * time.Second,
+			Interface:           t.WireGuardInterface,
+		}
+		if _, err := s.tunnelManager.CreateTunnelWithOptions(t.TunnelID, t.Hostname, t.TargetPort, t.WireGuardPublicKey, t.Metadata, opts); err == nil {
+			s.setProxyOptions(t)
+			continue
+		}
+
+		// The tunnel exists with an outdated configuration, so replace it
+		if _, err := s.tunnelManager.GetTunnel(t.TunnelID); err == nil {
+			if err := s.tunnelManager.RemoveTunnel(t.TunnelID); err != nil {
+				s.logger.Error().Err(err).Str("tunnel_id", t.TunnelID).Msg("Failed to replace standby tunnel")
+				continue
+			}
+		}
+		if _, err := s.tunnelManager.CreateTunnelWithOptions(t.TunnelID, t.Hostname, t.TargetPort, t.WireGuardPublicKey, t.Metadata, opts); err != nil {
+			s.logger.Error().Err(err).Str("tunnel_id", t.TunnelID).Msg("Failed to copy tunnel from leader")
+			continue
+		}
+		s.setProxyOptions(t)
+	}
+
+	for _, t := range s.tunnelManager.GetAllTunnels() {
+		if wanted[t.ID] {
+			continue
+		}
+		if err := s.tunnelManager.RemoveTunnel(t.ID); err != nil {
+			s.logger.Error().Err(err).Str("tunnel_id", t.ID).Msg("Failed to remove standby tunnel")
+		}
+	}
+}
+
+// setProxyOptions copies the load balancer settings of a tunnel from the
+// leader
+func (s *StateSyncer) setProxyOptions(t api.HATunnel) {
+	if err := api.ApplyTunnelOptions(s.tunnelManager, t); err != nil {
+		s.logger.Error().Err(err).Str("tunnel_id", t.TunnelID).Msg("Failed to copy tunnel settings from leader")
+	}
+}
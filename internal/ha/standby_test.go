@@ -0,0 +1,59 @@
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+func TestStateSyncerApply(t *testing.T) {
+	state := api.HAStateResponse{Tunnels: []api.HATunnel{
+		{TunnelID: "web", Hostname: "web.example.com", TargetPort: 8080},
+		{TunnelID: "api", Hostname: "api.example.com", TargetPort: 9090, Metadata: map[string]string{"team": "a"}},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/ha/state" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(state)
+	}))
+	defer server.Close()
+
+	manager := tunnel.NewManager(10)
+	// Outdated copy of a leader tunnel
+	if _, err := manager.CreateTunnel("api", "api.example.com", 8000, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	// Tunnel the leader no longer has
+	if _, err := manager.CreateTunnel("old", "old.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	syncer := NewStateSyncer(NewElector(nil, "b", "", 0), manager)
+	fetched, err := syncer.fetch(context.Background(), server.URL+"/")
+	if err != nil {
+		t.Fatalf("Failed to fetch state: %v", err)
+	}
+	syncer.apply(fetched)
+
+	tunnels := manager.GetAllTunnels()
+	if len(tunnels) != 2 {
+		t.Fatalf("Expected 2 tunnels, got %d", len(tunnels))
+	}
+	apiTunnel, err := manager.GetTunnel("api")
+	if err != nil {
+		t.Fatalf("Expected api tunnel: %v", err)
+	}
+	if apiTunnel.TargetPort != 9090 || apiTunnel.Metadata["team"] != "a" {
+		t.Errorf("Expected api tunnel to be replaced, got port %d", apiTunnel.TargetPort)
+	}
+	if _, err := manager.GetTunnel("old"); err == nil {
+		t.Error("Expected tunnel missing on the leader to be removed")
+	}
+}
@@ -0,0 +1,41 @@
+// Package kubernetes provides the Kubernetes operator mode for the easy-tunnel-lb-agent.
+package kubernetes
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/dynamic"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Client holds the clients of the Kubernetes APIs used by the controllers:
+// the typed clientset for Services and Leases, and a dynamic client for the
+// Gateway API resources, which are custom resources
+type Client struct {
+	kube    clientset.Interface
+	dynamic dynamic.Interface
+}
+
+// NewClient creates a client for the API server described by config
+func NewClient(config *rest.Config) (*Client, error) {
+	kube, err := clientset.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes dynamic client: %v", err)
+	}
+	return &Client{kube: kube, dynamic: dynamicClient}, nil
+}
+
+// NewInClusterClient creates a client using the service account of the pod
+// the agent runs in
+func NewInClusterClient() (*Client, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster: %v", err)
+	}
+	return NewClient(config)
+}
@@ -0,0 +1,285 @@
+// Package kubernetes provides the Kubernetes operator mode for the easy-tunnel-lb-agent.
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Annotations that opt a LoadBalancer Service into easy-tunnel-lb
+const (
+	// AnnotationHostname is the public hostname to route to the Service (required)
+	AnnotationHostname = "easy-tunnel-lb.io/hostname"
+	// AnnotationPort selects the Service port to tunnel by name or number
+	// (defaults to the first port)
+	AnnotationPort = "easy-tunnel-lb.io/port"
+	// AnnotationWireGuardPublicKey is the WireGuard public key of the tunnel client
+	AnnotationWireGuardPublicKey = "easy-tunnel-lb.io/wireguard-public-key"
+)
+
+// Metadata keys set on tunnels created for Services
+const (
+	metadataSource    = "source"
+	metadataNamespace = "kubernetes.namespace"
+	metadataService   = "kubernetes.service"
+	sourceKubernetes  = "kubernetes"
+)
+
+// retryInterval is how long to wait before watching again after a failure
+const retryInterval = 5 * time.Second
+
+// Controller keeps tunnels in sync with annotated LoadBalancer Services
+type Controller struct {
+	client        *Client
+	tunnelManager *tunnel.Manager
+	namespace     string
+	logger        *zerolog.Logger
+}
+
+// NewController creates a controller watching Services in namespace, or in
+// all namespaces if namespace is empty
+func NewController(client *Client, tunnelManager *tunnel.Manager, namespace string) *Controller {
+	return &Controller{
+		client:        client,
+		tunnelManager: tunnelManager,
+		namespace:     namespace,
+		logger:        utils.GetModuleLogger(utils.ModuleKubernetes),
+	}
+}
+
+// Run watches Services until ctx is cancelled. The informer lists the
+// Services again whenever its watch cannot resume, such as after its
+// resource version expired, and reports the changes it missed.
+func (c *Controller) Run(ctx context.Context) {
+	c.logger.Info().
+		Str("namespace", c.namespace).
+		Msg("Starting Kubernetes service controller")
+
+	factory := informers.NewSharedInformerFactoryWithOptions(c.client.kube, 0, informers.WithNamespace(c.namespace))
+	informer := factory.Core().V1().Services().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.handleService(ctx, obj) },
+		UpdateFunc: func(_, obj interface{}) { c.handleService(ctx, obj) },
+		DeleteFunc: c.handleDelete,
+	})
+	if err != nil {
+		c.logger.Error().Err(err).Msg("Failed to watch Kubernetes services")
+		return
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+
+	// Remove tunnels for Services deleted while we were not watching
+	c.removeStale(informer.GetStore().ListKeys())
+	<-ctx.Done()
+}
+
+// removeStale removes the tunnels of Services other than those with the
+// given namespace/name keys
+func (c *Controller) removeStale(keys []string) {
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if namespace, name, err := cache.SplitMetaNamespaceKey(key); err == nil {
+			seen[TunnelID(namespace, name)] = true
+		}
+	}
+	for _, t := range c.tunnelManager.GetAllTunnels() {
+		if !c.owns(t) || seen[t.ID] {
+			continue
+		}
+		c.removeTunnel(t.ID)
+	}
+}
+
+// handleService reconciles an added or updated Service
+func (c *Controller) handleService(ctx context.Context, obj interface{}) {
+	if svc, ok := obj.(*corev1.Service); ok {
+		c.reconcile(ctx, svc)
+	}
+}
+
+// handleDelete removes the tunnel of a deleted Service, including one whose
+// deletion the informer only noticed when listing again
+func (c *Controller) handleDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if svc, ok := obj.(*corev1.Service); ok {
+		c.removeTunnel(TunnelID(svc.Namespace, svc.Name))
+	}
+}
+
+// reconcile creates, updates or removes the tunnel for a Service and writes
+// its public endpoint back to the Service status. It reports whether the
+// Service should have a tunnel.
+func (c *Controller) reconcile(ctx context.Context, svc *corev1.Service) bool {
+	id := TunnelID(svc.Namespace, svc.Name)
+	hostname := svc.Annotations[AnnotationHostname]
+
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || hostname == "" {
+		if t, err := c.tunnelManager.GetTunnel(id); err == nil && c.owns(t) {
+			c.removeTunnel(id)
+			c.updateStatus(ctx, svc, nil)
+		}
+		return false
+	}
+
+	port, err := servicePort(svc)
+	if err != nil {
+		c.logger.Warn().
+			Err(err).
+			Str("namespace", svc.Namespace).
+			Str("service", svc.Name).
+			Msg("Skipping service")
+		return false
+	}
+
+	metadata := map[string]string{
+		metadataSource:    sourceKubernetes,
+		metadataNamespace: svc.Namespace,
+		metadataService:   svc.Name,
+	}
+	publicKey := svc.Annotations[AnnotationWireGuardPublicKey]
+
+	tunnelInfo, err := ensureTunnel(c.tunnelManager, id, hostname, port, publicKey, metadata)
+	if err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("namespace", svc.Namespace).
+			Str("service", svc.Name).
+			Msg("Failed to create tunnel for service")
+		return true
+	}
+
+	endpoint := tunnelInfo.PublicEndpoint
+	if endpoint == "" {
+		endpoint = tunnelInfo.Hostname
+	}
+	c.updateStatus(ctx, svc, []corev1.LoadBalancerIngress{{Hostname: endpoint}})
+	return true
+}
+
+// updateStatus writes the ingress addresses to the Service status if they changed
+func (c *Controller) updateStatus(ctx context.Context, svc *corev1.Service, ingress []corev1.LoadBalancerIngress) {
+	if ingressEqual(svc.Status.LoadBalancer.Ingress, ingress) {
+		return
+	}
+
+	if ingress == nil {
+		ingress = []corev1.LoadBalancerIngress{}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: ingress}},
+	})
+	if err == nil {
+		_, err = c.client.kube.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	}
+	if err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("namespace", svc.Namespace).
+			Str("service", svc.Name).
+			Msg("Failed to update service status")
+		return
+	}
+
+	c.logger.Info().
+		Str("namespace", svc.Namespace).
+		Str("service", svc.Name).
+		Interface("ingress", ingress).
+		Msg("Updated service load balancer status")
+}
+
+func (c *Controller) removeTunnel(id string) {
+	t, err := c.tunnelManager.GetTunnel(id)
+	if err != nil || !c.owns(t) {
+		return
+	}
+	if err := c.tunnelManager.RemoveTunnel(id); err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("tunnel_id", id).
+			Msg("Failed to remove tunnel for service")
+	}
+}
+
+// ensureTunnel creates a tunnel, replacing an existing tunnel with the same
+// ID if its configuration changed
+func ensureTunnel(tunnelManager *tunnel.Manager, id, hostname string, port int, publicKey string, metadata map[string]string) (*tunnel.TunnelInfo, error) {
+	tunnelInfo, err := tunnelManager.CreateTunnel(id, hostname, port, publicKey, metadata)
+	if err == nil {
+		return tunnelInfo, nil
+	}
+
+	// The tunnel exists with an outdated configuration, so replace it
+	if _, getErr := tunnelManager.GetTunnel(id); getErr != nil {
+		return nil, err
+	}
+	if err := tunnelManager.RemoveTunnel(id); err != nil {
+		return nil, err
+	}
+	return tunnelManager.CreateTunnel(id, hostname, port, publicKey, metadata)
+}
+
+// owns reports whether a tunnel was created by this controller
+func (c *Controller) owns(t *tunnel.TunnelInfo) bool {
+	if t.Metadata[metadataSource] != sourceKubernetes {
+		return false
+	}
+	return c.namespace == "" || t.Metadata[metadataNamespace] == c.namespace
+}
+
+// TunnelID returns the ID of the tunnel created for a Service. Namespaces and
+// Service names cannot contain dots, so the ID is unambiguous.
+func TunnelID(namespace, name string) string {
+	return "k8s." + namespace + "." + name
+}
+
+// servicePort returns the Service port selected by AnnotationPort, or the
+// first port if the annotation is not set
+func servicePort(svc *corev1.Service) (int, error) {
+	if len(svc.Spec.Ports) == 0 {
+		return 0, fmt.Errorf("service has no ports")
+	}
+
+	selector := svc.Annotations[AnnotationPort]
+	if selector == "" {
+		return int(svc.Spec.Ports[0].Port), nil
+	}
+
+	number, _ := strconv.Atoi(selector)
+	for _, p := range svc.Spec.Ports {
+		if p.Name == selector || int(p.Port) == number {
+			return int(p.Port), nil
+		}
+	}
+	return 0, fmt.Errorf("service has no port %q", selector)
+}
+
+func ingressEqual(a, b []corev1.LoadBalancerIngress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].IP != b[i].IP || a[i].Hostname != b[i].Hostname {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newService(namespace, name string, serviceType corev1.ServiceType, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations},
+		Spec: corev1.ServiceSpec{
+			Type:  serviceType,
+			Ports: []corev1.ServicePort{{Name: "http", Port: 80}, {Name: "admin", Port: 9000}},
+		},
+	}
+}
+
+// waitFor polls condition until it holds or the test times out
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startController runs a controller for a fake API server holding objects
+func startController(t *testing.T, manager *tunnel.Manager, objects ...runtime.Object) *fake.Clientset {
+	t.Helper()
+
+	kube := fake.NewClientset(objects...)
+	controller := NewController(&Client{kube: kube}, manager, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		controller.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return kube
+}
+
+func TestControllerSync(t *testing.T) {
+	manager := tunnel.NewManager(10)
+
+	// A tunnel for a Service deleted while the controller was not running
+	_, err := manager.CreateTunnel(TunnelID("default", "gone"), "gone.example.com", 80, "", map[string]string{
+		metadataSource:    sourceKubernetes,
+		metadataNamespace: "default",
+		metadataService:   "gone",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	// Tunnels created through the API are left alone
+	if _, err := manager.CreateTunnel("manual", "manual.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	kube := startController(t, manager,
+		newService("default", "web", corev1.ServiceTypeLoadBalancer, map[string]string{
+			AnnotationHostname: "web.example.com",
+			AnnotationPort:     "admin",
+		}),
+		newService("default", "internal", corev1.ServiceTypeClusterIP, map[string]string{
+			AnnotationHostname: "internal.example.com",
+		}),
+		newService("default", "other", corev1.ServiceTypeLoadBalancer, nil),
+	)
+
+	waitFor(t, "the tunnels to be reconciled", func() bool {
+		_, staleErr := manager.GetTunnel(TunnelID("default", "gone"))
+		_, webErr := manager.GetTunnel(TunnelID("default", "web"))
+		return staleErr != nil && webErr == nil
+	})
+
+	tunnelInfo, err := manager.GetTunnel(TunnelID("default", "web"))
+	if err != nil {
+		t.Fatalf("Expected tunnel for annotated service: %v", err)
+	}
+	if tunnelInfo.Hostname != "web.example.com" || tunnelInfo.TargetPort != 9000 {
+		t.Errorf("Unexpected tunnel %s:%d", tunnelInfo.Hostname, tunnelInfo.TargetPort)
+	}
+
+	for _, id := range []string{TunnelID("default", "internal"), TunnelID("default", "other")} {
+		if _, err := manager.GetTunnel(id); err == nil {
+			t.Errorf("Expected no tunnel %s", id)
+		}
+	}
+	if _, err := manager.GetTunnel("manual"); err != nil {
+		t.Error("Expected manually created tunnel to be kept")
+	}
+
+	var ingress []corev1.LoadBalancerIngress
+	waitFor(t, "the service status to be updated", func() bool {
+		svc, err := kube.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get service: %v", err)
+		}
+		ingress = svc.Status.LoadBalancer.Ingress
+		return len(ingress) > 0
+	})
+	if len(ingress) != 1 || ingress[0].Hostname != "web.example.com" {
+		t.Errorf("Unexpected ingress %+v", ingress)
+	}
+}
+
+func TestControllerWatch(t *testing.T) {
+	manager := tunnel.NewManager(10)
+	kube := startController(t, manager)
+	services := kube.CoreV1().Services("default")
+	ctx := context.Background()
+	id := TunnelID("default", "web")
+
+	svc := newService("default", "web", corev1.ServiceTypeLoadBalancer, map[string]string{
+		AnnotationHostname: "web.example.com",
+	})
+	if _, err := services.Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	waitFor(t, "a tunnel for the added service", func() bool {
+		tunnelInfo, err := manager.GetTunnel(id)
+		return err == nil && tunnelInfo.TargetPort == 80
+	})
+
+	// Changing the hostname replaces the tunnel
+	svc.Annotations[AnnotationHostname] = "www.example.com"
+	if _, err := services.Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update service: %v", err)
+	}
+	waitFor(t, "the tunnel to follow the new hostname", func() bool {
+		tunnelInfo, err := manager.GetTunnel(id)
+		return err == nil && tunnelInfo.Hostname == "www.example.com"
+	})
+
+	if err := services.Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete service: %v", err)
+	}
+	waitFor(t, "the tunnel of the deleted service to be removed", func() bool {
+		_, err := manager.GetTunnel(id)
+		return err != nil
+	})
+}
+
+func TestServicePort(t *testing.T) {
+	tests := []struct {
+		name        string
+		selector    string
+		expected    int
+		shouldError bool
+	}{
+		{name: "Default to first port", selector: "", expected: 80},
+		{name: "Select by name", selector: "admin", expected: 9000},
+		{name: "Select by number", selector: "9000", expected: 9000},
+		{name: "Unknown port", selector: "metrics", shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newService("default", "web", corev1.ServiceTypeLoadBalancer, map[string]string{
+				AnnotationPort: tt.selector,
+			})
+			port, err := servicePort(svc)
+			if tt.shouldError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if port != tt.expected {
+				t.Errorf("Expected port %d, got %d", tt.expected, port)
+			}
+		})
+	}
+}
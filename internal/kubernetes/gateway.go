@@ -0,0 +1,220 @@
+// Package kubernetes provides the Kubernetes operator mode for the easy-tunnel-lb-agent.
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// The Gateway API resources, which have no typed client in client-go
+var (
+	gatewaysResource   = schema.GroupVersionResource{Group: gatewayGroup, Version: "v1", Resource: "gateways"}
+	httpRoutesResource = schema.GroupVersionResource{Group: gatewayGroup, Version: "v1", Resource: "httproutes"}
+	tcpRoutesResource  = schema.GroupVersionResource{Group: gatewayGroup, Version: "v1alpha2", Resource: "tcproutes"}
+)
+
+// ObjectMeta is the subset of Kubernetes object metadata used by the
+// Gateway API controller
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// Gateway is the subset of a Gateway API Gateway used by the controller
+type Gateway struct {
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     GatewaySpec `json:"spec"`
+}
+
+// GatewaySpec describes a Gateway's class and listeners
+type GatewaySpec struct {
+	GatewayClassName string     `json:"gatewayClassName"`
+	Listeners        []Listener `json:"listeners"`
+}
+
+// Listener is a port and protocol a Gateway accepts traffic on
+type Listener struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// ParentReference identifies the Gateway (and optionally listener) a route attaches to
+type ParentReference struct {
+	Group       *string `json:"group,omitempty"`
+	Kind        *string `json:"kind,omitempty"`
+	Namespace   *string `json:"namespace,omitempty"`
+	Name        string  `json:"name"`
+	SectionName *string `json:"sectionName,omitempty"`
+	Port        *int    `json:"port,omitempty"`
+}
+
+// BackendRef identifies the Service a route forwards traffic to
+type BackendRef struct {
+	Group     *string `json:"group,omitempty"`
+	Kind      *string `json:"kind,omitempty"`
+	Name      string  `json:"name"`
+	Namespace *string `json:"namespace,omitempty"`
+	Port      *int    `json:"port,omitempty"`
+}
+
+// HTTPPathMatch describes how to match request paths
+type HTTPPathMatch struct {
+	Type  *string `json:"type,omitempty"`
+	Value *string `json:"value,omitempty"`
+}
+
+// HTTPRouteMatch is a single request match of an HTTPRoute rule
+type HTTPRouteMatch struct {
+	Path *HTTPPathMatch `json:"path,omitempty"`
+}
+
+// HTTPRouteRule is a set of matches and the backends they route to
+type HTTPRouteRule struct {
+	Matches     []HTTPRouteMatch `json:"matches,omitempty"`
+	BackendRefs []BackendRef     `json:"backendRefs,omitempty"`
+}
+
+// HTTPRouteSpec describes an HTTPRoute
+type HTTPRouteSpec struct {
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+	Hostnames  []string          `json:"hostnames,omitempty"`
+	Rules      []HTTPRouteRule   `json:"rules,omitempty"`
+}
+
+// TCPRouteRule lists the backends of a TCPRoute
+type TCPRouteRule struct {
+	BackendRefs []BackendRef `json:"backendRefs,omitempty"`
+}
+
+// TCPRouteSpec describes a TCPRoute
+type TCPRouteSpec struct {
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+	Rules      []TCPRouteRule    `json:"rules,omitempty"`
+}
+
+// Condition is a Kubernetes status condition
+type Condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	ObservedGeneration int64     `json:"observedGeneration,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message"`
+}
+
+// RouteParentStatus is the status of a route for one of its parents
+type RouteParentStatus struct {
+	ParentRef      ParentReference `json:"parentRef"`
+	ControllerName string          `json:"controllerName"`
+	Conditions     []Condition     `json:"conditions"`
+}
+
+// RouteStatus is the status of an HTTPRoute or TCPRoute
+type RouteStatus struct {
+	Parents []RouteParentStatus `json:"parents"`
+}
+
+// RouteMeta is ObjectMeta with the generation used in route conditions
+type RouteMeta struct {
+	ObjectMeta
+	Generation int64 `json:"generation,omitempty"`
+}
+
+// HTTPRoute is a Gateway API HTTPRoute
+type HTTPRoute struct {
+	Metadata RouteMeta     `json:"metadata"`
+	Spec     HTTPRouteSpec `json:"spec"`
+	Status   RouteStatus   `json:"status"`
+}
+
+// TCPRoute is a Gateway API TCPRoute
+type TCPRoute struct {
+	Metadata RouteMeta    `json:"metadata"`
+	Spec     TCPRouteSpec `json:"spec"`
+	Status   RouteStatus  `json:"status"`
+}
+
+// ListGateways lists the Gateways in a namespace, or in all namespaces if
+// namespace is empty
+func (c *Client) ListGateways(ctx context.Context, namespace string) ([]Gateway, error) {
+	var gateways []Gateway
+	err := c.listGatewayResources(ctx, gatewaysResource, namespace, func() interface{} {
+		gateways = append(gateways, Gateway{})
+		return &gateways[len(gateways)-1]
+	})
+	return gateways, err
+}
+
+// ListHTTPRoutes lists the HTTPRoutes in a namespace, or in all namespaces if
+// namespace is empty
+func (c *Client) ListHTTPRoutes(ctx context.Context, namespace string) ([]HTTPRoute, error) {
+	var routes []HTTPRoute
+	err := c.listGatewayResources(ctx, httpRoutesResource, namespace, func() interface{} {
+		routes = append(routes, HTTPRoute{})
+		return &routes[len(routes)-1]
+	})
+	return routes, err
+}
+
+// ListTCPRoutes lists the TCPRoutes in a namespace, or in all namespaces if
+// namespace is empty
+func (c *Client) ListTCPRoutes(ctx context.Context, namespace string) ([]TCPRoute, error) {
+	var routes []TCPRoute
+	err := c.listGatewayResources(ctx, tcpRoutesResource, namespace, func() interface{} {
+		routes = append(routes, TCPRoute{})
+		return &routes[len(routes)-1]
+	})
+	return routes, err
+}
+
+// UpdateHTTPRouteStatus replaces the parent statuses of an HTTPRoute
+func (c *Client) UpdateHTTPRouteStatus(ctx context.Context, namespace, name string, status RouteStatus) error {
+	return c.patchRouteStatus(ctx, httpRoutesResource, namespace, name, status)
+}
+
+// UpdateTCPRouteStatus replaces the parent statuses of a TCPRoute
+func (c *Client) UpdateTCPRouteStatus(ctx context.Context, namespace, name string, status RouteStatus) error {
+	return c.patchRouteStatus(ctx, tcpRoutesResource, namespace, name, status)
+}
+
+// listGatewayResources lists a Gateway API resource, decoding each object
+// into the value returned by next
+func (c *Client) listGatewayResources(ctx context.Context, resource schema.GroupVersionResource, namespace string, next func() interface{}) error {
+	list, err := c.dynamic.Resource(resource).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, next()); err != nil {
+			return fmt.Errorf("failed to decode %s %s/%s: %v", resource.Resource, item.GetNamespace(), item.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// patchRouteStatus merges status into the status subresource of a route
+func (c *Client) patchRouteStatus(ctx context.Context, resource schema.GroupVersionResource, namespace, name string, status RouteStatus) error {
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	_, err = c.dynamic.Resource(resource).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// watchGatewayResources watches Gateways, HTTPRoutes or TCPRoutes from their
+// current state on
+func (c *Client) watchGatewayResources(ctx context.Context, resource schema.GroupVersionResource, namespace string) (watch.Interface, error) {
+	return c.dynamic.Resource(resource).Namespace(namespace).Watch(ctx, metav1.ListOptions{})
+}
@@ -0,0 +1,620 @@
+// Package kubernetes provides the Kubernetes operator mode for the easy-tunnel-lb-agent.
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// GatewayControllerName is the controller name reported in route statuses
+const GatewayControllerName = "easy-tunnel-lb.io/gateway-controller"
+
+// gatewayGroup is the API group of Gateway API resources
+const gatewayGroup = "gateway.networking.k8s.io"
+
+// resyncInterval is how often all routes are reconciled even without changes
+const resyncInterval = 5 * time.Minute
+
+// Metadata keys set on tunnels created for routes
+const (
+	metadataRoute    = "kubernetes.route"
+	sourceGatewayAPI = "gateway-api"
+)
+
+// Route condition types and reasons defined by the Gateway API
+const (
+	conditionAccepted     = "Accepted"
+	conditionResolvedRefs = "ResolvedRefs"
+
+	reasonAccepted              = "Accepted"
+	reasonNoMatchingParent      = "NoMatchingParent"
+	reasonNotAllowedByListeners = "NotAllowedByListeners"
+	reasonUnsupportedValue      = "UnsupportedValue"
+	reasonResolvedRefs          = "ResolvedRefs"
+	reasonInvalidKind           = "InvalidKind"
+	reasonRefNotPermitted       = "RefNotPermitted"
+	reasonRouteConflict         = "RouteConflict"
+)
+
+// GatewayController registers tunnels and routes for HTTPRoutes and TCPRoutes
+// attached to Gateways of its GatewayClass
+type GatewayController struct {
+	client        *Client
+	tunnelManager *tunnel.Manager
+	router        *loadbalancer.Router
+	namespace     string
+	className     string
+	logger        *zerolog.Logger
+	trigger       chan struct{}
+	mu            sync.Mutex
+}
+
+// routeResult is the outcome of reconciling a route, reported as conditions
+type routeResult struct {
+	accepted       bool
+	acceptedReason string
+	resolvedReason string
+	message        string
+}
+
+// backend is a resolved route backend
+type backend struct {
+	namespace string
+	name      string
+	port      int
+}
+
+// NewGatewayController creates a controller for routes attached to Gateways
+// of className in namespace, or in all namespaces if namespace is empty
+func NewGatewayController(client *Client, tunnelManager *tunnel.Manager, router *loadbalancer.Router, namespace, className string) *GatewayController {
+	return &GatewayController{
+		client:        client,
+		tunnelManager: tunnelManager,
+		router:        router,
+		namespace:     namespace,
+		className:     className,
+		logger:        utils.GetModuleLogger(utils.ModuleKubernetes),
+		trigger:       make(chan struct{}, 1),
+	}
+}
+
+// Run watches Gateways and routes and reconciles them until ctx is cancelled
+func (c *GatewayController) Run(ctx context.Context) {
+	c.logger.Info().
+		Str("namespace", c.namespace).
+		Str("gateway_class", c.className).
+		Msg("Starting Kubernetes Gateway API controller")
+
+	for _, resource := range []schema.GroupVersionResource{gatewaysResource, httpRoutesResource, tcpRoutesResource} {
+		go c.watchResource(ctx, resource)
+	}
+
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+
+	c.requestSync()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.trigger:
+		case <-ticker.C:
+		}
+
+		if err := c.sync(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Error().Err(err).Msg("Failed to reconcile Gateway API routes")
+		}
+	}
+}
+
+// requestSync schedules a reconcile, coalescing requests that arrive while
+// one is pending
+func (c *GatewayController) requestSync() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// watchResource requests a reconcile whenever a Gateway API resource changes.
+// The watch starts from the current state, as sync lists every resource
+// anyway, and is restarted when it ends.
+func (c *GatewayController) watchResource(ctx context.Context, resource schema.GroupVersionResource) {
+	for {
+		err := c.watchChanges(ctx, resource)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.logger.Warn().Err(err).Str("resource", resource.Resource).Msg("Gateway API watch failed, retrying")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// watchChanges requests a reconcile for each change to resource until the
+// watch ends
+func (c *GatewayController) watchChanges(ctx context.Context, resource schema.GroupVersionResource) error {
+	w, err := c.client.watchGatewayResources(ctx, resource, c.namespace)
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	// Changes made while the previous watch was down were missed
+	c.requestSync()
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Error:
+			return apierrors.FromObject(event.Object)
+		case watch.Bookmark:
+		default:
+			c.requestSync()
+		}
+	}
+	return nil
+}
+
+// sync reconciles all routes and removes tunnels whose route is gone or no
+// longer accepted
+func (c *GatewayController) sync(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gatewayList, err := c.client.ListGateways(ctx, c.namespace)
+	if err != nil {
+		return fmt.Errorf("failed to list gateways: %v", err)
+	}
+	gateways := make(map[string]*Gateway)
+	for i := range gatewayList {
+		gw := &gatewayList[i]
+		if gw.Spec.GatewayClassName == c.className {
+			gateways[gw.Metadata.Namespace+"/"+gw.Metadata.Name] = gw
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	httpRoutes, err := c.client.ListHTTPRoutes(ctx, c.namespace)
+	if err != nil {
+		return fmt.Errorf("failed to list HTTP routes: %v", err)
+	}
+	for i := range httpRoutes {
+		for _, id := range c.reconcileHTTPRoute(ctx, &httpRoutes[i], gateways) {
+			seen[id] = true
+		}
+	}
+
+	// TCPRoute is part of the experimental channel and may not be installed
+	tcpRoutes, err := c.client.ListTCPRoutes(ctx, c.namespace)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to list TCP routes: %v", err)
+	}
+	if err == nil {
+		for i := range tcpRoutes {
+			for _, id := range c.reconcileTCPRoute(ctx, &tcpRoutes[i], gateways) {
+				seen[id] = true
+			}
+		}
+	}
+
+	for _, t := range c.tunnelManager.GetAllTunnels() {
+		if c.owns(t) && !seen[t.ID] {
+			c.removeTunnel(t.ID)
+		}
+	}
+
+	return nil
+}
+
+// reconcileHTTPRoute registers the tunnels and path routes of an HTTPRoute
+// and returns the IDs of the tunnels it should have
+func (c *GatewayController) reconcileHTTPRoute(ctx context.Context, route *HTTPRoute, gateways map[string]*Gateway) []string {
+	parents, listenerPorts := c.matchParents(route.Metadata.Namespace, route.Spec.ParentRefs, gateways, "HTTP", "HTTPS")
+	if len(parents) == 0 {
+		return nil
+	}
+
+	var ids []string
+	result := rejected(reasonNoMatchingParent, "no listener of the parent Gateway accepts this route")
+	if len(listenerPorts) > 0 {
+		result = c.registerHTTPRoute(route, &ids)
+	}
+	if !result.programmed() {
+		ids = nil
+	}
+
+	c.updateRouteStatus(ctx, "HTTPRoute", route.Metadata, route.Status, parents, result)
+	return ids
+}
+
+func (c *GatewayController) registerHTTPRoute(route *HTTPRoute, ids *[]string) routeResult {
+	if len(route.Spec.Hostnames) == 0 {
+		return rejected(reasonUnsupportedValue, "hostnames are required")
+	}
+	for _, hostname := range route.Spec.Hostnames {
+		if strings.Contains(hostname, "*") {
+			return rejected(reasonUnsupportedValue, fmt.Sprintf("wildcard hostname %s is not supported", hostname))
+		}
+	}
+
+	type rulePlan struct {
+		backend backend
+		matches []loadbalancer.PathMatch
+	}
+	plans := make([]rulePlan, 0, len(route.Spec.Rules))
+	for _, rule := range route.Spec.Rules {
+		b, result := resolveBackend(route.Metadata.Namespace, rule.BackendRefs)
+		if result != nil {
+			return *result
+		}
+
+		matches, err := pathMatches(rule.Matches)
+		if err != nil {
+			return rejected(reasonUnsupportedValue, err.Error())
+		}
+		plans = append(plans, rulePlan{backend: b, matches: matches})
+	}
+
+	for i, plan := range plans {
+		id := routeTunnelID("httproute", route.Metadata.Namespace, route.Metadata.Name, i)
+		tunnelInfo, err := c.ensureTunnel(id, "HTTPRoute", route.Metadata, route.Spec.Hostnames[0], plan.backend.port)
+		if err != nil {
+			return rejected(reasonUnsupportedValue, err.Error())
+		}
+
+		// Re-register the tunnel's routes at once so changed matches take
+		// effect without requests seeing them half registered
+		ip := targetIP(tunnelInfo, plan.backend)
+		var routes []loadbalancer.Route
+		for _, hostname := range route.Spec.Hostnames {
+			for _, match := range plan.matches {
+				match := match
+				routes = append(routes, loadbalancer.Route{Hostname: hostname, Path: &match, IP: ip, Port: plan.backend.port})
+			}
+		}
+		if err := c.router.ReplaceTunnelRoutes(id, routes); err != nil {
+			c.router.RemoveRoute(id)
+			return rejected(reasonRouteConflict, err.Error())
+		}
+		*ids = append(*ids, id)
+	}
+
+	return routeResult{accepted: true, acceptedReason: reasonAccepted, resolvedReason: reasonResolvedRefs, message: "Route registered"}
+}
+
+// reconcileTCPRoute registers the tunnel of a TCPRoute on the listener port
+// it attaches to and returns the IDs of the tunnels it should have
+func (c *GatewayController) reconcileTCPRoute(ctx context.Context, route *TCPRoute, gateways map[string]*Gateway) []string {
+	parents, listenerPorts := c.matchParents(route.Metadata.Namespace, route.Spec.ParentRefs, gateways, "TCP")
+	if len(parents) == 0 {
+		return nil
+	}
+
+	var ids []string
+	result := rejected(reasonNoMatchingParent, "no listener of the parent Gateway accepts this route")
+	if len(listenerPorts) > 0 {
+		result = c.registerTCPRoute(route, listenerPorts, &ids)
+	}
+	if !result.programmed() {
+		ids = nil
+	}
+
+	c.updateRouteStatus(ctx, "TCPRoute", route.Metadata, route.Status, parents, result)
+	return ids
+}
+
+func (c *GatewayController) registerTCPRoute(route *TCPRoute, listenerPorts []int, ids *[]string) routeResult {
+	if len(route.Spec.Rules) != 1 {
+		return rejected(reasonUnsupportedValue, "exactly one rule is supported")
+	}
+
+	listenPort := 0
+	for _, port := range listenerPorts {
+		if port == c.router.TCPPort() {
+			listenPort = port
+		}
+	}
+	if listenPort == 0 {
+		return rejected(reasonNotAllowedByListeners, fmt.Sprintf("TCP routes must attach to a listener on port %d", c.router.TCPPort()))
+	}
+
+	b, result := resolveBackend(route.Metadata.Namespace, route.Spec.Rules[0].BackendRefs)
+	if result != nil {
+		return *result
+	}
+
+	id := routeTunnelID("tcproute", route.Metadata.Namespace, route.Metadata.Name, 0)
+	tunnelInfo, err := c.ensureTunnel(id, "TCPRoute", route.Metadata, "", b.port)
+	if err != nil {
+		return rejected(reasonUnsupportedValue, err.Error())
+	}
+
+	routes := []loadbalancer.Route{{ListenPort: listenPort, IP: targetIP(tunnelInfo, b), Port: b.port}}
+	if err := c.router.ReplaceTunnelRoutes(id, routes); err != nil {
+		c.router.RemoveRoute(id)
+		return rejected(reasonRouteConflict, err.Error())
+	}
+	*ids = append(*ids, id)
+
+	return routeResult{accepted: true, acceptedReason: reasonAccepted, resolvedReason: reasonResolvedRefs, message: "Route registered"}
+}
+
+// matchParents returns the parent references that point at one of our
+// Gateways, and the ports of the listeners they attach to that accept one of
+// the given protocols
+func (c *GatewayController) matchParents(namespace string, refs []ParentReference, gateways map[string]*Gateway, protocols ...string) ([]ParentReference, []int) {
+	var parents []ParentReference
+	var ports []int
+
+	for _, ref := range refs {
+		if (ref.Group != nil && *ref.Group != gatewayGroup) || (ref.Kind != nil && *ref.Kind != "Gateway") {
+			continue
+		}
+		gwNamespace := namespace
+		if ref.Namespace != nil {
+			gwNamespace = *ref.Namespace
+		}
+		gw, ours := gateways[gwNamespace+"/"+ref.Name]
+		if !ours {
+			continue
+		}
+		parents = append(parents, ref)
+
+		for _, listener := range gw.Spec.Listeners {
+			if ref.SectionName != nil && *ref.SectionName != listener.Name {
+				continue
+			}
+			if ref.Port != nil && *ref.Port != listener.Port {
+				continue
+			}
+			for _, protocol := range protocols {
+				if listener.Protocol == protocol {
+					ports = append(ports, listener.Port)
+				}
+			}
+		}
+	}
+
+	return parents, ports
+}
+
+// updateRouteStatus writes the route's conditions for each of our parents,
+// keeping the statuses written by other controllers
+func (c *GatewayController) updateRouteStatus(ctx context.Context, kind string, meta RouteMeta, current RouteStatus, parents []ParentReference, result routeResult) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	var updated RouteStatus
+	previous := make(map[string]RouteParentStatus)
+	for _, p := range current.Parents {
+		if p.ControllerName == GatewayControllerName {
+			previous[parentKey(p.ParentRef)] = p
+		} else {
+			updated.Parents = append(updated.Parents, p)
+		}
+	}
+
+	changed := len(previous) != len(parents)
+	for _, ref := range parents {
+		conditions := result.conditions(meta.Generation, now)
+		old, exists := previous[parentKey(ref)]
+		if exists && conditionsEqual(old.Conditions, conditions) {
+			conditions = old.Conditions
+		} else {
+			changed = true
+		}
+		updated.Parents = append(updated.Parents, RouteParentStatus{
+			ParentRef:      ref,
+			ControllerName: GatewayControllerName,
+			Conditions:     conditions,
+		})
+	}
+	if !changed {
+		return
+	}
+
+	var err error
+	if kind == "TCPRoute" {
+		err = c.client.UpdateTCPRouteStatus(ctx, meta.Namespace, meta.Name, updated)
+	} else {
+		err = c.client.UpdateHTTPRouteStatus(ctx, meta.Namespace, meta.Name, updated)
+	}
+	if err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("kind", kind).
+			Str("namespace", meta.Namespace).
+			Str("route", meta.Name).
+			Msg("Failed to update route status")
+		return
+	}
+
+	c.logger.Info().
+		Str("kind", kind).
+		Str("namespace", meta.Namespace).
+		Str("route", meta.Name).
+		Bool("accepted", result.accepted).
+		Str("message", result.message).
+		Msg("Updated route status")
+}
+
+// ensureTunnel creates the tunnel for a route rule, replacing it if its
+// configuration changed
+func (c *GatewayController) ensureTunnel(id, kind string, meta RouteMeta, hostname string, port int) (*tunnel.TunnelInfo, error) {
+	metadata := map[string]string{
+		metadataSource:    sourceGatewayAPI,
+		metadataNamespace: meta.Namespace,
+		metadataRoute:     kind + "/" + meta.Name,
+	}
+	publicKey := meta.Annotations[AnnotationWireGuardPublicKey]
+
+	return ensureTunnel(c.tunnelManager, id, hostname, port, publicKey, metadata)
+}
+
+func (c *GatewayController) removeTunnel(id string) {
+	c.router.RemoveRoute(id)
+	if err := c.tunnelManager.RemoveTunnel(id); err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("tunnel_id", id).
+			Msg("Failed to remove tunnel for route")
+	}
+}
+
+// owns reports whether a tunnel was created by this controller
+func (c *GatewayController) owns(t *tunnel.TunnelInfo) bool {
+	if t.Metadata[metadataSource] != sourceGatewayAPI {
+		return false
+	}
+	return c.namespace == "" || t.Metadata[metadataNamespace] == c.namespace
+}
+
+// resolveBackend returns the Service a rule forwards to. Only the first
+// backend is used; traffic splitting is not supported.
+func resolveBackend(namespace string, refs []BackendRef) (backend, *routeResult) {
+	if len(refs) == 0 {
+		r := rejected(reasonUnsupportedValue, "a backend is required")
+		return backend{}, &r
+	}
+
+	ref := refs[0]
+	if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Service") {
+		r := routeResult{accepted: true, acceptedReason: reasonAccepted, resolvedReason: reasonInvalidKind, message: "only Service backends are supported"}
+		return backend{}, &r
+	}
+	if ref.Namespace != nil && *ref.Namespace != namespace {
+		r := routeResult{accepted: true, acceptedReason: reasonAccepted, resolvedReason: reasonRefNotPermitted, message: "cross-namespace backends are not supported"}
+		return backend{}, &r
+	}
+	if ref.Port == nil {
+		r := rejected(reasonUnsupportedValue, "backend port is required")
+		return backend{}, &r
+	}
+
+	return backend{namespace: namespace, name: ref.Name, port: *ref.Port}, nil
+}
+
+// pathMatches converts HTTPRoute matches to router path matches. A rule
+// without matches matches every path.
+func pathMatches(matches []HTTPRouteMatch) ([]loadbalancer.PathMatch, error) {
+	if len(matches) == 0 {
+		return []loadbalancer.PathMatch{{Type: loadbalancer.PathMatchPrefix, Value: "/"}}, nil
+	}
+
+	result := make([]loadbalancer.PathMatch, 0, len(matches))
+	for _, m := range matches {
+		match := loadbalancer.PathMatch{Type: loadbalancer.PathMatchPrefix, Value: "/"}
+		if m.Path != nil {
+			if m.Path.Type != nil {
+				match.Type = loadbalancer.PathMatchType(*m.Path.Type)
+			}
+			if m.Path.Value != nil {
+				match.Value = *m.Path.Value
+			}
+		}
+		if match.Type != loadbalancer.PathMatchPrefix && match.Type != loadbalancer.PathMatchExact {
+			return nil, fmt.Errorf("path match type %s is not supported", match.Type)
+		}
+		result = append(result, match)
+	}
+	return result, nil
+}
+
+// targetIP returns the address to forward a route's traffic to: the tunnel
+// client if it connects over a transport, otherwise the backend Service
+func targetIP(t *tunnel.TunnelInfo, b backend) string {
+	if t.Endpoint != "" {
+		return t.Endpoint
+	}
+	return fmt.Sprintf("%s.%s.svc", b.name, b.namespace)
+}
+
+// routeTunnelID returns the ID of the tunnel created for a route rule
+func routeTunnelID(kind, namespace, name string, rule int) string {
+	return fmt.Sprintf("gw.%s.%s.%s.%d", kind, namespace, name, rule)
+}
+
+func rejected(reason, message string) routeResult {
+	return routeResult{acceptedReason: reason, resolvedReason: reasonResolvedRefs, message: message}
+}
+
+// programmed reports whether the route's tunnels and routes are registered
+func (r routeResult) programmed() bool {
+	return r.accepted && r.resolvedReason == reasonResolvedRefs
+}
+
+// conditions returns the Accepted and ResolvedRefs conditions for a result
+func (r routeResult) conditions(generation int64, now time.Time) []Condition {
+	accepted := "False"
+	if r.accepted {
+		accepted = "True"
+	}
+	resolved := "True"
+	if r.resolvedReason != reasonResolvedRefs {
+		resolved = "False"
+	}
+
+	return []Condition{
+		{
+			Type:               conditionAccepted,
+			Status:             accepted,
+			ObservedGeneration: generation,
+			LastTransitionTime: now,
+			Reason:             r.acceptedReason,
+			Message:            r.message,
+		},
+		{
+			Type:               conditionResolvedRefs,
+			Status:             resolved,
+			ObservedGeneration: generation,
+			LastTransitionTime: now,
+			Reason:             r.resolvedReason,
+			Message:            r.message,
+		},
+	}
+}
+
+// conditionsEqual compares conditions ignoring their transition times
+func conditionsEqual(a, b []Condition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.LastTransitionTime, y.LastTransitionTime = time.Time{}, time.Time{}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+func parentKey(ref ParentReference) string {
+	key := ref.Name
+	if ref.Namespace != nil {
+		key = *ref.Namespace + "/" + key
+	}
+	if ref.SectionName != nil {
+		key += "#" + *ref.SectionName
+	}
+	if ref.Port != nil {
+		key += fmt.Sprintf(":%d", *ref.Port)
+	}
+	return key
+}
@@ -0,0 +1,245 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func strPtr(s string) *string { return &s }
+
+func intPtr(i int) *int { return &i }
+
+// fakeObject is a Gateway API object stored by the fake dynamic client
+type fakeObject struct {
+	resource schema.GroupVersionResource
+	object   interface{}
+}
+
+// fakeKinds are the kinds of the Gateway API resources
+var fakeKinds = map[schema.GroupVersionResource]string{
+	gatewaysResource:   "Gateway",
+	httpRoutesResource: "HTTPRoute",
+	tcpRoutesResource:  "TCPRoute",
+}
+
+// newFakeDynamicClient creates a dynamic client serving objects. They are
+// stored under their resource, since the fake client would guess the
+// resource of a Gateway as "gatewaies".
+func newFakeDynamicClient(t *testing.T, objects ...fakeObject) *dynamicfake.FakeDynamicClient {
+	t.Helper()
+
+	listKinds := make(map[schema.GroupVersionResource]string)
+	for resource, kind := range fakeKinds {
+		listKinds[resource] = kind + "List"
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds)
+	for _, obj := range objects {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj.object)
+		if err != nil {
+			t.Fatalf("Failed to convert %s: %v", obj.resource.Resource, err)
+		}
+		u := &unstructured.Unstructured{Object: content}
+		u.SetAPIVersion(obj.resource.GroupVersion().String())
+		u.SetKind(fakeKinds[obj.resource])
+		if err := client.Tracker().Create(obj.resource, u, u.GetNamespace()); err != nil {
+			t.Fatalf("Failed to store %s: %v", obj.resource.Resource, err)
+		}
+	}
+	return client
+}
+
+// routeStatus returns the status written to a route
+func routeStatus(t *testing.T, client *Client, resource schema.GroupVersionResource, namespace, name string) RouteStatus {
+	t.Helper()
+
+	u, err := client.dynamic.Resource(resource).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get route %s: %v", name, err)
+	}
+	var route HTTPRoute
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &route); err != nil {
+		t.Fatalf("Failed to decode route %s: %v", name, err)
+	}
+	return route.Status
+}
+
+func newGatewayTestController(t *testing.T, routes ...fakeObject) (*GatewayController, *Client, *tunnel.Manager, *loadbalancer.Router) {
+	t.Helper()
+
+	objects := []fakeObject{
+		{gatewaysResource, &Gateway{
+			Metadata: ObjectMeta{Name: "edge", Namespace: "infra"},
+			Spec: GatewaySpec{
+				GatewayClassName: "easy-tunnel-lb",
+				Listeners: []Listener{
+					{Name: "http", Port: 80, Protocol: "HTTP"},
+					{Name: "tcp", Port: 8444, Protocol: "TCP"},
+				},
+			},
+		}},
+		{gatewaysResource, &Gateway{
+			Metadata: ObjectMeta{Name: "other", Namespace: "infra"},
+			Spec:     GatewaySpec{GatewayClassName: "someone-else"},
+		}},
+	}
+	client := &Client{dynamic: newFakeDynamicClient(t, append(objects, routes...)...)}
+
+	manager := tunnel.NewManager(10)
+	router := loadbalancer.NewRouter(&loadbalancer.Config{HTTPPort: 8443, TCPPort: 8444})
+	return NewGatewayController(client, manager, router, "", "easy-tunnel-lb"), client, manager, router
+}
+
+func TestGatewayControllerHTTPRoutes(t *testing.T) {
+	edge := ParentReference{Name: "edge", Namespace: strPtr("infra")}
+	var routes []fakeObject
+	for _, route := range []HTTPRoute{
+		{
+			Metadata: RouteMeta{ObjectMeta: ObjectMeta{Name: "shop", Namespace: "default"}, Generation: 3},
+			Spec: HTTPRouteSpec{
+				ParentRefs: []ParentReference{edge},
+				Hostnames:  []string{"shop.example.com"},
+				Rules: []HTTPRouteRule{
+					{
+						Matches:     []HTTPRouteMatch{{Path: &HTTPPathMatch{Type: strPtr("PathPrefix"), Value: strPtr("/api")}}},
+						BackendRefs: []BackendRef{{Name: "shop-api", Port: intPtr(8080)}},
+					},
+					{
+						BackendRefs: []BackendRef{{Name: "shop-web", Port: intPtr(3000)}},
+					},
+				},
+			},
+		},
+		{
+			Metadata: RouteMeta{ObjectMeta: ObjectMeta{Name: "regex", Namespace: "default"}},
+			Spec: HTTPRouteSpec{
+				ParentRefs: []ParentReference{edge},
+				Hostnames:  []string{"regex.example.com"},
+				Rules: []HTTPRouteRule{{
+					Matches:     []HTTPRouteMatch{{Path: &HTTPPathMatch{Type: strPtr("RegularExpression"), Value: strPtr("/.*")}}},
+					BackendRefs: []BackendRef{{Name: "regex", Port: intPtr(80)}},
+				}},
+			},
+		},
+		{
+			Metadata: RouteMeta{ObjectMeta: ObjectMeta{Name: "foreign", Namespace: "default"}},
+			Spec: HTTPRouteSpec{
+				ParentRefs: []ParentReference{{Name: "other", Namespace: strPtr("infra")}},
+				Hostnames:  []string{"foreign.example.com"},
+				Rules:      []HTTPRouteRule{{BackendRefs: []BackendRef{{Name: "foreign", Port: intPtr(80)}}}},
+			},
+		},
+	} {
+		routes = append(routes, fakeObject{httpRoutesResource, &route})
+	}
+	controller, client, manager, router := newGatewayTestController(t, routes...)
+
+	// A route tunnel whose HTTPRoute no longer exists
+	staleID := routeTunnelID("httproute", "default", "stale", 0)
+	if _, err := manager.CreateTunnel(staleID, "stale.example.com", 80, "", map[string]string{
+		metadataSource:    sourceGatewayAPI,
+		metadataNamespace: "default",
+		metadataRoute:     "HTTPRoute/stale",
+	}); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	if err := controller.sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	tests := []struct {
+		path       string
+		expectedID string
+		expectedIP string
+	}{
+		{"/api/orders", routeTunnelID("httproute", "default", "shop", 0), "shop-api.default.svc"},
+		{"/", routeTunnelID("httproute", "default", "shop", 1), "shop-web.default.svc"},
+	}
+	for _, tt := range tests {
+		target, err := router.Route("shop.example.com", tt.path)
+		if err != nil {
+			t.Fatalf("Expected route for %s: %v", tt.path, err)
+		}
+		if target.ID != tt.expectedID || target.IP != tt.expectedIP {
+			t.Errorf("Expected %s via %s for %s, got %s via %s", tt.expectedID, tt.expectedIP, tt.path, target.ID, target.IP)
+		}
+	}
+
+	if _, err := manager.GetTunnel(staleID); err == nil {
+		t.Error("Expected stale route tunnel to be removed")
+	}
+	if _, err := router.Route("regex.example.com", "/"); err == nil {
+		t.Error("Expected unsupported route not to be registered")
+	}
+	if _, err := router.Route("foreign.example.com", "/"); err == nil {
+		t.Error("Expected route of another gateway class not to be registered")
+	}
+
+	statusTests := []struct {
+		route            string
+		expectedAccepted string
+		expectedReason   string
+	}{
+		{"shop", "True", reasonAccepted},
+		{"regex", "False", reasonUnsupportedValue},
+	}
+	for _, tt := range statusTests {
+		status := routeStatus(t, client, httpRoutesResource, "default", tt.route)
+		if len(status.Parents) != 1 || status.Parents[0].ControllerName != GatewayControllerName {
+			t.Fatalf("Unexpected parents %+v", status.Parents)
+		}
+		accepted := status.Parents[0].Conditions[0]
+		if accepted.Type != conditionAccepted || accepted.Status != tt.expectedAccepted || accepted.Reason != tt.expectedReason {
+			t.Errorf("Unexpected Accepted condition for %s: %+v", tt.route, accepted)
+		}
+	}
+	if status := routeStatus(t, client, httpRoutesResource, "default", "foreign"); len(status.Parents) != 0 {
+		t.Error("Expected no status for a route of another gateway class")
+	}
+}
+
+func TestGatewayControllerTCPRoutes(t *testing.T) {
+	controller, _, _, router := newGatewayTestController(t, fakeObject{tcpRoutesResource, &TCPRoute{
+		Metadata: RouteMeta{ObjectMeta: ObjectMeta{Name: "db", Namespace: "default"}},
+		Spec: TCPRouteSpec{
+			ParentRefs: []ParentReference{{Name: "edge", Namespace: strPtr("infra"), SectionName: strPtr("tcp")}},
+			Rules:      []TCPRouteRule{{BackendRefs: []BackendRef{{Name: "postgres", Port: intPtr(5432)}}}},
+		},
+	}})
+
+	if err := controller.sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	target, err := router.GetTunnelByPort(8444)
+	if err != nil {
+		t.Fatalf("Expected TCP route: %v", err)
+	}
+	if target.IP != "postgres.default.svc" || target.Port != 5432 {
+		t.Errorf("Unexpected target %s:%d", target.IP, target.Port)
+	}
+}
+
+func TestPathMatches(t *testing.T) {
+	matches, err := pathMatches(nil)
+	if err != nil || len(matches) != 1 || matches[0].Value != "/" {
+		t.Errorf("Expected a rule without matches to match every path, got %+v (%v)", matches, err)
+	}
+
+	matches, err = pathMatches([]HTTPRouteMatch{{Path: &HTTPPathMatch{Type: strPtr("Exact"), Value: strPtr("/healthz")}}})
+	if err != nil || matches[0].Type != loadbalancer.PathMatchExact {
+		t.Errorf("Expected exact match, got %+v (%v)", matches, err)
+	}
+
+	if _, err := pathMatches([]HTTPRouteMatch{{Path: &HTTPPathMatch{Type: strPtr("RegularExpression")}}}); err == nil {
+		t.Error("Expected error for regular expression match, got nil")
+	}
+}
@@ -0,0 +1,136 @@
+// Package kubernetes provides the Kubernetes operator mode for the easy-tunnel-lb-agent.
+package kubernetes
+
+import (
+	"context"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ha"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AnnotationLeaderAddress records the API address of the agent holding a Lease
+const AnnotationLeaderAddress = "easy-tunnel-lb.io/leader-address"
+
+// LeaseLock is a leader lock stored in a Lease object
+type LeaseLock struct {
+	client    *Client
+	namespace string
+	name      string
+}
+
+// NewLeaseLock creates a leader lock stored in the named Lease
+func NewLeaseLock(client *Client, namespace, name string) *LeaseLock {
+	return &LeaseLock{client: client, namespace: namespace, name: name}
+}
+
+// TryAcquire takes or renews the Lease for candidate. Updates use the Lease's
+// resource version, so only one of several agents racing for it wins.
+func (l *LeaseLock) TryAcquire(ctx context.Context, candidate ha.LeaderRecord) (ha.LeaderRecord, error) {
+	leases := l.client.kube.CoordinationV1().Leases(l.namespace)
+
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: l.name, Namespace: l.namespace},
+		}
+		setLeaseRecord(lease, candidate)
+		if _, err := leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return leaseConflict(err, candidate)
+		}
+		return candidate, nil
+	}
+	if err != nil {
+		return ha.LeaderRecord{}, err
+	}
+
+	current := leaseRecord(lease)
+	if current.HolderIdentity == candidate.HolderIdentity {
+		candidate.AcquireTime = current.AcquireTime
+	} else if !current.Expired(candidate.RenewTime) {
+		return current, nil
+	} else if lease.Spec.LeaseTransitions != nil {
+		transitions := *lease.Spec.LeaseTransitions + 1
+		lease.Spec.LeaseTransitions = &transitions
+	}
+
+	setLeaseRecord(lease, candidate)
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return leaseConflict(err, current)
+	}
+	return candidate, nil
+}
+
+// Release gives up the Lease if it is held by identity
+func (l *LeaseLock) Release(ctx context.Context, identity string) error {
+	leases := l.client.kube.CoordinationV1().Leases(l.namespace)
+
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if leaseRecord(lease).HolderIdentity != identity {
+		return nil
+	}
+
+	empty := ""
+	lease.Spec.HolderIdentity = &empty
+	lease.Spec.RenewTime = nil
+	delete(lease.Annotations, AnnotationLeaderAddress)
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// leaseConflict turns losing a race for the Lease into its last known holder
+func leaseConflict(err error, holder ha.LeaderRecord) (ha.LeaderRecord, error) {
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		return holder, nil
+	}
+	return ha.LeaderRecord{}, err
+}
+
+// leaseRecord converts a Lease into a leader record
+func leaseRecord(lease *coordinationv1.Lease) ha.LeaderRecord {
+	var record ha.LeaderRecord
+	if lease.Spec.HolderIdentity != nil {
+		record.HolderIdentity = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.LeaseDurationSeconds != nil {
+		record.LeaseDuration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if lease.Spec.AcquireTime != nil {
+		record.AcquireTime = lease.Spec.AcquireTime.Time
+	}
+	if lease.Spec.RenewTime != nil {
+		record.RenewTime = lease.Spec.RenewTime.Time
+	}
+	record.Address = lease.Annotations[AnnotationLeaderAddress]
+	return record
+}
+
+// setLeaseRecord stores a leader record in a Lease
+func setLeaseRecord(lease *coordinationv1.Lease, record ha.LeaderRecord) {
+	holder := record.HolderIdentity
+	duration := int32(record.LeaseDuration.Seconds())
+	acquireTime := metav1.NewMicroTime(record.AcquireTime)
+	renewTime := metav1.NewMicroTime(record.RenewTime)
+
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &acquireTime
+	lease.Spec.RenewTime = &renewTime
+	if lease.Spec.LeaseTransitions == nil {
+		transitions := int32(0)
+		lease.Spec.LeaseTransitions = &transitions
+	}
+
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string)
+	}
+	lease.Annotations[AnnotationLeaderAddress] = record.Address
+}
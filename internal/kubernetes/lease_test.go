@@ -0,0 +1,71 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ha"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// getLease returns the Lease stored by the lock under test
+func getLease(t *testing.T, kube *fake.Clientset) *coordinationv1.Lease {
+	t.Helper()
+
+	lease, err := kube.CoordinationV1().Leases("default").Get(context.Background(), "easy-tunnel-lb-agent", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get lease: %v", err)
+	}
+	return lease
+}
+
+func TestLeaseLock(t *testing.T) {
+	kube := fake.NewClientset()
+	lock := NewLeaseLock(&Client{kube: kube}, "default", "easy-tunnel-lb-agent")
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Microsecond)
+
+	candidate := func(identity string, at time.Time) ha.LeaderRecord {
+		return ha.LeaderRecord{
+			HolderIdentity: identity,
+			Address:        "http://" + identity + ":8080",
+			AcquireTime:    at,
+			RenewTime:      at,
+			LeaseDuration:  15 * time.Second,
+		}
+	}
+
+	// Creates the Lease
+	record, err := lock.TryAcquire(ctx, candidate("a", now))
+	if err != nil || record.HolderIdentity != "a" {
+		t.Fatalf("Expected a to acquire the lease, got %q (%v)", record.HolderIdentity, err)
+	}
+
+	// Another agent sees the holder and its address
+	record, err = lock.TryAcquire(ctx, candidate("b", now.Add(5*time.Second)))
+	if err != nil {
+		t.Fatalf("TryAcquire failed: %v", err)
+	}
+	if record.HolderIdentity != "a" || record.Address != "http://a:8080" || !record.RenewTime.Equal(now) {
+		t.Errorf("Unexpected holder record %+v", record)
+	}
+
+	// Takes over once the lease expires
+	record, err = lock.TryAcquire(ctx, candidate("b", now.Add(20*time.Second)))
+	if err != nil || record.HolderIdentity != "b" {
+		t.Fatalf("Expected b to take over the lease, got %q (%v)", record.HolderIdentity, err)
+	}
+	if transitions := *getLease(t, kube).Spec.LeaseTransitions; transitions != 1 {
+		t.Errorf("Expected 1 lease transition, got %d", transitions)
+	}
+
+	if err := lock.Release(ctx, "b"); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if holder := *getLease(t, kube).Spec.HolderIdentity; holder != "" {
+		t.Errorf("Expected released lease, got holder %s", holder)
+	}
+}
@@ -0,0 +1,157 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// AccessLists restrict which clients may reach a tunnel. Denied clients are
+// refused; if a tunnel has an allowlist, only clients on it are let in.
+type AccessLists struct {
+	// AllowedIPs and DeniedIPs hold client networks, as ParseCIDRs returns
+	// them
+	AllowedIPs []*net.IPNet
+	DeniedIPs  []*net.IPNet
+
+	// AllowedCountries and DeniedCountries hold ISO 3166-1 country codes
+	// and need a country lookup; clients of unknown countries are only let
+	// in if no countries are allowed
+	AllowedCountries []string
+	DeniedCountries  []string
+
+	// DenyAll refuses every client, e.g. of a tunnel whose lists could not
+	// be parsed
+	DenyAll bool
+}
+
+// CountryFunc returns the ISO 3166-1 code of a client address's country,
+// "" if unknown
+type CountryFunc func(addr netip.Addr) string
+
+// SetCountryLookup makes the load balancer look up the countries of clients
+// for access lists, logs and metrics
+func (lb *LoadBalancer) SetCountryLookup(fn CountryFunc) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.countryOf = fn
+}
+
+// clientCountry returns the country of a client, "" if unknown or no
+// lookup is set
+func (lb *LoadBalancer) clientCountry(remoteAddr string) string {
+	lb.mu.RLock()
+	lookup := lb.countryOf
+	lb.mu.RUnlock()
+	if lookup == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(clientIP(remoteAddr))
+	if err != nil {
+		return ""
+	}
+	return lookup(addr.Unmap().WithZone(""))
+}
+
+// ParseCIDRs parses client address ranges given as CIDRs or single IP
+// addresses; IPv4-mapped IPv6 ranges become IPv4 ones
+func ParseCIDRs(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		var prefix netip.Prefix
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address %q: %v", entry, err)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			var err error
+			if prefix, err = netip.ParsePrefix(entry); err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", entry, err)
+			}
+			if prefix.Addr().Is4In6() {
+				if prefix.Bits() < 96 {
+					return nil, fmt.Errorf("invalid CIDR %q: IPv4-mapped prefix shorter than /96", entry)
+				}
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+		}
+		prefix = prefix.Masked()
+		networks = append(networks, &net.IPNet{
+			IP:   net.IP(prefix.Addr().AsSlice()),
+			Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+		})
+	}
+	return networks, nil
+}
+
+// ParseCountries normalizes ISO 3166-1 alpha-2 country codes to upper case
+func ParseCountries(entries []string) ([]string, error) {
+	countries := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		code := strings.ToUpper(strings.TrimSpace(entry))
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("invalid country code %q", entry)
+		}
+		countries = append(countries, code)
+	}
+	return countries, nil
+}
+
+// allowClient reports whether a tunnel's access lists let a client from
+// country in
+func (lb *LoadBalancer) allowClient(options *TunnelOptions, remoteAddr, country string) bool {
+	access := options.Access
+	if access.DenyAll {
+		return false
+	}
+	if len(access.DeniedCountries) > 0 && containsCountry(access.DeniedCountries, country) {
+		return false
+	}
+	if len(access.AllowedCountries) > 0 && !containsCountry(access.AllowedCountries, country) {
+		return false
+	}
+	if len(access.AllowedIPs) == 0 && len(access.DeniedIPs) == 0 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(clientIP(remoteAddr))
+	if err != nil {
+		return false
+	}
+	ip := net.IP(addr.Unmap().WithZone("").AsSlice())
+
+	if containsIP(access.DeniedIPs, ip) {
+		return false
+	}
+	if len(access.AllowedIPs) == 0 {
+		return true
+	}
+	return containsIP(access.AllowedIPs, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCountry(countries []string, country string) bool {
+	if country == "" {
+		return false
+	}
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AffinityMode selects how requests to a hostname with several targets are
+// spread over them
+type AffinityMode string
+
+const (
+	// AffinityNone spreads requests round robin
+	AffinityNone AffinityMode = "none"
+	// AffinityClientIP sends each client IP to the same target, using
+	// consistent hashing so that only the clients of a removed target move
+	AffinityClientIP AffinityMode = "client_ip"
+	// AffinityCookie sends new clients round robin and remembers their
+	// target in a cookie
+	AffinityCookie AffinityMode = "cookie"
+)
+
+// DefaultAffinityCookie is the cookie remembering a client's target if
+// none is configured
+const DefaultAffinityCookie = "easy_tunnel_affinity"
+
+// Affinity keeps the clients of a hostname with several targets on the
+// same target, for stateful backends
+type Affinity struct {
+	Mode AffinityMode
+
+	// CookieName and CookieTTL configure the cookie of AffinityCookie; a
+	// zero TTL makes it a session cookie
+	CookieName string
+	CookieTTL  time.Duration
+}
+
+// ParseAffinityMode parses an affinity mode; empty selects AffinityNone
+func ParseAffinityMode(mode string) (AffinityMode, error) {
+	switch AffinityMode(mode) {
+	case "", AffinityNone:
+		return AffinityNone, nil
+	case AffinityClientIP, AffinityCookie:
+		return AffinityMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown session affinity %q", mode)
+	}
+}
+
+// pick returns the target of a request among the targets of its hostname
+// and the cookie to set on the response, if any
+func (a Affinity) pick(route *hostRoute, r *http.Request) (*Target, *http.Cookie) {
+	targets := route.targets
+	if len(targets) == 1 {
+		return targets[0], nil
+	}
+
+	switch a.Mode {
+	case AffinityClientIP:
+		return rendezvous(targets, clientIP(r.RemoteAddr)), nil
+
+	case AffinityCookie:
+		name := a.CookieName
+		if name == "" {
+			name = DefaultAffinityCookie
+		}
+		if cookie, err := r.Cookie(name); err == nil {
+			for _, target := range targets {
+				if cookie.Value == affinityCookieValue(target) {
+					return target, nil
+				}
+			}
+		}
+		target := route.roundRobin()
+		cookie := &http.Cookie{
+			Name:     name,
+			Value:    affinityCookieValue(target),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if a.CookieTTL > 0 {
+			cookie.MaxAge = int(a.CookieTTL / time.Second)
+		}
+		return target, cookie
+
+	default:
+		return route.roundRobin(), nil
+	}
+}
+
+// rendezvous picks the target with the highest hash of key and target ID
+// (highest random weight hashing)
+func rendezvous(targets []*Target, key string) *Target {
+	var best *Target
+	var bestWeight uint64
+	for _, target := range targets {
+		sum := sha256.Sum256([]byte(key + "\x00" + target.ID))
+		if weight := binary.BigEndian.Uint64(sum[:8]); best == nil || weight > bestWeight {
+			best, bestWeight = target, weight
+		}
+	}
+	return best
+}
+
+// affinityCookieValue identifies a target in the affinity cookie without
+// revealing its tunnel ID
+func affinityCookieValue(target *Target) string {
+	sum := sha256.Sum256([]byte(target.ID))
+	return hex.EncodeToString(sum[:8])
+}
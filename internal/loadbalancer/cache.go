@@ -0,0 +1,620 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultCacheMaxBytes bounds the size of cached responses if no limit is
+// configured
+const DefaultCacheMaxBytes = 64 << 20
+
+// DefaultCacheMaxObjectBytes is the largest response cached if no limit is
+// configured
+const DefaultCacheMaxObjectBytes = 1 << 20
+
+// cacheFileSuffix names the files of a disk-backed cache
+const cacheFileSuffix = ".cache"
+
+// Cache keeps responses of targets that mark them cacheable with
+// Cache-Control or Expires, and answers requests for them without asking
+// the target again until they go stale
+type Cache struct {
+	// Enabled caches the responses of all tunnels; tunnels may override it
+	Enabled bool
+
+	// MaxBytes bounds the size of all cached bodies; zero uses
+	// DefaultCacheMaxBytes
+	MaxBytes int64
+
+	// MaxObjectBytes is the largest body cached; zero uses
+	// DefaultCacheMaxObjectBytes
+	MaxObjectBytes int64
+
+	// MaxTTL caps how long responses are fresh; zero leaves it to the
+	// targets
+	MaxTTL time.Duration
+
+	// Dir, if set, keeps the cached bodies in files there instead of in
+	// memory. Files left by an earlier run are removed.
+	Dir string
+}
+
+// Validate checks that no limit is negative
+func (c Cache) Validate() error {
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("invalid cache size: %d", c.MaxBytes)
+	}
+	if c.MaxObjectBytes < 0 {
+		return fmt.Errorf("invalid cache object size: %d", c.MaxObjectBytes)
+	}
+	if c.MaxTTL < 0 {
+		return fmt.Errorf("invalid cache TTL: %v", c.MaxTTL)
+	}
+	return nil
+}
+
+// CacheStats describe the cached responses of a tunnel
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// cacheEntry is a cached response
+type cacheEntry struct {
+	key      string
+	base     string
+	tunnelID string
+	status   int
+	header   http.Header
+	// body holds the body of in-memory entries, path the file of
+	// disk-backed ones
+	body    []byte
+	path    string
+	size    int64
+	stored  time.Time
+	expires time.Time
+	// age is how old the response already was when it was stored
+	age time.Duration
+}
+
+// responseCache is a size-bounded LRU cache of responses, keyed by host,
+// request URI and the request headers the responses vary by
+type responseCache struct {
+	mu     sync.Mutex
+	config Cache
+	logger *zerolog.Logger
+	lru    *list.List
+	// entries holds the entries by host and request URI, and by key among
+	// the variants of these
+	entries map[string]map[string]*list.Element
+	// vary holds the header names the responses to a host and request URI
+	// vary by
+	vary    map[string][]string
+	bytes   int64
+	tunnels map[string]*CacheStats
+}
+
+func newResponseCache(config Cache, logger *zerolog.Logger) *responseCache {
+	if config.MaxBytes == 0 {
+		config.MaxBytes = DefaultCacheMaxBytes
+	}
+	if config.MaxObjectBytes == 0 {
+		config.MaxObjectBytes = DefaultCacheMaxObjectBytes
+	}
+	return &responseCache{
+		config:  config,
+		logger:  logger,
+		lru:     list.New(),
+		entries: make(map[string]map[string]*list.Element),
+		vary:    make(map[string][]string),
+		tunnels: make(map[string]*CacheStats),
+	}
+}
+
+// open prepares the directory of a disk-backed cache, removing the files
+// of an earlier run
+func (c *responseCache) open() error {
+	if c.config.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.config.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	stale, err := filepath.Glob(filepath.Join(c.config.Dir, "*"+cacheFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// statsOf returns the counters of a tunnel. Must be called with c.mu held.
+func (c *responseCache) statsOf(tunnelID string) *CacheStats {
+	stats, ok := c.tunnels[tunnelID]
+	if !ok {
+		stats = &CacheStats{}
+		c.tunnels[tunnelID] = stats
+	}
+	return stats
+}
+
+// get returns the fresh entry for a request, if any, counting the hit or
+// miss for the tunnel
+func (c *responseCache) get(tunnelID, base string, header http.Header, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.statsOf(tunnelID)
+	element, ok := c.entries[base][variantKey(base, c.vary[base], header)]
+	if !ok {
+		stats.Misses++
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if entry.tunnelID != tunnelID || !now.Before(entry.expires) {
+		c.remove(element)
+		stats.Misses++
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	stats.Hits++
+	return entry
+}
+
+// put stores a response, evicting the least recently used ones of the
+// tunnel beyond maxBytes, and of all tunnels beyond the cache size
+func (c *responseCache) put(entry *cacheEntry, varyNames []string, header http.Header, maxBytes int64) {
+	entry.key = variantKey(entry.base, varyNames, header)
+	if c.config.Dir != "" {
+		sum := sha256.Sum256([]byte(entry.key))
+		entry.path = filepath.Join(c.config.Dir, hex.EncodeToString(sum[:])+strconv.FormatInt(entry.stored.UnixNano(), 36)+cacheFileSuffix)
+		if err := os.WriteFile(entry.path, entry.body, 0o600); err != nil {
+			c.logger.Debug().Err(err).Str("tunnel_id", entry.tunnelID).Msg("Failed to write cached response")
+			return
+		}
+		entry.body = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.entries[entry.base][entry.key]; ok {
+		c.remove(existing)
+	}
+	variants, ok := c.entries[entry.base]
+	if !ok {
+		variants = make(map[string]*list.Element)
+		c.entries[entry.base] = variants
+	}
+	c.vary[entry.base] = varyNames
+	variants[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+	stats := c.statsOf(entry.tunnelID)
+	stats.Entries++
+	stats.Bytes += entry.size
+
+	for element := c.lru.Back(); element != nil && maxBytes > 0 && stats.Bytes > maxBytes; {
+		prev := element.Prev()
+		if element.Value.(*cacheEntry).tunnelID == entry.tunnelID {
+			c.remove(element)
+		}
+		element = prev
+	}
+	for c.bytes > c.config.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry. Must be called with c.mu held.
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries[entry.base], entry.key)
+	if len(c.entries[entry.base]) == 0 {
+		delete(c.entries, entry.base)
+		delete(c.vary, entry.base)
+	}
+	c.bytes -= entry.size
+	if stats, ok := c.tunnels[entry.tunnelID]; ok {
+		stats.Entries--
+		stats.Bytes -= entry.size
+	}
+	if entry.path != "" {
+		// Hits still reading the file keep it open
+		os.Remove(entry.path)
+	}
+}
+
+// invalidate drops the entries for a host and request URI, e.g. after a
+// request changed the resource
+func (c *responseCache) invalidate(base string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, element := range c.entries[base] {
+		c.remove(element)
+	}
+}
+
+// purge drops the entries of a tunnel and returns how many there were
+func (c *responseCache) purge(tunnelID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*cacheEntry).tunnelID == tunnelID {
+			c.remove(element)
+			purged++
+		}
+		element = next
+	}
+	return purged
+}
+
+// forget drops the entries and counters of a removed tunnel
+func (c *responseCache) forget(tunnelID string) {
+	c.purge(tunnelID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tunnels, tunnelID)
+}
+
+// stats returns the counters of a tunnel
+func (c *responseCache) stats(tunnelID string) CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stats, ok := c.tunnels[tunnelID]; ok {
+		return *stats
+	}
+	return CacheStats{}
+}
+
+// variantKey is the key of the response to a request among those for
+// base that vary by the header names
+func variantKey(base string, varyNames []string, header http.Header) string {
+	if len(varyNames) == 0 {
+		return base
+	}
+	var key strings.Builder
+	key.WriteString(base)
+	for _, name := range varyNames {
+		key.WriteString("\n")
+		key.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// cacheRequest marks a request whose response may be stored
+type cacheRequest struct {
+	tunnelID string
+	options  *TunnelOptions
+	base     string
+	header   http.Header
+}
+
+// cacheRequestKey is the request context key of a request's cacheRequest
+type cacheRequestKey struct{}
+
+// cacheOf returns the cache settings in effect for a tunnel with options
+func (lb *LoadBalancer) cacheOf(options *TunnelOptions) (enabled bool, maxBytes int64, maxTTL time.Duration) {
+	config := lb.router.config.Cache
+	enabled = config.Enabled
+	if options.Cache != nil {
+		enabled = *options.Cache
+	}
+	maxTTL = config.MaxTTL
+	if options.CacheMaxTTL > 0 && (maxTTL == 0 || options.CacheMaxTTL < maxTTL) {
+		maxTTL = options.CacheMaxTTL
+	}
+	return enabled, options.CacheMaxBytes, maxTTL
+}
+
+// cacheBase is the part of the cache key that identifies a resource
+func cacheBase(r *http.Request) string {
+	return requestHost(r.Host) + r.URL.RequestURI()
+}
+
+// serveCached answers a request from the tunnel's cached responses,
+// reporting whether it did. Otherwise, it returns the request to proxy,
+// marked if its response may be cached, and drops the cached responses of
+// resources that unsafe requests may change.
+func (lb *LoadBalancer) serveCached(w http.ResponseWriter, r *http.Request, tunnelID string, options *TunnelOptions) (*http.Request, bool) {
+	if enabled, _, _ := lb.cacheOf(options); !enabled {
+		return r, false
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions, http.MethodTrace:
+		return r, false
+	default:
+		lb.cache.invalidate(cacheBase(r))
+		return r, false
+	}
+	// Responses to authenticated requests may be meant for one client only
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		return r, false
+	}
+	directives := parseCacheControl(r.Header.Values("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return r, false
+	}
+
+	base := cacheBase(r)
+	_, noCache := directives["no-cache"]
+	if maxAge, ok := directives["max-age"]; !noCache && (!ok || maxAge != "0") {
+		now := time.Now()
+		if entry := lb.cache.get(tunnelID, base, r.Header, now); entry != nil {
+			if lb.writeCached(w, r, tunnelID, options, entry, now) {
+				return r, true
+			}
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), cacheRequestKey{}, &cacheRequest{
+		tunnelID: tunnelID,
+		options:  options,
+		base:     base,
+		header:   r.Header.Clone(),
+	})), false
+}
+
+// writeCached answers a request with a cached response, passing it
+// through the tunnel's header rules and compression like a proxied one. It
+// reports false if the body of a disk-backed entry is gone.
+func (lb *LoadBalancer) writeCached(w http.ResponseWriter, r *http.Request, tunnelID string, options *TunnelOptions, entry *cacheEntry, now time.Time) bool {
+	body := io.NopCloser(bytes.NewReader(entry.body))
+	if entry.path != "" {
+		file, err := os.Open(entry.path)
+		if err != nil {
+			return false
+		}
+		body = file
+	}
+
+	resp := &http.Response{
+		StatusCode:    entry.status,
+		Header:        entry.header.Clone(),
+		Body:          body,
+		ContentLength: entry.size,
+		Request:       r,
+	}
+	defer resp.Body.Close()
+	resp.Header.Set("Age", strconv.Itoa(int((entry.age + now.Sub(entry.stored)).Seconds())))
+	resp.Header.Set("X-Cache", "HIT")
+	if etag := resp.Header.Get("ETag"); etag != "" && entry.status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Length")
+	}
+	lb.transformResponse(resp, options, publicOrigin(r))
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	if resp.ContentLength >= 0 && resp.StatusCode != http.StatusNotModified {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != http.MethodHead {
+		n, _ := io.Copy(w, resp.Body)
+		lb.stats.Tunnel(tunnelID).AddBytesSent(n)
+	}
+	lb.stats.Tunnel(tunnelID).IncRequests()
+	return true
+}
+
+// storeResponse tees a cacheable response of a marked request into the
+// cache as the client reads it; the response is stored once read whole
+func (lb *LoadBalancer) storeResponse(resp *http.Response) {
+	cr, ok := resp.Request.Context().Value(cacheRequestKey{}).(*cacheRequest)
+	if !ok {
+		return
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	if resp.Request.Method != http.MethodGet {
+		return
+	}
+	_, maxBytes, maxTTL := lb.cacheOf(cr.options)
+	now := time.Now()
+	ttl, age := freshness(resp, now)
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	limit := lb.cache.config.MaxObjectBytes
+	if maxBytes > 0 && maxBytes < limit {
+		limit = maxBytes
+	}
+	if ttl <= 0 || resp.ContentLength > limit || isStreaming(resp.Header) {
+		return
+	}
+	varyNames, ok := varyOf(resp.Header)
+	if !ok {
+		return
+	}
+
+	header := resp.Header.Clone()
+	header.Del("X-Cache")
+	header.Del("Age")
+	entry := &cacheEntry{
+		base:     cr.base,
+		tunnelID: cr.tunnelID,
+		status:   resp.StatusCode,
+		header:   header,
+		stored:   now,
+		expires:  now.Add(ttl),
+		age:      age,
+	}
+	resp.Body = &captureBody{ReadCloser: resp.Body, limit: limit, done: func(body []byte) {
+		entry.body = body
+		entry.size = int64(len(body))
+		lb.cache.put(entry, varyNames, cr.header, maxBytes)
+	}}
+}
+
+// cacheableStatus are the status codes whose responses are cached if
+// marked fresh
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// freshness returns how long a response may be served from a shared
+// cache, zero if it must not be stored, and how old it already is
+func freshness(resp *http.Response, now time.Time) (time.Duration, time.Duration) {
+	if !cacheableStatus[resp.StatusCode] || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return 0, 0
+	}
+	directives := parseCacheControl(resp.Header.Values("Cache-Control"))
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			return 0, 0
+		}
+	}
+
+	var age time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	var lifetime time.Duration
+	if value, ok := directives["s-maxage"]; ok {
+		seconds, _ := strconv.Atoi(value)
+		lifetime = time.Duration(seconds) * time.Second
+	} else if value, ok := directives["max-age"]; ok {
+		seconds, _ := strconv.Atoi(value)
+		lifetime = time.Duration(seconds) * time.Second
+	} else if expires := resp.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, 0
+		}
+		date := now
+		if parsed, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+			date = parsed
+		}
+		lifetime = expiresAt.Sub(date)
+	}
+	return lifetime - age, age
+}
+
+// varyOf returns the request header names a response varies by, and
+// false if it varies by something that cannot be matched
+func varyOf(header http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, true
+}
+
+// parseCacheControl returns the directives of Cache-Control header values
+// by lowercase name, with their unquoted arguments
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+		}
+	}
+	return directives
+}
+
+// etagMatches reports whether an If-None-Match header matches an entity
+// tag, comparing weakly
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// captureBody copies a response body as it is read, handing the copy to
+// done once the body was read to its end within limit bytes
+type captureBody struct {
+	io.ReadCloser
+	buffer bytes.Buffer
+	limit  int64
+	done   func(body []byte)
+	failed bool
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.failed {
+		if int64(b.buffer.Len()+n) > b.limit {
+			b.failed = true
+			b.buffer = bytes.Buffer{}
+		} else {
+			b.buffer.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.failed {
+		b.failed = true // Store once
+		b.done(b.buffer.Bytes())
+	}
+	return n, err
+}
+
+// CacheStats returns the cache counters of a tunnel
+func (lb *LoadBalancer) CacheStats(tunnelID string) CacheStats {
+	return lb.cache.stats(tunnelID)
+}
+
+// PurgeCache drops the cached responses of a tunnel and returns how many
+// there were
+func (lb *LoadBalancer) PurgeCache(tunnelID string) int {
+	purged := lb.cache.purge(tunnelID)
+	if purged > 0 {
+		lb.logger.Info().Str("tunnel_id", tunnelID).Int("entries", purged).Msg("Purged cached responses")
+	}
+	return purged
+}
@@ -0,0 +1,147 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateStore holds the serving certificate and allows it to be
+// replaced without restarting the listener
+type certificateStore struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	// certFile and keyFile are the files the certificate was loaded from,
+	// with their modification times when it was
+	certFile    string
+	keyFile     string
+	certModTime time.Time
+	keyModTime  time.Time
+
+	// stapling staples OCSP responses to the certificate, refreshed from
+	// ocspRefresh on; ocspNextUpdate is when the current staple expires
+	stapling       bool
+	ocspRefresh    time.Time
+	ocspNextUpdate time.Time
+}
+
+// load reads a certificate/key pair from disk and makes it the serving certificate
+func (s *certificateStore) load(certFile, keyFile string) error {
+	// Stat before reading, so that files changing meanwhile are read again
+	certModTime, keyModTime := modTime(certFile), modTime(keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = &cert
+	s.certFile, s.keyFile = certFile, keyFile
+	s.certModTime, s.keyModTime = certModTime, keyModTime
+	s.ocspRefresh, s.ocspNextUpdate = time.Time{}, time.Time{}
+	return nil
+}
+
+// reloadIfChanged loads the certificate again if its files changed since
+// it was loaded, reporting whether they did. A pair that fails to load,
+// such as while a renewal has written the certificate but not yet the key,
+// leaves the current certificate in place and is tried again next time.
+func (s *certificateStore) reloadIfChanged() (bool, error) {
+	s.mu.RLock()
+	certFile, keyFile := s.certFile, s.keyFile
+	changed := !modTime(certFile).Equal(s.certModTime) || !modTime(keyFile).Equal(s.keyModTime)
+	s.mu.RUnlock()
+
+	if certFile == "" || !changed {
+		return false, nil
+	}
+	return true, s.load(certFile, keyFile)
+}
+
+// modTime returns the modification time of a file, zero if it cannot be read
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (s *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.cert == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	return s.cert, nil
+}
+
+// StartCertificateWatcher checks the certificate files of the HTTPS port
+// and listeners every interval and serves renewed certificates, such as
+// those of cert-manager or an ACME client on the host, without restarting
+// the listeners. It also keeps the OCSP staples of the certificates fresh
+// if stapling is enabled. A zero interval disables it. It runs until ctx is
+// cancelled.
+func (lb *LoadBalancer) StartCertificateWatcher(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lb.refreshOCSPStaples(time.Now())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				lb.reloadChangedCertificates()
+				lb.refreshOCSPStaples(now)
+			}
+		}
+	}()
+}
+
+// certificateStores returns the certificates of the HTTPS port and listeners
+func (lb *LoadBalancer) certificateStores() []*certificateStore {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	stores := append([]*certificateStore{}, lb.listenerCerts...)
+	if lb.certs != nil {
+		stores = append(stores, lb.certs)
+	}
+	return stores
+}
+
+// reloadChangedCertificates reloads the certificates whose files changed
+func (lb *LoadBalancer) reloadChangedCertificates() {
+	for _, store := range lb.certificateStores() {
+		changed, err := store.reloadIfChanged()
+		if !changed {
+			continue
+		}
+		store.mu.RLock()
+		certFile := store.certFile
+		store.mu.RUnlock()
+		if err != nil {
+			lb.logger.Warn().
+				Err(err).
+				Str("cert_file", certFile).
+				Msg("Failed to reload renewed TLS certificate, keeping the current one")
+			continue
+		}
+		lb.logger.Info().
+			Str("cert_file", certFile).
+			Msg("Reloaded renewed TLS certificate")
+	}
+}
@@ -0,0 +1,137 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// CircuitBreakerPolicy stops sending traffic to targets that keep failing
+type CircuitBreakerPolicy struct {
+	// Failures is how many consecutive connection failures open a
+	// target's circuit (zero disables circuit breaking)
+	Failures int
+
+	// Cooldown is how long an open circuit skips its target before a
+	// single probe is let through
+	Cooldown time.Duration
+}
+
+// Validate checks that the policy is usable
+func (p CircuitBreakerPolicy) Validate() error {
+	if p.Failures < 0 {
+		return fmt.Errorf("invalid circuit breaker failures: %d", p.Failures)
+	}
+	if p.Failures > 0 && p.Cooldown <= 0 {
+		return fmt.Errorf("invalid circuit breaker cooldown: %v", p.Cooldown)
+	}
+	return nil
+}
+
+// circuit is the state of one target's circuit. It is open while
+// openUntil is in the future; afterwards it is half-open, and the next
+// caller becomes the probe that closes or reopens it.
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// circuitBreakers tracks the circuits of all targets by tunnel ID
+type circuitBreakers struct {
+	mu       sync.Mutex
+	policy   CircuitBreakerPolicy
+	circuits map[string]*circuit
+	logger   *zerolog.Logger
+	now      func() time.Time
+}
+
+func newCircuitBreakers(policy CircuitBreakerPolicy, logger *zerolog.Logger) *circuitBreakers {
+	return &circuitBreakers{
+		policy:   policy,
+		circuits: make(map[string]*circuit),
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// allow reports whether traffic may be sent to a target. Once the cooldown
+// of an open circuit has passed, only one caller is allowed until it
+// reports the outcome.
+func (b *circuitBreakers) allow(id string) bool {
+	if b.policy.Failures == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, exists := b.circuits[id]
+	if !exists || c.failures < b.policy.Failures {
+		return true
+	}
+	if c.probing || b.now().Before(c.openUntil) {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// pick returns the first of targets whose circuit allows traffic and the
+// targets after it, or nil if all circuits are open
+func (b *circuitBreakers) pick(targets []*Target) (*Target, []*Target) {
+	for i, target := range targets {
+		if b.allow(target.ID) {
+			return target, targets[i+1:]
+		}
+	}
+	return nil, nil
+}
+
+// success closes a target's circuit
+func (b *circuitBreakers) success(id string) {
+	if b.policy.Failures == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, exists := b.circuits[id]
+	if !exists {
+		return
+	}
+	delete(b.circuits, id)
+	if c.failures >= b.policy.Failures {
+		b.logger.Info().
+			Str("tunnel_id", id).
+			Msg("Closed circuit of recovered target")
+	}
+}
+
+// failure records a failed connection to a target, opening its circuit
+// after too many in a row or when its probe fails
+func (b *circuitBreakers) failure(id string) {
+	if b.policy.Failures == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, exists := b.circuits[id]
+	if !exists {
+		c = &circuit{}
+		b.circuits[id] = c
+	}
+	c.failures++
+	c.probing = false
+	if c.failures >= b.policy.Failures {
+		c.openUntil = b.now().Add(b.policy.Cooldown)
+		b.logger.Warn().
+			Str("tunnel_id", id).
+			Int("failures", c.failures).
+			Dur("cooldown", b.policy.Cooldown).
+			Msg("Opened circuit of failing target")
+	}
+}
@@ -0,0 +1,243 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Headers identifying the client certificate to the target. The values
+// clients send are removed from the requests of tunnels requiring client
+// certificates.
+const (
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// maxClientCAPools bounds the parsed CA bundles kept for handshakes
+const maxClientCAPools = 256
+
+// ClientCertAuth requires the clients of a tunnel to present a certificate
+// signed by one of its CAs during the TLS handshake, e.g. to reach an
+// internal service from managed devices only
+type ClientCertAuth struct {
+	// CA is a PEM bundle of the certificates client certificates must
+	// chain to
+	CA string
+
+	// Hostnames of the tunnel requiring client certificates; empty
+	// requires them on all of its hostnames
+	Hostnames []string
+}
+
+// Validate checks that client certificates can be required
+func (a *ClientCertAuth) Validate() error {
+	if _, err := parseClientCAs(a.CA); err != nil {
+		return err
+	}
+	for _, hostname := range a.Hostnames {
+		if _, err := NormalizeHostname(hostname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether clients of hostname need a certificate
+func (a *ClientCertAuth) appliesTo(hostname string) bool {
+	if len(a.Hostnames) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(a.Hostnames, func(h string) bool {
+		return normalizeHost(h) == hostname
+	})
+}
+
+// parseClientCAs parses a PEM bundle of CA certificates
+func parseClientCAs(bundle string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	rest := []byte(bundle)
+	found := false
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client CA certificate: %v", err)
+		}
+		pool.AddCert(cert)
+		found = true
+	}
+	if !found {
+		return nil, errors.New("client CA bundle contains no PEM certificates")
+	}
+	return pool, nil
+}
+
+// clientCAPools holds parsed CA bundles, so that handshakes do not parse
+// them again
+type clientCAPools struct {
+	mu    sync.Mutex
+	pools map[string]*x509.CertPool
+}
+
+// get returns the pool of a CA bundle, nil if it is invalid
+func (c *clientCAPools) get(bundle string) *x509.CertPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool, ok := c.pools[bundle]; ok {
+		return pool
+	}
+	pool, err := parseClientCAs(bundle)
+	if err != nil {
+		return nil
+	}
+	if c.pools == nil || len(c.pools) >= maxClientCAPools {
+		c.pools = make(map[string]*x509.CertPool)
+	}
+	c.pools[bundle] = pool
+	return pool
+}
+
+// httpTunnelIDs returns the tunnels routed for HTTP requests to hostname
+func (r *Router) httpTunnelIDs(hostname string) []string {
+	t := r.tables.Load()
+	var ids []string
+	if route, exists := t.hostMap[hostname]; exists {
+		for _, target := range route.targets {
+			ids = append(ids, target.ID)
+		}
+	}
+	for _, route := range t.pathMap[hostname] {
+		ids = append(ids, route.target.ID)
+	}
+	return ids
+}
+
+// serverTLSConfig returns the TLS settings of an HTTPS listener serving
+// certs under the TLS policy, or certificates obtained on demand for routed
+// hostnames certs does not cover if enabled. Handshakes for hostnames whose
+// tunnels require client certificates ask for one signed by their CAs.
+func (lb *LoadBalancer) serverTLSConfig(certs *certificateStore) *tls.Config {
+	config := &tls.Config{GetCertificate: certs.getCertificate}
+	lb.tlsPolicy().apply(config)
+	if lb.onDemand != nil {
+		config.GetCertificate = lb.onDemand.getCertificate(certs)
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		pool := lb.clientCAPool(normalizeHost(hello.ServerName))
+		if pool == nil {
+			return nil, nil
+		}
+		verifying := config.Clone()
+		verifying.GetConfigForClient = nil
+		verifying.ClientAuth = tls.RequireAndVerifyClientCert
+		verifying.ClientCAs = pool
+		return verifying, nil
+	}
+	return config
+}
+
+// clientCAPool returns the CAs client certificates for hostname may be
+// signed by, those of all its tunnels requiring them, or nil if none do
+func (lb *LoadBalancer) clientCAPool(hostname string) *x509.CertPool {
+	if hostname == "" {
+		return nil
+	}
+	var bundles []string
+	for _, id := range lb.router.httpTunnelIDs(hostname) {
+		auth := lb.optionsOf(id).ClientCertAuth
+		if auth != nil && auth.appliesTo(hostname) && !slices.Contains(bundles, auth.CA) {
+			bundles = append(bundles, auth.CA)
+		}
+	}
+	if len(bundles) == 0 {
+		return nil
+	}
+	slices.Sort(bundles)
+	return lb.clientCAs.get(strings.Join(bundles, "\n"))
+}
+
+// verifyClientCert enforces the client certificate requirement of a tunnel
+// on the hostname of a request. Requests with a certificate signed by one
+// of the tunnel's CAs are passed on with its identity in
+// HeaderClientCertSubject and HeaderClientCertFingerprint; others are
+// refused with the 403 page. It reports whether the request may be proxied.
+func (lb *LoadBalancer) verifyClientCert(w http.ResponseWriter, r *http.Request, tunnelID string, options *TunnelOptions) bool {
+	auth := options.ClientCertAuth
+	if auth == nil {
+		return true
+	}
+	// Clients cannot claim a certificate of their own
+	r.Header.Del(HeaderClientCertSubject)
+	r.Header.Del(HeaderClientCertFingerprint)
+
+	host := requestHost(r.Host)
+	if !auth.appliesTo(host) {
+		return true
+	}
+	// Connections set up for another hostname, e.g. reused by HTTP/2
+	// clients, were not asked for a certificate for this one
+	if r.TLS != nil && normalizeHost(r.TLS.ServerName) != host {
+		http.Error(w, "Misdirected request, connect to this hostname", http.StatusMisdirectedRequest)
+		return false
+	}
+
+	if err := lb.checkClientCert(r.TLS, auth.CA); err != nil {
+		lb.stats.Tunnel(tunnelID).IncDenied()
+		lb.logger.Warn().
+			Err(err).
+			Str("host", host).
+			Str("tunnel_id", tunnelID).
+			Str("client_ip", clientIP(r.RemoteAddr)).
+			Msg("Client certificate rejected")
+		lb.serveErrorPage(w, r, tunnelID, PageForbidden)
+		return false
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set(HeaderClientCertSubject, cert.Subject.String())
+	r.Header.Set(HeaderClientCertFingerprint, hex.EncodeToString(fingerprint[:]))
+	return true
+}
+
+// checkClientCert verifies the client certificate of a connection against
+// a tunnel's CAs. The handshake checked it against the CAs of all tunnels
+// of the hostname, which path routes may spread over several tunnels.
+func (lb *LoadBalancer) checkClientCert(state *tls.ConnectionState, bundle string) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+	pool := lb.clientCAs.get(bundle)
+	if pool == nil {
+		return errors.New("invalid client CA bundle")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
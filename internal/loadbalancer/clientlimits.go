@@ -0,0 +1,152 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// clientLimiterIdleTTL is how long the bucket of a client without open
+// connections is kept; by then it has refilled
+const clientLimiterIdleTTL = 10 * time.Minute
+
+// ClientLimits bound what a single client address may send to a tunnel;
+// zero disables a limit
+type ClientLimits struct {
+	// RequestsPerSecond is the average rate of HTTP requests and new TCP
+	// connections, with bursts of up to Burst (RequestsPerSecond if zero)
+	RequestsPerSecond int
+	Burst             int
+
+	// MaxConnections bounds the client's concurrent HTTP requests and TCP
+	// connections
+	MaxConnections int
+}
+
+// Validate checks that no limit is negative
+func (l ClientLimits) Validate() error {
+	if l.RequestsPerSecond < 0 {
+		return fmt.Errorf("invalid client requests per second: %d", l.RequestsPerSecond)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("invalid client burst: %d", l.Burst)
+	}
+	if l.MaxConnections < 0 {
+		return fmt.Errorf("invalid client max connections: %d", l.MaxConnections)
+	}
+	return nil
+}
+
+// clientLimits returns the client limits in effect for a tunnel with
+// options
+func (lb *LoadBalancer) clientLimits(options *TunnelOptions) ClientLimits {
+	limits := lb.router.config.ClientLimits
+	override := options.ClientLimits
+	if override.RequestsPerSecond > 0 {
+		limits.RequestsPerSecond = override.RequestsPerSecond
+		limits.Burst = override.Burst
+	}
+	if override.Burst > 0 {
+		limits.Burst = override.Burst
+	}
+	if override.MaxConnections > 0 {
+		limits.MaxConnections = override.MaxConnections
+	}
+	return limits
+}
+
+// clientLimiter tracks the request rate and open connections of clients
+// per tunnel with token buckets
+type clientLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	clients   map[clientKey]*clientBucket
+	lastSweep time.Time
+}
+
+type clientKey struct {
+	tunnelID string
+	ip       string
+}
+
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{now: time.Now, clients: make(map[clientKey]*clientBucket)}
+}
+
+// acquire admits a request or connection of a client to a tunnel, taking a
+// token and an open connection slot, and returns the func freeing the slot
+// once it is done. If the client is over a limit it returns false and, for
+// the rate limit, how long until a token is available.
+func (l *clientLimiter) acquire(tunnelID, ip string, limits ClientLimits) (func(), bool, time.Duration) {
+	if limits.RequestsPerSecond <= 0 && limits.MaxConnections <= 0 {
+		return func() {}, true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > clientLimiterIdleTTL {
+		for key, b := range l.clients {
+			if b.active == 0 && now.Sub(b.last) > clientLimiterIdleTTL {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	key := clientKey{tunnelID: tunnelID, ip: ip}
+	burst := float64(limits.Burst)
+	if burst < 1 {
+		burst = math.Max(1, float64(limits.RequestsPerSecond))
+	}
+	b, exists := l.clients[key]
+	if !exists {
+		b = &clientBucket{tokens: burst, last: now}
+		l.clients[key] = b
+	}
+
+	if limits.MaxConnections > 0 && b.active >= limits.MaxConnections {
+		return nil, false, 0
+	}
+	if limits.RequestsPerSecond > 0 {
+		rate := float64(limits.RequestsPerSecond)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		if b.tokens < 1 {
+			b.last = now
+			return nil, false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		}
+		b.tokens--
+	}
+	b.last = now
+	b.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			b.active--
+			b.last = l.now()
+		})
+	}, true, 0
+}
+
+// resetConn closes a TCP connection with a reset instead of a graceful
+// shutdown
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,152 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressionMinSize is the smallest response compressed if no
+// minimum is configured
+const DefaultCompressionMinSize = 1024
+
+// Compression gzips responses of targets for clients accepting it. Brotli
+// is not supported.
+type Compression struct {
+	Enabled bool
+
+	// MinSize is the smallest response compressed, in bytes; responses of
+	// unknown length are always compressed
+	MinSize int
+}
+
+// Validate checks that the minimum size is not negative
+func (c Compression) Validate() error {
+	if c.MinSize < 0 {
+		return fmt.Errorf("invalid compression minimum size: %d", c.MinSize)
+	}
+	return nil
+}
+
+// compression returns the compression settings in effect for a tunnel
+// with options
+func (lb *LoadBalancer) compression(options *TunnelOptions) Compression {
+	compression := lb.router.config.Compression
+	if options.Compression != nil {
+		compression.Enabled = *options.Compression
+	}
+	if options.CompressionMinSize > 0 {
+		compression.MinSize = options.CompressionMinSize
+	}
+	if compression.MinSize == 0 {
+		compression.MinSize = DefaultCompressionMinSize
+	}
+	return compression
+}
+
+// compressibleTypes are the media types worth compressing besides text/*
+// and the +json and +xml types
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+}
+
+// compressResponse gzips a response if the client accepts gzip and the
+// response is large enough and of a compressible type
+func compressResponse(resp *http.Response, compression Compression) {
+	if !compression.Enabled || !shouldCompress(resp, compression.MinSize) {
+		return
+	}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Body = &gzipBody{PipeReader: pr, body: body}
+
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The compressed body no longer matches a strong validator
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// gzipBody is a compressed response body; closing it stops reading the
+// target's body
+type gzipBody struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+func (b *gzipBody) Close() error {
+	b.PipeReader.Close()
+	return b.body.Close()
+}
+
+func shouldCompress(resp *http.Response, minSize int) bool {
+	if resp.Request == nil || resp.Request.Method == http.MethodHead || !acceptsGzip(resp.Request.Header) {
+		return false
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(minSize) {
+		return false
+	}
+	if strings.Contains(resp.Header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if streamingTypes[mediaType] {
+		// Compression would hold back events until enough are buffered
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header http.Header) bool {
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+				if weight, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil && weight == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
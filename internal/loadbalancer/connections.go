@@ -0,0 +1,125 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrConnectionNotFound is returned for connections that are not open
+var ErrConnectionNotFound error = &kindError{kind: ErrNotFound, message: "connection not found"}
+
+// Connection is a proxied TCP connection, UDP session or HTTP request in
+// progress
+type Connection struct {
+	ID          string
+	TunnelID    string
+	ClientAddr  string
+	BackendAddr string
+
+	// Protocol is tcp, tls for TLS passthrough, udp, http, https, http3 or
+	// websocket
+	Protocol string
+
+	// BytesReceived flowed from the client to the target, BytesSent back
+	BytesReceived int64
+	BytesSent     int64
+
+	Started time.Time
+}
+
+// trackedConn is an entry of the connection table
+type trackedConn struct {
+	seq           uint64
+	info          Connection
+	bytesReceived atomic.Int64
+	bytesSent     atomic.Int64
+
+	// kill aborts the connection
+	kill func()
+}
+
+// connectionTable tracks the open connections of the load balancer
+type connectionTable struct {
+	mu    sync.Mutex
+	next  uint64
+	conns map[string]*trackedConn
+}
+
+// open adds a connection killed by kill; remove it with close
+func (t *connectionTable) open(info Connection, kill func()) *trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	info.ID = strconv.FormatUint(t.next, 10)
+	info.Started = time.Now()
+	conn := &trackedConn{seq: t.next, info: info, kill: kill}
+	if t.conns == nil {
+		t.conns = make(map[string]*trackedConn)
+	}
+	t.conns[info.ID] = conn
+	return conn
+}
+
+func (t *connectionTable) close(conn *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn.info.ID)
+}
+
+// Connections returns the open connections, oldest first
+func (lb *LoadBalancer) Connections() []Connection {
+	lb.connections.mu.Lock()
+	defer lb.connections.mu.Unlock()
+
+	tracked := make([]*trackedConn, 0, len(lb.connections.conns))
+	for _, conn := range lb.connections.conns {
+		tracked = append(tracked, conn)
+	}
+	sort.Slice(tracked, func(i, j int) bool { return tracked[i].seq < tracked[j].seq })
+
+	conns := make([]Connection, len(tracked))
+	for i, conn := range tracked {
+		conns[i] = conn.info
+		conns[i].BytesReceived = conn.bytesReceived.Load()
+		conns[i].BytesSent = conn.bytesSent.Load()
+	}
+	return conns
+}
+
+// KillConnection closes an open TCP connection, or aborts an HTTP request
+func (lb *LoadBalancer) KillConnection(id string) error {
+	lb.connections.mu.Lock()
+	conn, exists := lb.connections.conns[id]
+	lb.connections.mu.Unlock()
+	if !exists {
+		return ErrConnectionNotFound
+	}
+
+	lb.logger.Warn().
+		Str("connection_id", id).
+		Str("tunnel_id", conn.info.TunnelID).
+		Str("client_ip", clientIP(conn.info.ClientAddr)).
+		Msg("Killing connection")
+	conn.kill()
+	return nil
+}
+
+// httpProtocol names the protocol of a proxied HTTP request
+func httpProtocol(r *http.Request) string {
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		return "websocket"
+	case r.ProtoMajor == 3:
+		return "http3"
+	case r.TLS != nil:
+		return "https"
+	}
+	return "http"
+}
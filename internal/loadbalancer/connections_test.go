@@ -0,0 +1,346 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/stats"
+)
+
+func TestConnectionTable(t *testing.T) {
+	// The target echoes what it receives
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer public.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	if err := router.AddTCPRoute("tunnel-1", public.Addr().(*net.TCPAddr).Port, "10.0.0.2", 5432); err != nil {
+		t.Fatalf("Failed to add TCP route: %v", err)
+	}
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", backend.Addr().String())
+	})
+
+	client, err := net.Dial("tcp", public.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	accepted, err := public.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		lb.handleTCPConnection(accepted)
+		close(done)
+	}()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+
+	conns := lb.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %+v", conns)
+	}
+	conn := conns[0]
+	if conn.TunnelID != "tunnel-1" || conn.Protocol != "tcp" || conn.BackendAddr != "10.0.0.2:5432" ||
+		conn.ClientAddr != client.LocalAddr().String() || conn.BytesReceived != 4 || conn.BytesSent != 4 {
+		t.Errorf("Unexpected connection %+v", conn)
+	}
+
+	if err := lb.KillConnection("unknown"); !errors.Is(err, ErrConnectionNotFound) {
+		t.Errorf("Expected ErrConnectionNotFound, got %v", err)
+	}
+	if err := lb.KillConnection(conn.ID); err != nil {
+		t.Fatalf("Failed to kill connection: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the killed connection to be closed")
+	}
+	if conns := lb.Connections(); len(conns) != 0 {
+		t.Errorf("Expected no connections after the kill, got %+v", conns)
+	}
+}
+
+func TestKillHTTPConnection(t *testing.T) {
+	// The target streams until the request is aborted
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		lb.handleHTTPRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://app.example.com/events", nil))
+		close(done)
+	}()
+	<-started
+
+	conns := lb.Connections()
+	if len(conns) != 1 || conns[0].Protocol != "http" || conns[0].TunnelID != "tunnel-1" {
+		t.Fatalf("Expected the streaming request, got %+v", conns)
+	}
+	if err := lb.KillConnection(conns[0].ID); err != nil {
+		t.Fatalf("Failed to kill connection: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the killed request to be aborted")
+	}
+}
+
+// startTCPProxy serves one client connection to the target at backendAddr
+// through handleTCPConnection, returning the client's end and a channel
+// closed once the load balancer is done with the connection
+func startTCPProxy(t *testing.T, config *Config, backendAddr string) (*net.TCPConn, <-chan struct{}) {
+	t.Helper()
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { public.Close() })
+
+	router := NewRouter(config)
+	if err := router.AddTCPRoute("tunnel-1", public.Addr().(*net.TCPAddr).Port, "10.0.0.2", 25); err != nil {
+		t.Fatalf("Failed to add TCP route: %v", err)
+	}
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", backendAddr)
+	})
+
+	client, err := net.Dial("tcp", public.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	accepted, err := public.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		lb.handleTCPConnection(accepted)
+		close(done)
+	}()
+	return client.(*net.TCPConn), done
+}
+
+func TestTCPHalfClose(t *testing.T) {
+	// The target reads the whole request before answering, like a client
+	// that shuts down its sending side to mark the end of its request
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("received " + string(request)))
+	}()
+
+	client, done := startTCPProxy(t, &Config{}, backend.Addr().String())
+	if _, err := client.Write([]byte("QUIT")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatalf("Failed to close for writing: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(client)
+	if err != nil || string(reply) != "received QUIT" {
+		t.Errorf("Expected the reply after the half-close, got %q, %v", reply, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed once both sides are done")
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	config := &Config{TCP: TCPConfig{IdleTimeout: 200 * time.Millisecond}}
+	client, done := startTCPProxy(t, config, backend.Addr().String())
+
+	// Traffic keeps the connection open past the timeout
+	reply := make([]byte, 4)
+	for range 3 {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatalf("Expected the active connection to stay open, got %v", err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(reply); err == nil {
+		t.Error("Expected the idle connection to be closed for the client")
+	}
+}
+
+func TestTCPConfigValidate(t *testing.T) {
+	if err := (TCPConfig{KeepAlive: 15 * time.Second}).Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+	if err := (TCPConfig{KeepAlive: -time.Second}).Validate(); err == nil {
+		t.Error("Expected an error for a negative keep-alive interval")
+	}
+	if err := (TCPConfig{IdleTimeout: -time.Second}).Validate(); err == nil {
+		t.Error("Expected an error for a negative idle timeout")
+	}
+}
+
+func TestTCPStats(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadAll(conn)
+		conn.Write([]byte("pong!"))
+	}()
+
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer public.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	if err := router.AddTCPRoute("tunnel-1", public.Addr().(*net.TCPAddr).Port, "10.0.0.2", 25); err != nil {
+		t.Fatalf("Failed to add TCP route: %v", err)
+	}
+	collector := stats.NewCollector()
+	lb := NewLoadBalancer(router, config, collector)
+	reachable := true
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		if !reachable {
+			return nil, errors.New("tunnel down")
+		}
+		return net.Dial("tcp", backend.Addr().String())
+	})
+
+	proxy := func(request string) string {
+		t.Helper()
+		client, err := net.Dial("tcp", public.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+		accepted, err := public.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept: %v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			lb.handleTCPConnection(accepted)
+			close(done)
+		}()
+		client.Write([]byte(request))
+		client.(*net.TCPConn).CloseWrite()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, _ := io.ReadAll(client)
+		<-done
+		return string(reply)
+	}
+
+	if reply := proxy("ping"); reply != "pong!" {
+		t.Fatalf("Expected the reply of the target, got %q", reply)
+	}
+	reachable = false
+	proxy("ping")
+
+	snap := collector.Get("tunnel-1")
+	if snap.TCPAccepted != 2 || snap.TCPActive != 0 || snap.TCPDialFailures != 1 {
+		t.Errorf("Unexpected TCP connection counters: %+v", snap)
+	}
+	if snap.TCPBytesIn != 4 || snap.TCPBytesOut != 5 {
+		t.Errorf("Expected 4 bytes in and 5 out, got %d and %d", snap.TCPBytesIn, snap.TCPBytesOut)
+	}
+	if durations := collector.TCPDurations("tunnel-1"); durations.Count != 1 {
+		t.Errorf("Expected the duration of the proxied connection, got %+v", durations)
+	}
+}
@@ -0,0 +1,590 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Paths the load balancer serves itself on the hostnames of tunnels with
+// OIDC edge authentication
+const (
+	oidcCallbackPath = "/.easy-tunnel/oidc/callback"
+	oidcLogoutPath   = "/.easy-tunnel/oidc/logout"
+)
+
+// Cookies of the OIDC login flow: the session of a signed in client, and
+// the state of a login in progress
+const (
+	edgeSessionCookie = "easy_tunnel_session"
+	edgeStateCookie   = "easy_tunnel_oidc_state"
+)
+
+// Headers identifying the authenticated client to the target. The values
+// clients send are removed from the requests of tunnels with edge
+// authentication.
+const (
+	HeaderForwardedUser  = "X-Forwarded-User"
+	HeaderForwardedEmail = "X-Forwarded-Email"
+)
+
+const (
+	// edgeSessionTTL is how long a client stays signed in with OIDC
+	edgeSessionTTL = 12 * time.Hour
+
+	// oidcLoginTimeout bounds the time a client may take to sign in with
+	// the provider
+	oidcLoginTimeout = 10 * time.Minute
+
+	// oidcDiscoveryTTL is how long the endpoints of a provider are used
+	// before they are discovered again
+	oidcDiscoveryTTL = time.Hour
+
+	// maxVerifiedCredentials bounds the basic auth credentials remembered
+	// as verified, so that bcrypt runs once per client, not per request
+	maxVerifiedCredentials = 1024
+)
+
+// EdgeAuth makes the load balancer authenticate the clients of a tunnel
+// before proxying their requests, e.g. to share a preview environment
+// without exposing it publicly. Exactly one of BasicAuth and OIDC is set.
+type EdgeAuth struct {
+	// BasicAuth maps user names to bcrypt hashes of their passwords
+	BasicAuth map[string]string
+
+	// OIDC signs clients in with an OpenID Connect provider
+	OIDC *OIDCAuth
+}
+
+// OIDCAuth signs the clients of a tunnel in with an OpenID Connect
+// provider, using the authorization code flow. The provider must accept
+// https://<hostname>/.easy-tunnel/oidc/callback as redirect URI for every
+// hostname of the tunnel.
+type OIDCAuth struct {
+	// Issuer is the HTTPS URL of the provider, whose endpoints are
+	// discovered from its OpenID configuration
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+
+	// AllowedEmails and AllowedDomains, if set, let only users with one of
+	// these email addresses, or an address in one of these domains, in
+	AllowedEmails  []string
+	AllowedDomains []string
+}
+
+// Validate checks that edge authentication can be enforced
+func (a *EdgeAuth) Validate() error {
+	if (len(a.BasicAuth) > 0) == (a.OIDC != nil) {
+		return errors.New("edge authentication needs either basic auth credentials or OIDC")
+	}
+	for user, hash := range a.BasicAuth {
+		if user == "" || strings.Contains(user, ":") {
+			return fmt.Errorf("invalid basic auth user name %q", user)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash for user %s: %v", user, err)
+		}
+	}
+	if oidc := a.OIDC; oidc != nil {
+		issuer, err := url.Parse(oidc.Issuer)
+		if err != nil || issuer.Scheme != "https" || issuer.Host == "" {
+			return fmt.Errorf("invalid OIDC issuer %q: must be an https URL", oidc.Issuer)
+		}
+		if oidc.ClientID == "" {
+			return errors.New("OIDC client ID is required")
+		}
+	}
+	return nil
+}
+
+// allows reports whether a user with email may sign in
+func (o *OIDCAuth) allows(email string) bool {
+	if len(o.AllowedEmails) == 0 && len(o.AllowedDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	for _, allowed := range o.AllowedEmails {
+		if strings.EqualFold(allowed, email) {
+			return true
+		}
+	}
+	for _, domain := range o.AllowedDomains {
+		if strings.EqualFold(strings.TrimPrefix(domain, "@"), email[at+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// edgeAuthenticator holds the state of edge authentication shared by all
+// tunnels
+type edgeAuthenticator struct {
+	// secret signs session and login state cookies
+	secret []byte
+	client *http.Client
+
+	mu sync.Mutex
+	// verified holds the digests of basic auth credentials bcrypt accepted
+	verified map[[sha256.Size]byte]bool
+	// providers are the discovered endpoints of OIDC providers by issuer
+	providers map[string]*oidcProvider
+}
+
+// oidcProvider are the endpoints of an OpenID Connect provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+
+	discovered time.Time
+}
+
+// edgeSession is the signed session cookie of a client signed in with OIDC
+type edgeSession struct {
+	TunnelID string `json:"t"`
+	Issuer   string `json:"i"`
+	Subject  string `json:"s"`
+	Email    string `json:"e,omitempty"`
+	Expires  int64  `json:"x"`
+}
+
+// oidcLogin is the signed state of a login in progress
+type oidcLogin struct {
+	TunnelID string `json:"t"`
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Return   string `json:"r"`
+	Expires  int64  `json:"x"`
+}
+
+// newEdgeAuthenticator creates the edge authenticator, signing cookies
+// with secret or, if it is empty, a random key
+func newEdgeAuthenticator(secret string) *edgeAuthenticator {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &edgeAuthenticator{
+		secret:    key,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		verified:  make(map[[sha256.Size]byte]bool),
+		providers: make(map[string]*oidcProvider),
+	}
+}
+
+// authenticateEdge enforces the edge authentication of a tunnel. Requests
+// of authenticated clients are passed on without their credentials, with
+// the client's identity in HeaderForwardedUser and HeaderForwardedEmail.
+// Others are answered here: with a basic auth challenge, or by the OIDC
+// login flow. It reports whether the request may be proxied.
+func (lb *LoadBalancer) authenticateEdge(w http.ResponseWriter, r *http.Request, tunnelID string, options *TunnelOptions) bool {
+	auth := options.EdgeAuth
+	if auth == nil {
+		return true
+	}
+	// Clients cannot claim an identity of their own
+	r.Header.Del(HeaderForwardedUser)
+	r.Header.Del(HeaderForwardedEmail)
+
+	if auth.OIDC == nil {
+		user, password, ok := r.BasicAuth()
+		if ok && lb.edge.checkPassword(auth.BasicAuth[user], user, password) {
+			r.Header.Del("Authorization")
+			r.Header.Set(HeaderForwardedUser, user)
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", requestHost(r.Host)))
+		lb.serveErrorPage(w, r, tunnelID, PageUnauthorized)
+		return false
+	}
+
+	switch r.URL.Path {
+	case oidcCallbackPath:
+		lb.oidcCallback(w, r, tunnelID, auth.OIDC)
+		return false
+	case oidcLogoutPath:
+		http.SetCookie(w, lb.edge.cookie(r, edgeSessionCookie, "", "/", -1))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return false
+	}
+
+	var session edgeSession
+	if cookie, err := r.Cookie(edgeSessionCookie); err == nil && lb.edge.verify(cookie.Value, &session) &&
+		session.TunnelID == tunnelID && session.Issuer == auth.OIDC.Issuer &&
+		time.Now().Unix() < session.Expires && auth.OIDC.allows(session.Email) {
+		removeCookies(r, edgeSessionCookie, edgeStateCookie)
+		r.Header.Set(HeaderForwardedUser, session.Subject)
+		if session.Email != "" {
+			r.Header.Set(HeaderForwardedEmail, session.Email)
+		}
+		return true
+	}
+
+	// Only page loads can be sent to sign in
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		lb.serveErrorPage(w, r, tunnelID, PageUnauthorized)
+		return false
+	}
+	lb.oidcLogin(w, r, tunnelID, auth.OIDC)
+	return false
+}
+
+// checkPassword reports whether password matches the bcrypt hash of a
+// user, remembering credentials that do
+func (e *edgeAuthenticator) checkPassword(hash, user, password string) bool {
+	if hash == "" {
+		return false
+	}
+	key := sha256.Sum256([]byte(hash + "\x00" + user + "\x00" + password))
+	e.mu.Lock()
+	verified := e.verified[key]
+	e.mu.Unlock()
+	if verified {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.verified) >= maxVerifiedCredentials {
+		clear(e.verified)
+	}
+	e.verified[key] = true
+	return true
+}
+
+// oidcLogin sends a client to the provider to sign in, remembering where
+// it was going in the login state cookie
+func (lb *LoadBalancer) oidcLogin(w http.ResponseWriter, r *http.Request, tunnelID string, config *OIDCAuth) {
+	provider, err := lb.edge.provider(r.Context(), config.Issuer)
+	if err != nil {
+		lb.logger.Error().
+			Err(err).
+			Str("tunnel_id", tunnelID).
+			Str("issuer", config.Issuer).
+			Msg("Failed to discover OIDC provider")
+		lb.serveErrorPage(w, r, tunnelID, PageBadGateway)
+		return
+	}
+
+	login := oidcLogin{
+		TunnelID: tunnelID,
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Return:   r.URL.RequestURI(),
+		Expires:  time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	http.SetCookie(w, lb.edge.cookie(r, edgeStateCookie, lb.edge.sign(login), oidcCallbackPath, int(oidcLoginTimeout.Seconds())))
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {config.ClientID},
+		"redirect_uri":  {redirectURI(r)},
+		"scope":         {"openid email profile"},
+		"state":         {login.State},
+		"nonce":         {login.Nonce},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// oidcCallback completes a login: it exchanges the authorization code the
+// provider sent the client back with for an ID token, and signs the
+// client in if the token is valid and its user allowed
+func (lb *LoadBalancer) oidcCallback(w http.ResponseWriter, r *http.Request, tunnelID string, config *OIDCAuth) {
+	var login oidcLogin
+	cookie, err := r.Cookie(edgeStateCookie)
+	if err != nil || !lb.edge.verify(cookie.Value, &login) || login.TunnelID != tunnelID ||
+		time.Now().Unix() >= login.Expires || r.URL.Query().Get("state") != login.State {
+		http.Error(w, "Invalid or expired sign-in, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, lb.edge.cookie(r, edgeStateCookie, "", oidcCallbackPath, -1))
+	if reason := r.URL.Query().Get("error"); reason != "" {
+		lb.logger.Warn().
+			Str("tunnel_id", tunnelID).
+			Str("error", reason).
+			Msg("OIDC sign-in failed")
+		lb.serveErrorPage(w, r, tunnelID, PageUnauthorized)
+		return
+	}
+
+	claims, err := lb.edge.exchange(r.Context(), config, r.URL.Query().Get("code"), redirectURI(r))
+	if err == nil {
+		err = claims.validate(config, login.Nonce, time.Now())
+	}
+	if err != nil {
+		lb.logger.Error().
+			Err(err).
+			Str("tunnel_id", tunnelID).
+			Str("issuer", config.Issuer).
+			Msg("Failed to complete OIDC sign-in")
+		lb.serveErrorPage(w, r, tunnelID, PageBadGateway)
+		return
+	}
+	// Unverified addresses are not trusted
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		claims.Email = ""
+	}
+	if !config.allows(claims.Email) {
+		lb.logger.Warn().
+			Str("tunnel_id", tunnelID).
+			Str("subject", claims.Subject).
+			Str("email", claims.Email).
+			Msg("OIDC user not allowed")
+		lb.serveErrorPage(w, r, tunnelID, PageForbidden)
+		return
+	}
+
+	session := edgeSession{
+		TunnelID: tunnelID,
+		Issuer:   config.Issuer,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		Expires:  time.Now().Add(edgeSessionTTL).Unix(),
+	}
+	http.SetCookie(w, lb.edge.cookie(r, edgeSessionCookie, lb.edge.sign(session), "/", int(edgeSessionTTL.Seconds())))
+	lb.logger.Info().
+		Str("tunnel_id", tunnelID).
+		Str("subject", claims.Subject).
+		Str("email", claims.Email).
+		Msg("Client signed in with OIDC")
+
+	// Only return to paths on this hostname
+	location := login.Return
+	if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") || strings.HasPrefix(location, "/\\") {
+		location = "/"
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// provider returns the endpoints of the provider of issuer, discovering
+// them from its OpenID configuration if needed
+func (e *edgeAuthenticator) provider(ctx context.Context, issuer string) (*oidcProvider, error) {
+	e.mu.Lock()
+	provider := e.providers[issuer]
+	e.mu.Unlock()
+	if provider != nil && time.Since(provider.discovered) < oidcDiscoveryTTL {
+		return provider, nil
+	}
+
+	discovered := &oidcProvider{}
+	if err := e.getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", discovered); err != nil {
+		return nil, err
+	}
+	if discovered.Issuer != issuer {
+		return nil, fmt.Errorf("provider claims issuer %q", discovered.Issuer)
+	}
+	for _, endpoint := range []string{discovered.AuthorizationEndpoint, discovered.TokenEndpoint} {
+		if !strings.HasPrefix(endpoint, "https://") {
+			return nil, fmt.Errorf("provider endpoint %q is not an https URL", endpoint)
+		}
+	}
+	discovered.discovered = time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.providers[issuer] = discovered
+	return discovered, nil
+}
+
+// idTokenClaims are the claims of an ID token checked by the load balancer
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expires       float64  `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+}
+
+// audience is the aud claim, a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// validate checks that an ID token was issued for this login
+func (c *idTokenClaims) validate(config *OIDCAuth, nonce string, now time.Time) error {
+	switch {
+	case c.Issuer != config.Issuer:
+		return fmt.Errorf("ID token issued by %q", c.Issuer)
+	case !slices.Contains(c.Audience, config.ClientID):
+		return fmt.Errorf("ID token issued to %v", []string(c.Audience))
+	case float64(now.Unix()) >= c.Expires:
+		return errors.New("ID token expired")
+	case c.Nonce != nonce:
+		return errors.New("ID token nonce does not match")
+	case c.Subject == "":
+		return errors.New("ID token has no subject")
+	}
+	return nil
+}
+
+// exchange redeems an authorization code at the provider's token endpoint
+// and returns the claims of the ID token. The token comes straight from
+// the provider over TLS, so, as OpenID Connect allows for the code flow,
+// its signature is not checked.
+func (e *edgeAuthenticator) exchange(ctx context.Context, config *OIDCAuth, code, redirectURI string) (*idTokenClaims, error) {
+	provider, err := e.provider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := e.doJSON(req, &token); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %v", err)
+	}
+	return &claims, nil
+}
+
+// getJSON fetches a JSON document
+func (e *edgeAuthenticator) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	return e.doJSON(req, v)
+}
+
+// doJSON sends a request to a provider and decodes its JSON response
+func (e *edgeAuthenticator) doJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", req.URL.Redacted(), resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// sign encodes v as a cookie value signed with the secret
+func (e *edgeAuthenticator) sign(v interface{}) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(e.mac(payload))
+}
+
+// verify decodes a cookie value into v, reporting whether it was signed
+// with the secret
+func (e *edgeAuthenticator) verify(value string, v interface{}) bool {
+	payload, signature, found := strings.Cut(value, ".")
+	if !found {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, e.mac(payload)) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+func (e *edgeAuthenticator) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, e.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// cookie returns a cookie of the login flow; a negative maxAge deletes it
+func (e *edgeAuthenticator) cookie(r *http.Request, name, value, path string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// redirectURI is where the provider sends clients of a request's hostname
+// back to
+func redirectURI(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oidcCallbackPath
+}
+
+// removeCookies removes the named cookies from a request, so they do not
+// reach the target
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !slices.Contains(names, cookie.Name) {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// randomToken returns a random URL-safe token
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
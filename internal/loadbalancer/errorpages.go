@@ -0,0 +1,210 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// ErrorPage names a page the load balancer answers with when it cannot
+// proxy a request
+type ErrorPage string
+
+const (
+	// PageUnauthorized is served to clients failing a tunnel's edge
+	// authentication
+	PageUnauthorized ErrorPage = "401"
+	// PageForbidden is served to clients a tunnel's access lists deny
+	PageForbidden ErrorPage = "403"
+	// PageNotFound is served for hostnames without a tunnel
+	PageNotFound ErrorPage = "404"
+	// PageTooLarge is served for request bodies over the size limit
+	PageTooLarge ErrorPage = "413"
+	// PageTooManyRequests is served to clients over their rate or
+	// connection limit
+	PageTooManyRequests ErrorPage = "429"
+	// PageBadGateway is served when the target could not be reached
+	PageBadGateway ErrorPage = "502"
+	// PageUnavailable is served when the circuits of all targets are open
+	PageUnavailable ErrorPage = "503"
+	// PageGatewayTimeout is served when the target did not answer in time
+	PageGatewayTimeout ErrorPage = "504"
+	// PageMaintenance is served while a tunnel is in maintenance mode
+	PageMaintenance ErrorPage = "maintenance"
+)
+
+// errorPages lists the pages and the status they are served with
+var errorPages = map[ErrorPage]int{
+	PageUnauthorized:    http.StatusUnauthorized,
+	PageForbidden:       http.StatusForbidden,
+	PageNotFound:        http.StatusNotFound,
+	PageTooLarge:        http.StatusRequestEntityTooLarge,
+	PageTooManyRequests: http.StatusTooManyRequests,
+	PageBadGateway:      http.StatusBadGateway,
+	PageUnavailable:     http.StatusServiceUnavailable,
+	PageGatewayTimeout:  http.StatusGatewayTimeout,
+	PageMaintenance:     http.StatusServiceUnavailable,
+}
+
+// ErrorPageData is what error page templates are rendered with
+type ErrorPageData struct {
+	Status      int
+	StatusText  string
+	Host        string
+	Maintenance bool
+
+	// RequestID and Cause identify requests that could not be proxied and
+	// why, such as connection_refused; both are empty for other pages
+	RequestID string
+	Cause     string
+}
+
+// defaultErrorPage is served for pages without a template of their own
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{if .Maintenance}}Down for maintenance{{else}}{{.Status}} {{.StatusText}}{{end}}</h1>
+<p>{{if .Maintenance}}{{.Host}} is being updated and will be back shortly.{{else}}The service at {{.Host}} could not handle the request.{{end}}</p>
+{{if .RequestID}}<p>Request ID: {{.RequestID}}{{if .Cause}} ({{.Cause}}){{end}}</p>
+{{end}}</body>
+</html>
+`))
+
+// ParseErrorPages parses error page templates by page name, the status
+// code of the page or "maintenance"
+func ParseErrorPages(pages map[string]string) (map[ErrorPage]*template.Template, error) {
+	parsed := make(map[ErrorPage]*template.Template, len(pages))
+	for name, text := range pages {
+		page := ErrorPage(name)
+		if _, ok := errorPages[page]; !ok {
+			return nil, fmt.Errorf("unknown error page %q", name)
+		}
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page %s: %v", name, err)
+		}
+		parsed[page] = tmpl
+	}
+	return parsed, nil
+}
+
+// cachedPage is a parsed tunnel error page and the text it was parsed from
+type cachedPage struct {
+	text string
+	tmpl *template.Template
+}
+
+// errorPageStore holds the global error pages and caches those of tunnels
+type errorPageStore struct {
+	mu      sync.Mutex
+	global  map[ErrorPage]*template.Template
+	tunnels map[string]map[ErrorPage]cachedPage
+}
+
+// load reads the global error pages from files named after the pages in
+// dir, e.g. 502.html and maintenance.html; missing files keep the default
+func (s *errorPageStore) load(dir string) error {
+	pages := make(map[string]string)
+	for page := range errorPages {
+		text, err := os.ReadFile(filepath.Join(dir, string(page)+".html"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read error page: %v", err)
+		}
+		pages[string(page)] = string(text)
+	}
+	parsed, err := ParseErrorPages(pages)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.global = parsed
+	return nil
+}
+
+// template returns the template of a page for a tunnel: its own if set,
+// otherwise the global one or the default
+func (s *errorPageStore) template(tunnelID string, page ErrorPage, custom map[string]string) *template.Template {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if text, ok := custom[string(page)]; ok {
+		if cached, ok := s.tunnels[tunnelID][page]; ok && cached.text == text {
+			return cached.tmpl
+		}
+		// Pages are validated when they are set, so this only fails if
+		// they bypassed validation
+		if tmpl, err := template.New(string(page)).Parse(text); err == nil {
+			if s.tunnels == nil {
+				s.tunnels = make(map[string]map[ErrorPage]cachedPage)
+			}
+			if s.tunnels[tunnelID] == nil {
+				s.tunnels[tunnelID] = make(map[ErrorPage]cachedPage)
+			}
+			s.tunnels[tunnelID][page] = cachedPage{text: text, tmpl: tmpl}
+			return tmpl
+		}
+	}
+	if tmpl, ok := s.global[page]; ok {
+		return tmpl
+	}
+	return defaultErrorPage
+}
+
+// forget drops the cached pages of a removed tunnel
+func (s *errorPageStore) forget(tunnelID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tunnels, tunnelID)
+}
+
+// serveErrorPage answers a request with an error page of the tunnel it was
+// routed to, if any
+func (lb *LoadBalancer) serveErrorPage(w http.ResponseWriter, r *http.Request, tunnelID string, page ErrorPage) {
+	lb.serveErrorPageData(w, r, tunnelID, page, ErrorPageData{})
+}
+
+// serveErrorPageData serves an error page rendered with data, whose status
+// and host are filled in
+func (lb *LoadBalancer) serveErrorPageData(w http.ResponseWriter, r *http.Request, tunnelID string, page ErrorPage, data ErrorPageData) {
+	status := errorPages[page]
+	var custom map[string]string
+	if tunnelID != "" {
+		custom = lb.optionsOf(tunnelID).ErrorPages
+	}
+
+	var body bytes.Buffer
+	data.Status = status
+	data.StatusText = http.StatusText(status)
+	data.Host = r.Host
+	data.Maintenance = page == PageMaintenance
+	if err := lb.errorPages.template(tunnelID, page, custom).Execute(&body, data); err != nil {
+		lb.logger.Error().
+			Err(err).
+			Str("tunnel_id", tunnelID).
+			Str("page", string(page)).
+			Msg("Failed to render error page")
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body.Bytes())
+	}
+}
@@ -0,0 +1,43 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors of the router, for callers such as the API to tell them
+// apart with errors.Is
+var (
+	// ErrNotFound is the kind of errors for routes and connections that do
+	// not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is the kind of errors for routes that clash with the
+	// hostnames, paths or ports of existing ones
+	ErrConflict = errors.New("conflict")
+)
+
+// kindError is an error of one of the kinds above
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// notFoundf returns an ErrNotFound error
+func notFoundf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrNotFound, message: fmt.Sprintf(format, args...)}
+}
+
+// conflictf returns an ErrConflict error
+func conflictf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrConflict, message: fmt.Sprintf(format, args...)}
+}
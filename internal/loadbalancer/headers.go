@@ -0,0 +1,177 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HeaderRules change the headers of a tunnel's requests on their way to
+// the target and of its responses on their way back, e.g. to strip
+// internal headers or to add HSTS or CORS headers
+type HeaderRules struct {
+	Request  HeaderRuleSet
+	Response HeaderRuleSet
+}
+
+// HeaderRuleSet changes headers: Remove deletes headers, then Set replaces
+// their values and Add appends values
+type HeaderRuleSet struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+// Validate checks that the rules only use valid header names and values
+func (r HeaderRules) Validate() error {
+	if err := r.Request.validate(); err != nil {
+		return fmt.Errorf("invalid request header rule: %v", err)
+	}
+	if err := r.Response.validate(); err != nil {
+		return fmt.Errorf("invalid response header rule: %v", err)
+	}
+	return nil
+}
+
+func (s HeaderRuleSet) validate() error {
+	for _, values := range []map[string]string{s.Set, s.Add} {
+		for name, value := range values {
+			if !validHeaderName(name) {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+			if strings.ContainsAny(value, "\r\n\x00") {
+				return fmt.Errorf("invalid value of header %s", name)
+			}
+		}
+	}
+	for _, name := range s.Remove {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// apply changes header by the rules
+func (s HeaderRuleSet) apply(header http.Header) {
+	for _, name := range s.Remove {
+		header.Del(name)
+	}
+	for name, value := range s.Set {
+		header.Set(name, value)
+	}
+	for name, value := range s.Add {
+		header.Add(name, value)
+	}
+}
+
+// validHeaderName reports whether name is an RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// HostRewrite replaces the Host and Origin headers of a tunnel's requests
+// for backends that expect their own name rather than the public hostname
+type HostRewrite struct {
+	// Host, if set, replaces the Host header; X-Forwarded-Host and
+	// Forwarded keep the public hostname
+	Host string
+
+	// Origin, if set, replaces the Origin header of requests from pages of
+	// the public hostname, such as for backends checking it against their
+	// own address. Other origins are passed on as they are, so they cannot
+	// pose as the backend. Access-Control-Allow-Origin headers naming
+	// Origin are changed back to the public origin.
+	Origin string
+}
+
+// Validate checks that Host is a host[:port] and Origin a
+// scheme://host[:port] without a path
+func (r HostRewrite) Validate() error {
+	if r.Host != "" {
+		u, err := url.Parse("//" + r.Host)
+		if err != nil || u.Host != r.Host || u.User != nil || u.Hostname() == "" {
+			return fmt.Errorf("invalid host rewrite %q, use host or host:port", r.Host)
+		}
+	}
+	if r.Origin != "" {
+		u, err := url.Parse(r.Origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+			u.Opaque != "" || u.Path != "" || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+			return fmt.Errorf("invalid origin rewrite %q, use scheme://host or scheme://host:port", r.Origin)
+		}
+	}
+	return nil
+}
+
+// publicOrigin returns the Origin header of a client's request if it is
+// the origin of the requested hostname, and "" otherwise
+func publicOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if origin := r.Header.Get("Origin"); strings.EqualFold(origin, scheme+"://"+r.Host) {
+		return origin
+	}
+	return ""
+}
+
+// rewriteHost sets the Host and Origin headers of a request to the
+// attempt's target as its tunnel's HostRewrite asks, starting from those
+// the client sent, so that a retry on another tunnel undoes the rewrites
+// of the previous one
+func (lb *LoadBalancer) rewriteHost(req *http.Request, attempt *proxyAttempt) {
+	rewrite := attempt.options.HostRewrite
+	req.Host = attempt.host
+	if rewrite.Host != "" {
+		req.Host = rewrite.Host
+	}
+	if attempt.origin != "" {
+		req.Header.Set("Origin", attempt.origin)
+		if rewrite.Origin != "" {
+			req.Header.Set("Origin", rewrite.Origin)
+		}
+	}
+}
+
+// restoreOrigin changes an Access-Control-Allow-Origin header granting the
+// rewritten origin back to the public origin the client sent, if any
+func (r HostRewrite) restoreOrigin(header http.Header, origin string) {
+	if r.Origin != "" && origin != "" && strings.EqualFold(header.Get("Access-Control-Allow-Origin"), r.Origin) {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// modifyResponse caches the response if it may be, and applies the
+// response header rules and compression of the tunnel that answered a
+// request
+func (lb *LoadBalancer) modifyResponse(resp *http.Response) error {
+	if attempt, ok := resp.Request.Context().Value(proxyAttemptKey{}).(*proxyAttempt); ok {
+		lb.storeResponse(resp)
+		lb.transformResponse(resp, attempt.options, attempt.origin)
+	}
+	return nil
+}
+
+// transformResponse applies the origin rewrite, response header rules and
+// compression of a tunnel with options to one of its responses; origin is
+// the public origin of the request, as publicOrigin returns it
+func (lb *LoadBalancer) transformResponse(resp *http.Response, options *TunnelOptions, origin string) {
+	options.HostRewrite.restoreOrigin(resp.Header, origin)
+	if rules := options.HeaderRules; rules != nil {
+		rules.Response.apply(resp.Header)
+	}
+	prepareStream(resp)
+	compressResponse(resp, lb.compression(options))
+}
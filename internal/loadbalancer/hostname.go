@@ -0,0 +1,202 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+// NormalizeHostname returns the canonical form of a hostname routes are
+// registered and looked up by: lowercase, without a trailing dot, and with
+// internationalized labels converted to punycode ("xn--" labels). It fails
+// if the result is not a valid RFC 1123 hostname.
+func NormalizeHostname(hostname string) (string, error) {
+	name := normalizeHost(hostname)
+	if name == "" {
+		return "", fmt.Errorf("invalid hostname %q: empty", hostname)
+	}
+	if len(name) > 253 {
+		return "", fmt.Errorf("invalid hostname %q: longer than 253 characters", hostname)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if err := validateLabel(label); err != nil {
+			return "", fmt.Errorf("invalid hostname %q: %v", hostname, err)
+		}
+	}
+	return name, nil
+}
+
+// normalizeRouteHostname returns the canonical form of the hostname of an
+// HTTP route, which unlike NormalizeHostname may be a wildcard: "*.domain"
+// for any subdomain of domain, or "*" for any hostname
+func normalizeRouteHostname(hostname string) (string, error) {
+	if hostname == "*" {
+		return hostname, nil
+	}
+	domain, wildcard := strings.CutPrefix(hostname, "*.")
+	if !wildcard {
+		return NormalizeHostname(hostname)
+	}
+	name, err := NormalizeHostname(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid wildcard hostname %q: %v", hostname, err)
+	}
+	return "*." + name, nil
+}
+
+// normalizeHost converts a hostname to its canonical form without
+// validating it, so that lookups of invalid hostnames simply find nothing
+func normalizeHost(hostname string) string {
+	name := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if isASCII(name) {
+		return name
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if isASCII(label) || !utf8.ValidString(label) {
+			continue
+		}
+		if encoded, ok := punycode(label); ok {
+			labels[i] = "xn--" + encoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// requestHost returns the canonical hostname of a Host header, without its
+// port and, for IPv6 literals, brackets
+func requestHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return normalizeHost(host)
+}
+
+// validateLabel checks that a label is 1 to 63 letters, digits and inner
+// hyphens
+func validateLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty label")
+	}
+	if len(label) > 63 {
+		return fmt.Errorf("label %q longer than 63 characters", label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return fmt.Errorf("label %q contains %q", label, c)
+		}
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters (RFC 3492 section 5)
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// punycode encodes a label as in RFC 3492. It returns false if the label is
+// too long to encode.
+func punycode(label string) (string, bool) {
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for handled := basic; handled < len(runes); {
+		// The smallest code point not handled yet
+		m := rune(0x10ffff)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		if delta < 0 {
+			return "", false
+		}
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := k - bias
+				if t < punycodeTMin {
+					t = punycodeTMin
+				} else if t > punycodeTMax {
+					t = punycodeTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), true
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > (punycodeBase-punycodeTMin)*punycodeTMax/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
@@ -0,0 +1,175 @@
+package loadbalancer
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		expected string
+		wantErr  bool
+	}{
+		{hostname: "app.example.com", expected: "app.example.com"},
+		{hostname: "App.Example.COM", expected: "app.example.com"},
+		{hostname: "app.example.com.", expected: "app.example.com"},
+		{hostname: "localhost", expected: "localhost"},
+		{hostname: "bücher.example", expected: "xn--bcher-kva.example"},
+		{hostname: "MÜNCHEN.de", expected: "xn--mnchen-3ya.de"},
+		{hostname: "例え.jp", expected: "xn--r8jz45g.jp"},
+		{hostname: "xn--bcher-kva.example", expected: "xn--bcher-kva.example"},
+		{hostname: "", wantErr: true},
+		{hostname: ".", wantErr: true},
+		{hostname: "app..example.com", wantErr: true},
+		{hostname: "-app.example.com", wantErr: true},
+		{hostname: "app-.example.com", wantErr: true},
+		{hostname: "app_1.example.com", wantErr: true},
+		{hostname: "*.example.com", wantErr: true},
+		{hostname: "app.example.com:8080", wantErr: true},
+		{hostname: strings.Repeat("a", 64) + ".example.com", wantErr: true},
+		{hostname: strings.Repeat("a.", 127) + "com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got, err := NormalizeHostname(tt.hostname)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeHostname(%q) error = %v, wantErr %v", tt.hostname, err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRouteNormalizedHostname(t *testing.T) {
+	router := NewRouter(&Config{})
+	if err := router.AddBackend("app", "App.Example.COM.", "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.AddPathRoute("shop", "bücher.example", PathMatch{Type: PathMatchPrefix, Value: "/"}, "10.0.0.2", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.AddBackend("bad", "bad host", "10.0.0.3", 80); err == nil {
+		t.Error("Expected an error for an invalid hostname")
+	}
+
+	for host, expected := range map[string]string{
+		"app.example.com":       "app",
+		"APP.example.com.":      "app",
+		"xn--bcher-kva.example": "shop",
+		"BÜCHER.example":        "shop",
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Host = host
+		target, _, err := router.RouteRequest(req)
+		if err != nil {
+			t.Errorf("Expected a route for %s, got %v", host, err)
+			continue
+		}
+		if target.ID != expected {
+			t.Errorf("Expected %s to route to %s, got %s", host, expected, target.ID)
+		}
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"app.example.com":      "app.example.com",
+		"app.example.com:8443": "app.example.com",
+		"App.Example.com.:80":  "app.example.com",
+		"[2001:db8::1]:8080":   "2001:db8::1",
+		"[2001:DB8::1]":        "2001:db8::1",
+		"192.0.2.1:80":         "192.0.2.1",
+		"bücher.example:443":   "xn--bcher-kva.example",
+	} {
+		if got := requestHost(host); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, host, got)
+		}
+	}
+}
+
+func TestRouteRequestHost(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultTunnel string
+		host          string
+		expected      string
+	}{
+		{name: "Plain hostname", host: "app.example.com", expected: "app"},
+		{name: "Hostname with port", host: "app.example.com:8443", expected: "app"},
+		{name: "Uppercase hostname with port", host: "APP.example.com.:443", expected: "app"},
+		{name: "IPv6 literal with default tunnel", defaultTunnel: "fallback", host: "[2001:db8::1]:8080", expected: "fallback"},
+		{name: "Unknown hostname", host: "other.example.com"},
+		{name: "Unknown hostname with default tunnel", defaultTunnel: "fallback", host: "other.example.com:8080", expected: "fallback"},
+		{name: "Known hostname with default tunnel", defaultTunnel: "fallback", host: "app.example.com", expected: "app"},
+		{name: "Default tunnel without route", defaultTunnel: "missing", host: "other.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&Config{DefaultTunnel: tt.defaultTunnel})
+			if err := router.AddBackend("app", "app.example.com", "10.0.0.1", 80); err != nil {
+				t.Fatalf("Failed to add route: %v", err)
+			}
+			if err := router.AddBackend("fallback", "fallback.example.com", "10.0.0.3", 80); err != nil {
+				t.Fatalf("Failed to add route: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.Host = tt.host
+			target, _, err := router.RouteRequest(req)
+			if tt.expected == "" {
+				if err == nil {
+					t.Errorf("Expected no route, got %s", target.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if target.ID != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, target.ID)
+			}
+		})
+	}
+}
+
+func TestDefaultTunnelResolution(t *testing.T) {
+	router := NewRouter(&Config{DefaultTunnel: "fallback"})
+	req := httptest.NewRequest("GET", "http://unknown.example.com/", nil)
+	if _, _, err := router.RouteRequest(req); err == nil {
+		t.Fatal("Expected no route without a default tunnel route")
+	}
+
+	// With only path routes the first by hostname is used, whatever order
+	// they were added in
+	for _, hostname := range []string{"b.example.com", "a.example.com", "c.example.com"} {
+		ip := map[string]string{"a.example.com": "10.0.0.1", "b.example.com": "10.0.0.2", "c.example.com": "10.0.0.3"}[hostname]
+		if err := router.AddPathRoute("fallback", hostname, PathMatch{Type: PathMatchPrefix, Value: "/"}, ip, 80); err != nil {
+			t.Fatalf("Failed to add route: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		target, _, err := router.RouteRequest(req)
+		if err != nil || target.IP != "10.0.0.1" {
+			t.Fatalf("Expected the route of a.example.com, got %v, %v", target, err)
+		}
+	}
+
+	// Hostname routes are preferred over path routes
+	if err := router.AddBackend("fallback", "z.example.com", "10.0.0.9", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if target, _, _ := router.RouteRequest(req); target == nil || target.IP != "10.0.0.9" {
+		t.Errorf("Expected the hostname route, got %v", target)
+	}
+
+	router.RemoveRoute("fallback")
+	if _, _, err := router.RouteRequest(req); err == nil {
+		t.Error("Expected no route after the default tunnel was removed")
+	}
+}
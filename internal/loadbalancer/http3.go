@@ -0,0 +1,53 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startHTTP3Server serves handler over HTTP/3 on the UDP port of the HTTPS
+// listener. If the port cannot be bound, HTTP/3 stays off and is not
+// advertised, as clients would otherwise try it first and fall back late.
+func (lb *LoadBalancer) startHTTP3Server(addr string, handler http.Handler, tlsConfig *tls.Config) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		lb.logger.Error().
+			Err(err).
+			Str("addr", addr).
+			Msg("Failed to listen for HTTP/3, serving HTTP/1.1 and HTTP/2 only")
+		return
+	}
+
+	server := &http3.Server{
+		Handler:        handler,
+		TLSConfig:      http3.ConfigureTLSConfig(tlsConfig),
+		MaxHeaderBytes: lb.router.config.Limits.MaxHeaderBytes,
+		IdleTimeout:    lb.router.config.Timeouts.Idle,
+	}
+	lb.http3Server = server
+
+	go func() {
+		if err := server.Serve(conn); err != nil && err != http.ErrServerClosed {
+			lb.logger.Error().Err(err).Msg("HTTP/3 server error")
+		}
+	}()
+
+	lb.logger.Info().
+		Str("addr", conn.LocalAddr().String()).
+		Msg("Serving HTTP/3")
+}
+
+// advertiseHTTP3 makes responses over TCP announce the HTTP/3 listener in
+// an Alt-Svc header
+func advertiseHTTP3(server *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			server.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
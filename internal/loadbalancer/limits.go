@@ -0,0 +1,68 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxHeaderBytes bounds the request line and headers of a request
+// if no limit is configured
+const DefaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
+
+// Limits bound how much a client may send to the public HTTP listener
+type Limits struct {
+	// MaxRequestBody is the largest request body accepted, in bytes;
+	// larger requests are answered with 413 Request Entity Too Large. Zero
+	// accepts bodies of any size.
+	MaxRequestBody int64
+
+	// MaxHeaderBytes bounds the request line and headers of a request;
+	// zero uses DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+}
+
+// Validate checks that no limit is negative
+func (l Limits) Validate() error {
+	if l.MaxRequestBody < 0 {
+		return fmt.Errorf("invalid max request body size: %d", l.MaxRequestBody)
+	}
+	if l.MaxHeaderBytes < 0 {
+		return fmt.Errorf("invalid max header bytes: %d", l.MaxHeaderBytes)
+	}
+	return nil
+}
+
+// limitRequestBody rejects a request whose declared body is too large and
+// caps the body of the others, reporting whether the request may proceed
+func (lb *LoadBalancer) limitRequestBody(w http.ResponseWriter, r *http.Request, tunnelID string, options *TunnelOptions) bool {
+	limit := lb.router.config.Limits.MaxRequestBody
+	if override := options.MaxRequestBody; override > 0 {
+		limit = override
+	}
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		lb.logger.Warn().
+			Str("host", r.Host).
+			Str("client_ip", clientIP(r.RemoteAddr)).
+			Str("tunnel_id", tunnelID).
+			Int64("content_length", r.ContentLength).
+			Msg("Request body too large")
+		// The body is not read, so the connection cannot be reused
+		w.Header().Set("Connection", "close")
+		lb.serveErrorPage(w, r, tunnelID, PageTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// isBodyTooLarge reports whether err means a request body exceeded the
+// limit while it was proxied
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
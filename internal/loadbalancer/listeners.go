@@ -0,0 +1,293 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Protocols of additional listeners
+const (
+	ListenerHTTP  = "http"
+	ListenerHTTPS = "https"
+	ListenerTCP   = "tcp"
+	ListenerUDP   = "udp"
+)
+
+// Listener is a public address served in addition to the HTTP and TCP
+// ports, e.g. on a private network interface
+type Listener struct {
+	// Name identifies the listener in logs
+	Name string
+
+	// Protocol is http or https, serving requests routed by hostname, or
+	// tcp or udp, serving connections or datagrams routed by the
+	// listener's port
+	Protocol string
+
+	// Address is the host:port to bind; an empty host binds all addresses
+	Address string
+
+	// TLS is the certificate of an https listener; nil serves the
+	// certificate of the HTTP port
+	TLS *TLSConfig
+}
+
+// Validate checks that the listener is usable
+func (l Listener) Validate() error {
+	if l.Name == "" {
+		return fmt.Errorf("listener without a name")
+	}
+	switch l.Protocol {
+	case ListenerHTTP, ListenerTCP, ListenerUDP:
+		if l.TLS != nil {
+			return fmt.Errorf("listener %s: a certificate needs the https protocol", l.Name)
+		}
+	case ListenerHTTPS:
+		if l.TLS != nil && (l.TLS.CertFile == "" || l.TLS.KeyFile == "") {
+			return fmt.Errorf("listener %s: certificate and key must be given together", l.Name)
+		}
+	default:
+		return fmt.Errorf("listener %s: unknown protocol %q (want %s, %s, %s or %s)", l.Name, l.Protocol, ListenerHTTP, ListenerHTTPS, ListenerTCP, ListenerUDP)
+	}
+	_, port, err := net.SplitHostPort(l.Address)
+	if err != nil {
+		return fmt.Errorf("listener %s: invalid address %q", l.Name, l.Address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("listener %s: invalid port %q", l.Name, port)
+	}
+	return nil
+}
+
+// ParseListeners parses a comma-separated list of additional listeners in
+// the form name=protocol://host:port, where https listeners may name their
+// own certificate, e.g. "private=http://10.0.0.5:8080,partner=https://
+// 192.0.2.10:8443?cert=/etc/partner.pem&key=/etc/partner.key,dns=udp://
+// :53". Names must be unique, and so must addresses of the same transport.
+func ParseListeners(spec string) ([]Listener, error) {
+	var listeners []Listener
+	names := make(map[string]bool)
+	addresses := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid listener %q, want name=protocol://host:port", entry)
+		}
+		u, err := url.Parse(rest)
+		if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid listener %q, want name=protocol://host:port", entry)
+		}
+
+		listener := Listener{Name: strings.TrimSpace(name), Protocol: u.Scheme, Address: u.Host}
+		query := u.Query()
+		if cert, key := query.Get("cert"), query.Get("key"); cert != "" || key != "" {
+			listener.TLS = &TLSConfig{CertFile: cert, KeyFile: key}
+		}
+		if err := listener.Validate(); err != nil {
+			return nil, err
+		}
+		if names[listener.Name] {
+			return nil, fmt.Errorf("duplicate listener %s", listener.Name)
+		}
+		// UDP sockets can share the address of a TCP one
+		address := listener.Address
+		if listener.Protocol == ListenerUDP {
+			address = "udp/" + address
+		}
+		if other, exists := addresses[address]; exists {
+			return nil, fmt.Errorf("listeners %s and %s share address %s", other, listener.Name, listener.Address)
+		}
+		names[listener.Name] = true
+		addresses[address] = listener.Name
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// startListeners binds and serves the additional listeners. Must be called
+// with lb.mu held, after the HTTP and TCP servers were started.
+func (lb *LoadBalancer) startListeners() error {
+	for _, l := range lb.router.config.Listeners {
+		if err := lb.startListener(l); err != nil {
+			return fmt.Errorf("failed to start listener %s: %v", l.Name, err)
+		}
+		if lb.listening == nil {
+			lb.listening = make(map[string]bool)
+		}
+		lb.listening[l.Name] = true
+		lb.logger.Info().
+			Str("listener", l.Name).
+			Str("protocol", l.Protocol).
+			Str("addr", l.Address).
+			Msg("Serving additional listener")
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) startListener(l Listener) error {
+	if l.Protocol == ListenerUDP {
+		conn, err := net.ListenPacket("udp", l.Address)
+		if err != nil {
+			return err
+		}
+		lb.udpConns = append(lb.udpConns, conn)
+		go lb.serveUDP(conn)
+		return nil
+	}
+
+	var none net.Listener
+	if l.Protocol == ListenerTCP {
+		listeners, err := lb.listen(&none, l.Address)
+		if err != nil {
+			return err
+		}
+		lb.tcpListeners = append(lb.tcpListeners, listeners...)
+		lb.acceptTCP(listeners)
+		return nil
+	}
+
+	server := lb.newHTTPServer(l.Address)
+	if l.Protocol == ListenerHTTPS {
+		certs := lb.certs
+		if l.TLS != nil {
+			certs = &certificateStore{stapling: lb.tlsPolicy().OCSPStapling}
+			if err := certs.load(l.TLS.CertFile, l.TLS.KeyFile); err != nil {
+				return err
+			}
+			lb.listenerCerts = append(lb.listenerCerts, certs)
+		}
+		if certs == nil && lb.onDemand != nil {
+			certs = &certificateStore{}
+		}
+		if certs == nil {
+			return fmt.Errorf("no certificate for https, configure one for the listener or the HTTP port")
+		}
+		server.TLSConfig = lb.serverTLSConfig(certs)
+		lb.tlsPolicy().configureServer(server)
+	} else if lb.onDemand != nil {
+		// Answer HTTP-01 challenges of the CA for on-demand certificates
+		server.Handler = lb.onDemand.manager.HTTPHandler(server.Handler)
+	}
+	listeners, err := lb.listen(&none, l.Address)
+	if err != nil {
+		return err
+	}
+	lb.listenerServers = append(lb.listenerServers, server)
+	lb.serveHTTP(server, listeners, l.Protocol == ListenerHTTPS)
+	return nil
+}
+
+// ListenerState is the state of a port the load balancer serves
+type ListenerState struct {
+	// Name is "http", "tcp" or "http3" for the main ports, or the name of
+	// an additional listener
+	Name      string
+	Protocol  string
+	Address   string
+	Listening bool
+}
+
+// ListenerStates returns the state of the HTTP and TCP ports, the HTTP/3
+// port if enabled, and the additional listeners
+func (lb *LoadBalancer) ListenerStates() []ListenerState {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	config := lb.router.config
+	tlsConfig := config.TLSConfig
+	httpProtocol := ListenerHTTP
+	if lb.certs != nil || lb.onDemand != nil || (tlsConfig != nil && tlsConfig.CertFile != "") {
+		httpProtocol = ListenerHTTPS
+	}
+	httpAddress := net.JoinHostPort(config.Host, strconv.Itoa(config.HTTPPort))
+	states := []ListenerState{
+		{Name: "http", Protocol: httpProtocol, Address: httpAddress, Listening: lb.httpServer != nil},
+		{Name: "tcp", Protocol: ListenerTCP, Address: net.JoinHostPort(config.Host, strconv.Itoa(config.TCPPort)), Listening: lb.tcpListeners != nil},
+	}
+	if tlsConfig != nil && tlsConfig.HTTP3 {
+		states = append(states, ListenerState{Name: "http3", Protocol: "quic", Address: httpAddress, Listening: lb.http3Server != nil})
+	}
+	for _, l := range config.Listeners {
+		states = append(states, ListenerState{Name: l.Name, Protocol: l.Protocol, Address: l.Address, Listening: lb.listening[l.Name]})
+	}
+	return states
+}
+
+// listen takes the inherited listener, if there is one, or binds addr. With
+// several accept loops configured, that many sockets are bound to addr with
+// SO_REUSEPORT and the kernel spreads new connections over them.
+func (lb *LoadBalancer) listen(inherited *net.Listener, addr string) ([]net.Listener, error) {
+	if listener := *inherited; listener != nil {
+		*inherited = nil
+		return []net.Listener{listener}, nil
+	}
+
+	config := lb.router.config
+	sockets := max(config.AcceptLoops, 1)
+	var lc net.ListenConfig
+	if config.ReusePort || sockets > 1 {
+		lc.Control = reusePort
+	}
+	listeners := make([]net.Listener, 0, sockets)
+	for range sockets {
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+
+		// The other sockets join the port the first one was given
+		if host, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
+			addr = net.JoinHostPort(host, strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+		}
+	}
+	return listeners, nil
+}
+
+// reusePort sets SO_REUSEPORT on a socket before it is bound, so that other
+// sockets, of this process or others, can bind the same port
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// closeUDP closes the sockets of the UDP listeners. Must be called with
+// lb.mu held.
+func (lb *LoadBalancer) closeUDP() {
+	for _, conn := range lb.udpConns {
+		if err := conn.Close(); err != nil {
+			lb.logger.Error().Err(err).Str("addr", conn.LocalAddr().String()).Msg("Failed to stop UDP listener")
+		}
+	}
+	lb.udpConns = nil
+}
+
+// closeListeners closes all listeners, returning the first error
+func closeListeners(listeners []net.Listener) error {
+	var first error
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
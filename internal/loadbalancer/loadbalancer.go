@@ -2,15 +2,27 @@
 package loadbalancer
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/stats"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tracing"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // LoadBalancer handles the routing of incoming requests to appropriate tunnels
@@ -18,34 +30,399 @@ type LoadBalancer struct {
 	router     *Router
 	logger     *zerolog.Logger
 	httpServer *http.Server
-	tcpServer  net.Listener
-	mu         sync.RWMutex
+
+	// tcpListeners are the sockets of the TCP port and additional TCP
+	// listeners, each with its own accept loop
+	tcpListeners []net.Listener
+
+	// listenerServers serve the additional HTTP and HTTPS listeners, and
+	// listenerCerts hold the certificates of HTTPS listeners with their own
+	listenerServers []*http.Server
+	listenerCerts   []*certificateStore
+
+	// listening holds the names of the additional listeners being served
+	listening map[string]bool
+
+	// udpConns are the sockets of the additional UDP listeners
+	udpConns []net.PacketConn
+
+	// http3Server serves HTTP/3 next to the HTTPS listener, nil unless
+	// enabled and listening
+	http3Server *http3.Server
+	stats       *stats.Collector
+	certs       *certificateStore
+	mu          sync.RWMutex
+
+	// dial connects to tunnel targets; transports proxy HTTP requests
+	// through it, pooling connections per target
+	dial         DialFunc
+	transportsMu sync.Mutex
+	transports   map[string]*targetTransport
+	rootCAs      *x509.CertPool
+
+	// proxies are the reverse proxies to targets by tunnel ID
+	proxiesMu sync.RWMutex
+	proxies   map[string]*targetProxy
+
+	// errorPages answer requests that cannot be proxied
+	errorPages errorPageStore
+
+	// breakers skip targets whose connections keep failing
+	breakers *circuitBreakers
+
+	// inheritedHTTP and inheritedTCP, if set, are served by the next Start
+	// instead of binding the configured ports
+	inheritedHTTP net.Listener
+	inheritedTCP  net.Listener
+
+	// clients limits the request rate and connections of each client
+	clients *clientLimiter
+
+	// tunnelOptions holds the settings of tunnels by tunnel ID. Lookups
+	// read the current table without locking; changes are serialized by
+	// optionsMu and swap in a modified copy, so neither the table nor the
+	// options in it are ever modified.
+	optionsMu     sync.Mutex
+	tunnelOptions atomic.Pointer[map[string]*TunnelOptions]
+
+	// countryOf looks up the countries of clients, if set
+	countryOf CountryFunc
+
+	// connections are the open connections, for introspection
+	connections connectionTable
+
+	// mirrors holds a slot for every mirrored request in flight
+	mirrors chan struct{}
+
+	// cache holds the cacheable responses of tunnels that enable caching
+	cache *responseCache
+
+	// edge authenticates the clients of tunnels with edge authentication
+	edge *edgeAuthenticator
+
+	// clientCAs are the parsed CA bundles of tunnels requiring client
+	// certificates
+	clientCAs clientCAPools
+
+	// filters are the compiled patterns of tunnels' request filter rules
+	filters filterPatterns
+
+	// onDemand obtains certificates for routed hostnames, nil unless
+	// enabled
+	onDemand *onDemandCertificates
+}
+
+// DialFunc connects to the target address of a tunnel
+type DialFunc func(ctx context.Context, tunnelID, address string) (net.Conn, error)
+
+// TunnelOptions are the settings of a tunnel's traffic
+type TunnelOptions struct {
+	// Timeouts whose Dial, ResponseHeader or MaxRequest are non-zero
+	// override the load balancer's
+	Timeouts Timeouts
+
+	// BackendTLS, if set, makes requests to the tunnel's target use HTTPS
+	BackendTLS *BackendTLS
+
+	// ErrorPages are templates of the tunnel's error pages by page name,
+	// overriding the load balancer's
+	ErrorPages map[string]string
+
+	// Maintenance makes the load balancer answer the tunnel's requests
+	// with its maintenance page instead of proxying them
+	Maintenance bool
+
+	// Paused makes the load balancer treat the tunnel as if it were not
+	// routed: requests go to the other targets of their hostname or get
+	// the 404 page, and connections are closed
+	Paused bool
+
+	// HeaderRules, if set, change the headers of the tunnel's requests
+	// and responses
+	HeaderRules *HeaderRules
+
+	// HostRewrite replaces the Host and Origin headers of the tunnel's
+	// requests
+	HostRewrite HostRewrite
+
+	// Compression, if set, turns compression of the tunnel's responses on
+	// or off; a non-zero CompressionMinSize overrides the load balancer's
+	Compression        *bool
+	CompressionMinSize int
+
+	// Access restricts which clients may reach the tunnel
+	Access AccessLists
+
+	// RequestFilters block the tunnel's HTTP requests matching one of the
+	// rules with the 403 page
+	RequestFilters []FilterRule
+
+	// ClientLimits whose fields are non-zero override the load balancer's
+	ClientLimits ClientLimits
+
+	// MaxRequestBody, if non-zero, overrides the load balancer's limit on
+	// the size of the tunnel's request bodies
+	MaxRequestBody int64
+
+	// RetryAttempts, if set, overrides how often the load balancer retries
+	// the tunnel's requests; zero disables retries
+	RetryAttempts *int
+
+	// OverBandwidth makes the load balancer refuse the tunnel's new
+	// requests and connections while its owner exceeds its bandwidth limit
+	OverBandwidth bool
+
+	// Mirror, if set, sends copies of the tunnel's HTTP requests to a
+	// shadow tunnel
+	Mirror *Mirror
+
+	// Cache, if set, turns caching of the tunnel's responses on or off. A
+	// non-zero CacheMaxBytes bounds the size of its cached responses, and
+	// a non-zero CacheMaxTTL lowers the load balancer's TTL cap.
+	Cache         *bool
+	CacheMaxBytes int64
+	CacheMaxTTL   time.Duration
+
+	// EdgeAuth, if set, makes the load balancer authenticate the tunnel's
+	// clients before proxying their requests
+	EdgeAuth *EdgeAuth
+
+	// ClientCertAuth, if set, makes the load balancer require client
+	// certificates signed by the tunnel's CAs on its hostnames
+	ClientCertAuth *ClientCertAuth
 }
 
+// tunnelIDKey is the request context key of the tunnel a request is
+// proxied to
+type tunnelIDKey struct{}
+
 // Config holds the configuration for the load balancer
 type Config struct {
+	// Host is the address to listen on; empty listens on all IPv4 and IPv6
+	// addresses
+	Host      string
 	HTTPPort  int
 	TCPPort   int
 	TLSConfig *TLSConfig
+
+	// ReusePort binds the HTTP and TCP ports with SO_REUSEPORT, so that
+	// several agent processes can serve them, the kernel spreading new
+	// connections over the processes
+	ReusePort bool
+
+	// AcceptLoops is the number of sockets bound to each of the HTTP and
+	// TCP ports, each accepting connections in its own loop; more than
+	// one implies ReusePort
+	AcceptLoops int
+
+	// Listeners are public addresses served in addition to the HTTP and
+	// TCP ports
+	Listeners []Listener
+
+	// Affinity keeps clients of hostnames with several targets on one
+	Affinity Affinity
+
+	// Retry retries idempotent HTTP requests whose target is unreachable
+	Retry RetryPolicy
+
+	// CircuitBreaker skips targets whose connections keep failing
+	CircuitBreaker CircuitBreakerPolicy
+
+	// Timeouts bound the time spent on clients and targets
+	Timeouts Timeouts
+
+	// Transport tunes the connection pools to targets
+	Transport TransportConfig
+
+	// TCP tunes the proxying of connections to the TCP listener
+	TCP TCPConfig
+
+	// ErrorPagesDir holds templates replacing the default error pages,
+	// named after the page, e.g. 502.html or maintenance.html
+	ErrorPagesDir string
+
+	// Compression gzips responses for clients accepting it
+	Compression Compression
+
+	// FlushInterval is how often proxied responses are flushed to clients
+	// while they are copied; -1 flushes after every write. Event streams
+	// and responses of unknown length are always flushed after every
+	// write, so zero flushes other responses only when buffers fill.
+	FlushInterval time.Duration
+
+	// Cache answers requests with cached responses of their tunnel
+	Cache Cache
+
+	// Limits bound the size of requests
+	Limits Limits
+
+	// ClientLimits bound the request rate and connections of each client
+	// address
+	ClientLimits ClientLimits
+
+	// EdgeAuthSecret signs the session cookies of clients signed in to
+	// tunnels with OIDC. If empty a random key is used, so sessions end
+	// when the agent restarts and are not shared by agents.
+	EdgeAuthSecret string
+
+	// DefaultTunnel, if set, is the ID of the tunnel receiving HTTP requests
+	// for hostnames without a route, instead of the not found page
+	DefaultTunnel string
 }
 
 // TLSConfig holds TLS certificate configuration
 type TLSConfig struct {
 	CertFile string
 	KeyFile  string
+
+	// HTTP3 additionally serves HTTP/3 over QUIC on the UDP port of the
+	// HTTPS listener, advertised to clients with Alt-Svc
+	HTTP3 bool
+
+	// Policy restricts the TLS versions, cipher suites, curves and ALPN
+	// protocols of all HTTPS listeners and enables OCSP stapling
+	Policy TLSPolicy
+
+	// OnDemand, if set, obtains certificates from an ACME CA during the
+	// handshake for routed hostnames the certificate does not cover, and
+	// serves HTTPS on the HTTP port without a certificate configured
+	OnDemand *OnDemandTLS
+}
+
+// NewLoadBalancer creates a new load balancer instance that records
+// per-tunnel traffic in the given stats collector
+func NewLoadBalancer(router *Router, config *Config, collector *stats.Collector) *LoadBalancer {
+	logger := utils.GetModuleLogger(utils.ModuleLoadBalancer)
+	lb := &LoadBalancer{
+		router:     router,
+		logger:     logger,
+		stats:      collector,
+		transports: make(map[string]*targetTransport),
+		proxies:    make(map[string]*targetProxy),
+		breakers:   newCircuitBreakers(config.CircuitBreaker, logger),
+		clients:    newClientLimiter(),
+		mirrors:    make(chan struct{}, maxMirrorRequests),
+		cache:      newResponseCache(config.Cache, logger),
+		edge:       newEdgeAuthenticator(config.EdgeAuthSecret),
+		onDemand:   newOnDemandCertificates(config.TLSConfig, router, logger),
+	}
+	router.onRemove = lb.forgetTarget
+	return lb
+}
+
+// forgetTarget drops the reverse proxy and connection pool of a removed
+// target
+func (lb *LoadBalancer) forgetTarget(tunnelID string) {
+	lb.forgetProxy(tunnelID)
+	lb.forgetTransport(tunnelID)
+	lb.errorPages.forget(tunnelID)
+	lb.cache.forget(tunnelID)
 }
 
-// NewLoadBalancer creates a new load balancer instance
-func NewLoadBalancer(router *Router, config *Config) *LoadBalancer {
-	logger := utils.GetLogger()
-	return &LoadBalancer{
-		router: router,
-		logger: logger,
+// skipMaintenance returns the first of targets not in maintenance mode and
+// the targets not in maintenance mode after it, or nil if all are. Paused
+// targets are skipped as well.
+func (lb *LoadBalancer) skipMaintenance(targets []*Target) (*Target, []*Target) {
+	var active []*Target
+	for _, target := range targets {
+		if options := lb.optionsOf(target.ID); !options.Maintenance && !options.Paused {
+			active = append(active, target)
+		}
+	}
+	if len(active) == 0 {
+		return nil, nil
 	}
+	return active[0], active[1:]
+}
+
+// firstUnpaused returns the first of targets that is not paused, nil if
+// all are
+func (lb *LoadBalancer) firstUnpaused(targets []*Target) *Target {
+	for _, target := range targets {
+		if !lb.optionsOf(target.ID).Paused {
+			return target
+		}
+	}
+	return nil
+}
+
+// SetDialer makes the load balancer connect to tunnel targets with dial,
+// e.g. over the tunnel's transport, instead of dialing them directly
+func (lb *LoadBalancer) SetDialer(dial DialFunc) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.dial = dial
+}
+
+func (lb *LoadBalancer) dialTunnel(ctx context.Context, tunnelID string, options *TunnelOptions, address string) (net.Conn, error) {
+	lb.mu.RLock()
+	dial := lb.dial
+	lb.mu.RUnlock()
+
+	if timeout := lb.timeouts(options).Dial; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if dial == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	return dial(ctx, tunnelID, address)
+}
+
+// noTunnelOptions are the settings of tunnels that have none set
+var noTunnelOptions = &TunnelOptions{}
+
+// SetTunnelOptions replaces the settings of a tunnel, or removes them if
+// options is nil; options must not be modified afterwards
+func (lb *LoadBalancer) SetTunnelOptions(tunnelID string, options *TunnelOptions) {
+	lb.optionsMu.Lock()
+	defer lb.optionsMu.Unlock()
+
+	var table map[string]*TunnelOptions
+	if current := lb.tunnelOptions.Load(); current != nil {
+		table = maps.Clone(*current)
+	}
+	if options == nil {
+		delete(table, tunnelID)
+	} else {
+		if table == nil {
+			table = make(map[string]*TunnelOptions)
+		}
+		table[tunnelID] = options
+	}
+	lb.tunnelOptions.Store(&table)
+}
+
+// optionsOf returns the settings of a tunnel, zero if none are set; they
+// must not be modified
+func (lb *LoadBalancer) optionsOf(tunnelID string) *TunnelOptions {
+	if table := lb.tunnelOptions.Load(); table != nil {
+		if options, ok := (*table)[tunnelID]; ok {
+			return options
+		}
+	}
+	return noTunnelOptions
 }
 
 // Start starts the load balancer
 func (lb *LoadBalancer) Start() error {
+	if err := lb.loadRootCAs(); err != nil {
+		return err
+	}
+	if err := lb.cache.open(); err != nil {
+		return err
+	}
+	if dir := lb.router.config.ErrorPagesDir; dir != "" {
+		if err := lb.errorPages.load(dir); err != nil {
+			return err
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
 	// Start HTTP server
 	if err := lb.startHTTPServer(); err != nil {
 		return fmt.Errorf("failed to start HTTP server: %v", err)
@@ -56,6 +433,20 @@ func (lb *LoadBalancer) Start() error {
 		return fmt.Errorf("failed to start TCP server: %v", err)
 	}
 
+	return lb.startListeners()
+}
+
+// Listening returns an error unless the HTTP and TCP listeners are bound
+func (lb *LoadBalancer) Listening() error {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	if lb.httpServer == nil {
+		return errors.New("HTTP listener is not bound")
+	}
+	if lb.tcpListeners == nil {
+		return errors.New("TCP listener is not bound")
+	}
 	return nil
 }
 
@@ -69,93 +460,447 @@ func (lb *LoadBalancer) Stop() error {
 		if err := lb.httpServer.Close(); err != nil {
 			lb.logger.Error().Err(err).Msg("Failed to stop HTTP server")
 		}
+		lb.httpServer = nil
 	}
+	if lb.http3Server != nil {
+		if err := lb.http3Server.Close(); err != nil {
+			lb.logger.Error().Err(err).Msg("Failed to stop HTTP/3 server")
+		}
+		lb.http3Server = nil
+	}
+	for _, server := range lb.listenerServers {
+		if err := server.Close(); err != nil {
+			lb.logger.Error().Err(err).Str("addr", server.Addr).Msg("Failed to stop HTTP server")
+		}
+	}
+	lb.listenerServers = nil
+	lb.listenerCerts = nil
+	lb.listening = nil
 
 	// Stop TCP server
-	if lb.tcpServer != nil {
-		if err := lb.tcpServer.Close(); err != nil {
+	if lb.tcpListeners != nil {
+		if err := closeListeners(lb.tcpListeners); err != nil {
 			lb.logger.Error().Err(err).Msg("Failed to stop TCP server")
 		}
+		lb.tcpListeners = nil
 	}
+	lb.closeUDP()
+
+	lb.transportsMu.Lock()
+	for _, t := range lb.transports {
+		t.transport.CloseIdleConnections()
+	}
+	lb.transportsMu.Unlock()
 
 	return nil
 }
 
-func (lb *LoadBalancer) startHTTPServer() error {
+// SetListeners makes the next Start serve HTTP and TCP on listeners
+// created elsewhere, such as sockets passed by systemd, instead of binding
+// the configured ports. Either may be nil.
+func (lb *LoadBalancer) SetListeners(httpListener, tcpListener net.Listener) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.inheritedHTTP = httpListener
+	lb.inheritedTCP = tcpListener
+}
+
+// drainPollInterval is how often Drain checks for open connections
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain stops accepting connections and requests and waits for the open
+// ones to finish, then stops the load balancer. Connections still open
+// when ctx is done are closed, and ctx's error is returned.
+func (lb *LoadBalancer) Drain(ctx context.Context) error {
+	lb.mu.Lock()
+	httpServer, http3Server := lb.httpServer, lb.http3Server
+	listenerServers := lb.listenerServers
+	if lb.tcpListeners != nil {
+		if err := closeListeners(lb.tcpListeners); err != nil {
+			lb.logger.Error().Err(err).Msg("Failed to stop TCP server")
+		}
+		lb.tcpListeners = nil
+	}
+	// UDP has no connections to finish; closing the sockets ends its
+	// sessions
+	lb.closeUDP()
+	lb.mu.Unlock()
+
+	// Shutdown closes the listeners right away; keep-alive connections are
+	// closed after their current request
+	if httpServer != nil {
+		httpServer.SetKeepAlivesEnabled(false)
+		go httpServer.Shutdown(ctx)
+	}
+	if http3Server != nil {
+		go http3Server.Shutdown(ctx)
+	}
+	for _, server := range listenerServers {
+		server.SetKeepAlivesEnabled(false)
+		go server.Shutdown(ctx)
+	}
+
+	open := len(lb.Connections())
+	lb.logger.Info().
+		Int("connections", open).
+		Msg("Stopped accepting connections, waiting for open connections to finish")
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	var err error
+	for open > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+			open = len(lb.Connections())
+		}
+	}
+
+	if err != nil {
+		conns := lb.Connections()
+		lb.logger.Warn().
+			Int("connections", len(conns)).
+			Msg("Drain timed out, closing remaining connections")
+		for _, conn := range conns {
+			lb.KillConnection(conn.ID)
+		}
+	} else {
+		lb.logger.Info().Msg("All connections finished")
+	}
+
+	if stopErr := lb.Stop(); stopErr != nil {
+		return stopErr
+	}
+	return err
+}
+
+// newHTTPServer creates a server for the public HTTP requests to addr
+func (lb *LoadBalancer) newHTTPServer(addr string) *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", lb.handleHTTPRequest)
 
-	lb.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", lb.router.config.HTTPPort),
-		Handler: mux,
+	timeouts := lb.router.config.Timeouts
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+		MaxHeaderBytes:    lb.router.config.Limits.MaxHeaderBytes,
 	}
+}
 
-	go func() {
-		if err := lb.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			lb.logger.Error().Err(err).Msg("HTTP server error")
+// serveHTTP serves server on each of listeners, over TLS if useTLS, in
+// which case TLS passthrough routes are served on them too
+func (lb *LoadBalancer) serveHTTP(server *http.Server, listeners []net.Listener, useTLS bool) {
+	for _, listener := range listeners {
+		go func() {
+			var err error
+			if useTLS {
+				err = server.ServeTLS(lb.passthrough(listener), "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				lb.logger.Error().Err(err).Str("addr", server.Addr).Msg("HTTP server error")
+			}
+		}()
+	}
+}
+
+func (lb *LoadBalancer) startHTTPServer() error {
+	lb.httpServer = lb.newHTTPServer(net.JoinHostPort(lb.router.config.Host, strconv.Itoa(lb.router.config.HTTPPort)))
+	mux := lb.httpServer.Handler
+
+	// Serve HTTPS when a certificate is configured or obtained on demand
+	tlsConfig := lb.router.config.TLSConfig
+	hasCert := tlsConfig != nil && tlsConfig.CertFile != "" && tlsConfig.KeyFile != ""
+	if hasCert || lb.onDemand != nil {
+		certs := &certificateStore{stapling: tlsConfig.Policy.OCSPStapling}
+		if hasCert {
+			if err := certs.load(tlsConfig.CertFile, tlsConfig.KeyFile); err != nil {
+				lb.httpServer = nil
+				return err
+			}
+		}
+		lb.certs = certs
+		lb.httpServer.TLSConfig = lb.serverTLSConfig(certs)
+		tlsConfig.Policy.configureServer(lb.httpServer)
+		if tlsConfig.HTTP3 {
+			lb.startHTTP3Server(lb.httpServer.Addr, mux, lb.httpServer.TLSConfig)
+		}
+		if lb.http3Server != nil {
+			lb.httpServer.Handler = advertiseHTTP3(lb.http3Server, mux)
 		}
-	}()
+	}
+
+	// Bind before returning, so that the listener is up once started
+	listeners, err := lb.listen(&lb.inheritedHTTP, lb.httpServer.Addr)
+	if err != nil {
+		if lb.http3Server != nil {
+			lb.http3Server.Close()
+			lb.http3Server = nil
+		}
+		lb.httpServer = nil
+		return err
+	}
+
+	lb.serveHTTP(lb.httpServer, listeners, lb.certs != nil)
+
+	return nil
+}
+
+// ReloadTLSCertificate replaces the serving certificate without restarting
+// the listener. TLS must have been enabled when the load balancer started.
+func (lb *LoadBalancer) ReloadTLSCertificate(certFile, keyFile string) error {
+	if lb.certs == nil {
+		return errors.New("TLS was not enabled at startup; restart required")
+	}
+	if err := lb.certs.load(certFile, keyFile); err != nil {
+		return err
+	}
 
+	lb.logger.Info().
+		Str("cert_file", certFile).
+		Msg("Reloaded TLS certificate")
 	return nil
 }
 
 func (lb *LoadBalancer) startTCPServer() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", lb.router.config.TCPPort))
+	listeners, err := lb.listen(&lb.inheritedTCP, net.JoinHostPort(lb.router.config.Host, strconv.Itoa(lb.router.config.TCPPort)))
 	if err != nil {
 		return err
 	}
 
-	lb.tcpServer = listener
+	lb.tcpListeners = listeners
+	lb.acceptTCP(listeners)
+
+	return nil
+}
 
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Op == "accept" {
-					return // Server is shutting down
+// acceptTCP accepts connections on each of listeners in its own loop
+func (lb *LoadBalancer) acceptTCP(listeners []net.Listener) {
+	for _, listener := range listeners {
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if opErr, ok := err.(*net.OpError); ok && opErr.Op == "accept" {
+						return // Server is shutting down
+					}
+					lb.logger.Error().Err(err).Msg("Failed to accept TCP connection")
+					continue
 				}
-				lb.logger.Error().Err(err).Msg("Failed to accept TCP connection")
-				continue
+				go lb.handleTCPConnection(conn)
 			}
-			go lb.handleTCPConnection(conn)
-		}
-	}()
-
-	return nil
+		}()
+	}
 }
 
 func (lb *LoadBalancer) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	host := r.Host
 
-	// Find the target tunnel based on the hostname
-	target, err := lb.router.GetTunnelByHost(host)
+	// Continue the client's trace, and hand it on to the target
+	ctx, span := tracing.StartServer(r, "proxy "+r.Method)
+	r = r.WithContext(ctx)
+	cw := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	w = cw
+	defer func() { tracing.EndHTTP(span, cw.status) }()
+
+	// Find the target tunnel based on the hostname and path
+	target, affinityCookie, err := lb.router.RouteRequest(r)
 	if err != nil {
 		lb.logger.Error().
 			Err(err).
 			Str("host", host).
+			Str("client_ip", clientIP(r.RemoteAddr)).
 			Msg("No tunnel found for host")
-		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		lb.serveErrorPage(w, r, "", PageNotFound)
 		return
 	}
+	if target.isStatic() {
+		lb.serveStatic(w, r, target)
+		return
+	}
+	// The options of the tunnel are looked up again only when the request
+	// goes to another one. Paused tunnels are passed over as if they were
+	// not routed.
+	options := lb.optionsOf(target.ID)
+	if options.Paused {
+		if target = lb.firstUnpaused(lb.router.fallbacks(r, target)); target == nil {
+			lb.logger.Info().
+				Str("host", host).
+				Str("client_ip", clientIP(r.RemoteAddr)).
+				Msg("All tunnels for host are paused")
+			lb.serveErrorPage(w, r, "", PageNotFound)
+			return
+		}
+		options = lb.optionsOf(target.ID)
+	}
+
+	country := lb.clientCountry(r.RemoteAddr)
+	lb.stats.Tunnel(target.ID).IncCountry(country)
+	if !lb.allowClient(options, r.RemoteAddr, country) {
+		lb.stats.Tunnel(target.ID).IncDenied()
+		lb.logger.Warn().
+			Str("host", host).
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(r.RemoteAddr)).
+			Func(withCountry(country)).
+			Msg("Client denied by access list")
+		lb.serveErrorPage(w, r, target.ID, PageForbidden)
+		return
+	}
+	if rule := lb.filterRequest(options, r); rule != "" {
+		lb.stats.Tunnel(target.ID).IncFiltered(rule)
+		lb.logger.Warn().
+			Str("host", host).
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(r.RemoteAddr)).
+			Func(withCountry(country)).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("user_agent", r.UserAgent()).
+			Str("rule", rule).
+			Msg("Request blocked by filter rule")
+		lb.serveErrorPage(w, r, target.ID, PageForbidden)
+		return
+	}
+	if options.OverBandwidth {
+		lb.stats.Tunnel(target.ID).IncRateLimited()
+		lb.logger.Warn().
+			Str("host", host).
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(r.RemoteAddr)).
+			Msg("Tunnel over its bandwidth limit")
+		w.Header().Set("Retry-After", "1")
+		lb.serveErrorPage(w, r, target.ID, PageTooManyRequests)
+		return
+	}
+	release, ok, retryAfter := lb.clients.acquire(target.ID, clientIP(r.RemoteAddr), lb.clientLimits(options))
+	if !ok {
+		lb.stats.Tunnel(target.ID).IncRateLimited()
+		lb.logger.Warn().
+			Str("host", host).
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(r.RemoteAddr)).
+			Dur("retry_after", retryAfter).
+			Msg("Client rate limited")
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		lb.serveErrorPage(w, r, target.ID, PageTooManyRequests)
+		return
+	}
+	defer release()
+
+	// Targets in maintenance mode are skipped; the maintenance page is
+	// served if all targets of the hostname are
+	routed := target
+	fallbacks := lb.router.fallbacks(r, target)
+	if target, fallbacks = lb.skipMaintenance(append([]*Target{target}, fallbacks...)); target == nil {
+		lb.serveErrorPage(w, r, routed.ID, PageMaintenance)
+		return
+	}
+	if target != routed {
+		options = lb.optionsOf(target.ID)
+	}
+	if !lb.verifyClientCert(w, r, target.ID, options) {
+		return
+	}
+	if !lb.authenticateEdge(w, r, target.ID, options) {
+		return
+	}
+	if !lb.limitRequestBody(w, r, target.ID, options) {
+		return
+	}
+
+	// Cached responses are served even while the target is unreachable
+	var cached bool
+	if r, cached = lb.serveCached(w, r, target.ID, options); cached {
+		lb.logger.Info().
+			Str("host", host).
+			Str("tunnel_id", target.ID).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("client_ip", clientIP(r.RemoteAddr)).
+			Func(withCountry(country)).
+			Dur("duration", time.Since(start)).
+			Msg("Served cached response")
+		return
+	}
+	ctx = r.Context()
+
+	// Requests that cannot reach the target, or whose target's circuit is
+	// open, fail over to the hostname's other targets
+	if !lb.breakers.allow(target.ID) {
+		if target, fallbacks = lb.breakers.pick(fallbacks); target == nil {
+			lb.logger.Warn().
+				Str("host", host).
+				Str("client_ip", clientIP(r.RemoteAddr)).
+				Msg("Circuits of all targets are open")
+			lb.serveErrorPage(w, r, routed.ID, PageUnavailable)
+			return
+		}
+		options = lb.optionsOf(target.ID)
+	}
+	attempt := &proxyAttempt{target: target, options: options, fallbacks: fallbacks}
+	span.SetAttributes(attribute.String("tunnel.id", target.ID))
+	tracing.Inject(ctx, r.Header)
 
-	// Create the reverse proxy
-	proxy := &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			req.URL.Scheme = "http"
-			req.URL.Host = fmt.Sprintf("%s:%d", target.IP, target.Port)
-			req.Host = host
-		},
+	tunnelStats := lb.stats.Tunnel(target.ID)
+	tunnelStats.IncRequests()
+	tunnelStats.ConnectionOpened()
+	defer tunnelStats.ConnectionClosed()
+
+	ctx = context.WithValue(ctx, tunnelIDKey{}, target.ID)
+	if timeout := lb.timeouts(options).MaxRequest; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, kill := context.WithCancel(ctx)
+	defer kill()
+	r = r.WithContext(context.WithValue(ctx, proxyAttemptKey{}, attempt))
+
+	conn := lb.connections.open(Connection{
+		TunnelID:    target.ID,
+		ClientAddr:  r.RemoteAddr,
+		BackendAddr: net.JoinHostPort(target.IP, strconv.Itoa(target.Port)),
+		Protocol:    httpProtocol(r),
+	}, kill)
+	defer lb.connections.close(conn)
+
+	// Count the bytes flowing in both directions
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReader{ReadCloser: r.Body, add: func(n int64) {
+			tunnelStats.AddBytesReceived(n)
+			conn.bytesReceived.Add(n)
+		}}
+	}
+	cw.add = func(n int64) {
+		tunnelStats.AddBytesSent(n)
+		conn.bytesSent.Add(n)
+	}
+	if affinityCookie != nil {
+		http.SetCookie(w, affinityCookie)
 	}
+	lb.mirrorRequest(r, target.ID, options)
 
 	// Forward the request
-	proxy.ServeHTTP(w, r)
+	lb.proxyFor(target).ServeHTTP(cw, r)
 
 	lb.logger.Info().
 		Str("host", host).
-		Str("tunnel_id", target.ID).
+		Str("tunnel_id", attempt.target.ID).
 		Str("method", r.Method).
 		Str("path", r.URL.Path).
+		Str("client_ip", clientIP(r.RemoteAddr)).
+		Func(withCountry(country)).
+		Int("retries", attempt.retries).
 		Dur("duration", time.Since(start)).
 		Msg("Handled HTTP request")
 }
@@ -169,36 +914,241 @@ func (lb *LoadBalancer) handleTCPConnection(clientConn net.Conn) {
 		lb.logger.Error().
 			Err(err).
 			Int("port", clientConn.LocalAddr().(*net.TCPAddr).Port).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
 			Msg("No tunnel found for port")
 		return
 	}
 
+	lb.proxyConnection(clientConn, target, "tcp")
+}
+
+// proxyConnection proxies a client connection accepted for protocol, tcp
+// or tls for TLS passthrough, to target, applying the tunnel's access
+// lists and limits and counting it in the tunnel's TCP statistics. The
+// caller closes clientConn.
+func (lb *LoadBalancer) proxyConnection(clientConn net.Conn, target *Target, protocol string) {
+	accepted := time.Now()
+	tunnelStats := lb.stats.Tunnel(target.ID)
+	tunnelStats.IncTCPAccepted()
+	options := lb.optionsOf(target.ID)
+	if options.Paused {
+		lb.logger.Info().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
+			Msg("Closed connection to paused tunnel")
+		return
+	}
+	country := lb.clientCountry(clientConn.RemoteAddr().String())
+	tunnelStats.IncCountry(country)
+	if !lb.allowClient(options, clientConn.RemoteAddr().String(), country) {
+		tunnelStats.IncDenied()
+		lb.logger.Warn().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
+			Func(withCountry(country)).
+			Msg("Client denied by access list")
+		return
+	}
+	if options.OverBandwidth {
+		tunnelStats.IncRateLimited()
+		lb.logger.Warn().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
+			Msg("Tunnel over its bandwidth limit")
+		resetConn(clientConn)
+		return
+	}
+	release, ok, _ := lb.clients.acquire(target.ID, clientIP(clientConn.RemoteAddr().String()), lb.clientLimits(options))
+	if !ok {
+		tunnelStats.IncRateLimited()
+		lb.logger.Warn().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
+			Msg("Client rate limited")
+		resetConn(clientConn)
+		return
+	}
+	defer release()
+	if options.Maintenance {
+		lb.logger.Info().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
+			Msg("Closed connection to tunnel in maintenance mode")
+		return
+	}
+	if !lb.breakers.allow(target.ID) {
+		lb.logger.Warn().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
+			Msg("Circuit of target is open")
+		return
+	}
+
+	tunnelStats.IncRequests()
+	tunnelStats.ConnectionOpened()
+	defer tunnelStats.ConnectionClosed()
+	tunnelStats.TCPConnectionOpened()
+	defer tunnelStats.TCPConnectionClosed()
+
 	// Connect to the backend
-	backendConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", target.IP, target.Port))
+	backendConn, err := lb.dialTunnel(context.Background(), target.ID, options, net.JoinHostPort(target.IP, strconv.Itoa(target.Port)))
 	if err != nil {
+		lb.breakers.failure(target.ID)
+		tunnelStats.IncTCPDialFailures()
 		lb.logger.Error().
 			Err(err).
 			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
 			Msg("Failed to connect to backend")
 		return
 	}
 	defer backendConn.Close()
+	lb.breakers.success(target.ID)
+
+	setKeepAlive(clientConn, lb.router.config.TCP.KeepAlive)
+	setKeepAlive(backendConn, lb.router.config.TCP.KeepAlive)
+	abort := sync.OnceFunc(func() {
+		abortConn(clientConn)
+		abortConn(backendConn)
+	})
+	conn := lb.connections.open(Connection{
+		TunnelID:    target.ID,
+		ClientAddr:  clientConn.RemoteAddr().String(),
+		BackendAddr: net.JoinHostPort(target.IP, strconv.Itoa(target.Port)),
+		Protocol:    protocol,
+	}, abort)
+	defer lb.connections.close(conn)
 
-	// Start proxying in both directions
-	go lb.proxy(clientConn, backendConn)
-	lb.proxy(backendConn, clientConn)
+	// Proxy in both directions until both are done
+	idle := lb.relay(clientConn, backendConn, abort, func(n int64) {
+		tunnelStats.AddBytesSent(n)
+		tunnelStats.AddTCPBytesOut(n)
+		conn.bytesSent.Add(n)
+	}, func(n int64) {
+		tunnelStats.AddBytesReceived(n)
+		tunnelStats.AddTCPBytesIn(n)
+		conn.bytesReceived.Add(n)
+	})
+	tunnelStats.ObserveTCPDuration(time.Since(accepted))
+	if idle {
+		lb.logger.Info().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientConn.RemoteAddr().String())).
+			Dur("idle_timeout", lb.router.config.TCP.IdleTimeout).
+			Msg("Closed idle TCP connection")
+	}
 }
 
-func (lb *LoadBalancer) proxy(dst net.Conn, src net.Conn) {
-	buffer := make([]byte, 32*1024)
-	for {
-		n, err := src.Read(buffer)
-		if err != nil {
-			return
+// setTarget points an outgoing request at target, over HTTPS if the
+// options of the target's tunnel ask for it
+func (lb *LoadBalancer) setTarget(req *http.Request, target *Target, options *TunnelOptions) {
+	req.URL.Scheme = "http"
+	if options.BackendTLS != nil {
+		req.URL.Scheme = "https"
+	}
+	req.URL.Host = net.JoinHostPort(target.IP, strconv.Itoa(target.Port))
+}
+
+// clientIP returns the IP address of a host:port remote address, without
+// the brackets of IPv6 literals
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// withCountry logs the country of a client if it is known
+func withCountry(country string) func(e *zerolog.Event) {
+	return func(e *zerolog.Event) {
+		if country != "" {
+			e.Str("country", country)
 		}
-		_, err = dst.Write(buffer[:n])
-		if err != nil {
-			return
+	}
+}
+
+// setForwardedHeaders tells the backend about the original request in the
+// X-Forwarded-Host and X-Forwarded-Proto headers and the RFC 7239 Forwarded
+// header, which quotes and brackets IPv6 addresses. ReverseProxy itself
+// appends the client to X-Forwarded-For.
+func setForwardedHeaders(out, in *http.Request) {
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Host", in.Host)
+	out.Header.Set("X-Forwarded-Proto", proto)
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s",
+		forwardedNode(clientIP(in.RemoteAddr)), quoteForwarded(in.Host), proto)
+	if prior := in.Header.Get("Forwarded"); prior != "" {
+		element = prior + ", " + element
+	}
+	out.Header.Set("Forwarded", element)
+}
+
+// forwardedNode formats an address as a Forwarded node; IPv6 addresses are
+// bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return quoteForwarded(ip)
+}
+
+// quoteForwarded quotes a Forwarded value unless it is a plain token
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(value)
 		}
 	}
-} 
\ No newline at end of file
+	return value
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	add func(int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to a response
+type countingResponseWriter struct {
+	http.ResponseWriter
+	add    func(int64)
+	status int
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	streamWithoutWriteDeadline(w.ResponseWriter)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if w.add != nil {
+		w.add(int64(n))
+	}
+	return n, err
+}
+
+// Unwrap lets the proxy hijack the connection of upgraded requests through
+// the counting wrapper
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush lets streaming responses pass through the counting wrapper
+func (w *countingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,3122 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/stats"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{remoteAddr: "203.0.113.7:40000", expected: "203.0.113.7"},
+		{remoteAddr: "[2001:db8::7]:40000", expected: "2001:db8::7"},
+		{remoteAddr: "garbage", expected: "garbage"},
+	}
+
+	for _, tt := range tests {
+		if got := clientIP(tt.remoteAddr); got != tt.expected {
+			t.Errorf("clientIP(%s) = %s, expected %s", tt.remoteAddr, got, tt.expected)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		tls        bool
+		prior      string
+		forwarded  string
+		proto      string
+	}{
+		{
+			name:       "IPv4 client",
+			remoteAddr: "203.0.113.7:40000",
+			host:       "app.example.com",
+			forwarded:  "for=203.0.113.7;host=app.example.com;proto=http",
+			proto:      "http",
+		},
+		{
+			name:       "IPv6 client over TLS",
+			remoteAddr: "[2001:db8::7]:40000",
+			host:       "app.example.com",
+			tls:        true,
+			forwarded:  `for="[2001:db8::7]";host=app.example.com;proto=https`,
+			proto:      "https",
+		},
+		{
+			name:       "Host with port and prior proxy",
+			remoteAddr: "203.0.113.7:40000",
+			host:       "app.example.com:8443",
+			prior:      "for=198.51.100.1",
+			forwarded:  `for=198.51.100.1, for=203.0.113.7;host="app.example.com:8443";proto=http`,
+			proto:      "http",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := httptest.NewRequest(http.MethodGet, "/", nil)
+			in.RemoteAddr = tt.remoteAddr
+			in.Host = tt.host
+			if tt.tls {
+				in.TLS = &tls.ConnectionState{}
+			}
+			if tt.prior != "" {
+				in.Header.Set("Forwarded", tt.prior)
+			}
+
+			out := in.Clone(in.Context())
+			setForwardedHeaders(out, in)
+
+			if got := out.Header.Get("Forwarded"); got != tt.forwarded {
+				t.Errorf("Expected Forwarded %s, got %s", tt.forwarded, got)
+			}
+			if got := out.Header.Get("X-Forwarded-Proto"); got != tt.proto {
+				t.Errorf("Expected X-Forwarded-Proto %s, got %s", tt.proto, got)
+			}
+			if got := out.Header.Get("X-Forwarded-Host"); got != tt.host {
+				t.Errorf("Expected X-Forwarded-Host %s, got %s", tt.host, got)
+			}
+		})
+	}
+}
+
+func TestSetDialer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "through the tunnel")
+	}))
+	defer backend.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	if err := router.AddRoute("ws-1", "app.example.com", "ws-1.websocket.invalid", 8080); err != nil {
+		t.Fatalf("Unexpected error adding route: %v", err)
+	}
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+
+	var dialed []string
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		dialed = append(dialed, tunnelID+" "+address)
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	w := httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "through the tunnel" {
+		t.Errorf("Expected response from backend, got %d %q", w.Code, w.Body.String())
+	}
+	if len(dialed) != 1 || dialed[0] != "ws-1 ws-1.websocket.invalid:8080" {
+		t.Errorf("Expected one dial of the tunnel's endpoint, got %v", dialed)
+	}
+}
+
+func TestSessionAffinity(t *testing.T) {
+	tests := []struct {
+		name     string
+		affinity Affinity
+		// sticky requests of one client always reach the same target
+		sticky bool
+	}{
+		{name: "Round robin", affinity: Affinity{Mode: AffinityNone}},
+		{name: "Client IP", affinity: Affinity{Mode: AffinityClientIP}, sticky: true},
+		{name: "Cookie", affinity: Affinity{Mode: AffinityCookie, CookieTTL: time.Hour}, sticky: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&Config{Affinity: tt.affinity})
+			for _, id := range []string{"replica-1", "replica-2", "replica-3"} {
+				if err := router.AddBackend(id, "app.example.com", id+".invalid", 8080); err != nil {
+					t.Fatalf("Failed to add backend: %v", err)
+				}
+			}
+
+			var cookie *http.Cookie
+			seen := make(map[string]int)
+			for i := 0; i < 6; i++ {
+				req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+				req.RemoteAddr = "203.0.113.7:40000"
+				if cookie != nil {
+					req.AddCookie(cookie)
+				}
+				target, setCookie, err := router.RouteRequest(req)
+				if err != nil {
+					t.Fatalf("RouteRequest() error = %v", err)
+				}
+				seen[target.ID]++
+				if setCookie != nil {
+					if tt.affinity.Mode != AffinityCookie || cookie != nil {
+						t.Errorf("Unexpected cookie on request %d: %v", i, setCookie)
+					}
+					if setCookie.Name != DefaultAffinityCookie || setCookie.MaxAge != 3600 || strings.Contains(setCookie.Value, "replica") {
+						t.Errorf("Unexpected affinity cookie %v", setCookie)
+					}
+					cookie = setCookie
+				}
+			}
+
+			if tt.sticky && len(seen) != 1 {
+				t.Errorf("Expected one client to stick to one target, got %v", seen)
+			}
+			if !tt.sticky && len(seen) != 3 {
+				t.Errorf("Expected requests spread over all targets, got %v", seen)
+			}
+		})
+	}
+
+	// Client IP affinity only moves the clients of a removed target
+	router := NewRouter(&Config{Affinity: Affinity{Mode: AffinityClientIP}})
+	for _, id := range []string{"replica-1", "replica-2", "replica-3"} {
+		router.AddBackend(id, "app.example.com", id+".invalid", 8080)
+	}
+	route := func(ip string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		req.RemoteAddr = ip + ":40000"
+		target, _, _ := router.RouteRequest(req)
+		return target.ID
+	}
+	before := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		before[ip] = route(ip)
+	}
+	router.RemoveRoute("replica-2")
+	for ip, id := range before {
+		if id != "replica-2" && route(ip) != id {
+			t.Errorf("Client %s moved from %s to %s", ip, id, route(ip))
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		method         string
+		targets        []string
+		failures       int // dials failing before the backend is reached
+		attempts       int
+		tunnelAttempts *int
+		expectedStatus int
+		expectedDials  []string
+	}{
+		{
+			name:           "Fails over to another target",
+			method:         http.MethodGet,
+			targets:        []string{"replica-1", "replica-2"},
+			failures:       1,
+			attempts:       2,
+			expectedStatus: http.StatusOK,
+			expectedDials:  []string{"replica-1", "replica-2"},
+		},
+		{
+			name:           "Retries the same target",
+			method:         http.MethodGet,
+			targets:        []string{"replica-1"},
+			failures:       2,
+			attempts:       2,
+			expectedStatus: http.StatusOK,
+			expectedDials:  []string{"replica-1", "replica-1", "replica-1"},
+		},
+		{
+			name:           "Gives up after the configured attempts",
+			method:         http.MethodGet,
+			targets:        []string{"replica-1"},
+			failures:       3,
+			attempts:       2,
+			expectedStatus: http.StatusBadGateway,
+			expectedDials:  []string{"replica-1", "replica-1", "replica-1"},
+		},
+		{
+			name:           "Does not retry non-idempotent requests",
+			method:         http.MethodPost,
+			targets:        []string{"replica-1", "replica-2"},
+			failures:       1,
+			attempts:       2,
+			expectedStatus: http.StatusBadGateway,
+			expectedDials:  []string{"replica-1"},
+		},
+		{
+			name:           "Tunnel policy disables retries",
+			method:         http.MethodGet,
+			targets:        []string{"replica-1", "replica-2"},
+			failures:       1,
+			attempts:       2,
+			tunnelAttempts: new(int),
+			expectedStatus: http.StatusBadGateway,
+			expectedDials:  []string{"replica-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Retry: RetryPolicy{Attempts: tt.attempts, Backoff: time.Millisecond}}
+			router := NewRouter(config)
+			for _, id := range tt.targets {
+				if err := router.AddBackend(id, "app.example.com", id+".invalid", 8080); err != nil {
+					t.Fatalf("Failed to add backend: %v", err)
+				}
+			}
+			collector := stats.NewCollector()
+			lb := NewLoadBalancer(router, config, collector)
+			for _, id := range tt.targets {
+				lb.SetTunnelOptions(id, &TunnelOptions{RetryAttempts: tt.tunnelAttempts})
+			}
+
+			var dialed []string
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				dialed = append(dialed, tunnelID)
+				if len(dialed) <= tt.failures {
+					return nil, fmt.Errorf("tunnel %s unreachable", tunnelID)
+				}
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+
+			req := httptest.NewRequest(tt.method, "http://app.example.com/", nil)
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if strings.Join(dialed, ",") != strings.Join(tt.expectedDials, ",") {
+				t.Errorf("Expected dials %v, got %v", tt.expectedDials, dialed)
+			}
+			if retries := collector.Totals().Retries; retries != int64(len(tt.expectedDials)-1) {
+				t.Errorf("Expected %d retries counted, got %d", len(tt.expectedDials)-1, retries)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	breakers := newCircuitBreakers(CircuitBreakerPolicy{Failures: 2, Cooldown: 30 * time.Second}, utils.GetModuleLogger(utils.ModuleLoadBalancer))
+	breakers.now = func() time.Time { return now }
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		failure bool
+		success bool
+		allowed bool
+	}{
+		{name: "Closed", allowed: true},
+		{name: "One failure", failure: true, allowed: true},
+		{name: "Opened after two failures", failure: true, allowed: false},
+		{name: "Open during cooldown", advance: 29 * time.Second, allowed: false},
+		{name: "Half-open after cooldown", advance: time.Second, allowed: true},
+		{name: "Only one probe", allowed: false},
+		{name: "Failed probe reopens", failure: true, allowed: false},
+		{name: "Probe after next cooldown", advance: 30 * time.Second, allowed: true},
+		{name: "Successful probe closes", success: true, allowed: true},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if step.failure {
+			breakers.failure("replica-1")
+		}
+		if step.success {
+			breakers.success("replica-1")
+		}
+		if allowed := breakers.allow("replica-1"); allowed != step.allowed {
+			t.Errorf("%s: allow() = %v, expected %v", step.name, allowed, step.allowed)
+		}
+	}
+
+	// Requests skip a target with an open circuit
+	config := &Config{CircuitBreaker: CircuitBreakerPolicy{Failures: 1, Cooldown: time.Minute}}
+	router := NewRouter(config)
+	router.AddBackend("replica-1", "app.example.com", "replica-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	var dialed []string
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		dialed = append(dialed, tunnelID)
+		return nil, fmt.Errorf("tunnel %s unreachable", tunnelID)
+	})
+	for _, expected := range []int{http.StatusBadGateway, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodPost, "http://app.example.com/", nil))
+		if w.Code != expected {
+			t.Errorf("Expected status %d, got %d", expected, w.Code)
+		}
+	}
+	if len(dialed) != 1 {
+		t.Errorf("Expected the open circuit to prevent dials, got %v", dialed)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "slow")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		timeouts       Timeouts
+		tunnelTimeouts Timeouts
+		hangDial       bool
+		expectedStatus int
+	}{
+		{
+			name:           "Response within timeout",
+			timeouts:       Timeouts{ResponseHeader: time.Second},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Response header timeout",
+			timeouts:       Timeouts{ResponseHeader: 20 * time.Millisecond},
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:           "Tunnel overrides response header timeout",
+			timeouts:       Timeouts{ResponseHeader: 20 * time.Millisecond},
+			tunnelTimeouts: Timeouts{ResponseHeader: time.Second},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Max request duration",
+			timeouts:       Timeouts{MaxRequest: 20 * time.Millisecond},
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:           "Dial timeout",
+			timeouts:       Timeouts{Dial: 20 * time.Millisecond},
+			hangDial:       true,
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Timeouts: tt.timeouts}
+			router := NewRouter(config)
+			if err := router.AddRoute("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080); err != nil {
+				t.Fatalf("Unexpected error adding route: %v", err)
+			}
+			lb := NewLoadBalancer(router, config, stats.NewCollector())
+			lb.SetTunnelOptions("tunnel-1", &TunnelOptions{Timeouts: tt.tunnelTimeouts})
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				if tt.hangDial {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestBackendTransport(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "over https")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		backendTLS     *BackendTLS
+		expectedStatus int
+	}{
+		{
+			name:           "HTTPS target",
+			backendTLS:     &BackendTLS{InsecureSkipVerify: true},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Unverified certificate",
+			backendTLS:     &BackendTLS{ServerName: "app.example.com"},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "Plain HTTP to HTTPS target",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			router := NewRouter(config)
+			if err := router.AddRoute("tunnel-1", "app.example.com", "tunnel-1.invalid", 8443); err != nil {
+				t.Fatalf("Unexpected error adding route: %v", err)
+			}
+			lb := NewLoadBalancer(router, config, stats.NewCollector())
+			lb.SetTunnelOptions("tunnel-1", &TunnelOptions{BackendTLS: tt.backendTLS})
+			dials := 0
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				dials++
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "https://"))
+			})
+
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+				if w.Code != tt.expectedStatus {
+					t.Fatalf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+				}
+			}
+			if tt.expectedStatus == http.StatusOK && dials != 1 {
+				t.Errorf("Expected the connection to be reused, got %d dials", dials)
+			}
+
+			// Removing the route drops the target's connection pool
+			router.RemoveRoute("tunnel-1")
+			if _, exists := lb.transports["tunnel-1"]; exists {
+				t.Error("Expected the transport of the removed target to be dropped")
+			}
+		})
+	}
+}
+
+func TestProxyReuse(t *testing.T) {
+	config := &Config{}
+	router := NewRouter(config)
+	if err := router.AddRoute("tunnel-1", "app.example.com", "10.0.0.2", 8080); err != nil {
+		t.Fatalf("Unexpected error adding route: %v", err)
+	}
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+
+	target, _ := router.GetTunnelByHost("app.example.com")
+	proxy := lb.proxyFor(target)
+	if lb.proxyFor(target) != proxy {
+		t.Error("Expected the proxy to be reused for the same target")
+	}
+
+	// Changing the route invalidates the proxy
+	router.RemoveRoute("tunnel-1")
+	if _, exists := lb.proxies["tunnel-1"]; exists {
+		t.Error("Expected the proxy of the removed target to be dropped")
+	}
+	if err := router.AddRoute("tunnel-1", "app.example.com", "10.0.0.3", 8080); err != nil {
+		t.Fatalf("Unexpected error adding route: %v", err)
+	}
+	target, _ = router.GetTunnelByHost("app.example.com")
+	if lb.proxyFor(target) == proxy {
+		t.Error("Expected a new proxy for the changed target")
+	}
+}
+
+func TestProxyReuseAcrossHostnames(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+
+	config := &Config{}
+	router := NewRouter(config)
+	for _, hostname := range []string{"example.com", "www.example.com"} {
+		if err := router.AddBackend("tunnel-1", hostname, host, port); err != nil {
+			t.Fatalf("Unexpected error adding route: %v", err)
+		}
+	}
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+
+	var proxy *httputil.ReverseProxy
+	for i := 0; i < 4; i++ {
+		hostname := []string{"example.com", "www.example.com"}[i%2]
+		w := httptest.NewRecorder()
+		lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodGet, "http://"+hostname+"/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		current := lb.proxies["tunnel-1"].proxy
+		if proxy != nil && current != proxy {
+			t.Fatalf("Expected one proxy for all hostnames of the tunnel, got a new one for %s", hostname)
+		}
+		proxy = current
+	}
+
+	// Rebuilding the routing table with the same target keeps the proxy
+	if err := router.ReplaceTunnelRoutes("tunnel-1", []Route{
+		{Hostname: "example.com", IP: host, Port: port},
+		{Hostname: "www.example.com", IP: host, Port: port},
+	}); err != nil {
+		t.Fatalf("Unexpected error replacing routes: %v", err)
+	}
+	target, _ := router.GetTunnelByHost("www.example.com")
+	if lb.proxyFor(target) != proxy {
+		t.Error("Expected the proxy to survive replacing the tunnel's routes")
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "from "+r.Host)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		host           string
+		options        map[string]TunnelOptions
+		unreachable    bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Unknown hostname",
+			host:           "unknown.example.com",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "404 Not Found",
+		},
+		{
+			name:           "Default bad gateway page",
+			host:           "app.example.com",
+			unreachable:    true,
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "502 Bad Gateway",
+		},
+		{
+			name: "Custom bad gateway page",
+			host: "app.example.com",
+			options: map[string]TunnelOptions{
+				"replica-1": {ErrorPages: map[string]string{"502": "<p>{{.Host}} is restarting</p>"}},
+			},
+			unreachable:    true,
+			expectedStatus: http.StatusBadGateway,
+			expectedBody:   "<p>app.example.com is restarting</p>",
+		},
+		{
+			name: "Maintenance page",
+			host: "app.example.com",
+			options: map[string]TunnelOptions{
+				"replica-1": {Maintenance: true, ErrorPages: map[string]string{"maintenance": "<p>Back soon</p>"}},
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "<p>Back soon</p>",
+		},
+		{
+			name: "Targets in maintenance are skipped",
+			host: "replicated.example.com",
+			options: map[string]TunnelOptions{
+				"replica-1": {Maintenance: true},
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "from replicated.example.com",
+		},
+		{
+			name: "Paused tunnel is not routed",
+			host: "app.example.com",
+			options: map[string]TunnelOptions{
+				"replica-1": {Paused: true},
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "404 Not Found",
+		},
+		{
+			name: "Paused targets are skipped",
+			host: "replicated.example.com",
+			options: map[string]TunnelOptions{
+				"replica-1": {Paused: true},
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "from replicated.example.com",
+		},
+		{
+			name: "Tunnel over its bandwidth limit",
+			host: "app.example.com",
+			options: map[string]TunnelOptions{
+				"replica-1": {OverBandwidth: true},
+			},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedBody:   "429 Too Many Requests",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			router := NewRouter(config)
+			router.AddBackend("replica-1", "app.example.com", "replica-1.invalid", 8080)
+			router.AddBackend("replica-1", "replicated.example.com", "replica-1.invalid", 8080)
+			router.AddBackend("replica-2", "replicated.example.com", "replica-2.invalid", 8080)
+			lb := NewLoadBalancer(router, config, stats.NewCollector())
+			for id, options := range tt.options {
+				lb.SetTunnelOptions(id, &options)
+			}
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				if tt.unreachable {
+					return nil, fmt.Errorf("tunnel %s unreachable", tunnelID)
+				}
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodPost, "http://"+tt.host+"/", nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.expectedBody) {
+				t.Errorf("Expected body containing %q, got %q", tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestProxyErrorCauses(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	hangUp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer hangUp.Close()
+	selfSigned := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer selfSigned.Close()
+
+	dialBackend := func(url string) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://"))
+		}
+	}
+	tests := []struct {
+		name           string
+		dial           func() (net.Conn, error)
+		options        TunnelOptions
+		expectedStatus int
+		expectedCause  string
+	}{
+		{
+			name: "Tunnel unreachable",
+			dial: func() (net.Conn, error) {
+				return nil, errors.New("no handshake with peer")
+			},
+			expectedStatus: http.StatusBadGateway,
+			expectedCause:  ProxyErrorUnreachable,
+		},
+		{
+			name: "Backend refuses connections",
+			dial: func() (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+			},
+			expectedStatus: http.StatusBadGateway,
+			expectedCause:  ProxyErrorConnectionRefused,
+		},
+		{
+			name: "Backend hostname does not resolve",
+			dial: func() (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "backend.internal", IsNotFound: true}}
+			},
+			expectedStatus: http.StatusBadGateway,
+			expectedCause:  ProxyErrorDNS,
+		},
+		{
+			name:           "Untrusted backend certificate",
+			dial:           dialBackend(selfSigned.URL),
+			options:        TunnelOptions{BackendTLS: &BackendTLS{ServerName: "backend.internal"}},
+			expectedStatus: http.StatusBadGateway,
+			expectedCause:  ProxyErrorTLS,
+		},
+		{
+			name:           "Backend too slow",
+			dial:           dialBackend(slow.URL),
+			options:        TunnelOptions{Timeouts: Timeouts{ResponseHeader: 50 * time.Millisecond}},
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedCause:  ProxyErrorTimeout,
+		},
+		{
+			name:           "Backend closes the connection",
+			dial:           dialBackend(hangUp.URL),
+			expectedStatus: http.StatusBadGateway,
+			expectedCause:  ProxyErrorBackend,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			router := NewRouter(config)
+			router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+			collector := stats.NewCollector()
+			lb := NewLoadBalancer(router, config, collector)
+			lb.SetTunnelOptions("tunnel-1", &tt.options)
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				return tt.dial()
+			})
+
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodPost, "http://app.example.com/", nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if cause := w.Header().Get(HeaderProxyError); cause != tt.expectedCause {
+				t.Errorf("Expected cause %s, got %q", tt.expectedCause, cause)
+			}
+			requestID := w.Header().Get(HeaderRequestID)
+			if len(requestID) != 32 || !strings.Contains(w.Body.String(), requestID) {
+				t.Errorf("Expected a request ID in the header and page, got %q", requestID)
+			}
+			if counted := collector.ProxyErrors("tunnel-1"); len(counted) != 1 || counted[tt.expectedCause] != 1 {
+				t.Errorf("Expected one %s error counted, got %v", tt.expectedCause, counted)
+			}
+		})
+	}
+
+	// Request IDs of clients are kept
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return nil, errors.New("no handshake with peer")
+	})
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/", nil)
+	req.Header.Set(HeaderRequestID, "client-id-1")
+	w := httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+	if requestID := w.Header().Get(HeaderRequestID); requestID != "client-id-1" {
+		t.Errorf("Expected the client's request ID, got %q", requestID)
+	}
+}
+
+func TestParseErrorPages(t *testing.T) {
+	tests := []struct {
+		name        string
+		pages       map[string]string
+		shouldError bool
+	}{
+		{name: "Known pages", pages: map[string]string{"404": "<p>{{.Host}}</p>", "maintenance": "<p>Back soon</p>"}},
+		{name: "Unknown page", pages: map[string]string{"418": "teapot"}, shouldError: true},
+		{name: "Invalid template", pages: map[string]string{"502": "{{.Host"}, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseErrorPages(tt.pages)
+			if (err != nil) != tt.shouldError {
+				t.Errorf("Expected error %v, got %v", tt.shouldError, err)
+			}
+		})
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "internal/1.0")
+		io.WriteString(w, r.Header.Get("X-Internal")+"|"+r.Header.Get("X-Env"))
+	}))
+	defer backend.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetTunnelOptions("tunnel-1", &TunnelOptions{HeaderRules: &HeaderRules{
+		Request: HeaderRuleSet{Set: map[string]string{"X-Env": "prod"}, Remove: []string{"X-Internal"}},
+		Response: HeaderRuleSet{
+			Set:    map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+			Remove: []string{"Server"},
+		},
+	}})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("X-Env", "dev")
+	w := httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+
+	if body := w.Body.String(); body != "|prod" {
+		t.Errorf("Expected the target to see rewritten request headers, got %q", body)
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("Expected HSTS header to be set, got %q", got)
+	}
+	if got := w.Header().Get("Server"); got != "" {
+		t.Errorf("Expected Server header to be removed, got %q", got)
+	}
+}
+
+func TestHostRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "http://app.internal:8080")
+		io.WriteString(w, r.Host+"|"+r.Header.Get("Origin")+"|"+r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backend.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetTunnelOptions("tunnel-1", &TunnelOptions{HostRewrite: HostRewrite{Host: "app.internal:8080", Origin: "http://app.internal:8080"}})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	tests := []struct {
+		origin      string
+		body        string
+		allowOrigin string
+	}{
+		{"http://app.example.com", "app.internal:8080|http://app.internal:8080|app.example.com", "http://app.example.com"},
+		{"http://evil.example.com", "app.internal:8080|http://evil.example.com|app.example.com", "http://app.internal:8080"},
+		{"", "app.internal:8080||app.example.com", "http://app.internal:8080"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		lb.handleHTTPRequest(w, req)
+
+		if body := w.Body.String(); body != tt.body {
+			t.Errorf("Origin %q: expected the target to see %q, got %q", tt.origin, tt.body, body)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("Origin %q: expected Access-Control-Allow-Origin %q, got %q", tt.origin, tt.allowOrigin, got)
+		}
+	}
+
+	for _, rewrite := range []HostRewrite{
+		{Host: "app.internal/path"},
+		{Host: "user@app.internal"},
+		{Origin: "app.internal"},
+		{Origin: "ftp://app.internal"},
+		{Origin: "http://app.internal/path"},
+	} {
+		if err := rewrite.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", rewrite)
+		}
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Traceparent"))
+	}))
+	defer backend.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected a proxy span, got %d spans", len(spans))
+	}
+	span := spans[0]
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.SpanContext().SpanID().String() + "-01"
+	if body := w.Body.String(); body != expected {
+		t.Errorf("Expected the target to see traceparent %s, got %q", expected, body)
+	}
+	for _, attr := range span.Attributes() {
+		if attr.Key == "tunnel.id" && attr.Value.AsString() != "tunnel-1" {
+			t.Errorf("Expected tunnel.id tunnel-1, got %s", attr.Value.AsString())
+		}
+		if attr.Key == "http.response.status_code" && attr.Value.AsInt64() != http.StatusOK {
+			t.Errorf("Expected status code 200, got %d", attr.Value.AsInt64())
+		}
+	}
+}
+
+func TestValidateHeaderRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       HeaderRules
+		shouldError bool
+	}{
+		{
+			name: "Valid rules",
+			rules: HeaderRules{
+				Request:  HeaderRuleSet{Remove: []string{"X-Internal"}},
+				Response: HeaderRuleSet{Add: map[string]string{"Access-Control-Allow-Origin": "*"}},
+			},
+		},
+		{name: "Invalid name", rules: HeaderRules{Request: HeaderRuleSet{Set: map[string]string{"X Bad": "1"}}}, shouldError: true},
+		{name: "Invalid removed name", rules: HeaderRules{Response: HeaderRuleSet{Remove: []string{""}}}, shouldError: true},
+		{name: "Invalid value", rules: HeaderRules{Response: HeaderRuleSet{Set: map[string]string{"X-Ok": "a\r\nb"}}}, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.Validate()
+			if (err != nil) != tt.shouldError {
+				t.Errorf("Expected error %v, got %v", tt.shouldError, err)
+			}
+		})
+	}
+}
+
+func TestStreamingResponses(t *testing.T) {
+	for _, contentType := range []string{"text/event-stream", "application/stream+json"} {
+		t.Run(contentType, func(t *testing.T) {
+			release := make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Cache-Control", "max-age=60")
+				io.WriteString(w, "data: first\n\n")
+				w.(http.Flusher).Flush()
+				// The second event is written after the write timeout
+				// passed and the client read the first one
+				<-release
+				time.Sleep(150 * time.Millisecond)
+				io.WriteString(w, "data: second\n\n")
+			}))
+			defer backend.Close()
+
+			config := &Config{
+				Compression: Compression{Enabled: true, MinSize: 1},
+				Cache:       Cache{Enabled: true},
+			}
+			router := NewRouter(config)
+			router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+			lb := NewLoadBalancer(router, config, stats.NewCollector())
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+			server := httptest.NewUnstartedServer(http.HandlerFunc(lb.handleHTTPRequest))
+			server.Config.WriteTimeout = 100 * time.Millisecond
+			server.Start()
+			defer server.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+			req.Host = "app.example.com"
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				close(release)
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("X-Accel-Buffering") != "no" {
+				t.Errorf("Expected an uncompressed stream unbuffered by proxies, got headers %v", resp.Header)
+			}
+
+			first := make([]byte, len("data: first\n\n"))
+			_, err = io.ReadFull(resp.Body, first)
+			close(release)
+			if err != nil || string(first) != "data: first\n\n" {
+				t.Fatalf("Expected the first event before the stream ended, got %q, %v", first, err)
+			}
+			rest, err := io.ReadAll(resp.Body)
+			if err != nil || string(rest) != "data: second\n\n" {
+				t.Errorf("Expected the second event after the write timeout, got %q, %v", rest, err)
+			}
+			if stats := lb.CacheStats("tunnel-1"); stats.Entries != 0 {
+				t.Errorf("Expected streams not to be cached, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	page := strings.Repeat("<p>hello</p>", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<p>hi</p>")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, page)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, page)
+		}
+	}))
+	defer backend.Close()
+
+	enabled, disabled := true, false
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		compression    Compression
+		options        TunnelOptions
+		expectGzip     bool
+	}{
+		{name: "Compressed", path: "/", acceptEncoding: "gzip, br", compression: Compression{Enabled: true}, expectGzip: true},
+		{name: "Disabled", path: "/", acceptEncoding: "gzip", compression: Compression{}},
+		{name: "Client does not accept gzip", path: "/", acceptEncoding: "br", compression: Compression{Enabled: true}},
+		{name: "Gzip refused", path: "/", acceptEncoding: "gzip;q=0", compression: Compression{Enabled: true}},
+		{name: "Below minimum size", path: "/small", acceptEncoding: "gzip", compression: Compression{Enabled: true}},
+		{name: "Incompressible type", path: "/image", acceptEncoding: "gzip", compression: Compression{Enabled: true}},
+		{name: "Enabled by tunnel", path: "/", acceptEncoding: "gzip", options: TunnelOptions{Compression: &enabled}, expectGzip: true},
+		{name: "Disabled by tunnel", path: "/", acceptEncoding: "gzip", compression: Compression{Enabled: true}, options: TunnelOptions{Compression: &disabled}},
+		{name: "Tunnel minimum size", path: "/small", acceptEncoding: "gzip", compression: Compression{Enabled: true}, options: TunnelOptions{CompressionMinSize: 1}, expectGzip: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Compression: tt.compression}
+			router := NewRouter(config)
+			router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+			lb := NewLoadBalancer(router, config, stats.NewCollector())
+			lb.SetTunnelOptions("tunnel-1", &tt.options)
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com"+tt.path, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, req)
+
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.expectGzip {
+				t.Fatalf("Expected gzip %v, got Content-Encoding %q", tt.expectGzip, w.Header().Get("Content-Encoding"))
+			}
+			if !tt.expectGzip {
+				return
+			}
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("Invalid gzip body: %v", err)
+			}
+			body, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatalf("Invalid gzip body: %v", err)
+			}
+			if tt.path == "/" && string(body) != page {
+				t.Errorf("Expected the decompressed body to match the target's")
+			}
+			if w.Header().Get("Content-Length") != "" || w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Expected no Content-Length and Vary: Accept-Encoding, got %v", w.Header())
+			}
+			if tt.path == "/" && w.Header().Get("ETag") != `W/"v1"` {
+				t.Errorf("Expected a weak ETag, got %q", w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		body           string
+		chunked        bool
+		tunnelLimit    int64
+		expectedStatus int
+	}{
+		{name: "Body within limit", body: strings.Repeat("a", 16), expectedStatus: http.StatusOK},
+		{name: "Body within the tunnel's limit", body: strings.Repeat("a", 32), tunnelLimit: 32, expectedStatus: http.StatusOK},
+		{name: "Body over the tunnel's limit", body: strings.Repeat("a", 33), tunnelLimit: 32, expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "Declared body over limit", body: strings.Repeat("a", 17), expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "Chunked body over limit", body: strings.Repeat("a", 4096), chunked: true, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Limits: Limits{MaxRequestBody: 16}}
+			router := NewRouter(config)
+			router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+			lb := NewLoadBalancer(router, config, stats.NewCollector())
+			lb.SetTunnelOptions("tunnel-1", &TunnelOptions{MaxRequestBody: tt.tunnelLimit})
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "http://app.example.com/", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if !lb.breakers.allow("tunnel-1") {
+				t.Error("Expected oversized requests not to count against the target's circuit")
+			}
+		})
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		options        TunnelOptions
+		expectedStatus int
+	}{
+		{name: "No lists", remoteAddr: "203.0.113.7:4000", expectedStatus: http.StatusOK},
+		{
+			name:           "Allowed range",
+			remoteAddr:     "10.1.2.3:4000",
+			options:        TunnelOptions{Access: AccessLists{AllowedIPs: mustParseCIDRs("10.0.0.0/8")}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Outside allowed ranges",
+			remoteAddr:     "203.0.113.7:4000",
+			options:        TunnelOptions{Access: AccessLists{AllowedIPs: mustParseCIDRs("10.0.0.0/8", "2001:db8::/32")}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Denied address within allowed range",
+			remoteAddr:     "10.1.2.3:4000",
+			options:        TunnelOptions{Access: AccessLists{AllowedIPs: mustParseCIDRs("10.0.0.0/8"), DeniedIPs: mustParseCIDRs("10.1.2.3")}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Denied IPv6 range",
+			remoteAddr:     "[2001:db8::1]:4000",
+			options:        TunnelOptions{Access: AccessLists{DeniedIPs: mustParseCIDRs("2001:db8::/32")}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "IPv4-mapped client",
+			remoteAddr:     "[::ffff:10.1.2.3]:4000",
+			options:        TunnelOptions{Access: AccessLists{AllowedIPs: mustParseCIDRs("10.0.0.0/8")}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Lists failed to parse",
+			remoteAddr:     "10.1.2.3:4000",
+			options:        TunnelOptions{Access: AccessLists{DenyAll: true}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Allowed country",
+			remoteAddr:     "192.0.2.1:4000",
+			options:        TunnelOptions{Access: AccessLists{AllowedCountries: []string{"DE", "FR"}}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Outside allowed countries",
+			remoteAddr:     "198.51.100.1:4000",
+			options:        TunnelOptions{Access: AccessLists{AllowedCountries: []string{"DE", "FR"}}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Unknown country with allowed countries",
+			remoteAddr:     "203.0.113.7:4000",
+			options:        TunnelOptions{Access: AccessLists{AllowedCountries: []string{"DE"}}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Denied country",
+			remoteAddr:     "198.51.100.1:4000",
+			options:        TunnelOptions{Access: AccessLists{DeniedCountries: []string{"US"}}},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			router := NewRouter(config)
+			router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+			collector := stats.NewCollector()
+			lb := NewLoadBalancer(router, config, collector)
+			lb.SetTunnelOptions("tunnel-1", &tt.options)
+			lb.SetCountryLookup(func(addr netip.Addr) string {
+				return map[string]string{"192.0.2.1": "DE", "198.51.100.1": "US"}[addr.String()]
+			})
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			expectedDenied := int64(0)
+			if tt.expectedStatus == http.StatusForbidden {
+				expectedDenied = 1
+			}
+			if denied := collector.Get("tunnel-1").Denied; denied != expectedDenied {
+				t.Errorf("Expected %d denied requests, got %d", expectedDenied, denied)
+			}
+		})
+	}
+}
+
+func mustParseCIDRs(entries ...string) []*net.IPNet {
+	networks, err := ParseCIDRs(entries)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+func TestParseCountries(t *testing.T) {
+	countries, err := ParseCountries([]string{"de", " US "})
+	if err != nil || len(countries) != 2 || countries[0] != "DE" || countries[1] != "US" {
+		t.Errorf("Expected [DE US], got %v (%v)", countries, err)
+	}
+	if _, err := ParseCountries([]string{"Germany"}); err == nil {
+		t.Error("Expected an error for a country name")
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		name        string
+		entries     []string
+		expected    []string
+		shouldError bool
+	}{
+		{
+			name:     "CIDRs and addresses",
+			entries:  []string{"10.1.0.0/8", "192.0.2.1", "2001:db8::/32", "::ffff:10.0.0.0/104"},
+			expected: []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "10.0.0.0/8"},
+		},
+		{name: "Invalid address", entries: []string{"10.0.0.256"}, shouldError: true},
+		{name: "Invalid prefix length", entries: []string{"10.0.0.0/33"}, shouldError: true},
+		{name: "Short IPv4-mapped prefix", entries: []string{"::ffff:0:0/80"}, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := ParseCIDRs(tt.entries)
+			if (err != nil) != tt.shouldError {
+				t.Errorf("Expected error %v, got %v", tt.shouldError, err)
+			}
+			var parsed []string
+			for _, network := range networks {
+				parsed = append(parsed, network.String())
+			}
+			if !slices.Equal(parsed, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestRequestFilters(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	rules := []FilterRule{
+		{Name: "dotfiles", Path: `^/\.(env|git)`},
+		{Name: "scanners", UserAgent: `(?i)sqlmap|nikto`},
+		{Name: "no-trace", Methods: []string{"TRACE"}},
+		{Name: "debug-header", Methods: []string{"POST"}, Headers: map[string]string{"X-Debug": ""}},
+	}
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		header       http.Header
+		expectedRule string
+	}{
+		{name: "Allowed", method: http.MethodGet, path: "/index.html"},
+		{name: "Path", method: http.MethodGet, path: "/.env", expectedRule: "dotfiles"},
+		{name: "User agent", method: http.MethodGet, path: "/", header: http.Header{"User-Agent": {"Mozilla/5.0 Nikto/2.5"}}, expectedRule: "scanners"},
+		{name: "Method", method: "TRACE", path: "/", expectedRule: "no-trace"},
+		{name: "All conditions", method: http.MethodPost, path: "/", header: http.Header{"X-Debug": {"1"}}, expectedRule: "debug-header"},
+		{name: "Missing header", method: http.MethodPost, path: "/"},
+		{name: "Other method", method: http.MethodGet, path: "/", header: http.Header{"X-Debug": {"1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			router := NewRouter(config)
+			router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+			collector := stats.NewCollector()
+			lb := NewLoadBalancer(router, config, collector)
+			lb.SetTunnelOptions("tunnel-1", &TunnelOptions{RequestFilters: rules})
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+
+			req := httptest.NewRequest(tt.method, "http://app.example.com"+tt.path, nil)
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, req)
+
+			expectedStatus := http.StatusOK
+			if tt.expectedRule != "" {
+				expectedStatus = http.StatusForbidden
+			}
+			if w.Code != expectedStatus {
+				t.Errorf("Expected status %d, got %d", expectedStatus, w.Code)
+			}
+			filtered := collector.Filtered("tunnel-1")
+			if tt.expectedRule == "" && len(filtered) != 0 {
+				t.Errorf("Expected no filtered requests, got %v", filtered)
+			}
+			if tt.expectedRule != "" && (len(filtered) != 1 || filtered[tt.expectedRule] != 1) {
+				t.Errorf("Expected one request filtered by %s, got %v", tt.expectedRule, filtered)
+			}
+		})
+	}
+}
+
+func TestValidateFilterRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       []FilterRule
+		shouldError bool
+	}{
+		{name: "Valid rules", rules: []FilterRule{{Name: "wp", Path: "^/wp-"}, {Name: "curl", UserAgent: "^curl/"}}},
+		{name: "No rules"},
+		{name: "Missing name", rules: []FilterRule{{Path: "^/wp-"}}, shouldError: true},
+		{name: "Invalid name", rules: []FilterRule{{Name: "wp admin", Path: "^/wp-"}}, shouldError: true},
+		{name: "Duplicate name", rules: []FilterRule{{Name: "wp", Path: "^/wp-"}, {Name: "wp", Path: "^/xmlrpc"}}, shouldError: true},
+		{name: "No conditions", rules: []FilterRule{{Name: "all"}}, shouldError: true},
+		{name: "Invalid pattern", rules: []FilterRule{{Name: "bad", Path: "("}}, shouldError: true},
+		{name: "Invalid method", rules: []FilterRule{{Name: "bad", Methods: []string{"GE T"}}}, shouldError: true},
+		{name: "Invalid header", rules: []FilterRule{{Name: "bad", Headers: map[string]string{"X Bad": ""}}}, shouldError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateFilterRules(tt.rules)
+			if (err != nil) != tt.shouldError {
+				t.Errorf("Expected error %v, got %v", tt.shouldError, err)
+			}
+		})
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := newClientLimiter()
+	limiter.now = func() time.Time { return now }
+
+	// Two requests per second with bursts of two
+	limits := ClientLimits{RequestsPerSecond: 2}
+	for i := 0; i < 2; i++ {
+		if _, ok, _ := limiter.acquire("tunnel-1", "192.0.2.1", limits); !ok {
+			t.Fatalf("Expected request %d within the burst to be admitted", i+1)
+		}
+	}
+	_, ok, retryAfter := limiter.acquire("tunnel-1", "192.0.2.1", limits)
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected the third request to be limited for 500ms, got %v and %v", ok, retryAfter)
+	}
+	if _, ok, _ := limiter.acquire("tunnel-1", "192.0.2.2", limits); !ok {
+		t.Error("Expected other clients to have their own bucket")
+	}
+	if _, ok, _ := limiter.acquire("tunnel-2", "192.0.2.1", limits); !ok {
+		t.Error("Expected other tunnels to have their own bucket")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if _, ok, _ := limiter.acquire("tunnel-1", "192.0.2.1", limits); !ok {
+		t.Error("Expected a request to be admitted once a token refilled")
+	}
+
+	// One connection at a time
+	limits = ClientLimits{MaxConnections: 1}
+	release, ok, _ := limiter.acquire("tunnel-3", "192.0.2.1", limits)
+	if !ok {
+		t.Fatal("Expected the first connection to be admitted")
+	}
+	if _, ok, _ := limiter.acquire("tunnel-3", "192.0.2.1", limits); ok {
+		t.Error("Expected a second concurrent connection to be refused")
+	}
+	release()
+	release()
+	if _, ok, _ := limiter.acquire("tunnel-3", "192.0.2.1", limits); !ok {
+		t.Error("Expected a connection to be admitted after the first was released")
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	config := &Config{ClientLimits: ClientLimits{RequestsPerSecond: 100}}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	collector := stats.NewCollector()
+	lb := NewLoadBalancer(router, config, collector)
+	lb.SetTunnelOptions("tunnel-1", &TunnelOptions{ClientLimits: ClientLimits{RequestsPerSecond: 1}})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+		if w.Code != expected {
+			t.Errorf("Expected status %d for request %d, got %d", expected, i+1, w.Code)
+		}
+		if expected == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("Expected Retry-After 1, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+	if limited := collector.Get("tunnel-1").RateLimited; limited != 1 {
+		t.Errorf("Expected 1 rate limited request, got %d", limited)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for localhost and
+// returns the paths of the certificate and key
+func writeTestCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freePort returns a TCP port that was free a moment ago
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestHTTP3(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	port := freePort(t)
+	config := &Config{
+		Host:      "127.0.0.1",
+		HTTPPort:  port,
+		TCPPort:   freePort(t),
+		TLSConfig: &TLSConfig{CertFile: certFile, KeyFile: keyFile, HTTP3: true},
+	}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+	if lb.http3Server == nil {
+		t.Fatal("Expected the HTTP/3 server to be listening")
+	}
+
+	url := "https://127.0.0.1:" + strconv.Itoa(port) + "/"
+	clientTLS := &tls.Config{InsecureSkipVerify: true}
+
+	// Responses over TCP advertise HTTP/3
+	https := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = https.Get(url); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if altSvc := resp.Header.Get("Alt-Svc"); !strings.Contains(altSvc, `h3=":`+strconv.Itoa(port)+`"`) {
+		t.Errorf("Expected Alt-Svc to advertise h3 on port %d, got %q", port, altSvc)
+	}
+
+	// The same handler answers over HTTP/3
+	h3 := &http3.Transport{TLSClientConfig: clientTLS}
+	defer h3.Close()
+	resp, err = (&http.Client{Transport: h3, Timeout: 5 * time.Second}).Get(url)
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected HTTP/3 404 for an unknown host, got %s %d", resp.Proto, resp.StatusCode)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Error("Expected no Alt-Svc header over HTTP/3")
+	}
+}
+
+func TestHTTP3NotAdvertisedWithoutListener(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	port := freePort(t)
+
+	// Another socket holds the UDP port
+	udp, err := net.ListenPacket("udp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	config := &Config{
+		Host:      "127.0.0.1",
+		HTTPPort:  port,
+		TCPPort:   freePort(t),
+		TLSConfig: &TLSConfig{CertFile: certFile, KeyFile: keyFile, HTTP3: true},
+	}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+	if lb.http3Server != nil {
+		t.Error("Expected HTTP/3 to stay off without its UDP port")
+	}
+
+	https := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = https.Get("https://127.0.0.1:" + strconv.Itoa(port) + "/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if altSvc := resp.Header.Get("Alt-Svc"); altSvc != "" {
+		t.Errorf("Expected no Alt-Svc header, got %q", altSvc)
+	}
+}
+
+func TestListening(t *testing.T) {
+	config := &Config{
+		Host:     "127.0.0.1",
+		HTTPPort: freePort(t),
+		TCPPort:  freePort(t),
+	}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	if err := lb.Listening(); err == nil {
+		t.Error("Expected an error before the load balancer starts")
+	}
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	if err := lb.Listening(); err != nil {
+		t.Errorf("Expected the listeners to be bound, got %v", err)
+	}
+	lb.Stop()
+	if err := lb.Listening(); err == nil {
+		t.Error("Expected an error after the load balancer stops")
+	}
+
+	// The HTTP port is taken
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	config.HTTPPort = held.Addr().(*net.TCPAddr).Port
+	lb = NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	if err := lb.Start(); err == nil {
+		lb.Stop()
+		t.Fatal("Expected starting on a taken port to fail")
+	}
+	if err := lb.Listening(); err == nil {
+		t.Error("Expected an error when the HTTP listener could not be bound")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	// The target echoes what it receives
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	start := func() (*LoadBalancer, string) {
+		config := &Config{Host: "127.0.0.1", HTTPPort: freePort(t), TCPPort: freePort(t)}
+		router := NewRouter(config)
+		if err := router.AddTCPRoute("db", config.TCPPort, "10.0.0.2", 5432); err != nil {
+			t.Fatalf("Failed to add TCP route: %v", err)
+		}
+		lb := NewLoadBalancer(router, config, stats.NewCollector())
+		lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+			return net.Dial("tcp", backend.Addr().String())
+		})
+		if err := lb.Start(); err != nil {
+			t.Fatalf("Failed to start load balancer: %v", err)
+		}
+		return lb, net.JoinHostPort("127.0.0.1", strconv.Itoa(config.TCPPort))
+	}
+	connect := func(addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		reply := make([]byte, 4)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("Failed to read echo: %v", err)
+		}
+		return conn
+	}
+
+	t.Run("Waits for open connections", func(t *testing.T) {
+		lb, addr := start()
+		conn := connect(addr)
+
+		done := make(chan error, 1)
+		go func() { done <- lb.Drain(context.Background()) }()
+
+		// New connections are refused while the open one is served
+		for i := 0; ; i++ {
+			refused, err := net.Dial("tcp", addr)
+			if err != nil {
+				break
+			}
+			refused.Close()
+			if i == 50 {
+				t.Fatal("Expected new connections to be refused")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if _, err := conn.Write([]byte("pong")); err != nil {
+			t.Errorf("Expected the open connection to be served, got %v", err)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Expected the drain to wait for the open connection, got %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		conn.Close()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Expected the drain to finish, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the drain to finish once the connection closed")
+		}
+	})
+
+	t.Run("Closes connections at the timeout", func(t *testing.T) {
+		lb, addr := start()
+		conn := connect(addr)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := lb.Drain(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Expected the drain to time out, got %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Expected the remaining connection to be closed")
+		}
+	})
+}
+
+func TestInheritedListeners(t *testing.T) {
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The configured ports are not bound while listeners are inherited
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	port := held.Addr().(*net.TCPAddr).Port
+	config := &Config{Host: "127.0.0.1", HTTPPort: port, TCPPort: port}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	lb.SetListeners(httpListener, tcpListener)
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+
+	resp, err := http.Get("http://" + httpListener.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("Request to the inherited listener failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown host, got %d", resp.StatusCode)
+	}
+	if len(lb.tcpListeners) != 1 || lb.tcpListeners[0] != tcpListener {
+		t.Error("Expected the inherited TCP listener to be served")
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	config := &Config{
+		Host:        "127.0.0.1",
+		HTTPPort:    freePort(t),
+		TCPPort:     freePort(t),
+		AcceptLoops: 2,
+	}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+	if len(lb.tcpListeners) != 2 {
+		t.Errorf("Expected 2 TCP sockets, got %d", len(lb.tcpListeners))
+	}
+
+	// Another agent process shares the ports
+	other := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	if err := other.Start(); err != nil {
+		t.Fatalf("Expected a second load balancer to bind the same ports, got %v", err)
+	}
+	defer other.Stop()
+
+	for range 4 {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", config.HTTPPort))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for an unknown host, got %d", resp.StatusCode)
+		}
+	}
+
+	// Without SO_REUSEPORT the ports stay taken
+	single := &Config{Host: config.Host, HTTPPort: config.HTTPPort, TCPPort: config.TCPPort}
+	lb2 := NewLoadBalancer(NewRouter(single), single, stats.NewCollector())
+	if err := lb2.Start(); err == nil {
+		lb2.Stop()
+		t.Error("Expected binding taken ports without SO_REUSEPORT to fail")
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners("private=http://10.0.0.5:8080, partner=https://[2001:db8::1]:8443?cert=/etc/p.pem&key=/etc/p.key,db=tcp://:5432,dns=udp://:5432,")
+	if err != nil {
+		t.Fatalf("Failed to parse listeners: %v", err)
+	}
+	expected := []Listener{
+		{Name: "private", Protocol: ListenerHTTP, Address: "10.0.0.5:8080"},
+		{Name: "partner", Protocol: ListenerHTTPS, Address: "[2001:db8::1]:8443", TLS: &TLSConfig{CertFile: "/etc/p.pem", KeyFile: "/etc/p.key"}},
+		{Name: "db", Protocol: ListenerTCP, Address: ":5432"},
+		{Name: "dns", Protocol: ListenerUDP, Address: ":5432"},
+	}
+	if !reflect.DeepEqual(listeners, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, listeners)
+	}
+
+	for _, spec := range []string{
+		"private",
+		"private=10.0.0.5:8080",
+		"private=sctp://10.0.0.5:8080",
+		"dns=udp://10.0.0.5:53?cert=/etc/p.pem&key=/etc/p.key",
+		"a=udp://10.0.0.5:53,b=udp://10.0.0.5:53",
+		"private=http://10.0.0.5",
+		"private=http://10.0.0.5:0",
+		"private=http://10.0.0.5:8080/path",
+		"private=http://10.0.0.5:8080?cert=/etc/p.pem&key=/etc/p.key",
+		"partner=https://10.0.0.5:8443?cert=/etc/p.pem",
+		"=http://10.0.0.5:8080",
+		"a=http://10.0.0.5:8080,a=http://10.0.0.5:8081",
+		"a=http://10.0.0.5:8080,b=tcp://10.0.0.5:8080",
+	} {
+		if _, err := ParseListeners(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestAdditionalListeners(t *testing.T) {
+	// The target echoes what it receives
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	certFile, keyFile := writeTestCertificate(t)
+	privatePort, partnerPort, dbPort := freePort(t), freePort(t), freePort(t)
+	config := &Config{
+		Host:     "127.0.0.1",
+		HTTPPort: freePort(t),
+		TCPPort:  freePort(t),
+		Listeners: []Listener{
+			{Name: "private", Protocol: ListenerHTTP, Address: fmt.Sprintf("127.0.0.1:%d", privatePort)},
+			{Name: "partner", Protocol: ListenerHTTPS, Address: fmt.Sprintf("127.0.0.1:%d", partnerPort), TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile}},
+			{Name: "db", Protocol: ListenerTCP, Address: fmt.Sprintf("127.0.0.1:%d", dbPort)},
+		},
+	}
+	router := NewRouter(config)
+	if err := router.AddTCPRoute("db", dbPort, "10.0.0.2", 5432); err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", backend.Addr().String())
+	})
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+
+	for _, state := range lb.ListenerStates() {
+		if !state.Listening {
+			t.Errorf("Expected listener %s to be listening", state.Name)
+		}
+	}
+	if states := lb.ListenerStates(); len(states) != 5 || states[0].Protocol != ListenerHTTP || states[3].Name != "partner" {
+		t.Errorf("Expected the HTTP and TCP ports and the additional listeners, got %+v", states)
+	}
+
+	// The HTTP port serves plain HTTP while the partner listener has its
+	// own certificate
+	https := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for _, url := range []string{
+		fmt.Sprintf("http://127.0.0.1:%d/", config.HTTPPort),
+		fmt.Sprintf("http://127.0.0.1:%d/", privatePort),
+		fmt.Sprintf("https://127.0.0.1:%d/", partnerPort),
+	} {
+		resp, err := https.Get(url)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for an unknown host from %s, got %d", url, resp.StatusCode)
+		}
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", dbPort))
+	if err != nil {
+		t.Fatalf("Failed to connect to the TCP listener: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Expected the echo through the TCP listener, got %q, %v", reply, err)
+	}
+
+	lb.Stop()
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", privatePort)); err == nil {
+		t.Error("Expected the additional listeners to be closed")
+	}
+	for _, state := range lb.ListenerStates() {
+		if state.Listening {
+			t.Errorf("Expected listener %s to be stopped", state.Name)
+		}
+	}
+}
+
+func TestCertificateRenewal(t *testing.T) {
+	config := &Config{}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+
+	certFile, keyFile := writeTestCertificate(t)
+	listenerCert, listenerKey := writeTestCertificate(t)
+	lb.certs = &certificateStore{}
+	if err := lb.certs.load(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	listener := &certificateStore{}
+	if err := listener.load(listenerCert, listenerKey); err != nil {
+		t.Fatal(err)
+	}
+	lb.listenerCerts = []*certificateStore{listener}
+	served := func(store *certificateStore) []byte {
+		cert, err := store.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Certificate[0]
+	}
+	// replace overwrites a file with another one, with a later
+	// modification time
+	replace := func(path, with string) {
+		data, err := os.ReadFile(with)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	renew := func(certFile, keyFile string) {
+		newCert, newKey := writeTestCertificate(t)
+		replace(certFile, newCert)
+		replace(keyFile, newKey)
+	}
+
+	original, originalListener := served(lb.certs), served(listener)
+	lb.reloadChangedCertificates()
+	if !bytes.Equal(served(lb.certs), original) {
+		t.Error("Expected unchanged files not to be reloaded")
+	}
+
+	renew(certFile, keyFile)
+	renew(listenerCert, listenerKey)
+	lb.reloadChangedCertificates()
+	if bytes.Equal(served(lb.certs), original) {
+		t.Error("Expected the renewed certificate of the HTTP port to be served")
+	}
+	if bytes.Equal(served(listener), originalListener) {
+		t.Error("Expected the renewed certificate of the listener to be served")
+	}
+
+	// A certificate written without its key keeps the current pair
+	current := served(lb.certs)
+	newCert, _ := writeTestCertificate(t)
+	replace(certFile, newCert)
+	lb.reloadChangedCertificates()
+	if !bytes.Equal(served(lb.certs), current) {
+		t.Error("Expected a mismatched pair to keep the current certificate")
+	}
+}
+
+func TestParseTLSPolicy(t *testing.T) {
+	policy, err := ParseTLSPolicy("1.2", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "P-384,X25519,P-256", "http/1.1")
+	if err != nil {
+		t.Fatalf("ParseTLSPolicy() error = %v", err)
+	}
+	want := TLSPolicy{
+		MinVersion:       tls.VersionTLS12,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		CurvePreferences: []tls.CurveID{tls.CurveP384, tls.X25519, tls.CurveP256},
+		ALPN:             []string{ALPNHTTP1},
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("ParseTLSPolicy() = %+v, want %+v", policy, want)
+	}
+	if policy, err := ParseTLSPolicy("", "", "", ""); err != nil || !reflect.DeepEqual(policy, TLSPolicy{}) {
+		t.Errorf("Expected empty values to keep the defaults, got %+v, %v", policy, err)
+	}
+
+	invalid := []struct {
+		minVersion, cipherSuites, curves, alpn string
+	}{
+		{minVersion: "1.0"},
+		{cipherSuites: "TLS_RSA_WITH_RC4_128_SHA"},
+		{cipherSuites: "TLS_AES_128_GCM_SHA256"},
+		{minVersion: "1.3", cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		{curves: "P-224"},
+		{alpn: "h3"},
+	}
+	for _, tt := range invalid {
+		if _, err := ParseTLSPolicy(tt.minVersion, tt.cipherSuites, tt.curves, tt.alpn); err == nil {
+			t.Errorf("ParseTLSPolicy(%+v) expected error", tt)
+		}
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	config := &Config{TLSConfig: &TLSConfig{Policy: TLSPolicy{MinVersion: tls.VersionTLS13, ALPN: []string{ALPNHTTP1}}}}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+
+	certFile, keyFile := writeTestCertificate(t)
+	certs := &certificateStore{}
+	if err := certs.load(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = lb.serverTLSConfig(certs)
+	lb.tlsPolicy().configureServer(server.Config)
+	server.StartTLS()
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	if _, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("Expected a TLS 1.2 handshake to fail")
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatalf("TLS 1.3 handshake failed: %v", err)
+	}
+	defer conn.Close()
+	if state := conn.ConnectionState(); state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != ALPNHTTP1 {
+		t.Errorf("Expected TLS 1.3 with http/1.1, got version %x and protocol %q", state.Version, state.NegotiatedProtocol)
+	}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := false
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(caCert, caCert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+	if err := os.WriteFile(certFile, chain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certs := &certificateStore{stapling: true}
+	if err := certs.load(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	staple := func() []byte {
+		cert, err := certs.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.OCSPStaple
+	}
+
+	now := time.Now()
+	if stapled, err := certs.refreshOCSP(now); !stapled || err != nil {
+		t.Fatalf("refreshOCSP() = %v, %v", stapled, err)
+	}
+	if resp, err := ocsp.ParseResponseForCert(staple(), template, caCert); err != nil || resp.Status != ocsp.Good {
+		t.Fatalf("Expected a good OCSP response stapled, got %v", err)
+	}
+	if stapled, _ := certs.refreshOCSP(now.Add(time.Minute)); stapled {
+		t.Error("Expected a fresh staple not to be refreshed")
+	}
+
+	// A failed refresh keeps the staple until it expires
+	failing = true
+	if _, err := certs.refreshOCSP(now.Add(45 * time.Minute)); err == nil || staple() == nil {
+		t.Errorf("Expected the error and the staple kept, got %v", err)
+	}
+	if _, err := certs.refreshOCSP(now.Add(2 * time.Hour)); err == nil || staple() != nil {
+		t.Errorf("Expected the expired staple to be dropped, got %v", err)
+	}
+
+	// Certificates without a responder are served unstapled
+	selfSigned, selfSignedKey := writeTestCertificate(t)
+	if err := certs.load(selfSigned, selfSignedKey); err != nil {
+		t.Fatal(err)
+	}
+	if stapled, err := certs.refreshOCSP(now); stapled || err != nil || staple() != nil {
+		t.Errorf("refreshOCSP() = %v, %v, want no staple", stapled, err)
+	}
+}
+
+func TestHTTPSListenerNeedsCertificate(t *testing.T) {
+	config := &Config{
+		Host:      "127.0.0.1",
+		HTTPPort:  freePort(t),
+		TCPPort:   freePort(t),
+		Listeners: []Listener{{Name: "partner", Protocol: ListenerHTTPS, Address: fmt.Sprintf("127.0.0.1:%d", freePort(t))}},
+	}
+	lb := NewLoadBalancer(NewRouter(config), config, stats.NewCollector())
+	defer lb.Stop()
+	if err := lb.Start(); err == nil {
+		t.Error("Expected an https listener without any certificate to fail")
+	}
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The target terminates TLS itself and greets its clients
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("backend"))
+			}()
+		}
+	}()
+
+	config := &Config{
+		Host:      "127.0.0.1",
+		HTTPPort:  freePort(t),
+		TCPPort:   freePort(t),
+		TLSConfig: &TLSConfig{CertFile: certFile, KeyFile: keyFile},
+	}
+	router := NewRouter(config)
+	if err := router.AddTLSRoute("mail", "mail.example.com", "127.0.0.1", 993); err != nil {
+		t.Fatal(err)
+	}
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", backend.Addr().String())
+	})
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+	addr := fmt.Sprintf("127.0.0.1:%d", config.HTTPPort)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake through the load balancer failed: %v", err)
+	}
+	defer conn.Close()
+	greeting, err := io.ReadAll(conn)
+	if err != nil || string(greeting) != "backend" {
+		t.Errorf("Expected the target's greeting, got %q, %v", greeting, err)
+	}
+
+	// Other hostnames are still terminated by the load balancer
+	https := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := https.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown host, got %d", resp.StatusCode)
+	}
+}
+
+func TestUDPListener(t *testing.T) {
+	// The target echoes datagrams
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := backend.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	port := freePort(t)
+	config := &Config{
+		Host:      "127.0.0.1",
+		HTTPPort:  freePort(t),
+		TCPPort:   freePort(t),
+		Listeners: []Listener{{Name: "dns", Protocol: ListenerUDP, Address: fmt.Sprintf("127.0.0.1:%d", port)}},
+	}
+	router := NewRouter(config)
+	if err := router.AddUDPRoute("dns", port, "127.0.0.1", backend.LocalAddr().(*net.UDPAddr).Port); err != nil {
+		t.Fatal(err)
+	}
+	collector := stats.NewCollector()
+	lb := NewLoadBalancer(router, config, collector)
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply := make([]byte, 16)
+	for _, message := range []string{"ping", "pong"} {
+		conn.Write([]byte(message))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(reply)
+		if err != nil || string(reply[:n]) != message {
+			t.Fatalf("Expected the echo %q, got %q, %v", message, reply[:n], err)
+		}
+	}
+
+	// Both datagrams belong to one session
+	conns := lb.Connections()
+	if len(conns) != 1 || conns[0].Protocol != "udp" || conns[0].BytesReceived != 8 || conns[0].BytesSent != 8 {
+		t.Errorf("Expected one UDP session with 8 bytes each way, got %+v", conns)
+	}
+
+	// Sessions end once the serving loop sees its socket closed
+	lb.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(lb.Connections()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if conns := lb.Connections(); len(conns) != 0 {
+		t.Errorf("Expected stopping to end the sessions, got %+v", conns)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "production:"+string(body))
+	}))
+	defer backend.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + r.Host + " " + string(body)
+		io.WriteString(w, "shadow")
+	}))
+	defer shadow.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("prod", "app.example.com", "prod.invalid", 8080)
+	router.AddBackend("canary", "canary.example.com", "canary.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetTunnelOptions("prod", &TunnelOptions{Mirror: &Mirror{TunnelID: "canary"}})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		if tunnelID == "canary" {
+			return net.Dial("tcp", strings.TrimPrefix(shadow.URL, "http://"))
+		}
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/orders", strings.NewReader("order"))
+	w := httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+
+	if body := w.Body.String(); body != "production:order" {
+		t.Errorf("Expected the target's response with the whole body, got %q", body)
+	}
+	select {
+	case got := <-mirrored:
+		if expected := "POST /orders app.example.com order"; got != expected {
+			t.Errorf("Expected mirrored request %q, got %q", expected, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be mirrored")
+	}
+
+	// Requests to the shadow tunnel itself are not mirrored
+	req = httptest.NewRequest(http.MethodGet, "http://canary.example.com/", nil)
+	lb.handleHTTPRequest(httptest.NewRecorder(), req)
+	<-mirrored // The request itself
+	select {
+	case got := <-mirrored:
+		t.Errorf("Expected no mirrored request, got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Without a route to the shadow tunnel, requests are only proxied
+	router.RemoveRoute("canary")
+	req = httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	w = httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 without a shadow route, got %d", w.Code)
+	}
+	select {
+	case got := <-mirrored:
+		t.Errorf("Expected no mirrored request, got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCache(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/lang":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		default:
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		fmt.Fprintf(w, "%s %d %s", r.URL.Path, requests, r.Header.Get("Accept-Language"))
+	}))
+	defer backend.Close()
+
+	for _, dir := range []string{"", t.TempDir()} {
+		name := "memory"
+		if dir != "" {
+			name = "disk"
+		}
+		t.Run(name, func(t *testing.T) {
+			requests = 0
+			config := &Config{Cache: Cache{Enabled: true, Dir: dir}}
+			router := NewRouter(config)
+			router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+			lb := NewLoadBalancer(router, config, stats.NewCollector())
+			if err := lb.cache.open(); err != nil {
+				t.Fatalf("Unexpected error opening cache: %v", err)
+			}
+			lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+				return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+			})
+			get := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, "http://app.example.com"+path, nil)
+				for name, values := range header {
+					req.Header[name] = values
+				}
+				w := httptest.NewRecorder()
+				lb.handleHTTPRequest(w, req)
+				return w
+			}
+
+			tests := []struct {
+				name     string
+				method   string
+				path     string
+				header   http.Header
+				status   int
+				body     string
+				xCache   string
+				requests int
+			}{
+				{name: "Miss", method: http.MethodGet, path: "/app.js", status: http.StatusOK, body: "/app.js 1 ", xCache: "MISS", requests: 1},
+				{name: "Hit", method: http.MethodGet, path: "/app.js", status: http.StatusOK, body: "/app.js 1 ", xCache: "HIT", requests: 1},
+				{name: "HEAD hit", method: http.MethodHead, path: "/app.js", status: http.StatusOK, xCache: "HIT", requests: 1},
+				{name: "Conditional hit", method: http.MethodGet, path: "/app.js", header: http.Header{"If-None-Match": {`"v1"`}}, status: http.StatusNotModified, xCache: "HIT", requests: 1},
+				{name: "Client bypasses the cache", method: http.MethodGet, path: "/app.js", header: http.Header{"Cache-Control": {"no-cache"}}, status: http.StatusOK, body: "/app.js 2 ", xCache: "MISS", requests: 2},
+				{name: "Refreshed", method: http.MethodGet, path: "/app.js", status: http.StatusOK, body: "/app.js 2 ", xCache: "HIT", requests: 2},
+				{name: "Unsafe request invalidates", method: http.MethodPost, path: "/app.js", status: http.StatusOK, body: "/app.js 3 ", requests: 3},
+				{name: "Miss after invalidation", method: http.MethodGet, path: "/app.js", status: http.StatusOK, body: "/app.js 4 ", xCache: "MISS", requests: 4},
+				{name: "Authorized requests are not cached", method: http.MethodGet, path: "/app.js", header: http.Header{"Authorization": {"Bearer x"}}, status: http.StatusOK, body: "/app.js 5 ", requests: 5},
+				{name: "Private responses are not cached", method: http.MethodGet, path: "/private", status: http.StatusOK, body: "/private 6 ", xCache: "MISS", requests: 6},
+				{name: "Private responses miss again", method: http.MethodGet, path: "/private", status: http.StatusOK, body: "/private 7 ", xCache: "MISS", requests: 7},
+				{name: "Variant miss", method: http.MethodGet, path: "/lang", header: http.Header{"Accept-Language": {"de"}}, status: http.StatusOK, body: "/lang 8 de", xCache: "MISS", requests: 8},
+				{name: "Other variant miss", method: http.MethodGet, path: "/lang", header: http.Header{"Accept-Language": {"fr"}}, status: http.StatusOK, body: "/lang 9 fr", xCache: "MISS", requests: 9},
+				{name: "Variant hit", method: http.MethodGet, path: "/lang", header: http.Header{"Accept-Language": {"de"}}, status: http.StatusOK, body: "/lang 8 de", xCache: "HIT", requests: 9},
+			}
+			for _, tt := range tests {
+				w := get(tt.method, tt.path, tt.header)
+				if w.Code != tt.status || w.Body.String() != tt.body || w.Header().Get("X-Cache") != tt.xCache || requests != tt.requests {
+					t.Errorf("%s: expected %d %q (X-Cache %q) after %d requests, got %d %q (X-Cache %q) after %d",
+						tt.name, tt.status, tt.body, tt.xCache, tt.requests, w.Code, w.Body.String(), w.Header().Get("X-Cache"), requests)
+				}
+			}
+
+			stats := lb.CacheStats("tunnel-1")
+			if stats.Entries != 3 || stats.Hits != 5 {
+				t.Errorf("Expected 3 entries and 5 hits, got %+v", stats)
+			}
+			if purged := lb.PurgeCache("tunnel-1"); purged != 3 {
+				t.Errorf("Expected 3 purged entries, got %d", purged)
+			}
+			if w := get(http.MethodGet, "/app.js", nil); w.Header().Get("X-Cache") != "MISS" {
+				t.Errorf("Expected a miss after purging, got %q", w.Header().Get("X-Cache"))
+			}
+			if dir != "" {
+				files, _ := filepath.Glob(filepath.Join(dir, "*"+cacheFileSuffix))
+				if len(files) != 1 {
+					t.Errorf("Expected 1 cache file, got %d", len(files))
+				}
+			}
+		})
+	}
+}
+
+func TestCacheDisabledForTunnel(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	config := &Config{Cache: Cache{Enabled: true}}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	disabled := false
+	lb.SetTunnelOptions("tunnel-1", &TunnelOptions{Cache: &disabled})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+		if got := w.Header().Get("X-Cache"); got != "" {
+			t.Errorf("Expected no X-Cache header, got %q", got)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Expected both requests to reach the target, got %d", requests)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		expected time.Duration
+	}{
+		{name: "max-age", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}}, expected: time.Minute},
+		{name: "s-maxage wins", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, expected: 2 * time.Minute},
+		{name: "Age subtracted", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, expected: 40 * time.Second},
+		{name: "Expires", status: http.StatusOK, header: http.Header{"Date": {now.Format(http.TimeFormat)}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, expected: time.Hour},
+		{name: "No freshness", status: http.StatusOK, header: http.Header{}},
+		{name: "no-store", status: http.StatusOK, header: http.Header{"Cache-Control": {"no-store, max-age=60"}}},
+		{name: "Set-Cookie", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}},
+		{name: "Uncacheable status", status: http.StatusInternalServerError, header: http.Header{"Cache-Control": {"max-age=60"}}},
+	}
+	for _, tt := range tests {
+		ttl, _ := freshness(&http.Response{StatusCode: tt.status, Header: tt.header}, now)
+		if ttl != tt.expected && !(tt.expected == 0 && ttl <= 0) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, ttl)
+		}
+	}
+}
+
+func TestServeStatic(t *testing.T) {
+	config := &Config{}
+	router := NewRouter(config)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	routes := []Route{
+		{Hostname: "example.com", Redirect: &Redirect{URL: "https://www.example.com/", PreservePath: true}},
+		{Hostname: "old.example.com", Redirect: &Redirect{URL: "https://new.example.com/welcome", Status: http.StatusTemporaryRedirect}},
+		{Hostname: "status.example.com", Response: &StaticResponse{ContentType: "application/json", Body: `{"status":"ok"}`}},
+		{Hostname: "status.example.com", Path: &PathMatch{Type: PathMatchPrefix, Value: "/gone"}, Response: &StaticResponse{Status: http.StatusGone, Body: "gone"}},
+	}
+	for _, route := range routes {
+		if err := router.AddStaticRoute(route); err != nil {
+			t.Fatalf("Failed to add static route: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		status      int
+		location    string
+		contentType string
+		body        string
+	}{
+		{name: "Redirect preserving the path", method: http.MethodGet, url: "http://example.com/docs?page=2", status: http.StatusMovedPermanently, location: "https://www.example.com/docs?page=2"},
+		{name: "Fixed redirect", method: http.MethodPost, url: "http://old.example.com/anything", status: http.StatusTemporaryRedirect, location: "https://new.example.com/welcome"},
+		{name: "Response", method: http.MethodGet, url: "http://status.example.com/", status: http.StatusOK, contentType: "application/json", body: `{"status":"ok"}`},
+		{name: "HEAD response", method: http.MethodHead, url: "http://status.example.com/", status: http.StatusOK, contentType: "application/json"},
+		{name: "Path response", method: http.MethodGet, url: "http://status.example.com/gone/page", status: http.StatusGone, contentType: "text/plain; charset=utf-8", body: "gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, httptest.NewRequest(tt.method, tt.url, nil))
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Expected Location %q, got %q", tt.location, got)
+			}
+			if tt.location != "" {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Expected Content-Type %q, got %q", tt.contentType, got)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("Expected body %q, got %q", tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestEdgeAuthBasic(t *testing.T) {
+	var forwarded http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	auth := &EdgeAuth{BasicAuth: map[string]string{"alice": string(hash)}}
+	lb.SetTunnelOptions("tunnel-1", &TunnelOptions{EdgeAuth: auth})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		status   int
+	}{
+		{name: "No credentials", status: http.StatusUnauthorized},
+		{name: "Wrong password", user: "alice", password: "wrong", status: http.StatusUnauthorized},
+		{name: "Unknown user", user: "bob", password: "secret", status: http.StatusUnauthorized},
+		{name: "Valid credentials", user: "alice", password: "secret", status: http.StatusOK},
+		{name: "Remembered credentials", user: "alice", password: "secret", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			req.Header.Set(HeaderForwardedUser, "mallory")
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			lb.handleHTTPRequest(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status == http.StatusUnauthorized {
+				if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+					t.Errorf("Expected a basic auth challenge, got %q", w.Header().Get("WWW-Authenticate"))
+				}
+				if forwarded != nil {
+					t.Error("Expected the request not to reach the target")
+				}
+				return
+			}
+			if got := forwarded.Get(HeaderForwardedUser); got != tt.user {
+				t.Errorf("Expected %s %q, got %q", HeaderForwardedUser, tt.user, got)
+			}
+			if got := forwarded.Get("Authorization"); got != "" {
+				t.Errorf("Expected the credentials to be removed, got %q", got)
+			}
+		})
+	}
+}
+
+func TestEdgeAuthOIDC(t *testing.T) {
+	var nonce string
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer := "https://" + r.Host
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/authorize",
+				"token_endpoint":         issuer + "/token",
+			})
+		case "/token":
+			if client, secret, _ := r.BasicAuth(); client != "app" || secret != "app-secret" || r.FormValue("code") != "code-1" {
+				http.Error(w, "invalid_grant", http.StatusBadRequest)
+				return
+			}
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss":            issuer,
+				"sub":            "user-1",
+				"aud":            "app",
+				"exp":            time.Now().Add(time.Hour).Unix(),
+				"nonce":          nonce,
+				"email":          "alice@example.com",
+				"email_verified": true,
+			})
+			json.NewEncoder(w).Encode(map[string]string{
+				"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".",
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+
+	var forwarded http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	lb.edge.client = idp.Client()
+	auth := &EdgeAuth{OIDC: &OIDCAuth{Issuer: idp.URL, ClientID: "app", ClientSecret: "app-secret", AllowedDomains: []string{"example.com"}}}
+	lb.SetTunnelOptions("tunnel-1", &TunnelOptions{EdgeAuth: auth})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	// Unauthenticated page loads are sent to the provider
+	w := httptest.NewRecorder()
+	lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/docs?page=2", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got status %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), idp.URL+"/authorize?") {
+		t.Fatalf("Expected a redirect to the authorization endpoint, got %q", w.Header().Get("Location"))
+	}
+	query := location.Query()
+	if got := query.Get("redirect_uri"); got != "http://app.example.com"+oidcCallbackPath {
+		t.Errorf("Unexpected redirect URI %q", got)
+	}
+	nonce = query.Get("nonce")
+	state := w.Result().Cookies()[0]
+
+	// Other requests are refused
+	w = httptest.NewRecorder()
+	lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodPost, "http://app.example.com/api", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for an unauthenticated POST, got %d", w.Code)
+	}
+
+	// A callback with a forged state is rejected
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com"+oidcCallbackPath+"?code=code-1&state=forged", nil)
+	req.AddCookie(state)
+	w = httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a forged state, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://app.example.com"+oidcCallbackPath+"?code=code-1&state="+query.Get("state"), nil)
+	req.AddCookie(state)
+	w = httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/docs?page=2" {
+		t.Fatalf("Expected a redirect back to the page, got status %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == edgeSessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatal("Expected a session cookie")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://app.example.com/docs", nil)
+	req.AddCookie(session)
+	req.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	w = httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the signed in request to be proxied, got status %d", w.Code)
+	}
+	if got := forwarded.Get(HeaderForwardedUser); got != "user-1" {
+		t.Errorf("Expected %s user-1, got %q", HeaderForwardedUser, got)
+	}
+	if got := forwarded.Get(HeaderForwardedEmail); got != "alice@example.com" {
+		t.Errorf("Expected %s alice@example.com, got %q", HeaderForwardedEmail, got)
+	}
+	if got := forwarded.Get("Cookie"); got != "app=1" {
+		t.Errorf("Expected only the target's cookies, got %q", got)
+	}
+
+	// Sessions are bound to their tunnel
+	router.AddBackend("tunnel-2", "other.example.com", "tunnel-2.invalid", 8080)
+	lb.SetTunnelOptions("tunnel-2", &TunnelOptions{EdgeAuth: auth})
+	req = httptest.NewRequest(http.MethodGet, "http://other.example.com/", nil)
+	req.AddCookie(session)
+	w = httptest.NewRecorder()
+	lb.handleHTTPRequest(w, req)
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected the session of another tunnel to be ignored, got status %d", w.Code)
+	}
+}
+
+// newTestClientCA returns the PEM certificate of a new CA and a client
+// certificate it signed for commonName
+func newTestClientCA(t *testing.T, commonName string) (string, tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return string(caPEM), tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestOnDemandTLS(t *testing.T) {
+	// The CA is unreachable, so only the cached certificate can be served
+	cacheDir := t.TempDir()
+	config := &Config{TLSConfig: &TLSConfig{OnDemand: &OnDemandTLS{CacheDir: cacheDir, DirectoryURL: "http://127.0.0.1:1/directory"}}}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "app.example.com", "tunnel-1.invalid", 8080)
+	router.AddBackend("tunnel-2", "new.example.com", "tunnel-2.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+
+	// A certificate obtained earlier, as autocert caches it
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "app.example.com"},
+		DNSNames:     []string{"app.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(filepath.Join(cacheDir, "app.example.com"), cached, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := writeTestCertificate(t)
+	certs := &certificateStore{}
+	if err := certs.load(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = lb.serverTLSConfig(certs)
+	server.StartTLS()
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"localhost", "localhost"},             // covered by the configured certificate
+		{"app.example.com", "app.example.com"}, // obtained on demand
+		{"new.example.com", "localhost"},       // routed, but the CA cannot be reached
+		{"other.example.com", "localhost"},     // not routed
+	}
+	for _, tt := range tests {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Handshake for %s failed: %v", tt.serverName, err)
+		}
+		served := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if served != tt.expected {
+			t.Errorf("Expected certificate for %s to be served for %s, got %s", tt.expected, tt.serverName, served)
+		}
+	}
+
+	if !lb.onDemand.failedRecently("new.example.com") {
+		t.Error("Expected the failure to be remembered, so that the CA is not asked on every handshake")
+	}
+	if err := lb.onDemand.hostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("Expected host policy to refuse a hostname that is not routed")
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	var forwarded http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	caPEM, clientCert := newTestClientCA(t, "device-1")
+	_, otherCert := newTestClientCA(t, "device-2")
+
+	config := &Config{}
+	router := NewRouter(config)
+	router.AddBackend("tunnel-1", "secure.example.com", "tunnel-1.invalid", 8080)
+	router.AddBackend("tunnel-1", "open.example.com", "tunnel-1.invalid", 8080)
+	lb := NewLoadBalancer(router, config, stats.NewCollector())
+	auth := &ClientCertAuth{CA: caPEM, Hostnames: []string{"secure.example.com"}}
+	lb.SetTunnelOptions("tunnel-1", &TunnelOptions{ClientCertAuth: auth})
+	lb.SetDialer(func(ctx context.Context, tunnelID, address string) (net.Conn, error) {
+		return net.Dial("tcp", strings.TrimPrefix(backend.URL, "http://"))
+	})
+
+	certFile, keyFile := writeTestCertificate(t)
+	certs := &certificateStore{}
+	if err := certs.load(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(lb.handleHTTPRequest))
+	server.TLS = lb.serverTLSConfig(certs)
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		serverName string
+		host       string
+		cert       *tls.Certificate
+		status     int // zero if the handshake fails
+		subject    string
+	}{
+		{name: "Signed certificate", serverName: "secure.example.com", host: "secure.example.com", cert: &clientCert, status: http.StatusOK, subject: "CN=device-1"},
+		{name: "No certificate", serverName: "secure.example.com", host: "secure.example.com"},
+		{name: "Certificate of another CA", serverName: "secure.example.com", host: "secure.example.com", cert: &otherCert},
+		{name: "Hostname without requirement", serverName: "open.example.com", host: "open.example.com", status: http.StatusOK},
+		{name: "Connection of another hostname", serverName: "open.example.com", host: "secure.example.com", status: http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			tlsConfig := &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}
+			if tt.cert != nil {
+				tlsConfig.Certificates = []tls.Certificate{*tt.cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+			req.Host = tt.host
+			req.Header.Set(HeaderClientCertSubject, "CN=forged")
+			resp, err := client.Do(req)
+			if tt.status == 0 {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("Expected the handshake to fail, got status %d", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := forwarded.Get(HeaderClientCertSubject); got != tt.subject {
+				t.Errorf("Expected %s %q, got %q", HeaderClientCertSubject, tt.subject, got)
+			}
+			if tt.cert != nil && len(forwarded.Get(HeaderClientCertFingerprint)) != 64 {
+				t.Errorf("Expected a SHA-256 fingerprint, got %q", forwarded.Get(HeaderClientCertFingerprint))
+			}
+		})
+	}
+
+	// Plain HTTP requests cannot present a certificate
+	w := httptest.NewRecorder()
+	lb.handleHTTPRequest(w, httptest.NewRequest(http.MethodGet, "http://secure.example.com/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 over plain HTTP, got %d", w.Code)
+	}
+}
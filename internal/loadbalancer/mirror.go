@@ -0,0 +1,150 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxMirrorBody is the largest request body mirrored; requests with larger
+// bodies are only proxied
+const maxMirrorBody = 1 << 20
+
+// maxMirrorRequests bounds the mirrored requests in flight, so that a slow
+// shadow target cannot pile up requests; further copies are dropped
+const maxMirrorRequests = 256
+
+// defaultMirrorTimeout bounds mirrored requests whose shadow tunnel sets
+// no maximum request duration
+const defaultMirrorTimeout = 30 * time.Second
+
+// hopHeaders apply to a single connection and are not copied to mirrored
+// requests
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Mirror sends copies of a tunnel's HTTP requests to a shadow tunnel,
+// discarding its responses, e.g. to try a new version of a service
+// against production traffic
+type Mirror struct {
+	// TunnelID is the shadow tunnel receiving the copies
+	TunnelID string
+
+	// Percent of requests mirrored, 1 to 100; zero mirrors all
+	Percent int
+}
+
+// mirrorRequest sends a copy of a request to the tunnel's shadow tunnel,
+// if it has one, without waiting for it. The body is buffered so both the
+// target and the shadow can read it.
+func (lb *LoadBalancer) mirrorRequest(r *http.Request, tunnelID string, options *TunnelOptions) {
+	mirror := options.Mirror
+	if mirror == nil || mirror.TunnelID == tunnelID {
+		return
+	}
+	if mirror.Percent > 0 && mirror.Percent < 100 && rand.IntN(100) >= mirror.Percent {
+		return
+	}
+	// Upgraded connections cannot be replayed
+	if r.Header.Get("Upgrade") != "" {
+		return
+	}
+	shadow := lb.router.targetOf(mirror.TunnelID)
+	if shadow == nil {
+		return
+	}
+	shadowOptions := lb.optionsOf(shadow.ID)
+	if shadowOptions.Maintenance {
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > maxMirrorBody {
+			return
+		}
+		read, err := io.ReadAll(io.LimitReader(r.Body, maxMirrorBody+1))
+		// Whatever was read still goes to the target
+		r.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(read), r.Body), Closer: r.Body}
+		if err != nil || len(read) > maxMirrorBody {
+			return
+		}
+		body = read
+	}
+
+	select {
+	case lb.mirrors <- struct{}{}:
+	default:
+		lb.logger.Debug().
+			Str("tunnel_id", tunnelID).
+			Str("mirror_tunnel_id", shadow.ID).
+			Msg("Dropped mirrored request, too many in flight")
+		return
+	}
+
+	timeout := lb.timeouts(shadowOptions).MaxRequest
+	if timeout <= 0 {
+		timeout = defaultMirrorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.WithoutCancel(r.Context()), tunnelIDKey{}, shadow.ID), timeout)
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	out.Body = http.NoBody
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+	for _, header := range hopHeaders {
+		out.Header.Del(header)
+	}
+	lb.setTarget(out, shadow, shadowOptions)
+	setForwardedHeaders(out, r)
+	// ReverseProxy appends the client to X-Forwarded-For for proxied
+	// requests; mirrored ones bypass it
+	forwardedFor := clientIP(r.RemoteAddr)
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
+	}
+	out.Header.Set("X-Forwarded-For", forwardedFor)
+	if rules := shadowOptions.HeaderRules; rules != nil {
+		rules.Request.apply(out.Header)
+	}
+
+	go func() {
+		defer func() { <-lb.mirrors }()
+		defer cancel()
+		lb.sendMirror(out, tunnelID, shadow, shadowOptions)
+	}()
+}
+
+// sendMirror sends a mirrored request to the shadow target, discarding
+// the response
+func (lb *LoadBalancer) sendMirror(req *http.Request, tunnelID string, shadow *Target, options *TunnelOptions) {
+	transport := lb.transportFor(shadow.ID, options.BackendTLS)
+	resp, err := roundTripWithTimeout(transport, req, lb.timeouts(options).ResponseHeader)
+	if err != nil {
+		lb.logger.Debug().
+			Err(err).
+			Str("tunnel_id", tunnelID).
+			Str("mirror_tunnel_id", shadow.ID).
+			Msg("Failed to mirror request")
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	lb.stats.Tunnel(shadow.ID).IncRequests()
+}
+
+// replayBody is a request body partly read ahead, still closing the
+// original body
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,159 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryInterval is how long a failed OCSP request waits before it
+	// is tried again
+	ocspRetryInterval = 5 * time.Minute
+
+	// ocspDefaultRefresh is how long a staple without a next update time
+	// is served before it is refreshed
+	ocspDefaultRefresh = time.Hour
+
+	// maxOCSPResponseSize bounds the OCSP responses read
+	maxOCSPResponseSize = 1 << 20
+)
+
+// errNoOCSPResponder is returned for certificates naming no OCSP responder
+var errNoOCSPResponder = errors.New("certificate names no OCSP responder")
+
+// ocspClient requests OCSP responses
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// refreshOCSP staples a new OCSP response to the certificate once the
+// current one is halfway to its next update, reporting whether it did. A
+// failed request keeps the current staple until it expires and is retried
+// later; certificates without an OCSP responder are served unstapled.
+func (s *certificateStore) refreshOCSP(now time.Time) (bool, error) {
+	s.mu.RLock()
+	cert := s.cert
+	due := s.stapling && cert != nil && !now.Before(s.ocspRefresh)
+	s.mu.RUnlock()
+	if !due {
+		return false, nil
+	}
+
+	response, raw, err := fetchOCSP(cert)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert != cert {
+		// Replaced meanwhile; the new certificate is stapled next time
+		return false, nil
+	}
+	if errors.Is(err, errNoOCSPResponder) {
+		s.ocspRefresh = cert.Leaf.NotAfter
+		return false, nil
+	}
+	if err != nil {
+		s.ocspRefresh = now.Add(ocspRetryInterval)
+		if len(cert.OCSPStaple) > 0 && !s.ocspNextUpdate.IsZero() && now.After(s.ocspNextUpdate) {
+			unstapled := *cert
+			unstapled.OCSPStaple = nil
+			s.cert = &unstapled
+		}
+		return false, err
+	}
+
+	// Handshakes may still use the current certificate, so staple a copy
+	stapled := *cert
+	stapled.OCSPStaple = raw
+	s.cert = &stapled
+	s.ocspNextUpdate = response.NextUpdate
+	if response.NextUpdate.IsZero() {
+		s.ocspRefresh = now.Add(ocspDefaultRefresh)
+	} else {
+		s.ocspRefresh = response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+	}
+	return true, nil
+}
+
+// fetchOCSP requests the OCSP response of a certificate from its responder,
+// returning it parsed and raw. The issuer is the second certificate of the
+// chain, so certificate files must contain the chain.
+func fetchOCSP(cert *tls.Certificate) (*ocsp.Response, []byte, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errNoOCSPResponder
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("certificate file lacks the issuer certificate needed for OCSP")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid issuer certificate: %v", err)
+	}
+
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocspClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned status %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read OCSP response: %v", err)
+	}
+
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	switch response.Status {
+	case ocsp.Good:
+		return response, raw, nil
+	case ocsp.Revoked:
+		return nil, nil, errors.New("OCSP responder reports the certificate as revoked")
+	default:
+		return nil, nil, errors.New("OCSP responder does not know the certificate")
+	}
+}
+
+// refreshOCSPStaples refreshes the OCSP staples of the certificates that
+// are due
+func (lb *LoadBalancer) refreshOCSPStaples(now time.Time) {
+	for _, store := range lb.certificateStores() {
+		stapled, err := store.refreshOCSP(now)
+		if !stapled && err == nil {
+			continue
+		}
+		store.mu.RLock()
+		certFile := store.certFile
+		store.mu.RUnlock()
+		if err != nil {
+			lb.logger.Warn().
+				Err(err).
+				Str("cert_file", certFile).
+				Msg("Failed to fetch OCSP response to staple")
+			continue
+		}
+		lb.logger.Debug().
+			Str("cert_file", certFile).
+			Msg("Stapled new OCSP response")
+	}
+}
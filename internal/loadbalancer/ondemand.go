@@ -0,0 +1,153 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// OnDemandTLS configures certificates obtained from an ACME CA while the
+// first client of a hostname shakes hands
+type OnDemandTLS struct {
+	// Email is the contact address of the ACME account, optional
+	Email string
+
+	// CacheDir stores the account key and certificates, so that they
+	// survive restarts and are shared by agents sharing the directory
+	CacheDir string
+
+	// DirectoryURL is the ACME directory of the CA; empty uses Let's
+	// Encrypt
+	DirectoryURL string
+}
+
+// onDemandRetryInterval is how long a hostname whose certificate could not
+// be obtained is served the configured certificate before trying again,
+// so that clients cannot make the agent exhaust the CA's rate limits
+const onDemandRetryInterval = 5 * time.Minute
+
+// onDemandCertificates obtains and renews certificates for routed
+// hostnames the configured certificates do not cover
+type onDemandCertificates struct {
+	manager *autocert.Manager
+	router  *Router
+	logger  *zerolog.Logger
+
+	// failed holds when obtaining the certificate of a hostname failed
+	mu     sync.Mutex
+	failed map[string]time.Time
+}
+
+// newOnDemandCertificates returns the on-demand certificates of config,
+// nil if it does not enable them
+func newOnDemandCertificates(config *TLSConfig, router *Router, logger *zerolog.Logger) *onDemandCertificates {
+	if config == nil || config.OnDemand == nil {
+		return nil
+	}
+	o := &onDemandCertificates{router: router, logger: logger, failed: make(map[string]time.Time)}
+	o.manager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.OnDemand.CacheDir),
+		HostPolicy: o.hostPolicy,
+		Email:      config.OnDemand.Email,
+	}
+	if config.OnDemand.DirectoryURL != "" {
+		o.manager.Client = &acme.Client{DirectoryURL: config.OnDemand.DirectoryURL}
+	}
+	return o
+}
+
+// hostPolicy allows certificates only for hostnames routed to a tunnel by
+// name, so that clients cannot make the agent request certificates for
+// arbitrary names. Names matching only a wildcard route are refused, as
+// anyone could otherwise exhaust the CA's rate limits with made-up
+// subdomains.
+func (o *onDemandCertificates) hostPolicy(_ context.Context, host string) error {
+	if net.ParseIP(host) != nil {
+		return fmt.Errorf("no certificates for IP addresses")
+	}
+	if len(o.router.httpTunnelIDs(normalizeHost(host))) == 0 {
+		return fmt.Errorf("hostname %s is not routed", host)
+	}
+	return nil
+}
+
+// getCertificate returns a GetCertificate function serving the certificate
+// of certs to clients of hostnames it covers, and a certificate obtained on
+// demand to those of other routed hostnames. Clients of unknown hostnames
+// get the certificate of certs, if there is one.
+func (o *onDemandCertificates) getCertificate(certs *certificateStore) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// TLS-ALPN-01 challenges of the CA validating a hostname
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return o.manager.GetCertificate(hello)
+		}
+
+		host := normalizeHost(hello.ServerName)
+		cert, err := certs.getCertificate(hello)
+		if err == nil && (host == "" || covers(cert, host)) {
+			return cert, nil
+		}
+		if host != "" && !o.failedRecently(host) && o.hostPolicy(hello.Context(), host) == nil {
+			onDemand, onDemandErr := o.manager.GetCertificate(hello)
+			if onDemandErr == nil {
+				return onDemand, nil
+			}
+			o.setFailed(host)
+			o.logger.Warn().
+				Err(onDemandErr).
+				Str("host", host).
+				Msg("Failed to obtain on-demand TLS certificate")
+			err = onDemandErr
+		}
+		if cert != nil {
+			return cert, nil
+		}
+		return nil, err
+	}
+}
+
+// failedRecently reports whether obtaining the certificate of host failed
+// within onDemandRetryInterval
+func (o *onDemandCertificates) failedRecently(host string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	failed, exists := o.failed[host]
+	if exists && time.Since(failed) >= onDemandRetryInterval {
+		delete(o.failed, host)
+		return false
+	}
+	return exists
+}
+
+func (o *onDemandCertificates) setFailed(host string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failed[host] = time.Now()
+}
+
+// covers reports whether cert is valid for host
+func covers(cert *tls.Certificate, host string) bool {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return false
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return false
+		}
+		leaf = parsed
+	}
+	return leaf.VerifyHostname(host) == nil
+}
@@ -0,0 +1,175 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultClientHelloTimeout bounds reading the TLS ClientHello of a
+// connection to an HTTPS listener if no read header timeout is configured
+const defaultClientHelloTimeout = 10 * time.Second
+
+// errClientHelloRead stops the handshake once the ClientHello was read
+var errClientHelloRead = errors.New("client hello read")
+
+// acceptResult is a connection, or the error, an sniListener's accept loop
+// hands to the HTTPS server
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// sniListener wraps the listener of an HTTPS server, passing connections
+// whose SNI has a TLS passthrough route through to its tunnel and handing
+// the others to the server. While there are no passthrough routes,
+// connections are handed over without looking at them.
+type sniListener struct {
+	net.Listener
+	lb       *LoadBalancer
+	accepted chan acceptResult
+	done     chan struct{}
+	once     sync.Once
+}
+
+// passthrough wraps the listener of an HTTPS server for TLS passthrough
+func (lb *LoadBalancer) passthrough(listener net.Listener) net.Listener {
+	l := &sniListener{
+		Listener: listener,
+		lb:       lb,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !l.hand(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !l.lb.router.hasTLSRoutes() {
+			if !l.hand(acceptResult{conn: conn}) {
+				conn.Close()
+				return
+			}
+			continue
+		}
+		// Reading the ClientHello may take a while; don't hold up others
+		go l.route(conn)
+	}
+}
+
+// hand passes result to the server, reporting false if the listener was
+// closed instead
+func (l *sniListener) hand(result acceptResult) bool {
+	select {
+	case l.accepted <- result:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// route passes conn through if its SNI has a passthrough route, and hands
+// it to the server otherwise, replaying the ClientHello read
+func (l *sniListener) route(conn net.Conn) {
+	serverName, hello := l.lb.readServerName(conn)
+	conn = &prefixConn{Conn: conn, prefix: hello}
+	if serverName != "" {
+		if target, err := l.lb.router.GetTunnelBySNI(serverName); err == nil {
+			defer conn.Close()
+			l.lb.proxyConnection(conn, target, RouteTLS)
+			return
+		}
+	}
+	if !l.hand(acceptResult{conn: conn}) {
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection for the server
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-l.accepted:
+		return result.conn, result.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections; passed through connections stay open
+func (l *sniListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// readServerName reads the ClientHello of a TLS connection and returns
+// its server name, empty if there is none or the connection does not
+// start with a ClientHello, and the bytes read
+func (lb *LoadBalancer) readServerName(conn net.Conn) (string, []byte) {
+	timeout := lb.router.config.Timeouts.ReadHeader
+	if timeout <= 0 {
+		timeout = defaultClientHelloTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var hello bytes.Buffer
+	var serverName string
+	tls.Server(&helloConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return serverName, hello.Bytes()
+}
+
+// helloConn lets a TLS server read the ClientHello of a connection without
+// writing to it
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Write discards the alert the aborted handshake sends
+func (c *helloConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// prefixConn replays bytes already read from a connection before reading
+// more from it
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection, so passed through
+// connections propagate half-closes like TCP ones
+func (c *prefixConn) CloseWrite() error {
+	return halfClose(c.Conn)
+}
@@ -0,0 +1,210 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"syscall"
+)
+
+// HeaderRequestID carries the correlation ID of a request. Error responses
+// for requests that could not be proxied carry the client's ID or a new
+// one, which is logged with the error.
+const HeaderRequestID = "X-Request-Id"
+
+// HeaderProxyError names the cause of a request that could not be proxied
+// in the error response
+const HeaderProxyError = "X-Proxy-Error"
+
+// maxRequestIDLength bounds the client request IDs reused in responses
+const maxRequestIDLength = 128
+
+// Causes of requests that could not be proxied, telling a broken tunnel
+// from a broken backend
+const (
+	// ProxyErrorUnreachable is the cause of targets that could not be
+	// dialed, such as when the tunnel's client is offline
+	ProxyErrorUnreachable = "unreachable"
+	// ProxyErrorConnectionRefused is the cause of targets whose tunnel is
+	// up but whose backend does not listen on its port
+	ProxyErrorConnectionRefused = "connection_refused"
+	// ProxyErrorDNS is the cause of backend hostnames that do not resolve
+	ProxyErrorDNS = "dns"
+	// ProxyErrorTLS is the cause of failed TLS handshakes with backends
+	// served over TLS, such as for untrusted certificates
+	ProxyErrorTLS = "tls"
+	// ProxyErrorTimeout is the cause of backends that did not answer in
+	// time
+	ProxyErrorTimeout = "timeout"
+	// ProxyErrorBackend is the cause of other failures after the backend
+	// was connected to, such as connections it closed or malformed
+	// responses
+	ProxyErrorBackend = "backend"
+)
+
+// targetProxy is the reverse proxy to a target
+type targetProxy struct {
+	target *Target
+	proxy  *httputil.ReverseProxy
+}
+
+// dialError is returned when a target could not be connected to
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return "failed to connect to target: " + e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// proxyFor returns the reverse proxy to a target, creating it on first
+// use. Targets are compared by value, since every hostname of a tunnel and
+// every rebuild of the routing table has its own Target; a target whose
+// address changed gets a new proxy.
+func (lb *LoadBalancer) proxyFor(target *Target) *httputil.ReverseProxy {
+	lb.proxiesMu.RLock()
+	existing, ok := lb.proxies[target.ID]
+	lb.proxiesMu.RUnlock()
+	if ok && *existing.target == *target {
+		return existing.proxy
+	}
+
+	lb.proxiesMu.Lock()
+	defer lb.proxiesMu.Unlock()
+	if existing, ok := lb.proxies[target.ID]; ok && *existing.target == *target {
+		return existing.proxy
+	}
+	proxy := &httputil.ReverseProxy{
+		// The outgoing request still carries the incoming request's host,
+		// client address and headers
+		Director: func(req *http.Request) {
+			attempt, ok := req.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+			options := lb.optionsOf(target.ID)
+			if ok {
+				options = attempt.options
+			}
+			lb.setTarget(req, target, options)
+			setForwardedHeaders(req, req)
+			if ok {
+				attempt.host, attempt.origin = req.Host, publicOrigin(req)
+				lb.rewriteHost(req, attempt)
+			}
+			if rules := options.HeaderRules; rules != nil {
+				rules.Request.apply(req.Header)
+			}
+		},
+		Transport:      retryTransport{lb: lb},
+		ModifyResponse: lb.modifyResponse,
+		ErrorHandler:   lb.proxyError,
+		FlushInterval:  lb.router.config.FlushInterval,
+	}
+	lb.proxies[target.ID] = &targetProxy{target: target, proxy: proxy}
+	return proxy
+}
+
+// forgetProxy drops the reverse proxy to a removed target
+func (lb *LoadBalancer) forgetProxy(tunnelID string) {
+	lb.proxiesMu.Lock()
+	defer lb.proxiesMu.Unlock()
+	delete(lb.proxies, tunnelID)
+}
+
+// proxyError answers requests that could not be proxied: 502 Bad Gateway
+// if the target could not be reached or answered badly, 504 Gateway
+// Timeout if it did not answer in time and 413 Request Entity Too Large if
+// the request body exceeded the limit. Failures of the tunnel or backend
+// are counted by cause, which the response names next to a request ID the
+// error is logged with.
+func (lb *LoadBalancer) proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	page := PageBadGateway
+	cause := proxyErrorCause(err)
+	if isBodyTooLarge(err) {
+		page, cause = PageTooLarge, ""
+	} else if errors.Is(err, context.Canceled) && req.Context().Err() != nil {
+		// The client went away, so there is nobody to answer
+		cause = ""
+	} else if cause == ProxyErrorTimeout {
+		page = PageGatewayTimeout
+	}
+
+	var tunnelID string
+	if attempt, ok := req.Context().Value(proxyAttemptKey{}).(*proxyAttempt); ok {
+		tunnelID = attempt.target.ID
+	}
+	if cause != "" && tunnelID != "" {
+		lb.stats.Tunnel(tunnelID).IncProxyError(cause)
+	}
+
+	requestID := requestIDOf(req)
+	w.Header().Set(HeaderRequestID, requestID)
+	if cause != "" {
+		w.Header().Set(HeaderProxyError, cause)
+	}
+	lb.logger.Error().
+		Err(err).
+		Str("host", req.Host).
+		Str("tunnel_id", tunnelID).
+		Str("cause", cause).
+		Str("request_id", requestID).
+		Int("status", errorPages[page]).
+		Msg("Failed to proxy request")
+	lb.serveErrorPageData(w, req, tunnelID, page, ErrorPageData{RequestID: requestID, Cause: cause})
+}
+
+// proxyErrorCause tells why a request could not be proxied
+func proxyErrorCause(err error) string {
+	var dnsErr *net.DNSError
+	var dialErr *dialError
+	switch {
+	case errors.As(err, &dnsErr):
+		return ProxyErrorDNS
+	case isTLSError(err):
+		return ProxyErrorTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ProxyErrorConnectionRefused
+	case errors.As(err, &dialErr):
+		return ProxyErrorUnreachable
+	case isTimeout(err):
+		return ProxyErrorTimeout
+	}
+	return ProxyErrorBackend
+}
+
+// isTLSError reports whether err is a failed TLS handshake with a backend
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// requestIDOf returns the request ID the client sent, or a new one if it
+// sent none or one unfit for a header
+func requestIDOf(req *http.Request) string {
+	if id := req.Header.Get(HeaderRequestID); id != "" && len(id) <= maxRequestIDLength && printable(id) {
+		return id
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// printable reports whether s only holds printable ASCII
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
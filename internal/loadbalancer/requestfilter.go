@@ -0,0 +1,154 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// MaxFilterRules bounds the request filter rules of a tunnel
+const MaxFilterRules = 100
+
+// maxFilterPatterns bounds the compiled patterns kept for requests
+const maxFilterPatterns = 1024
+
+// filterRuleName is the form of rule names, which label metrics
+var filterRuleName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// FilterRule blocks the requests of a tunnel that match all of its set
+// conditions, such as scanners probing for well-known paths, before they
+// reach the tunnel
+type FilterRule struct {
+	// Name identifies the rule in logs and counters
+	Name string
+
+	// Methods, if set, match requests with one of these methods
+	Methods []string
+
+	// Path and UserAgent, if set, are regular expressions matching the
+	// request path and User-Agent header
+	Path      string
+	UserAgent string
+
+	// Headers map header names to regular expressions matching one of
+	// the header's values; the header must be present, with any value if
+	// the expression is empty
+	Headers map[string]string
+}
+
+// ValidateFilterRules checks that rules have unique names and at least one
+// valid condition each
+func ValidateFilterRules(rules []FilterRule) error {
+	if len(rules) > MaxFilterRules {
+		return fmt.Errorf("too many request filter rules: %d (at most %d)", len(rules), MaxFilterRules)
+	}
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if !filterRuleName.MatchString(rule.Name) {
+			return fmt.Errorf("invalid request filter rule name %q", rule.Name)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate request filter rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("request filter rule %s: %v", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r FilterRule) validate() error {
+	if len(r.Methods) == 0 && r.Path == "" && r.UserAgent == "" && len(r.Headers) == 0 {
+		return errors.New("no conditions")
+	}
+	for _, method := range r.Methods {
+		if !validHeaderName(method) {
+			return fmt.Errorf("invalid method %q", method)
+		}
+	}
+	for _, pattern := range []string{r.Path, r.UserAgent} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	for name, pattern := range r.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q for header %s: %v", pattern, name, err)
+		}
+	}
+	return nil
+}
+
+// filterPatterns holds compiled filter patterns, so that requests do not
+// compile them again
+type filterPatterns struct {
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// get returns the compiled pattern, nil if it is invalid
+func (c *filterPatterns) get(pattern string) *regexp.Regexp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if re, ok := c.patterns[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	if c.patterns == nil || len(c.patterns) >= maxFilterPatterns {
+		c.patterns = make(map[string]*regexp.Regexp)
+	}
+	c.patterns[pattern] = re
+	return re
+}
+
+// matches reports whether a pattern matches s; invalid patterns, which
+// are rejected when rules are set, match nothing
+func (c *filterPatterns) matches(pattern, s string) bool {
+	re := c.get(pattern)
+	return re != nil && re.MatchString(s)
+}
+
+// filterRequest returns the name of the first of a tunnel's filter rules
+// matching a request, "" if the request may pass
+func (lb *LoadBalancer) filterRequest(options *TunnelOptions, r *http.Request) string {
+	for _, rule := range options.RequestFilters {
+		if lb.filterMatches(rule, r) {
+			return rule.Name
+		}
+	}
+	return ""
+}
+
+func (lb *LoadBalancer) filterMatches(rule FilterRule, r *http.Request) bool {
+	if len(rule.Methods) > 0 && !slices.ContainsFunc(rule.Methods, func(m string) bool {
+		return strings.EqualFold(m, r.Method)
+	}) {
+		return false
+	}
+	if rule.Path != "" && !lb.filters.matches(rule.Path, r.URL.Path) {
+		return false
+	}
+	if rule.UserAgent != "" && !lb.filters.matches(rule.UserAgent, r.UserAgent()) {
+		return false
+	}
+	for name, pattern := range rule.Headers {
+		if !slices.ContainsFunc(r.Header.Values(name), func(v string) bool {
+			return lb.filters.matches(pattern, v)
+		}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy retries proxied requests whose target could not be reached
+type RetryPolicy struct {
+	// Attempts is how many times a request is retried (zero disables
+	// retries)
+	Attempts int
+
+	// Backoff is the delay before retrying a target that already failed,
+	// doubled with every retry; other targets are tried without delay
+	Backoff time.Duration
+}
+
+// Validate checks that the policy is usable
+func (p RetryPolicy) Validate() error {
+	if p.Attempts < 0 {
+		return fmt.Errorf("invalid retry attempts: %d", p.Attempts)
+	}
+	if p.Backoff < 0 {
+		return fmt.Errorf("invalid retry backoff: %v", p.Backoff)
+	}
+	return nil
+}
+
+// retryPolicy returns the retry policy in effect for a tunnel with options
+func (lb *LoadBalancer) retryPolicy(options *TunnelOptions) RetryPolicy {
+	policy := lb.router.config.Retry
+	if attempts := options.RetryAttempts; attempts != nil {
+		policy.Attempts = *attempts
+	}
+	return policy
+}
+
+// proxyAttempt tracks the target of a proxied request and the options of
+// its tunnel across retries
+type proxyAttempt struct {
+	target    *Target
+	options   *TunnelOptions
+	fallbacks []*Target
+	retries   int
+
+	// host is the Host header of the request as the client sent it, and
+	// origin its Origin header if it is the public origin, which each
+	// target's HostRewrite starts from
+	host, origin string
+}
+
+// proxyAttemptKey is the request context key of a request's proxyAttempt
+type proxyAttemptKey struct{}
+
+// retryTransport proxies requests with the load balancer's transport,
+// retrying those that failed to reach their target
+type retryTransport struct {
+	lb *LoadBalancer
+}
+
+// RoundTrip sends a request, retrying it on another target of its
+// hostname, or the same target after a backoff, if it could not be
+// delivered and can safely be sent again
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempt, _ := req.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	if attempt == nil {
+		tunnelID, _ := req.Context().Value(tunnelIDKey{}).(string)
+		options := t.lb.optionsOf(tunnelID)
+		return roundTripWithTimeout(t.lb.transportFor(tunnelID, options.BackendTLS), req, t.lb.timeouts(options).ResponseHeader)
+	}
+	resp, err := t.send(req, attempt.target, attempt.options)
+
+	policy := t.lb.retryPolicy(attempt.options)
+	backoff := policy.Backoff
+	for err != nil && attempt.retries < policy.Attempts && retryable(req) {
+		failed := attempt.target
+		if next, rest := t.lb.breakers.pick(attempt.fallbacks); next != nil {
+			attempt.target, attempt.fallbacks = next, rest
+			attempt.options = t.lb.optionsOf(next.ID)
+		} else {
+			// The same target is only retried while its circuit is closed
+			attempt.fallbacks = nil
+			if !t.lb.breakers.allow(failed.ID) {
+				break
+			}
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+			backoff *= 2
+		}
+
+		attempt.retries++
+		t.lb.stats.Tunnel(failed.ID).IncRetries()
+		t.lb.logger.Debug().
+			Err(err).
+			Str("tunnel_id", failed.ID).
+			Str("retry_tunnel_id", attempt.target.ID).
+			Int("retry", attempt.retries).
+			Msg("Retrying request after connection error")
+
+		ctx := context.WithValue(req.Context(), tunnelIDKey{}, attempt.target.ID)
+		req = req.Clone(ctx)
+		t.lb.setTarget(req, attempt.target, attempt.options)
+		t.lb.rewriteHost(req, attempt)
+		resp, err = t.send(req, attempt.target, attempt.options)
+	}
+	return resp, err
+}
+
+// send sends a request to target, whose tunnel has options, within its
+// response header timeout, recording the outcome in its circuit unless the
+// client was at fault
+func (t retryTransport) send(req *http.Request, target *Target, options *TunnelOptions) (*http.Response, error) {
+	transport := t.lb.transportFor(target.ID, options.BackendTLS)
+	resp, err := roundTripWithTimeout(transport, req, t.lb.timeouts(options).ResponseHeader)
+	if err == nil {
+		t.lb.breakers.success(target.ID)
+	} else if req.Context().Err() == nil && !isBodyTooLarge(err) {
+		t.lb.breakers.failure(target.ID)
+	}
+	return resp, err
+}
+
+// retryable reports whether a failed request can be sent again: it must
+// be idempotent, have no body that was already consumed, and its client
+// must still be waiting
+func retryable(req *http.Request) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
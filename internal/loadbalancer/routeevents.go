@@ -0,0 +1,132 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+// RouteEventType is the kind of change a route event reports
+type RouteEventType string
+
+const (
+	// RouteAdded reports a new route
+	RouteAdded RouteEventType = "added"
+	// RouteUpdated reports a route whose target IP or port, priority, or
+	// redirect or response changed
+	RouteUpdated RouteEventType = "updated"
+	// RouteRemoved reports a route that no longer exists
+	RouteRemoved RouteEventType = "removed"
+)
+
+// RouteEvent is a change of the routing table. Route is the route as it is
+// after the change, or as it was before it for removed routes.
+type RouteEvent struct {
+	Type  RouteEventType
+	Route Route
+}
+
+// routeKey identifies a route regardless of its target
+type routeKey struct {
+	tunnelID   string
+	protocol   string
+	hostname   string
+	path       PathMatch
+	listenPort int
+}
+
+func keyOf(route Route) routeKey {
+	key := routeKey{tunnelID: route.TunnelID, protocol: route.Protocol, hostname: route.Hostname, listenPort: route.ListenPort}
+	if route.Path != nil {
+		key.path = *route.Path
+	}
+	return key
+}
+
+// Subscribe calls fn with every change of the routing table, in the order
+// they are made, and returns the func cancelling the subscription. Changes
+// made together, e.g. by ReplaceRoutes, are reported one route at a time.
+// fn runs after the change is visible to requests and must not change the
+// routes or subscribe itself.
+func (r *Router) Subscribe(fn func(RouteEvent)) func() {
+	r.notifyMu.Lock()
+	defer r.notifyMu.Unlock()
+
+	if r.subscribers == nil {
+		r.subscribers = make(map[int]func(RouteEvent))
+	}
+	id := r.nextSubscriber
+	r.nextSubscriber++
+	r.subscribers[id] = fn
+
+	return func() {
+		r.notifyMu.Lock()
+		defer r.notifyMu.Unlock()
+		delete(r.subscribers, id)
+	}
+}
+
+// update applies a change to a copy of the routing tables under the
+// router's lock and swaps it in, then saves the table and notifies
+// subscribers if any route changed. Nothing changes if change fails,
+// including which tunnels count as restored.
+func (r *Router) update(change func(t *routeTables) error) error {
+	r.mu.Lock()
+	current := r.tables.Load()
+	next := current.clone()
+	r.registered = r.registered[:0]
+	if err := change(next); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	before := current.snapshot()
+	after := next.snapshot()
+	events := diffRoutes(before, after)
+	next.fallback = r.resolveDefault(after)
+	r.tables.Store(next)
+	for _, id := range r.registered {
+		delete(r.restored, id)
+	}
+
+	// Take notifyMu before unlocking so that concurrent changes are
+	// reported in the order they were made
+	r.notifyMu.Lock()
+	r.mu.Unlock()
+	for _, event := range events {
+		for _, fn := range r.subscribers {
+			fn(event)
+		}
+	}
+	r.notifyMu.Unlock()
+
+	if len(events) > 0 {
+		r.persist()
+	}
+	return nil
+}
+
+// diffRoutes returns the events turning the routes before into the routes
+// after: removals and updates in the order of before, then additions in
+// the order of after
+func diffRoutes(before, after []Route) []RouteEvent {
+	previous := make(map[routeKey]Route, len(before))
+	for _, route := range before {
+		previous[keyOf(route)] = route
+	}
+	current := make(map[routeKey]Route, len(after))
+	for _, route := range after {
+		current[keyOf(route)] = route
+	}
+
+	var events []RouteEvent
+	for _, route := range before {
+		now, exists := current[keyOf(route)]
+		switch {
+		case !exists:
+			events = append(events, RouteEvent{Type: RouteRemoved, Route: route})
+		case now.IP != route.IP || now.Port != route.Port || now.Priority != route.Priority || now.Redirect != route.Redirect || now.Response != route.Response:
+			events = append(events, RouteEvent{Type: RouteUpdated, Route: now})
+		}
+	}
+	for _, route := range after {
+		if _, existed := previous[keyOf(route)]; !existed {
+			events = append(events, RouteEvent{Type: RouteAdded, Route: route})
+		}
+	}
+	return events
+}
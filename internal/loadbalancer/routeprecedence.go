@@ -0,0 +1,201 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+)
+
+// RouteOutcome says which of two routes matching the same requests gets
+// them
+type RouteOutcome string
+
+const (
+	// RouteExistingWins means the route in the routing table keeps the
+	// requests both routes match
+	RouteExistingWins RouteOutcome = "existing"
+	// RouteNewWins means the checked route takes them over
+	RouteNewWins RouteOutcome = "new"
+	// RouteShared means both are tunnels of the same hostname, which
+	// share its requests
+	RouteShared RouteOutcome = "shared"
+	// RouteConflict means neither takes precedence, so the checked route
+	// cannot be added
+	RouteConflict RouteOutcome = "conflict"
+)
+
+// RouteOverlap is a route of the routing table that matches some of the
+// requests a checked route matches
+type RouteOverlap struct {
+	Route   Route
+	Outcome RouteOutcome
+}
+
+// RouteCheck is the result of checking a route against the routing table
+type RouteCheck struct {
+	// Err is why the route cannot be added, nil if it can
+	Err error
+
+	// Overlaps are the routes of other tunnels, and static routes, that
+	// match some of the same requests, in routing table order
+	Overlaps []RouteOverlap
+}
+
+// CheckRoute reports whether route could be added to the routing table,
+// and which routes it would overlap, without changing anything. Routes of
+// tunnels are checked as an addition to the tunnel's routes, static routes
+// as replacing the static route of the same hostname and path.
+func (r *Router) CheckRoute(route Route) RouteCheck {
+	routes := r.Snapshot()
+
+	var err error
+	if route.Protocol == RouteTLS {
+		route.Hostname, err = NormalizeHostname(route.Hostname)
+	} else if route.Hostname != "" {
+		route.Hostname, err = normalizeRouteHostname(route.Hostname)
+	}
+	if err != nil {
+		return RouteCheck{Err: err}
+	}
+	if route.isStatic() {
+		routes = withoutStaticRoute(routes, route.Hostname, route.Path)
+	}
+
+	var check RouteCheck
+	if _, err := buildRouteTables(append(slices.Clip(routes), route)); err != nil {
+		check.Err = err
+	}
+	for _, existing := range routes {
+		if outcome, ok := overlap(route, existing); ok {
+			check.Overlaps = append(check.Overlaps, RouteOverlap{Route: existing, Outcome: outcome})
+		}
+	}
+	return check
+}
+
+// overlap reports whether two routes of different tunnels match some of
+// the same requests, and which of them gets those
+func overlap(route, existing Route) (RouteOutcome, bool) {
+	if route.TunnelID != "" && route.TunnelID == existing.TunnelID {
+		return "", false
+	}
+	switch {
+	case route.Protocol != existing.Protocol:
+		return "", false
+	case route.ListenPort > 0 || existing.ListenPort > 0:
+		return RouteConflict, route.ListenPort == existing.ListenPort
+	case route.Protocol == RouteTLS:
+		return RouteConflict, route.Hostname == existing.Hostname
+	case !hostsOverlap(route.Hostname, existing.Hostname) || !pathsOverlap(route.Path, existing.Path):
+		return "", false
+	}
+
+	order := cmp.Compare(hostPrecedence(existing.Hostname), hostPrecedence(route.Hostname))
+	if order == 0 {
+		switch {
+		case route.Path != nil && existing.Path != nil:
+			order = comparePaths(*route.Path, route.Priority, *existing.Path, existing.Priority)
+		case route.Path != nil:
+			order = -1
+		case existing.Path != nil:
+			order = 1
+		case !route.isStatic() && !existing.isStatic():
+			return RouteShared, true
+		}
+	}
+	switch {
+	case order < 0:
+		return RouteNewWins, true
+	case order > 0:
+		return RouteExistingWins, true
+	}
+	return RouteConflict, true
+}
+
+// hostPrecedence ranks the hostnames of routes matching the same requests:
+// hostnames first, then longer wildcards, then "*"
+func hostPrecedence(hostname string) int {
+	if !strings.HasPrefix(hostname, "*") {
+		return math.MaxInt
+	}
+	return len(hostname)
+}
+
+// hostsOverlap reports whether two route hostnames, either of which may be
+// a wildcard, match some of the same hostnames
+func hostsOverlap(a, b string) bool {
+	return a == b || hostMatches(a, b) || hostMatches(b, a)
+}
+
+// hostMatches reports whether the wildcard pattern matches every hostname
+// hostname matches, itself a wildcard or not
+func hostMatches(pattern, hostname string) bool {
+	if pattern == "*" {
+		return true
+	}
+	suffix, wildcard := strings.CutPrefix(pattern, "*")
+	return wildcard && strings.HasSuffix(strings.TrimPrefix(hostname, "*"), suffix)
+}
+
+// pathsOverlap reports whether two path matches, nil for a hostname route
+// matching all paths, match some of the same paths
+func pathsOverlap(a, b *PathMatch) bool {
+	switch {
+	case a == nil || b == nil:
+		return true
+	case a.Type == PathMatchExact && b.Type == PathMatchExact:
+		return a.Value == b.Value
+	case a.Type == PathMatchExact:
+		return b.matches(a.Value)
+	case b.Type == PathMatchExact:
+		return a.matches(b.Value)
+	}
+	return a.matches(b.Value) || b.matches(a.Value)
+}
+
+// comparePaths orders path routes of a hostname by precedence: exact
+// matches first, then longer values, then higher priorities. It returns a
+// negative number if the route matching a with priority aPriority comes
+// first.
+func comparePaths(a PathMatch, aPriority int, b PathMatch, bPriority int) int {
+	if (a.Type == PathMatchExact) != (b.Type == PathMatchExact) {
+		if a.Type == PathMatchExact {
+			return -1
+		}
+		return 1
+	}
+	if order := cmp.Compare(len(b.Value), len(a.Value)); order != 0 {
+		return order
+	}
+	return cmp.Compare(bPriority, aPriority)
+}
+
+// lookup returns the route of a request to host and path: the target of
+// its first matching path route or else its hostname route, trying the
+// routes of host, then those of the wildcards of its domains from the
+// longest, then those of "*". Both are nil if no route matches.
+func (t *routeTables) lookup(host, path string) (*Target, *hostRoute) {
+	name, domain := host, host
+	for {
+		for _, route := range t.pathMap[name] {
+			if route.match.matches(path) {
+				return route.target, nil
+			}
+		}
+		if route, exists := t.hostMap[name]; exists {
+			return nil, route
+		}
+
+		switch dot := strings.IndexByte(domain, '.'); {
+		case name == "*":
+			return nil, nil
+		case dot < 0:
+			name = "*"
+		default:
+			domain = domain[dot+1:]
+			name = "*." + domain
+		}
+	}
+}
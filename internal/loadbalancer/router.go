@@ -2,39 +2,144 @@
 package loadbalancer
 
 import (
-	"fmt"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
 )
 
-// Router manages the routing table for tunnels
+// Router manages the routing table for tunnels. Lookups read the current
+// routeTables without locking; changes are serialized by mu, build new
+// tables from a copy of the current ones and swap them in, so the tables
+// requests see are never modified.
 type Router struct {
-	mu            sync.RWMutex
-	hostMap       map[string]*Target
-	portMap       map[int]*Target
+	mu            sync.Mutex
+	tables        atomic.Pointer[routeTables]
 	config        *Config
+	logger        *zerolog.Logger
+
+	// restored holds the IDs of tunnels whose routes were loaded from the
+	// routes file and not registered again since
+	restored map[string]bool
+	// registered holds the IDs of tunnels the change in progress registers
+	// or removes; they leave restored once the change is stored
+	registered []string
+
+	// onRemove is called with the ID of every removed tunnel
+	onRemove func(tunnelID string)
+
+	// routesFile, if set, is where the routing table is saved after every
+	// change; saveMu serializes the saves
+	saveMu     sync.Mutex
+	routesFile string
+	// saveErr is the error of the last save, nil once one succeeds, and
+	// savedAt is when a save last succeeded
+	saveErr error
+	savedAt time.Time
+
+	// subscribers are notified of route changes in order, under notifyMu
+	notifyMu       sync.Mutex
+	subscribers    map[int]func(RouteEvent)
+	nextSubscriber int
+}
+
+// PathMatchType selects how a path route matches request paths
+type PathMatchType string
+
+const (
+	// PathMatchPrefix matches paths equal to the value or below it, e.g.
+	// "/api" matches "/api" and "/api/v1" but not "/apis"
+	PathMatchPrefix PathMatchType = "PathPrefix"
+	// PathMatchExact matches only paths equal to the value
+	PathMatchExact PathMatchType = "Exact"
+)
+
+// PathMatch describes the request paths a route applies to
+type PathMatch struct {
+	Type  PathMatchType `json:"type"`
+	Value string        `json:"value"`
+}
+
+// pathRoute is a route for a hostname restricted to matching paths.
+// Priority orders it among the routes of its hostname matching the same
+// requests, higher first.
+type pathRoute struct {
+	match    PathMatch
+	priority int
+	target   *Target
+}
+
+// hostRoute is the route of a hostname to one or more targets. Its
+// targets are not modified once the route is published; changes replace
+// the route.
+type hostRoute struct {
+	targets []*Target
+	next    atomic.Uint64
+}
+
+// withTargets returns a route to targets that continues the round robin of
+// h, which may be nil
+func (h *hostRoute) withTargets(targets []*Target) *hostRoute {
+	route := &hostRoute{targets: targets}
+	if h != nil {
+		route.next.Store(h.next.Load())
+	}
+	return route
 }
 
-// Target represents a tunnel endpoint
+// roundRobin returns the next of the route's targets
+func (h *hostRoute) roundRobin() *Target {
+	return h.targets[(h.next.Add(1)-1)%uint64(len(h.targets))]
+}
+
+// Target represents a tunnel endpoint. Targets returned by the lookups on
+// the request path are shared with the routing table and must not be
+// modified; the other getters return copies.
 type Target struct {
 	ID   string
 	IP   string
 	Port int
+
+	// redirect or response answer requests to static routes, which have no
+	// tunnel
+	redirect *Redirect
+	response *StaticResponse
+}
+
+// isStatic reports whether the target is a static route's
+func (t *Target) isStatic() bool {
+	return t.redirect != nil || t.response != nil
 }
 
 // NewRouter creates a new router instance
 func NewRouter(config *Config) *Router {
-	return &Router{
-		hostMap: make(map[string]*Target),
-		portMap: make(map[int]*Target),
+	r := &Router{
 		config:  config,
+		logger:  utils.GetModuleLogger(utils.ModuleLoadBalancer),
 	}
+	r.tables.Store(newRouteTables())
+	return r
 }
 
 // AddRoute adds a new route to the routing table
 func (r *Router) AddRoute(tunnelID string, hostname string, ip string, port int) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	hostname, err := NormalizeHostname(hostname)
+	if err != nil {
+		return err
+	}
+
+	return r.update(func(t *routeTables) error {
+		return r.addRoute(t, tunnelID, hostname, ip, port)
+	})
+}
 
+func (r *Router) addRoute(t *routeTables, tunnelID string, hostname string, ip string, port int) error {
+	r.registered = append(r.registered, tunnelID)
 	target := &Target{
 		ID:   tunnelID,
 		IP:   ip,
@@ -42,19 +147,27 @@ func (r *Router) AddRoute(tunnelID string, hostname string, ip string, port int)
 	}
 
 	// Check if hostname is already in use
-	if _, exists := r.hostMap[hostname]; exists {
-		return fmt.Errorf("hostname %s is already in use", hostname)
+	if _, exists := t.hostMap[hostname]; exists {
+		return conflictf("hostname %s is already in use", hostname)
+	}
+	if _, exists := t.sniMap[hostname]; exists {
+		return conflictf("hostname %s is already in use", hostname)
+	}
+
+	// Check the port before changing anything, so a conflict leaves no
+	// half added route behind
+	if port > 0 {
+		if _, exists := t.portMap[port]; exists {
+			return conflictf("port %d is already in use", port)
+		}
 	}
 
 	// Add to host map
-	r.hostMap[hostname] = target
+	t.hostMap[hostname] = &hostRoute{targets: []*Target{target}}
 
 	// Optionally add to port map if port-based routing is needed
 	if port > 0 {
-		if _, exists := r.portMap[port]; exists {
-			return fmt.Errorf("port %d is already in use", port)
-		}
-		r.portMap[port] = target
+		t.portMap[port] = target
 	}
 
 	return nil
@@ -62,58 +175,433 @@ func (r *Router) AddRoute(tunnelID string, hostname string, ip string, port int)
 
 // RemoveRoute removes a route from the routing table
 func (r *Router) RemoveRoute(tunnelID string) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r.update(func(t *routeTables) error {
+		r.removeRoute(t, tunnelID)
+		return nil
+	})
+	if r.onRemove != nil {
+		r.onRemove(tunnelID)
+	}
+}
+
+func (r *Router) removeRoute(t *routeTables, tunnelID string) {
+	r.registered = append(r.registered, tunnelID)
 
 	// Remove from host map
-	for hostname, target := range r.hostMap {
-		if target.ID == tunnelID {
-			delete(r.hostMap, hostname)
+	for hostname, route := range t.hostMap {
+		kept := make([]*Target, 0, len(route.targets))
+		for _, target := range route.targets {
+			if target.ID != tunnelID {
+				kept = append(kept, target)
+			}
+		}
+		switch {
+		case len(kept) == 0:
+			delete(t.hostMap, hostname)
+		case len(kept) < len(route.targets):
+			t.hostMap[hostname] = route.withTargets(kept)
 		}
 	}
 
 	// Remove from port map
-	for port, target := range r.portMap {
+	for port, target := range t.portMap {
+		if target.ID == tunnelID {
+			delete(t.portMap, port)
+		}
+	}
+
+	// Remove from path map
+	for hostname, routes := range t.pathMap {
+		kept := make([]*pathRoute, 0, len(routes))
+		for _, route := range routes {
+			if route.target.ID != tunnelID {
+				kept = append(kept, route)
+			}
+		}
+		switch {
+		case len(kept) == 0:
+			delete(t.pathMap, hostname)
+		case len(kept) < len(routes):
+			t.pathMap[hostname] = kept
+		}
+	}
+
+	// Remove from the TLS passthrough and UDP maps
+	for hostname, target := range t.sniMap {
 		if target.ID == tunnelID {
-			delete(r.portMap, port)
+			delete(t.sniMap, hostname)
+		}
+	}
+	for port, target := range t.udpMap {
+		if target.ID == tunnelID {
+			delete(t.udpMap, port)
 		}
 	}
 }
 
-// GetTunnelByHost returns the target for a given hostname
-func (r *Router) GetTunnelByHost(hostname string) (*Target, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// AddBackend adds a tunnel to the targets of hostname, creating its route
+// if needed. Requests to a hostname with several targets are spread over
+// them according to the configured session affinity.
+func (r *Router) AddBackend(tunnelID string, hostname string, ip string, port int) error {
+	hostname, err := NormalizeHostname(hostname)
+	if err != nil {
+		return err
+	}
+
+	return r.update(func(t *routeTables) error {
+		return r.addBackend(t, tunnelID, hostname, ip, port)
+	})
+}
+
+func (r *Router) addBackend(t *routeTables, tunnelID string, hostname string, ip string, port int) error {
+	r.registered = append(r.registered, tunnelID)
+	if _, exists := t.sniMap[hostname]; exists {
+		return conflictf("hostname %s is already in use", hostname)
+	}
+	route := t.hostMap[hostname]
+	var targets []*Target
+	if route != nil {
+		for _, target := range route.targets {
+			if target.isStatic() {
+				return conflictf("hostname %s is already in use", hostname)
+			}
+			if target.ID == tunnelID {
+				return conflictf("tunnel %s is already a target of hostname %s", tunnelID, hostname)
+			}
+		}
+		targets = slices.Clip(route.targets)
+	}
 
-	target, exists := r.hostMap[hostname]
+	t.hostMap[hostname] = route.withTargets(append(targets, &Target{
+		ID:   tunnelID,
+		IP:   ip,
+		Port: port,
+	}))
+
+	return nil
+}
+
+// AddPathRoute adds a route for requests to hostname whose path matches.
+// Path routes take precedence over a plain hostname route for the same
+// hostname; among path routes exact matches win, then the longest prefix.
+func (r *Router) AddPathRoute(tunnelID string, hostname string, match PathMatch, ip string, port int) error {
+	if err := match.validate(); err != nil {
+		return err
+	}
+	hostname, err := NormalizeHostname(hostname)
+	if err != nil {
+		return err
+	}
+
+	return r.update(func(t *routeTables) error {
+		return r.addPathRoute(t, tunnelID, hostname, match, ip, port)
+	})
+}
+
+func (r *Router) addPathRoute(t *routeTables, tunnelID string, hostname string, match PathMatch, ip string, port int) error {
+	r.registered = append(r.registered, tunnelID)
+	if _, exists := t.sniMap[hostname]; exists {
+		return conflictf("hostname %s is already in use", hostname)
+	}
+	for _, route := range t.pathMap[hostname] {
+		if route.match == match && route.priority == 0 && route.target.ID != tunnelID {
+			return conflictf("path %s on hostname %s is already in use", match.Value, hostname)
+		}
+	}
+
+	routes := append(slices.Clone(t.pathMap[hostname]), &pathRoute{
+		match: match,
+		target: &Target{
+			ID:   tunnelID,
+			IP:   ip,
+			Port: port,
+		},
+	})
+	sortPathRoutes(routes)
+	t.pathMap[hostname] = routes
+
+	return nil
+}
+
+// sortPathRoutes orders path routes by precedence: exact matches first,
+// then longer values first, then higher priorities first
+func sortPathRoutes(routes []*pathRoute) {
+	slices.SortStableFunc(routes, func(a, b *pathRoute) int {
+		return comparePaths(a.match, a.priority, b.match, b.priority)
+	})
+}
+
+// AddTCPRoute routes TCP connections accepted on listenPort to a tunnel
+func (r *Router) AddTCPRoute(tunnelID string, listenPort int, ip string, port int) error {
+	return r.update(func(t *routeTables) error {
+		return r.addTCPRoute(t, tunnelID, listenPort, ip, port)
+	})
+}
+
+func (r *Router) addTCPRoute(t *routeTables, tunnelID string, listenPort int, ip string, port int) error {
+	r.registered = append(r.registered, tunnelID)
+	if existing, exists := t.portMap[listenPort]; exists && existing.ID != tunnelID {
+		return conflictf("port %d is already in use", listenPort)
+	}
+
+	t.portMap[listenPort] = &Target{
+		ID:   tunnelID,
+		IP:   ip,
+		Port: port,
+	}
+
+	return nil
+}
+
+// AddTLSRoute passes TLS connections whose SNI is hostname through to a
+// tunnel, which terminates TLS itself. The hostname cannot have HTTP routes
+// at the same time.
+func (r *Router) AddTLSRoute(tunnelID string, hostname string, ip string, port int) error {
+	hostname, err := NormalizeHostname(hostname)
+	if err != nil {
+		return err
+	}
+
+	return r.update(func(t *routeTables) error {
+		return r.addTLSRoute(t, tunnelID, hostname, ip, port)
+	})
+}
+
+func (r *Router) addTLSRoute(t *routeTables, tunnelID string, hostname string, ip string, port int) error {
+	r.registered = append(r.registered, tunnelID)
+	if existing, exists := t.sniMap[hostname]; exists && existing.ID != tunnelID {
+		return conflictf("hostname %s is already in use", hostname)
+	}
+	if t.hasHTTPHost(hostname) {
+		return conflictf("hostname %s is already in use", hostname)
+	}
+
+	t.sniMap[hostname] = &Target{
+		ID:   tunnelID,
+		IP:   ip,
+		Port: port,
+	}
+
+	return nil
+}
+
+// AddUDPRoute forwards UDP datagrams received on listenPort to a tunnel
+func (r *Router) AddUDPRoute(tunnelID string, listenPort int, ip string, port int) error {
+	return r.update(func(t *routeTables) error {
+		return r.addUDPRoute(t, tunnelID, listenPort, ip, port)
+	})
+}
+
+func (r *Router) addUDPRoute(t *routeTables, tunnelID string, listenPort int, ip string, port int) error {
+	r.registered = append(r.registered, tunnelID)
+	if existing, exists := t.udpMap[listenPort]; exists && existing.ID != tunnelID {
+		return conflictf("UDP port %d is already in use", listenPort)
+	}
+
+	t.udpMap[listenPort] = &Target{
+		ID:   tunnelID,
+		IP:   ip,
+		Port: port,
+	}
+
+	return nil
+}
+
+// hasHTTPHost reports whether hostname has a route for HTTP requests
+func (t *routeTables) hasHTTPHost(hostname string) bool {
+	_, exists := t.hostMap[hostname]
+	return exists || len(t.pathMap[hostname]) > 0
+}
+
+// Route returns the target for a request to hostname and path, preferring
+// matching path routes over the plain hostname route, and the routes of the
+// hostname itself over those of wildcards matching it
+func (r *Router) Route(hostname string, path string) (*Target, error) {
+	hostname = normalizeHost(hostname)
+
+	target, route := r.tables.Load().lookup(hostname, path)
+	switch {
+	case target != nil:
+		return target, nil
+	case route == nil:
+		return nil, notFoundf("no tunnel found for hostname: %s", hostname)
+	}
+
+	return route.targets[0], nil
+}
+
+// RouteRequest returns the target for a request like Route, picking among
+// the targets of its hostname by the configured session affinity. The
+// returned cookie, if any, has to be set on the response.
+func (r *Router) RouteRequest(req *http.Request) (*Target, *http.Cookie, error) {
+	t := r.tables.Load()
+
+	target, route := t.lookup(requestHost(req.Host), req.URL.Path)
+	if target != nil {
+		return target, nil, nil
+	}
+	if route == nil {
+		if t.fallback != nil {
+			return t.fallback, nil, nil
+		}
+		return nil, nil, notFoundf("no tunnel found for hostname: %s", req.Host)
+	}
+
+	target, cookie := r.config.Affinity.pick(route, req)
+	return target, cookie, nil
+}
+
+// fallbacks returns the other targets of the hostname route a request was
+// routed to, in the order to try them; requests matching a path route have
+// none
+func (r *Router) fallbacks(req *http.Request, target *Target) []*Target {
+	matched, route := r.tables.Load().lookup(requestHost(req.Host), req.URL.Path)
+	if matched != nil || route == nil {
+		return nil
+	}
+
+	// Start after the failed target, so that fallbacks spread like round robin
+	var before, after []*Target
+	found := false
+	for _, t := range route.targets {
+		switch {
+		case t.ID == target.ID:
+			found = true
+		case found:
+			after = append(after, t)
+		default:
+			before = append(before, t)
+		}
+	}
+	return append(after, before...)
+}
+
+// resolveDefault returns the target of the default tunnel, nil if it has no
+// HTTP routes. routes are in snapshot order, so this is the target of its
+// plain hostname route with the lowest hostname or, if it has none, of its
+// first path route.
+func (r *Router) resolveDefault(routes []Route) *Target {
+	id := r.config.DefaultTunnel
+	if id == "" {
+		return nil
+	}
+	for _, route := range routes {
+		if route.TunnelID == id && route.Hostname != "" && route.Protocol == "" {
+			return &Target{ID: route.TunnelID, IP: route.IP, Port: route.Port, redirect: route.Redirect, response: route.Response}
+		}
+	}
+	return nil
+}
+
+// TCPPort returns the port the load balancer accepts TCP connections on
+func (r *Router) TCPPort() int {
+	return r.config.TCPPort
+}
+
+func (m PathMatch) matches(path string) bool {
+	if path == "" {
+		path = "/"
+	}
+	if m.Type == PathMatchExact {
+		return path == m.Value
+	}
+
+	prefix := strings.TrimSuffix(m.Value, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// GetTunnelByHost returns a copy of the target for a given hostname
+func (r *Router) GetTunnelByHost(hostname string) (*Target, error) {
+	route, exists := r.tables.Load().hostMap[normalizeHost(hostname)]
 	if !exists {
-		return nil, fmt.Errorf("no tunnel found for hostname: %s", hostname)
+		return nil, notFoundf("no tunnel found for hostname: %s", hostname)
 	}
 
-	return target, nil
+	target := *route.targets[0]
+	return &target, nil
 }
 
-// GetTunnelByPort returns the target for a given port
+// targetOf returns a target of a tunnel routed for HTTP, preferring its
+// hostname routes over its path routes, or nil if it has none
+func (r *Router) targetOf(tunnelID string) *Target {
+	t := r.tables.Load()
+	for _, route := range t.hostMap {
+		for _, target := range route.targets {
+			if target.ID == tunnelID {
+				return target
+			}
+		}
+	}
+	for _, routes := range t.pathMap {
+		for _, route := range routes {
+			if route.target.ID == tunnelID {
+				return route.target
+			}
+		}
+	}
+	return nil
+}
+
+// HasHost reports whether a hostname has a route, with or without a path
+// or for TLS passthrough
+func (r *Router) HasHost(hostname string) bool {
+	hostname = normalizeHost(hostname)
+	t := r.tables.Load()
+
+	_, exists := t.sniMap[hostname]
+	return exists || t.hasHTTPHost(hostname)
+}
+
+// GetTunnelByPort returns a copy of the target for a given port
 func (r *Router) GetTunnelByPort(port int) (*Target, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	target, exists := r.tables.Load().portMap[port]
+	if !exists {
+		return nil, notFoundf("no tunnel found for port: %d", port)
+	}
 
-	target, exists := r.portMap[port]
+	copied := *target
+	return &copied, nil
+}
+
+// GetTunnelBySNI returns a copy of the target of TLS connections to a
+// server name
+func (r *Router) GetTunnelBySNI(serverName string) (*Target, error) {
+	target, exists := r.tables.Load().sniMap[normalizeHost(serverName)]
 	if !exists {
-		return nil, fmt.Errorf("no tunnel found for port: %d", port)
+		return nil, notFoundf("no tunnel found for server name: %s", serverName)
 	}
 
-	return target, nil
+	copied := *target
+	return &copied, nil
 }
 
-// ListRoutes returns all active routes
-func (r *Router) ListRoutes() map[string]*Target {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// hasTLSRoutes reports whether any hostname is routed for TLS passthrough,
+// i.e. whether HTTPS listeners need to look at the SNI of connections
+func (r *Router) hasTLSRoutes() bool {
+	return len(r.tables.Load().sniMap) > 0
+}
+
+// GetTunnelByUDPPort returns a copy of the target of datagrams received on
+// a port
+func (r *Router) GetTunnelByUDPPort(port int) (*Target, error) {
+	target, exists := r.tables.Load().udpMap[port]
+	if !exists {
+		return nil, notFoundf("no tunnel found for UDP port: %d", port)
+	}
 
+	copied := *target
+	return &copied, nil
+}
+
+// ListRoutes returns copies of the first targets of all hostnames
+func (r *Router) ListRoutes() map[string]*Target {
 	routes := make(map[string]*Target)
-	for hostname, target := range r.hostMap {
-		routes[hostname] = target
+	for hostname, route := range r.tables.Load().hostMap {
+		target := *route.targets[0]
+		routes[hostname] = &target
 	}
 
 	return routes
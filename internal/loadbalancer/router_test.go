@@ -1,6 +1,10 @@
 package loadbalancer
 
 import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -20,12 +24,8 @@ func TestNewRouter(t *testing.T) {
 		t.Error("Expected router to store config reference")
 	}
 
-	if router.hostMap == nil {
-		t.Error("Expected non-nil hostMap")
-	}
-
-	if router.portMap == nil {
-		t.Error("Expected non-nil portMap")
+	if tables := router.tables.Load(); tables == nil || tables.hostMap == nil || tables.portMap == nil {
+		t.Error("Expected non-nil routing tables")
 	}
 }
 
@@ -301,4 +301,420 @@ func TestListRoutes(t *testing.T) {
 			t.Errorf("Expected port %d, got %d", r.port, target.Port)
 		}
 	}
-} 
\ No newline at end of file
+} 
+func TestRoutePaths(t *testing.T) {
+	router := NewRouter(&Config{})
+
+	if err := router.AddRoute("default", "app.example.com", "10.0.0.1", 8080); err != nil {
+		t.Fatalf("Failed to add test route: %v", err)
+	}
+	pathRoutes := []struct {
+		tunnelID string
+		match    PathMatch
+	}{
+		{"api", PathMatch{Type: PathMatchPrefix, Value: "/api"}},
+		{"api-v2", PathMatch{Type: PathMatchPrefix, Value: "/api/v2/"}},
+		{"health", PathMatch{Type: PathMatchExact, Value: "/api/health"}},
+	}
+	for _, r := range pathRoutes {
+		if err := router.AddPathRoute(r.tunnelID, "app.example.com", r.match, "10.0.0.2", 9000); err != nil {
+			t.Fatalf("Failed to add path route: %v", err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/", "default"},
+		{"/apis", "default"},
+		{"/api", "api"},
+		{"/api/v1/users", "api"},
+		{"/api/v2", "api-v2"},
+		{"/api/v2/users", "api-v2"},
+		{"/api/health", "health"},
+		{"/api/health/deep", "api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			target, err := router.Route("app.example.com", tt.path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if target.ID != tt.expected {
+				t.Errorf("Expected tunnel %s, got %s", tt.expected, target.ID)
+			}
+		})
+	}
+
+	// Conflicting and invalid path routes are rejected
+	if err := router.AddPathRoute("other", "app.example.com", PathMatch{Type: PathMatchPrefix, Value: "/api"}, "10.0.0.3", 9000); err == nil {
+		t.Error("Expected error adding duplicate path route, got nil")
+	}
+	if err := router.AddPathRoute("other", "app.example.com", PathMatch{Type: "RegularExpression", Value: "/.*"}, "10.0.0.3", 9000); err == nil {
+		t.Error("Expected error adding unsupported path match, got nil")
+	}
+
+	// Removing a tunnel removes its path routes
+	router.RemoveRoute("api")
+	if target, _ := router.Route("app.example.com", "/api/v1"); target.ID != "default" {
+		t.Errorf("Expected removed path route to fall back to default, got %s", target.ID)
+	}
+
+	if _, err := router.Route("other.example.com", "/api"); err == nil {
+		t.Error("Expected error routing unknown hostname, got nil")
+	}
+}
+
+// TestEqualPriorityPrecedence checks that routes of the same priority are
+// picked by hostname: exact hostnames, then wildcards, then the catch-all,
+// then the default tunnel
+func TestEqualPriorityPrecedence(t *testing.T) {
+	root := &PathMatch{Type: PathMatchPrefix, Value: "/"}
+	api := &PathMatch{Type: PathMatchPrefix, Value: "/api"}
+	exact := Route{TunnelID: "exact", Hostname: "app.example.com", Path: root, Priority: 5, IP: "10.0.0.1", Port: 80}
+	exactAPI := Route{TunnelID: "exact-api", Hostname: "app.example.com", Path: api, Priority: 5, IP: "10.0.0.2", Port: 80}
+	exactHost := Route{TunnelID: "exact-host", Hostname: "app.example.com", IP: "10.0.0.3", Port: 80}
+	wildcard := Route{TunnelID: "wildcard", Hostname: "*.example.com", Path: root, Priority: 5, IP: "10.0.0.4", Port: 80}
+	catchAll := Route{TunnelID: "catch-all", Hostname: "*", Path: root, Priority: 5, IP: "10.0.0.5", Port: 80}
+	fallback := Route{TunnelID: "default", Hostname: "default.example.net", IP: "10.0.0.6", Port: 80}
+
+	tests := []struct {
+		name     string
+		routes   []Route
+		host     string
+		path     string
+		expected string
+	}{
+		{
+			name:     "Exact host over wildcard and catch-all",
+			routes:   []Route{catchAll, wildcard, exact, fallback},
+			host:     "app.example.com",
+			path:     "/",
+			expected: "exact",
+		},
+		{
+			name:     "Wildcard over catch-all",
+			routes:   []Route{catchAll, wildcard, exact, fallback},
+			host:     "other.example.com",
+			path:     "/",
+			expected: "wildcard",
+		},
+		{
+			name:     "Wildcard for nested subdomain",
+			routes:   []Route{catchAll, wildcard, exact, fallback},
+			host:     "deep.app.example.com",
+			path:     "/",
+			expected: "wildcard",
+		},
+		{
+			name:     "Catch-all over default route",
+			routes:   []Route{catchAll, wildcard, exact, fallback},
+			host:     "app.example.org",
+			path:     "/",
+			expected: "catch-all",
+		},
+		{
+			name:     "Default route without catch-all",
+			routes:   []Route{wildcard, exact, fallback},
+			host:     "app.example.org",
+			path:     "/",
+			expected: "default",
+		},
+		{
+			name:     "Exact host path route",
+			routes:   []Route{wildcard, exactAPI, fallback},
+			host:     "app.example.com",
+			path:     "/api/users",
+			expected: "exact-api",
+		},
+		{
+			name:     "Wildcard when no exact path route matches",
+			routes:   []Route{wildcard, exactAPI, fallback},
+			host:     "app.example.com",
+			path:     "/",
+			expected: "wildcard",
+		},
+		{
+			name:     "Exact hostname route over wildcard path route",
+			routes:   []Route{wildcard, exactHost, fallback},
+			host:     "app.example.com",
+			path:     "/",
+			expected: "exact-host",
+		},
+		{
+			name:     "Default route when no wildcard matches",
+			routes:   []Route{exactAPI, fallback},
+			host:     "app.example.com",
+			path:     "/",
+			expected: "default",
+		},
+		{
+			name:   "No route without default route",
+			routes: []Route{exactAPI},
+			host:   "app.example.com",
+			path:   "/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&Config{DefaultTunnel: "default"})
+			if err := router.ReplaceRoutes(tt.routes); err != nil {
+				t.Fatalf("Failed to replace routes: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+			target, _, err := router.RouteRequest(req)
+			if tt.expected == "" {
+				if err == nil {
+					t.Errorf("Expected no route, got %s", target.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if target.ID != tt.expected {
+				t.Errorf("Expected tunnel %s, got %s", tt.expected, target.ID)
+			}
+		})
+	}
+}
+
+func TestAddTCPRoute(t *testing.T) {
+	router := NewRouter(&Config{TCPPort: 8444})
+
+	if err := router.AddTCPRoute("db", router.TCPPort(), "10.0.0.1", 5432); err != nil {
+		t.Fatalf("Failed to add TCP route: %v", err)
+	}
+	if err := router.AddTCPRoute("other", router.TCPPort(), "10.0.0.2", 5432); err == nil {
+		t.Error("Expected error adding TCP route on a used port, got nil")
+	}
+
+	target, err := router.GetTunnelByPort(8444)
+	if err != nil {
+		t.Fatalf("Failed to get tunnel by port: %v", err)
+	}
+	if target.ID != "db" || target.Port != 5432 {
+		t.Errorf("Unexpected target %s:%d", target.ID, target.Port)
+	}
+}
+
+func TestAddTLSRoute(t *testing.T) {
+	router := NewRouter(&Config{})
+
+	if err := router.AddTLSRoute("mail", "Mail.Example.com", "10.0.0.1", 993); err != nil {
+		t.Fatalf("Failed to add TLS route: %v", err)
+	}
+	if err := router.AddTLSRoute("other", "mail.example.com", "10.0.0.2", 993); err == nil {
+		t.Error("Expected error adding a TLS route for a used hostname, got nil")
+	}
+	if err := router.AddBackend("web", "mail.example.com", "10.0.0.3", 80); err == nil {
+		t.Error("Expected error routing a passed through hostname for HTTP, got nil")
+	}
+	if err := router.AddBackend("web", "www.example.com", "10.0.0.3", 80); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+	if err := router.AddTLSRoute("other", "www.example.com", "10.0.0.2", 443); err == nil {
+		t.Error("Expected error passing through a hostname routed for HTTP, got nil")
+	}
+
+	target, err := router.GetTunnelBySNI("MAIL.example.com")
+	if err != nil {
+		t.Fatalf("Failed to get tunnel by SNI: %v", err)
+	}
+	if target.ID != "mail" || target.Port != 993 {
+		t.Errorf("Unexpected target %s:%d", target.ID, target.Port)
+	}
+	if _, err := router.Route("mail.example.com", "/"); err == nil {
+		t.Error("Expected no HTTP route for a passed through hostname")
+	}
+	if !router.HasHost("mail.example.com") {
+		t.Error("Expected the passed through hostname to be in use")
+	}
+
+	router.RemoveRoute("mail")
+	if _, err := router.GetTunnelBySNI("mail.example.com"); err == nil {
+		t.Error("Expected the TLS route to be removed")
+	}
+	if router.hasTLSRoutes() {
+		t.Error("Expected no TLS routes left")
+	}
+}
+
+func TestAddUDPRoute(t *testing.T) {
+	router := NewRouter(&Config{TCPPort: 8444})
+
+	if err := router.AddUDPRoute("dns", 53, "10.0.0.1", 5353); err != nil {
+		t.Fatalf("Failed to add UDP route: %v", err)
+	}
+	if err := router.AddUDPRoute("other", 53, "10.0.0.2", 5353); err == nil {
+		t.Error("Expected error adding a UDP route on a used port, got nil")
+	}
+	// TCP and UDP ports are separate
+	if err := router.AddTCPRoute("other", 53, "10.0.0.2", 53); err != nil {
+		t.Fatalf("Failed to add TCP route on a UDP port: %v", err)
+	}
+
+	target, err := router.GetTunnelByUDPPort(53)
+	if err != nil {
+		t.Fatalf("Failed to get tunnel by UDP port: %v", err)
+	}
+	if target.ID != "dns" || target.Port != 5353 {
+		t.Errorf("Unexpected target %s:%d", target.ID, target.Port)
+	}
+	if target, _ := router.GetTunnelByPort(53); target == nil || target.ID != "other" {
+		t.Errorf("Expected the TCP port routed to other, got %v", target)
+	}
+
+	router.RemoveRoute("dns")
+	if _, err := router.GetTunnelByUDPPort(53); err == nil {
+		t.Error("Expected the UDP route to be removed")
+	}
+}
+
+func TestAddBackend(t *testing.T) {
+	router := NewRouter(&Config{})
+
+	for _, id := range []string{"replica-1", "replica-2"} {
+		if err := router.AddBackend(id, "app.example.com", id+".invalid", 8080); err != nil {
+			t.Fatalf("Failed to add backend %s: %v", id, err)
+		}
+	}
+	if err := router.AddBackend("replica-1", "app.example.com", "replica-1.invalid", 8080); err == nil {
+		t.Error("Expected error adding the same backend twice")
+	}
+	if _, err := router.GetTunnelByPort(8080); err == nil {
+		t.Error("Expected backends not to claim TCP ports")
+	}
+
+	// Removing one backend keeps the hostname routed to the other
+	router.RemoveRoute("replica-1")
+	target, err := router.Route("app.example.com", "/")
+	if err != nil || target.ID != "replica-2" {
+		t.Fatalf("Expected remaining backend replica-2, got %v, %v", target, err)
+	}
+	router.RemoveRoute("replica-2")
+	if _, err := router.Route("app.example.com", "/"); err == nil {
+		t.Error("Expected hostname without backends to be unrouted")
+	}
+}
+
+func TestRouterCopies(t *testing.T) {
+	router := NewRouter(&Config{})
+	if err := router.AddRoute("test-1", "app.example.com", "10.0.0.1", 8080); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+
+	router.ListRoutes()["app.example.com"].IP = "changed"
+	if target, _ := router.GetTunnelByHost("app.example.com"); target != nil {
+		target.IP = "changed"
+	}
+	if target, _ := router.GetTunnelByPort(8080); target != nil {
+		target.Port = 1
+	}
+
+	target, err := router.Route("app.example.com", "/")
+	if err != nil || target.IP != "10.0.0.1" || target.Port != 8080 {
+		t.Errorf("Expected route to be unchanged, got %+v, %v", target, err)
+	}
+}
+
+// TestConcurrentRouting routes requests while routes change, for -race
+func TestConcurrentRouting(t *testing.T) {
+	router := NewRouter(&Config{})
+	if err := router.AddBackend("stable", "app.example.com", "stable.invalid", 8080); err != nil {
+		t.Fatalf("Failed to add backend: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "http://app.example.com/api", nil)
+			for !stop.Load() {
+				target, _, err := router.RouteRequest(req)
+				if err != nil {
+					t.Errorf("Expected app.example.com to stay routed, got %v", err)
+					return
+				}
+				router.fallbacks(req, target)
+				router.Snapshot()
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("replica-%d", i%3)
+		router.AddBackend(id, "app.example.com", id+".invalid", 8080)
+		router.AddPathRoute(id, "app.example.com", PathMatch{Type: PathMatchPrefix, Value: "/api"}, id+".invalid", 8080)
+		router.RemoveRoute(id)
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+// benchmarkRouter returns a router with a thousand hostnames
+func benchmarkRouter(b *testing.B) *Router {
+	routes := make([]Route, 1000)
+	for i := range routes {
+		id := fmt.Sprintf("tunnel-%d", i)
+		routes[i] = Route{TunnelID: id, Hostname: id + ".example.com", IP: id + ".invalid", Port: 8080}
+	}
+	router := NewRouter(&Config{})
+	if err := router.ReplaceRoutes(routes); err != nil {
+		b.Fatal(err)
+	}
+	return router
+}
+
+func BenchmarkRouteRequest(b *testing.B) {
+	router := benchmarkRouter(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := httptest.NewRequest("GET", "http://tunnel-500.example.com/", nil)
+		for pb.Next() {
+			if _, _, err := router.RouteRequest(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkRouteRequestWithWrites routes requests while a tunnel's route is
+// added and removed continuously
+func BenchmarkRouteRequestWithWrites(b *testing.B) {
+	router := benchmarkRouter(b)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			router.AddBackend("churn", "churn.example.com", "churn.invalid", 8080)
+			router.RemoveRoute("churn")
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := httptest.NewRequest("GET", "http://tunnel-500.example.com/", nil)
+		for pb.Next() {
+			if _, _, err := router.RouteRequest(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
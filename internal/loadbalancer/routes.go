@@ -0,0 +1,561 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Route protocols other than the default, HTTP for hostname routes and TCP
+// for listen port routes
+const (
+	// RouteTLS passes TLS connections whose SNI is the route's hostname
+	// through to the target without terminating them
+	RouteTLS = "tls"
+	// RouteUDP forwards datagrams received on the route's listen port
+	RouteUDP = "udp"
+)
+
+// Route is one entry of the routing table: a hostname, a path on a
+// hostname, or a TCP listen port routed to a tunnel's target. Static
+// routes have no tunnel and answer requests with their redirect or
+// response.
+type Route struct {
+	TunnelID string `json:"tunnel_id"`
+
+	// Protocol is empty for HTTP and TCP routes, RouteTLS for SNI
+	// passthrough of Hostname or RouteUDP for datagrams to ListenPort
+	Protocol string `json:"protocol,omitempty"`
+
+	// Hostname routes HTTP requests, restricted to Path if set. HTTP
+	// routes may have a wildcard hostname, "*.domain" for the subdomains
+	// of domain or "*" for any hostname; the routes of a hostname take
+	// precedence over those of wildcards matching it, and longer wildcards
+	// over shorter ones.
+	Hostname string     `json:"hostname,omitempty"`
+	Path     *PathMatch `json:"path,omitempty"`
+
+	// Priority orders path routes of a hostname that match the same
+	// requests, higher first. Routes with the same path need different
+	// priorities; the lower one only receives requests once the higher one
+	// is removed.
+	Priority int `json:"priority,omitempty"`
+
+	// ListenPort routes TCP connections accepted on it
+	ListenPort int `json:"listen_port,omitempty"`
+
+	// IP and Port are the tunnel's target
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+
+	// Redirect or Response answer the requests of static routes
+	Redirect *Redirect       `json:"redirect,omitempty"`
+	Response *StaticResponse `json:"response,omitempty"`
+}
+
+// routesFile is the format the routing table is persisted in
+type routesFile struct {
+	Routes []Route `json:"routes"`
+}
+
+// routeTables are the lookup tables of a routing table. Published tables
+// are immutable: changes are made to a clone.
+type routeTables struct {
+	hostMap map[string]*hostRoute
+	portMap map[int]*Target
+	pathMap map[string][]*pathRoute
+
+	// sniMap routes TLS connections by SNI, udpMap datagrams by the port
+	// they were received on
+	sniMap map[string]*Target
+	udpMap map[int]*Target
+
+	// fallback is the target of the default tunnel, resolved on every
+	// change of the routing table
+	fallback *Target
+}
+
+func newRouteTables() *routeTables {
+	return &routeTables{
+		hostMap: make(map[string]*hostRoute),
+		portMap: make(map[int]*Target),
+		pathMap: make(map[string][]*pathRoute),
+		sniMap:  make(map[string]*Target),
+		udpMap:  make(map[int]*Target),
+	}
+}
+
+// clone returns a copy of the tables that shares their routes and targets,
+// which changes replace rather than modify
+func (t *routeTables) clone() *routeTables {
+	return &routeTables{
+		hostMap:  maps.Clone(t.hostMap),
+		portMap:  maps.Clone(t.portMap),
+		pathMap:  maps.Clone(t.pathMap),
+		sniMap:   maps.Clone(t.sniMap),
+		udpMap:   maps.Clone(t.udpMap),
+		fallback: t.fallback,
+	}
+}
+
+// Snapshot returns the routing table: hostname routes with their targets in
+// order, then path routes by precedence, then TCP, TLS passthrough and UDP
+// routes
+func (r *Router) Snapshot() []Route {
+	return r.tables.Load().snapshot()
+}
+
+// RouteCounts returns the number of routes of each tunnel by tunnel ID
+func (r *Router) RouteCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, route := range r.Snapshot() {
+		if route.TunnelID != "" {
+			counts[route.TunnelID]++
+		}
+	}
+	return counts
+}
+
+func (t *routeTables) snapshot() []Route {
+	var routes []Route
+
+	hostnames := make([]string, 0, len(t.hostMap))
+	for hostname := range t.hostMap {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		for _, target := range t.hostMap[hostname].targets {
+			routes = append(routes, Route{TunnelID: target.ID, Hostname: hostname, IP: target.IP, Port: target.Port,
+				Redirect: target.redirect, Response: target.response})
+		}
+	}
+
+	hostnames = hostnames[:0]
+	for hostname := range t.pathMap {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		for _, route := range t.pathMap[hostname] {
+			match := route.match
+			routes = append(routes, Route{TunnelID: route.target.ID, Hostname: hostname, Path: &match, Priority: route.priority,
+				IP: route.target.IP, Port: route.target.Port, Redirect: route.target.redirect, Response: route.target.response})
+		}
+	}
+
+	ports := make([]int, 0, len(t.portMap))
+	for port := range t.portMap {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		target := t.portMap[port]
+		routes = append(routes, Route{TunnelID: target.ID, ListenPort: port, IP: target.IP, Port: target.Port})
+	}
+
+	hostnames = hostnames[:0]
+	for hostname := range t.sniMap {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		target := t.sniMap[hostname]
+		routes = append(routes, Route{TunnelID: target.ID, Protocol: RouteTLS, Hostname: hostname, IP: target.IP, Port: target.Port})
+	}
+
+	ports = ports[:0]
+	for port := range t.udpMap {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		target := t.udpMap[port]
+		routes = append(routes, Route{TunnelID: target.ID, Protocol: RouteUDP, ListenPort: port, IP: target.IP, Port: target.Port})
+	}
+	return routes
+}
+
+// ReplaceRoutes atomically replaces the whole routing table. Nothing
+// changes if a route is invalid or conflicts with another one.
+func (r *Router) ReplaceRoutes(routes []Route) error {
+	tables, err := buildRouteTables(routes)
+	if err != nil {
+		return err
+	}
+
+	var removed map[string]bool
+	r.update(func(t *routeTables) error {
+		removed = t.tunnelIDs()
+		t.hostMap, t.portMap, t.pathMap = tables.hostMap, tables.portMap, tables.pathMap
+		t.sniMap, t.udpMap = tables.sniMap, tables.udpMap
+		for id := range t.tunnelIDs() {
+			delete(removed, id)
+		}
+		return nil
+	})
+
+	r.forget(removed)
+	return nil
+}
+
+// ReplaceTunnelRoutes atomically replaces the routes of one tunnel, so
+// requests never see it half registered. Nothing changes if a route is
+// invalid or conflicts with another tunnel's.
+func (r *Router) ReplaceTunnelRoutes(tunnelID string, routes []Route) error {
+	err := r.update(func(t *routeTables) error {
+		var all []Route
+		for _, route := range t.snapshot() {
+			if route.TunnelID != tunnelID {
+				all = append(all, route)
+			}
+		}
+		for _, route := range routes {
+			route.TunnelID = tunnelID
+			all = append(all, route)
+		}
+		if err := t.replace(all); err != nil {
+			return err
+		}
+		r.registered = append(r.registered, tunnelID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(routes) == 0 {
+		r.forget(map[string]bool{tunnelID: true})
+	}
+	return nil
+}
+
+// tunnelIDs returns the IDs of all routed tunnels
+func (t *routeTables) tunnelIDs() map[string]bool {
+	ids := make(map[string]bool)
+	for _, route := range t.hostMap {
+		for _, target := range route.targets {
+			ids[target.ID] = true
+		}
+	}
+	for _, target := range t.portMap {
+		ids[target.ID] = true
+	}
+	for _, routes := range t.pathMap {
+		for _, route := range routes {
+			ids[route.target.ID] = true
+		}
+	}
+	for _, target := range t.sniMap {
+		ids[target.ID] = true
+	}
+	for _, target := range t.udpMap {
+		ids[target.ID] = true
+	}
+	// Static routes have no tunnel
+	delete(ids, "")
+	return ids
+}
+
+// forget notifies the removal of tunnels that lost all their routes
+func (r *Router) forget(ids map[string]bool) {
+	if r.onRemove == nil {
+		return
+	}
+	for id := range ids {
+		r.onRemove(id)
+	}
+}
+
+// buildRouteTables builds the lookup tables of routes, applying the same
+// rules as adding them one by one
+func buildRouteTables(routes []Route) (*routeTables, error) {
+	tables := newRouteTables()
+
+	for _, route := range routes {
+		if route.isStatic() {
+			if err := route.validateStatic(); err != nil {
+				return nil, err
+			}
+		} else if route.TunnelID == "" {
+			return nil, fmt.Errorf("route without tunnel ID")
+		}
+		target := &Target{ID: route.TunnelID, IP: route.IP, Port: route.Port, redirect: route.Redirect, response: route.Response}
+
+		switch route.Protocol {
+		case "":
+		case RouteUDP:
+			if route.ListenPort <= 0 {
+				return nil, fmt.Errorf("UDP route of tunnel %s has no listen port", route.TunnelID)
+			}
+			if existing, exists := tables.udpMap[route.ListenPort]; exists && existing.ID != route.TunnelID {
+				return nil, conflictf("UDP port %d is already in use", route.ListenPort)
+			}
+			tables.udpMap[route.ListenPort] = target
+			continue
+		case RouteTLS:
+			hostname, err := NormalizeHostname(route.Hostname)
+			if err != nil {
+				return nil, err
+			}
+			if existing, exists := tables.sniMap[hostname]; exists && existing.ID != route.TunnelID {
+				return nil, conflictf("hostname %s is already in use", hostname)
+			}
+			tables.sniMap[hostname] = target
+			continue
+		default:
+			return nil, fmt.Errorf("route of tunnel %s has unknown protocol %q", route.TunnelID, route.Protocol)
+		}
+
+		if route.ListenPort > 0 {
+			if existing, exists := tables.portMap[route.ListenPort]; exists && existing.ID != route.TunnelID {
+				return nil, conflictf("port %d is already in use", route.ListenPort)
+			}
+			tables.portMap[route.ListenPort] = target
+			continue
+		}
+
+		if route.Hostname == "" {
+			return nil, fmt.Errorf("route of tunnel %s has neither hostname nor listen port", route.TunnelID)
+		}
+		hostname, err := normalizeRouteHostname(route.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		if route.Priority != 0 && route.Path == nil {
+			return nil, fmt.Errorf("route of hostname %s has a priority but no path", hostname)
+		}
+
+		switch {
+		case route.Path != nil:
+			if err := route.Path.validate(); err != nil {
+				return nil, err
+			}
+			for _, existing := range tables.pathMap[hostname] {
+				if existing.match == *route.Path && existing.priority == route.Priority && (existing.target.ID != route.TunnelID || route.isStatic()) {
+					return nil, conflictf("path %s on hostname %s is already in use with priority %d", route.Path.Value, hostname, route.Priority)
+				}
+			}
+			tables.pathMap[hostname] = append(tables.pathMap[hostname], &pathRoute{match: *route.Path, priority: route.Priority, target: target})
+
+		default:
+			host, exists := tables.hostMap[hostname]
+			if !exists {
+				host = &hostRoute{}
+				tables.hostMap[hostname] = host
+			}
+			for _, existing := range host.targets {
+				if existing.isStatic() || route.isStatic() {
+					return nil, conflictf("hostname %s is already in use", hostname)
+				}
+				if existing.ID == route.TunnelID {
+					return nil, conflictf("tunnel %s is already a target of hostname %s", route.TunnelID, hostname)
+				}
+			}
+			host.targets = append(host.targets, target)
+		}
+	}
+
+	for _, routes := range tables.pathMap {
+		sortPathRoutes(routes)
+	}
+	for hostname := range tables.sniMap {
+		if tables.hasHTTPHost(hostname) {
+			return nil, conflictf("hostname %s has both HTTP and TLS passthrough routes", hostname)
+		}
+	}
+	return tables, nil
+}
+
+// SetRoutesFile makes the router save its routing table to path after
+// every change, replacing the file atomically
+func (r *Router) SetRoutesFile(path string) {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.routesFile = path
+}
+
+// LoadRoutes replaces the routing table with the one saved in the routes
+// file, if there is one, and returns the number of routes loaded
+func (r *Router) LoadRoutes() (int, error) {
+	r.saveMu.Lock()
+	path := r.routesFile
+	r.saveMu.Unlock()
+	if path == "" {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read routes file: %v", err)
+	}
+	var saved routesFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("invalid routes file %s: %v", path, err)
+	}
+	if err := r.ReplaceRoutes(saved.Routes); err != nil {
+		return 0, fmt.Errorf("invalid routes file %s: %v", path, err)
+	}
+
+	r.mu.Lock()
+	r.restored = r.tables.Load().tunnelIDs()
+	r.mu.Unlock()
+	return len(saved.Routes), nil
+}
+
+// ExpireRestoredRoutes removes, once grace has passed, the routes loaded
+// by LoadRoutes of tunnels that were not registered again in the meantime,
+// so that tunnels gone while the agent was down do not keep receiving
+// traffic. It returns immediately; ctx cancels the expiry.
+func (r *Router) ExpireRestoredRoutes(ctx context.Context, grace time.Duration) {
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+			r.removeRestored()
+		}
+	}()
+}
+
+// removeRestored removes the routes of tunnels that were restored from the
+// routes file and not registered since, returning their IDs
+func (r *Router) removeRestored() []string {
+	var ids []string
+	r.update(func(t *routeTables) error {
+		for id := range r.restored {
+			ids = append(ids, id)
+		}
+		for _, id := range ids {
+			r.removeRoute(t, id)
+		}
+		return nil
+	})
+
+	sort.Strings(ids)
+	removed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+		r.logger.Warn().
+			Str("tunnel_id", id).
+			Msg("Removed restored routes of tunnel that was not registered again")
+	}
+	r.forget(removed)
+	return ids
+}
+
+// persist saves the routing table to the routes file, if set. Saves are
+// serialized and each writes the table as it is when the save starts, so
+// the file ends up with the latest table.
+func (r *Router) persist() {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	if r.routesFile == "" {
+		return
+	}
+
+	r.saveErr = writeFileAtomic(r.routesFile, routesFile{Routes: r.Snapshot()})
+	if r.saveErr == nil {
+		r.savedAt = time.Now()
+	}
+	if err := r.saveErr; err != nil {
+		r.logger.Error().
+			Err(err).
+			Str("path", r.routesFile).
+			Msg("Failed to save routes")
+	}
+}
+
+// CheckRoutesFile returns an error if the routing table cannot be saved:
+// the last save failed or the directory of the routes file is not
+// writable. Without a routes file it returns nil.
+func (r *Router) CheckRoutesFile() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	if r.routesFile == "" {
+		return nil
+	}
+	if r.saveErr != nil {
+		return fmt.Errorf("failed to save routes: %v", r.saveErr)
+	}
+
+	probe, err := os.CreateTemp(filepath.Dir(r.routesFile), "."+filepath.Base(r.routesFile)+".*")
+	if err != nil {
+		return fmt.Errorf("routes file directory is not writable: %v", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+// RoutesFileStatus is the state of the routes file
+type RoutesFileStatus struct {
+	Path string
+	// LastSaved is when the routing table was last saved, zero if it was
+	// not saved since the agent started
+	LastSaved time.Time
+	// Error is why the routing table cannot be saved, nil if it can
+	Error error
+}
+
+// RoutesFileStatus returns the state of the routes file, checking that it
+// can be saved as CheckRoutesFile does
+func (r *Router) RoutesFileStatus() RoutesFileStatus {
+	err := r.CheckRoutesFile()
+
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	return RoutesFileStatus{Path: r.routesFile, LastSaved: r.savedAt, Error: err}
+}
+
+// writeFileAtomic writes value as JSON to a temporary file next to path
+// and renames it over path, so readers see either the old or the new file
+func writeFileAtomic(path string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// validate checks that a path match can be routed
+func (m PathMatch) validate() error {
+	switch m.Type {
+	case PathMatchPrefix, PathMatchExact:
+	default:
+		return fmt.Errorf("unsupported path match type: %s", m.Type)
+	}
+	if !strings.HasPrefix(m.Value, "/") {
+		return fmt.Errorf("path %q must start with /", m.Value)
+	}
+	return nil
+}
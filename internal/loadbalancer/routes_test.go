@@ -0,0 +1,572 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplaceRoutes(t *testing.T) {
+	api := &PathMatch{Type: PathMatchPrefix, Value: "/api"}
+
+	tests := []struct {
+		name    string
+		routes  []Route
+		wantErr bool
+	}{
+		{
+			name: "Hostname, path and TCP routes",
+			routes: []Route{
+				{TunnelID: "a", Hostname: "a.example.com", IP: "10.0.0.1", Port: 80},
+				{TunnelID: "b", Hostname: "a.example.com", IP: "10.0.0.2", Port: 80},
+				{TunnelID: "c", Hostname: "a.example.com", Path: api, IP: "10.0.0.3", Port: 8080},
+				{TunnelID: "d", ListenPort: 9000, IP: "10.0.0.4", Port: 22},
+			},
+		},
+		{
+			name: "TLS passthrough and UDP routes",
+			routes: []Route{
+				{TunnelID: "a", Hostname: "a.example.com", IP: "10.0.0.1", Port: 80},
+				{TunnelID: "d", ListenPort: 9000, IP: "10.0.0.4", Port: 22},
+				{TunnelID: "e", Protocol: RouteTLS, Hostname: "e.example.com", IP: "10.0.0.5", Port: 443},
+				{TunnelID: "f", Protocol: RouteUDP, ListenPort: 9000, IP: "10.0.0.6", Port: 53},
+			},
+		},
+		{
+			name:    "Port conflict",
+			routes:  []Route{{TunnelID: "a", ListenPort: 9000}, {TunnelID: "b", ListenPort: 9000}},
+			wantErr: true,
+		},
+		{
+			name:    "UDP port conflict",
+			routes:  []Route{{TunnelID: "a", Protocol: RouteUDP, ListenPort: 53}, {TunnelID: "b", Protocol: RouteUDP, ListenPort: 53}},
+			wantErr: true,
+		},
+		{
+			name:    "Hostname routed for HTTP and TLS passthrough",
+			routes:  []Route{{TunnelID: "a", Hostname: "a.example.com"}, {TunnelID: "b", Protocol: RouteTLS, Hostname: "a.example.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown protocol",
+			routes:  []Route{{TunnelID: "a", Protocol: "sctp", ListenPort: 9000}},
+			wantErr: true,
+		},
+		{
+			name:    "Path conflict",
+			routes:  []Route{{TunnelID: "a", Hostname: "a.example.com", Path: api}, {TunnelID: "b", Hostname: "a.example.com", Path: api}},
+			wantErr: true,
+		},
+		{
+			name: "Same path with different priorities",
+			routes: []Route{
+				{TunnelID: "b", Hostname: "a.example.com", Path: api, Priority: 10, IP: "10.0.0.2", Port: 80},
+				{TunnelID: "a", Hostname: "a.example.com", Path: api, IP: "10.0.0.1", Port: 80},
+			},
+		},
+		{
+			name:    "Priority without a path",
+			routes:  []Route{{TunnelID: "a", Hostname: "a.example.com", Priority: 1}},
+			wantErr: true,
+		},
+		{
+			name: "Wildcard hostnames",
+			routes: []Route{
+				{TunnelID: "a", Hostname: "*", IP: "10.0.0.1", Port: 80},
+				{TunnelID: "b", Hostname: "*.example.com", IP: "10.0.0.2", Port: 80},
+				{TunnelID: "c", Hostname: "*.example.com", Path: api, IP: "10.0.0.3", Port: 80},
+			},
+		},
+		{
+			name:    "Wildcard of an invalid domain",
+			routes:  []Route{{TunnelID: "a", Hostname: "*.-example.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid path",
+			routes:  []Route{{TunnelID: "a", Hostname: "a.example.com", Path: &PathMatch{Type: PathMatchExact, Value: "api"}}},
+			wantErr: true,
+		},
+		{
+			name:    "Missing hostname and port",
+			routes:  []Route{{TunnelID: "a", IP: "10.0.0.1", Port: 80}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&Config{})
+			if err := router.AddRoute("old", "old.example.com", "10.0.0.9", 0); err != nil {
+				t.Fatalf("Failed to add route: %v", err)
+			}
+			var removed []string
+			router.onRemove = func(id string) { removed = append(removed, id) }
+
+			err := router.ReplaceRoutes(tt.routes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReplaceRoutes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := router.GetTunnelByHost("old.example.com"); err != nil {
+					t.Error("Expected the routing table to be unchanged after an error")
+				}
+				if len(removed) != 0 {
+					t.Errorf("Expected no removed tunnels, got %v", removed)
+				}
+				return
+			}
+
+			if got := router.Snapshot(); !reflect.DeepEqual(got, tt.routes) {
+				t.Errorf("Expected snapshot %+v, got %+v", tt.routes, got)
+			}
+			if !reflect.DeepEqual(removed, []string{"old"}) {
+				t.Errorf("Expected the old tunnel to be removed, got %v", removed)
+			}
+		})
+	}
+}
+
+func TestReplaceTunnelRoutes(t *testing.T) {
+	router := NewRouter(&Config{})
+	if err := router.AddPathRoute("a", "example.com", PathMatch{Type: PathMatchPrefix, Value: "/a"}, "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.AddPathRoute("b", "example.com", PathMatch{Type: PathMatchPrefix, Value: "/b"}, "10.0.0.2", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+
+	// Taking another tunnel's path fails without changing anything
+	taken := []Route{{Hostname: "example.com", Path: &PathMatch{Type: PathMatchPrefix, Value: "/b"}, IP: "10.0.0.1", Port: 80}}
+	if err := router.ReplaceTunnelRoutes("a", taken); err == nil {
+		t.Error("Expected an error for a path of another tunnel")
+	}
+	if target, err := router.Route("example.com", "/a"); err != nil || target.ID != "a" {
+		t.Errorf("Expected /a to still route to a, got %v (%v)", target, err)
+	}
+
+	moved := []Route{{Hostname: "example.com", Path: &PathMatch{Type: PathMatchExact, Value: "/c"}, IP: "10.0.0.3", Port: 8080}}
+	if err := router.ReplaceTunnelRoutes("a", moved); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := router.Route("example.com", "/a"); err == nil {
+		t.Error("Expected /a to be unrouted")
+	}
+	if target, err := router.Route("example.com", "/c"); err != nil || target.ID != "a" || target.Port != 8080 {
+		t.Errorf("Expected /c to route to a on port 8080, got %v (%v)", target, err)
+	}
+	if target, err := router.Route("example.com", "/b"); err != nil || target.ID != "b" {
+		t.Errorf("Expected /b to still route to b, got %v (%v)", target, err)
+	}
+}
+
+func TestRoutesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+
+	router := NewRouter(&Config{})
+	router.SetRoutesFile(path)
+	if n, err := router.LoadRoutes(); err != nil || n != 0 {
+		t.Fatalf("Expected no routes without a file, got %d (%v)", n, err)
+	}
+	if err := router.AddBackend("a", "a.example.com", "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.AddPathRoute("b", "a.example.com", PathMatch{Type: PathMatchExact, Value: "/b"}, "10.0.0.2", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.AddTCPRoute("c", 9000, "10.0.0.3", 22); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	router.RemoveRoute("b")
+
+	restored := NewRouter(&Config{})
+	restored.SetRoutesFile(path)
+	n, err := restored.LoadRoutes()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 routes, got %d", n)
+	}
+	if got, want := restored.Snapshot(), router.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected restored routes %+v, got %+v", want, got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"routes":[{"tunnel_id":"a"}]}`), 0o644); err != nil {
+		t.Fatalf("Failed to write routes file: %v", err)
+	}
+	if _, err := NewRouter(&Config{}).LoadRoutes(); err != nil {
+		t.Errorf("Expected no error without a routes file, got %v", err)
+	}
+	invalid := NewRouter(&Config{})
+	invalid.SetRoutesFile(path)
+	if _, err := invalid.LoadRoutes(); err == nil {
+		t.Error("Expected an error for an invalid routes file")
+	}
+}
+
+func TestCheckRoutesFile(t *testing.T) {
+	router := NewRouter(&Config{})
+	if err := router.CheckRoutesFile(); err != nil {
+		t.Errorf("Expected no error without a routes file, got %v", err)
+	}
+
+	router.SetRoutesFile(filepath.Join(t.TempDir(), "routes.json"))
+	if err := router.CheckRoutesFile(); err != nil {
+		t.Errorf("Expected a writable routes file, got %v", err)
+	}
+	if status := router.RoutesFileStatus(); !status.LastSaved.IsZero() || status.Error != nil {
+		t.Errorf("Expected a healthy routes file not saved yet, got %+v", status)
+	}
+	if err := router.AddBackend("b", "b.example.com", "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if status := router.RoutesFileStatus(); status.LastSaved.IsZero() {
+		t.Error("Expected the save time to be recorded")
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing", "routes.json")
+	router.SetRoutesFile(missing)
+	if err := router.CheckRoutesFile(); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+	if err := router.AddBackend("a", "a.example.com", "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.CheckRoutesFile(); err == nil || !strings.Contains(err.Error(), "failed to save routes") {
+		t.Errorf("Expected the failed save to be reported, got %v", err)
+	}
+	if status := router.RoutesFileStatus(); status.Path != missing || status.Error == nil {
+		t.Errorf("Expected the failed save in the status, got %+v", status)
+	}
+}
+
+func TestRemoveRestored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	saved := NewRouter(&Config{})
+	saved.SetRoutesFile(path)
+	for _, id := range []string{"gone", "back", "gateway"} {
+		if err := saved.AddBackend(id, id+".example.com", "10.0.0.1", 80); err != nil {
+			t.Fatalf("Failed to add route: %v", err)
+		}
+	}
+
+	router := NewRouter(&Config{})
+	router.SetRoutesFile(path)
+	if _, err := router.LoadRoutes(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Tunnels registered again after the restart keep their routes
+	router.RemoveRoute("back")
+	if err := router.AddBackend("back", "back.example.com", "10.0.0.2", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	if err := router.ReplaceTunnelRoutes("gateway", []Route{{Hostname: "gateway.example.com", IP: "10.0.0.3", Port: 80}}); err != nil {
+		t.Fatalf("Failed to replace routes: %v", err)
+	}
+
+	// A change that fails leaves the tunnel restored
+	if err := router.AddRoute("gone", "back.example.com", "10.0.0.4", 80); err == nil {
+		t.Fatal("Expected a conflict for a hostname in use")
+	}
+
+	if removed := router.removeRestored(); !reflect.DeepEqual(removed, []string{"gone"}) {
+		t.Errorf("Expected the routes of gone to be removed, got %v", removed)
+	}
+	if router.HasHost("gone.example.com") {
+		t.Error("Expected the stale route to be removed")
+	}
+	if !router.HasHost("back.example.com") || !router.HasHost("gateway.example.com") {
+		t.Error("Expected re-registered routes to be kept")
+	}
+	if removed := router.removeRestored(); len(removed) != 0 {
+		t.Errorf("Expected restored routes to expire once, got %v", removed)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	router := NewRouter(&Config{})
+	var events []RouteEvent
+	unsubscribe := router.Subscribe(func(event RouteEvent) { events = append(events, event) })
+
+	host := Route{TunnelID: "a", Hostname: "a.example.com", IP: "10.0.0.1", Port: 80}
+	moved := Route{TunnelID: "a", Hostname: "a.example.com", IP: "10.0.0.2", Port: 80}
+	tcp := Route{TunnelID: "b", ListenPort: 9000, IP: "10.0.0.3", Port: 22}
+
+	if err := router.AddBackend("a", "a.example.com", "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	// A failed change reports nothing
+	if err := router.AddBackend("a", "a.example.com", "10.0.0.1", 80); err == nil {
+		t.Fatal("Expected an error for a duplicate target")
+	}
+	if err := router.ReplaceRoutes([]Route{moved, tcp}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	router.RemoveRoute("b")
+
+	expected := []RouteEvent{
+		{Type: RouteAdded, Route: host},
+		{Type: RouteUpdated, Route: moved},
+		{Type: RouteAdded, Route: tcp},
+		{Type: RouteRemoved, Route: tcp},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %+v, got %+v", expected, events)
+	}
+
+	unsubscribe()
+	router.RemoveRoute("a")
+	if len(events) != len(expected) {
+		t.Errorf("Expected no events after unsubscribing, got %+v", events[len(expected):])
+	}
+}
+
+func TestStaticRoutes(t *testing.T) {
+	router := NewRouter(&Config{})
+	if err := router.AddBackend("www", "www.example.com", "10.0.0.1", 80); err != nil {
+		t.Fatalf("Failed to add route: %v", err)
+	}
+	health := &PathMatch{Type: PathMatchExact, Value: "/healthz"}
+
+	tests := []struct {
+		name    string
+		route   Route
+		wantErr bool
+	}{
+		{name: "Redirect", route: Route{Hostname: "Example.com", Redirect: &Redirect{URL: "https://www.example.com", PreservePath: true}}},
+		{name: "Response on a path of a tunnel's hostname", route: Route{Hostname: "www.example.com", Path: health, Response: &StaticResponse{Body: "ok"}}},
+		{name: "Hostname of a tunnel", route: Route{Hostname: "www.example.com", Response: &StaticResponse{}}, wantErr: true},
+		{name: "With a tunnel", route: Route{TunnelID: "www", Hostname: "static.example.com", Response: &StaticResponse{}}, wantErr: true},
+		{name: "Neither redirect nor response", route: Route{Hostname: "static.example.com"}, wantErr: true},
+		{name: "Both redirect and response", route: Route{Hostname: "static.example.com", Redirect: &Redirect{URL: "https://example.com"}, Response: &StaticResponse{}}, wantErr: true},
+		{name: "Relative redirect URL", route: Route{Hostname: "static.example.com", Redirect: &Redirect{URL: "/elsewhere"}}, wantErr: true},
+		{name: "Invalid redirect status", route: Route{Hostname: "static.example.com", Redirect: &Redirect{URL: "https://example.com", Status: 200}}, wantErr: true},
+		{name: "Invalid response status", route: Route{Hostname: "static.example.com", Response: &StaticResponse{Status: 99}}, wantErr: true},
+		{name: "Listen port", route: Route{ListenPort: 9000, Response: &StaticResponse{}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := router.AddStaticRoute(tt.route); (err != nil) != tt.wantErr {
+				t.Errorf("AddStaticRoute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Replacing a static route keeps a single one
+	if err := router.AddStaticRoute(Route{Hostname: "example.com", Redirect: &Redirect{URL: "https://www.example.com", Status: http.StatusFound}}); err != nil {
+		t.Fatalf("Unexpected error replacing a static route: %v", err)
+	}
+	if target, err := router.Route("example.com", "/"); err != nil || target.redirect == nil || target.redirect.Status != http.StatusFound {
+		t.Errorf("Expected the replaced redirect, got %+v (%v)", target, err)
+	}
+	if len(router.Snapshot()) != 3 {
+		t.Errorf("Expected 3 routes, got %+v", router.Snapshot())
+	}
+
+	// Tunnels cannot take the hostname of a static route
+	if err := router.AddRoute("apex", "example.com", "10.0.0.2", 80); err == nil {
+		t.Error("Expected an error routing a tunnel to the hostname of a static route")
+	}
+	if err := router.AddBackend("apex", "example.com", "10.0.0.2", 80); err == nil {
+		t.Error("Expected an error adding a tunnel to the hostname of a static route")
+	}
+
+	// Removing the tunnel leaves the static path route of its hostname
+	router.RemoveRoute("www")
+	if target, err := router.Route("www.example.com", "/healthz"); err != nil || target.response == nil {
+		t.Errorf("Expected the static response to stay, got %+v (%v)", target, err)
+	}
+
+	if err := router.RemoveStaticRoute("www.example.com", health); err != nil {
+		t.Fatalf("Unexpected error removing a static route: %v", err)
+	}
+	if err := router.RemoveStaticRoute("www.example.com", health); err == nil {
+		t.Error("Expected an error removing a missing static route")
+	}
+	if err := router.RemoveStaticRoute("example.com", nil); err != nil {
+		t.Fatalf("Unexpected error removing a static route: %v", err)
+	}
+	if routes := router.Snapshot(); len(routes) != 0 {
+		t.Errorf("Expected no routes, got %+v", routes)
+	}
+}
+
+func TestStaticRoutesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	router := NewRouter(&Config{})
+	router.SetRoutesFile(path)
+	static := Route{Hostname: "example.com", Redirect: &Redirect{URL: "https://www.example.com"}}
+	if err := router.AddStaticRoute(static); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	restored := NewRouter(&Config{})
+	restored.SetRoutesFile(path)
+	if n, err := restored.LoadRoutes(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 route loaded, got %d (%v)", n, err)
+	}
+	if got := restored.Snapshot(); !reflect.DeepEqual(got, []Route{static}) {
+		t.Errorf("Expected %+v, got %+v", []Route{static}, got)
+	}
+	// Static routes are not expired like the routes of tunnels
+	if ids := restored.removeRestored(); len(ids) != 0 {
+		t.Errorf("Expected no restored tunnels, got %v", ids)
+	}
+}
+
+func TestRoutePrecedence(t *testing.T) {
+	api := &PathMatch{Type: PathMatchPrefix, Value: "/api"}
+	router := NewRouter(&Config{})
+	err := router.ReplaceRoutes([]Route{
+		{TunnelID: "exact", Hostname: "app.example.com", IP: "10.0.0.1", Port: 80},
+		{TunnelID: "exact-api", Hostname: "app.example.com", Path: &PathMatch{Type: PathMatchExact, Value: "/api/health"}, IP: "10.0.0.2", Port: 80},
+		{TunnelID: "wildcard", Hostname: "*.example.com", IP: "10.0.0.3", Port: 80},
+		{TunnelID: "wildcard-api", Hostname: "*.example.com", Path: api, IP: "10.0.0.4", Port: 80},
+		{TunnelID: "wildcard-api-canary", Hostname: "*.example.com", Path: api, Priority: 5, IP: "10.0.0.5", Port: 80},
+		{TunnelID: "deep-wildcard", Hostname: "*.eu.example.com", IP: "10.0.0.6", Port: 80},
+		{TunnelID: "catch-all", Hostname: "*", IP: "10.0.0.7", Port: 80},
+	})
+	if err != nil {
+		t.Fatalf("Failed to replace routes: %v", err)
+	}
+
+	tests := []struct {
+		host, path string
+		want       string
+	}{
+		{host: "app.example.com", path: "/", want: "exact"},
+		{host: "app.example.com", path: "/api/health", want: "exact-api"},
+		// The hostname route of a hostname wins over wildcard path routes
+		{host: "app.example.com", path: "/api/users", want: "exact"},
+		{host: "web.example.com", path: "/", want: "wildcard"},
+		{host: "web.example.com", path: "/api/users", want: "wildcard-api-canary"},
+		{host: "a.b.example.com", path: "/", want: "wildcard"},
+		{host: "web.eu.example.com", path: "/api", want: "deep-wildcard"},
+		{host: "example.com", path: "/", want: "catch-all"},
+		{host: "other.org", path: "/api", want: "catch-all"},
+	}
+	for _, tt := range tests {
+		target, err := router.Route(tt.host, tt.path)
+		if err != nil {
+			t.Errorf("Route(%q, %q) failed: %v", tt.host, tt.path, err)
+			continue
+		}
+		if target.ID != tt.want {
+			t.Errorf("Route(%q, %q) = %s, want %s", tt.host, tt.path, target.ID, tt.want)
+		}
+	}
+
+	// The lower priority route takes over once the higher one is removed
+	router.RemoveRoute("wildcard-api-canary")
+	if target, err := router.Route("web.example.com", "/api"); err != nil || target.ID != "wildcard-api" {
+		t.Errorf("Expected the lower priority route, got %+v (%v)", target, err)
+	}
+
+	router.RemoveRoute("catch-all")
+	if _, err := router.Route("other.org", "/"); err == nil {
+		t.Error("Expected no route without the catch-all route")
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	api := &PathMatch{Type: PathMatchPrefix, Value: "/api"}
+	router := NewRouter(&Config{})
+	err := router.ReplaceRoutes([]Route{
+		{TunnelID: "app", Hostname: "app.example.com", IP: "10.0.0.1", Port: 80},
+		{TunnelID: "api", Hostname: "*.example.com", Path: api, IP: "10.0.0.2", Port: 80},
+		{Hostname: "www.example.com", Redirect: &Redirect{URL: "https://example.com"}},
+		{TunnelID: "db", ListenPort: 5432, IP: "10.0.0.3", Port: 5432},
+	})
+	if err != nil {
+		t.Fatalf("Failed to replace routes: %v", err)
+	}
+	before := router.Snapshot()
+
+	tests := []struct {
+		name     string
+		route    Route
+		wantErr  bool
+		overlaps map[string]RouteOutcome
+	}{
+		{
+			name:     "Backend of a hostname",
+			route:    Route{TunnelID: "app2", Hostname: "App.example.com"},
+			overlaps: map[string]RouteOutcome{"app": RouteShared, "api": RouteNewWins},
+		},
+		{
+			name:     "Path of a hostname",
+			route:    Route{TunnelID: "app-api", Hostname: "app.example.com", Path: api},
+			overlaps: map[string]RouteOutcome{"app": RouteNewWins, "api": RouteNewWins},
+		},
+		{
+			name:     "Wildcard below a hostname",
+			route:    Route{TunnelID: "all", Hostname: "*.example.com"},
+			overlaps: map[string]RouteOutcome{"app": RouteExistingWins, "api": RouteExistingWins, "": RouteExistingWins},
+		},
+		{
+			name:     "Same path and priority",
+			route:    Route{TunnelID: "api2", Hostname: "*.example.com", Path: api},
+			wantErr:  true,
+			overlaps: map[string]RouteOutcome{"app": RouteExistingWins, "api": RouteConflict, "": RouteExistingWins},
+		},
+		{
+			name:     "Same path with a higher priority",
+			route:    Route{TunnelID: "api2", Hostname: "*.example.com", Path: api, Priority: 1},
+			overlaps: map[string]RouteOutcome{"app": RouteExistingWins, "api": RouteNewWins, "": RouteExistingWins},
+		},
+		{
+			name:     "Static route of a tunnel's hostname",
+			route:    Route{Hostname: "app.example.com", Response: &StaticResponse{}},
+			wantErr:  true,
+			overlaps: map[string]RouteOutcome{"app": RouteConflict, "api": RouteNewWins},
+		},
+		{
+			name:     "Replacing a static route",
+			route:    Route{Hostname: "www.example.com", Response: &StaticResponse{}},
+			overlaps: map[string]RouteOutcome{"api": RouteNewWins},
+		},
+		{
+			name:     "Listen port in use",
+			route:    Route{TunnelID: "db2", ListenPort: 5432},
+			wantErr:  true,
+			overlaps: map[string]RouteOutcome{"db": RouteConflict},
+		},
+		{
+			name:     "Additional route of the same tunnel",
+			route:    Route{TunnelID: "api", Hostname: "*.example.com"},
+			overlaps: map[string]RouteOutcome{"app": RouteExistingWins, "": RouteExistingWins},
+		},
+		{
+			name:    "Invalid hostname",
+			route:   Route{TunnelID: "bad", Hostname: "*.*.example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := router.CheckRoute(tt.route)
+			if (check.Err != nil) != tt.wantErr {
+				t.Errorf("CheckRoute() error = %v, wantErr %v", check.Err, tt.wantErr)
+			}
+			overlaps := make(map[string]RouteOutcome)
+			for _, overlap := range check.Overlaps {
+				overlaps[overlap.Route.TunnelID] = overlap.Outcome
+			}
+			if len(overlaps) == 0 {
+				overlaps = nil
+			}
+			if !reflect.DeepEqual(overlaps, tt.overlaps) {
+				t.Errorf("Expected overlaps %v, got %v", tt.overlaps, overlaps)
+			}
+		})
+	}
+
+	if after := router.Snapshot(); !reflect.DeepEqual(after, before) {
+		t.Errorf("Expected CheckRoute to leave the routing table unchanged, got %+v", after)
+	}
+}
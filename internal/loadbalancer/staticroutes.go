@@ -0,0 +1,184 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxStaticBody bounds the body of static responses, which are kept in the
+// routing table and its routes file
+const maxStaticBody = 64 << 10
+
+// Redirect answers the requests of a route with a redirect, e.g. from an
+// apex domain to its www hostname
+type Redirect struct {
+	// URL is where requests are redirected to
+	URL string `json:"url"`
+
+	// Status is 301, 302, 303, 307 or 308; zero uses 301
+	Status int `json:"status,omitempty"`
+
+	// PreservePath appends the path and query of requests to URL
+	PreservePath bool `json:"preserve_path,omitempty"`
+}
+
+// StaticResponse answers the requests of a route with a fixed response
+type StaticResponse struct {
+	// Status is the response status; zero uses 200
+	Status int `json:"status,omitempty"`
+
+	// ContentType of Body; empty uses text/plain
+	ContentType string `json:"content_type,omitempty"`
+
+	Body string `json:"body,omitempty"`
+}
+
+// validate checks that a redirect can be served
+func (r *Redirect) validate() error {
+	switch r.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect status: %d", r.Status)
+	}
+	target, err := url.Parse(r.URL)
+	if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		return fmt.Errorf("invalid redirect URL %q: must be an absolute http or https URL", r.URL)
+	}
+	return nil
+}
+
+// validate checks that a static response can be served
+func (s *StaticResponse) validate() error {
+	if s.Status != 0 && (s.Status < 200 || s.Status > 599) {
+		return fmt.Errorf("invalid response status: %d", s.Status)
+	}
+	if len(s.Body) > maxStaticBody {
+		return fmt.Errorf("response body of %d bytes exceeds %d bytes", len(s.Body), maxStaticBody)
+	}
+	return nil
+}
+
+// isStatic reports whether a route answers requests itself instead of
+// routing them to a tunnel
+func (route Route) isStatic() bool {
+	return route.Redirect != nil || route.Response != nil
+}
+
+// validateStatic checks a static route: it has a hostname and either a
+// redirect or a response, and no tunnel
+func (route Route) validateStatic() error {
+	switch {
+	case route.TunnelID != "":
+		return fmt.Errorf("static route of hostname %s cannot have a tunnel", route.Hostname)
+	case route.Protocol != "" || route.ListenPort != 0 || route.Hostname == "":
+		return fmt.Errorf("static routes need a hostname and route HTTP requests")
+	case route.Redirect != nil && route.Response != nil:
+		return fmt.Errorf("route of hostname %s cannot both redirect and respond", route.Hostname)
+	case route.Redirect != nil:
+		return route.Redirect.validate()
+	}
+	return route.Response.validate()
+}
+
+// AddStaticRoute answers requests to the route's hostname, restricted to
+// its path if set, with its redirect or response instead of routing them
+// to a tunnel. It replaces an earlier static route of the same hostname and
+// path; a hostname route cannot share its hostname with tunnels.
+func (r *Router) AddStaticRoute(route Route) error {
+	if !route.isStatic() {
+		return fmt.Errorf("static routes need a redirect or a response")
+	}
+	if err := route.validateStatic(); err != nil {
+		return err
+	}
+	hostname, err := normalizeRouteHostname(route.Hostname)
+	if err != nil {
+		return err
+	}
+	route.Hostname = hostname
+
+	return r.update(func(t *routeTables) error {
+		routes := withoutStaticRoute(t.snapshot(), route.Hostname, route.Path)
+		return t.replace(append(routes, route))
+	})
+}
+
+// RemoveStaticRoute removes the static route of hostname and path, nil for
+// the hostname route
+func (r *Router) RemoveStaticRoute(hostname string, path *PathMatch) error {
+	hostname, err := normalizeRouteHostname(hostname)
+	if err != nil {
+		return err
+	}
+
+	return r.update(func(t *routeTables) error {
+		before := t.snapshot()
+		routes := withoutStaticRoute(before, hostname, path)
+		if len(routes) == len(before) {
+			return notFoundf("no static route found for hostname %s", hostname)
+		}
+		return t.replace(routes)
+	})
+}
+
+// withoutStaticRoute returns routes without the static route of hostname
+// and path
+func withoutStaticRoute(routes []Route, hostname string, path *PathMatch) []Route {
+	kept := routes[:0:0]
+	for _, route := range routes {
+		samePath := (route.Path == nil && path == nil) || (route.Path != nil && path != nil && *route.Path == *path)
+		if route.isStatic() && route.Hostname == hostname && samePath {
+			continue
+		}
+		kept = append(kept, route)
+	}
+	return kept
+}
+
+// replace rebuilds the tables from routes
+func (t *routeTables) replace(routes []Route) error {
+	tables, err := buildRouteTables(routes)
+	if err != nil {
+		return err
+	}
+	t.hostMap, t.portMap, t.pathMap = tables.hostMap, tables.portMap, tables.pathMap
+	t.sniMap, t.udpMap = tables.sniMap, tables.udpMap
+	return nil
+}
+
+// serveStatic answers a request routed to a static route
+func (lb *LoadBalancer) serveStatic(w http.ResponseWriter, r *http.Request, target *Target) {
+	if redirect := target.redirect; redirect != nil {
+		location := redirect.URL
+		if redirect.PreservePath {
+			location = strings.TrimSuffix(location, "/") + r.URL.RequestURI()
+		}
+		status := redirect.Status
+		if status == 0 {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, location, status)
+		return
+	}
+
+	response := target.response
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	contentType := response.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(response.Body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(response.Body))
+	}
+}
@@ -0,0 +1,53 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// streamingTypes are the media types of responses streamed to clients as
+// the target writes them, such as server-sent events. They are flushed as
+// they arrive and never compressed or cached.
+var streamingTypes = map[string]bool{
+	"text/event-stream":         true,
+	"application/x-ndjson":      true,
+	"application/stream+json":   true,
+	"multipart/x-mixed-replace": true,
+}
+
+// ValidateFlushInterval checks that a flush interval is -1 (flush after
+// every write) or more
+func ValidateFlushInterval(interval time.Duration) error {
+	if interval < -1 {
+		return fmt.Errorf("invalid flush interval: %v", interval)
+	}
+	return nil
+}
+
+// isStreaming reports whether a response is of a streaming media type
+func isStreaming(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && streamingTypes[mediaType]
+}
+
+// prepareStream asks proxies in front of the agent, such as nginx, not to
+// buffer a streaming response. The agent's proxy flushes event streams and
+// responses of unknown length after every write.
+func prepareStream(resp *http.Response) {
+	if isStreaming(resp.Header) && resp.Header.Get("X-Accel-Buffering") == "" {
+		resp.Header.Set("X-Accel-Buffering", "no")
+	}
+}
+
+// streamWithoutWriteDeadline lifts the server's write timeout from a
+// streaming response, which would otherwise cut it off; MaxRequest still
+// bounds it
+func streamWithoutWriteDeadline(w http.ResponseWriter) {
+	if isStreaming(w.Header()) {
+		// Writers without deadlines, such as HTTP/3 streams, keep theirs
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	}
+}
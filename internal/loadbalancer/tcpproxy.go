@@ -0,0 +1,143 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TCPConfig tunes the proxying of connections to the TCP listener
+type TCPConfig struct {
+	// KeepAlive is the interval of keep-alive probes on the client and
+	// target legs of a connection (zero disables them)
+	KeepAlive time.Duration
+
+	// IdleTimeout closes connections without traffic in either direction
+	// for this long (zero keeps them open)
+	IdleTimeout time.Duration
+}
+
+// Validate checks that the configuration is usable
+func (c TCPConfig) Validate() error {
+	if c.KeepAlive < 0 {
+		return fmt.Errorf("invalid TCP keep-alive interval: %v", c.KeepAlive)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid TCP idle timeout: %v", c.IdleTimeout)
+	}
+	return nil
+}
+
+// setKeepAlive turns keep-alive probes of a TCP connection on or off;
+// other connections, e.g. streams of a tunnel, are left alone
+func setKeepAlive(conn net.Conn, interval time.Duration) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if interval <= 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	tcp.SetKeepAlive(true)
+	tcp.SetKeepAlivePeriod(interval)
+}
+
+// halfClose tells the peer of conn that no more data is sent, while data
+// can still be read from it. Streams of tunnels without CloseWrite, such
+// as yamux streams, half-close on Close.
+func halfClose(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// abortConn closes conn in both directions, resetting streams of tunnels
+// whose Close only half-closes them
+func abortConn(conn net.Conn) {
+	if r, ok := conn.(interface{ Reset() error }); ok {
+		r.Reset()
+		return
+	}
+	conn.Close()
+}
+
+// relay copies data between a client and a target until both directions
+// are done. The end of one direction is passed on as a half-close, so
+// protocols that shut down their sending side before reading the reply
+// keep working; an error in either direction or the idle timeout aborts
+// the whole connection. It reports whether the idle timeout closed the
+// connection.
+func (lb *LoadBalancer) relay(clientConn, backendConn net.Conn, abort func(), sent, received func(int64)) bool {
+	idleTimeout := lb.router.config.TCP.IdleTimeout
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	active := func(count func(int64)) func(int64) {
+		return func(n int64) {
+			lastActive.Store(time.Now().UnixNano())
+			count(n)
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- lb.proxy(clientConn, backendConn, active(sent)) }()
+	go func() { errs <- lb.proxy(backendConn, clientConn, active(received)) }()
+
+	done := make(chan struct{})
+	defer close(done)
+	var idle atomic.Bool
+	if idleTimeout > 0 {
+		go func() {
+			timer := time.NewTimer(idleTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-timer.C:
+				}
+				quiet := time.Since(time.Unix(0, lastActive.Load()))
+				if quiet >= idleTimeout {
+					idle.Store(true)
+					abort()
+					return
+				}
+				timer.Reset(idleTimeout - quiet)
+			}
+		}()
+	}
+
+	for range 2 {
+		if err := <-errs; err != nil {
+			abort()
+		}
+	}
+	return idle.Load()
+}
+
+// proxy copies src to dst until src ends, then half-closes dst. It returns
+// the error that stopped the copy, nil if src ended normally.
+func (lb *LoadBalancer) proxy(dst net.Conn, src net.Conn, count func(int64)) error {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, writeErr := dst.Write(buffer[:n]); writeErr != nil {
+				return writeErr
+			}
+			count(int64(n))
+		}
+		if errors.Is(err, io.EOF) {
+			halfClose(dst)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
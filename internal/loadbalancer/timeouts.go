@@ -0,0 +1,147 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts bound how long the load balancer waits on clients and targets;
+// zero disables a timeout
+type Timeouts struct {
+	// Dial bounds connecting to a target
+	Dial time.Duration
+
+	// ResponseHeader bounds waiting for a target's response headers
+	ResponseHeader time.Duration
+
+	// MaxRequest bounds the whole of a proxied request, including its
+	// body and upgraded connections such as WebSockets
+	MaxRequest time.Duration
+
+	// ReadHeader, Read, Write and Idle are the HTTP server's timeouts for
+	// reading request headers, reading whole requests, writing responses
+	// and waiting for the next request on a keep-alive connection. They
+	// apply to all tunnels.
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// Validate checks that no timeout is negative
+func (t Timeouts) Validate() error {
+	for name, timeout := range map[string]time.Duration{
+		"dial":            t.Dial,
+		"response header": t.ResponseHeader,
+		"max request":     t.MaxRequest,
+		"read header":     t.ReadHeader,
+		"read":            t.Read,
+		"write":           t.Write,
+		"idle":            t.Idle,
+	} {
+		if timeout < 0 {
+			return fmt.Errorf("invalid %s timeout: %v", name, timeout)
+		}
+	}
+	return nil
+}
+
+// timeouts returns the timeouts in effect for the traffic of a tunnel with
+// options
+func (lb *LoadBalancer) timeouts(options *TunnelOptions) Timeouts {
+	timeouts := lb.router.config.Timeouts
+	override := options.Timeouts
+	if override.Dial > 0 {
+		timeouts.Dial = override.Dial
+	}
+	if override.ResponseHeader > 0 {
+		timeouts.ResponseHeader = override.ResponseHeader
+	}
+	if override.MaxRequest > 0 {
+		timeouts.MaxRequest = override.MaxRequest
+	}
+	return timeouts
+}
+
+// timeoutError is returned when a target does not answer in time
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var errResponseHeaderTimeout = &timeoutError{msg: "timeout awaiting response headers"}
+
+// isTimeout reports whether err means a deadline passed
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// roundTripWithTimeout sends req, failing it if no response headers arrive
+// within timeout. The response body stays readable until it is closed.
+func roundTripWithTimeout(transport http.RoundTripper, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return transport.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timer cancelled the request, possibly just as its headers
+		// arrived
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// Upgraded connections need their body to stay writable
+		resp.Body = &cancelOnCloseWriter{ReadWriteCloser: rwc, cancel: cancel}
+	} else {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a response once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// cancelOnCloseWriter is cancelOnClose for the writable body of an
+// upgraded connection
+type cancelOnCloseWriter struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseWriter) Close() error {
+	err := b.ReadWriteCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,157 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ALPN protocols HTTPS listeners can negotiate
+const (
+	ALPNHTTP2 = "h2"
+	ALPNHTTP1 = "http/1.1"
+)
+
+// TLSPolicy restricts the handshakes of HTTPS listeners. The zero value
+// accepts TLS 1.2 and later with Go's default cipher suites and curves and
+// negotiates HTTP/2 or HTTP/1.1.
+type TLSPolicy struct {
+	// MinVersion is the oldest TLS version accepted, such as
+	// tls.VersionTLS13; zero accepts TLS 1.2
+	MinVersion uint16
+
+	// CipherSuites are the TLS 1.2 cipher suites accepted; empty uses Go's
+	// defaults. TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+
+	// CurvePreferences are the key exchange mechanisms offered, in order of
+	// preference; empty uses Go's defaults
+	CurvePreferences []tls.CurveID
+
+	// ALPN lists the protocols negotiated over TLS in order of preference;
+	// empty negotiates HTTP/2 or HTTP/1.1. Leaving out h2 disables HTTP/2.
+	ALPN []string
+
+	// OCSPStapling staples OCSP responses fetched from the responder named
+	// in the certificates to handshakes
+	OCSPStapling bool
+}
+
+// tlsVersions are the TLS versions a policy may require at least
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the key exchange mechanisms a policy may offer
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// ParseTLSPolicy parses a minimum TLS version ("1.2" or "1.3") and
+// comma-separated lists of cipher suites by their IANA names, such as
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, of curves (X25519, P-256,
+// P-384, P-521) and of ALPN protocols (h2, http/1.1). Empty values keep
+// the defaults.
+func ParseTLSPolicy(minVersion, cipherSuites, curves, alpn string) (TLSPolicy, error) {
+	var policy TLSPolicy
+	if minVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.TrimSpace(minVersion), "TLS")]
+		if !ok {
+			return policy, fmt.Errorf("unsupported minimum TLS version %q, use 1.2 or 1.3", minVersion)
+		}
+		policy.MinVersion = version
+	}
+
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	for _, name := range splitList(cipherSuites) {
+		suite, ok := suites[name]
+		if !ok {
+			return policy, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return policy, fmt.Errorf("TLS cipher suite %q is a TLS 1.3 suite, which are not configurable", name)
+		}
+		if !slices.Contains(policy.CipherSuites, suite.ID) {
+			policy.CipherSuites = append(policy.CipherSuites, suite.ID)
+		}
+	}
+	if len(policy.CipherSuites) > 0 && policy.MinVersion == tls.VersionTLS13 {
+		return policy, fmt.Errorf("TLS cipher suites only apply to TLS 1.2, which the minimum version 1.3 rules out")
+	}
+
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return policy, fmt.Errorf("unsupported TLS curve %q, use X25519, P-256, P-384 or P-521", name)
+		}
+		if !slices.Contains(policy.CurvePreferences, id) {
+			policy.CurvePreferences = append(policy.CurvePreferences, id)
+		}
+	}
+
+	for _, protocol := range splitList(alpn) {
+		if protocol != ALPNHTTP2 && protocol != ALPNHTTP1 {
+			return policy, fmt.Errorf("unsupported ALPN protocol %q, use h2 or http/1.1", protocol)
+		}
+		if !slices.Contains(policy.ALPN, protocol) {
+			policy.ALPN = append(policy.ALPN, protocol)
+		}
+	}
+	return policy, nil
+}
+
+// splitList splits a comma-separated list, dropping blank entries
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// nextProtos returns the ALPN protocols to negotiate
+func (p TLSPolicy) nextProtos() []string {
+	if len(p.ALPN) == 0 {
+		return []string{ALPNHTTP2, ALPNHTTP1}
+	}
+	return slices.Clone(p.ALPN)
+}
+
+// apply restricts config to the policy
+func (p TLSPolicy) apply(config *tls.Config) {
+	config.MinVersion = p.MinVersion
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	config.CipherSuites = slices.Clone(p.CipherSuites)
+	config.CurvePreferences = slices.Clone(p.CurvePreferences)
+	config.NextProtos = p.nextProtos()
+}
+
+// configureServer applies the policy to the HTTP/2 support of server, which
+// net/http enables unless the protocol is disabled explicitly
+func (p TLSPolicy) configureServer(server *http.Server) {
+	if !slices.Contains(p.nextProtos(), ALPNHTTP2) {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+}
+
+// tlsPolicy returns the TLS policy of the HTTPS listeners
+func (lb *LoadBalancer) tlsPolicy() TLSPolicy {
+	if tlsConfig := lb.router.config.TLSConfig; tlsConfig != nil {
+		return tlsConfig.Policy
+	}
+	return TLSPolicy{}
+}
@@ -0,0 +1,162 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DefaultMaxIdleConnsPerTarget is how many idle connections are kept open
+// to each target if none is configured
+const DefaultMaxIdleConnsPerTarget = 32
+
+// TransportConfig tunes the connection pools to tunnel targets
+type TransportConfig struct {
+	// MaxIdleConnsPerTarget is how many idle keep-alive connections are
+	// kept open to each target
+	MaxIdleConnsPerTarget int
+
+	// IdleConnTimeout closes connections idle for this long (zero keeps
+	// them open)
+	IdleConnTimeout time.Duration
+
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool
+
+	// CAFile verifies the certificates of HTTPS targets instead of the
+	// system's roots
+	CAFile string
+}
+
+// Validate checks that the configuration is usable
+func (c TransportConfig) Validate() error {
+	if c.MaxIdleConnsPerTarget < 0 {
+		return fmt.Errorf("invalid max idle connections per target: %d", c.MaxIdleConnsPerTarget)
+	}
+	if c.IdleConnTimeout < 0 {
+		return fmt.Errorf("invalid idle connection timeout: %v", c.IdleConnTimeout)
+	}
+	return nil
+}
+
+// BackendTLS makes the load balancer connect to a tunnel's target over
+// HTTPS
+type BackendTLS struct {
+	// ServerName is sent to the target and verified against its
+	// certificate; empty uses the target's address
+	ServerName string
+
+	// InsecureSkipVerify accepts any certificate, e.g. a self-signed one
+	InsecureSkipVerify bool
+}
+
+// targetTransport is the connection pool to a target and the TLS settings
+// it was created with
+type targetTransport struct {
+	backendTLS *BackendTLS
+	transport  *http.Transport
+}
+
+// loadRootCAs reads the CA certificates verifying HTTPS targets, if
+// configured
+func (lb *LoadBalancer) loadRootCAs() error {
+	caFile := lb.router.config.Transport.CAFile
+	if caFile == "" {
+		return nil
+	}
+	caCert, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read backend CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("no CA certificates found in %s", caFile)
+	}
+
+	lb.transportsMu.Lock()
+	defer lb.transportsMu.Unlock()
+	lb.rootCAs = pool
+	return nil
+}
+
+// transportFor returns the connection pool to a tunnel's target, replacing
+// it if the tunnel's TLS settings changed
+func (lb *LoadBalancer) transportFor(tunnelID string, backendTLS *BackendTLS) *http.Transport {
+	lb.transportsMu.Lock()
+	defer lb.transportsMu.Unlock()
+
+	if existing, ok := lb.transports[tunnelID]; ok {
+		if sameBackendTLS(existing.backendTLS, backendTLS) {
+			return existing.transport
+		}
+		existing.transport.CloseIdleConnections()
+	}
+
+	var settings *BackendTLS
+	if backendTLS != nil {
+		copied := *backendTLS
+		settings = &copied
+	}
+	transport := lb.newTransport(settings)
+	lb.transports[tunnelID] = &targetTransport{backendTLS: settings, transport: transport}
+	return transport
+}
+
+// forgetTransport closes the idle connections to a removed target
+func (lb *LoadBalancer) forgetTransport(tunnelID string) {
+	lb.transportsMu.Lock()
+	defer lb.transportsMu.Unlock()
+
+	if existing, ok := lb.transports[tunnelID]; ok {
+		existing.transport.CloseIdleConnections()
+		delete(lb.transports, tunnelID)
+	}
+}
+
+// newTransport creates a connection pool to a target. Targets are dialed
+// directly, never through an HTTP proxy from the environment, as some are
+// only reachable through their tunnel.
+func (lb *LoadBalancer) newTransport(backendTLS *BackendTLS) *http.Transport {
+	config := lb.router.config.Transport
+	maxIdle := config.MaxIdleConnsPerTarget
+	if maxIdle == 0 {
+		maxIdle = DefaultMaxIdleConnsPerTarget
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		tunnelID, _ := ctx.Value(tunnelIDKey{}).(string)
+		conn, err := lb.dialTunnel(ctx, tunnelID, lb.optionsOf(tunnelID), address)
+		if err != nil {
+			return nil, &dialError{err: err}
+		}
+		return conn, nil
+	}
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = maxIdle
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	if backendTLS != nil {
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			ServerName:         backendTLS.ServerName,
+			InsecureSkipVerify: backendTLS.InsecureSkipVerify,
+			RootCAs:            lb.rootCAs,
+		}
+	}
+	return transport
+}
+
+func sameBackendTLS(a, b *BackendTLS) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
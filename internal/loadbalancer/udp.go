@@ -0,0 +1,205 @@
+// Package loadbalancer provides load balancing functionality for the easy-tunnel-lb-agent.
+package loadbalancer
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/stats"
+)
+
+// udpSessionTimeout ends UDP sessions without datagrams in either
+// direction for this long
+const udpSessionTimeout = 60 * time.Second
+
+// maxDatagramSize is the largest UDP payload
+const maxDatagramSize = 64 * 1024
+
+// udpSession relays the datagrams of one client address to a tunnel's
+// target over a socket of its own, on which the replies come back
+type udpSession struct {
+	backend    net.Conn
+	tracked    *trackedConn
+	stats      *stats.TunnelStats
+	lastActive atomic.Int64
+	release    func()
+	closeOnce  sync.Once
+}
+
+func (s *udpSession) active() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// serveUDP forwards the datagrams received on conn to the tunnel routed
+// for its port, and their replies back, until conn is closed
+func (lb *LoadBalancer) serveUDP(conn net.PacketConn) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, session := range sessions {
+			lb.closeUDPSession(session)
+		}
+	}()
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // Server is shutting down
+			}
+			lb.logger.Error().Err(err).Msg("Failed to read UDP datagram")
+			continue
+		}
+
+		key := addr.String()
+		mu.Lock()
+		session := sessions[key]
+		mu.Unlock()
+		if session == nil {
+			if session = lb.openUDPSession(port, key); session == nil {
+				continue
+			}
+			mu.Lock()
+			sessions[key] = session
+			mu.Unlock()
+			go func() {
+				lb.relayUDP(conn, addr, session)
+				mu.Lock()
+				if sessions[key] == session {
+					delete(sessions, key)
+				}
+				mu.Unlock()
+			}()
+		}
+
+		session.active()
+		if _, err := session.backend.Write(buffer[:n]); err != nil {
+			continue
+		}
+		session.stats.AddBytesReceived(int64(n))
+		session.tracked.bytesReceived.Add(int64(n))
+	}
+}
+
+// openUDPSession starts a session for the first datagram of a client,
+// applying the tunnel's access lists and limits. It returns nil if the
+// datagram is dropped.
+func (lb *LoadBalancer) openUDPSession(port int, clientAddr string) *udpSession {
+	target, err := lb.router.GetTunnelByUDPPort(port)
+	if err != nil {
+		lb.logger.Error().
+			Err(err).
+			Int("port", port).
+			Str("client_ip", clientIP(clientAddr)).
+			Msg("No tunnel found for UDP port")
+		return nil
+	}
+
+	tunnelStats := lb.stats.Tunnel(target.ID)
+	options := lb.optionsOf(target.ID)
+	country := lb.clientCountry(clientAddr)
+	tunnelStats.IncCountry(country)
+	if !lb.allowClient(options, clientAddr, country) {
+		tunnelStats.IncDenied()
+		lb.logger.Warn().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientAddr)).
+			Func(withCountry(country)).
+			Msg("Client denied by access list")
+		return nil
+	}
+	if options.OverBandwidth {
+		tunnelStats.IncRateLimited()
+		lb.logger.Warn().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientAddr)).
+			Msg("Tunnel over its bandwidth limit")
+		return nil
+	}
+	release, ok, _ := lb.clients.acquire(target.ID, clientIP(clientAddr), lb.clientLimits(options))
+	if !ok {
+		tunnelStats.IncRateLimited()
+		lb.logger.Warn().
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientAddr)).
+			Msg("Client rate limited")
+		return nil
+	}
+	if options.Maintenance || options.Paused {
+		release()
+		return nil
+	}
+
+	// Datagrams go to the target's address itself: UDP tunnels are reached
+	// directly or over WireGuard
+	backendAddr := net.JoinHostPort(target.IP, strconv.Itoa(target.Port))
+	backend, err := net.Dial("udp", backendAddr)
+	if err != nil {
+		release()
+		lb.logger.Error().
+			Err(err).
+			Str("tunnel_id", target.ID).
+			Str("client_ip", clientIP(clientAddr)).
+			Msg("Failed to connect to backend")
+		return nil
+	}
+
+	tunnelStats.IncRequests()
+	tunnelStats.ConnectionOpened()
+	session := &udpSession{backend: backend, stats: tunnelStats, release: release}
+	session.active()
+	session.tracked = lb.connections.open(Connection{
+		TunnelID:    target.ID,
+		ClientAddr:  clientAddr,
+		BackendAddr: backendAddr,
+		Protocol:    RouteUDP,
+	}, func() { backend.Close() })
+	return session
+}
+
+// relayUDP sends the target's replies of a session back to the client
+// until the session is idle for udpSessionTimeout or its socket fails
+func (lb *LoadBalancer) relayUDP(conn net.PacketConn, clientAddr net.Addr, session *udpSession) {
+	defer lb.closeUDPSession(session)
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		session.backend.SetReadDeadline(time.Now().Add(udpSessionTimeout - session.idle()))
+		n, err := session.backend.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && session.idle() < udpSessionTimeout {
+				continue // The client sent datagrams in the meantime
+			}
+			return
+		}
+		session.active()
+		if _, err := conn.WriteTo(buffer[:n], clientAddr); err != nil {
+			return
+		}
+		session.stats.AddBytesSent(int64(n))
+		session.tracked.bytesSent.Add(int64(n))
+	}
+}
+
+// closeUDPSession ends a session, once
+func (lb *LoadBalancer) closeUDPSession(session *udpSession) {
+	session.closeOnce.Do(func() {
+		session.backend.Close()
+		lb.connections.close(session.tracked)
+		session.stats.ConnectionClosed()
+		session.release()
+	})
+}
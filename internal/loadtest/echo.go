@@ -0,0 +1,82 @@
+package loadtest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// EchoUpgrade is the Upgrade protocol of the echo backend's raw
+// connections, which carry the TCP load through the HTTP listener
+const EchoUpgrade = "echo"
+
+// EchoBackend answers HTTP requests with their body, and turns connections
+// that ask to upgrade to EchoUpgrade into raw echo streams
+type EchoBackend struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewEchoBackend starts an echo backend on a free loopback port
+func NewEchoBackend() (*EchoBackend, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &EchoBackend{listener: listener}
+	b.server = &http.Server{Handler: http.HandlerFunc(b.serveHTTP)}
+	go b.server.Serve(listener)
+	return b, nil
+}
+
+// Port returns the port the backend listens on
+func (b *EchoBackend) Port() int {
+	return b.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the backend
+func (b *EchoBackend) Close() error {
+	return b.server.Close()
+}
+
+func (b *EchoBackend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), EchoUpgrade) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, r.Body)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + EchoUpgrade + "\r\nConnection: Upgrade\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	echo(conn, rw.Reader)
+}
+
+// echo writes back what it reads until the connection closes
+func echo(conn net.Conn, r *bufio.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
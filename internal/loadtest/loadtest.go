@@ -0,0 +1,352 @@
+// Package loadtest drives synthetic load through an agent's public
+// listener, to size an agent before it takes production traffic.
+package loadtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Load test modes
+const (
+	ModeHTTP = "http"
+	ModeTCP  = "tcp"
+)
+
+// readyPollInterval is how often WaitReady probes the tunnels
+const readyPollInterval = 200 * time.Millisecond
+
+// Options configure a load test
+type Options struct {
+	// PublicURL is the agent's public listener, e.g. http://agent:80
+	PublicURL string
+
+	// Hosts are the hostnames the load is spread over
+	Hosts []string
+
+	// Mode is http, sending one request per operation, or tcp, sending
+	// echo round trips over long-lived connections
+	Mode string
+
+	// Concurrency is the number of workers, each with one operation in
+	// flight
+	Concurrency int
+
+	// Duration of the test
+	Duration time.Duration
+
+	// PayloadSize is the size in bytes of the body of each request or the
+	// message of each round trip
+	PayloadSize int
+
+	// TLSConfig is used if PublicURL is https
+	TLSConfig *tls.Config
+}
+
+// Validate checks the options
+func (o Options) Validate() error {
+	u, err := url.Parse(o.PublicURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid public URL %q", o.PublicURL)
+	}
+	if len(o.Hosts) == 0 {
+		return fmt.Errorf("no hosts to send load to")
+	}
+	if o.Mode != ModeHTTP && o.Mode != ModeTCP {
+		return fmt.Errorf("invalid mode %q, use %s or %s", o.Mode, ModeHTTP, ModeTCP)
+	}
+	if o.Concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+	if o.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+	if o.PayloadSize <= 0 {
+		return fmt.Errorf("payload size must be positive")
+	}
+	return nil
+}
+
+// Report is the result of a load test
+type Report struct {
+	Mode     string        `json:"mode"`
+	Duration time.Duration `json:"duration"`
+
+	// Operations are the completed requests or round trips, Errors the
+	// failed ones
+	Operations int64 `json:"operations"`
+	Errors     int64 `json:"errors"`
+
+	// Latency percentiles of the completed operations
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// Throughput returns the completed operations per second
+func (r *Report) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Operations) / r.Duration.Seconds()
+}
+
+// workerResult is what one worker measured
+type workerResult struct {
+	latencies []time.Duration
+	errors    int64
+}
+
+// Run drives load for the duration of the test or until ctx is canceled
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, opts.PayloadSize)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	httpClient := newHTTPClient(opts)
+	defer httpClient.CloseIdleConnections()
+
+	results := make([]workerResult, opts.Concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			host := opts.Hosts[i%len(opts.Hosts)]
+			if opts.Mode == ModeTCP {
+				results[i] = runTCPWorker(ctx, opts, host, payload)
+			} else {
+				results[i] = runHTTPWorker(ctx, httpClient, opts.PublicURL, host, payload)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Mode: opts.Mode, Duration: time.Since(start)}
+	var latencies []time.Duration
+	for _, result := range results {
+		latencies = append(latencies, result.latencies...)
+		report.Errors += result.errors
+	}
+	report.Operations = int64(len(latencies))
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50 = percentile(latencies, 50)
+	report.P90 = percentile(latencies, 90)
+	report.P99 = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		report.Max = latencies[len(latencies)-1]
+	}
+	return report, nil
+}
+
+// percentile returns the p-th percentile of sorted latencies by the
+// nearest-rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func newHTTPClient(opts Options) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = opts.Concurrency
+	transport.TLSClientConfig = opts.TLSConfig
+	return &http.Client{Transport: transport}
+}
+
+// runHTTPWorker sends requests to host until ctx is done
+func runHTTPWorker(ctx context.Context, httpClient *http.Client, publicURL, host string, payload []byte) workerResult {
+	var result workerResult
+	for ctx.Err() == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, publicURL, bytes.NewReader(payload))
+		if err != nil {
+			result.errors++
+			return result
+		}
+		req.Host = host
+
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				result.errors++
+			}
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, payload) {
+			result.errors++
+			continue
+		}
+		result.latencies = append(result.latencies, time.Since(start))
+	}
+	return result
+}
+
+// runTCPWorker sends echo round trips over a connection to host until ctx is
+// done, reconnecting after errors
+func runTCPWorker(ctx context.Context, opts Options, host string, payload []byte) workerResult {
+	var result workerResult
+	reply := make([]byte, len(payload))
+	for ctx.Err() == nil {
+		conn, r, err := dialEcho(ctx, opts, host)
+		if err != nil {
+			if ctx.Err() == nil {
+				result.errors++
+				// Don't spin while the agent refuses connections
+				select {
+				case <-ctx.Done():
+				case <-time.After(readyPollInterval):
+				}
+			}
+			continue
+		}
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+		for ctx.Err() == nil {
+			start := time.Now()
+			if _, err := conn.Write(payload); err != nil {
+				break
+			}
+			if _, err := io.ReadFull(r, reply); err != nil {
+				break
+			}
+			if !bytes.Equal(reply, payload) {
+				break
+			}
+			result.latencies = append(result.latencies, time.Since(start))
+		}
+		// The connection broke or echoed something else
+		if ctx.Err() == nil {
+			result.errors++
+		}
+		stop()
+		conn.Close()
+	}
+	return result
+}
+
+// dialEcho opens a connection to the public listener and upgrades it to an
+// echo stream to the tunnel of host
+func dialEcho(ctx context.Context, opts Options, host string) (net.Conn, *bufio.Reader, error) {
+	u, err := url.Parse(opts.PublicURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var conn net.Conn
+	if u.Scheme == "https" {
+		dialer := &tls.Dialer{Config: opts.TLSConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, opts.PublicURL, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Host = host
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", EchoUpgrade)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, fmt.Errorf("upgrade refused with status %d", resp.StatusCode)
+	}
+	return conn, r, nil
+}
+
+// WaitReady probes every host until the agent forwards its requests to the
+// echo backend, or ctx is done
+func WaitReady(ctx context.Context, opts Options) error {
+	httpClient := newHTTPClient(opts)
+	defer httpClient.CloseIdleConnections()
+
+	pending := append([]string(nil), opts.Hosts...)
+	for {
+		var waiting []string
+		for _, host := range pending {
+			if !probe(ctx, httpClient, opts.PublicURL, host) {
+				waiting = append(waiting, host)
+			}
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+		pending = waiting
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d of %d tunnels not ready, e.g. %s", len(pending), len(opts.Hosts), pending[0])
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// probe reports whether a request to host reaches the echo backend
+func probe(ctx context.Context, httpClient *http.Client, publicURL, host string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, publicURL, bytes.NewReader([]byte(host)))
+	if err != nil {
+		return false
+	}
+	req.Host = host
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return err == nil && resp.StatusCode == http.StatusOK && string(body) == host
+}
@@ -0,0 +1,141 @@
+package loadtest
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/loadbalancer"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/stats"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	tests := []struct {
+		latencies []time.Duration
+		p         int
+		expected  time.Duration
+	}{
+		{latencies: nil, p: 50, expected: 0},
+		{latencies: sorted[:1], p: 99, expected: time.Millisecond},
+		{latencies: sorted, p: 50, expected: 50 * time.Millisecond},
+		{latencies: sorted, p: 90, expected: 90 * time.Millisecond},
+		{latencies: sorted, p: 99, expected: 99 * time.Millisecond},
+		{latencies: sorted[:10], p: 99, expected: 10 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := percentile(tt.latencies, tt.p); got != tt.expected {
+			t.Errorf("Expected p%d of %d latencies to be %v, got %v", tt.p, len(tt.latencies), tt.expected, got)
+		}
+	}
+}
+
+func TestLoadTest(t *testing.T) {
+	backend, err := NewEchoBackend()
+	if err != nil {
+		t.Fatalf("Failed to start echo backend: %v", err)
+	}
+	defer backend.Close()
+
+	// An agent with the WebSocket transport, its API and its load balancer
+	transport := tunnel.NewWebSocketTransport()
+	manager := tunnel.NewManager(10)
+	if err := manager.AddTransport(transport); err != nil {
+		t.Fatalf("Failed to add transport: %v", err)
+	}
+	handler := api.NewHandler(manager, "test")
+	handler.SetWebSocketTransport(transport)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	apiServer := httptest.NewServer(mux)
+	defer apiServer.Close()
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &loadbalancer.Config{Host: "127.0.0.1"}
+	router := loadbalancer.NewRouter(config)
+	lb := loadbalancer.NewLoadBalancer(router, config, stats.NewCollector())
+	lb.SetDialer(manager.DialTunnel)
+	manager.SetRouter(router)
+	lb.SetListeners(httpListener, tcpListener)
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Failed to start load balancer: %v", err)
+	}
+	defer lb.Stop()
+
+	tunnels, err := StartTunnels(client.New(apiServer.URL, ""), apiServer.URL, 2, "loadtest", "loadtest.invalid", backend.Port(), nil)
+	if err != nil {
+		t.Fatalf("Failed to start tunnels: %v", err)
+	}
+	defer tunnels.Close()
+
+	for _, id := range []string{"loadtest-1", "loadtest-2"} {
+		waitFor(t, func() bool { return transport.Connected(id) })
+	}
+
+	opts := Options{
+		PublicURL:   "http://" + httpListener.Addr().String(),
+		Hosts:       tunnels.Hosts,
+		Concurrency: 4,
+		Duration:    200 * time.Millisecond,
+		PayloadSize: 512,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitReady(ctx, opts); err != nil {
+		t.Fatalf("Tunnels not ready: %v", err)
+	}
+
+	for _, mode := range []string{ModeHTTP, ModeTCP} {
+		t.Run(mode, func(t *testing.T) {
+			opts := opts
+			opts.Mode = mode
+			report, err := Run(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Load test failed: %v", err)
+			}
+			if report.Operations == 0 || report.Errors != 0 {
+				t.Errorf("Expected operations without errors, got %d operations and %d errors", report.Operations, report.Errors)
+			}
+			if report.P50 <= 0 || report.P50 > report.P99 || report.P99 > report.Max {
+				t.Errorf("Expected ordered percentiles, got p50 %v, p99 %v, max %v", report.P50, report.P99, report.Max)
+			}
+		})
+	}
+
+	tunnels.Close()
+	if err := tunnels.Err(); err != nil {
+		t.Errorf("Expected tunnel clients to stop cleanly, got %v", err)
+	}
+	if tunnels := manager.GetAllTunnels(); len(tunnels) != 0 {
+		t.Errorf("Expected tunnels to be removed, got %d", len(tunnels))
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,76 @@
+package loadtest
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnelclient"
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+)
+
+// tunnelHeartbeatInterval is the heartbeat interval of synthetic tunnels
+const tunnelHeartbeatInterval = 30 * time.Second
+
+// Tunnels are the synthetic tunnels of a load test. Their clients run in
+// this process and connect them to the echo backend over WebSocket.
+type Tunnels struct {
+	Hosts []string
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	errs   chan error
+}
+
+// StartTunnels creates count tunnels named prefix-1 to prefix-count, with
+// hostnames under domain, whose traffic goes to the local port of the echo
+// backend. Close removes them again.
+func StartTunnels(api *client.Client, apiURL string, count int, prefix, domain string, backendPort int, tlsConfig *tls.Config) (*Tunnels, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Tunnels{cancel: cancel, errs: make(chan error, count)}
+	for i := 1; i <= count; i++ {
+		id := fmt.Sprintf("%s-%d", prefix, i)
+		hostname := id + "." + domain
+		c, err := tunnelclient.New(api, apiURL, tunnelclient.Config{
+			TunnelID:          id,
+			Hostname:          hostname,
+			LocalHost:         "127.0.0.1",
+			LocalPort:         backendPort,
+			Transport:         tunnelclient.TransportWebSocket,
+			HeartbeatInterval: tunnelHeartbeatInterval,
+			TLSConfig:         tlsConfig,
+		})
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.Hosts = append(t.Hosts, hostname)
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			if err := c.Run(ctx); err != nil {
+				t.errs <- fmt.Errorf("tunnel %s: %v", id, err)
+			}
+		}()
+	}
+	return t, nil
+}
+
+// Err returns the error of a tunnel client that stopped, if any
+func (t *Tunnels) Err() error {
+	select {
+	case err := <-t.errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Close stops the tunnel clients, which remove their tunnels
+func (t *Tunnels) Close() {
+	t.cancel()
+	t.wg.Wait()
+}
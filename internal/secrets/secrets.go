@@ -0,0 +1,354 @@
+// Package secrets provides envelope encryption of the secrets the
+// easy-tunnel-lb-agent stores, such as private keys.
+//
+// Each secret is encrypted with AES-256-GCM under a random data key, and the
+// data key is encrypted (wrapped) with a key encryption key held in a local
+// keyring or in a KMS. Sealed secrets are text, so they can be stored in the
+// files that held the plaintext before.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// sealedPrefix starts every sealed secret, telling them from plaintext
+const sealedPrefix = "etlb-sealed:v1:"
+
+// KeySize is the size of key encryption and data keys in bytes
+const KeySize = 32
+
+// KeyWrapper encrypts and decrypts the data keys of sealed secrets
+type KeyWrapper interface {
+	// WrapKey encrypts a data key, returning the ID of the key encryption
+	// key it used
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+
+	// UnwrapKey decrypts a data key wrapped with the key encryption key
+	// keyID
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+
+	// Stale reports whether data keys wrapped with keyID should be wrapped
+	// again, because a newer key encryption key replaced it
+	Stale(keyID string) bool
+}
+
+// envelope is the encoding of a sealed secret
+type envelope struct {
+	KeyID      string `json:"k"`
+	WrappedKey []byte `json:"w"`
+	Nonce      []byte `json:"n"`
+	Ciphertext []byte `json:"c"`
+}
+
+// Box seals and opens secrets with the data keys a KeyWrapper wraps
+type Box struct {
+	wrapper KeyWrapper
+}
+
+// NewBox creates a box wrapping data keys with wrapper
+func NewBox(wrapper KeyWrapper) *Box {
+	return &Box{wrapper: wrapper}
+}
+
+// SetKMSToken replaces the token of a box whose keys are in a transit KMS;
+// other boxes ignore it
+func (b *Box) SetKMSToken(token string) {
+	if b == nil {
+		return
+	}
+	if kms, ok := b.wrapper.(*TransitKMS); ok {
+		kms.SetToken(token)
+	}
+}
+
+// IsSealed reports whether data is a sealed secret rather than plaintext
+func IsSealed(data []byte) bool {
+	return strings.HasPrefix(string(data), sealedPrefix)
+}
+
+// Seal encrypts a secret under a new data key
+func (b *Box) Seal(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	keyID, wrapped, err := b.wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	return encode(envelope{
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, nil),
+	})
+}
+
+// Open decrypts a sealed secret
+func (b *Box) Open(sealed []byte) ([]byte, error) {
+	env, err := decode(sealed)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := b.wrapper.UnwrapKey(env.KeyID, env.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid sealed secret: bad nonce")
+	}
+	plaintext, err := gcm.Open(nil, env.Nonce, env.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt sealed secret: corrupted data")
+	}
+	return plaintext, nil
+}
+
+// Stale reports whether a sealed secret's data key was wrapped with a key
+// encryption key that has since been rotated out
+func (b *Box) Stale(sealed []byte) bool {
+	env, err := decode(sealed)
+	return err == nil && b.wrapper.Stale(env.KeyID)
+}
+
+// Rewrap wraps the data key of a sealed secret with the current key
+// encryption key, leaving the encrypted secret itself as it is
+func (b *Box) Rewrap(sealed []byte) ([]byte, error) {
+	env, err := decode(sealed)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := b.wrapper.UnwrapKey(env.KeyID, env.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	env.KeyID, env.WrappedKey, err = b.wrapper.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	return encode(env)
+}
+
+// ReadFile reads a secret from a file that holds it sealed or, for files
+// written before encryption was configured, in plaintext. Files sealed
+// with a rotated key are wrapped with the current key in place. A nil box
+// reads files as they are.
+func (b *Box) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !IsSealed(data) {
+		return data, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("%s is sealed, but no secrets key is configured", path)
+	}
+	plaintext, err := b.Open(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if b.Stale(data) {
+		if rewrapped, err := b.Rewrap(data); err == nil {
+			// A failure leaves the file readable with the old key
+			_ = writeFile(path, rewrapped)
+		}
+	}
+	return plaintext, nil
+}
+
+// WriteFile seals a secret into a file readable only by its owner. A nil box
+// writes the plaintext.
+func (b *Box) WriteFile(path string, plaintext []byte) error {
+	if b == nil {
+		return writeFile(path, plaintext)
+	}
+	sealed, err := b.Seal(plaintext)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, sealed)
+}
+
+// writeFile replaces a file atomically with mode 0600
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func encode(env envelope) ([]byte, error) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sealedPrefix + base64.RawURLEncoding.EncodeToString(data) + "\n"), nil
+}
+
+func decode(sealed []byte) (envelope, error) {
+	var env envelope
+	text := strings.TrimSpace(string(sealed))
+	if !strings.HasPrefix(text, sealedPrefix) {
+		return env, errors.New("not a sealed secret")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(text, sealedPrefix))
+	if err != nil {
+		return env, fmt.Errorf("invalid sealed secret: %v", err)
+	}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return env, fmt.Errorf("invalid sealed secret: %v", err)
+	}
+	return env, nil
+}
+
+// Keyring wraps data keys with local key encryption keys. The first key is
+// the current one; the others only unwrap data keys wrapped before a
+// rotation.
+type Keyring struct {
+	ids  []string
+	keys map[string]cipher.AEAD
+}
+
+// ParseKeyring parses key encryption keys written as id:key, separated by
+// commas or newlines, with each key 32 bytes encoded in base64. The first
+// key is the current one. Blank lines and lines starting with # are
+// ignored.
+func ParseKeyring(spec string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid secrets key %q, use id:base64-key", redact(entry))
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("secrets key %s must be %d bytes encoded in base64", id, KeySize)
+		}
+		if _, exists := k.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate secrets key %s", id)
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		k.ids = append(k.ids, id)
+		k.keys[id] = gcm
+	}
+	if len(k.ids) == 0 {
+		return nil, errors.New("no secrets keys given")
+	}
+	return k, nil
+}
+
+// redact hides the key of an id:key entry in error messages
+func redact(entry string) string {
+	if id, _, found := strings.Cut(entry, ":"); found {
+		return id + ":<redacted>"
+	}
+	return "<redacted>"
+}
+
+// GenerateKey returns a new key encryption key with the given ID, in the
+// id:key form ParseKeyring reads
+func GenerateKey(id string) (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// WrapKey encrypts a data key with the current key
+func (k *Keyring) WrapKey(dataKey []byte) (string, []byte, error) {
+	id := k.ids[0]
+	gcm := k.keys[id]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return id, gcm.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+// UnwrapKey decrypts a data key with the key it was wrapped with
+func (k *Keyring) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	gcm, exists := k.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("unknown secrets key %s", keyID)
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("invalid wrapped data key")
+	}
+	nonce, ciphertext := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	dataKey, err := gcm.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with secrets key %s", keyID)
+	}
+	return dataKey, nil
+}
+
+// Stale reports whether keyID is not the current key
+func (k *Keyring) Stale(keyID string) bool {
+	return keyID != k.ids[0]
+}
+
+// Config selects where the key encryption keys of a Box come from: a
+// keyring or a transit KMS
+type Config struct {
+	Keys     string
+	KMSURL   string
+	KMSKey   string
+	KMSToken string
+}
+
+// FromConfig creates the box of the configured keys, or returns nil if none
+// are configured and secrets stay in plaintext
+func FromConfig(c Config) (*Box, error) {
+	switch {
+	case c.KMSURL != "":
+		return NewBox(NewTransitKMS(c.KMSURL, c.KMSKey, c.KMSToken)), nil
+	case c.Keys != "":
+		keyring, err := ParseKeyring(c.Keys)
+		if err != nil {
+			return nil, err
+		}
+		return NewBox(keyring), nil
+	}
+	return nil, nil
+}
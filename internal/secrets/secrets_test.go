@@ -0,0 +1,210 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustKeyring(t *testing.T, ids ...string) (*Keyring, []string) {
+	t.Helper()
+	var entries []string
+	for _, id := range ids {
+		entry, err := GenerateKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	keyring, err := ParseKeyring(strings.Join(entries, ","))
+	if err != nil {
+		t.Fatalf("ParseKeyring() error = %v", err)
+	}
+	return keyring, entries
+}
+
+func TestSealOpen(t *testing.T) {
+	keyring, _ := mustKeyring(t, "k1")
+	box := NewBox(keyring)
+
+	secret := []byte("server private key")
+	sealed, err := box.Seal(secret)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, secret) {
+		t.Fatalf("Expected a sealed secret, got %q", sealed)
+	}
+	opened, err := box.Open(sealed)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !bytes.Equal(opened, secret) {
+		t.Errorf("Open() = %q, want %q", opened, secret)
+	}
+
+	other, _ := mustKeyring(t, "k1")
+	if _, err := NewBox(other).Open(sealed); err == nil {
+		t.Error("Expected opening with another key to fail")
+	}
+	tampered := []byte(strings.Replace(string(sealed), sealedPrefix, sealedPrefix+"x", 1))
+	if _, err := box.Open(tampered); err == nil {
+		t.Error("Expected opening a corrupted secret to fail")
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	_, entries := mustKeyring(t, "new", "old")
+	keyring, err := ParseKeyring("# rotated 2026-10\n" + entries[0] + "\n\n" + entries[1] + "\n")
+	if err != nil {
+		t.Fatalf("ParseKeyring() error = %v", err)
+	}
+	if keyring.Stale("new") || !keyring.Stale("old") {
+		t.Error("Expected the first key to be the current one")
+	}
+
+	invalid := []string{
+		"",
+		"no-separator",
+		":" + strings.SplitN(entries[0], ":", 2)[1],
+		"short:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		entries[0] + "," + entries[0],
+	}
+	for _, spec := range invalid {
+		_, err := ParseKeyring(spec)
+		if err == nil {
+			t.Errorf("ParseKeyring(%q) expected error", spec)
+			continue
+		}
+		if key := strings.SplitN(entries[0], ":", 2)[1]; strings.Contains(err.Error(), key) {
+			t.Errorf("Expected the error to hide the key, got %v", err)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, entries := mustKeyring(t, "old")
+	sealed, err := NewBox(old).Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating prepends the new key and keeps the old one for reading
+	current, err := GenerateKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := ParseKeyring(current + "," + entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := NewBox(rotated)
+	if !box.Stale(sealed) {
+		t.Fatal("Expected a secret sealed with the old key to be stale")
+	}
+	rewrapped, err := box.Rewrap(sealed)
+	if err != nil {
+		t.Fatalf("Rewrap() error = %v", err)
+	}
+	if box.Stale(rewrapped) {
+		t.Error("Expected the rewrapped secret to use the current key")
+	}
+	if opened, err := box.Open(rewrapped); err != nil || string(opened) != "secret" {
+		t.Errorf("Open() = %q, %v", opened, err)
+	}
+}
+
+func TestReadWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	old, entries := mustKeyring(t, "old")
+
+	path := filepath.Join(dir, "key")
+	if err := NewBox(old).WriteFile(path, []byte("secret")); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the file written with mode 0600, got %v %v", info, err)
+	}
+	if _, err := (*Box)(nil).ReadFile(path); err == nil {
+		t.Error("Expected reading a sealed file without a key to fail")
+	}
+
+	current, err := GenerateKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := ParseKeyring(current + "," + entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := NewBox(rotated)
+	data, err := box.ReadFile(path)
+	if err != nil || string(data) != "secret" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+	sealed, _ := os.ReadFile(path)
+	if box.Stale(sealed) {
+		t.Error("Expected the file to be rewrapped with the current key")
+	}
+
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, []byte("legacy"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := box.ReadFile(plain); err != nil || string(data) != "legacy" {
+		t.Errorf("ReadFile() = %q, %v, want the plaintext", data, err)
+	}
+}
+
+func TestTransitKMS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		// The fake KMS "encrypts" by reversing the base64 plaintext
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/agent":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + reverse(req["plaintext"])}})
+		case "/v1/transit/decrypt/agent":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": reverse(strings.TrimPrefix(req["ciphertext"], "vault:v1:"))}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	box := NewBox(NewTransitKMS(server.URL+"/v1/transit/", "agent", "token"))
+	sealed, err := box.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if opened, err := box.Open(sealed); err != nil || string(opened) != "secret" {
+		t.Errorf("Open() = %q, %v", opened, err)
+	}
+	if box.Stale(sealed) {
+		t.Error("Expected a secret sealed with the transit key not to be stale")
+	}
+
+	box.SetKMSToken("wrong")
+	if _, err = box.Seal([]byte("secret")); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected the KMS error, got %v", err)
+	}
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
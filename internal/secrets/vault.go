@@ -0,0 +1,115 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultKeyPrefix starts the key IDs of data keys wrapped by a transit KMS
+const vaultKeyPrefix = "transit:"
+
+// TransitKMS wraps data keys with a key of a KMS speaking the HashiCorp
+// Vault (or OpenBao) transit API, which keeps the key encryption key out of
+// the agent. Rotating the transit key in the KMS needs no change here: the
+// KMS keeps decrypting data keys wrapped with older versions.
+type TransitKMS struct {
+	url    string
+	key    string
+	client *http.Client
+
+	mu    sync.RWMutex
+	token string
+}
+
+// NewTransitKMS creates a wrapper using the named key of the transit
+// secrets engine mounted at url, such as
+// https://vault.example.com:8200/v1/transit, authenticating with token
+func NewTransitKMS(url, key, token string) *TransitKMS {
+	return &TransitKMS{
+		url:    strings.TrimSuffix(url, "/"),
+		key:    key,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// SetToken replaces the token the KMS is called with, such as after it was
+// renewed
+func (k *TransitKMS) SetToken(token string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.token = token
+}
+
+// WrapKey encrypts a data key with the transit key
+func (k *TransitKMS) WrapKey(dataKey []byte) (string, []byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := k.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dataKey)}, &resp); err != nil {
+		return "", nil, err
+	}
+	return vaultKeyPrefix + k.key, []byte(resp.Data.Ciphertext), nil
+}
+
+// UnwrapKey decrypts a data key with the transit key
+func (k *TransitKMS) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != vaultKeyPrefix+k.key {
+		return nil, fmt.Errorf("data key was wrapped with %s, not transit key %s", keyID, k.key)
+	}
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := k.call("decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+// Stale reports whether keyID names another key than the transit key
+func (k *TransitKMS) Stale(keyID string) bool {
+	return keyID != vaultKeyPrefix+k.key
+}
+
+// call posts a request to an operation of the transit key
+func (k *TransitKMS) call(operation string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, k.url+"/"+operation+"/"+k.key, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	k.mu.RLock()
+	req.Header.Set("X-Vault-Token", k.token)
+	k.mu.RUnlock()
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("KMS %s failed: %v", operation, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("KMS %s failed with status %d: %s", operation, resp.StatusCode, strings.Join(failure.Errors, "; "))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid KMS %s response: %v", operation, err)
+	}
+	return nil
+}
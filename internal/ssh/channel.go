@@ -0,0 +1,239 @@
+// Package ssh adapts golang.org/x/crypto/ssh to what tunnels need:
+// password and public key authentication and remote port forwarding, so
+// that a stock OpenSSH client can expose a local service with "ssh -R".
+package ssh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// readChunkSize is the most data a channel reads from the connection at
+// once
+const readChunkSize = 32 * 1024
+
+var (
+	// ErrChannelClosed is returned for reads and writes after Close
+	ErrChannelClosed = errors.New("ssh: channel closed")
+	// ErrTimeout is returned when a deadline passes
+	ErrTimeout = timeoutError{}
+)
+
+// timeoutError is a net.Error so that callers recognize deadlines
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "ssh: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Channel is a channel of a connection; it is a net.Conn carrying the
+// channel's data. golang.org/x/crypto/ssh channels have no deadlines, so
+// reads are served from a goroutine reading the channel, and a write that
+// misses its deadline closes the channel.
+type Channel struct {
+	conn *Conn
+	ch   gossh.Channel
+
+	// forward the server opened the channel to, on clients
+	forward Forward
+
+	// chunks carries the data read from the channel; readErr is set
+	// before it is closed
+	chunks  chan []byte
+	readErr error
+
+	readMu  sync.Mutex
+	pending []byte
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// deadlineChanged is closed and replaced when a deadline changes, to
+	// wake up blocked readers and writers
+	deadlineChanged chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newChannel(c *Conn, ch gossh.Channel) *Channel {
+	channel := &Channel{
+		conn:            c,
+		ch:              ch,
+		chunks:          make(chan []byte),
+		deadlineChanged: make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+	go channel.readLoop()
+	return channel
+}
+
+func (ch *Channel) readLoop() {
+	buf := make([]byte, readChunkSize)
+	for {
+		n, err := ch.ch.Read(buf)
+		if n > 0 {
+			select {
+			case ch.chunks <- append([]byte(nil), buf[:n]...):
+			case <-ch.closed:
+				return
+			}
+		}
+		if err != nil {
+			ch.readErr = err
+			close(ch.chunks)
+			return
+		}
+	}
+}
+
+// deadline returns the read or write deadline and the channel closed when
+// it changes
+func (ch *Channel) deadline(write bool) (time.Time, <-chan struct{}) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if write {
+		return ch.writeDeadline, ch.deadlineChanged
+	}
+	return ch.readDeadline, ch.deadlineChanged
+}
+
+// wait returns a channel firing when deadline passes, nil for no deadline,
+// and the function releasing its timer
+func wait(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, timer.Stop
+}
+
+// Read reads data of the channel, returning io.EOF once the peer closed
+// its side
+func (ch *Channel) Read(p []byte) (int, error) {
+	ch.readMu.Lock()
+	defer ch.readMu.Unlock()
+
+	for len(ch.pending) == 0 {
+		deadline, changed := ch.deadline(false)
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, ErrTimeout
+		}
+		expired, stop := wait(deadline)
+		select {
+		case chunk, ok := <-ch.chunks:
+			stop()
+			if !ok {
+				return 0, ch.readErr
+			}
+			ch.pending = chunk
+		case <-ch.closed:
+			stop()
+			return 0, ErrChannelClosed
+		case <-expired:
+			return 0, ErrTimeout
+		case <-changed:
+			stop()
+		}
+	}
+	n := copy(p, ch.pending)
+	ch.pending = ch.pending[n:]
+	return n, nil
+}
+
+// Write sends p, blocking while the peer's window is full
+func (ch *Channel) Write(p []byte) (int, error) {
+	deadline, _ := ch.deadline(true)
+	if deadline.IsZero() {
+		return ch.ch.Write(p)
+	}
+	if !time.Now().Before(deadline) {
+		return 0, ErrTimeout
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	written := make(chan result, 1)
+	go func() {
+		n, err := ch.ch.Write(p)
+		written <- result{n: n, err: err}
+	}()
+	for {
+		deadline, changed := ch.deadline(true)
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			// The pending write cannot be taken back
+			ch.Close()
+			return 0, ErrTimeout
+		}
+		expired, stop := wait(deadline)
+		select {
+		case r := <-written:
+			stop()
+			return r.n, r.err
+		case <-expired:
+			ch.Close()
+			return 0, ErrTimeout
+		case <-changed:
+			stop()
+		}
+	}
+}
+
+// CloseWrite tells the peer that no more data is sent
+func (ch *Channel) CloseWrite() error {
+	return ch.ch.CloseWrite()
+}
+
+// Close closes the channel in both directions
+func (ch *Channel) Close() error {
+	ch.closeOnce.Do(func() {
+		close(ch.closed)
+		ch.ch.Close()
+	})
+	return nil
+}
+
+// LocalAddr returns the local address of the channel's connection
+func (ch *Channel) LocalAddr() net.Addr {
+	return ch.conn.conn.LocalAddr()
+}
+
+// RemoteAddr returns the peer's address
+func (ch *Channel) RemoteAddr() net.Addr {
+	return ch.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadline
+func (ch *Channel) SetDeadline(t time.Time) error {
+	ch.setDeadline(func() {
+		ch.readDeadline, ch.writeDeadline = t, t
+	})
+	return nil
+}
+
+// SetReadDeadline sets the deadline of reads, including blocked ones
+func (ch *Channel) SetReadDeadline(t time.Time) error {
+	ch.setDeadline(func() { ch.readDeadline = t })
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of writes, including blocked ones
+func (ch *Channel) SetWriteDeadline(t time.Time) error {
+	ch.setDeadline(func() { ch.writeDeadline = t })
+	return nil
+}
+
+func (ch *Channel) setDeadline(set func()) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	set()
+	close(ch.deadlineChanged)
+	ch.deadlineChanged = make(chan struct{})
+}
@@ -0,0 +1,101 @@
+// Package ssh adapts golang.org/x/crypto/ssh to what tunnels need:
+// password and public key authentication and remote port forwarding, so
+// that a stock OpenSSH client can expose a local service with "ssh -R".
+package ssh
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ClientConfig configures the client side of connections
+type ClientConfig struct {
+	User string
+
+	// Key and Password authenticate the user; the key is tried first
+	Key      ed25519.PrivateKey
+	Password string
+
+	// HostKeyCallback verifies the server's host key
+	HostKeyCallback func(key *PublicKey) error
+}
+
+// clientConfig translates config for golang.org/x/crypto/ssh
+func (config *ClientConfig) clientConfig() (*gossh.ClientConfig, error) {
+	if config.HostKeyCallback == nil {
+		return nil, errors.New("ssh: no host key callback configured")
+	}
+	c := &gossh.ClientConfig{
+		User:          config.User,
+		ClientVersion: Version,
+		HostKeyCallback: func(_ string, _ net.Addr, key gossh.PublicKey) error {
+			return config.HostKeyCallback(&PublicKey{key: key})
+		},
+	}
+	if config.Key != nil {
+		signer, err := gossh.NewSignerFromKey(config.Key)
+		if err != nil {
+			return nil, err
+		}
+		c.Auth = append(c.Auth, gossh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		c.Auth = append(c.Auth, gossh.Password(config.Password))
+	}
+	return c, nil
+}
+
+// NewClientConn exchanges keys with the server of conn and authenticates.
+// The caller must run Serve for the connection to make progress.
+func NewClientConn(conn net.Conn, config *ClientConfig) (*Conn, error) {
+	c, err := config.clientConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	client, channels, requests, err := gossh.NewClientConn(conn, conn.RemoteAddr().String(), c)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newConn(client, channels, requests, true), nil
+}
+
+// RequestForward asks the server to forward connections to f to this
+// client. For port 0 the server's choice of port is returned.
+func (c *Conn) RequestForward(f Forward) (Forward, error) {
+	ok, reply, err := c.SendRequest(RequestForward, true, gossh.Marshal(&f))
+	if err != nil {
+		return Forward{}, err
+	}
+	if !ok {
+		return Forward{}, errors.New("ssh: forward rejected")
+	}
+	if f.Port == 0 {
+		var allocated forwardReply
+		if err := gossh.Unmarshal(reply, &allocated); err != nil {
+			return Forward{}, err
+		}
+		f.Port = allocated.Port
+	}
+	return f, nil
+}
+
+// AcceptForwarded waits for the server to open a channel to one of the
+// client's forwards
+func (c *Conn) AcceptForwarded() (*Channel, Forward, error) {
+	select {
+	case ch := <-c.forwarded:
+		return ch, ch.forward, nil
+	case <-c.done:
+		return nil, Forward{}, c.err
+	}
+}
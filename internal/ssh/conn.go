@@ -0,0 +1,166 @@
+// Package ssh adapts golang.org/x/crypto/ssh to what tunnels need:
+// password and public key authentication and remote port forwarding, so
+// that a stock OpenSSH client can expose a local service with "ssh -R".
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrConnClosed is returned for operations on a closed connection
+var ErrConnClosed = errors.New("ssh: connection closed")
+
+// forwardedBacklog is how many forwarded channels wait for AcceptForwarded
+const forwardedBacklog = 64
+
+// RequestHandler answers a global request such as "tcpip-forward"; reply
+// is the payload of a successful response
+type RequestHandler func(name string, payload []byte) (ok bool, reply []byte)
+
+// Conn is an authenticated connection, carrying global requests and
+// channels in both directions
+type Conn struct {
+	conn     gossh.Conn
+	requests <-chan *gossh.Request
+
+	// err is why the connection closed, set before done is closed
+	err  error
+	done chan struct{}
+
+	// forwarded queues the channels the server opens to a client's
+	// forwards; nil on servers, which reject channels opened by clients
+	forwarded chan *Channel
+}
+
+func newConn(conn gossh.Conn, channels <-chan gossh.NewChannel, requests <-chan *gossh.Request, isClient bool) *Conn {
+	c := &Conn{
+		conn:     conn,
+		requests: requests,
+		done:     make(chan struct{}),
+	}
+	if isClient {
+		c.forwarded = make(chan *Channel, forwardedBacklog)
+	}
+	go c.handleChannels(channels)
+	go func() {
+		err := conn.Wait()
+		if err == nil || errors.Is(err, io.EOF) {
+			err = ErrConnClosed
+		}
+		c.err = err
+		close(c.done)
+	}()
+	return c
+}
+
+// User returns the authenticated user
+func (c *Conn) User() string {
+	return c.conn.User()
+}
+
+// RemoteAddr returns the peer's address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Done is closed once the connection is closed
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection and all its channels
+func (c *Conn) Close() error {
+	c.conn.Close()
+	return nil
+}
+
+// Serve handles the peer's global requests with handler until the
+// connection closes
+func (c *Conn) Serve(handler RequestHandler) error {
+	for req := range c.requests {
+		ok, reply := handler(req.Type, req.Payload)
+		if req.WantReply {
+			req.Reply(ok, reply)
+		}
+	}
+	<-c.done
+	return c.err
+}
+
+// handleChannels answers the channels the peer opens. Servers reject them,
+// as only remote forwarding is supported; clients queue the channels to
+// their forwards for AcceptForwarded.
+func (c *Conn) handleChannels(channels <-chan gossh.NewChannel) {
+	for open := range channels {
+		if c.forwarded == nil {
+			open.Reject(gossh.Prohibited, "only remote forwarding (ssh -N -R) is supported")
+			continue
+		}
+		var data forwardedChannel
+		if open.ChannelType() != channelForwarded {
+			open.Reject(gossh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		if err := gossh.Unmarshal(open.ExtraData(), &data); err != nil {
+			open.Reject(gossh.ConnectionFailed, "malformed forward")
+			continue
+		}
+		ch, requests, err := open.Accept()
+		if err != nil {
+			continue
+		}
+		go gossh.DiscardRequests(requests)
+
+		channel := newChannel(c, ch)
+		channel.forward = Forward{Address: data.Address, Port: data.Port}
+		select {
+		case c.forwarded <- channel:
+		default:
+			channel.Close()
+		}
+	}
+}
+
+// SendRequest sends a global request and waits for its reply if wantReply
+// is set, returning whether it succeeded and the reply's payload
+func (c *Conn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	return c.conn.SendRequest(name, wantReply, payload)
+}
+
+// OpenChannel opens a channel of kind to the peer, e.g.
+// "forwarded-tcpip", with the type specific data extra
+func (c *Conn) OpenChannel(ctx context.Context, kind string, extra []byte) (*Channel, error) {
+	type result struct {
+		ch  gossh.Channel
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		ch, requests, err := c.conn.OpenChannel(kind, extra)
+		if err == nil {
+			go gossh.DiscardRequests(requests)
+		}
+		opened <- result{ch: ch, err: err}
+	}()
+
+	select {
+	case r := <-opened:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return newChannel(c, r.ch), nil
+	case <-ctx.Done():
+		// The peer's answer still has to be processed
+		go func() {
+			if r := <-opened; r.err == nil {
+				r.ch.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+// Package ssh adapts golang.org/x/crypto/ssh to what tunnels need:
+// password and public key authentication and remote port forwarding, so
+// that a stock OpenSSH client can expose a local service with "ssh -R".
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Global requests of remote port forwarding (RFC 4254, section 7)
+const (
+	RequestForward       = "tcpip-forward"
+	RequestCancelForward = "cancel-tcpip-forward"
+)
+
+// channelForwarded is the type of channels opened to a remote forward
+const channelForwarded = "forwarded-tcpip"
+
+// Forward is a remote port forward requested by a client
+type Forward struct {
+	Address string
+	Port    uint32
+}
+
+// forwardReply is the reply to a forward request for port 0
+type forwardReply struct {
+	Port uint32
+}
+
+// forwardedChannel is the data of a channel opened to a forward
+type forwardedChannel struct {
+	Address    string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// ParseForward decodes the payload of a forward or cancel request
+func ParseForward(payload []byte) (Forward, error) {
+	var f Forward
+	if err := gossh.Unmarshal(payload, &f); err != nil {
+		return Forward{}, err
+	}
+	if f.Port > 65535 {
+		return Forward{}, errors.New("ssh: invalid forward port")
+	}
+	return f, nil
+}
+
+// ForwardReply is the reply to a forward request for port 0, telling the
+// client the port allocated instead
+func ForwardReply(port uint32) []byte {
+	return gossh.Marshal(&forwardReply{Port: port})
+}
+
+// OpenForwarded opens a channel to a forward for a connection from origin,
+// which the client connects to its local target
+func (c *Conn) OpenForwarded(ctx context.Context, f Forward, origin net.Addr) (*Channel, error) {
+	data := forwardedChannel{Address: f.Address, Port: f.Port, OriginHost: "127.0.0.1"}
+	if origin != nil {
+		if host, port, err := net.SplitHostPort(origin.String()); err == nil {
+			p, _ := strconv.Atoi(port)
+			data.OriginHost, data.OriginPort = host, uint32(p)
+		}
+	}
+	return c.OpenChannel(ctx, channelForwarded, gossh.Marshal(&data))
+}
@@ -0,0 +1,177 @@
+// Package ssh adapts golang.org/x/crypto/ssh to what tunnels need:
+// password and public key authentication and remote port forwarding, so
+// that a stock OpenSSH client can expose a local service with "ssh -R".
+package ssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/secrets"
+)
+
+// minRSABits is the smallest RSA key accepted for authentication
+const minRSABits = 2048
+
+// PublicKey is a public key a client authenticates with or a server
+// presents as host key
+type PublicKey struct {
+	key gossh.PublicKey
+}
+
+// ParsePublicKey parses a public key in the SSH wire format
+func ParsePublicKey(blob []byte) (*PublicKey, error) {
+	key, err := gossh.ParsePublicKey(blob)
+	if err != nil {
+		return nil, err
+	}
+	return newPublicKey(key)
+}
+
+// newPublicKey wraps key, rejecting certificates and weak RSA keys
+func newPublicKey(key gossh.PublicKey) (*PublicKey, error) {
+	if _, ok := key.(*gossh.Certificate); ok {
+		return nil, errors.New("ssh: certificates are not supported")
+	}
+	if crypto, ok := key.(gossh.CryptoPublicKey); ok {
+		if rsaKey, ok := crypto.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSABits {
+			return nil, errors.New("ssh: unsupported rsa key")
+		}
+	}
+	return &PublicKey{key: key}, nil
+}
+
+// ParseAuthorizedKey parses a public key in the authorized_keys format,
+// e.g. "ssh-ed25519 AAAA... user@host"
+func ParseAuthorizedKey(line string) (*PublicKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.New("ssh: expected key type and base64 key")
+	}
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	if key.Type() != fields[0] {
+		return nil, fmt.Errorf("ssh: key type %q does not match key", fields[0])
+	}
+	return newPublicKey(key)
+}
+
+// Type returns the key's type, e.g. "ssh-ed25519"
+func (k *PublicKey) Type() string {
+	return k.key.Type()
+}
+
+// Marshal returns the key in the SSH wire format
+func (k *PublicKey) Marshal() []byte {
+	return k.key.Marshal()
+}
+
+// Equal reports whether both keys are the same
+func (k *PublicKey) Equal(other *PublicKey) bool {
+	return other != nil && bytes.Equal(k.key.Marshal(), other.key.Marshal())
+}
+
+// Fingerprint returns the key's SHA256 fingerprint as shown by ssh-keygen
+func (k *PublicKey) Fingerprint() string {
+	return gossh.FingerprintSHA256(k.key)
+}
+
+// HostKeyFingerprint returns the SHA256 fingerprint clients are shown for
+// the host key
+func HostKeyFingerprint(key ed25519.PrivateKey) string {
+	public, err := gossh.NewPublicKey(key.Public())
+	if err != nil {
+		return ""
+	}
+	return gossh.FingerprintSHA256(public)
+}
+
+// GenerateHostKey generates an ed25519 host key
+func GenerateHostKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// LoadHostKey reads an ed25519 host key in the OpenSSH (ssh-keygen -t
+// ed25519) or PKCS #8 PEM format. If the file does not exist, a new key is
+// generated and saved to it, so clients see the same key across restarts.
+// With a box, the key is saved sealed and a key found in plaintext is
+// sealed in place; a nil box keeps the key in plaintext.
+func LoadHostKey(path string, box *secrets.Box) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := GenerateHostKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate host key: %v", err)
+		}
+		if err := saveHostKey(path, key, box); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %v", err)
+	}
+	sealed := secrets.IsSealed(data)
+	if sealed {
+		if data, err = box.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read host key: %v", err)
+		}
+	}
+	key, err := ParseHostKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if box != nil && !sealed {
+		if err := box.WriteFile(path, data); err != nil {
+			return nil, fmt.Errorf("failed to seal host key: %v", err)
+		}
+	}
+	return key, nil
+}
+
+// saveHostKey writes a host key in the PKCS #8 PEM format, sealed with box
+// unless it is nil
+func saveHostKey(path string, key ed25519.PrivateKey, box *secrets.Box) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode host key: %v", err)
+	}
+	if err := box.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		return fmt.Errorf("failed to save host key: %v", err)
+	}
+	return nil
+}
+
+// ParseHostKey parses a PEM encoded ed25519 private key in the OpenSSH or
+// PKCS #8 format
+func ParseHostKey(data []byte) (ed25519.PrivateKey, error) {
+	key, err := gossh.ParseRawPrivateKey(data)
+	var missing *gossh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("ssh: encrypted host keys are not supported")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh: invalid host key: %v", err)
+	}
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ed25519.PrivateKey:
+		return *key, nil
+	default:
+		return nil, errors.New("ssh: host key must be an ed25519 key")
+	}
+}
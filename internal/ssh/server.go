@@ -0,0 +1,96 @@
+// Package ssh adapts golang.org/x/crypto/ssh to what tunnels need:
+// password and public key authentication and remote port forwarding, so
+// that a stock OpenSSH client can expose a local service with "ssh -R".
+package ssh
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// handshakeTimeout limits the time to exchange keys and authenticate
+	handshakeTimeout = 30 * time.Second
+
+	// defaultMaxAuthTries is how many authentication attempts a
+	// connection gets by default
+	defaultMaxAuthTries = 6
+)
+
+// Version is the identification string the agent sends
+const Version = "SSH-2.0-easy-tunnel"
+
+// ServerConfig configures the server side of connections
+type ServerConfig struct {
+	HostKey ed25519.PrivateKey
+
+	// PasswordCallback authenticates a user with a password, nil disables
+	// password authentication
+	PasswordCallback func(user, password string) error
+
+	// PublicKeyCallback authenticates a user with a public key the client
+	// proved to hold, nil disables public key authentication
+	PublicKeyCallback func(user string, key *PublicKey) error
+
+	// MaxAuthTries limits the authentication attempts of a connection,
+	// defaults to 6
+	MaxAuthTries int
+}
+
+// serverConfig translates config for golang.org/x/crypto/ssh
+func (config *ServerConfig) serverConfig() (*gossh.ServerConfig, error) {
+	if config.HostKey == nil {
+		return nil, errors.New("ssh: no host key configured")
+	}
+	signer, err := gossh.NewSignerFromKey(config.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	maxTries := config.MaxAuthTries
+	if maxTries <= 0 {
+		maxTries = defaultMaxAuthTries
+	}
+	c := &gossh.ServerConfig{
+		MaxAuthTries:  maxTries,
+		ServerVersion: Version,
+	}
+	c.AddHostKey(signer)
+	if config.PasswordCallback != nil {
+		c.PasswordCallback = func(meta gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			return nil, config.PasswordCallback(meta.User(), string(password))
+		}
+	}
+	if config.PublicKeyCallback != nil {
+		c.PublicKeyCallback = func(meta gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			public, err := newPublicKey(key)
+			if err != nil {
+				return nil, err
+			}
+			return nil, config.PublicKeyCallback(meta.User(), public)
+		}
+	}
+	return c, nil
+}
+
+// NewServerConn exchanges keys with the client of conn and authenticates it
+func NewServerConn(conn net.Conn, config *ServerConfig) (*Conn, error) {
+	c, err := config.serverConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	server, channels, requests, err := gossh.NewServerConn(conn, c)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return newConn(server, channels, requests, false), nil
+}
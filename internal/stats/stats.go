@@ -0,0 +1,399 @@
+// Package stats provides per-tunnel traffic accounting for the easy-tunnel-lb-agent.
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TCPDurationBuckets are the upper bounds in seconds of the buckets TCP
+// connection durations are counted in
+var TCPDurationBuckets = []float64{0.1, 1, 10, 60, 300, 1800, 3600}
+
+// TunnelStats holds the live traffic counters for a single tunnel.
+// Bytes received flow from public clients into the tunnel; bytes sent flow
+// from the tunnel back to public clients.
+type TunnelStats struct {
+	bytesSent         atomic.Int64
+	bytesReceived     atomic.Int64
+	requests          atomic.Int64
+	activeConnections atomic.Int64
+	retries           atomic.Int64
+	denied            atomic.Int64
+	rateLimited       atomic.Int64
+
+	// Connections proxied by the TCP and TLS passthrough listeners
+	tcpAccepted     atomic.Int64
+	tcpActive       atomic.Int64
+	tcpBytesIn      atomic.Int64
+	tcpBytesOut     atomic.Int64
+	tcpDialFailures atomic.Int64
+
+	tcpDurationsMu sync.Mutex
+	tcpDurations   Histogram
+
+	countriesMu sync.Mutex
+	countries   map[string]int64
+
+	proxyErrorsMu sync.Mutex
+	proxyErrors   map[string]int64
+
+	filteredMu sync.Mutex
+	filtered   map[string]int64
+}
+
+// Snapshot is a point-in-time copy of a tunnel's counters
+type Snapshot struct {
+	BytesSent         int64
+	BytesReceived     int64
+	Requests          int64
+	ActiveConnections int64
+	Retries           int64
+	Denied            int64
+	RateLimited       int64
+
+	// TCP connections accepted for the tunnel, open, their bytes from and
+	// to clients, and those whose target could not be dialed
+	TCPAccepted     int64
+	TCPActive       int64
+	TCPBytesIn      int64
+	TCPBytesOut     int64
+	TCPDialFailures int64
+}
+
+// Histogram counts observations in cumulative buckets, as Prometheus
+// histograms do
+type Histogram struct {
+	// Buckets counts the observations of at most each bound of Bounds
+	Bounds  []float64
+	Buckets []int64
+	Sum     float64
+	Count   int64
+}
+
+// observe counts a value
+func (h *Histogram) observe(value float64) {
+	for i, bound := range h.Bounds {
+		if value <= bound {
+			h.Buckets[i]++
+		}
+	}
+	h.Sum += value
+	h.Count++
+}
+
+// newTCPDurations returns an empty histogram of TCP connection durations
+func newTCPDurations() Histogram {
+	return Histogram{Bounds: TCPDurationBuckets, Buckets: make([]int64, len(TCPDurationBuckets))}
+}
+
+// clone returns a copy of the histogram
+func (h *Histogram) clone() Histogram {
+	return Histogram{
+		Bounds:  h.Bounds,
+		Buckets: append([]int64(nil), h.Buckets...),
+		Sum:     h.Sum,
+		Count:   h.Count,
+	}
+}
+
+// AddBytesSent records bytes sent to public clients
+func (s *TunnelStats) AddBytesSent(n int64) {
+	s.bytesSent.Add(n)
+}
+
+// AddBytesReceived records bytes received from public clients
+func (s *TunnelStats) AddBytesReceived(n int64) {
+	s.bytesReceived.Add(n)
+}
+
+// IncRequests records a proxied HTTP request or accepted TCP connection
+func (s *TunnelStats) IncRequests() {
+	s.requests.Add(1)
+}
+
+// IncRetries records a proxied request retried after the tunnel could not
+// be reached
+func (s *TunnelStats) IncRetries() {
+	s.retries.Add(1)
+}
+
+// IncDenied records a request or connection refused by the tunnel's
+// access lists
+func (s *TunnelStats) IncDenied() {
+	s.denied.Add(1)
+}
+
+// IncRateLimited records a request or connection refused because its
+// client was over its rate or connection limit
+func (s *TunnelStats) IncRateLimited() {
+	s.rateLimited.Add(1)
+}
+
+// IncCountry records a request or connection from a client in a country;
+// unknown countries ("") are not counted
+func (s *TunnelStats) IncCountry(country string) {
+	if country == "" {
+		return
+	}
+	s.countriesMu.Lock()
+	defer s.countriesMu.Unlock()
+	if s.countries == nil {
+		s.countries = make(map[string]int64)
+	}
+	s.countries[country]++
+}
+
+// Countries returns a copy of the requests and connections by client
+// country
+func (s *TunnelStats) Countries() map[string]int64 {
+	s.countriesMu.Lock()
+	defer s.countriesMu.Unlock()
+	countries := make(map[string]int64, len(s.countries))
+	for country, n := range s.countries {
+		countries[country] = n
+	}
+	return countries
+}
+
+// IncProxyError records a request that could not be proxied, by the cause
+// of the failure
+func (s *TunnelStats) IncProxyError(cause string) {
+	s.proxyErrorsMu.Lock()
+	defer s.proxyErrorsMu.Unlock()
+	if s.proxyErrors == nil {
+		s.proxyErrors = make(map[string]int64)
+	}
+	s.proxyErrors[cause]++
+}
+
+// ProxyErrors returns a copy of the requests that could not be proxied by
+// cause
+func (s *TunnelStats) ProxyErrors() map[string]int64 {
+	s.proxyErrorsMu.Lock()
+	defer s.proxyErrorsMu.Unlock()
+	counts := make(map[string]int64, len(s.proxyErrors))
+	for cause, n := range s.proxyErrors {
+		counts[cause] = n
+	}
+	return counts
+}
+
+// IncFiltered records a request blocked by the named request filter rule
+func (s *TunnelStats) IncFiltered(rule string) {
+	s.filteredMu.Lock()
+	defer s.filteredMu.Unlock()
+	if s.filtered == nil {
+		s.filtered = make(map[string]int64)
+	}
+	s.filtered[rule]++
+}
+
+// Filtered returns a copy of the requests blocked by request filter rules
+// by rule name
+func (s *TunnelStats) Filtered() map[string]int64 {
+	s.filteredMu.Lock()
+	defer s.filteredMu.Unlock()
+	counts := make(map[string]int64, len(s.filtered))
+	for rule, n := range s.filtered {
+		counts[rule] = n
+	}
+	return counts
+}
+
+// IncTCPAccepted records a TCP connection accepted for the tunnel
+func (s *TunnelStats) IncTCPAccepted() {
+	s.tcpAccepted.Add(1)
+}
+
+// TCPConnectionOpened records the start of a proxied TCP connection
+func (s *TunnelStats) TCPConnectionOpened() {
+	s.tcpActive.Add(1)
+}
+
+// TCPConnectionClosed records the end of a proxied TCP connection
+func (s *TunnelStats) TCPConnectionClosed() {
+	s.tcpActive.Add(-1)
+}
+
+// AddTCPBytesIn records bytes of TCP connections received from clients
+func (s *TunnelStats) AddTCPBytesIn(n int64) {
+	s.tcpBytesIn.Add(n)
+}
+
+// AddTCPBytesOut records bytes of TCP connections sent to clients
+func (s *TunnelStats) AddTCPBytesOut(n int64) {
+	s.tcpBytesOut.Add(n)
+}
+
+// IncTCPDialFailures records a TCP connection whose target could not be
+// dialed
+func (s *TunnelStats) IncTCPDialFailures() {
+	s.tcpDialFailures.Add(1)
+}
+
+// ObserveTCPDuration records how long a proxied TCP connection was open
+func (s *TunnelStats) ObserveTCPDuration(d time.Duration) {
+	s.tcpDurationsMu.Lock()
+	defer s.tcpDurationsMu.Unlock()
+	if s.tcpDurations.Bounds == nil {
+		s.tcpDurations = newTCPDurations()
+	}
+	s.tcpDurations.observe(d.Seconds())
+}
+
+// TCPDurations returns a copy of the durations of the tunnel's proxied
+// TCP connections in seconds
+func (s *TunnelStats) TCPDurations() Histogram {
+	s.tcpDurationsMu.Lock()
+	defer s.tcpDurationsMu.Unlock()
+	if s.tcpDurations.Bounds == nil {
+		return newTCPDurations()
+	}
+	return s.tcpDurations.clone()
+}
+
+// ConnectionOpened records the start of an active connection
+func (s *TunnelStats) ConnectionOpened() {
+	s.activeConnections.Add(1)
+}
+
+// ConnectionClosed records the end of an active connection
+func (s *TunnelStats) ConnectionClosed() {
+	s.activeConnections.Add(-1)
+}
+
+// Snapshot returns a copy of the current counters
+func (s *TunnelStats) Snapshot() Snapshot {
+	return Snapshot{
+		BytesSent:         s.bytesSent.Load(),
+		BytesReceived:     s.bytesReceived.Load(),
+		Requests:          s.requests.Load(),
+		ActiveConnections: s.activeConnections.Load(),
+		Retries:           s.retries.Load(),
+		Denied:            s.denied.Load(),
+		RateLimited:       s.rateLimited.Load(),
+		TCPAccepted:       s.tcpAccepted.Load(),
+		TCPActive:         s.tcpActive.Load(),
+		TCPBytesIn:        s.tcpBytesIn.Load(),
+		TCPBytesOut:       s.tcpBytesOut.Load(),
+		TCPDialFailures:   s.tcpDialFailures.Load(),
+	}
+}
+
+// Collector tracks traffic statistics for all tunnels
+type Collector struct {
+	mu      sync.RWMutex
+	tunnels map[string]*TunnelStats
+}
+
+// NewCollector creates a new statistics collector
+func NewCollector() *Collector {
+	return &Collector{
+		tunnels: make(map[string]*TunnelStats),
+	}
+}
+
+// Tunnel returns the counters for a tunnel, creating them if needed
+func (c *Collector) Tunnel(id string) *TunnelStats {
+	c.mu.RLock()
+	s, exists := c.tunnels[id]
+	c.mu.RUnlock()
+	if exists {
+		return s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, exists = c.tunnels[id]; !exists {
+		s = &TunnelStats{}
+		c.tunnels[id] = s
+	}
+	return s
+}
+
+// Get returns a snapshot of a tunnel's counters
+func (c *Collector) Get(id string) Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if s, exists := c.tunnels[id]; exists {
+		return s.Snapshot()
+	}
+	return Snapshot{}
+}
+
+// Countries returns a tunnel's requests and connections by client country
+func (c *Collector) Countries(id string) map[string]int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, exists := c.tunnels[id]; exists {
+		return s.Countries()
+	}
+	return map[string]int64{}
+}
+
+// ProxyErrors returns a tunnel's requests that could not be proxied by cause
+func (c *Collector) ProxyErrors(id string) map[string]int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, exists := c.tunnels[id]; exists {
+		return s.ProxyErrors()
+	}
+	return map[string]int64{}
+}
+
+// Filtered returns a tunnel's requests blocked by request filter rules by
+// rule name
+func (c *Collector) Filtered(id string) map[string]int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, exists := c.tunnels[id]; exists {
+		return s.Filtered()
+	}
+	return map[string]int64{}
+}
+
+// TCPDurations returns the durations of a tunnel's proxied TCP connections
+func (c *Collector) TCPDurations(id string) Histogram {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if s, exists := c.tunnels[id]; exists {
+		return s.TCPDurations()
+	}
+	return newTCPDurations()
+}
+
+// Remove discards the counters for a tunnel
+func (c *Collector) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tunnels, id)
+}
+
+// Totals returns the counters aggregated across all tunnels
+func (c *Collector) Totals() Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var total Snapshot
+	for _, s := range c.tunnels {
+		snap := s.Snapshot()
+		total.BytesSent += snap.BytesSent
+		total.BytesReceived += snap.BytesReceived
+		total.Requests += snap.Requests
+		total.ActiveConnections += snap.ActiveConnections
+		total.Retries += snap.Retries
+		total.Denied += snap.Denied
+		total.RateLimited += snap.RateLimited
+		total.TCPAccepted += snap.TCPAccepted
+		total.TCPActive += snap.TCPActive
+		total.TCPBytesIn += snap.TCPBytesIn
+		total.TCPBytesOut += snap.TCPBytesOut
+		total.TCPDialFailures += snap.TCPDialFailures
+	}
+	return total
+}
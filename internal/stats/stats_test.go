@@ -0,0 +1,137 @@
+package stats
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	collector := NewCollector()
+
+	first := collector.Tunnel("test-1")
+	if collector.Tunnel("test-1") != first {
+		t.Error("Expected the same counters for repeated lookups")
+	}
+
+	first.IncRequests()
+	first.AddBytesReceived(100)
+	first.AddBytesSent(250)
+	first.ConnectionOpened()
+
+	second := collector.Tunnel("test-2")
+	second.IncRequests()
+	second.AddBytesSent(50)
+	second.IncRetries()
+	second.IncDenied()
+	second.IncRateLimited()
+
+	snap := collector.Get("test-1")
+	if snap.Requests != 1 || snap.BytesReceived != 100 || snap.BytesSent != 250 || snap.ActiveConnections != 1 {
+		t.Errorf("Unexpected snapshot for test-1: %+v", snap)
+	}
+
+	totals := collector.Totals()
+	if totals.Requests != 2 {
+		t.Errorf("Expected 2 total requests, got %d", totals.Requests)
+	}
+	if totals.BytesSent != 300 {
+		t.Errorf("Expected 300 total bytes sent, got %d", totals.BytesSent)
+	}
+	if totals.Retries != 1 {
+		t.Errorf("Expected 1 total retry, got %d", totals.Retries)
+	}
+	if totals.Denied != 1 {
+		t.Errorf("Expected 1 total denied request, got %d", totals.Denied)
+	}
+	if totals.RateLimited != 1 {
+		t.Errorf("Expected 1 total rate limited request, got %d", totals.RateLimited)
+	}
+
+	second.IncProxyError("timeout")
+	second.IncProxyError("timeout")
+	second.IncProxyError("connection_refused")
+	if counted := collector.ProxyErrors("test-2"); len(counted) != 2 || counted["timeout"] != 2 || counted["connection_refused"] != 1 {
+		t.Errorf("Unexpected proxy errors for test-2: %v", counted)
+	}
+	if counted := collector.ProxyErrors("unknown"); len(counted) != 0 {
+		t.Errorf("Expected no proxy errors for an unknown tunnel, got %v", counted)
+	}
+
+	second.IncFiltered("scanners")
+	second.IncFiltered("scanners")
+	if counted := collector.Filtered("test-2"); len(counted) != 1 || counted["scanners"] != 2 {
+		t.Errorf("Unexpected filtered requests for test-2: %v", counted)
+	}
+
+	second.IncTCPAccepted()
+	second.TCPConnectionOpened()
+	second.AddTCPBytesIn(10)
+	second.AddTCPBytesOut(40)
+	second.IncTCPDialFailures()
+	if snap := collector.Get("test-2"); snap.TCPAccepted != 1 || snap.TCPActive != 1 || snap.TCPBytesIn != 10 || snap.TCPBytesOut != 40 || snap.TCPDialFailures != 1 {
+		t.Errorf("Unexpected TCP counters for test-2: %+v", snap)
+	}
+	second.TCPConnectionClosed()
+	if totals := collector.Totals(); totals.TCPAccepted != 1 || totals.TCPActive != 0 {
+		t.Errorf("Unexpected TCP totals: %+v", totals)
+	}
+
+	first.ConnectionClosed()
+	if active := collector.Get("test-1").ActiveConnections; active != 0 {
+		t.Errorf("Expected 0 active connections, got %d", active)
+	}
+
+	collector.Remove("test-1")
+	if snap := collector.Get("test-1"); snap != (Snapshot{}) {
+		t.Errorf("Expected empty snapshot after removal, got %+v", snap)
+	}
+}
+
+func TestTCPDurations(t *testing.T) {
+	collector := NewCollector()
+	if durations := collector.TCPDurations("unknown"); durations.Count != 0 || len(durations.Buckets) != len(TCPDurationBuckets) {
+		t.Errorf("Expected empty buckets for an unknown tunnel, got %+v", durations)
+	}
+
+	s := collector.Tunnel("test-1")
+	s.ObserveTCPDuration(500 * time.Millisecond)
+	s.ObserveTCPDuration(90 * time.Second)
+	s.ObserveTCPDuration(2 * time.Hour)
+
+	durations := collector.TCPDurations("test-1")
+	if durations.Count != 3 || durations.Sum != 0.5+90+7200 {
+		t.Errorf("Unexpected count and sum: %+v", durations)
+	}
+	// Buckets are cumulative: 0.1, 1, 10, 60, 300, 1800, 3600
+	if want := []int64{0, 1, 1, 1, 2, 2, 2}; !slices.Equal(durations.Buckets, want) {
+		t.Errorf("Expected buckets %v, got %v", want, durations.Buckets)
+	}
+
+	// The copy returned is not changed by later observations
+	s.ObserveTCPDuration(time.Second)
+	if durations.Buckets[1] != 1 {
+		t.Error("Expected the returned histogram to be a copy")
+	}
+}
+
+func TestCollectorConcurrency(t *testing.T) {
+	collector := NewCollector()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				collector.Tunnel("test-1").IncRequests()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests := collector.Get("test-1").Requests; requests != 1000 {
+		t.Errorf("Expected 1000 requests, got %d", requests)
+	}
+}
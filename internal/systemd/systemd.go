@@ -0,0 +1,120 @@
+// Package systemd integrates the easy-tunnel-lb-agent with systemd: socket
+// activation and service notifications.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation
+const listenFDsStart = 3
+
+// Notification states of the service
+const (
+	StateReady     = "READY=1"
+	StateReloading = "RELOADING=1"
+	StateStopping  = "STOPPING=1"
+	StateWatchdog  = "WATCHDOG=1"
+)
+
+// Listeners returns the stream sockets passed by systemd socket activation,
+// keyed by their FileDescriptorName (the socket unit's name if unset). It
+// returns nil if the agent was not socket activated. The environment
+// variables are unset, so child processes do not inherit the sockets.
+func Listeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make(map[string]net.Listener, count)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s passed by systemd is not a stream socket: %v", name, err)
+		}
+		if _, exists := listeners[name]; exists {
+			listener.Close()
+			return nil, fmt.Errorf("systemd passed more than one socket named %s", name)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// Notify sends state to the service manager, returning false without an
+// error if the agent does not run under systemd with notifications
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Abstract sockets start with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to systemd notify socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return true, nil
+}
+
+// Reloading is the notification that the agent starts reloading its
+// configuration, with the time systemd requires
+func Reloading() string {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return StateReloading
+	}
+	return fmt.Sprintf("%s\nMONOTONIC_USEC=%d", StateReloading, ts.Nano()/1000)
+}
+
+// Status is the notification of a human readable status
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// WatchdogInterval returns how often systemd expects watchdog pings, or
+// zero if the watchdog is not enabled for the agent
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
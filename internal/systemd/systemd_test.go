@@ -0,0 +1,84 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify(StateReady); sent || err != nil {
+		t.Errorf("Expected no notification outside systemd, got %v, %v", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if sent, err := Notify(StateReady + "\n" + Status("Serving 3 tunnels")); !sent || err != nil {
+		t.Fatalf("Expected the notification to be sent, got %v, %v", sent, err)
+	}
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read notification: %v", err)
+	}
+	if got := string(buf[:n]); got != "READY=1\nSTATUS=Serving 3 tunnels" {
+		t.Errorf("Unexpected notification %q", got)
+	}
+}
+
+func TestReloading(t *testing.T) {
+	state := Reloading()
+	if !strings.HasPrefix(state, "RELOADING=1\nMONOTONIC_USEC=") {
+		t.Errorf("Expected a reload notification with the monotonic time, got %q", state)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{name: "Disabled", expected: 0},
+		{name: "Enabled", usec: "30000000", expected: 30 * time.Second},
+		{name: "For this process", usec: "30000000", pid: strconv.Itoa(os.Getpid()), expected: 30 * time.Second},
+		{name: "For another process", usec: "30000000", pid: "1", expected: 0},
+		{name: "Invalid", usec: "soon", expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := WatchdogInterval(); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestListenersWithoutActivation(t *testing.T) {
+	// Sockets passed to another process are not ours
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+	listeners, err := Listeners()
+	if listeners != nil || err != nil {
+		t.Errorf("Expected no listeners, got %v, %v", listeners, err)
+	}
+	if _, set := os.LookupEnv("LISTEN_FDS"); set {
+		t.Error("Expected the socket activation variables to be unset")
+	}
+}
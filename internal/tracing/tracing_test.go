@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	r.Header.Set("Traceparent", traceparent)
+	ctx, span := StartServer(r, "proxy GET")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("failed"))
+
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	EndHTTP(span, http.StatusBadGateway)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	server := spans[1]
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the incoming trace to be continued, got trace %s", server.SpanContext().TraceID())
+	}
+	if server.Status().Code != codes.Error {
+		t.Errorf("Expected a 502 to mark the span as failed, got %v", server.Status())
+	}
+	if spans[0].Parent().SpanID() != server.SpanContext().SpanID() || spans[0].Status().Code != codes.Error {
+		t.Errorf("Expected a failed child of the server span, got %+v", spans[0])
+	}
+
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + server.SpanContext().SpanID().String() + "-01"
+	if got := outgoing.Get("Traceparent"); got != expected {
+		t.Errorf("Expected outgoing traceparent %s, got %s", expected, got)
+	}
+}
+
+func TestInjectWithoutSpan(t *testing.T) {
+	header := http.Header{}
+	Inject(context.Background(), header)
+	if len(header) != 0 {
+		t.Errorf("Expected no headers without a span, got %v", header)
+	}
+}
@@ -0,0 +1,52 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors of the manager, for callers such as the API to tell
+// them apart with errors.Is
+var (
+	// ErrNotFound is the kind of errors for tunnels, hostnames and
+	// reservations that do not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is the kind of errors for changes that clash with
+	// existing tunnels or reservations
+	ErrConflict = errors.New("conflict")
+
+	// ErrLimitExceeded is the kind of errors for changes beyond the limits
+	// of the agent or a tenant
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
+
+// kindError is an error of one of the kinds above
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// notFoundf returns an ErrNotFound error
+func notFoundf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrNotFound, message: fmt.Sprintf(format, args...)}
+}
+
+// conflictf returns an ErrConflict error
+func conflictf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrConflict, message: fmt.Sprintf(format, args...)}
+}
+
+// tunnelNotFound returns the error for a tunnel ID that does not exist
+func tunnelNotFound(id string) error {
+	return notFoundf("tunnel with ID %s not found", id)
+}
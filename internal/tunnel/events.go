@@ -0,0 +1,96 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of change an Event describes
+type EventType string
+
+const (
+	// EventTunnelCreated is emitted after a tunnel has been registered
+	EventTunnelCreated EventType = "created"
+	// EventTunnelRemoved is emitted after a tunnel has been removed
+	EventTunnelRemoved EventType = "removed"
+	// EventTunnelDegraded is emitted when a tunnel stops sending heartbeats
+	EventTunnelDegraded EventType = "degraded"
+	// EventTunnelRecovered is emitted when a degraded tunnel heartbeats again
+	EventTunnelRecovered EventType = "recovered"
+	// EventKeysRotated is emitted after a tunnel's WireGuard keys were rotated
+	EventKeysRotated EventType = "keys_rotated"
+	// EventHostnamesChanged is emitted after hostnames were added to or
+	// removed from a tunnel
+	EventHostnamesChanged EventType = "hostnames_changed"
+	// EventTunnelPaused is emitted after a tunnel's routes were withdrawn
+	// by pausing it
+	EventTunnelPaused EventType = "paused"
+	// EventTunnelResumed is emitted after a paused tunnel was routed again
+	EventTunnelResumed EventType = "resumed"
+)
+
+// Event describes a change in a tunnel's lifecycle
+type Event struct {
+	Type     EventType
+	TunnelID string
+	Hostname string
+	// Hostnames are all of the tunnel's hostnames, starting with Hostname
+	Hostnames []string
+	Time      time.Time
+	Message   string
+}
+
+// eventBus fans out events to all current subscribers
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers map[int]chan Event
+	nextID      int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[int]chan Event),
+	}
+}
+
+// subscribe registers a new subscriber with the given channel buffer size
+func (b *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	ch := make(chan Event, buffer)
+	b.subscribers[id] = ch
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers, id)
+			close(ch)
+		})
+	}
+
+	return ch, cancel
+}
+
+// publish delivers the event to every subscriber without blocking.
+// It returns the number of subscribers that were too slow to receive it.
+func (b *eventBus) publish(event Event) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	dropped := 0
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			dropped++
+		}
+	}
+
+	return dropped
+}
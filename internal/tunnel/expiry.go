@@ -0,0 +1,106 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// expiryInterval is how often the expiry monitor looks for expired tunnels
+const expiryInterval = time.Second
+
+// SetExpiry sets when a tunnel is removed automatically, zero for never,
+// and the TTL a refresh extends it by, zero to extend it by the time left
+// at the moment of the call
+func (m *Manager) SetExpiry(id string, expiresAt time.Time, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("TTL must not be negative")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	if ttl == 0 && !expiresAt.IsZero() {
+		ttl = time.Until(expiresAt)
+	}
+	tunnel.ExpiresAt = expiresAt
+	tunnel.TTL = ttl
+	return nil
+}
+
+// RefreshExpiry moves the expiry of a tunnel to ttl from now, or to its TTL
+// from now if ttl is zero, and returns a copy of the tunnel. A TTL given
+// here also becomes the tunnel's TTL for later refreshes.
+func (m *Manager) RefreshExpiry(id string, ttl time.Duration) (*TunnelInfo, error) {
+	if ttl < 0 {
+		return nil, errors.New("TTL must not be negative")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return nil, tunnelNotFound(id)
+	}
+	if ttl == 0 {
+		ttl = tunnel.TTL
+	}
+	if ttl <= 0 {
+		return nil, errors.New("tunnel has no TTL to refresh by")
+	}
+	tunnel.TTL = ttl
+	tunnel.ExpiresAt = time.Now().Add(ttl)
+	m.logger.Debug().
+		Str("tunnel_id", id).
+		Time("expires_at", tunnel.ExpiresAt).
+		Msg("Refreshed tunnel expiry")
+	return tunnel.Clone(), nil
+}
+
+// Remaining returns how long until the tunnel expires, zero if it does not
+// or already has
+func (t *TunnelInfo) Remaining(now time.Time) time.Duration {
+	if t.ExpiresAt.IsZero() || !now.Before(t.ExpiresAt) {
+		return 0
+	}
+	return t.ExpiresAt.Sub(now)
+}
+
+// StartExpiryMonitor removes tunnels once their expiry has passed, with a
+// removed event whose message is "expired". It runs until ctx is cancelled.
+func (m *Manager) StartExpiryMonitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.removeExpired(now)
+			}
+		}
+	}()
+}
+
+// removeExpired removes the tunnels that expired by now
+func (m *Manager) removeExpired(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tunnel := range m.tunnels {
+		if tunnel.ExpiresAt.IsZero() || now.Before(tunnel.ExpiresAt) {
+			continue
+		}
+		m.logger.Info().
+			Str("tunnel_id", tunnel.ID).
+			Time("expires_at", tunnel.ExpiresAt).
+			Msg("Removing expired tunnel")
+		m.removeTunnel(tunnel, "expired")
+	}
+}
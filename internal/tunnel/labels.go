@@ -0,0 +1,291 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Label keys are an optional DNS subdomain prefix and a name, as in
+// Kubernetes, e.g. team or example.com/team; values are names or empty
+var (
+	labelNamePattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]{0,61}[A-Za-z0-9])?$`)
+	labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?$`)
+)
+
+// ValidateLabels checks the keys and values of tunnel labels
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+		if err := validateLabelValue(value); err != nil {
+			return fmt.Errorf("label %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func validateLabelKey(key string) error {
+	name := key
+	if prefix, rest, found := strings.Cut(key, "/"); found {
+		if !labelPrefixPattern.MatchString(prefix) {
+			return fmt.Errorf("invalid label key %q: the prefix must be a DNS subdomain", key)
+		}
+		name = rest
+	}
+	if !labelNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid label key %q: names are up to 63 letters, digits, '-', '_' or '.', starting and ending with a letter or digit", key)
+	}
+	return nil
+}
+
+func validateLabelValue(value string) error {
+	if value != "" && !labelNamePattern.MatchString(value) {
+		return fmt.Errorf("invalid value %q: values are up to 63 letters, digits, '-', '_' or '.', starting and ending with a letter or digit", value)
+	}
+	return nil
+}
+
+// selectorOp is the operator of a selector requirement
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opNotExists
+)
+
+// requirement is one comma-separated term of a selector
+type requirement struct {
+	key    string
+	op     selectorOp
+	values []string
+}
+
+func (r requirement) matches(labels map[string]string) bool {
+	value, exists := labels[r.key]
+	switch r.op {
+	case opEquals, opIn:
+		return exists && slices.Contains(r.values, value)
+	case opNotEquals, opNotIn:
+		return !exists || !slices.Contains(r.values, value)
+	case opExists:
+		return exists
+	default:
+		return !exists
+	}
+}
+
+// Selector selects tunnels by their labels. It is a comma-separated list
+// of requirements that must all hold: key=value (or key==value),
+// key!=value, key in (a,b), key notin (a,b), key to require a label and
+// !key to require its absence. Tunnels without a label match != and notin
+// for it. The empty selector matches all tunnels.
+type Selector struct {
+	requirements []requirement
+}
+
+// ParseSelector parses a label selector
+func ParseSelector(selector string) (Selector, error) {
+	var s Selector
+	for _, term := range splitSelector(selector) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return Selector{}, fmt.Errorf("invalid selector %q: empty requirement", selector)
+		}
+		r, err := parseRequirement(term)
+		if err != nil {
+			return Selector{}, fmt.Errorf("invalid selector %q: %v", selector, err)
+		}
+		s.requirements = append(s.requirements, r)
+	}
+	return s, nil
+}
+
+// splitSelector splits a selector at the commas outside of value sets
+func splitSelector(selector string) []string {
+	if strings.TrimSpace(selector) == "" {
+		return nil
+	}
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, selector[start:])
+}
+
+func parseRequirement(term string) (requirement, error) {
+	if open := strings.IndexByte(term, '('); open >= 0 {
+		fields := strings.Fields(term[:open])
+		if len(fields) != 2 || (fields[1] != "in" && fields[1] != "notin") || !strings.HasSuffix(term, ")") {
+			return requirement{}, fmt.Errorf("%q is not of the form key in (values) or key notin (values)", term)
+		}
+		r := requirement{key: fields[0], op: opIn}
+		if fields[1] == "notin" {
+			r.op = opNotIn
+		}
+		for _, value := range strings.Split(term[open+1:len(term)-1], ",") {
+			value = strings.TrimSpace(value)
+			if err := validateLabelValue(value); err != nil {
+				return requirement{}, err
+			}
+			r.values = append(r.values, value)
+		}
+		return r, validateLabelKey(r.key)
+	}
+
+	var r requirement
+	switch {
+	case strings.HasPrefix(term, "!") && !strings.Contains(term, "="):
+		r = requirement{key: strings.TrimSpace(term[1:]), op: opNotExists}
+	case strings.Contains(term, "!="):
+		key, value, _ := strings.Cut(term, "!=")
+		r = requirement{key: strings.TrimSpace(key), op: opNotEquals, values: []string{strings.TrimSpace(value)}}
+	case strings.Contains(term, "="):
+		key, value, _ := strings.Cut(term, "=")
+		value = strings.TrimPrefix(value, "=")
+		r = requirement{key: strings.TrimSpace(key), op: opEquals, values: []string{strings.TrimSpace(value)}}
+	default:
+		r = requirement{key: term, op: opExists}
+	}
+	if err := validateLabelKey(r.key); err != nil {
+		return requirement{}, err
+	}
+	for _, value := range r.values {
+		if err := validateLabelValue(value); err != nil {
+			return requirement{}, err
+		}
+	}
+	return r, nil
+}
+
+// Empty reports whether the selector matches all tunnels
+func (s Selector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+// Matches reports whether labels satisfy all requirements of the selector
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s.requirements {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// labelIndex finds the tunnels with a label value: IDs by value by key
+type labelIndex map[string]map[string]map[string]bool
+
+func (x labelIndex) add(id string, labels map[string]string) {
+	for key, value := range labels {
+		values := x[key]
+		if values == nil {
+			values = make(map[string]map[string]bool)
+			x[key] = values
+		}
+		if values[value] == nil {
+			values[value] = make(map[string]bool)
+		}
+		values[value][id] = true
+	}
+}
+
+func (x labelIndex) remove(id string, labels map[string]string) {
+	for key, value := range labels {
+		delete(x[key][value], id)
+		if len(x[key][value]) == 0 {
+			delete(x[key], value)
+		}
+		if len(x[key]) == 0 {
+			delete(x, key)
+		}
+	}
+}
+
+// candidates returns the IDs of the tunnels that can match s, those with
+// the values of its most selective equality or set requirement, and false
+// if s has no such requirement
+func (x labelIndex) candidates(s Selector) ([]string, bool) {
+	var best map[string]bool
+	found := false
+	for _, r := range s.requirements {
+		if r.op != opEquals && r.op != opIn {
+			continue
+		}
+		ids := make(map[string]bool)
+		for _, value := range r.values {
+			maps.Copy(ids, x[r.key][value])
+		}
+		if !found || len(ids) < len(best) {
+			best, found = ids, true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	ids := slices.Collect(maps.Keys(best))
+	sort.Strings(ids)
+	return ids, true
+}
+
+// SetLabels replaces the labels of a tunnel
+func (m *Manager) SetLabels(id string, labels map[string]string) error {
+	if err := ValidateLabels(labels); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	if m.labels == nil {
+		m.labels = make(labelIndex)
+	}
+	m.labels.remove(id, tunnel.Labels)
+	tunnel.Labels = maps.Clone(labels)
+	m.labels.add(id, tunnel.Labels)
+	return nil
+}
+
+// SelectTunnels returns copies of the tunnels whose labels match selector,
+// sorted by ID
+func (m *Manager) SelectTunnels(selector Selector) []*TunnelInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids, indexed := m.labels.candidates(selector)
+	if !indexed {
+		ids = slices.Collect(maps.Keys(m.tunnels))
+		sort.Strings(ids)
+	}
+	var tunnels []*TunnelInfo
+	for _, id := range ids {
+		tunnel, exists := m.tunnels[id]
+		if exists && selector.Matches(tunnel.Labels) {
+			tunnels = append(tunnels, tunnel.Clone())
+		}
+	}
+	return tunnels
+}
@@ -2,15 +2,33 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/stats"
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
 	"github.com/rs/zerolog"
 )
 
-// TunnelInfo represents information about a single tunnel
+// TunnelStatus describes the liveness of a tunnel
+type TunnelStatus string
+
+const (
+	// StatusActive means the tunnel is healthy or has not opted into heartbeats
+	StatusActive TunnelStatus = "active"
+	// StatusDegraded means the tunnel's client stopped sending heartbeats
+	StatusDegraded TunnelStatus = "degraded"
+)
+
+// TunnelInfo represents information about a single tunnel. The manager
+// returns copies of its tunnels, which change only through its methods.
 type TunnelInfo struct {
 	ID              string
 	Hostname        string
@@ -20,6 +38,211 @@ type TunnelInfo struct {
 	LastActive      time.Time
 	WireGuardConfig *WireGuardConfig
 	Metadata        map[string]string
+
+	// Tenant owns the tunnel, whose limits it counts against; empty for
+	// tunnels not created on behalf of a tenant
+	Tenant string
+
+	// Hostnames are all hostnames routed to the tunnel's target, starting
+	// with Hostname
+	Hostnames []string
+
+	// Transport the tunnel's client connects over, empty if the agent
+	// reaches the target directly, and the address the agent forwards the
+	// tunnel's traffic to over it
+	Transport string
+	Endpoint  string
+
+	// Protocol the tunnel's traffic is routed by, empty to route its
+	// hostnames for HTTP, and the public port TCP and UDP tunnels listen on
+	Protocol   string
+	ListenPort int
+
+	// ConnectToken authenticates the client of transports the client
+	// connects to with a token, such as WebSocket
+	ConnectToken string
+
+	// Public key in the authorized_keys format an SSH client may
+	// authenticate with instead of the connect token
+	SSHPublicKey string
+
+	// Public key supplied by the tunnel client, if using WireGuard
+	ClientPublicKey string
+
+	// WireGuard options requested for the tunnel; WireGuardConfig holds
+	// the values in effect
+	WireGuardOptions WireGuardOptions
+
+	// When the WireGuard keys were last rotated, zero if never
+	KeysRotatedAt time.Time
+
+	// ProxyTimeouts override the load balancer's timeouts for the
+	// tunnel's traffic
+	ProxyTimeouts ProxyTimeouts
+
+	// BackendTLS, if set, makes the load balancer connect to the tunnel's
+	// target over HTTPS
+	BackendTLS *BackendTLS
+
+	// ErrorPages are templates replacing the load balancer's error pages
+	// by page name, and Maintenance serves the maintenance page instead
+	// of proxying the tunnel's traffic
+	ErrorPages  map[string]string
+	Maintenance bool
+
+	// Paused withdraws the tunnel's routes, keeping its registration and
+	// transport so that its client stays connected
+	Paused bool
+
+	// Labels are indexed key/value pairs that selectors match tunnels by,
+	// unlike Metadata, which is opaque to the agent
+	Labels map[string]string
+
+	// HeaderRules, if set, change the headers of the tunnel's requests and
+	// responses
+	HeaderRules *HeaderRules
+
+	// HostRewrite replaces the Host and Origin headers of the tunnel's
+	// requests
+	HostRewrite HostRewrite
+
+	// Compression overrides whether and from which size the load balancer
+	// compresses the tunnel's responses
+	Compression Compression
+
+	// Cache overrides whether and how the load balancer caches the
+	// tunnel's responses
+	Cache Cache
+
+	// Access restricts which clients the load balancer lets reach the
+	// tunnel
+	Access AccessLists
+
+	// RequestFilters are rules the load balancer blocks the tunnel's
+	// matching HTTP requests with
+	RequestFilters []FilterRule
+
+	// ClientLimits override the load balancer's limits on each client of
+	// the tunnel
+	ClientLimits ClientLimits
+
+	// RequestPolicy overrides the load balancer's request body limit and
+	// retries for the tunnel's HTTP requests
+	RequestPolicy RequestPolicy
+
+	// Mirror, if set, has the load balancer send copies of the tunnel's
+	// HTTP requests to a shadow tunnel
+	Mirror *Mirror
+
+	// EdgeAuth, if set, has the load balancer authenticate the tunnel's
+	// clients before proxying their requests
+	EdgeAuth *EdgeAuth
+
+	// ClientCertAuth, if set, has the load balancer require client
+	// certificates signed by the tunnel's CAs
+	ClientCertAuth *ClientCertAuth
+
+	// ExpiresAt is when the tunnel is removed automatically, zero if
+	// never, and TTL how far a refresh without a TTL moves it
+	ExpiresAt time.Time
+	TTL       time.Duration
+
+	// Liveness as reported by the tunnel client's heartbeats
+	Status        TunnelStatus
+	LastHeartbeat time.Time
+	ClientHealth  string
+	ClientVersion string
+
+	// DegradedReason explains a degraded status
+	DegradedReason string
+
+	// WireGuard peer statistics from the handshake monitor. HandshakeStale
+	// is set while the latest handshake is older than the handshake timeout.
+	Peer           PeerStats
+	HandshakeStale bool
+
+	// Path is the quality of the network path to the WireGuard peer as
+	// measured by the path prober, and pathProbes its latest probes
+	Path       PathStats
+	pathProbes pathWindow
+
+	heartbeatStale bool
+
+	// routed is set while the router routes the tunnel's hostnames to its
+	// reachable endpoint, or, for tunnels with a protocol on transports
+	// that do not report reachability, from when the protocol is set
+	routed bool
+
+	// generatedHostname is set if the tunnel was created without a
+	// hostname and got a subdomain of the base domain
+	generatedHostname bool
+
+	// initialHostnames are the hostnames the tunnel was created with, nil
+	// until SetInitialHostnames
+	initialHostnames []string
+}
+
+// Clone returns a deep copy of the tunnel
+func (t *TunnelInfo) Clone() *TunnelInfo {
+	clone := *t
+	if t.WireGuardConfig != nil {
+		config := *t.WireGuardConfig
+		clone.WireGuardConfig = &config
+	}
+	if t.BackendTLS != nil {
+		settings := *t.BackendTLS
+		clone.BackendTLS = &settings
+	}
+	if t.HeaderRules != nil {
+		clone.HeaderRules = &HeaderRules{
+			Request:  t.HeaderRules.Request.clone(),
+			Response: t.HeaderRules.Response.clone(),
+		}
+	}
+	if t.Compression.Enabled != nil {
+		enabled := *t.Compression.Enabled
+		clone.Compression.Enabled = &enabled
+	}
+	if t.Mirror != nil {
+		mirror := *t.Mirror
+		clone.Mirror = &mirror
+	}
+	if t.RequestPolicy.RetryAttempts != nil {
+		attempts := *t.RequestPolicy.RetryAttempts
+		clone.RequestPolicy.RetryAttempts = &attempts
+	}
+	if t.Cache.Enabled != nil {
+		enabled := *t.Cache.Enabled
+		clone.Cache.Enabled = &enabled
+	}
+	if t.EdgeAuth != nil {
+		clone.EdgeAuth = t.EdgeAuth.clone()
+	}
+	if t.ClientCertAuth != nil {
+		auth := *t.ClientCertAuth
+		auth.Hostnames = slices.Clone(t.ClientCertAuth.Hostnames)
+		clone.ClientCertAuth = &auth
+	}
+	clone.Metadata = maps.Clone(t.Metadata)
+	clone.Labels = maps.Clone(t.Labels)
+	clone.ErrorPages = maps.Clone(t.ErrorPages)
+	clone.Hostnames = slices.Clone(t.Hostnames)
+	clone.initialHostnames = slices.Clone(t.initialHostnames)
+	clone.Access = AccessLists{
+		AllowedIPs:       slices.Clone(t.Access.AllowedIPs),
+		DeniedIPs:        slices.Clone(t.Access.DeniedIPs),
+		AllowedCountries: slices.Clone(t.Access.AllowedCountries),
+		DeniedCountries:  slices.Clone(t.Access.DeniedCountries),
+	}
+	if t.RequestFilters != nil {
+		clone.RequestFilters = make([]FilterRule, len(t.RequestFilters))
+		for i, rule := range t.RequestFilters {
+			rule.Methods = slices.Clone(rule.Methods)
+			rule.Headers = maps.Clone(rule.Headers)
+			clone.RequestFilters[i] = rule
+		}
+	}
+	return &clone
 }
 
 // WireGuardConfig contains WireGuard-specific configuration
@@ -29,6 +252,18 @@ type WireGuardConfig struct {
 	ServerIP   string
 	ClientIP   string
 	Port       int
+
+	// IPv6 addresses of the interface and client, empty unless the
+	// interface has an IPv6 prefix
+	ServerIPv6 string
+	ClientIPv6 string
+
+	// Keepalive interval in seconds and client MTU, zero if unset
+	PersistentKeepalive int
+	MTU                 int
+
+	// Interface is the name of the WireGuard interface holding the peer
+	Interface string
 }
 
 // Manager handles the lifecycle of tunnels
@@ -37,61 +272,440 @@ type Manager struct {
 	mu         sync.RWMutex
 	maxTunnels int
 	logger     *zerolog.Logger
-	wg         *WireGuardManager
+	// Transports by name; wireGuard is also registered as a transport
+	transports map[string]Transport
+	wireGuard  *WireGuardTransport
+	router     Router
+	events     *eventBus
+	stats      *stats.Collector
+	// labels indexes the tunnels by their labels
+	labels labelIndex
+
+	// routedIDs are the tunnels the manager added routes for, which the
+	// reconciler checks for routes left behind, and drift what it found
+	routedIDs map[string]bool
+	drift     DriftStats
+
+	// onOptions receives the traffic options of tunnels, if set
+	onOptions OptionsFunc
+
+	heartbeatTimeout time.Duration
+
+	// baseDomain, if set, is the domain of the hostnames generated for
+	// tunnels created without one; reserved holds the generated hostnames
+	// of tunnels about to be created by tunnel ID
+	baseDomain string
+	reserved   map[string]string
+
+	// reservations claim hostnames for their owners by hostname
+	reservations map[string]Reservation
+
+	// Limits of tenants by name, defaultTenantLimits applying to the
+	// others, and the traffic of tenants as last measured by the bandwidth
+	// monitor
+	defaultTenantLimits TenantLimits
+	tenantLimits        map[string]TenantLimits
+	tenantBytes         map[string]int64
+	tenantRates         map[string]int64
+	overBandwidth       map[string]bool
 }
 
 // NewManager creates a new tunnel manager
 func NewManager(maxTunnels int) *Manager {
-	logger := utils.GetLogger()
+	logger := utils.GetModuleLogger(utils.ModuleTunnel)
+	wireGuard := NewWireGuardTransport()
 	return &Manager{
 		tunnels:    make(map[string]*TunnelInfo),
 		maxTunnels: maxTunnels,
 		logger:     logger,
-		wg:         NewWireGuardManager(),
+		transports: map[string]Transport{TransportWireGuard: wireGuard},
+		wireGuard:  wireGuard,
+		events:     newEventBus(),
+		stats:      stats.NewCollector(),
+		reserved:   make(map[string]string),
+
+		reservations: make(map[string]Reservation),
 	}
 }
 
-// CreateTunnel creates a new tunnel with the given configuration
-func (m *Manager) CreateTunnel(id, hostname string, targetPort int, wgPubKey string, metadata map[string]string) (*TunnelInfo, error) {
+// AddTransport registers a transport that tunnels can be created on
+func (m *Manager) AddTransport(transport Transport) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Check if we've reached the maximum number of tunnels
-	if len(m.tunnels) >= m.maxTunnels {
-		return nil, fmt.Errorf("maximum number of tunnels (%d) reached", m.maxTunnels)
+	if _, exists := m.transports[transport.Name()]; exists {
+		return fmt.Errorf("transport %s already registered", transport.Name())
+	}
+	m.transports[transport.Name()] = transport
+	if notifier, ok := transport.(EndpointNotifier); ok {
+		notifier.NotifyEndpoint(m.endpointChanged)
 	}
+	return nil
+}
 
-	// Check if tunnel ID already exists
-	if _, exists := m.tunnels[id]; exists {
-		return nil, fmt.Errorf("tunnel with ID %s already exists", id)
+// SetRouter makes the manager route the hostnames of tunnels on transports
+// that report when their endpoints become reachable
+func (m *Manager) SetRouter(router Router) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.router = router
+}
+
+// endpointChanged routes a tunnel's hostname to its endpoint while the
+// endpoint is reachable
+func (m *Manager) endpointChanged(id string, reachable bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists || m.router == nil {
+		return
+	}
+	m.router.RemoveRoute(id)
+	tunnel.routed = reachable
+	if !reachable {
+		m.logger.Info().
+			Str("tunnel_id", id).
+			Msg("Removed route of unreachable tunnel")
+		return
+	}
+
+	m.routeHostnames(tunnel)
+	m.logger.Info().
+		Str("tunnel_id", id).
+		Strs("hostnames", tunnel.Hostnames).
+		Str("endpoint", tunnel.Endpoint).
+		Msg("Routed reachable tunnel")
+}
+
+// routeHostnames routes all hostnames of a tunnel to its endpoint, or its
+// listen port for the TCP and UDP protocols, returning the first error.
+// Paused tunnels are not routed. Must be called with m.mu held.
+func (m *Manager) routeHostnames(tunnel *TunnelInfo) error {
+	if tunnel.Paused {
+		return nil
+	}
+	if m.routedIDs == nil {
+		m.routedIDs = make(map[string]bool)
+	}
+	m.routedIDs[tunnel.ID] = true
+	if tunnel.Protocol != "" && tunnel.Protocol != ProtocolHTTP {
+		err := m.routeProtocol(tunnel)
+		if err != nil {
+			m.logger.Error().
+				Err(err).
+				Str("tunnel_id", tunnel.ID).
+				Str("protocol", tunnel.Protocol).
+				Msg("Failed to route tunnel")
+		}
+		return err
+	}
+
+	var first error
+	for _, hostname := range tunnel.Hostnames {
+		if err := m.router.AddBackend(tunnel.ID, hostname, tunnel.Endpoint, tunnel.TargetPort); err != nil {
+			m.logger.Error().
+				Err(err).
+				Str("tunnel_id", tunnel.ID).
+				Str("hostname", hostname).
+				Msg("Failed to route tunnel")
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// HasTransport reports whether tunnels can be created on the named transport
+func (m *Manager) HasTransport(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.transports[name]
+	return ok
+}
+
+// transportNames returns the names of the registered transports sorted.
+// Must be called with m.mu held.
+func (m *Manager) transportNames() []string {
+	names := make([]string, 0, len(m.transports))
+	for name := range m.transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DialTunnel connects to address on behalf of a tunnel, over the tunnel's
+// transport if it carries connections itself. Addresses of other and
+// unknown tunnels are dialed directly.
+func (m *Manager) DialTunnel(ctx context.Context, id, address string) (net.Conn, error) {
+	m.mu.RLock()
+	var transport Transport
+	tunnel, exists := m.tunnels[id]
+	if exists {
+		transport = m.transports[tunnel.Transport]
+	}
+	m.mu.RUnlock()
+
+	if dialer, ok := transport.(Dialer); ok {
+		return dialer.Dial(ctx, tunnel, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// WireGuard returns the WireGuard transport
+func (m *Manager) WireGuard() *WireGuardTransport {
+	return m.wireGuard
+}
+
+// AddWireGuardInterface adds a WireGuard interface that tunnels can select
+// with WireGuardOptions.Interface. Its name, subnet and port must not
+// conflict with the existing interfaces.
+func (m *Manager) AddWireGuardInterface(iface WireGuardInterface) error {
+	return m.wireGuard.AddInterface(iface)
+}
+
+// SetWireGuardIPv6Prefix gives peers on the default WireGuard interface an
+// IPv6 address from prefix in addition to their IPv4 address. It must be
+// called before WireGuard tunnels are created.
+func (m *Manager) SetWireGuardIPv6Prefix(prefix string) error {
+	return m.wireGuard.SetIPv6Prefix(prefix)
+}
+
+// HasWireGuardInterface reports whether tunnels can use the named WireGuard
+// interface; the empty name is the default interface
+func (m *Manager) HasWireGuardInterface(name string) bool {
+	return m.wireGuard.HasInterface(name)
+}
+
+// StartWireGuard creates the WireGuard interfaces with the given
+// implementation (auto, kernel or userspace) unless they already exist
+func (m *Manager) StartWireGuard(implementation string) error {
+	return m.wireGuard.Start(implementation)
+}
+
+// CheckWireGuard returns an error unless all WireGuard interfaces exist and
+// are up
+func (m *Manager) CheckWireGuard() error {
+	return m.wireGuard.CheckInterfaces()
+}
+
+// StopWireGuard stops the userspace WireGuard interfaces the agent started
+func (m *Manager) StopWireGuard() {
+	m.wireGuard.Stop()
+}
+
+// RemoveWireGuardPeers removes the WireGuard peers of all tunnels while
+// keeping the tunnels, so that a shutting down agent stops accepting their
+// traffic. It returns the number of peers removed.
+func (m *Manager) RemoveWireGuardPeers() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.tunnels))
+	for id := range m.tunnels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	removed := 0
+	var errs []string
+	for _, id := range ids {
+		tunnel := m.tunnels[id]
+		if tunnel.Transport != TransportWireGuard || tunnel.WireGuardConfig == nil {
+			continue
+		}
+		if err := m.wireGuard.Teardown(tunnel); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", id, err))
+			continue
+		}
+		removed++
+	}
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("failed to remove WireGuard peers: %s", strings.Join(errs, "; "))
+	}
+	return removed, nil
+}
+
+// SetWireGuardDefaults sets the persistent keepalive interval and MTU of
+// WireGuard peers created without explicit options, applying the MTU to the
+// WireGuard interfaces
+func (m *Manager) SetWireGuardDefaults(keepalive, mtu int) error {
+	return m.wireGuard.SetDefaults(keepalive, mtu)
+}
+
+// SetPeerFirewall sets the firewall that WireGuard peers on all interfaces
+// are opened in from now on
+func (m *Manager) SetPeerFirewall(firewall PeerFirewall) {
+	m.wireGuard.SetFirewall(firewall)
+}
+
+// WireGuardInterfaces returns the WireGuard interfaces by the names they
+// were created with, starting with the default one
+func (m *Manager) WireGuardInterfaces() []WireGuardInterface {
+	return m.wireGuard.Interfaces()
+}
+
+// WireGuardStatus returns the state of the WireGuard interfaces, starting
+// with the default one
+func (m *Manager) WireGuardStatus() []WireGuardInterfaceStatus {
+	return m.wireGuard.InterfaceStatus()
+}
+
+// CreateTunnel creates a new tunnel with the given configuration.
+// Repeating a create with exactly the same configuration as an existing
+// tunnel returns the existing tunnel, so clients can safely retry.
+func (m *Manager) CreateTunnel(id, hostname string, targetPort int, wgPubKey string, metadata map[string]string) (*TunnelInfo, error) {
+	return m.CreateTunnelWithOptions(id, hostname, targetPort, wgPubKey, metadata, WireGuardOptions{})
+}
+
+// CreateTunnelWithOptions creates a tunnel like CreateTunnel, tuning its
+// WireGuard peer with opts
+func (m *Manager) CreateTunnelWithOptions(id, hostname string, targetPort int, wgPubKey string, metadata map[string]string, opts WireGuardOptions) (*TunnelInfo, error) {
+	return m.CreateTunnelForTenant("", id, hostname, targetPort, wgPubKey, metadata, opts)
+}
+
+// CreateTunnelForTenant creates a tunnel like CreateTunnelWithOptions,
+// owned by tenant and failing with a *TenantLimitError if the tenant is at
+// one of its limits
+func (m *Manager) CreateTunnelForTenant(tenant, id, hostname string, targetPort int, wgPubKey string, metadata map[string]string, opts WireGuardOptions) (*TunnelInfo, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
 
-	tunnel := &TunnelInfo{
+	// Tunnels with a WireGuard public key connect over WireGuard; the
+	// targets of the others are reached directly
+	transport := ""
+	if wgPubKey != "" {
+		transport = TransportWireGuard
+	}
+	return m.createTunnel(&TunnelInfo{
 		ID:         id,
 		Hostname:   hostname,
 		TargetPort: targetPort,
-		Created:    time.Now(),
-		LastActive: time.Now(),
 		Metadata:   metadata,
+		Transport:  transport,
+		Tenant:     tenant,
+
+		ClientPublicKey:  wgPubKey,
+		WireGuardOptions: opts,
+	})
+}
+
+// CreateTunnelOnTransport creates a tunnel whose client connects over the
+// named transport, which sets up the client's configuration
+func (m *Manager) CreateTunnelOnTransport(transport, id, hostname string, targetPort int, metadata map[string]string) (*TunnelInfo, error) {
+	return m.CreateTunnelOnTransportWithOptions(transport, id, hostname, targetPort, metadata, TransportOptions{})
+}
+
+// CreateTunnelOnTransportWithOptions creates a tunnel on the named transport
+// with options for the transport
+func (m *Manager) CreateTunnelOnTransportWithOptions(transport, id, hostname string, targetPort int, metadata map[string]string, opts TransportOptions) (*TunnelInfo, error) {
+	return m.CreateTunnelOnTransportForTenant("", transport, id, hostname, targetPort, metadata, opts)
+}
+
+// CreateTunnelOnTransportForTenant creates a tunnel like
+// CreateTunnelOnTransportWithOptions, owned by tenant and failing with a
+// *TenantLimitError if the tenant is at one of its limits
+func (m *Manager) CreateTunnelOnTransportForTenant(tenant, transport, id, hostname string, targetPort int, metadata map[string]string, opts TransportOptions) (*TunnelInfo, error) {
+	if transport == "" {
+		return nil, fmt.Errorf("transport is required")
+	}
+	return m.createTunnel(&TunnelInfo{
+		ID:           id,
+		Hostname:     hostname,
+		TargetPort:   targetPort,
+		Metadata:     metadata,
+		Transport:    transport,
+		Tenant:       tenant,
+		SSHPublicKey: opts.SSHPublicKey,
+		ConnectToken: opts.ConnectToken,
+	})
+}
+
+// createTunnel sets up a tunnel on its transport and adds it
+func (m *Manager) createTunnel(tunnel *TunnelInfo) (*TunnelInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A hostname reserved by GenerateHostname is only valid for this create
+	reserved := m.reserved[tunnel.ID]
+	delete(m.reserved, tunnel.ID)
+
+	// Check if tunnel ID already exists
+	if existing, exists := m.tunnels[tunnel.ID]; exists {
+		if existing.matches(tunnel) {
+			m.logger.Debug().
+				Str("tunnel_id", tunnel.ID).
+				Msg("Tunnel already exists with identical configuration")
+			return existing.Clone(), nil
+		}
+		return nil, conflictf("tunnel with ID %s already exists", tunnel.ID)
 	}
 
-	// If WireGuard public key is provided, set up WireGuard
-	if wgPubKey != "" {
-		wgConfig, err := m.wg.SetupPeer(id, wgPubKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to setup WireGuard peer: %v", err)
+	// Check if we've reached the maximum number of tunnels
+	if len(m.tunnels) >= m.maxTunnels {
+		return nil, &kindError{kind: ErrLimitExceeded, message: fmt.Sprintf("maximum number of tunnels (%d) reached", m.maxTunnels)}
+	}
+	if err := m.checkTenantLimits(tunnel, []string{tunnel.Hostname}); err != nil {
+		return nil, err
+	}
+
+	if tunnel.Hostname != "" && tunnel.Hostname == reserved {
+		tunnel.PublicEndpoint = reserved
+		tunnel.generatedHostname = true
+	}
+	tunnel.Hostnames = []string{tunnel.Hostname}
+	now := time.Now()
+	tunnel.Created = now
+	tunnel.LastActive = now
+	tunnel.Status = StatusActive
+
+	if tunnel.Transport != "" {
+		transport, ok := m.transports[tunnel.Transport]
+		if !ok {
+			return nil, fmt.Errorf("unknown transport %s", tunnel.Transport)
+		}
+		if err := transport.Setup(tunnel); err != nil {
+			return nil, err
 		}
-		tunnel.WireGuardConfig = wgConfig
+		tunnel.Endpoint = transport.Endpoint(tunnel)
 	}
 
-	m.tunnels[id] = tunnel
+	m.tunnels[tunnel.ID] = tunnel
+	m.optionsChanged(tunnel)
 	m.logger.Info().
-		Str("tunnel_id", id).
-		Str("hostname", hostname).
-		Int("target_port", targetPort).
+		Str("tunnel_id", tunnel.ID).
+		Str("hostname", tunnel.Hostname).
+		Int("target_port", tunnel.TargetPort).
+		Str("transport", tunnel.Transport).
 		Msg("Created new tunnel")
 
-	return tunnel, nil
+	m.publish(EventTunnelCreated, tunnel, "")
+
+	return tunnel.Clone(), nil
+}
+
+// matches reports whether the tunnel was created with the configuration of
+// the requested tunnel
+func (t *TunnelInfo) matches(requested *TunnelInfo) bool {
+	if t.Hostname != requested.Hostname || t.TargetPort != requested.TargetPort ||
+		t.ClientPublicKey != requested.ClientPublicKey || t.Transport != requested.Transport ||
+		t.WireGuardOptions != requested.WireGuardOptions || t.SSHPublicKey != requested.SSHPublicKey ||
+		t.Tenant != requested.Tenant {
+		return false
+	}
+	if len(t.Metadata) != len(requested.Metadata) {
+		return false
+	}
+	for k, v := range requested.Metadata {
+		if existing, ok := t.Metadata[k]; !ok || existing != v {
+			return false
+		}
+	}
+	return true
 }
 
 // RemoveTunnel removes an existing tunnel
@@ -101,52 +715,71 @@ func (m *Manager) RemoveTunnel(id string) error {
 
 	tunnel, exists := m.tunnels[id]
 	if !exists {
-		return fmt.Errorf("tunnel with ID %s not found", id)
+		return tunnelNotFound(id)
 	}
+	m.removeTunnel(tunnel, "")
+	return nil
+}
 
-	// If it's a WireGuard tunnel, remove the peer
-	if tunnel.WireGuardConfig != nil {
-		if err := m.wg.RemovePeer(id); err != nil {
+// removeTunnel disconnects and removes a tunnel, publishing the removal
+// with message. Must be called with m.mu held.
+func (m *Manager) removeTunnel(tunnel *TunnelInfo, message string) {
+	id := tunnel.ID
+
+	// Disconnect the tunnel's client from its transport
+	routed := tunnel.routed
+	if transport, ok := m.transports[tunnel.Transport]; ok {
+		if err := transport.Teardown(tunnel); err != nil {
 			m.logger.Error().
 				Err(err).
 				Str("tunnel_id", id).
-				Msg("Failed to remove WireGuard peer")
+				Str("transport", tunnel.Transport).
+				Msg("Failed to tear down tunnel transport")
+		}
+		if _, notifies := transport.(EndpointNotifier); notifies {
+			routed = true
 		}
 	}
+	if routed && m.router != nil {
+		m.router.RemoveRoute(id)
+	}
 
 	delete(m.tunnels, id)
+	m.optionsRemoved(id)
+	m.labels.remove(id, tunnel.Labels)
+	m.stats.Remove(id)
 	m.logger.Info().
 		Str("tunnel_id", id).
 		Msg("Removed tunnel")
 
-	return nil
+	m.publish(EventTunnelRemoved, tunnel, message)
 }
 
-// GetTunnel retrieves information about a specific tunnel
+// GetTunnel returns a copy of a tunnel
 func (m *Manager) GetTunnel(id string) (*TunnelInfo, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	tunnel, exists := m.tunnels[id]
 	if !exists {
-		return nil, fmt.Errorf("tunnel with ID %s not found", id)
+		return nil, tunnelNotFound(id)
 	}
 
-	return tunnel, nil
+	return tunnel.Clone(), nil
 }
 
-// GetTunnelByHostname retrieves a tunnel by its hostname
+// GetTunnelByHostname returns a copy of the tunnel with a primary hostname
 func (m *Manager) GetTunnelByHostname(hostname string) (*TunnelInfo, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	for _, tunnel := range m.tunnels {
 		if tunnel.Hostname == hostname {
-			return tunnel, nil
+			return tunnel.Clone(), nil
 		}
 	}
 
-	return nil, fmt.Errorf("no tunnel found for hostname %s", hostname)
+	return nil, notFoundf("no tunnel found for hostname %s", hostname)
 }
 
 // UpdateLastActive updates the last active timestamp for a tunnel
@@ -159,15 +792,1195 @@ func (m *Manager) UpdateLastActive(id string) {
 	}
 }
 
-// GetAllTunnels returns a list of all active tunnels
-func (m *Manager) GetAllTunnels() []*TunnelInfo {
+// Heartbeat records a heartbeat from a tunnel client along with its
+// self-reported health and version, reactivating the tunnel if it was
+// degraded, and returns a copy of the tunnel
+func (m *Manager) Heartbeat(id, health, version string) (*TunnelInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return nil, tunnelNotFound(id)
+	}
+
+	now := time.Now()
+	tunnel.LastActive = now
+	tunnel.LastHeartbeat = now
+	tunnel.ClientHealth = health
+	tunnel.ClientVersion = version
+
+	if tunnel.heartbeatStale {
+		tunnel.heartbeatStale = false
+		m.updateStatus(tunnel, "heartbeat received")
+	}
+
+	return tunnel.Clone(), nil
+}
+
+// StartLivenessMonitor periodically marks tunnels as degraded when their
+// heartbeats stop for longer than the heartbeat timeout. Tunnels that never
+// sent a heartbeat are not monitored, and a zero timeout disables checks.
+// The monitor runs until ctx is cancelled.
+func (m *Manager) StartLivenessMonitor(ctx context.Context, timeout time.Duration) {
+	m.SetHeartbeatTimeout(timeout)
+
+	go func() {
+		for {
+			interval := m.HeartbeatTimeout() / 2
+			if interval <= 0 {
+				interval = time.Second
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-time.After(interval):
+				if timeout := m.HeartbeatTimeout(); timeout > 0 {
+					m.checkLiveness(now, timeout)
+				}
+			}
+		}
+	}()
+}
+
+// SetHeartbeatTimeout changes the heartbeat window used by the liveness monitor
+func (m *Manager) SetHeartbeatTimeout(timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heartbeatTimeout = timeout
+}
+
+// SetMaxTunnels changes the tunnel limit. Existing tunnels above a lowered
+// limit are kept, but no new tunnels can be created until the count drops.
+func (m *Manager) SetMaxTunnels(maxTunnels int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxTunnels = maxTunnels
+}
+
+// ProxyTimeouts override the load balancer's timeouts for a tunnel; zero
+// values use the load balancer's
+type ProxyTimeouts struct {
+	// Dial bounds connecting to the tunnel's target
+	Dial time.Duration
+
+	// ResponseHeader bounds waiting for the response headers of a request
+	ResponseHeader time.Duration
+
+	// MaxRequest bounds the whole of a request, including its body
+	MaxRequest time.Duration
+}
+
+// Validate checks the timeouts are not negative
+func (t ProxyTimeouts) Validate() error {
+	if t.Dial < 0 {
+		return fmt.Errorf("invalid dial timeout: %v", t.Dial)
+	}
+	if t.ResponseHeader < 0 {
+		return fmt.Errorf("invalid response header timeout: %v", t.ResponseHeader)
+	}
+	if t.MaxRequest < 0 {
+		return fmt.Errorf("invalid max request duration: %v", t.MaxRequest)
+	}
+	return nil
+}
+
+// SetProxyTimeouts changes the proxy timeouts of a tunnel
+func (m *Manager) SetProxyTimeouts(id string, timeouts ProxyTimeouts) error {
+	if err := timeouts.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.ProxyTimeouts = timeouts
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// ProxyTimeouts returns the proxy timeouts of a tunnel, zero if it does
+// not exist
+func (m *Manager) ProxyTimeouts(id string) ProxyTimeouts {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	tunnels := make([]*TunnelInfo, 0, len(m.tunnels))
-	for _, tunnel := range m.tunnels {
-		tunnels = append(tunnels, tunnel)
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.ProxyTimeouts
 	}
+	return ProxyTimeouts{}
+}
 
-	return tunnels
-} 
\ No newline at end of file
+// BackendTLS configures HTTPS connections to a tunnel's target
+type BackendTLS struct {
+	// ServerName is verified against the target's certificate; it
+	// defaults to the tunnel's hostname
+	ServerName string
+
+	// InsecureSkipVerify accepts any certificate, e.g. a self-signed one
+	InsecureSkipVerify bool
+}
+
+// SetBackendTLS makes the load balancer connect to a tunnel's target over
+// HTTPS, or over plain HTTP if backendTLS is nil
+func (m *Manager) SetBackendTLS(id string, backendTLS *BackendTLS) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.BackendTLS = nil
+	if backendTLS != nil {
+		settings := *backendTLS
+		if settings.ServerName == "" {
+			settings.ServerName = tunnel.Hostname
+		}
+		tunnel.BackendTLS = &settings
+	}
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// BackendTLS returns a copy of the HTTPS settings of a tunnel's target,
+// nil if the target is reached over plain HTTP or the tunnel does not exist
+func (m *Manager) BackendTLS(id string) *BackendTLS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists || tunnel.BackendTLS == nil {
+		return nil
+	}
+	settings := *tunnel.BackendTLS
+	return &settings
+}
+
+// SetErrorPages replaces the error page templates of a tunnel
+func (m *Manager) SetErrorPages(id string, pages map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.ErrorPages = nil
+	if len(pages) > 0 {
+		tunnel.ErrorPages = make(map[string]string, len(pages))
+		for page, text := range pages {
+			tunnel.ErrorPages[page] = text
+		}
+	}
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// ErrorPages returns the error page templates of a tunnel; the map must not
+// be modified
+func (m *Manager) ErrorPages(id string) map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.ErrorPages
+	}
+	return nil
+}
+
+// SetMaintenance turns maintenance mode of a tunnel on or off
+func (m *Manager) SetMaintenance(id string, enabled bool) error {
+	m.mu.Lock()
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		m.mu.Unlock()
+		return tunnelNotFound(id)
+	}
+	changed := tunnel.Maintenance != enabled
+	tunnel.Maintenance = enabled
+	m.optionsChanged(tunnel)
+	m.mu.Unlock()
+
+	if changed {
+		m.logger.Info().
+			Str("tunnel_id", id).
+			Bool("maintenance", enabled).
+			Msg("Changed maintenance mode of tunnel")
+	}
+	return nil
+}
+
+// Maintenance reports whether a tunnel is in maintenance mode
+func (m *Manager) Maintenance(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tunnel, exists := m.tunnels[id]
+	return exists && tunnel.Maintenance
+}
+
+// HeaderRules change the headers of a tunnel's requests on their way to
+// the target and of its responses on their way back
+type HeaderRules struct {
+	Request  HeaderRuleSet
+	Response HeaderRuleSet
+}
+
+// HeaderRuleSet removes headers, then sets and appends header values
+type HeaderRuleSet struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+func (s HeaderRuleSet) clone() HeaderRuleSet {
+	return HeaderRuleSet{Set: maps.Clone(s.Set), Add: maps.Clone(s.Add), Remove: slices.Clone(s.Remove)}
+}
+
+// SetHeaderRules replaces the header rules of a tunnel; rules must not be
+// modified afterwards
+func (m *Manager) SetHeaderRules(id string, rules *HeaderRules) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.HeaderRules = rules
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// HeaderRules returns the header rules of a tunnel, nil if it has none; the
+// rules must not be modified
+func (m *Manager) HeaderRules(id string) *HeaderRules {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.HeaderRules
+	}
+	return nil
+}
+
+// HostRewrite replaces the headers naming the public hostname in a
+// tunnel's requests for backends that expect their own name
+type HostRewrite struct {
+	// Host, if set, replaces the Host header
+	Host string
+
+	// Origin, if set, replaces the Origin header of requests that have one
+	Origin string
+}
+
+// SetHostRewrite changes the Host and Origin rewrites of a tunnel
+func (m *Manager) SetHostRewrite(id string, rewrite HostRewrite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.HostRewrite = rewrite
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// HostRewrite returns the Host and Origin rewrites of a tunnel
+func (m *Manager) HostRewrite(id string) HostRewrite {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.HostRewrite
+	}
+	return HostRewrite{}
+}
+
+// Compression overrides the load balancer's response compression for a
+// tunnel
+type Compression struct {
+	// Enabled, if set, turns compression on or off
+	Enabled *bool
+
+	// MinSize, if non-zero, is the smallest response compressed in bytes
+	MinSize int
+}
+
+// SetCompression changes the response compression of a tunnel
+func (m *Manager) SetCompression(id string, compression Compression) error {
+	if compression.MinSize < 0 {
+		return fmt.Errorf("invalid compression minimum size: %d", compression.MinSize)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.Compression = compression
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// Cache overrides the load balancer's response caching for a tunnel
+type Cache struct {
+	// Enabled, if set, turns caching on or off
+	Enabled *bool
+
+	// MaxBytes, if non-zero, bounds the size of the tunnel's cached
+	// responses in bytes
+	MaxBytes int64
+
+	// MaxTTL, if non-zero, caps how long the tunnel's responses are served
+	// from the cache
+	MaxTTL time.Duration
+}
+
+// SetCache changes the response caching of a tunnel
+func (m *Manager) SetCache(id string, cache Cache) error {
+	if cache.MaxBytes < 0 || cache.MaxTTL < 0 {
+		return fmt.Errorf("invalid cache settings: %+v", cache)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.Cache = cache
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// AccessLists restrict which clients may reach a tunnel. Denied clients are
+// refused; if an allowlist is set, only clients on it are let in.
+type AccessLists struct {
+	// AllowedIPs and DeniedIPs hold CIDRs or IP addresses
+	AllowedIPs []string
+	DeniedIPs  []string
+
+	// AllowedCountries and DeniedCountries hold ISO 3166-1 country codes
+	AllowedCountries []string
+	DeniedCountries  []string
+}
+
+// Validate checks the IP lists hold CIDRs or IP addresses and the country
+// lists two-letter codes
+func (a AccessLists) Validate() error {
+	for _, entry := range slices.Concat(a.AllowedIPs, a.DeniedIPs) {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("invalid CIDR %q: %v", entry, err)
+			}
+		} else if net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid IP address %q", entry)
+		}
+	}
+	for _, code := range slices.Concat(a.AllowedCountries, a.DeniedCountries) {
+		if len(code) != 2 || !isLetter(code[0]) || !isLetter(code[1]) {
+			return fmt.Errorf("invalid country code %q", code)
+		}
+	}
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// SetAccessLists replaces the access lists of a tunnel; the lists must not
+// be modified afterwards
+func (m *Manager) SetAccessLists(id string, access AccessLists) error {
+	if err := access.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.Access = access
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// AccessLists returns the access lists of a tunnel; the lists must not be
+// modified
+func (m *Manager) AccessLists(id string) AccessLists {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.Access
+	}
+	return AccessLists{}
+}
+
+// ClientLimits override the load balancer's per-client limits for a tunnel;
+// zero values use the load balancer's
+type ClientLimits struct {
+	RequestsPerSecond int
+	Burst             int
+	MaxConnections    int
+}
+
+// SetClientLimits changes the per-client limits of a tunnel
+func (m *Manager) SetClientLimits(id string, limits ClientLimits) error {
+	if limits.RequestsPerSecond < 0 || limits.Burst < 0 || limits.MaxConnections < 0 {
+		return fmt.Errorf("invalid client limits: %+v", limits)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.ClientLimits = limits
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// ClientLimits returns the per-client limits of a tunnel
+func (m *Manager) ClientLimits(id string) ClientLimits {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.ClientLimits
+	}
+	return ClientLimits{}
+}
+
+// RequestPolicy overrides the load balancer's request body limit and
+// retries for a tunnel
+type RequestPolicy struct {
+	// MaxRequestBody, if non-zero, is the largest request body accepted in
+	// bytes
+	MaxRequestBody int64
+
+	// RetryAttempts, if set, is how often a request that failed to reach
+	// the target is retried; zero disables retries
+	RetryAttempts *int
+}
+
+// SetRequestPolicy changes the request body limit and retries of a tunnel
+func (m *Manager) SetRequestPolicy(id string, policy RequestPolicy) error {
+	if policy.MaxRequestBody < 0 || (policy.RetryAttempts != nil && *policy.RetryAttempts < 0) {
+		return fmt.Errorf("invalid request policy: %+v", policy)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.RequestPolicy = policy
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// RequestPolicy returns the request body limit and retries of a tunnel
+func (m *Manager) RequestPolicy(id string) RequestPolicy {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.RequestPolicy
+	}
+	return RequestPolicy{}
+}
+
+// Mirror sends copies of a tunnel's HTTP requests to a shadow tunnel,
+// whose responses are discarded
+type Mirror struct {
+	TunnelID string
+
+	// Percent of requests mirrored, 1 to 100; zero mirrors all
+	Percent int
+}
+
+// SetMirror sets the shadow tunnel receiving copies of a tunnel's
+// requests, or stops mirroring them if mirror is nil. The shadow tunnel
+// need not exist yet; requests are mirrored while it is routed.
+func (m *Manager) SetMirror(id string, mirror *Mirror) error {
+	if mirror != nil {
+		if mirror.TunnelID == "" {
+			return fmt.Errorf("mirror tunnel ID is required")
+		}
+		if mirror.TunnelID == id {
+			return fmt.Errorf("tunnel %s cannot mirror to itself", id)
+		}
+		if mirror.Percent < 0 || mirror.Percent > 100 {
+			return fmt.Errorf("invalid mirror percent: %d", mirror.Percent)
+		}
+		copied := *mirror
+		mirror = &copied
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.Mirror = mirror
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// Mirror returns a copy of the mirror of a tunnel, nil if it has none
+func (m *Manager) Mirror(id string) *Mirror {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists && tunnel.Mirror != nil {
+		mirror := *tunnel.Mirror
+		return &mirror
+	}
+	return nil
+}
+
+// EdgeAuth authenticates the clients of a tunnel at the load balancer,
+// with HTTP basic auth or an OpenID Connect login
+type EdgeAuth struct {
+	// BasicAuth maps user names to bcrypt hashes of their passwords
+	BasicAuth map[string]string
+
+	OIDC *OIDCAuth
+}
+
+// OIDCAuth signs the clients of a tunnel in with an OpenID Connect
+// provider, optionally only users with the allowed email addresses or
+// domains
+type OIDCAuth struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	AllowedEmails  []string
+	AllowedDomains []string
+}
+
+func (a *EdgeAuth) clone() *EdgeAuth {
+	clone := &EdgeAuth{BasicAuth: maps.Clone(a.BasicAuth)}
+	if a.OIDC != nil {
+		oidc := *a.OIDC
+		oidc.AllowedEmails = slices.Clone(a.OIDC.AllowedEmails)
+		oidc.AllowedDomains = slices.Clone(a.OIDC.AllowedDomains)
+		clone.OIDC = &oidc
+	}
+	return clone
+}
+
+// SetEdgeAuth replaces the edge authentication of a tunnel, or removes it
+// if auth is nil; auth must not be modified afterwards
+func (m *Manager) SetEdgeAuth(id string, auth *EdgeAuth) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.EdgeAuth = auth
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// EdgeAuth returns the edge authentication of a tunnel, nil if it has
+// none; it must not be modified
+func (m *Manager) EdgeAuth(id string) *EdgeAuth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.EdgeAuth
+	}
+	return nil
+}
+
+// ClientCertAuth requires the clients of a tunnel to present a certificate
+// signed by one of its CAs, on all of its hostnames or the listed ones
+type ClientCertAuth struct {
+	// CA is a PEM bundle of CA certificates
+	CA        string
+	Hostnames []string
+}
+
+// SetClientCertAuth replaces the client certificate requirement of a
+// tunnel, or removes it if auth is nil; auth must not be modified
+// afterwards
+func (m *Manager) SetClientCertAuth(id string, auth *ClientCertAuth) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.ClientCertAuth = auth
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// ClientCertAuth returns the client certificate requirement of a tunnel,
+// nil if it has none; it must not be modified
+func (m *Manager) ClientCertAuth(id string) *ClientCertAuth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.ClientCertAuth
+	}
+	return nil
+}
+
+// FilterRule blocks the HTTP requests of a tunnel matching all of its set
+// conditions: one of the methods, and the regular expressions for the path,
+// the User-Agent header and the values of headers
+type FilterRule struct {
+	Name      string
+	Methods   []string
+	Path      string
+	UserAgent string
+	Headers   map[string]string
+}
+
+// SetRequestFilters replaces the request filter rules of a tunnel; the
+// rules must not be modified afterwards
+func (m *Manager) SetRequestFilters(id string, rules []FilterRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	tunnel.RequestFilters = rules
+	m.optionsChanged(tunnel)
+	return nil
+}
+
+// RequestFilters returns the request filter rules of a tunnel; they must
+// not be modified
+func (m *Manager) RequestFilters(id string) []FilterRule {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.RequestFilters
+	}
+	return nil
+}
+
+// AddHostname routes another hostname to a tunnel's target. Adding a
+// hostname the tunnel already has does nothing.
+func (m *Manager) AddHostname(id, hostname string) error {
+	if hostname == "" {
+		return fmt.Errorf("hostname is required")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	for _, existing := range tunnel.Hostnames {
+		if existing == hostname {
+			return nil
+		}
+	}
+
+	hostnames := append(append([]string(nil), tunnel.Hostnames...), hostname)
+	if err := m.checkTenantLimits(tunnel, hostnames); err != nil {
+		return err
+	}
+	tunnel.Hostnames = hostnames
+	m.hostnamesChanged(tunnel)
+	return nil
+}
+
+// RemoveHostname stops routing a hostname to a tunnel's target. Removing
+// the tunnel's primary hostname makes the next one primary; the last
+// hostname cannot be removed.
+func (m *Manager) RemoveHostname(id, hostname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+
+	kept := make([]string, 0, len(tunnel.Hostnames))
+	for _, existing := range tunnel.Hostnames {
+		if existing != hostname {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(tunnel.Hostnames) {
+		return notFoundf("tunnel %s has no hostname %s", id, hostname)
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("cannot remove the last hostname of tunnel %s", id)
+	}
+
+	tunnel.Hostnames = kept
+	tunnel.Hostname = kept[0]
+	m.hostnamesChanged(tunnel)
+	return nil
+}
+
+// ErrHostnamesConflict is returned when a tunnel is created again with other
+// hostnames than it was created with
+var ErrHostnamesConflict error = &kindError{kind: ErrConflict, message: "tunnel already exists with other hostnames"}
+
+// SetHostnames replaces the hostnames of a tunnel, the first becoming its
+// primary hostname
+func (m *Manager) SetHostnames(id string, hostnames []string) error {
+	unique, err := uniqueHostnames(hostnames)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	if equalStrings(tunnel.Hostnames, unique) {
+		return nil
+	}
+	if err := m.checkTenantLimits(tunnel, unique); err != nil {
+		return err
+	}
+
+	tunnel.Hostnames = unique
+	tunnel.Hostname = unique[0]
+	m.hostnamesChanged(tunnel)
+	return nil
+}
+
+// SetInitialHostnames sets the hostnames of a newly created tunnel like
+// SetHostnames. For a tunnel that already has them, i.e. a retried create,
+// it changes nothing, so that hostnames added since are kept, and fails
+// with ErrHostnamesConflict if they differ from the tunnel's initial ones.
+func (m *Manager) SetInitialHostnames(id string, hostnames []string) error {
+	unique, err := uniqueHostnames(hostnames)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	if tunnel.initialHostnames != nil {
+		if !equalStrings(tunnel.initialHostnames, unique) {
+			return ErrHostnamesConflict
+		}
+		return nil
+	}
+
+	if equalStrings(tunnel.Hostnames, unique) {
+		tunnel.initialHostnames = unique
+		return nil
+	}
+	if err := m.checkTenantLimits(tunnel, unique); err != nil {
+		return err
+	}
+	tunnel.initialHostnames = unique
+	tunnel.Hostnames = unique
+	tunnel.Hostname = unique[0]
+	m.hostnamesChanged(tunnel)
+	return nil
+}
+
+// uniqueHostnames returns hostnames without duplicates, failing if it is
+// empty or has an empty hostname
+func uniqueHostnames(hostnames []string) ([]string, error) {
+	var unique []string
+	seen := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		if hostname == "" {
+			return nil, fmt.Errorf("hostname is required")
+		}
+		if !seen[hostname] {
+			seen[hostname] = true
+			unique = append(unique, hostname)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, fmt.Errorf("a tunnel needs at least one hostname")
+	}
+	return unique, nil
+}
+
+// Hostnames returns a copy of all hostnames of a tunnel, starting with its
+// primary hostname
+func (m *Manager) Hostnames(id string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return slices.Clone(tunnel.Hostnames)
+	}
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hostnamesChanged re-routes a tunnel whose hostnames changed and notifies
+// subscribers. Must be called with m.mu held.
+func (m *Manager) hostnamesChanged(tunnel *TunnelInfo) {
+	if tunnel.routed && m.router != nil {
+		m.router.RemoveRoute(tunnel.ID)
+		m.routeHostnames(tunnel)
+	}
+	m.logger.Info().
+		Str("tunnel_id", tunnel.ID).
+		Strs("hostnames", tunnel.Hostnames).
+		Msg("Changed hostnames of tunnel")
+
+	m.publish(EventHostnamesChanged, tunnel, "")
+}
+
+// HeartbeatTimeout returns the heartbeat window used by the liveness monitor,
+// or zero if liveness tracking is disabled
+func (m *Manager) HeartbeatTimeout() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.heartbeatTimeout
+}
+
+func (m *Manager) checkLiveness(now time.Time, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tunnel := range m.tunnels {
+		if tunnel.LastHeartbeat.IsZero() || tunnel.heartbeatStale {
+			continue
+		}
+		if now.Sub(tunnel.LastHeartbeat) > timeout {
+			tunnel.heartbeatStale = true
+			m.logger.Warn().
+				Str("tunnel_id", tunnel.ID).
+				Time("last_heartbeat", tunnel.LastHeartbeat).
+				Msg("Tunnel heartbeats stopped")
+			m.updateStatus(tunnel, "heartbeat timeout")
+		}
+	}
+}
+
+// updateStatus derives the tunnel's status from its heartbeats and WireGuard
+// handshakes, publishing an event with message if it changed. Must be called
+// with m.mu held.
+func (m *Manager) updateStatus(tunnel *TunnelInfo, message string) {
+	var reasons []string
+	if tunnel.heartbeatStale {
+		reasons = append(reasons, "heartbeat timeout")
+	}
+	if tunnel.HandshakeStale {
+		reasons = append(reasons, "handshake timeout")
+	}
+	tunnel.DegradedReason = strings.Join(reasons, ", ")
+
+	status := StatusActive
+	if len(reasons) > 0 {
+		status = StatusDegraded
+	}
+	if status == tunnel.Status {
+		return
+	}
+	tunnel.Status = status
+
+	if status == StatusDegraded {
+		m.logger.Warn().
+			Str("tunnel_id", tunnel.ID).
+			Str("reason", tunnel.DegradedReason).
+			Msg("Tunnel degraded")
+		m.publish(EventTunnelDegraded, tunnel, message)
+	} else {
+		m.logger.Info().
+			Str("tunnel_id", tunnel.ID).
+			Msg("Tunnel recovered")
+		m.publish(EventTunnelRecovered, tunnel, message)
+	}
+}
+
+// StartHandshakeMonitor periodically reads the transports' peer statistics,
+// marking tunnels degraded while their latest handshake is older than
+// timeout and, if removeAfter is positive, removing tunnels whose peer has
+// not completed a handshake for that long. Peers that never completed a
+// handshake are measured from the tunnel's creation. A zero timeout
+// disables monitoring. The monitor runs until ctx is cancelled.
+func (m *Manager) StartHandshakeMonitor(ctx context.Context, timeout, removeAfter time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(peerStatsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				stats, err := m.peerStats()
+				if err != nil {
+					m.logger.Warn().Err(err).Msg("Failed to read tunnel transport statistics")
+					continue
+				}
+				for _, id := range m.applyPeerStats(now, stats, timeout, removeAfter) {
+					if err := m.RemoveTunnel(id); err != nil {
+						m.logger.Error().Err(err).Str("tunnel_id", id).Msg("Failed to remove dead WireGuard peer")
+					}
+				}
+			}
+		}
+	}()
+}
+
+// peerStats reads the connection statistics of all transports
+func (m *Manager) peerStats() (map[string]PeerStats, error) {
+	m.mu.RLock()
+	transports := make([]Transport, 0, len(m.transports))
+	for _, name := range m.transportNames() {
+		transports = append(transports, m.transports[name])
+	}
+	m.mu.RUnlock()
+
+	all := make(map[string]PeerStats)
+	for _, transport := range transports {
+		stats, err := transport.Stats()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", transport.Name(), err)
+		}
+		for id, peer := range stats {
+			all[id] = peer
+		}
+	}
+	return all, nil
+}
+
+// peerStatsInterval is how often the handshake monitor reads peer statistics
+const peerStatsInterval = 30 * time.Second
+
+// applyPeerStats records peer statistics and updates the handshake status of
+// WireGuard tunnels, returning the tunnels whose peers are dead for longer
+// than removeAfter
+func (m *Manager) applyPeerStats(now time.Time, stats map[string]PeerStats, timeout, removeAfter time.Duration) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var dead []string
+	for id, tunnel := range m.tunnels {
+		if tunnel.Transport == "" {
+			continue
+		}
+		peer, ok := stats[id]
+		if !ok {
+			continue
+		}
+		tunnel.Peer = peer
+
+		since := peer.LatestHandshake
+		if since.IsZero() {
+			since = tunnel.Created
+		}
+		age := now.Sub(since)
+
+		if removeAfter > 0 && age > removeAfter {
+			m.logger.Warn().
+				Str("tunnel_id", id).
+				Dur("handshake_age", age).
+				Msg("Removing tunnel with dead WireGuard peer")
+			dead = append(dead, id)
+			continue
+		}
+
+		stale := age > timeout
+		if stale == tunnel.HandshakeStale {
+			continue
+		}
+		tunnel.HandshakeStale = stale
+		if stale {
+			m.updateStatus(tunnel, "handshake timeout")
+		} else {
+			m.updateStatus(tunnel, "handshake completed")
+		}
+	}
+	return dead
+}
+
+// RotateKeys replaces the WireGuard server keys of a tunnel and, if
+// clientPublicKey is set, the client's key, returning a copy of the updated
+// tunnel
+func (m *Manager) RotateKeys(id, clientPublicKey string) (*TunnelInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return nil, tunnelNotFound(id)
+	}
+	if err := m.rotateKeys(tunnel, clientPublicKey, "rotation requested"); err != nil {
+		return nil, err
+	}
+	return tunnel.Clone(), nil
+}
+
+// rotateKeys rotates the keys of a tunnel. Must be called with m.mu held.
+func (m *Manager) rotateKeys(tunnel *TunnelInfo, clientPublicKey, reason string) error {
+	if tunnel.WireGuardConfig == nil {
+		return fmt.Errorf("tunnel %s does not use WireGuard", tunnel.ID)
+	}
+
+	config, err := m.wireGuard.RotateKeys(tunnel, clientPublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to rotate WireGuard keys: %v", err)
+	}
+	tunnel.WireGuardConfig = config
+	if clientPublicKey != "" {
+		tunnel.ClientPublicKey = clientPublicKey
+	}
+	tunnel.KeysRotatedAt = time.Now()
+
+	m.publish(EventKeysRotated, tunnel, reason)
+	return nil
+}
+
+// StartKeyRotation periodically rotates the keys of tunnels with a key
+// rotation interval once their keys are that old. It runs until ctx is
+// cancelled.
+func (m *Manager) StartKeyRotation(ctx context.Context, checkInterval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.rotateDueKeys(now)
+			}
+		}
+	}()
+}
+
+func (m *Manager) rotateDueKeys(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, tunnel := range m.tunnels {
+		if !tunnel.keysDue(now) {
+			continue
+		}
+		if err := m.rotateKeys(tunnel, "", "scheduled rotation"); err != nil {
+			m.logger.Error().
+				Err(err).
+				Str("tunnel_id", tunnel.ID).
+				Msg("Failed to rotate WireGuard keys")
+		}
+	}
+}
+
+// keysDue reports whether the tunnel's keys are due for scheduled rotation
+func (t *TunnelInfo) keysDue(now time.Time) bool {
+	interval := t.WireGuardOptions.KeyRotationInterval
+	if interval <= 0 || t.WireGuardConfig == nil {
+		return false
+	}
+	since := t.KeysRotatedAt
+	if since.IsZero() {
+		since = t.Created
+	}
+	return now.Sub(since) >= interval
+}
+
+// Stats returns the traffic statistics collector shared with the load balancer
+func (m *Manager) Stats() *stats.Collector {
+	return m.stats
+}
+
+// LastHandshake returns the latest WireGuard handshake time for a tunnel.
+// A zero time is returned for tunnels without WireGuard or without a handshake yet.
+func (m *Manager) LastHandshake(id string) (time.Time, error) {
+	tunnel, err := m.GetTunnel(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return m.wireGuard.LatestHandshake(tunnel)
+}
+
+// GetAllTunnels returns copies of all active tunnels
+func (m *Manager) GetAllTunnels() []*TunnelInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tunnels := make([]*TunnelInfo, 0, len(m.tunnels))
+	for _, tunnel := range m.tunnels {
+		tunnels = append(tunnels, tunnel.Clone())
+	}
+
+	return tunnels
+}
+
+// Subscribe returns a channel that receives tunnel lifecycle events and a
+// function that cancels the subscription. Events are dropped for subscribers
+// whose buffer is full, so slow consumers never block tunnel operations.
+func (m *Manager) Subscribe(buffer int) (<-chan Event, func()) {
+	return m.events.subscribe(buffer)
+}
+
+func (m *Manager) publish(eventType EventType, tunnel *TunnelInfo, message string) {
+	dropped := m.events.publish(Event{
+		Type:      eventType,
+		TunnelID:  tunnel.ID,
+		Hostname:  tunnel.Hostname,
+		Hostnames: slices.Clone(tunnel.Hostnames),
+		Time:      time.Now(),
+		Message:   message,
+	})
+	if dropped > 0 {
+		m.logger.Warn().
+			Str("tunnel_id", tunnel.ID).
+			Str("event", string(eventType)).
+			Int("dropped", dropped).
+			Msg("Dropped tunnel event for slow subscribers")
+	}
+}
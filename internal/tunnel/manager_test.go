@@ -1,6 +1,16 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -287,4 +297,1276 @@ func TestGetAllTunnels(t *testing.T) {
 			t.Errorf("Tunnel %s not found in results", tt.id)
 		}
 	}
-} 
\ No newline at end of file
+} 
+
+func TestTunnelCopies(t *testing.T) {
+	manager := NewManager(10)
+	if _, err := manager.CreateTunnel("test-1", "test.example.com", 8080, "", map[string]string{"env": "test"}); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	enabled := true
+	if err := manager.SetHeaderRules("test-1", &HeaderRules{Request: HeaderRuleSet{Set: map[string]string{"X-Env": "test"}}}); err != nil {
+		t.Fatalf("Failed to set header rules: %v", err)
+	}
+	if err := manager.SetCompression("test-1", Compression{Enabled: &enabled}); err != nil {
+		t.Fatalf("Failed to set compression: %v", err)
+	}
+
+	// Changing what the getters return leaves the tunnel as it is
+	tunnel, _ := manager.GetTunnel("test-1")
+	tunnel.Metadata["env"] = "changed"
+	tunnel.Hostnames[0] = "changed.example.com"
+	tunnel.HeaderRules.Request.Set["X-Env"] = "changed"
+	*tunnel.Compression.Enabled = false
+	manager.GetAllTunnels()[0].Status = StatusDegraded
+	manager.Hostnames("test-1")[0] = "changed.example.com"
+
+	tunnel, _ = manager.GetTunnel("test-1")
+	if tunnel.Metadata["env"] != "test" || tunnel.Hostnames[0] != "test.example.com" || tunnel.Status != StatusActive {
+		t.Errorf("Expected tunnel to be unchanged, got metadata %v, hostnames %v and status %s", tunnel.Metadata, tunnel.Hostnames, tunnel.Status)
+	}
+	if tunnel.HeaderRules.Request.Set["X-Env"] != "test" || !*tunnel.Compression.Enabled {
+		t.Errorf("Expected settings to be unchanged, got header rules %+v and compression %v", tunnel.HeaderRules, *tunnel.Compression.Enabled)
+	}
+}
+
+// TestConcurrentTunnelAccess reads tunnels while they change, for -race
+func TestConcurrentTunnelAccess(t *testing.T) {
+	manager := NewManager(10)
+	if _, err := manager.CreateTunnel("test-1", "test.example.com", 8080, "", map[string]string{"env": "test"}); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	events, cancel := manager.Subscribe(1000)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				tunnel, err := manager.GetTunnel("test-1")
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				tunnel.Hostnames = append(tunnel.Hostnames[:1], "reader.example.com")
+				tunnel.Metadata["reader"] = "yes"
+				// Let the writer run while the copy is in use
+				runtime.Gosched()
+				_ = tunnel.LastHeartbeat
+				for _, tunnel := range manager.GetAllTunnels() {
+					tunnel.Status = StatusDegraded
+				}
+				hostnames := manager.Hostnames("test-1")
+				runtime.Gosched()
+				_ = hostnames[len(hostnames)-1]
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		manager.AddHostname("test-1", "www.example.com")
+		manager.Heartbeat("test-1", "healthy", "1.0.0")
+		manager.RemoveHostname("test-1", "www.example.com")
+		runtime.Gosched()
+	}
+	close(done)
+	wg.Wait()
+
+	for len(events) > 0 {
+		event := <-events
+		for _, hostname := range event.Hostnames {
+			if hostname == "reader.example.com" {
+				t.Error("Expected events not to share hostnames with readers")
+			}
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	manager := NewManager(10)
+
+	events, cancel := manager.Subscribe(10)
+	defer cancel()
+
+	if _, err := manager.CreateTunnel("test-1", "test.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	if err := manager.RemoveTunnel("test-1"); err != nil {
+		t.Fatalf("Failed to remove test tunnel: %v", err)
+	}
+
+	expected := []EventType{EventTunnelCreated, EventTunnelRemoved}
+	for _, eventType := range expected {
+		select {
+		case event := <-events:
+			if event.Type != eventType {
+				t.Errorf("Expected event type %s, got %s", eventType, event.Type)
+			}
+			if event.TunnelID != "test-1" {
+				t.Errorf("Expected tunnel ID test-1, got %s", event.TunnelID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s event", eventType)
+		}
+	}
+
+	// Cancelling closes the channel
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("Expected events channel to be closed after cancel")
+	}
+}
+
+func TestHeartbeatLiveness(t *testing.T) {
+	manager := NewManager(10)
+	timeout := time.Minute
+
+	if _, err := manager.CreateTunnel("test-1", "test1.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+	if _, err := manager.CreateTunnel("test-2", "test2.example.com", 8081, "", nil); err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	// Only tunnels that have sent a heartbeat are monitored
+	tunnel, err := manager.Heartbeat("test-1", "healthy", "v1.2.3")
+	if err != nil {
+		t.Fatalf("Unexpected error recording heartbeat: %v", err)
+	}
+	if tunnel.ClientHealth != "healthy" || tunnel.ClientVersion != "v1.2.3" {
+		t.Errorf("Expected client health/version to be recorded, got %s/%s", tunnel.ClientHealth, tunnel.ClientVersion)
+	}
+
+	events, cancel := manager.Subscribe(10)
+	defer cancel()
+
+	manager.checkLiveness(time.Now().Add(2*timeout), timeout)
+
+	if tunnel, _ := manager.GetTunnel("test-1"); tunnel.Status != StatusDegraded {
+		t.Errorf("Expected test-1 to be degraded, got %s", tunnel.Status)
+	}
+	if tunnel, _ := manager.GetTunnel("test-2"); tunnel.Status != StatusActive {
+		t.Errorf("Expected test-2 to stay active, got %s", tunnel.Status)
+	}
+
+	// A new heartbeat recovers the tunnel
+	if _, err := manager.Heartbeat("test-1", "healthy", "v1.2.3"); err != nil {
+		t.Fatalf("Unexpected error recording heartbeat: %v", err)
+	}
+	if tunnel, _ := manager.GetTunnel("test-1"); tunnel.Status != StatusActive {
+		t.Errorf("Expected test-1 to recover, got %s", tunnel.Status)
+	}
+
+	for _, eventType := range []EventType{EventTunnelDegraded, EventTunnelRecovered} {
+		select {
+		case event := <-events:
+			if event.Type != eventType {
+				t.Errorf("Expected event type %s, got %s", eventType, event.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s event", eventType)
+		}
+	}
+
+	// Heartbeats for unknown tunnels fail
+	if _, err := manager.Heartbeat("non-existent", "", ""); err == nil {
+		t.Error("Expected error for heartbeat on non-existent tunnel, got nil")
+	}
+}
+
+func TestCreateTunnelIdempotent(t *testing.T) {
+	manager := NewManager(1)
+	metadata := map[string]string{"env": "test"}
+
+	first, err := manager.CreateTunnel("test-1", "test.example.com", 8080, "", metadata)
+	if err != nil {
+		t.Fatalf("Failed to create test tunnel: %v", err)
+	}
+
+	// An identical create returns the existing tunnel, even at the tunnel limit
+	second, err := manager.CreateTunnel("test-1", "test.example.com", 8080, "", map[string]string{"env": "test"})
+	if err != nil {
+		t.Fatalf("Unexpected error for identical create: %v", err)
+	}
+	if !reflect.DeepEqual(second, first) {
+		t.Error("Expected identical create to return the existing tunnel")
+	}
+
+	// Any difference in configuration is still a conflict
+	if _, err := manager.CreateTunnel("test-1", "test.example.com", 8080, "", map[string]string{"env": "prod"}); err == nil {
+		t.Error("Expected error for conflicting metadata, got nil")
+	}
+	if _, err := manager.CreateTunnel("test-1", "test.example.com", 8081, "", metadata); err == nil {
+		t.Error("Expected error for conflicting target port, got nil")
+	}
+}
+
+func TestCreateTunnelWithOptions(t *testing.T) {
+	manager := NewManager(10)
+
+	opts := WireGuardOptions{PersistentKeepalive: 15}
+	tunnel, err := manager.CreateTunnelWithOptions("opts-1", "opts.example.com", 8080, "", nil, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tunnel.WireGuardOptions != opts {
+		t.Errorf("Expected options %+v, got %+v", opts, tunnel.WireGuardOptions)
+	}
+
+	// Retrying with the same options returns the tunnel, other options conflict
+	if _, err := manager.CreateTunnelWithOptions("opts-1", "opts.example.com", 8080, "", nil, opts); err != nil {
+		t.Errorf("Expected identical retry to succeed, got %v", err)
+	}
+	if _, err := manager.CreateTunnelWithOptions("opts-1", "opts.example.com", 8080, "", nil, WireGuardOptions{MTU: 1380}); err == nil {
+		t.Error("Expected error for different options, got nil")
+	}
+
+	if _, err := manager.CreateTunnelWithOptions("opts-2", "opts.example.com", 8080, "", nil, WireGuardOptions{MTU: 100}); err == nil {
+		t.Error("Expected error for invalid MTU, got nil")
+	}
+	if _, err := manager.CreateTunnelWithOptions("opts-3", "opts.example.com", 8080, "", nil, WireGuardOptions{PrivateKey: "not-a-key"}); err == nil {
+		t.Error("Expected error for invalid private key, got nil")
+	}
+}
+
+func TestKeysDue(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	wg := &WireGuardConfig{ClientIP: "10.10.0.2"}
+
+	tests := []struct {
+		name     string
+		tunnel   TunnelInfo
+		now      time.Time
+		expected bool
+	}{
+		{
+			name:   "No rotation interval",
+			tunnel: TunnelInfo{Created: created, WireGuardConfig: wg},
+			now:    created.Add(365 * 24 * time.Hour),
+		},
+		{
+			name:   "Without WireGuard",
+			tunnel: TunnelInfo{Created: created, WireGuardOptions: WireGuardOptions{KeyRotationInterval: time.Hour}},
+			now:    created.Add(2 * time.Hour),
+		},
+		{
+			name:   "Keys younger than interval",
+			tunnel: TunnelInfo{Created: created, WireGuardConfig: wg, WireGuardOptions: WireGuardOptions{KeyRotationInterval: time.Hour}},
+			now:    created.Add(59 * time.Minute),
+		},
+		{
+			name:     "Keys from creation due",
+			tunnel:   TunnelInfo{Created: created, WireGuardConfig: wg, WireGuardOptions: WireGuardOptions{KeyRotationInterval: time.Hour}},
+			now:      created.Add(time.Hour),
+			expected: true,
+		},
+		{
+			name: "Recently rotated keys",
+			tunnel: TunnelInfo{
+				Created: created, WireGuardConfig: wg, KeysRotatedAt: created.Add(90 * time.Minute),
+				WireGuardOptions: WireGuardOptions{KeyRotationInterval: time.Hour},
+			},
+			now: created.Add(2 * time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.tunnel.keysDue(tt.now); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	manager := NewManager(10)
+	for _, id := range []string{"preview", "app"} {
+		if _, err := manager.CreateTunnel(id, id+".example.com", 8080, "", nil); err != nil {
+			t.Fatalf("Failed to create test tunnel: %v", err)
+		}
+	}
+	if _, err := manager.RefreshExpiry("preview", 0); err == nil {
+		t.Error("Expected an error refreshing a tunnel without TTL")
+	}
+	if err := manager.SetExpiry("preview", time.Time{}, -time.Second); err == nil {
+		t.Error("Expected an error for a negative TTL")
+	}
+	if err := manager.SetExpiry("missing", time.Time{}, 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown tunnel, got %v", err)
+	}
+
+	expiresAt := time.Now().Add(10 * time.Minute)
+	if err := manager.SetExpiry("preview", expiresAt, 0); err != nil {
+		t.Fatalf("Failed to set expiry: %v", err)
+	}
+	refreshed, err := manager.RefreshExpiry("preview", 0)
+	if err != nil {
+		t.Fatalf("Failed to refresh expiry: %v", err)
+	}
+	if refreshed.TTL <= 9*time.Minute || refreshed.TTL > 10*time.Minute {
+		t.Errorf("Expected a TTL of about 10 minutes, got %s", refreshed.TTL)
+	}
+	if refreshed, _ = manager.RefreshExpiry("preview", time.Hour); refreshed.TTL != time.Hour || refreshed.Remaining(time.Now()) <= 59*time.Minute {
+		t.Errorf("Expected a refresh by an hour, got TTL %s expiring at %s", refreshed.TTL, refreshed.ExpiresAt)
+	}
+
+	events, cancel := manager.Subscribe(10)
+	defer cancel()
+
+	manager.removeExpired(time.Now())
+	if len(manager.GetAllTunnels()) != 2 {
+		t.Fatal("Expected no tunnel to be removed before its expiry")
+	}
+	manager.removeExpired(refreshed.ExpiresAt)
+	if _, err := manager.GetTunnel("preview"); err == nil {
+		t.Error("Expected the expired tunnel to be removed")
+	}
+	if _, err := manager.GetTunnel("app"); err != nil {
+		t.Errorf("Expected the tunnel without expiry to be kept: %v", err)
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventTunnelRemoved || event.TunnelID != "preview" || event.Message != "expired" {
+			t.Errorf("Expected an expired removal of preview, got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the removed event")
+	}
+}
+
+func TestRotateKeysWithoutWireGuard(t *testing.T) {
+	manager := NewManager(10)
+	if _, err := manager.CreateTunnel("plain", "plain.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := manager.RotateKeys("plain", ""); err == nil {
+		t.Error("Expected error rotating keys of a tunnel without WireGuard, got nil")
+	}
+	if _, err := manager.RotateKeys("missing", ""); err == nil {
+		t.Error("Expected error rotating keys of a missing tunnel, got nil")
+	}
+}
+
+func TestRemoveWireGuardPeers(t *testing.T) {
+	manager := NewManager(10)
+	manager.tunnels["plain"] = &TunnelInfo{ID: "plain", Transport: TransportWireGuard}
+	manager.tunnels["ssh"] = &TunnelInfo{ID: "ssh", Transport: "ssh"}
+	manager.tunnels["web"] = &TunnelInfo{ID: "web", Transport: TransportWireGuard, WireGuardConfig: &WireGuardConfig{}}
+
+	// Only the tunnel with a WireGuard peer is torn down; its peer is not
+	// known to the interface here
+	removed, err := manager.RemoveWireGuardPeers()
+	if removed != 0 || err == nil || !strings.Contains(err.Error(), "web: no WireGuard peer") {
+		t.Errorf("Expected the peer of web to be attempted, got %d, %v", removed, err)
+	}
+	if len(manager.tunnels) != 3 {
+		t.Errorf("Expected the tunnels to be kept, got %d", len(manager.tunnels))
+	}
+}
+
+func TestApplyPeerStats(t *testing.T) {
+	manager := NewManager(10)
+	created := time.Now().Add(-time.Hour)
+	for _, id := range []string{"fresh", "stale", "dead", "never"} {
+		manager.tunnels[id] = &TunnelInfo{
+			ID: id, Hostname: id + ".example.com", Created: created, Status: StatusActive,
+			Transport: TransportWireGuard, WireGuardConfig: &WireGuardConfig{},
+		}
+	}
+	manager.tunnels["plain"] = &TunnelInfo{ID: "plain", Created: created, Status: StatusActive}
+
+	events, cancel := manager.Subscribe(10)
+	defer cancel()
+
+	now := time.Now()
+	stats := map[string]PeerStats{
+		"fresh": {LatestHandshake: now.Add(-time.Minute), ReceivedBytes: 10, SentBytes: 20},
+		"stale": {LatestHandshake: now.Add(-5 * time.Minute)},
+		"dead":  {LatestHandshake: now.Add(-30 * time.Minute)},
+		"never": {},
+	}
+	dead := manager.applyPeerStats(now, stats, 3*time.Minute, 20*time.Minute)
+
+	if len(dead) != 2 {
+		t.Errorf("Expected dead and never-connected peers to be removed, got %v", dead)
+	}
+	fresh := manager.tunnels["fresh"]
+	if fresh.Status != StatusActive || fresh.Peer.ReceivedBytes != 10 {
+		t.Errorf("Expected fresh tunnel to stay active with stats, got %s %+v", fresh.Status, fresh.Peer)
+	}
+	stale := manager.tunnels["stale"]
+	if stale.Status != StatusDegraded || !stale.HandshakeStale || stale.DegradedReason != "handshake timeout" {
+		t.Errorf("Expected stale tunnel degraded by handshake timeout, got %s %q", stale.Status, stale.DegradedReason)
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != EventTunnelDegraded || event.TunnelID != "stale" {
+			t.Errorf("Expected degraded event for stale, got %s for %s", event.Type, event.TunnelID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for degraded event")
+	}
+
+	// A heartbeat does not recover a tunnel whose handshakes stopped
+	stale.LastHeartbeat = now
+	if _, err := manager.Heartbeat("stale", "healthy", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stale.Status != StatusDegraded {
+		t.Errorf("Expected stale tunnel to stay degraded after heartbeat, got %s", stale.Status)
+	}
+
+	// A new handshake does
+	stats["stale"] = PeerStats{LatestHandshake: now}
+	manager.applyPeerStats(now, stats, 3*time.Minute, 0)
+	if stale.Status != StatusActive || stale.HandshakeStale || stale.DegradedReason != "" {
+		t.Errorf("Expected stale tunnel to recover, got %s %q", stale.Status, stale.DegradedReason)
+	}
+}
+
+// fakePinger answers the pings to the addresses it holds after their delay
+type fakePinger map[netip.Addr]time.Duration
+
+func (p fakePinger) Ping(ctx context.Context, addr netip.Addr) (time.Duration, error) {
+	if rtt, ok := p[addr]; ok {
+		return rtt, nil
+	}
+	return 0, context.DeadlineExceeded
+}
+
+func TestProbePaths(t *testing.T) {
+	manager := NewManager(10)
+	for id, ip := range map[string]string{"up": "10.8.0.2", "down": "10.8.0.3"} {
+		manager.tunnels[id] = &TunnelInfo{
+			ID: id, Hostname: id + ".example.com", Status: StatusActive,
+			Transport: TransportWireGuard, WireGuardConfig: &WireGuardConfig{ClientIP: ip},
+		}
+	}
+	manager.tunnels["plain"] = &TunnelInfo{ID: "plain", Status: StatusActive}
+
+	pinger := fakePinger{netip.MustParseAddr("10.8.0.2"): 20 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		manager.probePaths(context.Background(), pinger, time.Second)
+	}
+
+	up := manager.PathStats("up")
+	if up.Sent != 3 || up.Lost != 0 || up.RTT != 20*time.Millisecond || up.LastRTT != 20*time.Millisecond || up.LastProbe.IsZero() {
+		t.Errorf("Expected three answered probes of 20ms, got %+v", up)
+	}
+	down := manager.PathStats("down")
+	if down.Sent != 3 || down.Lost != 3 || down.LossRatio() != 1 || !down.unreachable() {
+		t.Errorf("Expected three lost probes, got %+v", down)
+	}
+	if plain := manager.PathStats("plain"); plain.Sent != 0 {
+		t.Errorf("Expected tunnels without WireGuard not to be probed, got %+v", plain)
+	}
+
+	// The statistics cover the latest probes only
+	pinger[netip.MustParseAddr("10.8.0.3")] = 10 * time.Millisecond
+	for i := 0; i < pathProbeWindow; i++ {
+		manager.probePaths(context.Background(), pinger, time.Second)
+	}
+	if down = manager.PathStats("down"); down.Sent != pathProbeWindow || down.Lost != 0 || down.RTT != 10*time.Millisecond {
+		t.Errorf("Expected the path to have recovered, got %+v", down)
+	}
+}
+
+func TestAddWireGuardInterface(t *testing.T) {
+	manager := NewManager(10)
+
+	if !manager.HasWireGuardInterface("") || !manager.HasWireGuardInterface(DefaultWireGuardInterface) {
+		t.Error("Expected the default interface to be available")
+	}
+	if manager.HasWireGuardInterface("wg1") {
+		t.Error("Expected wg1 to be unknown before it is added")
+	}
+
+	if err := manager.AddWireGuardInterface(WireGuardInterface{Name: "wg1", Subnet: "10.11.0.0/16", Port: 51821}); err != nil {
+		t.Fatalf("Failed to add interface: %v", err)
+	}
+	if !manager.HasWireGuardInterface("wg1") {
+		t.Error("Expected wg1 to be available")
+	}
+
+	conflicting := []WireGuardInterface{
+		{Name: "wg1", Subnet: "10.12.0.0/16", Port: 51822},
+		{Name: "wg2", Subnet: "10.12.0.0/16", Port: 51821},
+		{Name: "wg2", Subnet: "10.11.4.0/24", Port: 51822},
+	}
+	for _, iface := range conflicting {
+		if err := manager.AddWireGuardInterface(iface); err == nil {
+			t.Errorf("Expected error adding %+v, got nil", iface)
+		}
+	}
+
+	if _, err := manager.CreateTunnelWithOptions("test-1", "test.example.com", 8080, "pubkey", nil, WireGuardOptions{Interface: "wg9"}); err == nil {
+		t.Error("Expected error creating tunnel on unknown interface, got nil")
+	}
+}
+
+// fakeTransport connects tunnels without touching the host
+type fakeTransport struct {
+	setupErr error
+	torndown []string
+}
+
+func (f *fakeTransport) Name() string { return "fake" }
+
+func (f *fakeTransport) Setup(tunnel *TunnelInfo) error {
+	return f.setupErr
+}
+
+func (f *fakeTransport) Teardown(tunnel *TunnelInfo) error {
+	f.torndown = append(f.torndown, tunnel.ID)
+	return nil
+}
+
+func (f *fakeTransport) Endpoint(tunnel *TunnelInfo) string {
+	return "fake-" + tunnel.ID
+}
+
+func (f *fakeTransport) Stats() (map[string]PeerStats, error) {
+	return map[string]PeerStats{"t1": {ReceivedBytes: 42}}, nil
+}
+
+func TestCreateTunnelOnTransport(t *testing.T) {
+	manager := NewManager(10)
+	transport := &fakeTransport{}
+	if err := manager.AddTransport(transport); err != nil {
+		t.Fatalf("Unexpected error adding transport: %v", err)
+	}
+	if err := manager.AddTransport(&fakeTransport{}); err == nil {
+		t.Error("Expected error adding a transport twice, got nil")
+	}
+	if !manager.HasTransport("fake") || !manager.HasTransport(TransportWireGuard) {
+		t.Error("Expected fake and wireguard transports to be registered")
+	}
+
+	tunnel, err := manager.CreateTunnelOnTransport("fake", "t1", "t1.example.com", 8080, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tunnel.Transport != "fake" || tunnel.Endpoint != "fake-t1" {
+		t.Errorf("Expected tunnel on fake transport at fake-t1, got %q at %q", tunnel.Transport, tunnel.Endpoint)
+	}
+
+	// Retrying the same create returns the tunnel; another transport conflicts
+	if again, err := manager.CreateTunnelOnTransport("fake", "t1", "t1.example.com", 8080, nil); err != nil || !reflect.DeepEqual(again, tunnel) {
+		t.Errorf("Expected identical create to return the existing tunnel, got %v, %v", again, err)
+	}
+	if _, err := manager.CreateTunnel("t1", "t1.example.com", 8080, "", nil); err == nil {
+		t.Error("Expected error creating the tunnel without its transport, got nil")
+	}
+
+	stats, err := manager.peerStats()
+	if err != nil {
+		t.Fatalf("Unexpected error reading stats: %v", err)
+	}
+	if stats["t1"].ReceivedBytes != 42 {
+		t.Errorf("Expected transport stats for t1, got %+v", stats["t1"])
+	}
+
+	if err := manager.RemoveTunnel("t1"); err != nil {
+		t.Fatalf("Unexpected error removing tunnel: %v", err)
+	}
+	if len(transport.torndown) != 1 || transport.torndown[0] != "t1" {
+		t.Errorf("Expected t1 to be torn down, got %v", transport.torndown)
+	}
+
+	transport.setupErr = errors.New("unreachable")
+	if _, err := manager.CreateTunnelOnTransport("fake", "t2", "t2.example.com", 8080, nil); err == nil {
+		t.Error("Expected setup error, got nil")
+	}
+	if _, err := manager.GetTunnel("t2"); err == nil {
+		t.Error("Expected tunnel with failed setup not to be added")
+	}
+	if _, err := manager.CreateTunnelOnTransport("missing", "t3", "t3.example.com", 8080, nil); err == nil {
+		t.Error("Expected error creating a tunnel on an unknown transport, got nil")
+	}
+}
+
+func TestHostnames(t *testing.T) {
+	manager := NewManager(10)
+	router := &fakeRouter{routes: make(map[string]string)}
+	manager.SetRouter(router)
+	events, cancel := manager.Subscribe(10)
+	defer cancel()
+
+	if _, err := manager.CreateTunnel("t1", "example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	<-events
+	manager.endpointChanged("t1", true)
+
+	steps := []struct {
+		name      string
+		change    func() error
+		wantErr   bool
+		hostnames []string
+		route     string
+	}{
+		{
+			name:      "Add hostname",
+			change:    func() error { return manager.AddHostname("t1", "www.example.com") },
+			hostnames: []string{"example.com", "www.example.com"},
+			route:     "example.com->,www.example.com->",
+		},
+		{
+			name:      "Add existing hostname",
+			change:    func() error { return manager.AddHostname("t1", "www.example.com") },
+			hostnames: []string{"example.com", "www.example.com"},
+			route:     "example.com->,www.example.com->",
+		},
+		{
+			name:      "Remove primary hostname",
+			change:    func() error { return manager.RemoveHostname("t1", "example.com") },
+			hostnames: []string{"www.example.com"},
+			route:     "www.example.com->",
+		},
+		{
+			name:      "Remove last hostname",
+			change:    func() error { return manager.RemoveHostname("t1", "www.example.com") },
+			wantErr:   true,
+			hostnames: []string{"www.example.com"},
+			route:     "www.example.com->",
+		},
+		{
+			name:      "Remove unknown hostname",
+			change:    func() error { return manager.RemoveHostname("t1", "other.example.com") },
+			wantErr:   true,
+			hostnames: []string{"www.example.com"},
+			route:     "www.example.com->",
+		},
+		{
+			name:      "Set hostnames",
+			change:    func() error { return manager.SetHostnames("t1", []string{"shop.example", "example.com", "shop.example"}) },
+			hostnames: []string{"shop.example", "example.com"},
+			route:     "shop.example->,example.com->",
+		},
+		{
+			name:      "Unknown tunnel",
+			change:    func() error { return manager.AddHostname("missing", "example.com") },
+			wantErr:   true,
+			hostnames: []string{"shop.example", "example.com"},
+			route:     "shop.example->,example.com->",
+		},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := step.change(); (err != nil) != step.wantErr {
+				t.Fatalf("Expected error %v, got %v", step.wantErr, err)
+			}
+			tunnel, _ := manager.GetTunnel("t1")
+			if !equalStrings(tunnel.Hostnames, step.hostnames) || tunnel.Hostname != step.hostnames[0] {
+				t.Errorf("Expected hostnames %v, got %v (primary %s)", step.hostnames, tunnel.Hostnames, tunnel.Hostname)
+			}
+			if route := router.route("t1"); route != step.route {
+				t.Errorf("Expected routes %q, got %q", step.route, route)
+			}
+		})
+	}
+
+	// Only changes are published
+	var changes int
+	for len(events) > 0 {
+		if event := <-events; event.Type == EventHostnamesChanged {
+			changes++
+		}
+	}
+	if changes != 3 {
+		t.Errorf("Expected 3 hostname change events, got %d", changes)
+	}
+}
+
+func TestGeneratedHostnames(t *testing.T) {
+	manager := NewManager(10)
+	router := &fakeRouter{routes: make(map[string]string), hosts: make(map[string]bool)}
+	manager.SetRouter(router)
+
+	if _, err := manager.GenerateHostname("t1"); err == nil {
+		t.Fatal("Expected an error generating a hostname without a base domain")
+	}
+
+	// Tunnels without hostnames, such as TCP routes, are not given one
+	portOnly, err := manager.CreateTunnel("tcp-1", "", 8080, "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if portOnly.Hostname != "" || portOnly.PublicEndpoint != "" {
+		t.Errorf("Expected no hostname, got %q and %q", portOnly.Hostname, portOnly.PublicEndpoint)
+	}
+
+	manager.SetBaseDomain("*.Tunnels.Example.com.")
+	if domain := manager.BaseDomain(); domain != "tunnels.example.com" {
+		t.Errorf("Expected base domain tunnels.example.com, got %s", domain)
+	}
+
+	hostname, err := manager.GenerateHostname("t1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	label := strings.TrimSuffix(hostname, ".tunnels.example.com")
+	if len(label) != subdomainLength || label == hostname || strings.Trim(label, subdomainAlphabet) != "" {
+		t.Errorf("Expected a random subdomain of tunnels.example.com, got %s", hostname)
+	}
+	first, err := manager.CreateTunnel("t1", hostname, 8080, "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first.PublicEndpoint != hostname {
+		t.Errorf("Expected public endpoint %s, got %s", hostname, first.PublicEndpoint)
+	}
+
+	// Retrying the create returns the tunnel with its generated hostname
+	if again, err := manager.GenerateHostname("t1"); err != nil || again != hostname {
+		t.Errorf("Expected hostname %s on retry, got %q, %v", hostname, again, err)
+	}
+	if again, err := manager.CreateTunnel("t1", hostname, 8080, "", nil); err != nil || !reflect.DeepEqual(again, first) {
+		t.Errorf("Expected the existing tunnel on retry, got %v, %v", again, err)
+	}
+
+	second, err := manager.GenerateHostname("t2")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if second == hostname {
+		t.Errorf("Expected unique hostnames, got %s twice", hostname)
+	}
+
+	// A hostname reserved for another tunnel ID is an ordinary hostname
+	explicit, err := manager.CreateTunnel("t3", second, 8080, "", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if explicit.PublicEndpoint != "" {
+		t.Errorf("Expected no public endpoint for an explicit hostname, got %q", explicit.PublicEndpoint)
+	}
+}
+
+func TestGeneratedHostnameAvoidsRoutes(t *testing.T) {
+	manager := NewManager(10)
+	router := &fakeRouter{routes: make(map[string]string), hosts: map[string]bool{"gateway.example.com": true}}
+	manager.SetRouter(router)
+
+	// Hostnames routed without a tunnel of the manager, e.g. by Gateway
+	// API routes, are taken
+	if !manager.hostnameInUse("gateway.example.com") {
+		t.Error("Expected a routed hostname to be in use")
+	}
+	if manager.hostnameInUse("free.example.com") {
+		t.Error("Expected an unrouted hostname to be free")
+	}
+}
+
+func TestHostnameReservations(t *testing.T) {
+	manager := NewManager(10)
+
+	if _, err := manager.ReserveHostname("app.example.com", "alice"); err != nil {
+		t.Fatalf("Failed to reserve hostname: %v", err)
+	}
+	if _, err := manager.ReserveHostname("app.example.com", "alice"); err != nil {
+		t.Errorf("Expected reserving again to succeed, got %v", err)
+	}
+	if _, err := manager.ReserveHostname("app.example.com", "mallory"); !errors.Is(err, ErrHostnameReserved) {
+		t.Errorf("Expected ErrHostnameReserved, got %v", err)
+	}
+
+	if err := manager.CheckHostnameOwner("app.example.com", "alice"); err != nil {
+		t.Errorf("Expected owner to pass, got %v", err)
+	}
+	for _, owner := range []string{"mallory", ""} {
+		if err := manager.CheckHostnameOwner("app.example.com", owner); !errors.Is(err, ErrHostnameReserved) {
+			t.Errorf("Expected ErrHostnameReserved for %q, got %v", owner, err)
+		}
+	}
+	if err := manager.CheckHostnameOwner("other.example.com", "mallory"); err != nil {
+		t.Errorf("Expected unreserved hostname to pass, got %v", err)
+	}
+
+	manager.SetBaseDomain("example.com")
+	manager.mu.Lock()
+	inUse := manager.hostnameInUse("app.example.com")
+	manager.mu.Unlock()
+	if !inUse {
+		t.Error("Expected reserved hostname not to be generated")
+	}
+
+	if reservations := manager.HostnameReservations(); len(reservations) != 1 || reservations[0].Owner != "alice" {
+		t.Errorf("Expected alice's reservation, got %+v", reservations)
+	}
+	if err := manager.ReleaseHostname("app.example.com"); err != nil {
+		t.Fatalf("Failed to release hostname: %v", err)
+	}
+	if err := manager.ReleaseHostname("app.example.com"); err == nil {
+		t.Error("Expected releasing an unreserved hostname to fail")
+	}
+	if _, err := manager.ReserveHostname("app.example.com", "mallory"); err != nil {
+		t.Errorf("Expected released hostname to be reservable, got %v", err)
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	manager := NewManager(10)
+	manager.SetTenantLimits(TenantLimits{Tunnels: 2, Hostnames: 3, Ports: 1}, map[string]TenantLimits{
+		"big": {},
+	})
+
+	if _, err := manager.CreateTunnelForTenant("acme", "one", "one.example.com", 8080, "", nil, WireGuardOptions{}); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	var limitErr *TenantLimitError
+	_, err := manager.CreateTunnelForTenant("acme", "two", "two.example.com", 9090, "", nil, WireGuardOptions{})
+	if !errors.As(err, &limitErr) || limitErr.Resource != "ports" {
+		t.Errorf("Expected ports limit error, got %v", err)
+	}
+	if _, err := manager.CreateTunnelForTenant("acme", "two", "two.example.com", 8080, "", nil, WireGuardOptions{}); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	_, err = manager.CreateTunnelForTenant("acme", "three", "three.example.com", 8080, "", nil, WireGuardOptions{})
+	if !errors.As(err, &limitErr) || limitErr.Resource != "tunnels" {
+		t.Errorf("Expected tunnels limit error, got %v", err)
+	}
+
+	if err := manager.AddHostname("one", "www.example.com"); err != nil {
+		t.Fatalf("Failed to add hostname: %v", err)
+	}
+	err = manager.AddHostname("two", "api.example.com")
+	if !errors.As(err, &limitErr) || limitErr.Resource != "hostnames" {
+		t.Errorf("Expected hostnames limit error, got %v", err)
+	}
+
+	// Other tenants, tenants with their own limits and tunnels without a
+	// tenant are not affected
+	if _, err := manager.CreateTunnelForTenant("other", "three", "three.example.com", 9090, "", nil, WireGuardOptions{}); err != nil {
+		t.Errorf("Expected other tenant to create a tunnel, got %v", err)
+	}
+	for i, id := range []string{"big-1", "big-2", "big-3"} {
+		if _, err := manager.CreateTunnelForTenant("big", id, id+".example.com", 8000+i, "", nil, WireGuardOptions{}); err != nil {
+			t.Errorf("Expected unlimited tenant to create tunnel %s, got %v", id, err)
+		}
+	}
+	if _, err := manager.CreateTunnelWithOptions("plain", "plain.example.com", 7070, "", nil, WireGuardOptions{}); err != nil {
+		t.Errorf("Expected tunnel without a tenant to be created, got %v", err)
+	}
+
+	usage := manager.TenantUsage("acme")
+	if usage.Tunnels != 2 || usage.Hostnames != 3 || usage.Ports != 1 || usage.Limits.Tunnels != 2 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+	if tenants := manager.Tenants(); len(tenants) != 3 || tenants[0] != "acme" {
+		t.Errorf("Expected tenants acme, big and other, got %v", tenants)
+	}
+}
+
+func TestTenantBandwidth(t *testing.T) {
+	manager := NewManager(10)
+	manager.SetTenantLimits(TenantLimits{BytesPerSecond: 1000}, nil)
+	if _, err := manager.CreateTunnelForTenant("acme", "app", "app.example.com", 8080, "", nil, WireGuardOptions{}); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+
+	manager.measureBandwidth(time.Second)
+	manager.Stats().Tunnel("app").AddBytesSent(5000)
+	manager.measureBandwidth(time.Second)
+	if !manager.OverBandwidth("app") {
+		t.Error("Expected tunnel to be over its tenant's bandwidth limit")
+	}
+	if usage := manager.TenantUsage("acme"); usage.BytesPerSecond != 5000 || !usage.OverBandwidth {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+
+	manager.Stats().Tunnel("app").AddBytesReceived(500)
+	manager.measureBandwidth(time.Second)
+	if manager.OverBandwidth("app") {
+		t.Error("Expected tunnel to be back under its tenant's bandwidth limit")
+	}
+}
+
+func TestLoadTenantLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	data := `{"default":{"max_tunnels":5},"tenants":{"acme":{"max_hostnames":2,"max_bytes_per_second":1000}}}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write tenants file: %v", err)
+	}
+	defaults, tenants, err := LoadTenantLimits(path)
+	if err != nil {
+		t.Fatalf("Failed to load tenant limits: %v", err)
+	}
+	if defaults.Tunnels != 5 {
+		t.Errorf("Expected default limit of 5 tunnels, got %+v", defaults)
+	}
+	if acme := tenants["acme"]; acme.Hostnames != 2 || acme.BytesPerSecond != 1000 || acme.Tunnels != 0 {
+		t.Errorf("Unexpected limits of acme %+v", acme)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"default":{"max_ports":-1}}`), 0600); err != nil {
+		t.Fatalf("Failed to write tenants file: %v", err)
+	}
+	if _, _, err := LoadTenantLimits(path); err == nil {
+		t.Error("Expected negative limits to be rejected")
+	}
+}
+
+func TestSetProtocol(t *testing.T) {
+	manager := NewManager(10)
+	router := &fakeRouter{routes: make(map[string]string)}
+	manager.SetRouter(router)
+
+	// Tunnels reached directly are not routed by the manager until they
+	// choose a protocol
+	if _, err := manager.CreateTunnel("t1", "app.example.com", 5432, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route := router.route("t1"); route != "" {
+		t.Fatalf("Expected no route without a protocol, got %q", route)
+	}
+
+	tests := []struct {
+		protocol   string
+		listenPort int
+		expected   string
+	}{
+		{protocol: ProtocolTCP, listenPort: 9000, expected: "tcp:9000->"},
+		{protocol: ProtocolTLS, expected: "tls:app.example.com->"},
+		{protocol: ProtocolUDP, listenPort: 53, expected: "udp:53->"},
+		{protocol: ProtocolHTTP, expected: "app.example.com->"},
+		{protocol: "", expected: ""},
+	}
+	for _, tt := range tests {
+		if err := manager.SetProtocol("t1", tt.protocol, tt.listenPort); err != nil {
+			t.Fatalf("Unexpected error setting protocol %q: %v", tt.protocol, err)
+		}
+		if route := router.route("t1"); route != tt.expected {
+			t.Errorf("Expected route %q for protocol %q, got %q", tt.expected, tt.protocol, route)
+		}
+	}
+
+	for _, invalid := range []struct {
+		protocol   string
+		listenPort int
+	}{
+		{protocol: ProtocolTCP},
+		{protocol: ProtocolUDP, listenPort: 70000},
+		{protocol: ProtocolTLS, listenPort: 443},
+		{protocol: "sctp", listenPort: 9000},
+	} {
+		if err := manager.SetProtocol("t1", invalid.protocol, invalid.listenPort); err == nil {
+			t.Errorf("Expected error for protocol %q with listen port %d", invalid.protocol, invalid.listenPort)
+		}
+	}
+	if err := ValidateProtocol(ProtocolUDP, 53, TransportWebSocket); err == nil {
+		t.Error("Expected UDP to require a transport reaching the target directly")
+	}
+
+	// Removing the tunnel removes its routes
+	if err := manager.SetProtocol("t1", ProtocolTCP, 9000); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := manager.RemoveTunnel("t1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route := router.route("t1"); route != "" {
+		t.Errorf("Expected the removed tunnel's route to be gone, got %q", route)
+	}
+}
+
+func TestSetPaused(t *testing.T) {
+	manager := NewManager(10)
+	router := &fakeRouter{routes: make(map[string]string)}
+	manager.SetRouter(router)
+	if _, err := manager.CreateTunnel("t1", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := manager.SetProtocol("t1", ProtocolHTTP, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	events, cancel := manager.Subscribe(10)
+	defer cancel()
+
+	if err := manager.SetPaused("t1", true); err != nil {
+		t.Fatalf("Unexpected error pausing: %v", err)
+	}
+	if route := router.route("t1"); route != "" || !manager.Paused("t1") {
+		t.Errorf("Expected the paused tunnel's route to be withdrawn, got %q", route)
+	}
+
+	// Changes while paused do not route the tunnel
+	if err := manager.AddHostname("t1", "www.example.com"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route := router.route("t1"); route != "" {
+		t.Errorf("Expected no route while paused, got %q", route)
+	}
+
+	if err := manager.SetPaused("t1", false); err != nil {
+		t.Fatalf("Unexpected error resuming: %v", err)
+	}
+	if route := router.route("t1"); route != "app.example.com->,www.example.com->" {
+		t.Errorf("Expected the resumed tunnel to be routed again, got %q", route)
+	}
+
+	var types []EventType
+	for len(events) > 0 {
+		types = append(types, (<-events).Type)
+	}
+	expected := []EventType{EventTunnelPaused, EventHostnamesChanged, EventTunnelResumed}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("Expected events %v, got %v", expected, types)
+	}
+	if err := manager.SetPaused("missing", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown tunnel, got %v", err)
+	}
+}
+
+func TestSetAccessLists(t *testing.T) {
+	manager := NewManager(10)
+	if _, err := manager.CreateTunnel("t1", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	access := AccessLists{
+		AllowedIPs:       []string{"10.0.0.0/8", "2001:db8::1"},
+		DeniedIPs:        []string{"10.1.2.3"},
+		AllowedCountries: []string{"DE"},
+	}
+	if err := manager.SetAccessLists("t1", access); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := manager.AccessLists("t1"); !reflect.DeepEqual(got, access) {
+		t.Errorf("Expected %+v, got %+v", access, got)
+	}
+
+	for _, invalid := range []AccessLists{
+		{AllowedIPs: []string{"10.0.0.0/33"}},
+		{DeniedIPs: []string{"10.0.0.256"}},
+		{DeniedCountries: []string{"Germany"}},
+	} {
+		if err := manager.SetAccessLists("t1", invalid); err == nil {
+			t.Errorf("Expected error for access lists %+v", invalid)
+		}
+	}
+	if got := manager.AccessLists("t1"); !reflect.DeepEqual(got, access) {
+		t.Errorf("Expected invalid lists to be rejected, got %+v", got)
+	}
+}
+
+func TestSetOptionsFunc(t *testing.T) {
+	manager := NewManager(10)
+	if _, err := manager.CreateTunnel("t1", "app.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	options := make(map[string]*TrafficOptions)
+	manager.SetOptionsFunc(func(tunnelID string, o *TrafficOptions) {
+		if o == nil {
+			delete(options, tunnelID)
+			return
+		}
+		options[tunnelID] = o
+	})
+	if options["t1"] == nil {
+		t.Fatal("Expected the options of existing tunnels when the function is set")
+	}
+
+	if err := manager.SetMaintenance("t1", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	maintenance := options["t1"]
+	if !maintenance.Maintenance {
+		t.Error("Expected a snapshot with maintenance mode on")
+	}
+	if err := manager.SetPaused("t1", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !options["t1"].Paused || !options["t1"].Maintenance {
+		t.Errorf("Expected a snapshot of all options, got %+v", options["t1"])
+	}
+	if maintenance.Paused {
+		t.Error("Expected earlier snapshots not to change")
+	}
+
+	if _, err := manager.CreateTunnel("t2", "other.example.com", 8080, "", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if options["t2"] == nil {
+		t.Error("Expected the options of a created tunnel")
+	}
+	if err := manager.RemoveTunnel("t1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := options["t1"]; ok {
+		t.Error("Expected the options of a removed tunnel to be dropped")
+	}
+}
+
+func TestLabelSelectors(t *testing.T) {
+	manager := NewManager(10)
+	labels := map[string]string{
+		"web":    "env=staging,team=web",
+		"api":    "env=staging,team=core",
+		"prod":   "env=production,team=web",
+		"legacy": "",
+	}
+	for id, pairs := range labels {
+		if _, err := manager.CreateTunnel(id, id+".example.com", 8080, "", nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		set := make(map[string]string)
+		for _, pair := range strings.Split(pairs, ",") {
+			if key, value, found := strings.Cut(pair, "="); found {
+				set[key] = value
+			}
+		}
+		if err := manager.SetLabels(id, set); err != nil {
+			t.Fatalf("Unexpected error setting labels: %v", err)
+		}
+	}
+
+	tests := []struct {
+		selector string
+		expected []string
+	}{
+		{"", []string{"api", "legacy", "prod", "web"}},
+		{"env=staging", []string{"api", "web"}},
+		{"env==staging,team!=core", []string{"web"}},
+		{"team!=core", []string{"legacy", "prod", "web"}},
+		{"env in (staging, production),team notin (core)", []string{"prod", "web"}},
+		{"team", []string{"api", "prod", "web"}},
+		{"!team", []string{"legacy"}},
+		{"env=qa", nil},
+	}
+	for _, tt := range tests {
+		selector, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", tt.selector, err)
+		}
+		var ids []string
+		for _, tunnel := range manager.SelectTunnels(selector) {
+			ids = append(ids, tunnel.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.expected) {
+			t.Errorf("Selector %q: expected %v, got %v", tt.selector, tt.expected, ids)
+		}
+	}
+
+	// Relabelled and removed tunnels leave the index
+	if err := manager.SetLabels("web", map[string]string{"env": "production"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := manager.RemoveTunnel("api"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	selector, _ := ParseSelector("env=staging")
+	if selected := manager.SelectTunnels(selector); len(selected) != 0 {
+		t.Errorf("Expected no staging tunnels left, got %d", len(selected))
+	}
+
+	for _, invalid := range []string{"=staging", "env=a b", "team in staging", "a,,b", "-bad=1"} {
+		if _, err := ParseSelector(invalid); err == nil {
+			t.Errorf("Expected selector %q to be invalid", invalid)
+		}
+	}
+	if err := manager.SetLabels("web", map[string]string{"bad key": "x"}); err == nil {
+		t.Error("Expected an invalid label key to be rejected")
+	}
+	if err := manager.SetLabels("missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown tunnel, got %v", err)
+	}
+}
+
+// countingRouter is a fakeRouter that counts the routes of each tunnel
+type countingRouter struct {
+	*fakeRouter
+}
+
+func (r countingRouter) RouteCounts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int)
+	for id, routes := range r.routes {
+		counts[id] = len(strings.Split(routes, ","))
+	}
+	return counts
+}
+
+// reconcilingTransport is a fakeTransport reporting fixed drift
+type reconcilingTransport struct {
+	fakeTransport
+	reconciled []string
+}
+
+func (f *reconcilingTransport) Reconcile(tunnels []*TunnelInfo) ([]string, []string, error) {
+	for _, tunnel := range tunnels {
+		f.reconciled = append(f.reconciled, tunnel.ID)
+	}
+	return []string{"t1"}, []string{"orphan-key"}, nil
+}
+
+func TestReconcile(t *testing.T) {
+	manager := NewManager(10)
+	transport := &reconcilingTransport{}
+	if err := manager.AddTransport(transport); err != nil {
+		t.Fatalf("Unexpected error adding transport: %v", err)
+	}
+	router := countingRouter{&fakeRouter{routes: make(map[string]string)}}
+	manager.SetRouter(router)
+	for _, id := range []string{"t1", "t2", "t3"} {
+		if _, err := manager.CreateTunnelOnTransport("fake", id, id+".example.com", 8080, nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := manager.SetProtocol(id, ProtocolHTTP, 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := manager.AddHostname("t1", "www.example.com"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// t1 loses a route, t3's removal does not reach the router and another
+	// controller routes a tunnel the manager does not know
+	router.RemoveRoute("t1")
+	router.AddBackend("t1", "t1.example.com", "fake-t1", 8080)
+	if err := manager.RemoveTunnel("t3"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	router.AddBackend("t3", "t3.example.com", "fake-t3", 8080)
+	router.AddBackend("gateway/default/web", "web.example.com", "10.0.0.5", 80)
+
+	manager.reconcile(time.Now())
+
+	if route := router.route("t1"); route != "t1.example.com->fake-t1,www.example.com->fake-t1" {
+		t.Errorf("Expected t1 to be routed again, got %q", route)
+	}
+	if route := router.route("t3"); route != "" {
+		t.Errorf("Expected the leftover route of t3 to be removed, got %q", route)
+	}
+	if route := router.route("gateway/default/web"); route == "" {
+		t.Error("Expected routes the manager did not add to be kept")
+	}
+	sort.Strings(transport.reconciled)
+	if !reflect.DeepEqual(transport.reconciled, []string{"t1", "t2"}) {
+		t.Errorf("Expected the transport to reconcile t1 and t2, got %v", transport.reconciled)
+	}
+
+	drift := manager.Drift()
+	expected := DriftStats{Runs: 1, LastRun: drift.LastRun, MissingPeers: 1, OrphanedPeers: 1, MissingRoutes: 1, OrphanedRoutes: 1}
+	if drift != expected {
+		t.Errorf("Expected drift %+v, got %+v", expected, drift)
+	}
+
+	// Without drift, nothing changes
+	manager.reconcile(time.Now())
+	if drift := manager.Drift(); drift.Runs != 2 || drift.MissingRoutes != 1 || drift.OrphanedRoutes != 1 {
+		t.Errorf("Expected no new route drift, got %+v", drift)
+	}
+}
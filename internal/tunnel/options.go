@@ -0,0 +1,81 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+// TrafficOptions are the settings of a tunnel that the load balancer
+// applies to its traffic. The manager takes a new snapshot whenever one of
+// them changes; snapshots share their maps, slices and pointers with the
+// tunnel and must not be modified.
+type TrafficOptions struct {
+	ProxyTimeouts  ProxyTimeouts
+	BackendTLS     *BackendTLS
+	ErrorPages     map[string]string
+	Maintenance    bool
+	Paused         bool
+	HeaderRules    *HeaderRules
+	HostRewrite    HostRewrite
+	Compression    Compression
+	Cache          Cache
+	Access         AccessLists
+	ClientLimits   ClientLimits
+	RequestPolicy  RequestPolicy
+	Mirror         *Mirror
+	EdgeAuth       *EdgeAuth
+	ClientCertAuth *ClientCertAuth
+	RequestFilters []FilterRule
+
+	// OverBandwidth is set while the tenant owning the tunnel exceeds its
+	// bandwidth limit
+	OverBandwidth bool
+}
+
+// OptionsFunc receives the traffic options of a tunnel, nil once the
+// tunnel is removed
+type OptionsFunc func(tunnelID string, options *TrafficOptions)
+
+// SetOptionsFunc makes the manager call fn with the traffic options of
+// every tunnel, and again whenever they change. Calls are made in order
+// with the manager's lock held, so fn must not call the manager.
+func (m *Manager) SetOptionsFunc(fn OptionsFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onOptions = fn
+	for _, tunnel := range m.tunnels {
+		m.optionsChanged(tunnel)
+	}
+}
+
+// optionsChanged passes a new snapshot of the traffic options of a tunnel
+// on. Must be called with m.mu held.
+func (m *Manager) optionsChanged(tunnel *TunnelInfo) {
+	if m.onOptions == nil {
+		return
+	}
+	m.onOptions(tunnel.ID, &TrafficOptions{
+		ProxyTimeouts:  tunnel.ProxyTimeouts,
+		BackendTLS:     tunnel.BackendTLS,
+		ErrorPages:     tunnel.ErrorPages,
+		Maintenance:    tunnel.Maintenance,
+		Paused:         tunnel.Paused,
+		HeaderRules:    tunnel.HeaderRules,
+		HostRewrite:    tunnel.HostRewrite,
+		Compression:    tunnel.Compression,
+		Cache:          tunnel.Cache,
+		Access:         tunnel.Access,
+		ClientLimits:   tunnel.ClientLimits,
+		RequestPolicy:  tunnel.RequestPolicy,
+		Mirror:         tunnel.Mirror,
+		EdgeAuth:       tunnel.EdgeAuth,
+		ClientCertAuth: tunnel.ClientCertAuth,
+		RequestFilters: tunnel.RequestFilters,
+		OverBandwidth:  tunnel.Tenant != "" && m.overBandwidth[tunnel.Tenant],
+	})
+}
+
+// optionsRemoved tells that a tunnel is gone. Must be called with m.mu
+// held.
+func (m *Manager) optionsRemoved(id string) {
+	if m.onOptions != nil {
+		m.onOptions(id, nil)
+	}
+}
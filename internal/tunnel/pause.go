@@ -0,0 +1,54 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+// SetPaused pauses or resumes a tunnel. Pausing withdraws the routes the
+// manager added for the tunnel while keeping its registration and
+// transport, such as its WireGuard peer, so that resuming routes it again
+// without its client setting up the tunnel anew.
+func (m *Manager) SetPaused(id string, paused bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	if tunnel.Paused == paused {
+		return nil
+	}
+
+	tunnel.Paused = paused
+	if tunnel.routed && m.router != nil {
+		m.router.RemoveRoute(id)
+		if err := m.routeHostnames(tunnel); err != nil {
+			// Keep the tunnel paused rather than partly routed
+			m.router.RemoveRoute(id)
+			tunnel.Paused = true
+			m.optionsChanged(tunnel)
+			return err
+		}
+	}
+	m.optionsChanged(tunnel)
+
+	if paused {
+		m.logger.Info().
+			Str("tunnel_id", id).
+			Msg("Paused tunnel")
+		m.publish(EventTunnelPaused, tunnel, "")
+	} else {
+		m.logger.Info().
+			Str("tunnel_id", id).
+			Msg("Resumed tunnel")
+		m.publish(EventTunnelResumed, tunnel, "")
+	}
+	return nil
+}
+
+// Paused reports whether a tunnel is paused
+func (m *Manager) Paused(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tunnel, exists := m.tunnels[id]
+	return exists && tunnel.Paused
+}
@@ -0,0 +1,311 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// pathProbeWindow is how many of a tunnel's latest probes its path
+	// statistics cover
+	pathProbeWindow = 20
+
+	// maxConcurrentProbes bounds the probes in flight at once
+	maxConcurrentProbes = 32
+
+	// protocolICMP is the IP protocol number of ICMP
+	protocolICMP = 1
+)
+
+// PathStats describe the quality of a tunnel's network path, as measured by
+// echo requests to its peer over the tunnel. Unlike the backend's errors,
+// lost probes point at the tunnel itself.
+type PathStats struct {
+	// Sent and Lost count the latest probes, at most 20
+	Sent int
+	Lost int
+
+	// RTT is the average round-trip time of the answered probes among
+	// them, and LastRTT that of the latest answered probe
+	RTT     time.Duration
+	LastRTT time.Duration
+
+	// LastProbe is when the path was last probed, zero if never
+	LastProbe time.Time
+}
+
+// LossRatio returns the share of the latest probes that were lost
+func (s PathStats) LossRatio() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Lost) / float64(s.Sent)
+}
+
+// unreachable reports whether enough of the latest probes were sent, and
+// all of them lost, to consider the path down
+func (s PathStats) unreachable() bool {
+	return s.Sent >= 3 && s.Lost == s.Sent
+}
+
+// pathWindow holds the round-trip times of a tunnel's latest probes, with
+// negative times for lost probes
+type pathWindow struct {
+	rtts [pathProbeWindow]time.Duration
+	n    int
+	next int
+}
+
+// add records a probe and returns the statistics of the window
+func (w *pathWindow) add(rtt time.Duration) PathStats {
+	w.rtts[w.next] = rtt
+	w.next = (w.next + 1) % pathProbeWindow
+	if w.n < pathProbeWindow {
+		w.n++
+	}
+
+	stats := PathStats{Sent: w.n}
+	var total time.Duration
+	for i := 0; i < w.n; i++ {
+		if w.rtts[i] < 0 {
+			stats.Lost++
+			continue
+		}
+		total += w.rtts[i]
+	}
+	if answered := stats.Sent - stats.Lost; answered > 0 {
+		stats.RTT = total / time.Duration(answered)
+	}
+	return stats
+}
+
+// Pinger sends an echo request to a peer address and waits for the reply
+// until ctx is done, returning the round-trip time
+type Pinger interface {
+	Ping(ctx context.Context, addr netip.Addr) (time.Duration, error)
+}
+
+// icmpPinger pings with ICMP echo requests, over an unprivileged ICMP
+// datagram socket where the kernel allows it and a raw socket otherwise
+type icmpPinger struct {
+	id  int
+	seq atomic.Uint32
+}
+
+// NewICMPPinger returns a Pinger sending ICMP echo requests to IPv4
+// addresses. Raw sockets need the CAP_NET_RAW capability unless the
+// net.ipv4.ping_group_range sysctl lets the agent's group use datagram
+// sockets.
+func NewICMPPinger() Pinger {
+	return &icmpPinger{id: os.Getpid() & 0xffff}
+}
+
+// listen opens an ICMP socket, reporting whether it is a raw one
+func (p *icmpPinger) listen() (*icmp.PacketConn, bool, error) {
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err == nil {
+		return conn, false, nil
+	}
+	conn, rawErr := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if rawErr != nil {
+		return nil, false, fmt.Errorf("failed to open ICMP socket: %v", errors.Join(err, rawErr))
+	}
+	return conn, true, nil
+}
+
+// Ping implements Pinger
+func (p *icmpPinger) Ping(ctx context.Context, addr netip.Addr) (time.Duration, error) {
+	if !addr.Is4() {
+		return 0, fmt.Errorf("cannot ping %s: only IPv4 addresses are supported", addr)
+	}
+	conn, raw, err := p.listen()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	seq := int(p.seq.Add(1) & 0xffff)
+	request, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: seq, Data: []byte("easy-tunnel path probe")},
+	}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: addr.AsSlice()}
+	if raw {
+		dst = &net.IPAddr{IP: addr.AsSlice()}
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(request, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+		rtt := time.Since(start)
+
+		reply, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		// Datagram sockets get the replies to their own requests only,
+		// with an ID chosen by the kernel
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (raw && echo.ID != p.id) {
+			continue
+		}
+		if source, ok := addrOf(from); !ok || source != addr {
+			continue
+		}
+		return rtt, nil
+	}
+}
+
+// addrOf returns the IP address of a socket address
+func addrOf(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	parsed, ok := netip.AddrFromSlice(ip)
+	return parsed.Unmap(), ok
+}
+
+// StartPathProber pings the WireGuard peer of each tunnel over the tunnel
+// every interval, waiting up to timeout for each reply, and records the
+// round-trip times and losses as the tunnels' path statistics. A zero
+// interval disables probing. The prober runs until ctx is cancelled.
+func (m *Manager) StartPathProber(ctx context.Context, pinger Pinger, interval, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.probePaths(ctx, pinger, timeout)
+			}
+		}
+	}()
+}
+
+// probePaths probes the paths of all WireGuard tunnels once
+func (m *Manager) probePaths(ctx context.Context, pinger Pinger, timeout time.Duration) {
+	m.mu.RLock()
+	peers := make(map[string]netip.Addr)
+	for id, tunnel := range m.tunnels {
+		if tunnel.WireGuardConfig == nil {
+			continue
+		}
+		if addr, err := netip.ParseAddr(tunnel.WireGuardConfig.ClientIP); err == nil {
+			peers[id] = addr
+		}
+	}
+	m.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentProbes)
+	for id, addr := range peers {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			rtt, err := pinger.Ping(probeCtx, addr)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				m.logger.Debug().Err(err).Str("tunnel_id", id).Str("peer_ip", addr.String()).Msg("Path probe lost")
+			}
+			m.recordPathProbe(id, rtt, err, time.Now())
+		}()
+	}
+	wg.Wait()
+}
+
+// recordPathProbe adds the result of a probe to a tunnel's path statistics,
+// logging when its path goes down or comes back
+func (m *Manager) recordPathProbe(id string, rtt time.Duration, probeErr error, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return
+	}
+	wasUnreachable := tunnel.Path.unreachable()
+	if probeErr != nil {
+		rtt = -1
+	}
+	stats := tunnel.pathProbes.add(rtt)
+	stats.LastProbe = now
+	stats.LastRTT = tunnel.Path.LastRTT
+	if probeErr == nil {
+		stats.LastRTT = rtt
+	}
+	tunnel.Path = stats
+
+	switch {
+	case stats.unreachable() && !wasUnreachable:
+		m.logger.Warn().
+			Str("tunnel_id", id).
+			Int("lost", stats.Lost).
+			Msg("Tunnel network path unreachable")
+	case wasUnreachable && !stats.unreachable():
+		m.logger.Info().
+			Str("tunnel_id", id).
+			Dur("rtt", rtt).
+			Msg("Tunnel network path reachable again")
+	}
+}
+
+// PathStats returns the path statistics of a tunnel
+func (m *Manager) PathStats(id string) PathStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if tunnel, exists := m.tunnels[id]; exists {
+		return tunnel.Path
+	}
+	return PathStats{}
+}
@@ -0,0 +1,127 @@
+package tunnel
+
+import "fmt"
+
+// Protocols a tunnel's traffic is routed by. Tunnels without a protocol
+// have their hostnames routed like ProtocolHTTP.
+const (
+	// ProtocolHTTP terminates HTTP and HTTPS at the load balancer and
+	// routes requests by hostname
+	ProtocolHTTP = "http"
+	// ProtocolTCP forwards raw connections accepted on the tunnel's listen
+	// port
+	ProtocolTCP = "tcp"
+	// ProtocolTLS passes TLS connections through to the tunnel by their
+	// SNI, leaving TLS to the target
+	ProtocolTLS = "tls"
+	// ProtocolUDP forwards datagrams received on the tunnel's listen port.
+	// The load balancer sends them to the target's address, so tunnels
+	// must be reached directly or over WireGuard.
+	ProtocolUDP = "udp"
+)
+
+// ProtocolRouter is implemented by routers that route TCP, TLS passthrough
+// and UDP traffic besides HTTP requests
+type ProtocolRouter interface {
+	AddTCPRoute(tunnelID string, listenPort int, ip string, port int) error
+	AddTLSRoute(tunnelID string, hostname string, ip string, port int) error
+	AddUDPRoute(tunnelID string, listenPort int, ip string, port int) error
+}
+
+// ValidateProtocol checks that a tunnel on transport can be routed by
+// protocol. TCP and UDP need the public port to listen on, which the other
+// protocols route by hostname and cannot have.
+func ValidateProtocol(protocol string, listenPort int, transport string) error {
+	switch protocol {
+	case "", ProtocolHTTP, ProtocolTLS:
+		if listenPort != 0 {
+			return fmt.Errorf("listen port requires the %s or %s protocol", ProtocolTCP, ProtocolUDP)
+		}
+	case ProtocolTCP, ProtocolUDP:
+		if listenPort <= 0 || listenPort > 65535 {
+			return fmt.Errorf("the %s protocol requires a listen port between 1 and 65535", protocol)
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q (want %s, %s, %s or %s)", protocol, ProtocolHTTP, ProtocolTCP, ProtocolTLS, ProtocolUDP)
+	}
+	if protocol == ProtocolUDP && transport != "" && transport != TransportWireGuard {
+		return fmt.Errorf("the %s protocol cannot be used with the %s transport", ProtocolUDP, transport)
+	}
+	return nil
+}
+
+// SetProtocol sets the protocol a tunnel's traffic is routed by, with the
+// public port TCP and UDP tunnels listen on. A tunnel with a protocol is
+// routed by the manager: once its endpoint is reachable on transports
+// reporting it, otherwise right away. Tunnels on other transports without
+// a protocol are left to whoever routes them, as before.
+func (m *Manager) SetProtocol(id, protocol string, listenPort int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnel, exists := m.tunnels[id]
+	if !exists {
+		return tunnelNotFound(id)
+	}
+	if err := ValidateProtocol(protocol, listenPort, tunnel.Transport); err != nil {
+		return err
+	}
+	if tunnel.Protocol == protocol && tunnel.ListenPort == listenPort {
+		return nil
+	}
+	if _, ok := m.router.(ProtocolRouter); !ok && m.router != nil && protocol != "" && protocol != ProtocolHTTP {
+		return fmt.Errorf("the router cannot route the %s protocol", protocol)
+	}
+
+	previous, previousPort, wasRouted := tunnel.Protocol, tunnel.ListenPort, tunnel.routed
+	tunnel.Protocol, tunnel.ListenPort = protocol, listenPort
+	if m.router == nil {
+		return nil
+	}
+	if _, notifies := m.transports[tunnel.Transport].(EndpointNotifier); !notifies {
+		tunnel.routed = protocol != ""
+	}
+	if !tunnel.routed && !wasRouted {
+		return nil
+	}
+	m.router.RemoveRoute(id)
+	if !tunnel.routed {
+		return nil
+	}
+	if err := m.routeHostnames(tunnel); err != nil {
+		// Put back the routes the tunnel had
+		m.router.RemoveRoute(id)
+		tunnel.Protocol, tunnel.ListenPort, tunnel.routed = previous, previousPort, wasRouted
+		if wasRouted {
+			m.routeHostnames(tunnel)
+		}
+		return err
+	}
+	m.logger.Info().
+		Str("tunnel_id", id).
+		Str("protocol", protocol).
+		Int("listen_port", listenPort).
+		Msg("Routed tunnel by protocol")
+	return nil
+}
+
+// routeProtocol routes a tunnel by its TCP, TLS or UDP protocol. Must be
+// called with m.mu held.
+func (m *Manager) routeProtocol(tunnel *TunnelInfo) error {
+	router, ok := m.router.(ProtocolRouter)
+	if !ok {
+		return fmt.Errorf("the router cannot route the %s protocol", tunnel.Protocol)
+	}
+	switch tunnel.Protocol {
+	case ProtocolTCP:
+		return router.AddTCPRoute(tunnel.ID, tunnel.ListenPort, tunnel.Endpoint, tunnel.TargetPort)
+	case ProtocolUDP:
+		return router.AddUDPRoute(tunnel.ID, tunnel.ListenPort, tunnel.Endpoint, tunnel.TargetPort)
+	}
+	for _, hostname := range tunnel.Hostnames {
+		if err := router.AddTLSRoute(tunnel.ID, hostname, tunnel.Endpoint, tunnel.TargetPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
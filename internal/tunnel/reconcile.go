@@ -0,0 +1,182 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Reconciler is implemented by transports whose actual state can drift from
+// the tunnels, such as WireGuard peers removed or added by hand
+type Reconciler interface {
+	// Reconcile restores the transport of the given tunnels, its tunnels,
+	// where it was lost and removes what belongs to none of them. It
+	// returns the IDs of the tunnels it restored and the identifiers, such
+	// as public keys, of what it removed.
+	Reconcile(tunnels []*TunnelInfo) (missing, orphaned []string, err error)
+}
+
+// RouteCounter is implemented by routers that can count the routes of
+// each tunnel, letting the reconciler find routes lost or left behind
+type RouteCounter interface {
+	// RouteCounts returns the number of routes by tunnel ID
+	RouteCounts() map[string]int
+}
+
+// DriftStats counts the drift the reconciler found and repaired since the
+// agent started
+type DriftStats struct {
+	// Runs and Errors count the reconciliations and those that could not
+	// read or repair some state; LastRun is when the latest one ran
+	Runs    int64
+	Errors  int64
+	LastRun time.Time
+
+	// Peers re-added for tunnels and peers removed for belonging to none
+	MissingPeers  int64
+	OrphanedPeers int64
+	// Tunnels routed again after losing routes, and tunnels no longer
+	// routed whose routes were removed
+	MissingRoutes  int64
+	OrphanedRoutes int64
+}
+
+// Drift returns the drift the reconciler found so far
+func (m *Manager) Drift() DriftStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.drift
+}
+
+// StartReconciler compares the tunnels with the actual state of their
+// transports and routes every interval, repairing drift: peers of tunnels
+// missing from their WireGuard device are added back, peers on the device
+// that belong to no tunnel are removed, tunnels that lost routes are routed
+// again and routes the manager added for tunnels since removed or paused
+// are removed. Routes added by others, such as the Gateway API controller,
+// are left alone. A zero interval disables it. It runs until ctx is
+// cancelled.
+func (m *Manager) StartReconciler(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.reconcile(now)
+			}
+		}
+	}()
+}
+
+// reconcile repairs the drift between the tunnels and their transports and
+// routes. It holds m.mu throughout so that tunnels created meanwhile are
+// not taken for orphans.
+func (m *Manager) reconcile(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.drift.Runs++
+	m.drift.LastRun = now
+
+	for _, name := range m.transportNames() {
+		reconciler, ok := m.transports[name].(Reconciler)
+		if !ok {
+			continue
+		}
+		var tunnels []*TunnelInfo
+		for _, tunnel := range m.tunnels {
+			if tunnel.Transport == name {
+				tunnels = append(tunnels, tunnel)
+			}
+		}
+		missing, orphaned, err := reconciler.Reconcile(tunnels)
+		if err != nil {
+			m.drift.Errors++
+			m.logger.Warn().
+				Err(err).
+				Str("transport", name).
+				Msg("Failed to reconcile tunnel transport")
+		}
+		if len(missing) > 0 || len(orphaned) > 0 {
+			m.logger.Warn().
+				Str("transport", name).
+				Strs("restored_tunnels", missing).
+				Strs("removed", orphaned).
+				Msg("Repaired tunnel transport drift")
+		}
+		m.drift.MissingPeers += int64(len(missing))
+		m.drift.OrphanedPeers += int64(len(orphaned))
+	}
+
+	m.reconcileRoutes()
+}
+
+// reconcileRoutes routes tunnels that lost routes again and removes the
+// routes left for tunnels that should not have any. Must be called with
+// m.mu held.
+func (m *Manager) reconcileRoutes() {
+	counter, ok := m.router.(RouteCounter)
+	if !ok {
+		return
+	}
+	counts := counter.RouteCounts()
+
+	for id := range m.routedIDs {
+		tunnel, exists := m.tunnels[id]
+		if exists && tunnel.routed && !tunnel.Paused {
+			continue
+		}
+		if counts[id] > 0 {
+			m.router.RemoveRoute(id)
+			m.drift.OrphanedRoutes++
+			m.logger.Warn().
+				Str("tunnel_id", id).
+				Int("routes", counts[id]).
+				Msg("Removed routes of a tunnel that should not be routed")
+		}
+		delete(m.routedIDs, id)
+	}
+
+	for id, tunnel := range m.tunnels {
+		if !tunnel.routed || tunnel.Paused {
+			continue
+		}
+		expected := expectedRoutes(tunnel)
+		if counts[id] >= expected {
+			continue
+		}
+		m.router.RemoveRoute(id)
+		if err := m.routeHostnames(tunnel); err != nil {
+			m.drift.Errors++
+		}
+		m.drift.MissingRoutes++
+		m.logger.Warn().
+			Str("tunnel_id", id).
+			Int("routes", counts[id]).
+			Int("expected_routes", expected).
+			Msg("Routed tunnel that lost routes again")
+	}
+}
+
+// expectedRoutes returns the number of routes of a routed tunnel: one per
+// hostname, or its listen port for TCP and UDP
+func expectedRoutes(tunnel *TunnelInfo) int {
+	switch tunnel.Protocol {
+	case ProtocolTCP, ProtocolUDP:
+		return 1
+	}
+	hostnames := make(map[string]bool, len(tunnel.Hostnames))
+	for _, hostname := range tunnel.Hostnames {
+		hostnames[strings.ToLower(hostname)] = true
+	}
+	return len(hostnames)
+}
@@ -0,0 +1,102 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrHostnameReserved is returned when a hostname is reserved by another
+// owner
+var ErrHostnameReserved error = &kindError{kind: ErrConflict, message: "hostname is reserved by another owner"}
+
+// Reservation claims a hostname for an owner, such as an API token, so that
+// only the owner can create tunnels for it, even while none exists
+type Reservation struct {
+	Hostname string
+	Owner    string
+	Created  time.Time
+}
+
+// ReserveHostname reserves a hostname for owner. Reserving a hostname the
+// owner already holds returns the existing reservation; a hostname reserved
+// by another owner fails with ErrHostnameReserved.
+func (m *Manager) ReserveHostname(hostname, owner string) (Reservation, error) {
+	if hostname == "" {
+		return Reservation{}, fmt.Errorf("hostname is required")
+	}
+	if owner == "" {
+		return Reservation{}, fmt.Errorf("owner is required")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, exists := m.reservations[hostname]; exists {
+		if existing.Owner != owner {
+			return Reservation{}, ErrHostnameReserved
+		}
+		return existing, nil
+	}
+
+	reservation := Reservation{Hostname: hostname, Owner: owner, Created: time.Now()}
+	m.reservations[hostname] = reservation
+	m.logger.Info().
+		Str("hostname", hostname).
+		Str("owner", owner).
+		Msg("Reserved hostname")
+	return reservation, nil
+}
+
+// ReleaseHostname removes the reservation of a hostname. Tunnels already
+// using the hostname are kept.
+func (m *Manager) ReleaseHostname(hostname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.reservations[hostname]; !exists {
+		return notFoundf("hostname %s is not reserved", hostname)
+	}
+	delete(m.reservations, hostname)
+	m.logger.Info().
+		Str("hostname", hostname).
+		Msg("Released hostname")
+	return nil
+}
+
+// HostnameReservation returns the reservation of a hostname, if any
+func (m *Manager) HostnameReservation(hostname string) (Reservation, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	reservation, exists := m.reservations[hostname]
+	return reservation, exists
+}
+
+// HostnameReservations returns all reservations sorted by hostname
+func (m *Manager) HostnameReservations() []Reservation {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	reservations := make([]Reservation, 0, len(m.reservations))
+	for _, reservation := range m.reservations {
+		reservations = append(reservations, reservation)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Hostname < reservations[j].Hostname
+	})
+	return reservations
+}
+
+// CheckHostnameOwner fails with ErrHostnameReserved if the hostname is
+// reserved by anyone but owner. Callers without an identity pass an empty
+// owner and may only use hostnames nobody reserved.
+func (m *Manager) CheckHostnameOwner(hostname, owner string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if reservation, exists := m.reservations[hostname]; exists && reservation.Owner != owner {
+		return ErrHostnameReserved
+	}
+	return nil
+}
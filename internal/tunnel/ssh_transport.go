@@ -0,0 +1,347 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ssh"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// TransportSSH is the name of the SSH transport
+const TransportSSH = "ssh"
+
+// sshEndpointSuffix makes the endpoints of SSH tunnels unique names that
+// never resolve; connections to them are opened over the client's forward
+const sshEndpointSuffix = ".ssh.invalid"
+
+// SSHTransport carries tunnels over SSH remote port forwards, so that a
+// stock OpenSSH client can expose a local service with
+//
+//	ssh -N -p 2222 -R 0:localhost:8000 <tunnel ID>@agent.example.com
+//
+// The client logs in as the tunnel's ID with the tunnel's connect token as
+// password, or with the tunnel's public key. Once it asks for a forward, its
+// tunnel's endpoint is reported reachable and the agent opens a channel to
+// the forward for every connection to the tunnel's target.
+type SSHTransport struct {
+	mu      sync.RWMutex
+	logger  *zerolog.Logger
+	config  *ssh.ServerConfig
+	tunnels map[string]*sshTunnel
+	notify  func(tunnelID string, reachable bool)
+}
+
+// sshTunnel is the connection state of a tunnel's client
+type sshTunnel struct {
+	tunnelID   string
+	targetPort int
+	token      string
+	key        *ssh.PublicKey // nil if the client has to use the token
+	conn       *ssh.Conn      // nil while disconnected
+	forwards   []ssh.Forward
+	lastSeen   time.Time
+
+	received atomic.Int64
+	sent     atomic.Int64
+}
+
+// NewSSHTransport creates an SSH transport presenting hostKey to clients
+func NewSSHTransport(hostKey ed25519.PrivateKey) *SSHTransport {
+	t := &SSHTransport{
+		logger:  utils.GetModuleLogger(utils.ModuleTunnel),
+		tunnels: make(map[string]*sshTunnel),
+	}
+	t.config = &ssh.ServerConfig{
+		HostKey:           hostKey,
+		PasswordCallback:  t.checkPassword,
+		PublicKeyCallback: t.checkPublicKey,
+	}
+	return t
+}
+
+// Name returns the name of the transport
+func (t *SSHTransport) Name() string {
+	return TransportSSH
+}
+
+// Setup issues the connect token the tunnel's client logs in with and
+// authorizes the tunnel's public key, if any
+func (t *SSHTransport) Setup(tunnel *TunnelInfo) error {
+	var key *ssh.PublicKey
+	if tunnel.SSHPublicKey != "" {
+		var err error
+		if key, err = ssh.ParseAuthorizedKey(tunnel.SSHPublicKey); err != nil {
+			return fmt.Errorf("invalid SSH public key: %v", err)
+		}
+	}
+	token, err := connectToken(tunnel)
+	if err != nil {
+		return fmt.Errorf("failed to generate connect token: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tunnels[tunnel.ID] = &sshTunnel{
+		tunnelID:   tunnel.ID,
+		targetPort: tunnel.TargetPort,
+		token:      token,
+		key:        key,
+	}
+	tunnel.ConnectToken = token
+	return nil
+}
+
+// Teardown revokes the tunnel's credentials and disconnects its client
+func (t *SSHTransport) Teardown(tunnel *TunnelInfo) error {
+	t.mu.Lock()
+	client, exists := t.tunnels[tunnel.ID]
+	delete(t.tunnels, tunnel.ID)
+	t.mu.Unlock()
+
+	if exists && client.conn != nil {
+		client.conn.Close()
+	}
+	return nil
+}
+
+// Endpoint returns a name unique to the tunnel, as its traffic is not
+// routed but carried over the client's forward
+func (t *SSHTransport) Endpoint(tunnel *TunnelInfo) string {
+	return tunnel.ID + sshEndpointSuffix
+}
+
+// Stats returns the traffic of each tunnel's client; LatestHandshake is
+// the current time while the client is connected, as SSH has no periodic
+// handshakes, and the time it disconnected otherwise
+func (t *SSHTransport) Stats() (map[string]PeerStats, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now()
+	stats := make(map[string]PeerStats, len(t.tunnels))
+	for id, client := range t.tunnels {
+		lastSeen := client.lastSeen
+		if client.conn != nil {
+			lastSeen = now
+		}
+		stats[id] = PeerStats{
+			LatestHandshake: lastSeen,
+			ReceivedBytes:   client.received.Load(),
+			SentBytes:       client.sent.Load(),
+		}
+	}
+	return stats, nil
+}
+
+// NotifyEndpoint sets the function called when a tunnel's client starts or
+// stops forwarding
+func (t *SSHTransport) NotifyEndpoint(fn func(tunnelID string, reachable bool)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.notify = fn
+}
+
+func (t *SSHTransport) notifyEndpoint(tunnelID string, reachable bool) {
+	t.mu.RLock()
+	notify := t.notify
+	t.mu.RUnlock()
+	if notify != nil {
+		notify(tunnelID, reachable)
+	}
+}
+
+// Dial opens a channel to the client's forward with the port of address,
+// or to its first forward if none has that port
+func (t *SSHTransport) Dial(ctx context.Context, tunnel *TunnelInfo, address string) (net.Conn, error) {
+	port := 0
+	if _, p, err := net.SplitHostPort(address); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+
+	t.mu.RLock()
+	var conn *ssh.Conn
+	var forward ssh.Forward
+	if client, ok := t.tunnels[tunnel.ID]; ok && client.conn != nil && len(client.forwards) > 0 {
+		conn = client.conn
+		forward = client.forwards[0]
+		for _, f := range client.forwards {
+			if int(f.Port) == port {
+				forward = f
+				break
+			}
+		}
+	}
+	t.mu.RUnlock()
+
+	if conn == nil {
+		return nil, ErrClientNotConnected
+	}
+	return conn.OpenForwarded(ctx, forward, nil)
+}
+
+// Serve accepts the connections of SSH tunnel clients on ln until it is
+// closed
+func (t *SSHTransport) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go t.handleConn(conn)
+	}
+}
+
+// handleConn authenticates a client and serves its forward requests; a new
+// connection replaces the client's previous one
+func (t *SSHTransport) handleConn(raw net.Conn) {
+	var received, sent atomic.Int64
+	counted := &countingConn{Conn: raw, received: &received, sent: &sent}
+	conn, err := ssh.NewServerConn(counted, t.config)
+	if err != nil {
+		t.logger.Debug().
+			Err(err).
+			Str("remote_addr", raw.RemoteAddr().String()).
+			Msg("SSH handshake failed")
+		return
+	}
+
+	t.mu.Lock()
+	client := t.tunnels[conn.User()]
+	if client == nil {
+		// The tunnel was removed during the handshake
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	counted.received, counted.sent = &client.received, &client.sent
+	client.received.Add(received.Load())
+	client.sent.Add(sent.Load())
+	previous := client.conn
+	client.conn = conn
+	client.forwards = nil
+	t.mu.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	t.logger.Info().
+		Str("tunnel_id", client.tunnelID).
+		Str("remote_addr", raw.RemoteAddr().String()).
+		Msg("SSH tunnel client connected")
+
+	conn.Serve(func(name string, payload []byte) (bool, []byte) {
+		return t.handleRequest(client, conn, name, payload)
+	})
+
+	t.mu.Lock()
+	current := client.conn == conn
+	if current {
+		client.conn = nil
+		client.forwards = nil
+		client.lastSeen = time.Now()
+	}
+	t.mu.Unlock()
+
+	if current {
+		t.logger.Info().
+			Str("tunnel_id", client.tunnelID).
+			Msg("SSH tunnel client disconnected")
+		t.notifyEndpoint(client.tunnelID, false)
+	}
+}
+
+// handleRequest starts and cancels the client's remote forwards. Forwards
+// for port 0 are given the tunnel's target port.
+func (t *SSHTransport) handleRequest(client *sshTunnel, conn *ssh.Conn, name string, payload []byte) (bool, []byte) {
+	if name != ssh.RequestForward && name != ssh.RequestCancelForward {
+		return false, nil
+	}
+	forward, err := ssh.ParseForward(payload)
+	if err != nil {
+		return false, nil
+	}
+	var reply []byte
+	if name == ssh.RequestForward && forward.Port == 0 {
+		forward.Port = uint32(client.targetPort)
+		reply = ssh.ForwardReply(forward.Port)
+	}
+
+	t.mu.Lock()
+	if client.conn != conn {
+		t.mu.Unlock()
+		return false, nil
+	}
+	wasReachable := len(client.forwards) > 0
+	if name == ssh.RequestForward {
+		client.forwards = append(client.forwards, forward)
+	} else {
+		kept := client.forwards[:0]
+		for _, f := range client.forwards {
+			if f != forward {
+				kept = append(kept, f)
+			}
+		}
+		client.forwards = kept
+	}
+	reachable := len(client.forwards) > 0
+	t.mu.Unlock()
+
+	t.logger.Info().
+		Str("tunnel_id", client.tunnelID).
+		Str("request", name).
+		Str("address", forward.Address).
+		Uint32("port", forward.Port).
+		Msg("SSH tunnel client changed forwards")
+	if reachable != wasReachable {
+		t.notifyEndpoint(client.tunnelID, reachable)
+	}
+	return true, reply
+}
+
+// checkPassword accepts the tunnel's connect token as password, comparing
+// in constant time
+func (t *SSHTransport) checkPassword(user, password string) error {
+	t.mu.RLock()
+	client := t.tunnels[user]
+	t.mu.RUnlock()
+	if client == nil || subtle.ConstantTimeCompare([]byte(client.token), []byte(password)) != 1 {
+		t.logger.Warn().
+			Str("tunnel_id", user).
+			Msg("Rejected SSH tunnel client with invalid token")
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// checkPublicKey accepts the tunnel's public key
+func (t *SSHTransport) checkPublicKey(user string, key *ssh.PublicKey) error {
+	t.mu.RLock()
+	client := t.tunnels[user]
+	t.mu.RUnlock()
+	if client == nil || client.key == nil || !client.key.Equal(key) {
+		return errors.New("key not authorized")
+	}
+	return nil
+}
+
+// Connected reports whether the tunnel's client is connected
+func (t *SSHTransport) Connected(tunnelID string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	client, ok := t.tunnels[tunnelID]
+	return ok && client.conn != nil
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/ssh"
+)
+
+// fakeRouter records the routes the manager registers
+type fakeRouter struct {
+	mu     sync.Mutex
+	routes map[string]string
+	hosts  map[string]bool
+}
+
+func (r *fakeRouter) AddBackend(tunnelID, hostname, ip string, port int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	route := hostname + "->" + ip
+	if existing := r.routes[tunnelID]; existing != "" {
+		route = existing + "," + route
+	}
+	r.routes[tunnelID] = route
+	return nil
+}
+
+func (r *fakeRouter) AddTCPRoute(tunnelID string, listenPort int, ip string, port int) error {
+	return r.AddBackend(tunnelID, fmt.Sprintf("tcp:%d", listenPort), ip, port)
+}
+
+func (r *fakeRouter) AddTLSRoute(tunnelID string, hostname string, ip string, port int) error {
+	return r.AddBackend(tunnelID, "tls:"+hostname, ip, port)
+}
+
+func (r *fakeRouter) AddUDPRoute(tunnelID string, listenPort int, ip string, port int) error {
+	return r.AddBackend(tunnelID, fmt.Sprintf("udp:%d", listenPort), ip, port)
+}
+
+func (r *fakeRouter) RemoveRoute(tunnelID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, tunnelID)
+}
+
+func (r *fakeRouter) HasHost(hostname string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hosts[hostname]
+}
+
+func (r *fakeRouter) route(tunnelID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.routes[tunnelID]
+}
+
+func TestSSHTransport(t *testing.T) {
+	hostKey, err := ssh.GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := NewSSHTransport(hostKey)
+	manager := NewManager(10)
+	if err := manager.AddTransport(transport); err != nil {
+		t.Fatalf("Unexpected error adding transport: %v", err)
+	}
+	router := &fakeRouter{routes: make(map[string]string)}
+	manager.SetRouter(router)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go transport.Serve(ln)
+
+	tunnel, err := manager.CreateTunnelOnTransport(TransportSSH, "ssh-1", "ssh.example.com", 8080, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating tunnel: %v", err)
+	}
+	if tunnel.ConnectToken == "" || tunnel.Endpoint != "ssh-1.ssh.invalid" {
+		t.Fatalf("Expected connect token and endpoint, got %q and %q", tunnel.ConnectToken, tunnel.Endpoint)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := manager.DialTunnel(ctx, "ssh-1", tunnel.Endpoint+":8080"); err != ErrClientNotConnected {
+		t.Errorf("Expected ErrClientNotConnected before the client connects, got %v", err)
+	}
+
+	connect := func(password string) (*ssh.Conn, error) {
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ssh.NewClientConn(raw, &ssh.ClientConfig{
+			User:            "ssh-1",
+			Password:        password,
+			HostKeyCallback: func(*ssh.PublicKey) error { return nil },
+		})
+	}
+	if _, err := connect("wrong"); err == nil {
+		t.Error("Expected login with invalid token to be rejected")
+	}
+
+	// The client forwards port 0 like "ssh -R 0:localhost:8080" and
+	// answers every forwarded connection with a greeting
+	client, err := connect(tunnel.ConnectToken)
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+	go client.Serve(func(string, []byte) (bool, []byte) { return false, nil })
+	forward, err := client.RequestForward(ssh.Forward{Address: "localhost", Port: 0})
+	if err != nil {
+		t.Fatalf("Failed to request forward: %v", err)
+	}
+	if forward.Port != 8080 {
+		t.Errorf("Expected the target port to be allocated, got %d", forward.Port)
+	}
+	go func() {
+		for {
+			ch, _, err := client.AcceptForwarded()
+			if err != nil {
+				return
+			}
+			ch.Write([]byte("hello from target"))
+			ch.Close()
+		}
+	}()
+
+	// The forward makes the tunnel's endpoint routable
+	waitFor(t, func() bool { return router.route("ssh-1") == "ssh.example.com->ssh-1.ssh.invalid" })
+	backend, err := manager.DialTunnel(ctx, "ssh-1", tunnel.Endpoint+":8080")
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel: %v", err)
+	}
+	got, err := io.ReadAll(backend)
+	if err != nil || string(got) != "hello from target" {
+		t.Errorf("Expected greeting from target, got %q, %v", got, err)
+	}
+	backend.Close()
+
+	stats, err := manager.peerStats()
+	if err != nil {
+		t.Fatalf("Unexpected error reading stats: %v", err)
+	}
+	if peer := stats["ssh-1"]; peer.ReceivedBytes == 0 || peer.SentBytes == 0 || peer.LatestHandshake.IsZero() {
+		t.Errorf("Expected traffic and last seen time in stats, got %+v", peer)
+	}
+
+	// Disconnecting removes the route
+	client.Close()
+	waitFor(t, func() bool { return router.route("ssh-1") == "" })
+	if transport.Connected("ssh-1") {
+		t.Error("Expected client to be disconnected")
+	}
+
+	// Removing the tunnel revokes its token
+	if err := manager.RemoveTunnel("ssh-1"); err != nil {
+		t.Fatalf("Unexpected error removing tunnel: %v", err)
+	}
+	if _, err := connect(tunnel.ConnectToken); err == nil {
+		t.Error("Expected token of removed tunnel to be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// subdomainLength is the number of characters of generated subdomains
+const subdomainLength = 10
+
+// subdomainAlphabet are the characters of generated subdomains
+const subdomainAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// SetBaseDomain makes tunnels created without a hostname get a random
+// subdomain of domain, e.g. k3x9q2m1zv.tunnels.example.com. A leading "*."
+// is ignored; an empty domain requires a hostname for every tunnel.
+func (m *Manager) SetBaseDomain(domain string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.baseDomain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(domain, "*."), "."))
+}
+
+// BaseDomain returns the domain generated hostnames are subdomains of, or
+// "" if hostnames are not generated
+func (m *Manager) BaseDomain() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.baseDomain
+}
+
+// GenerateHostname returns the hostname of a tunnel created without one:
+// the subdomain generated for the tunnel if it already exists, otherwise a
+// new random subdomain of the base domain that no tunnel or route uses. The
+// new hostname is reserved for the tunnel ID until its next create, which
+// returns it as the tunnel's PublicEndpoint.
+func (m *Manager) GenerateHostname(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.baseDomain == "" {
+		return "", fmt.Errorf("hostname is required")
+	}
+	if existing, exists := m.tunnels[id]; exists && existing.generatedHostname {
+		return existing.Hostname, nil
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		label, err := randomLabel(subdomainLength)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate hostname: %v", err)
+		}
+		hostname := label + "." + m.baseDomain
+		if !m.hostnameInUse(hostname) {
+			m.reserved[id] = hostname
+			return hostname, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate an unused hostname under %s", m.baseDomain)
+}
+
+// hostnameInUse reports whether a tunnel, a generated or reserved hostname
+// or a route of the router has the hostname. Must be called with m.mu held.
+func (m *Manager) hostnameInUse(hostname string) bool {
+	for _, tunnel := range m.tunnels {
+		for _, existing := range tunnel.Hostnames {
+			if existing == hostname {
+				return true
+			}
+		}
+	}
+	for _, reserved := range m.reserved {
+		if reserved == hostname {
+			return true
+		}
+	}
+	if _, reserved := m.reservations[hostname]; reserved {
+		return true
+	}
+	if hosts, ok := m.router.(HostRouter); ok && hosts.HasHost(hostname) {
+		return true
+	}
+	return false
+}
+
+// randomLabel returns n random lowercase letters and digits, starting with a
+// letter
+func randomLabel(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		alphabet := subdomainAlphabet
+		if i == 0 {
+			alphabet = subdomainAlphabet[:26]
+		}
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b), nil
+}
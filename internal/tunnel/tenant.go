@@ -0,0 +1,292 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// TenantLimits bound the resources of a tenant's tunnels; zero values are
+// unlimited
+type TenantLimits struct {
+	// Tunnels is the most tunnels the tenant may have
+	Tunnels int
+
+	// Hostnames is the most hostnames routed to the tenant's tunnels
+	Hostnames int
+
+	// Ports is the most distinct target ports the tenant's tunnels expose
+	Ports int
+
+	// BytesPerSecond bounds the traffic of all the tenant's tunnels; while
+	// it is exceeded the load balancer refuses their new requests
+	BytesPerSecond int64
+}
+
+// TenantLimitError is returned when a change would take a tenant over one
+// of its limits
+type TenantLimitError struct {
+	Tenant   string
+	Resource string
+	Limit    int
+}
+
+func (e *TenantLimitError) Error() string {
+	return fmt.Sprintf("tenant %s is limited to %d %s", e.Tenant, e.Limit, e.Resource)
+}
+
+// Is makes tenant limit errors ErrLimitExceeded errors
+func (e *TenantLimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// TenantUsage is what a tenant's tunnels use
+type TenantUsage struct {
+	Tenant    string
+	Tunnels   int
+	Hostnames int
+	Ports     int
+
+	// Traffic of the tenant's current tunnels, and its rate measured by
+	// the bandwidth monitor
+	BytesSent      int64
+	BytesReceived  int64
+	BytesPerSecond int64
+
+	// OverBandwidth is set while the tenant exceeds its bandwidth limit
+	OverBandwidth bool
+
+	Limits TenantLimits
+}
+
+// tenantsFile is the format of the file LoadTenantLimits reads
+type tenantsFile struct {
+	Default tenantLimitsEntry            `json:"default"`
+	Tenants map[string]tenantLimitsEntry `json:"tenants"`
+}
+
+type tenantLimitsEntry struct {
+	MaxTunnels        int   `json:"max_tunnels"`
+	MaxHostnames      int   `json:"max_hostnames"`
+	MaxPorts          int   `json:"max_ports"`
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second"`
+}
+
+func (e tenantLimitsEntry) limits() (TenantLimits, error) {
+	if e.MaxTunnels < 0 || e.MaxHostnames < 0 || e.MaxPorts < 0 || e.MaxBytesPerSecond < 0 {
+		return TenantLimits{}, fmt.Errorf("limits must not be negative")
+	}
+	return TenantLimits{
+		Tunnels:        e.MaxTunnels,
+		Hostnames:      e.MaxHostnames,
+		Ports:          e.MaxPorts,
+		BytesPerSecond: e.MaxBytesPerSecond,
+	}, nil
+}
+
+// LoadTenantLimits reads the limits of tenants from a JSON file of the form
+// {"default": {...}, "tenants": {"name": {...}}}. The default limits apply
+// to tenants without an entry of their own.
+func LoadTenantLimits(path string) (TenantLimits, map[string]TenantLimits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TenantLimits{}, nil, fmt.Errorf("failed to read tenant limits: %v", err)
+	}
+	var file tenantsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return TenantLimits{}, nil, fmt.Errorf("failed to parse tenant limits: %v", err)
+	}
+
+	defaults, err := file.Default.limits()
+	if err != nil {
+		return TenantLimits{}, nil, fmt.Errorf("invalid default tenant limits: %v", err)
+	}
+	tenants := make(map[string]TenantLimits, len(file.Tenants))
+	for name, entry := range file.Tenants {
+		if name == "" {
+			return TenantLimits{}, nil, fmt.Errorf("tenant without a name")
+		}
+		if tenants[name], err = entry.limits(); err != nil {
+			return TenantLimits{}, nil, fmt.Errorf("invalid limits of tenant %s: %v", name, err)
+		}
+	}
+	return defaults, tenants, nil
+}
+
+// SetTenantLimits sets the limits of tenants without an entry in tenants
+// to defaults. Existing tunnels above lowered limits are kept.
+func (m *Manager) SetTenantLimits(defaults TenantLimits, tenants map[string]TenantLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaultTenantLimits = defaults
+	m.tenantLimits = tenants
+}
+
+// limitsOf returns the limits of a tenant. Must be called with m.mu held.
+func (m *Manager) limitsOf(tenant string) TenantLimits {
+	if limits, ok := m.tenantLimits[tenant]; ok {
+		return limits
+	}
+	return m.defaultTenantLimits
+}
+
+// checkTenantLimits fails if adding tunnel, or changing its hostnames to
+// hostnames if it exists, would take its tenant over a limit. Tunnels
+// without a tenant are not limited. Must be called with m.mu held.
+func (m *Manager) checkTenantLimits(tunnel *TunnelInfo, hostnames []string) error {
+	if tunnel.Tenant == "" {
+		return nil
+	}
+	limits := m.limitsOf(tunnel.Tenant)
+
+	tunnels, numHostnames := 0, len(hostnames)
+	ports := map[int]bool{tunnel.TargetPort: true}
+	for _, existing := range m.tunnels {
+		if existing.Tenant != tunnel.Tenant || existing.ID == tunnel.ID {
+			continue
+		}
+		tunnels++
+		numHostnames += len(existing.Hostnames)
+		ports[existing.TargetPort] = true
+	}
+
+	if _, exists := m.tunnels[tunnel.ID]; !exists {
+		if limits.Tunnels > 0 && tunnels+1 > limits.Tunnels {
+			return &TenantLimitError{Tenant: tunnel.Tenant, Resource: "tunnels", Limit: limits.Tunnels}
+		}
+		if limits.Ports > 0 && len(ports) > limits.Ports {
+			return &TenantLimitError{Tenant: tunnel.Tenant, Resource: "ports", Limit: limits.Ports}
+		}
+	}
+	if limits.Hostnames > 0 && numHostnames > limits.Hostnames {
+		return &TenantLimitError{Tenant: tunnel.Tenant, Resource: "hostnames", Limit: limits.Hostnames}
+	}
+	return nil
+}
+
+// Tenants returns the names of the tenants owning tunnels, sorted
+func (m *Manager) Tenants() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var tenants []string
+	for _, tunnel := range m.tunnels {
+		if tunnel.Tenant != "" && !seen[tunnel.Tenant] {
+			seen[tunnel.Tenant] = true
+			tenants = append(tenants, tunnel.Tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// TenantUsage returns what the tunnels of a tenant use
+func (m *Manager) TenantUsage(tenant string) TenantUsage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	usage := TenantUsage{
+		Tenant:         tenant,
+		Limits:         m.limitsOf(tenant),
+		BytesPerSecond: m.tenantRates[tenant],
+		OverBandwidth:  m.overBandwidth[tenant],
+	}
+	ports := make(map[int]bool)
+	for _, tunnel := range m.tunnels {
+		if tunnel.Tenant != tenant {
+			continue
+		}
+		usage.Tunnels++
+		usage.Hostnames += len(tunnel.Hostnames)
+		ports[tunnel.TargetPort] = true
+		snap := m.stats.Get(tunnel.ID)
+		usage.BytesSent += snap.BytesSent
+		usage.BytesReceived += snap.BytesReceived
+	}
+	usage.Ports = len(ports)
+	return usage
+}
+
+// OverBandwidth reports whether the tenant owning a tunnel exceeds its
+// bandwidth limit
+func (m *Manager) OverBandwidth(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tunnel, exists := m.tunnels[id]
+	return exists && tunnel.Tenant != "" && m.overBandwidth[tunnel.Tenant]
+}
+
+// bandwidthInterval is how often the bandwidth monitor measures traffic
+const bandwidthInterval = time.Second
+
+// StartBandwidthMonitor periodically measures the traffic rate of each
+// tenant, marking tenants over their bandwidth limit until their rate
+// drops below it again. It runs until ctx is cancelled.
+func (m *Manager) StartBandwidthMonitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(bandwidthInterval)
+		defer ticker.Stop()
+
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.measureBandwidth(now.Sub(last))
+				last = now
+			}
+		}
+	}()
+}
+
+// measureBandwidth updates the traffic rates of tenants from their traffic
+// since the last measurement, elapsed ago
+func (m *Manager) measureBandwidth(elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totals := make(map[string]int64)
+	for _, tunnel := range m.tunnels {
+		if tunnel.Tenant == "" {
+			continue
+		}
+		snap := m.stats.Get(tunnel.ID)
+		totals[tunnel.Tenant] += snap.BytesSent + snap.BytesReceived
+	}
+
+	rates := make(map[string]int64, len(totals))
+	over := make(map[string]bool)
+	for tenant, total := range totals {
+		// Removed tunnels take their bytes with them; such drops count as
+		// no traffic
+		if previous, ok := m.tenantBytes[tenant]; ok && total > previous && elapsed > 0 {
+			rates[tenant] = int64(float64(total-previous) / elapsed.Seconds())
+		}
+		limit := m.limitsOf(tenant).BytesPerSecond
+		over[tenant] = limit > 0 && rates[tenant] > limit
+		if over[tenant] != m.overBandwidth[tenant] {
+			m.logger.Warn().
+				Str("tenant", tenant).
+				Int64("bytes_per_second", rates[tenant]).
+				Int64("limit", limit).
+				Bool("over_bandwidth", over[tenant]).
+				Msg("Tenant bandwidth limit state changed")
+		}
+	}
+	previous := m.overBandwidth
+	m.tenantBytes = totals
+	m.tenantRates = rates
+	m.overBandwidth = over
+	for _, tunnel := range m.tunnels {
+		if tunnel.Tenant != "" && over[tunnel.Tenant] != previous[tunnel.Tenant] {
+			m.optionsChanged(tunnel)
+		}
+	}
+}
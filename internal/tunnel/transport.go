@@ -0,0 +1,78 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"context"
+	"net"
+)
+
+// Transport carries the traffic of tunnels between the agent and tunnel
+// clients. The manager creates tunnels on a transport by name and leaves
+// everything specific to the transport to it.
+type Transport interface {
+	// Name identifies the transport, e.g. "wireguard"
+	Name() string
+
+	// Setup connects the tunnel's client, recording the client's transport
+	// configuration in the tunnel
+	Setup(tunnel *TunnelInfo) error
+
+	// Teardown disconnects the tunnel's client and releases its resources
+	Teardown(tunnel *TunnelInfo) error
+
+	// Endpoint returns the address the agent forwards the tunnel's traffic
+	// to over the transport
+	Endpoint(tunnel *TunnelInfo) string
+
+	// Stats returns the connection statistics of the transport's tunnels
+	// by tunnel ID
+	Stats() (map[string]PeerStats, error)
+}
+
+// Dialer is implemented by transports that carry connections to a tunnel's
+// target themselves; their endpoints are not routable addresses
+type Dialer interface {
+	// Dial connects to address, the endpoint and target port of tunnel
+	Dial(ctx context.Context, tunnel *TunnelInfo, address string) (net.Conn, error)
+}
+
+// EndpointNotifier is implemented by transports whose tunnels only become
+// reachable once their client connects and asks for traffic, such as SSH
+// remote forwards
+type EndpointNotifier interface {
+	// NotifyEndpoint sets the function called when a tunnel's endpoint
+	// becomes reachable or unreachable
+	NotifyEndpoint(fn func(tunnelID string, reachable bool))
+}
+
+// Router is the load balancer's routing table, in which the manager routes
+// the hostnames of tunnels whose transport reports them reachable. Tunnels
+// sharing a hostname become its targets, e.g. the replicas of a service.
+type Router interface {
+	AddBackend(tunnelID string, hostname string, ip string, port int) error
+	RemoveRoute(tunnelID string)
+}
+
+// HostRouter is implemented by routers that can tell whether a hostname has
+// a route, including routes the manager did not add, such as Gateway API
+// routes and routes restored from a file
+type HostRouter interface {
+	HasHost(hostname string) bool
+}
+
+// TransportWireGuard is the name of the WireGuard transport, used by
+// tunnels created with a WireGuard public key
+const TransportWireGuard = "wireguard"
+
+// TransportOptions are the options of tunnels on transports other than
+// WireGuard
+type TransportOptions struct {
+	// SSHPublicKey lets the client of an SSH tunnel authenticate with the
+	// key, in the authorized_keys format
+	SSHPublicKey string
+
+	// ConnectToken, if set, is issued to the client instead of a new
+	// token, so that the client of a tunnel restored from an export keeps
+	// connecting with its token
+	ConnectToken string
+}
@@ -0,0 +1,309 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/hashicorp/yamux"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// TransportWebSocket is the name of the WebSocket transport
+const TransportWebSocket = "websocket"
+
+// webSocketEndpointSuffix makes the endpoints of WebSocket tunnels unique
+// names that never resolve; connections to them are opened over the
+// client's session instead
+const webSocketEndpointSuffix = ".websocket.invalid"
+
+// ErrClientNotConnected is returned when dialing a tunnel whose client has
+// no session with the agent
+var ErrClientNotConnected = errors.New("tunnel client not connected")
+
+// WebSocketTransport carries tunnels over WebSocket connections that the
+// clients dial out to the agent, for networks where WireGuard's UDP is
+// blocked. Each client authenticates with its tunnel's connect token and
+// serves a yamux session over the connection, in which the agent opens a
+// stream for every connection to the tunnel's target.
+type WebSocketTransport struct {
+	mu      sync.RWMutex
+	logger  *zerolog.Logger
+	clients map[string]*webSocketClient // tunnel ID -> client
+	tokens  map[string]string           // connect token -> tunnel ID
+	notify  func(tunnelID string, reachable bool)
+}
+
+// webSocketClient is the connection state of a tunnel's client
+type webSocketClient struct {
+	tunnelID string
+	token    string
+	session  *yamux.Session // nil while disconnected
+
+	received     atomic.Int64
+	sent         atomic.Int64
+	lastReceived atomic.Int64 // Unix nanoseconds
+}
+
+// NewWebSocketTransport creates a WebSocket transport
+func NewWebSocketTransport() *WebSocketTransport {
+	return &WebSocketTransport{
+		logger:  utils.GetModuleLogger(utils.ModuleTunnel),
+		clients: make(map[string]*webSocketClient),
+		tokens:  make(map[string]string),
+	}
+}
+
+// Name returns the name of the transport
+func (t *WebSocketTransport) Name() string {
+	return TransportWebSocket
+}
+
+// Setup issues the connect token the tunnel's client authenticates with
+func (t *WebSocketTransport) Setup(tunnel *TunnelInfo) error {
+	token, err := connectToken(tunnel)
+	if err != nil {
+		return fmt.Errorf("failed to generate connect token: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clients[tunnel.ID] = &webSocketClient{tunnelID: tunnel.ID, token: token}
+	t.tokens[token] = tunnel.ID
+	tunnel.ConnectToken = token
+	return nil
+}
+
+// connectToken returns the token a tunnel is restored with, or else a new
+// one
+func connectToken(tunnel *TunnelInfo) (string, error) {
+	if tunnel.ConnectToken != "" {
+		return tunnel.ConnectToken, nil
+	}
+	return newConnectToken()
+}
+
+func newConnectToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Teardown revokes the tunnel's token and disconnects its client
+func (t *WebSocketTransport) Teardown(tunnel *TunnelInfo) error {
+	t.mu.Lock()
+	client, exists := t.clients[tunnel.ID]
+	if exists {
+		delete(t.clients, tunnel.ID)
+		delete(t.tokens, client.token)
+	}
+	t.mu.Unlock()
+
+	if exists && client.session != nil {
+		client.session.Close()
+	}
+	return nil
+}
+
+// Endpoint returns a name unique to the tunnel, as its traffic is not
+// routed but carried over the client's session
+func (t *WebSocketTransport) Endpoint(tunnel *TunnelInfo) string {
+	return tunnel.ID + webSocketEndpointSuffix
+}
+
+// Stats returns the traffic of each tunnel's client; LatestHandshake is the
+// last time a frame was received from it
+func (t *WebSocketTransport) Stats() (map[string]PeerStats, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := make(map[string]PeerStats, len(t.clients))
+	for id, client := range t.clients {
+		var lastSeen time.Time
+		if nanos := client.lastReceived.Load(); nanos != 0 {
+			lastSeen = time.Unix(0, nanos)
+		}
+		stats[id] = PeerStats{
+			LatestHandshake: lastSeen,
+			ReceivedBytes:   client.received.Load(),
+			SentBytes:       client.sent.Load(),
+		}
+	}
+	return stats, nil
+}
+
+// NotifyEndpoint sets the function called when a tunnel's client connects
+// or disconnects
+func (t *WebSocketTransport) NotifyEndpoint(fn func(tunnelID string, reachable bool)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.notify = fn
+}
+
+func (t *WebSocketTransport) notifyEndpoint(tunnelID string, reachable bool) {
+	t.mu.RLock()
+	notify := t.notify
+	t.mu.RUnlock()
+	if notify != nil {
+		notify(tunnelID, reachable)
+	}
+}
+
+// Dial opens a stream to the tunnel's target over its client's session
+func (t *WebSocketTransport) Dial(ctx context.Context, tunnel *TunnelInfo, address string) (net.Conn, error) {
+	t.mu.RLock()
+	var session *yamux.Session
+	if client, ok := t.clients[tunnel.ID]; ok {
+		session = client.session
+	}
+	t.mu.RUnlock()
+
+	if session == nil {
+		return nil, ErrClientNotConnected
+	}
+	return session.Open()
+}
+
+// ServeHTTP accepts a tunnel client's WebSocket connection. The client
+// presents its tunnel's connect token as a bearer token; a new connection
+// replaces the client's previous one.
+func (t *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	t.mu.RLock()
+	client := t.clientForToken(token)
+	t.mu.RUnlock()
+	if client == nil {
+		t.logger.Warn().
+			Str("remote_addr", r.RemoteAddr).
+			Msg("Rejected WebSocket tunnel connection with invalid token")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Accept writes the error response itself
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	// The session outlives the request, whose context ends when
+	// ServeHTTP returns
+	config := yamux.DefaultConfig()
+	config.LogOutput = t.logger
+	session, err := yamux.Server(&countingConn{
+		Conn:         websocket.NetConn(context.Background(), conn, websocket.MessageBinary),
+		received:     &client.received,
+		sent:         &client.sent,
+		lastReceived: &client.lastReceived,
+	}, config)
+	if err != nil {
+		conn.CloseNow()
+		t.logger.Error().Err(err).Str("tunnel_id", client.tunnelID).Msg("Failed to start yamux session")
+		return
+	}
+
+	t.mu.Lock()
+	// The tunnel may have been removed during the handshake
+	if t.clients[client.tunnelID] != client {
+		t.mu.Unlock()
+		session.Close()
+		return
+	}
+	previous := client.session
+	client.session = session
+	t.mu.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	t.logger.Info().
+		Str("tunnel_id", client.tunnelID).
+		Str("remote_addr", r.RemoteAddr).
+		Msg("WebSocket tunnel client connected")
+	if previous == nil {
+		t.notifyEndpoint(client.tunnelID, true)
+	}
+
+	go t.watch(client, session)
+}
+
+// clientForToken returns the client with the connect token, comparing in
+// constant time. Must be called with t.mu held.
+func (t *WebSocketTransport) clientForToken(token string) *webSocketClient {
+	if token == "" {
+		return nil
+	}
+	for candidate, id := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return t.clients[id]
+		}
+	}
+	return nil
+}
+
+// watch marks the client disconnected once its session ends
+func (t *WebSocketTransport) watch(client *webSocketClient, session *yamux.Session) {
+	<-session.CloseChan()
+
+	t.mu.Lock()
+	current := client.session == session
+	if current {
+		client.session = nil
+	}
+	t.mu.Unlock()
+
+	if current {
+		t.logger.Info().
+			Str("tunnel_id", client.tunnelID).
+			Msg("WebSocket tunnel client disconnected")
+		t.notifyEndpoint(client.tunnelID, false)
+	}
+}
+
+// Connected reports whether the tunnel's client has a session
+func (t *WebSocketTransport) Connected(tunnelID string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	client, ok := t.clients[tunnelID]
+	return ok && client.session != nil
+}
+
+// countingConn counts the bytes of a client's connection and, if
+// lastReceived is set, records when it last received data
+type countingConn struct {
+	net.Conn
+	received     *atomic.Int64
+	sent         *atomic.Int64
+	lastReceived *atomic.Int64 // Unix nanoseconds
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.received.Add(int64(n))
+		if c.lastReceived != nil {
+			c.lastReceived.Store(time.Now().UnixNano())
+		}
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// dialWebSocket connects to the transport with a bearer token
+func dialWebSocket(ctx context.Context, url, token string) (*websocket.Conn, error) {
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Bearer " + token}},
+	})
+	return conn, err
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	transport := NewWebSocketTransport()
+	manager := NewManager(10)
+	if err := manager.AddTransport(transport); err != nil {
+		t.Fatalf("Unexpected error adding transport: %v", err)
+	}
+	router := &fakeRouter{routes: make(map[string]string)}
+	manager.SetRouter(router)
+	server := httptest.NewServer(transport)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tunnel, err := manager.CreateTunnelOnTransport(TransportWebSocket, "ws-1", "ws.example.com", 8080, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating tunnel: %v", err)
+	}
+	if tunnel.ConnectToken == "" || tunnel.Endpoint != "ws-1.websocket.invalid" {
+		t.Fatalf("Expected connect token and endpoint, got %q and %q", tunnel.ConnectToken, tunnel.Endpoint)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := manager.DialTunnel(ctx, "ws-1", tunnel.Endpoint+":8080"); err != ErrClientNotConnected {
+		t.Errorf("Expected ErrClientNotConnected before the client connects, got %v", err)
+	}
+	if route := router.route("ws-1"); route != "" {
+		t.Errorf("Expected no route before the client connects, got %q", route)
+	}
+	if _, err := dialWebSocket(ctx, url, "wrong"); err == nil {
+		t.Error("Expected connection with invalid token to be rejected")
+	}
+
+	// The client serves the streams the agent opens, answering each with
+	// a greeting
+	conn, err := dialWebSocket(ctx, url, tunnel.ConnectToken)
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	client, err := yamux.Client(websocket.NetConn(context.Background(), conn, websocket.MessageBinary), nil)
+	if err != nil {
+		t.Fatalf("Failed to start client session: %v", err)
+	}
+	defer client.Close()
+	go func() {
+		for {
+			stream, err := client.Accept()
+			if err != nil {
+				return
+			}
+			stream.Write([]byte("hello from target"))
+			stream.Close()
+		}
+	}()
+
+	waitFor(t, func() bool { return transport.Connected("ws-1") })
+	waitFor(t, func() bool { return router.route("ws-1") == "ws.example.com->ws-1.websocket.invalid" })
+	backend, err := manager.DialTunnel(ctx, "ws-1", tunnel.Endpoint+":8080")
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel: %v", err)
+	}
+	got, err := io.ReadAll(backend)
+	if err != nil || string(got) != "hello from target" {
+		t.Errorf("Expected greeting from target, got %q, %v", got, err)
+	}
+	backend.Close()
+
+	stats, err := manager.peerStats()
+	if err != nil {
+		t.Fatalf("Unexpected error reading stats: %v", err)
+	}
+	if peer := stats["ws-1"]; peer.ReceivedBytes == 0 || peer.SentBytes == 0 || peer.LatestHandshake.IsZero() {
+		t.Errorf("Expected traffic and last seen time in stats, got %+v", peer)
+	}
+
+	// Removing the tunnel disconnects the client and revokes its token
+	if err := manager.RemoveTunnel("ws-1"); err != nil {
+		t.Fatalf("Unexpected error removing tunnel: %v", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(time.Second):
+		t.Error("Expected client session to be closed")
+	}
+	if route := router.route("ws-1"); route != "" {
+		t.Errorf("Expected route to be removed with the tunnel, got %q", route)
+	}
+	if _, err := dialWebSocket(ctx, url, tunnel.ConnectToken); err == nil {
+		t.Error("Expected token of removed tunnel to be rejected")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -2,11 +2,16 @@
 package tunnel
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
 	"github.com/rs/zerolog"
@@ -16,36 +21,215 @@ import (
 type WireGuardManager struct {
 	mu           sync.RWMutex
 	logger       *zerolog.Logger
-	interfaceName string
+	name         string // configured interface name
+	interfaceName string // actual name, which differs for macOS utun devices
 	basePort     int
 	ipNet        *net.IPNet
+	serverIP     net.IP // the interface's own address
 	nextIP       net.IP
+
+	// Optional IPv6 prefix peers get an address from in addition to IPv4
+	ipNet6    *net.IPNet
+	serverIP6 net.IP
+	nextIP6   net.IP
+	peers        map[string]string // tunnel ID -> peer public key
+	addresses    map[string][]string // tunnel ID -> peer allowed IPs
+
+	// Optional firewall opening the interface to each peer's addresses
+	firewall PeerFirewall
+
+	// Embedded wireguard-go running the interface, if started by the agent
+	userspace *userspaceDevice
+
+	// Defaults for peers created without explicit options
+	defaultKeepalive int
+	defaultMTU       int
 }
 
-// NewWireGuardManager creates a new WireGuard manager
+// WireGuard limits for peer options
+const (
+	MaxPersistentKeepalive = 65535
+	MinMTU                 = 1280
+	MaxMTU                 = 65535
+)
+
+// WireGuardOptions tune the WireGuard peer of a tunnel; zero values use the
+// manager's defaults
+type WireGuardOptions struct {
+	// PersistentKeepalive is the interval in seconds at which keepalives are
+	// sent to keep NAT mappings between the agent and the client open
+	PersistentKeepalive int
+
+	// MTU is the MTU of the tunnel client's WireGuard interface
+	MTU int
+
+	// KeyRotationInterval, if set, rotates the tunnel's server keys
+	// automatically once they are this old
+	KeyRotationInterval time.Duration
+
+	// Interface is the WireGuard interface the peer is added to, isolating
+	// tunnel groups from each other; empty uses the default interface
+	Interface string
+
+	// PrivateKey, if set, is the peer's server key instead of a new one, so
+	// that the client of a tunnel restored from an export keeps connecting
+	// with its configuration. It is only used to set the peer up.
+	PrivateKey string
+}
+
+// MinKeyRotationInterval is the shortest automatic key rotation interval
+const MinKeyRotationInterval = time.Minute
+
+// Validate checks the options are within WireGuard's limits
+func (o WireGuardOptions) Validate() error {
+	if o.PersistentKeepalive < 0 || o.PersistentKeepalive > MaxPersistentKeepalive {
+		return fmt.Errorf("persistent keepalive must be between 0 and %d seconds", MaxPersistentKeepalive)
+	}
+	if o.MTU != 0 && (o.MTU < MinMTU || o.MTU > MaxMTU) {
+		return fmt.Errorf("MTU must be between %d and %d", MinMTU, MaxMTU)
+	}
+	if o.KeyRotationInterval != 0 && o.KeyRotationInterval < MinKeyRotationInterval {
+		return fmt.Errorf("key rotation interval must be at least %v", MinKeyRotationInterval)
+	}
+	if o.PrivateKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(o.PrivateKey)); err != nil || len(key) != 32 {
+			return errors.New("invalid WireGuard private key")
+		}
+	}
+	return nil
+}
+
+// Default WireGuard interface settings
+const (
+	DefaultWireGuardInterface = "wg0"
+	DefaultWireGuardSubnet    = "10.10.0.0/16"
+	DefaultWireGuardPort      = 51820
+)
+
+// NewWireGuardManager creates a new WireGuard manager for the default interface
 func NewWireGuardManager() *WireGuardManager {
-	logger := utils.GetLogger()
-	_, ipNet, _ := net.ParseCIDR("10.10.0.0/16")
-	nextIP := net.ParseIP("10.10.0.1")
-
-	return &WireGuardManager{
-		logger:       logger,
-		interfaceName: "wg0",
-		basePort:     51820,
+	w, _ := NewWireGuardInterface(WireGuardInterface{
+		Name:   DefaultWireGuardInterface,
+		Subnet: DefaultWireGuardSubnet,
+		Port:   DefaultWireGuardPort,
+	})
+	return w
+}
+
+// NewWireGuardInterface creates a WireGuard manager for an interface. The
+// interface takes the first address of its subnet and hands out the
+// following ones to peers.
+func NewWireGuardInterface(iface WireGuardInterface) (*WireGuardManager, error) {
+	ipNet, err := iface.subnet()
+	if err != nil {
+		return nil, err
+	}
+	serverIP := nextIP(ipNet.IP)
+
+	w := &WireGuardManager{
+		logger:       utils.GetModuleLogger(utils.ModuleWireGuard),
+		name:         iface.Name,
+		interfaceName: iface.Name,
+		basePort:     iface.Port,
 		ipNet:        ipNet,
-		nextIP:       nextIP,
+		serverIP:     serverIP,
+		nextIP:       serverIP,
+		peers:        make(map[string]string),
+		addresses:    make(map[string][]string),
 	}
+	if iface.Subnet6 != "" {
+		if err := w.setIPv6Prefix(iface); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
 }
 
-// SetupPeer creates a new WireGuard peer
-func (w *WireGuardManager) SetupPeer(id string, publicKey string) (*WireGuardConfig, error) {
+// SetIPv6Prefix gives peers an IPv6 address from prefix in addition to their
+// IPv4 address. It must be set before peers are added.
+func (w *WireGuardManager) SetIPv6Prefix(prefix string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Generate private/public key pair for the server
-	privKey, err := w.generatePrivateKey()
+	if len(w.peers) > 0 {
+		return fmt.Errorf("cannot change the IPv6 prefix of WireGuard interface %s with peers", w.name)
+	}
+	iface := w.describe()
+	iface.Subnet6 = prefix
+	return w.setIPv6Prefix(iface)
+}
+
+func (w *WireGuardManager) setIPv6Prefix(iface WireGuardInterface) error {
+	ipNet6, err := iface.subnet6()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate private key: %v", err)
+		return err
+	}
+	w.ipNet6 = ipNet6
+	w.serverIP6 = nextIP(ipNet6.IP)
+	w.nextIP6 = w.serverIP6
+	return nil
+}
+
+// describe returns the configured name, subnet and port of the interface
+func (w *WireGuardManager) describe() WireGuardInterface {
+	iface := WireGuardInterface{Name: w.name, Subnet: w.ipNet.String(), Port: w.basePort}
+	if w.ipNet6 != nil {
+		iface.Subnet6 = w.ipNet6.String()
+	}
+	return iface
+}
+
+// PeerFirewall installs host firewall rules for the addresses of WireGuard
+// peers
+type PeerFirewall interface {
+	AddPeer(iface string, addresses []string) error
+	RemovePeer(iface string, addresses []string) error
+}
+
+// SetFirewall sets the firewall that peers added from now on are opened in
+func (w *WireGuardManager) SetFirewall(firewall PeerFirewall) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.firewall = firewall
+}
+
+// SetDefaults sets the keepalive interval and MTU used for peers created
+// without explicit options. A non-zero MTU is also applied to the interface.
+func (w *WireGuardManager) SetDefaults(keepalive, mtu int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.defaultKeepalive = keepalive
+	w.defaultMTU = mtu
+	if mtu == 0 {
+		return nil
+	}
+	cmd := exec.Command("ip", "link", "set", "dev", w.interfaceName, "mtu", strconv.Itoa(mtu))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set MTU of %s: %v: %s", w.interfaceName, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// SetupPeer creates a new WireGuard peer
+func (w *WireGuardManager) SetupPeer(id string, publicKey string, opts WireGuardOptions) (*WireGuardConfig, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if opts.PersistentKeepalive == 0 {
+		opts.PersistentKeepalive = w.defaultKeepalive
+	}
+	if opts.MTU == 0 {
+		opts.MTU = w.defaultMTU
+	}
+
+	// Generate private/public key pair for the server, unless restoring one
+	privKey := opts.PrivateKey
+	if privKey == "" {
+		var err error
+		if privKey, err = w.generatePrivateKey(); err != nil {
+			return nil, fmt.Errorf("failed to generate private key: %v", err)
+		}
 	}
 
 	pubKey, err := w.generatePublicKey(privKey)
@@ -58,37 +242,124 @@ func (w *WireGuardManager) SetupPeer(id string, publicKey string) (*WireGuardCon
 	if peerIP == nil {
 		return nil, fmt.Errorf("failed to allocate IP for peer")
 	}
+	var peerIP6 net.IP
+	if w.ipNet6 != nil {
+		if peerIP6 = w.allocateIPv6(); peerIP6 == nil {
+			return nil, fmt.Errorf("failed to allocate IPv6 address for peer")
+		}
+	}
 
 	config := &WireGuardConfig{
 		PublicKey:  pubKey,
 		PrivateKey: privKey,
-		ServerIP:   w.nextIP.String(),
+		ServerIP:   w.serverIP.String(),
 		ClientIP:   peerIP.String(),
 		Port:       w.basePort,
+
+		PersistentKeepalive: opts.PersistentKeepalive,
+		MTU:                 opts.MTU,
+		Interface:           w.name,
+	}
+	if peerIP6 != nil {
+		config.ServerIPv6 = w.serverIP6.String()
+		config.ClientIPv6 = peerIP6.String()
 	}
 
 	// Add the peer to WireGuard interface
-	if err := w.addPeer(publicKey, peerIP); err != nil {
+	allowedIPs := peerAllowedIPs(config)
+	if err := w.addPeer(publicKey, allowedIPs, opts.PersistentKeepalive); err != nil {
 		return nil, fmt.Errorf("failed to add WireGuard peer: %v", err)
 	}
+	if w.firewall != nil {
+		if err := w.firewall.AddPeer(w.interfaceName, allowedIPs); err != nil {
+			exec.Command("wg", "set", w.interfaceName, "peer", publicKey, "remove").Run()
+			return nil, fmt.Errorf("failed to add firewall rules for WireGuard peer: %v", err)
+		}
+	}
+	w.peers[id] = publicKey
+	w.addresses[id] = allowedIPs
 
 	w.logger.Info().
 		Str("peer_id", id).
 		Str("peer_ip", peerIP.String()).
+		Str("peer_ipv6", config.ClientIPv6).
+		Str("interface", w.name).
 		Msg("Added WireGuard peer")
 
 	return config, nil
 }
 
+// RotateKeys replaces the server keys of a tunnel's peer, keeping its
+// addresses. If clientPublicKey is set and differs from the current peer
+// key, the client's key is replaced too: the new peer is added before the
+// old one is removed, and takes over its address immediately.
+func (w *WireGuardManager) RotateKeys(id string, config *WireGuardConfig, clientPublicKey string) (*WireGuardConfig, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	oldPublicKey, exists := w.peers[id]
+	if !exists {
+		return nil, fmt.Errorf("no WireGuard peer for tunnel %s", id)
+	}
+
+	privKey, err := w.generatePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	pubKey, err := w.generatePublicKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate public key: %v", err)
+	}
+
+	if clientPublicKey != "" && clientPublicKey != oldPublicKey {
+		if err := w.addPeer(clientPublicKey, peerAllowedIPs(config), config.PersistentKeepalive); err != nil {
+			return nil, fmt.Errorf("failed to add WireGuard peer: %v", err)
+		}
+		w.peers[id] = clientPublicKey
+		if err := exec.Command("wg", "set", w.interfaceName, "peer", oldPublicKey, "remove").Run(); err != nil {
+			w.logger.Warn().
+				Err(err).
+				Str("peer_id", id).
+				Msg("Failed to remove replaced WireGuard peer")
+		}
+	}
+
+	rotated := *config
+	rotated.PublicKey = pubKey
+	rotated.PrivateKey = privKey
+
+	w.logger.Info().
+		Str("peer_id", id).
+		Bool("client_key_replaced", w.peers[id] != oldPublicKey).
+		Msg("Rotated WireGuard keys")
+
+	return &rotated, nil
+}
+
 // RemovePeer removes a WireGuard peer
 func (w *WireGuardManager) RemovePeer(id string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	cmd := exec.Command("wg", "set", w.interfaceName, "peer", id, "remove")
+	publicKey, exists := w.peers[id]
+	if !exists {
+		return fmt.Errorf("no WireGuard peer for tunnel %s", id)
+	}
+
+	cmd := exec.Command("wg", "set", w.interfaceName, "peer", publicKey, "remove")
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to remove WireGuard peer: %v", err)
 	}
+	if w.firewall != nil {
+		if err := w.firewall.RemovePeer(w.interfaceName, w.addresses[id]); err != nil {
+			w.logger.Warn().
+				Err(err).
+				Str("peer_id", id).
+				Msg("Failed to remove firewall rules for WireGuard peer")
+		}
+	}
+	delete(w.peers, id)
+	delete(w.addresses, id)
 
 	w.logger.Info().
 		Str("peer_id", id).
@@ -97,8 +368,246 @@ func (w *WireGuardManager) RemovePeer(id string) error {
 	return nil
 }
 
+// LatestHandshake returns the time of the most recent handshake with the
+// peer for the given tunnel. A zero time means no handshake has happened yet.
+func (w *WireGuardManager) LatestHandshake(id string) (time.Time, error) {
+	w.mu.RLock()
+	publicKey, exists := w.peers[id]
+	w.mu.RUnlock()
+	if !exists {
+		return time.Time{}, fmt.Errorf("no WireGuard peer for tunnel %s", id)
+	}
+
+	cmd := exec.Command("wg", "show", w.interfaceName, "latest-handshakes")
+	output, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read WireGuard handshakes: %v", err)
+	}
+
+	return parseLatestHandshake(string(output), publicKey)
+}
+
+// GenerateKeyPair generates a WireGuard private key and its public key
+func GenerateKeyPair() (privateKey, publicKey string, err error) {
+	output, err := exec.Command("wg", "genkey").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate private key: %v", err)
+	}
+	privateKey = strings.TrimSpace(string(output))
+
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = strings.NewReader(privateKey)
+	output, err = cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate public key: %v", err)
+	}
+	return privateKey, strings.TrimSpace(string(output)), nil
+}
+
+// PeerStats are the statistics of a tunnel client's connection, such as a
+// WireGuard peer
+type PeerStats struct {
+	// LatestHandshake is zero if no handshake has completed yet. Transports
+	// other than WireGuard report the last time the client's connection
+	// was confirmed alive.
+	LatestHandshake time.Time
+	ReceivedBytes   int64
+	SentBytes       int64
+}
+
+// PeerStats returns the statistics of the peers of all tunnels by tunnel ID
+func (w *WireGuardManager) PeerStats() (map[string]PeerStats, error) {
+	w.mu.RLock()
+	peers := make(map[string]string, len(w.peers))
+	for id, publicKey := range w.peers {
+		peers[publicKey] = id
+	}
+	w.mu.RUnlock()
+	if len(peers) == 0 {
+		return nil, nil
+	}
+
+	output, err := exec.Command("wg", "show", w.interfaceName, "dump").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard peers: %v", err)
+	}
+	byKey, err := parsePeerDump(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]PeerStats, len(peers))
+	for publicKey, peer := range byKey {
+		if id, ok := peers[publicKey]; ok {
+			stats[id] = peer
+		}
+	}
+	return stats, nil
+}
+
+// WireGuardInterfaceStatus is the state of a WireGuard interface
+type WireGuardInterfaceStatus struct {
+	Name string
+	// PublicKey is the interface's own key, empty if it has none
+	PublicKey  string
+	ListenPort int
+	// Peers is the number of tunnels with a peer on the interface
+	Peers int
+	// Error is why the device could not be read, in which case the listen
+	// port is the configured one
+	Error string
+}
+
+// Status returns the state of the interface, reading its key and listen
+// port from the device
+func (w *WireGuardManager) Status() WireGuardInterfaceStatus {
+	w.mu.RLock()
+	status := WireGuardInterfaceStatus{Name: w.interfaceName, ListenPort: w.basePort, Peers: len(w.peers)}
+	w.mu.RUnlock()
+
+	output, err := exec.Command("wg", "show", status.Name, "dump").Output()
+	if err != nil {
+		status.Error = fmt.Sprintf("failed to read WireGuard interface: %v", err)
+		return status
+	}
+	publicKey, port, err := parseInterfaceDump(string(output))
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.PublicKey, status.ListenPort = publicKey, port
+	return status
+}
+
+// ReconcilePeers compares the peers of the interface with those of the
+// given tunnels, its tunnels, adding back the peers of tunnels missing from
+// the device and removing the device's peers that belong to no tunnel. It
+// returns the IDs of the tunnels whose peer it added back and the public
+// keys of the peers it removed.
+func (w *WireGuardManager) ReconcilePeers(tunnels []*TunnelInfo) (missing, orphaned []string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	output, err := exec.Command("wg", "show", w.interfaceName, "dump").Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read WireGuard peers of %s: %v", w.interfaceName, err)
+	}
+	actual, err := parsePeerDump(string(output))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lost, orphans := diffPeers(actual, tunnels)
+	var errs []string
+	for _, tunnel := range lost {
+		allowedIPs := peerAllowedIPs(tunnel.WireGuardConfig)
+		if err := w.addPeer(tunnel.ClientPublicKey, allowedIPs, tunnel.WireGuardConfig.PersistentKeepalive); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to add back WireGuard peer of tunnel %s: %v", tunnel.ID, err))
+			continue
+		}
+		w.peers[tunnel.ID] = tunnel.ClientPublicKey
+		w.addresses[tunnel.ID] = allowedIPs
+		missing = append(missing, tunnel.ID)
+	}
+	for _, publicKey := range orphans {
+		if err := exec.Command("wg", "set", w.interfaceName, "peer", publicKey, "remove").Run(); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to remove orphaned WireGuard peer %s: %v", publicKey, err))
+			continue
+		}
+		// Forget peers of tunnels whose removal did not reach the device
+		for id, key := range w.peers {
+			if key != publicKey {
+				continue
+			}
+			if w.firewall != nil {
+				if err := w.firewall.RemovePeer(w.interfaceName, w.addresses[id]); err != nil {
+					w.logger.Warn().
+						Err(err).
+						Str("peer_id", id).
+						Msg("Failed to remove firewall rules for WireGuard peer")
+				}
+			}
+			delete(w.peers, id)
+			delete(w.addresses, id)
+		}
+		orphaned = append(orphaned, publicKey)
+	}
+	if len(errs) > 0 {
+		return missing, orphaned, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return missing, orphaned, nil
+}
+
 // Helper functions
 
+// parsePeerDump parses the peers of `wg show <iface> dump` output by public
+// key. The first line describes the interface itself; each peer line holds
+// public key, preshared key, endpoint, allowed IPs, latest handshake,
+// received bytes, sent bytes and persistent keepalive.
+func parsePeerDump(output string) (map[string]PeerStats, error) {
+	stats := make(map[string]PeerStats)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("unexpected WireGuard peer line with %d fields", len(fields))
+		}
+		var values [3]int64
+		for i, field := range fields[4:7] {
+			value, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid WireGuard peer statistic %q", field)
+			}
+			values[i] = value
+		}
+
+		peer := PeerStats{ReceivedBytes: values[1], SentBytes: values[2]}
+		if values[0] != 0 {
+			peer.LatestHandshake = time.Unix(values[0], 0)
+		}
+		stats[fields[0]] = peer
+	}
+	return stats, nil
+}
+
+// parseInterfaceDump parses the interface line of `wg show <iface> dump`
+// output, which holds private key, public key, listen port and fwmark. The
+// keys are "(none)" for an interface without a private key.
+func parseInterfaceDump(output string) (publicKey string, port int, err error) {
+	line, _, _ := strings.Cut(output, "\n")
+	fields := strings.Split(line, "\t")
+	if len(fields) != 4 {
+		return "", 0, fmt.Errorf("unexpected WireGuard interface line with %d fields", len(fields))
+	}
+	port, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid WireGuard listen port %q", fields[2])
+	}
+	if publicKey = fields[1]; publicKey == "(none)" {
+		publicKey = ""
+	}
+	return publicKey, port, nil
+}
+
+// parseLatestHandshake finds a peer in `wg show <iface> latest-handshakes` output
+func parseLatestHandshake(output, publicKey string) (time.Time, error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != publicKey {
+			continue
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid handshake timestamp %q", fields[1])
+		}
+		if seconds == 0 {
+			return time.Time{}, nil
+		}
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("peer not found on interface")
+}
+
 func (w *WireGuardManager) generatePrivateKey() (string, error) {
 	cmd := exec.Command("wg", "genkey")
 	output, err := cmd.Output()
@@ -120,16 +629,7 @@ func (w *WireGuardManager) generatePublicKey(privateKey string) (string, error)
 
 func (w *WireGuardManager) allocateIP() net.IP {
 	// Simple IP allocation strategy: increment the last octet
-	ip := make(net.IP, len(w.nextIP))
-	copy(ip, w.nextIP)
-	
-	// Increment the IP
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i]++
-		if ip[i] != 0 {
-			break
-		}
-	}
+	ip := nextIP(w.nextIP)
 
 	// Check if the IP is still in our subnet
 	if !w.ipNet.Contains(ip) {
@@ -140,9 +640,63 @@ func (w *WireGuardManager) allocateIP() net.IP {
 	return ip
 }
 
-func (w *WireGuardManager) addPeer(publicKey string, peerIP net.IP) error {
-	cmd := exec.Command("wg", "set", w.interfaceName,
+func (w *WireGuardManager) allocateIPv6() net.IP {
+	ip := nextIP(w.nextIP6)
+	if !w.ipNet6.Contains(ip) {
+		return nil
+	}
+	w.nextIP6 = ip
+	return ip
+}
+
+// nextIP returns the address following ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// peerAllowedIPs returns the addresses routed to a tunnel's peer
+func peerAllowedIPs(config *WireGuardConfig) []string {
+	allowed := []string{config.ClientIP + "/32"}
+	if config.ClientIPv6 != "" {
+		allowed = append(allowed, config.ClientIPv6+"/128")
+	}
+	return allowed
+}
+
+func (w *WireGuardManager) addPeer(publicKey string, allowedIPs []string, keepalive int) error {
+	args := []string{"set", w.interfaceName,
 		"peer", publicKey,
-		"allowed-ips", peerIP.String()+"/32")
-	return cmd.Run()
-} 
\ No newline at end of file
+		"allowed-ips", strings.Join(allowedIPs, ",")}
+	if keepalive > 0 {
+		args = append(args, "persistent-keepalive", strconv.Itoa(keepalive))
+	}
+	return exec.Command("wg", args...).Run()
+} 
+// diffPeers returns the tunnels whose peer is missing from the actual peers
+// of a device, by public key, and the public keys of the actual peers that
+// belong to none of the tunnels, both sorted
+func diffPeers(actual map[string]PeerStats, tunnels []*TunnelInfo) (missing []*TunnelInfo, orphaned []string) {
+	expected := make(map[string]bool, len(tunnels))
+	for _, tunnel := range tunnels {
+		expected[tunnel.ClientPublicKey] = true
+		if _, exists := actual[tunnel.ClientPublicKey]; !exists {
+			missing = append(missing, tunnel)
+		}
+	}
+	for publicKey := range actual {
+		if !expected[publicKey] {
+			orphaned = append(orphaned, publicKey)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].ID < missing[j].ID })
+	sort.Strings(orphaned)
+	return missing, orphaned
+}
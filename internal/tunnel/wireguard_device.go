@@ -0,0 +1,382 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// WireGuard implementations backing the agent's interface
+const (
+	// WireGuardAuto uses the kernel module if available and falls back to
+	// the userspace implementation otherwise
+	WireGuardAuto = "auto"
+	// WireGuardKernel requires the kernel module
+	WireGuardKernel = "kernel"
+	// WireGuardUserspace runs the interface in the agent with the embedded
+	// wireguard-go
+	WireGuardUserspace = "userspace"
+)
+
+// userspaceDevice is a WireGuard interface run by the embedded wireguard-go
+type userspaceDevice struct {
+	device *device.Device
+	// uapi serves the interface's control socket, through which wg
+	// configures it like a kernel interface
+	uapi net.Listener
+}
+
+// WireGuardInterface describes a WireGuard interface with its own subnet,
+// optional IPv6 prefix and listen port
+type WireGuardInterface struct {
+	Name    string
+	Subnet  string
+	Subnet6 string
+	Port    int
+}
+
+// maxInterfaceNameLength is the longest Linux interface name
+const maxInterfaceNameLength = 15
+
+// subnet parses and checks the interface's IPv4 subnet
+func (i WireGuardInterface) subnet() (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(i.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q of WireGuard interface %s: %v", i.Subnet, i.Name, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ipNet.IP.To4() == nil || bits-ones < 2 {
+		return nil, fmt.Errorf("subnet %q of WireGuard interface %s must be an IPv4 network with room for peers", i.Subnet, i.Name)
+	}
+	ipNet.IP = ipNet.IP.To4()
+	return ipNet, nil
+}
+
+// subnet6 parses and checks the interface's IPv6 prefix
+func (i WireGuardInterface) subnet6() (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(i.Subnet6)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IPv6 prefix %q of WireGuard interface %s: %v", i.Subnet6, i.Name, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ipNet.IP.To4() != nil || bits-ones < 2 {
+		return nil, fmt.Errorf("IPv6 prefix %q of WireGuard interface %s must be an IPv6 network with room for peers", i.Subnet6, i.Name)
+	}
+	return ipNet, nil
+}
+
+// Validate checks the interface name, subnets and port
+func (i WireGuardInterface) Validate() error {
+	if i.Name == "" || len(i.Name) > maxInterfaceNameLength || strings.ContainsAny(i.Name, "/ \t:=,") {
+		return fmt.Errorf("invalid WireGuard interface name %q", i.Name)
+	}
+	if i.Port <= 0 || i.Port > 65535 {
+		return fmt.Errorf("invalid port %d of WireGuard interface %s", i.Port, i.Name)
+	}
+	if _, err := i.subnet(); err != nil {
+		return err
+	}
+	if i.Subnet6 != "" {
+		if _, err := i.subnet6(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Conflicts reports why two interfaces cannot be used together, if they
+// share a name, port or addresses
+func (i WireGuardInterface) Conflicts(other WireGuardInterface) error {
+	if i.Name == other.Name {
+		return fmt.Errorf("duplicate WireGuard interface %s", i.Name)
+	}
+	if i.Port == other.Port {
+		return fmt.Errorf("WireGuard interfaces %s and %s share port %d", i.Name, other.Name, i.Port)
+	}
+	a, errA := i.subnet()
+	b, errB := other.subnet()
+	if errA == nil && errB == nil && (a.Contains(b.IP) || b.Contains(a.IP)) {
+		return fmt.Errorf("subnets of WireGuard interfaces %s and %s overlap", i.Name, other.Name)
+	}
+	if i.Subnet6 == "" || other.Subnet6 == "" {
+		return nil
+	}
+	a, errA = i.subnet6()
+	b, errB = other.subnet6()
+	if errA == nil && errB == nil && (a.Contains(b.IP) || b.Contains(a.IP)) {
+		return fmt.Errorf("IPv6 prefixes of WireGuard interfaces %s and %s overlap", i.Name, other.Name)
+	}
+	return nil
+}
+
+// ParseWireGuardInterfaces parses a comma-separated list of additional
+// WireGuard interfaces in the form name=subnet[+ipv6prefix]:port, e.g.
+// "wg1=10.11.0.0/16:51821,wg2=10.12.0.0/16+fd00:12::/64:51822". The
+// interfaces must not conflict with each other or the default interface.
+func ParseWireGuardInterfaces(spec string) ([]WireGuardInterface, error) {
+	all := []WireGuardInterface{{Name: DefaultWireGuardInterface, Subnet: DefaultWireGuardSubnet, Port: DefaultWireGuardPort}}
+	var interfaces []WireGuardInterface
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		sep := strings.LastIndex(rest, ":")
+		if !ok || sep < 0 {
+			return nil, fmt.Errorf("invalid WireGuard interface %q, want name=subnet:port", entry)
+		}
+		port, err := strconv.Atoi(rest[sep+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in WireGuard interface %q", entry)
+		}
+
+		subnet, subnet6, _ := strings.Cut(rest[:sep], "+")
+		iface := WireGuardInterface{Name: strings.TrimSpace(name), Subnet: subnet, Subnet6: subnet6, Port: port}
+		if err := iface.Validate(); err != nil {
+			return nil, err
+		}
+		for _, other := range all {
+			if err := iface.Conflicts(other); err != nil {
+				return nil, err
+			}
+		}
+		all = append(all, iface)
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+// ValidateWireGuardImplementation checks implementation names a supported
+// WireGuard implementation
+func ValidateWireGuardImplementation(implementation string) error {
+	switch implementation {
+	case WireGuardAuto, WireGuardKernel, WireGuardUserspace:
+		return nil
+	}
+	return fmt.Errorf("unknown WireGuard implementation %q (want %s, %s or %s)",
+		implementation, WireGuardAuto, WireGuardKernel, WireGuardUserspace)
+}
+
+// implementationCandidates lists the implementations to try in order. Only
+// Linux has a kernel implementation.
+func implementationCandidates(implementation, goos string) []string {
+	switch implementation {
+	case WireGuardKernel:
+		return []string{WireGuardKernel}
+	case WireGuardUserspace:
+		return []string{WireGuardUserspace}
+	}
+	if goos != "linux" {
+		return []string{WireGuardUserspace}
+	}
+	return []string{WireGuardKernel, WireGuardUserspace}
+}
+
+// EnsureInterface creates and configures the WireGuard interface with the
+// given implementation unless it already exists, returning the
+// implementation in use ("existing" for interfaces created outside the
+// agent). Userspace interfaces run in the agent until Close.
+func (w *WireGuardManager) EnsureInterface(implementation string) (string, error) {
+	if err := ValidateWireGuardImplementation(implementation); err != nil {
+		return "", err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := net.InterfaceByName(w.interfaceName); err == nil {
+		w.logger.Info().
+			Str("interface", w.interfaceName).
+			Msg("Using existing WireGuard interface")
+		return "existing", nil
+	}
+
+	var errs []string
+	for _, candidate := range implementationCandidates(implementation, runtime.GOOS) {
+		var err error
+		if candidate == WireGuardKernel {
+			err = w.createKernelInterface()
+		} else {
+			err = w.startUserspaceInterface()
+		}
+		if err != nil {
+			w.logger.Warn().
+				Err(err).
+				Str("implementation", candidate).
+				Msg("Failed to create WireGuard interface")
+			errs = append(errs, fmt.Sprintf("%s: %v", candidate, err))
+			continue
+		}
+
+		if err := w.configureInterface(); err != nil {
+			w.stopUserspace()
+			return "", err
+		}
+		w.logger.Info().
+			Str("interface", w.interfaceName).
+			Str("implementation", candidate).
+			Msg("Created WireGuard interface")
+		return candidate, nil
+	}
+	return "", fmt.Errorf("failed to create WireGuard interface %s: %s", w.interfaceName, strings.Join(errs, "; "))
+}
+
+// CheckInterface returns an error unless the interface exists and is up
+func (w *WireGuardManager) CheckInterface() error {
+	w.mu.RLock()
+	name := w.interfaceName
+	w.mu.RUnlock()
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("WireGuard interface %s not found: %v", name, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("WireGuard interface %s is down", name)
+	}
+	return nil
+}
+
+// Close stops the userspace WireGuard interface started by EnsureInterface,
+// removing it
+func (w *WireGuardManager) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopUserspace()
+}
+
+// createKernelInterface creates an interface of the kernel module and sets
+// its listen port
+func (w *WireGuardManager) createKernelInterface() error {
+	commands := [][]string{
+		{"ip", "link", "add", "dev", w.interfaceName, "type", "wireguard"},
+		{"wg", "set", w.interfaceName, "listen-port", strconv.Itoa(w.basePort)},
+	}
+	for i, args := range commands {
+		if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			if i > 0 {
+				_ = exec.Command("ip", "link", "del", "dev", w.interfaceName).Run()
+			}
+			return fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// startUserspaceInterface creates a TUN device run by the embedded
+// wireguard-go, serving its control socket and setting its listen port. On
+// macOS interfaces must be named utunN, so the kernel picks the name.
+func (w *WireGuardManager) startUserspaceInterface() error {
+	name := w.interfaceName
+	if runtime.GOOS == "darwin" {
+		name = "utun"
+	}
+	tunDevice, err := tun.CreateTUN(name, device.DefaultMTU)
+	if err != nil {
+		return fmt.Errorf("failed to create TUN device: %v", err)
+	}
+	if name, err = tunDevice.Name(); err != nil {
+		tunDevice.Close()
+		return fmt.Errorf("failed to get TUN device name: %v", err)
+	}
+
+	uapiFile, err := ipc.UAPIOpen(name)
+	if err != nil {
+		tunDevice.Close()
+		return fmt.Errorf("failed to open control socket: %v", err)
+	}
+	logger := w.logger.With().Str("interface", name).Logger()
+	dev := device.NewDevice(tunDevice, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: func(format string, args ...any) { logger.Debug().Msgf(format, args...) },
+		Errorf:   func(format string, args ...any) { logger.Error().Msgf(format, args...) },
+	})
+	uapi, err := ipc.UAPIListen(name, uapiFile)
+	if err != nil {
+		uapiFile.Close()
+		dev.Close()
+		return fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+	go func() {
+		for {
+			c, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(c)
+		}
+	}()
+
+	if err := dev.IpcSet(fmt.Sprintf("listen_port=%d\n", w.basePort)); err != nil {
+		uapi.Close()
+		dev.Close()
+		return fmt.Errorf("failed to set listen port: %v", err)
+	}
+	w.interfaceName = name
+	w.userspace = &userspaceDevice{device: dev, uapi: uapi}
+	return nil
+}
+
+func (w *WireGuardManager) stopUserspace() {
+	if w.userspace == nil {
+		return
+	}
+	w.userspace.uapi.Close()
+	w.userspace.device.Close()
+	w.userspace = nil
+}
+
+// configureInterface assigns the server addresses and brings the interface up
+func (w *WireGuardManager) configureInterface() error {
+	addresses := []*net.IPNet{{IP: w.serverIP, Mask: w.ipNet.Mask}}
+	if w.ipNet6 != nil {
+		addresses = append(addresses, &net.IPNet{IP: w.serverIP6, Mask: w.ipNet6.Mask})
+	}
+	for _, args := range interfaceSetupCommands(runtime.GOOS, w.interfaceName, addresses) {
+		output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to configure WireGuard interface (%s): %v: %s",
+				strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// interfaceSetupCommands returns the commands configuring a new WireGuard
+// interface on goos with the given server addresses and their prefixes
+func interfaceSetupCommands(goos, name string, addresses []*net.IPNet) [][]string {
+	var commands [][]string
+	for _, address := range addresses {
+		family := "inet"
+		if address.IP.To4() == nil {
+			family = "inet6"
+		}
+		if goos == "darwin" {
+			// utun devices are point-to-point and need a destination for IPv4
+			network := &net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+			ifconfig := []string{"ifconfig", name, family, address.String()}
+			if family == "inet" {
+				ifconfig = append(ifconfig, address.IP.String())
+			}
+			commands = append(commands,
+				append(ifconfig, "alias"),
+				[]string{"route", "-q", "-n", "add", "-" + family, network.String(), "-interface", name},
+			)
+			continue
+		}
+		commands = append(commands, []string{"ip", "address", "add", address.String(), "dev", name})
+	}
+	if goos == "darwin" {
+		return append(commands, []string{"ifconfig", name, "up"})
+	}
+	return append(commands, []string{"ip", "link", "set", "up", "dev", name})
+}
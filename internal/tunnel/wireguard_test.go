@@ -0,0 +1,268 @@
+package tunnel
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLatestHandshake(t *testing.T) {
+	output := "peerA=\t1700000000\npeerB=\t0\n"
+
+	handshake, err := parseLatestHandshake(output, "peerA=")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !handshake.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Expected handshake at 1700000000, got %v", handshake)
+	}
+
+	handshake, err = parseLatestHandshake(output, "peerB=")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !handshake.IsZero() {
+		t.Errorf("Expected zero handshake, got %v", handshake)
+	}
+
+	if _, err := parseLatestHandshake(output, "peerC="); err == nil {
+		t.Error("Expected error for unknown peer, got nil")
+	}
+}
+
+func TestWireGuardOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    WireGuardOptions
+		wantErr bool
+	}{
+		{"defaults", WireGuardOptions{}, false},
+		{"typical", WireGuardOptions{PersistentKeepalive: 25, MTU: 1420}, false},
+		{"negative keepalive", WireGuardOptions{PersistentKeepalive: -1}, true},
+		{"keepalive too long", WireGuardOptions{PersistentKeepalive: MaxPersistentKeepalive + 1}, true},
+		{"MTU too small", WireGuardOptions{MTU: MinMTU - 1}, true},
+		{"MTU too large", WireGuardOptions{MTU: MaxMTU + 1}, true},
+		{"hourly key rotation", WireGuardOptions{KeyRotationInterval: time.Hour}, false},
+		{"key rotation too frequent", WireGuardOptions{KeyRotationInterval: time.Second}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestParsePeerDump(t *testing.T) {
+	output := "cHJpdg==\tcHVi\t51820\toff\n" +
+		"peerA=\t(none)\t203.0.113.7:40000\t10.10.0.2/32\t1700000000\t1024\t2048\t25\n" +
+		"peerB=\t(none)\t(none)\t10.10.0.3/32\t0\t0\t0\toff\n"
+
+	stats, err := parsePeerDump(output)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected 2 peers, got %d", len(stats))
+	}
+
+	a := stats["peerA="]
+	if !a.LatestHandshake.Equal(time.Unix(1700000000, 0)) || a.ReceivedBytes != 1024 || a.SentBytes != 2048 {
+		t.Errorf("Unexpected stats for peerA: %+v", a)
+	}
+	if b := stats["peerB="]; !b.LatestHandshake.IsZero() {
+		t.Errorf("Expected no handshake for peerB, got %v", b.LatestHandshake)
+	}
+
+	if _, err := parsePeerDump("iface\nbroken\tline\n"); err == nil {
+		t.Error("Expected error for malformed peer line, got nil")
+	}
+	if stats, err := parsePeerDump(""); err != nil || len(stats) != 0 {
+		t.Errorf("Expected no peers for empty output, got %v, %v", stats, err)
+	}
+}
+
+func TestParseInterfaceDump(t *testing.T) {
+	publicKey, port, err := parseInterfaceDump("cHJpdg==\tcHVi\t51820\toff\npeerA=\t(none)\t(none)\t10.10.0.2/32\t0\t0\t0\toff\n")
+	if err != nil || publicKey != "cHVi" || port != 51820 {
+		t.Errorf("Expected key cHVi and port 51820, got %q, %d and %v", publicKey, port, err)
+	}
+
+	publicKey, _, err = parseInterfaceDump("(none)\t(none)\t51821\toff\n")
+	if err != nil || publicKey != "" {
+		t.Errorf("Expected no key for an interface without one, got %q and %v", publicKey, err)
+	}
+
+	if _, _, err := parseInterfaceDump("broken\n"); err == nil {
+		t.Error("Expected error for malformed interface line, got nil")
+	}
+}
+
+func TestDiffPeers(t *testing.T) {
+	actual := map[string]PeerStats{"keyA=": {}, "keyC=": {}}
+	tunnels := []*TunnelInfo{
+		{ID: "b", ClientPublicKey: "keyB="},
+		{ID: "a", ClientPublicKey: "keyA="},
+	}
+
+	missing, orphaned := diffPeers(actual, tunnels)
+	if len(missing) != 1 || missing[0].ID != "b" {
+		t.Errorf("Expected the peer of b to be missing, got %v", missing)
+	}
+	if !reflect.DeepEqual(orphaned, []string{"keyC="}) {
+		t.Errorf("Expected keyC= to be orphaned, got %v", orphaned)
+	}
+}
+
+func TestImplementationCandidates(t *testing.T) {
+	tests := []struct {
+		implementation string
+		goos           string
+		expected       []string
+	}{
+		{WireGuardAuto, "linux", []string{WireGuardKernel, WireGuardUserspace}},
+		{WireGuardAuto, "darwin", []string{WireGuardUserspace}},
+		{WireGuardKernel, "linux", []string{WireGuardKernel}},
+		{WireGuardUserspace, "linux", []string{WireGuardUserspace}},
+	}
+	for _, tt := range tests {
+		got := implementationCandidates(tt.implementation, tt.goos)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s on %s: expected %v, got %v", tt.implementation, tt.goos, tt.expected, got)
+		}
+	}
+
+	if err := ValidateWireGuardImplementation("boringtun"); err == nil {
+		t.Error("Expected error for unknown implementation, got nil")
+	}
+}
+
+func TestInterfaceSetupCommands(t *testing.T) {
+	addresses := []*net.IPNet{
+		{IP: net.ParseIP("10.10.0.1").To4(), Mask: net.CIDRMask(16, 32)},
+		{IP: net.ParseIP("fd00:10::1"), Mask: net.CIDRMask(64, 128)},
+	}
+
+	linux := interfaceSetupCommands("linux", "wg0", addresses)
+	expected := [][]string{
+		{"ip", "address", "add", "10.10.0.1/16", "dev", "wg0"},
+		{"ip", "address", "add", "fd00:10::1/64", "dev", "wg0"},
+		{"ip", "link", "set", "up", "dev", "wg0"},
+	}
+	if !reflect.DeepEqual(linux, expected) {
+		t.Errorf("Expected linux commands %v, got %v", expected, linux)
+	}
+
+	darwin := interfaceSetupCommands("darwin", "utun4", addresses)
+	expected = [][]string{
+		{"ifconfig", "utun4", "inet", "10.10.0.1/16", "10.10.0.1", "alias"},
+		{"route", "-q", "-n", "add", "-inet", "10.10.0.0/16", "-interface", "utun4"},
+		{"ifconfig", "utun4", "inet6", "fd00:10::1/64", "alias"},
+		{"route", "-q", "-n", "add", "-inet6", "fd00:10::/64", "-interface", "utun4"},
+		{"ifconfig", "utun4", "up"},
+	}
+	if !reflect.DeepEqual(darwin, expected) {
+		t.Errorf("Expected darwin commands %v, got %v", expected, darwin)
+	}
+}
+
+func TestParseWireGuardInterfaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		expected []WireGuardInterface
+		wantErr  bool
+	}{
+		{name: "empty", spec: ""},
+		{
+			name: "two interfaces",
+			spec: "wg1=10.11.0.0/16:51821, wg2=10.12.0.0/24:51822",
+			expected: []WireGuardInterface{
+				{Name: "wg1", Subnet: "10.11.0.0/16", Port: 51821},
+				{Name: "wg2", Subnet: "10.12.0.0/24", Port: 51822},
+			},
+		},
+		{
+			name: "dual-stack interface",
+			spec: "wg1=10.11.0.0/16+fd00:11::/64:51821",
+			expected: []WireGuardInterface{
+				{Name: "wg1", Subnet: "10.11.0.0/16", Subnet6: "fd00:11::/64", Port: 51821},
+			},
+		},
+		{name: "IPv4 prefix as IPv6 prefix", spec: "wg1=10.11.0.0/16+10.12.0.0/16:51821", wantErr: true},
+		{name: "overlapping IPv6 prefixes", spec: "wg1=10.11.0.0/16+fd00::/48:51821,wg2=10.12.0.0/16+fd00:0:0:1::/64:51822", wantErr: true},
+		{name: "missing port", spec: "wg1=10.11.0.0/16", wantErr: true},
+		{name: "invalid subnet", spec: "wg1=10.11.0.0:51821", wantErr: true},
+		{name: "IPv6 subnet", spec: "wg1=fd00::/64:51821", wantErr: true},
+		{name: "subnet too small", spec: "wg1=10.11.0.0/31:51821", wantErr: true},
+		{name: "name too long", spec: "wireguard-tenant-a=10.11.0.0/16:51821", wantErr: true},
+		{name: "default name", spec: "wg0=10.11.0.0/16:51821", wantErr: true},
+		{name: "default port", spec: "wg1=10.11.0.0/16:51820", wantErr: true},
+		{name: "overlapping subnets", spec: "wg1=10.11.0.0/16:51821,wg2=10.11.1.0/24:51822", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseWireGuardInterfaces(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestNewWireGuardInterface(t *testing.T) {
+	w, err := NewWireGuardInterface(WireGuardInterface{Name: "wg1", Subnet: "10.11.0.0/16", Port: 51821})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if w.serverIP.String() != "10.11.0.1" {
+		t.Errorf("Expected server IP 10.11.0.1, got %s", w.serverIP)
+	}
+	if ip := w.allocateIP(); ip.String() != "10.11.0.2" {
+		t.Errorf("Expected first peer IP 10.11.0.2, got %s", ip)
+	}
+
+	if err := w.SetIPv6Prefix("fd00:11::/64"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if w.serverIP6.String() != "fd00:11::1" {
+		t.Errorf("Expected server IPv6 fd00:11::1, got %s", w.serverIP6)
+	}
+	if ip := w.allocateIPv6(); ip.String() != "fd00:11::2" {
+		t.Errorf("Expected first peer IPv6 fd00:11::2, got %s", ip)
+	}
+
+	allowed := peerAllowedIPs(&WireGuardConfig{ClientIP: "10.11.0.2", ClientIPv6: "fd00:11::2"})
+	if !reflect.DeepEqual(allowed, []string{"10.11.0.2/32", "fd00:11::2/128"}) {
+		t.Errorf("Unexpected allowed IPs %v", allowed)
+	}
+}
+
+func TestCheckInterface(t *testing.T) {
+	w, err := NewWireGuardInterface(WireGuardInterface{Name: "wg-missing", Subnet: "10.20.0.0/24", Port: 51900})
+	if err != nil {
+		t.Fatalf("Failed to create WireGuard manager: %v", err)
+	}
+	if err := w.CheckInterface(); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a missing interface to be reported, got %v", err)
+	}
+
+	// The loopback interface stands in for an interface that is up
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			w.interfaceName = iface.Name
+			if err := w.CheckInterface(); err != nil {
+				t.Errorf("Expected no error for an interface that is up, got %v", err)
+			}
+			return
+		}
+	}
+	t.Skip("No loopback interface is up")
+}
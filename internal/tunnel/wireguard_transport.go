@@ -0,0 +1,303 @@
+// Package tunnel provides tunnel management functionality for the easy-tunnel-lb-agent.
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WireGuardTransport connects tunnel clients as peers of the agent's
+// WireGuard interfaces: the default interface and additional ones isolating
+// groups of tunnels
+type WireGuardTransport struct {
+	mu         sync.RWMutex
+	wg         *WireGuardManager
+	interfaces map[string]*WireGuardManager
+	// started is set once the interfaces exist, before which there are no
+	// peers to reconcile
+	started bool
+}
+
+// NewWireGuardTransport creates a WireGuard transport with the default
+// interface
+func NewWireGuardTransport() *WireGuardTransport {
+	return &WireGuardTransport{
+		wg:         NewWireGuardManager(),
+		interfaces: make(map[string]*WireGuardManager),
+	}
+}
+
+// Name returns the name of the transport
+func (t *WireGuardTransport) Name() string {
+	return TransportWireGuard
+}
+
+// AddInterface adds a WireGuard interface that tunnels can select with
+// WireGuardOptions.Interface. Its name, subnet and port must not conflict
+// with the existing interfaces.
+func (t *WireGuardTransport) AddInterface(iface WireGuardInterface) error {
+	if err := iface.Validate(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, w := range t.all() {
+		if err := iface.Conflicts(w.describe()); err != nil {
+			return err
+		}
+	}
+	w, err := NewWireGuardInterface(iface)
+	if err != nil {
+		return err
+	}
+	t.interfaces[iface.Name] = w
+	return nil
+}
+
+// SetIPv6Prefix gives peers on the default interface an IPv6 address from
+// prefix in addition to their IPv4 address. It must be called before peers
+// are added.
+func (t *WireGuardTransport) SetIPv6Prefix(prefix string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	iface := t.wg.describe()
+	iface.Subnet6 = prefix
+	for _, w := range t.interfaces {
+		if err := iface.Conflicts(w.describe()); err != nil {
+			return err
+		}
+	}
+	return t.wg.SetIPv6Prefix(prefix)
+}
+
+// HasInterface reports whether tunnels can use the named interface; the
+// empty name is the default interface
+func (t *WireGuardTransport) HasInterface(name string) bool {
+	_, ok := t.interfaceFor(name)
+	return ok
+}
+
+// interfaceFor returns the manager of the named interface
+func (t *WireGuardTransport) interfaceFor(name string) (*WireGuardManager, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if name == "" || name == t.wg.name {
+		return t.wg, true
+	}
+	w, ok := t.interfaces[name]
+	return w, ok
+}
+
+// peerInterface returns the interface of a tunnel's peer
+func (t *WireGuardTransport) peerInterface(tunnel *TunnelInfo) *WireGuardManager {
+	if w, ok := t.interfaceFor(tunnel.WireGuardConfig.Interface); ok {
+		return w
+	}
+	return t.wg
+}
+
+// all returns the default and additional interfaces sorted by name. Must
+// be called with t.mu held.
+func (t *WireGuardTransport) all() []*WireGuardManager {
+	interfaces := []*WireGuardManager{t.wg}
+	names := make([]string, 0, len(t.interfaces))
+	for name := range t.interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		interfaces = append(interfaces, t.interfaces[name])
+	}
+	return interfaces
+}
+
+// snapshot returns all interfaces
+func (t *WireGuardTransport) snapshot() []*WireGuardManager {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.all()
+}
+
+// eachInterface calls fn for all interfaces, joining their errors
+func (t *WireGuardTransport) eachInterface(fn func(w *WireGuardManager) error) error {
+	var errs []string
+	for _, w := range t.snapshot() {
+		if err := fn(w); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Start creates the interfaces with the given implementation (auto, kernel
+// or userspace) unless they already exist
+func (t *WireGuardTransport) Start(implementation string) error {
+	err := t.eachInterface(func(w *WireGuardManager) error {
+		_, err := w.EnsureInterface(implementation)
+		return err
+	})
+	if err == nil {
+		t.mu.Lock()
+		t.started = true
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// CheckInterfaces returns an error unless all interfaces exist and are up
+func (t *WireGuardTransport) CheckInterfaces() error {
+	return t.eachInterface(func(w *WireGuardManager) error {
+		return w.CheckInterface()
+	})
+}
+
+// Stop stops the userspace interfaces the agent started
+func (t *WireGuardTransport) Stop() {
+	for _, w := range t.snapshot() {
+		w.Close()
+	}
+}
+
+// SetDefaults sets the persistent keepalive interval and MTU of peers
+// created without explicit options, applying the MTU to the interfaces
+func (t *WireGuardTransport) SetDefaults(keepalive, mtu int) error {
+	return t.eachInterface(func(w *WireGuardManager) error {
+		return w.SetDefaults(keepalive, mtu)
+	})
+}
+
+// SetFirewall sets the firewall that peers on all interfaces are opened in
+// from now on
+func (t *WireGuardTransport) SetFirewall(firewall PeerFirewall) {
+	for _, w := range t.snapshot() {
+		w.SetFirewall(firewall)
+	}
+}
+
+// Interfaces returns the interfaces by the names they were created with,
+// starting with the default one
+func (t *WireGuardTransport) Interfaces() []WireGuardInterface {
+	interfaces := t.snapshot()
+	described := make([]WireGuardInterface, 0, len(interfaces))
+	for _, w := range interfaces {
+		w.mu.RLock()
+		iface := w.describe()
+		iface.Name = w.interfaceName
+		w.mu.RUnlock()
+		described = append(described, iface)
+	}
+	return described
+}
+
+// InterfaceStatus returns the state of the interfaces, starting with the
+// default one
+func (t *WireGuardTransport) InterfaceStatus() []WireGuardInterfaceStatus {
+	interfaces := t.snapshot()
+	statuses := make([]WireGuardInterfaceStatus, 0, len(interfaces))
+	for _, w := range interfaces {
+		statuses = append(statuses, w.Status())
+	}
+	return statuses
+}
+
+// Setup adds the tunnel client's public key as a peer of the interface
+// selected in the tunnel's WireGuard options
+func (t *WireGuardTransport) Setup(tunnel *TunnelInfo) error {
+	w, ok := t.interfaceFor(tunnel.WireGuardOptions.Interface)
+	if !ok {
+		return fmt.Errorf("unknown WireGuard interface %s", tunnel.WireGuardOptions.Interface)
+	}
+	config, err := w.SetupPeer(tunnel.ID, tunnel.ClientPublicKey, tunnel.WireGuardOptions)
+	if err != nil {
+		return fmt.Errorf("failed to setup WireGuard peer: %v", err)
+	}
+	// The key lives on in the configuration, where rotations replace it
+	tunnel.WireGuardOptions.PrivateKey = ""
+	tunnel.WireGuardConfig = config
+	return nil
+}
+
+// Teardown removes the tunnel's peer
+func (t *WireGuardTransport) Teardown(tunnel *TunnelInfo) error {
+	if tunnel.WireGuardConfig == nil {
+		return nil
+	}
+	return t.peerInterface(tunnel).RemovePeer(tunnel.ID)
+}
+
+// Endpoint returns the peer's address on its interface
+func (t *WireGuardTransport) Endpoint(tunnel *TunnelInfo) string {
+	if tunnel.WireGuardConfig == nil {
+		return ""
+	}
+	return tunnel.WireGuardConfig.ClientIP
+}
+
+// Stats reads the peer statistics of all interfaces
+func (t *WireGuardTransport) Stats() (map[string]PeerStats, error) {
+	all := make(map[string]PeerStats)
+	for _, w := range t.snapshot() {
+		stats, err := w.PeerStats()
+		if err != nil {
+			return nil, err
+		}
+		for id, peer := range stats {
+			all[id] = peer
+		}
+	}
+	return all, nil
+}
+
+// RotateKeys replaces the server keys of the tunnel's peer and, if
+// clientPublicKey is set, the client's key, returning the new configuration
+func (t *WireGuardTransport) RotateKeys(tunnel *TunnelInfo, clientPublicKey string) (*WireGuardConfig, error) {
+	if tunnel.WireGuardConfig == nil {
+		return nil, fmt.Errorf("tunnel %s does not use WireGuard", tunnel.ID)
+	}
+	return t.peerInterface(tunnel).RotateKeys(tunnel.ID, tunnel.WireGuardConfig, clientPublicKey)
+}
+
+// LatestHandshake returns the time of the most recent handshake with the
+// tunnel's peer
+func (t *WireGuardTransport) LatestHandshake(tunnel *TunnelInfo) (time.Time, error) {
+	if tunnel.WireGuardConfig == nil {
+		return time.Time{}, nil
+	}
+	return t.peerInterface(tunnel).LatestHandshake(tunnel.ID)
+}
+
+// Reconcile adds back the peers of tunnels missing from their interface and
+// removes the peers of the interfaces that belong to none of the tunnels
+func (t *WireGuardTransport) Reconcile(tunnels []*TunnelInfo) (missing, orphaned []string, err error) {
+	t.mu.RLock()
+	started := t.started
+	t.mu.RUnlock()
+	if !started {
+		return nil, nil, nil
+	}
+
+	byInterface := make(map[*WireGuardManager][]*TunnelInfo)
+	for _, tunnel := range tunnels {
+		if tunnel.WireGuardConfig != nil {
+			w := t.peerInterface(tunnel)
+			byInterface[w] = append(byInterface[w], tunnel)
+		}
+	}
+	err = t.eachInterface(func(w *WireGuardManager) error {
+		restored, removed, err := w.ReconcilePeers(byInterface[w])
+		missing = append(missing, restored...)
+		orphaned = append(orphaned, removed...)
+		return err
+	})
+	return missing, orphaned, err
+}
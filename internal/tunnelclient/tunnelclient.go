@@ -0,0 +1,230 @@
+// Package tunnelclient is the client end of a tunnel: it registers a tunnel
+// with an agent, connects the local service to it over WireGuard or
+// WebSocket and keeps it alive with heartbeats.
+package tunnelclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+	"github.com/rs/zerolog"
+)
+
+// Transports the client can connect over
+const (
+	TransportWireGuard = "wireguard"
+	TransportWebSocket = tunnel.TransportWebSocket
+)
+
+// removeTimeout bounds removing the tunnel from the agent on shutdown
+const removeTimeout = 10 * time.Second
+
+// Config configures a tunnel client
+type Config struct {
+	// TunnelID and Hostname of the tunnel to create; the agent generates a
+	// hostname if it is empty
+	TunnelID string
+	Hostname string
+
+	// LocalHost and LocalPort address the service behind the tunnel. The
+	// port is also the tunnel's target port.
+	LocalHost string
+	LocalPort int
+
+	// Transport is wireguard or websocket
+	Transport string
+
+	// HeartbeatInterval is how often the client reports that it is alive
+	HeartbeatInterval time.Duration
+
+	// WireGuardInterface names the local interface; WireGuardEndpoint is the
+	// host, optionally with a port, of the agent's WireGuard listener. It
+	// defaults to the host of the API URL.
+	WireGuardInterface string
+	WireGuardEndpoint  string
+
+	// TLSConfig is used for wss:// WebSocket connections
+	TLSConfig *tls.Config
+
+	// KeepTunnel leaves the tunnel on the agent when the client stops
+	KeepTunnel bool
+
+	// Version is reported with heartbeats
+	Version string
+}
+
+// Validate checks the configuration
+func (c Config) Validate() error {
+	if c.TunnelID == "" {
+		return fmt.Errorf("tunnel ID is required")
+	}
+	if c.LocalPort <= 0 || c.LocalPort > 65535 {
+		return fmt.Errorf("invalid local port: %d", c.LocalPort)
+	}
+	if c.Transport != TransportWireGuard && c.Transport != TransportWebSocket {
+		return fmt.Errorf("invalid transport %q, use %s or %s", c.Transport, TransportWireGuard, TransportWebSocket)
+	}
+	if c.HeartbeatInterval <= 0 {
+		return fmt.Errorf("heartbeat interval must be positive")
+	}
+	if c.Transport == TransportWireGuard && c.WireGuardInterface == "" {
+		return fmt.Errorf("WireGuard interface name is required")
+	}
+	return nil
+}
+
+// Client is the client end of one tunnel
+type Client struct {
+	api    *client.Client
+	apiURL string
+	config Config
+	logger *zerolog.Logger
+
+	// wireGuard is the local WireGuard interface, if the transport is
+	// wireguard and it is up
+	wireGuard *wireGuardLink
+}
+
+// New creates a client that manages its tunnel through the API at apiURL
+func New(api *client.Client, apiURL string, config Config) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Client{
+		api:    api,
+		apiURL: apiURL,
+		config: config,
+		logger: utils.GetModuleLogger(utils.ModuleTunnel),
+	}, nil
+}
+
+// Run creates the tunnel, brings up the local side of its transport and
+// sends heartbeats until ctx is canceled or the agent forgets the tunnel.
+// On the way out it tears the transport down and, unless KeepTunnel is
+// set, removes the tunnel from the agent.
+func (c *Client) Run(ctx context.Context) error {
+	req := &client.CreateTunnelRequest{
+		TunnelID:   c.config.TunnelID,
+		Hostname:   c.config.Hostname,
+		TargetPort: c.config.LocalPort,
+	}
+	var privateKey string
+	if c.config.Transport == TransportWebSocket {
+		req.Transport = TransportWebSocket
+	} else {
+		var err error
+		privateKey, req.WireGuardPublicKey, err = tunnel.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+	}
+
+	created, err := c.api.CreateTunnel(ctx, nil, req)
+	if err != nil {
+		return fmt.Errorf("failed to create tunnel: %v", err)
+	}
+	c.logger.Info().
+		Str("tunnel_id", created.TunnelID).
+		Str("endpoint", created.PublicEndpoint).
+		Str("transport", c.config.Transport).
+		Msg("Created tunnel")
+	if !c.config.KeepTunnel {
+		defer c.removeTunnel()
+	}
+
+	switch c.config.Transport {
+	case TransportWebSocket:
+		if created.WebSocketConfig == nil {
+			return fmt.Errorf("agent returned no WebSocket configuration")
+		}
+		done := make(chan struct{})
+		defer func() { <-done }()
+		sessionCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			defer close(done)
+			c.serveWebSocket(sessionCtx, created.WebSocketConfig.URL, created.WebSocketConfig.Token)
+		}()
+	default:
+		if created.WireGuardConfig == nil {
+			return fmt.Errorf("agent returned no WireGuard configuration")
+		}
+		endpoint, err := c.wireGuardEndpoint()
+		if err != nil {
+			return err
+		}
+		c.wireGuard = newWireGuardLink(c.config.WireGuardInterface, endpoint)
+		if err := c.wireGuard.up(created.WireGuardConfig, privateKey); err != nil {
+			return err
+		}
+		defer func() {
+			if err := c.wireGuard.down(); err != nil {
+				c.logger.Error().Err(err).Msg("Failed to bring down WireGuard interface")
+			}
+		}()
+	}
+
+	return c.heartbeat(ctx)
+}
+
+// wireGuardEndpoint returns the configured endpoint or the host of the API
+func (c *Client) wireGuardEndpoint() (string, error) {
+	if c.config.WireGuardEndpoint != "" {
+		return c.config.WireGuardEndpoint, nil
+	}
+	u, err := url.Parse(c.apiURL)
+	if err != nil || u.Hostname() == "" {
+		return "", fmt.Errorf("cannot derive the WireGuard endpoint from API URL %q", c.apiURL)
+	}
+	return u.Hostname(), nil
+}
+
+// heartbeat reports that the client is alive every HeartbeatInterval. It
+// returns nil once ctx is canceled, and an error if the agent no longer
+// knows the tunnel.
+func (c *Client) heartbeat(ctx context.Context) error {
+	ticker := time.NewTicker(c.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		resp, err := c.api.Heartbeat(ctx, c.config.TunnelID, &client.HeartbeatRequest{Health: "healthy", Version: c.config.Version})
+		var apiErr *client.APIError
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+			return fmt.Errorf("tunnel %s was removed from the agent", c.config.TunnelID)
+		case err != nil:
+			c.logger.Warn().Err(err).Str("tunnel_id", c.config.TunnelID).Msg("Failed to send heartbeat")
+		case c.wireGuard != nil && resp.WireGuardPublicKey != "":
+			// Follow rotations of the agent's key
+			if err := c.wireGuard.updatePeer(resp.WireGuardPublicKey); err != nil {
+				c.logger.Error().Err(err).Str("tunnel_id", c.config.TunnelID).Msg("Failed to update WireGuard peer")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeTunnel removes the tunnel from the agent, logging failures
+func (c *Client) removeTunnel() {
+	ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+	defer cancel()
+	if _, err := c.api.RemoveTunnel(ctx, &client.RemoveTunnelRequest{TunnelID: c.config.TunnelID}); err != nil {
+		c.logger.Error().Err(err).Str("tunnel_id", c.config.TunnelID).Msg("Failed to remove tunnel")
+		return
+	}
+	c.logger.Info().Str("tunnel_id", c.config.TunnelID).Msg("Removed tunnel")
+}
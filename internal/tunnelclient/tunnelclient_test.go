@@ -0,0 +1,198 @@
+package tunnelclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{TunnelID: "web", LocalPort: 8080, Transport: TransportWireGuard, HeartbeatInterval: time.Second, WireGuardInterface: "etl0"}
+	tests := []struct {
+		name        string
+		modify      func(*Config)
+		expectError bool
+	}{
+		{name: "Valid", modify: func(c *Config) {}},
+		{name: "WebSocket without interface", modify: func(c *Config) { c.Transport = TransportWebSocket; c.WireGuardInterface = "" }},
+		{name: "Missing tunnel ID", modify: func(c *Config) { c.TunnelID = "" }, expectError: true},
+		{name: "Invalid local port", modify: func(c *Config) { c.LocalPort = 70000 }, expectError: true},
+		{name: "Unknown transport", modify: func(c *Config) { c.Transport = "ssh" }, expectError: true},
+		{name: "Zero heartbeat interval", modify: func(c *Config) { c.HeartbeatInterval = 0 }, expectError: true},
+		{name: "WireGuard without interface", modify: func(c *Config) { c.WireGuardInterface = "" }, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid
+			tt.modify(&config)
+			err := config.Validate()
+			if tt.expectError && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWebSocketClient(t *testing.T) {
+	// The local service echoes what it receives
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	transport := tunnel.NewWebSocketTransport()
+	manager := tunnel.NewManager(10)
+	if err := manager.AddTransport(transport); err != nil {
+		t.Fatalf("Failed to add transport: %v", err)
+	}
+	handler := api.NewHandler(manager, "test")
+	handler.SetWebSocketTransport(transport)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c, err := New(client.New(server.URL, ""), server.URL, Config{
+		TunnelID:          "office",
+		Hostname:          "office.example.com",
+		LocalHost:         "127.0.0.1",
+		LocalPort:         local.Addr().(*net.TCPAddr).Port,
+		Transport:         TransportWebSocket,
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return transport.Connected("office") })
+	info, err := manager.GetTunnel("office")
+	if err != nil {
+		t.Fatalf("Expected tunnel to be created: %v", err)
+	}
+	waitFor(t, func() bool {
+		info, _ := manager.GetTunnel("office")
+		return info != nil && !info.LastHeartbeat.IsZero()
+	})
+
+	dialCtx, dialCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dialCancel()
+	conn, err := manager.DialTunnel(dialCtx, "office", fmt.Sprintf("%s:%d", info.Endpoint, info.TargetPort))
+	if err != nil {
+		t.Fatalf("Failed to dial tunnel: %v", err)
+	}
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Expected echo from local service, got %q, %v", reply, err)
+	}
+	conn.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected no error on shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for client to stop")
+	}
+	if _, err := manager.GetTunnel("office"); err == nil {
+		t.Error("Expected tunnel to be removed on shutdown")
+	}
+}
+
+func TestWireGuardLink(t *testing.T) {
+	var commands []string
+	link := newWireGuardLink("etl0", "vpn.example.com")
+	link.run = func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil, nil
+	}
+
+	config := &client.WireGuardConfig{
+		PublicKey:           "server-key",
+		ServerIP:            "10.10.0.1",
+		ClientIP:            "10.10.0.2",
+		Port:                51820,
+		PersistentKeepalive: 25,
+	}
+	if err := link.up(config, "client-private-key"); err != nil {
+		t.Fatalf("Failed to bring link up: %v", err)
+	}
+	expected := `[Interface]
+PrivateKey = client-private-key
+Address = 10.10.0.2/32
+
+[Peer]
+PublicKey = server-key
+Endpoint = vpn.example.com:51820
+AllowedIPs = 10.10.0.1/32
+PersistentKeepalive = 25
+`
+	if got := link.quickConfig("client-private-key"); got != expected {
+		t.Errorf("Expected configuration:\n%s\ngot:\n%s", expected, got)
+	}
+
+	if err := link.updatePeer("server-key"); err != nil {
+		t.Errorf("Unexpected error for unchanged key: %v", err)
+	}
+	if err := link.updatePeer("rotated-key"); err != nil {
+		t.Errorf("Unexpected error updating peer: %v", err)
+	}
+	path := link.dir + "/etl0.conf"
+	if err := link.down(); err != nil {
+		t.Errorf("Unexpected error bringing link down: %v", err)
+	}
+
+	expectedCommands := []string{
+		"wg-quick up " + path,
+		"wg set etl0 peer rotated-key endpoint vpn.example.com:51820 allowed-ips 10.10.0.1/32 persistent-keepalive 25",
+		"wg set etl0 peer server-key remove",
+		"wg-quick down " + path,
+	}
+	if !reflect.DeepEqual(commands, expectedCommands) {
+		t.Errorf("Expected commands %v, got %v", expectedCommands, commands)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
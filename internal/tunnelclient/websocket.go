@@ -0,0 +1,119 @@
+package tunnelclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// Reconnect backoff of the WebSocket transport
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// serveWebSocket keeps a WebSocket connection to the agent open until ctx is
+// canceled, reconnecting with backoff, and connects every stream the agent
+// opens to the local service
+func (c *Client) serveWebSocket(ctx context.Context, connectURL, token string) {
+	options := &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.config.TLSConfig,
+		}},
+		HTTPHeader: http.Header{"Authorization": {"Bearer " + token}},
+	}
+	delay := minReconnectDelay
+	for ctx.Err() == nil {
+		conn, _, err := websocket.Dial(ctx, connectURL, options)
+		if err != nil {
+			c.logger.Warn().
+				Err(err).
+				Str("tunnel_id", c.config.TunnelID).
+				Dur("retry_in", delay).
+				Msg("Failed to connect to agent")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+		delay = minReconnectDelay
+
+		config := yamux.DefaultConfig()
+		config.LogOutput = c.logger
+		session, err := yamux.Client(websocket.NetConn(ctx, conn, websocket.MessageBinary), config)
+		if err != nil {
+			conn.CloseNow()
+			c.logger.Error().Err(err).Str("tunnel_id", c.config.TunnelID).Msg("Failed to start yamux session")
+			return
+		}
+
+		c.logger.Info().Str("tunnel_id", c.config.TunnelID).Msg("Connected to agent over WebSocket")
+		c.serveSession(ctx, session)
+		if ctx.Err() == nil {
+			c.logger.Warn().Str("tunnel_id", c.config.TunnelID).Msg("WebSocket connection to agent lost")
+		}
+	}
+}
+
+// serveSession forwards the streams of session until it ends or ctx is
+// canceled
+func (c *Client) serveSession(ctx context.Context, session *yamux.Session) {
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+	defer session.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.forward(stream)
+		}()
+	}
+}
+
+// forward connects a stream to the local service, closing it if the
+// service cannot be reached
+func (c *Client) forward(stream net.Conn) {
+	address := net.JoinHostPort(c.config.LocalHost, strconv.Itoa(c.config.LocalPort))
+	local, err := net.Dial("tcp", address)
+	if err != nil {
+		c.logger.Warn().Err(err).Str("address", address).Msg("Failed to connect to local service")
+		stream.Close()
+		return
+	}
+	defer stream.Close()
+	defer local.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, stream)
+		if tcp, ok := local.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(stream, local)
+		stream.Close()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
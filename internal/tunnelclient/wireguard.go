@@ -0,0 +1,131 @@
+package tunnelclient
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/pkg/client"
+)
+
+// wireGuardLink is the local WireGuard interface of a tunnel, brought up
+// and down with wg-quick
+type wireGuardLink struct {
+	name     string
+	endpoint string
+
+	dir       string // holds the wg-quick configuration while up
+	config    *client.WireGuardConfig
+	serverKey string
+
+	// run runs a command, returning its combined output
+	run func(name string, args ...string) ([]byte, error)
+}
+
+func newWireGuardLink(name, endpoint string) *wireGuardLink {
+	return &wireGuardLink{
+		name:     name,
+		endpoint: endpoint,
+		run: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).CombinedOutput()
+		},
+	}
+}
+
+// up writes the wg-quick configuration, which names the interface after
+// its file, and brings the interface up
+func (l *wireGuardLink) up(config *client.WireGuardConfig, privateKey string) error {
+	l.config = config
+	dir, err := os.MkdirTemp("", "easy-tunnel-")
+	if err != nil {
+		return fmt.Errorf("failed to create WireGuard configuration directory: %v", err)
+	}
+	path := filepath.Join(dir, l.name+".conf")
+	if err := os.WriteFile(path, []byte(l.quickConfig(privateKey)), 0600); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to write WireGuard configuration: %v", err)
+	}
+	if output, err := l.run("wg-quick", "up", path); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to bring up WireGuard interface %s: %v: %s", l.name, err, strings.TrimSpace(string(output)))
+	}
+
+	l.dir = dir
+	l.serverKey = strings.TrimSpace(config.PublicKey)
+	return nil
+}
+
+// down brings the interface down and removes its configuration
+func (l *wireGuardLink) down() error {
+	if l.dir == "" {
+		return nil
+	}
+	defer os.RemoveAll(l.dir)
+	output, err := l.run("wg-quick", "down", filepath.Join(l.dir, l.name+".conf"))
+	l.dir = ""
+	if err != nil {
+		return fmt.Errorf("failed to bring down WireGuard interface %s: %v: %s", l.name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// updatePeer replaces the agent's peer after it rotated its key
+func (l *wireGuardLink) updatePeer(serverKey string) error {
+	if l.dir == "" || serverKey == l.serverKey {
+		return nil
+	}
+	allowedIPs := strings.ReplaceAll(hostRoutes(l.config.ServerIP, l.config.ServerIPv6), " ", "")
+	args := []string{"set", l.name, "peer", serverKey, "endpoint", l.peerEndpoint(), "allowed-ips", allowedIPs}
+	if l.config.PersistentKeepalive > 0 {
+		args = append(args, "persistent-keepalive", strconv.Itoa(l.config.PersistentKeepalive))
+	}
+	if output, err := l.run("wg", args...); err != nil {
+		return fmt.Errorf("failed to add peer: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if output, err := l.run("wg", "set", l.name, "peer", l.serverKey, "remove"); err != nil {
+		return fmt.Errorf("failed to remove previous peer: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	l.serverKey = serverKey
+	return nil
+}
+
+// peerEndpoint returns the endpoint with the agent's WireGuard port if it
+// has none
+func (l *wireGuardLink) peerEndpoint() string {
+	if _, _, err := net.SplitHostPort(l.endpoint); err == nil {
+		return l.endpoint
+	}
+	return net.JoinHostPort(strings.Trim(l.endpoint, "[]"), strconv.Itoa(l.config.Port))
+}
+
+// quickConfig renders the wg-quick configuration of the interface
+func (l *wireGuardLink) quickConfig(privateKey string) string {
+	config := l.config
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(&b, "Address = %s\n", hostRoutes(config.ClientIP, config.ClientIPv6))
+	if config.Mtu > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", config.Mtu)
+	}
+	fmt.Fprintf(&b, "\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", strings.TrimSpace(config.PublicKey))
+	fmt.Fprintf(&b, "Endpoint = %s\n", l.peerEndpoint())
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", hostRoutes(config.ServerIP, config.ServerIPv6))
+	if config.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", config.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+// hostRoutes formats an IPv4 and optional IPv6 address as host prefixes
+func hostRoutes(ipv4, ipv6 string) string {
+	if ipv6 == "" {
+		return ipv4 + "/32"
+	}
+	return ipv4 + "/32, " + ipv6 + "/128"
+}
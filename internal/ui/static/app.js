@@ -0,0 +1,346 @@
+// Dashboard of easy-tunnel-lb-agent. It polls the API of the agent serving
+// it and follows its event stream, authenticating with the token the
+// operator enters, which is kept for the browser session only.
+"use strict";
+
+const API = "/api/v1";
+const POLL_INTERVAL_MS = 2000;
+const EVENT_RETRY_MS = 5000;
+const MAX_EVENTS = 100;
+
+const state = {
+  token: sessionStorage.getItem("token") || "",
+  lastPoll: 0,
+  lastTotal: null,
+  lastRequests: new Map(),
+  events: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+class APIError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(method, path, body) {
+  const headers = {};
+  if (state.token) {
+    headers.Authorization = "Bearer " + state.token;
+  }
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+  const resp = await fetch(API + path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const data = await resp.json().catch(() => ({}));
+  if (!resp.ok) {
+    throw new APIError(resp.status, data.message || resp.statusText);
+  }
+  return data;
+}
+
+// el creates an element with text content, never parsing HTML
+function el(tag, text, className) {
+  const node = document.createElement(tag);
+  if (text !== undefined) {
+    node.textContent = text;
+  }
+  if (className) {
+    node.className = className;
+  }
+  return node;
+}
+
+function row(cells) {
+  const tr = document.createElement("tr");
+  for (const cell of cells) {
+    tr.appendChild(cell instanceof Node ? cell : el("td", cell));
+  }
+  return tr;
+}
+
+function formatBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function formatRate(rate) {
+  return rate === undefined ? "-" : rate.toFixed(1);
+}
+
+function formatAge(time) {
+  if (!time) {
+    return "never";
+  }
+  const seconds = Math.max(0, Math.round((Date.now() - new Date(time).getTime()) / 1000));
+  if (seconds < 60) {
+    return seconds + "s ago";
+  }
+  if (seconds < 3600) {
+    return Math.floor(seconds / 60) + "m ago";
+  }
+  return Math.floor(seconds / 3600) + "h ago";
+}
+
+function showError(message) {
+  $("error").textContent = message;
+  $("error").hidden = !message;
+}
+
+function showLogin(loggedIn) {
+  $("login").hidden = loggedIn;
+  $("logout").hidden = !loggedIn;
+}
+
+async function poll() {
+  const now = Date.now();
+  const elapsed = (now - state.lastPoll) / 1000;
+
+  const status = await api("GET", "/status");
+  $("agent").textContent = "version " + status.version;
+  $("status").textContent = status.status;
+  $("status").className = "value " + (status.status === "healthy" ? "ok" : "bad");
+  $("uptime").textContent = status.uptime;
+  $("tunnel-count").textContent = status.num_tunnels +
+    (status.num_degraded ? " (" + status.num_degraded + " degraded)" : "");
+  $("connections").textContent = status.traffic.active_connections;
+  $("traffic").textContent = formatBytes(status.traffic.bytes_received) + " / " + formatBytes(status.traffic.bytes_sent);
+  if (state.lastTotal !== null && elapsed > 0) {
+    $("rate").textContent = formatRate((status.traffic.requests - state.lastTotal) / elapsed);
+  }
+  state.lastTotal = status.traffic.requests;
+
+  const components = $("components");
+  components.replaceChildren();
+  for (const component of status.components || []) {
+    const item = el("li");
+    item.appendChild(el("span", component.status === "ok" ? "● " : "✖ ", component.status === "ok" ? "ok" : "bad"));
+    item.appendChild(document.createTextNode(component.name + (component.error ? ": " + component.error : "")));
+    components.appendChild(item);
+  }
+  if (!components.children.length) {
+    components.appendChild(el("li", "No health checks configured", "note"));
+  }
+
+  // The tunnels need a token with the tunnels:read scope
+  let tunnels;
+  try {
+    tunnels = (await api("GET", "/tunnels")).tunnels;
+  } catch (err) {
+    if (err.status === 401 || err.status === 403) {
+      showLogin(false);
+    }
+    throw err;
+  }
+  showLogin(state.token !== "");
+
+  const requests = new Map();
+  const rows = [];
+  for (const tunnel of tunnels) {
+    let stats;
+    try {
+      stats = await api("GET", "/tunnels/" + encodeURIComponent(tunnel.tunnel_id) + "/stats");
+    } catch (err) {
+      if (err.status === 404) {
+        continue;
+      }
+      throw err;
+    }
+    requests.set(tunnel.tunnel_id, stats.requests);
+    const last = state.lastRequests.get(tunnel.tunnel_id);
+    const rate = last !== undefined && elapsed > 0 ? (stats.requests - last) / elapsed : undefined;
+    rows.push(tunnelRow(tunnel, stats, rate));
+  }
+  state.lastRequests = requests;
+  state.lastPoll = now;
+  $("tunnels").replaceChildren(...rows);
+  if (!rows.length) {
+    $("tunnels").appendChild(row([el("td", "No tunnels", "note")]));
+  }
+
+  await pollRoutes();
+}
+
+function tunnelRow(tunnel, stats, rate) {
+  let status = tunnel.status;
+  let className = status === "active" ? "ok" : "warn";
+  if (tunnel.paused) {
+    status = "paused";
+    className = "warn";
+  } else if (tunnel.maintenance) {
+    status = "maintenance";
+    className = "warn";
+  }
+
+  const actions = el("td", undefined, "actions");
+  const pause = el("button", tunnel.paused ? "Resume" : "Pause");
+  pause.addEventListener("click", () => act(tunnel.paused ? "resume" : "pause", tunnel.tunnel_id));
+  const remove = el("button", "Remove", "danger");
+  remove.addEventListener("click", () => {
+    if (confirm("Remove tunnel " + tunnel.tunnel_id + "?")) {
+      act("remove", tunnel.tunnel_id);
+    }
+  });
+  actions.append(pause, " ", remove);
+
+  const target = tunnel.protocol === "tcp" ? "tcp :" + tunnel.listen_port + " → " + tunnel.target_port : String(tunnel.target_port);
+  return row([
+    tunnel.tunnel_id,
+    (tunnel.hostnames || [tunnel.hostname]).join(", "),
+    target,
+    el("td", status + (stats.degraded_reason ? " (" + stats.degraded_reason + ")" : ""), className),
+    formatRate(rate),
+    String(stats.active_connections),
+    formatAge(stats.last_handshake),
+    actions,
+  ]);
+}
+
+// pollRoutes shows the routing table, which needs the admin scope
+async function pollRoutes() {
+  let routes;
+  try {
+    routes = (await api("GET", "/admin/routes")).routes;
+  } catch (err) {
+    $("routes").replaceChildren();
+    $("routes-note").textContent = err.status === 403 || err.status === 401
+      ? "The routing table needs a token with the admin scope."
+      : "The routing table is not available: " + err.message;
+    $("routes-note").hidden = false;
+    return;
+  }
+  $("routes-note").hidden = true;
+  $("routes").replaceChildren(...routes.map((route) => {
+    let target = route.ip + ":" + route.port;
+    if (route.redirect) {
+      target = "redirect to " + route.redirect.url;
+    } else if (route.response) {
+      target = "fixed response " + (route.response.status || 200);
+    }
+    const name = route.hostname || ":" + route.listen_port + (route.protocol ? "/" + route.protocol : "");
+    const path = (route.path || "") + (route.priority ? " (priority " + route.priority + ")" : "");
+    return row([name, path, route.tunnel_id || "", target]);
+  }));
+}
+
+async function act(action, id) {
+  try {
+    if (action === "remove") {
+      await api("POST", "/remove-tunnel", { tunnel_id: id });
+    } else {
+      await api("POST", "/tunnels/" + encodeURIComponent(id) + "/" + action);
+    }
+    showError("");
+  } catch (err) {
+    showError("Failed to " + action + " " + id + ": " + err.message);
+  }
+  refresh();
+}
+
+// followEvents reads the server-sent event stream with fetch, which unlike
+// EventSource can send the token, and reconnects when it ends
+async function followEvents() {
+  if (state.events) {
+    state.events.abort();
+  }
+  const controller = new AbortController();
+  state.events = controller;
+
+  const headers = state.token ? { Authorization: "Bearer " + state.token } : {};
+  try {
+    const resp = await fetch(API + "/events", { headers, signal: controller.signal });
+    if (!resp.ok) {
+      throw new APIError(resp.status, resp.statusText);
+    }
+    $("events-note").textContent = "Following tunnel events since " + new Date().toLocaleTimeString() + ".";
+
+    const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+    let buffer = "";
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) {
+        break;
+      }
+      buffer += value;
+      let end;
+      while ((end = buffer.indexOf("\n\n")) >= 0) {
+        const message = buffer.slice(0, end);
+        buffer = buffer.slice(end + 2);
+        const data = message.split("\n").filter((line) => line.startsWith("data: ")).map((line) => line.slice(6)).join("\n");
+        if (data) {
+          addEvent(JSON.parse(data));
+        }
+      }
+    }
+  } catch (err) {
+    if (controller.signal.aborted) {
+      return;
+    }
+    $("events-note").textContent = "Event stream unavailable (" + err.message + "), retrying…";
+  }
+  if (!controller.signal.aborted) {
+    setTimeout(followEvents, EVENT_RETRY_MS);
+  }
+}
+
+function addEvent(event) {
+  const list = $("events");
+  const text = new Date(event.time).toLocaleTimeString() + "  " + event.type.padEnd(17) + " " +
+    event.tunnel_id + " " + event.hostname + (event.message ? "  " + event.message : "");
+  const className = ["removed", "degraded", "paused"].includes(event.type) ? "warn" : "";
+  list.insertBefore(el("li", text, className), list.firstChild);
+  while (list.children.length > MAX_EVENTS) {
+    list.removeChild(list.lastChild);
+  }
+  refresh();
+}
+
+let refreshing = false;
+
+async function refresh() {
+  if (refreshing) {
+    return;
+  }
+  refreshing = true;
+  try {
+    await poll();
+    showError("");
+  } catch (err) {
+    showError(err.status === 401 ? "Enter an API token to see the tunnels." : err.message);
+  } finally {
+    refreshing = false;
+  }
+}
+
+$("login").addEventListener("submit", (e) => {
+  e.preventDefault();
+  state.token = $("token").value.trim();
+  $("token").value = "";
+  sessionStorage.setItem("token", state.token);
+  refresh();
+  followEvents();
+});
+
+$("logout").addEventListener("click", () => {
+  state.token = "";
+  sessionStorage.removeItem("token");
+  showLogin(false);
+  refresh();
+  followEvents();
+});
+
+showLogin(state.token !== "");
+refresh();
+followEvents();
+setInterval(refresh, POLL_INTERVAL_MS);
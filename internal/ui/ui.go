@@ -0,0 +1,47 @@
+// Package ui provides the embedded web dashboard of the easy-tunnel-lb-agent.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// Path is where the dashboard is served on the API port
+const Path = "/ui/"
+
+// contentSecurityPolicy confines the dashboard to its own files and the
+// API of the agent serving it
+const contentSecurityPolicy = "default-src 'self'; connect-src 'self'; img-src 'self' data:; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+//go:embed static
+var static embed.FS
+
+// RegisterRoutes serves the dashboard under Path. The dashboard itself is
+// public; it calls the API with the token the operator enters.
+func RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle(Path, Handler())
+	mux.Handle("/ui", http.RedirectHandler(Path, http.StatusMovedPermanently))
+}
+
+// Handler serves the files of the dashboard under Path
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix(Path, http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,41 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterRoutes(mux)
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{http.MethodGet, "/ui/", http.StatusOK, `<script src="app.js" defer></script>`},
+		{http.MethodGet, "/ui/app.js", http.StatusOK, "/api/v1"},
+		{http.MethodGet, "/ui/style.css", http.StatusOK, "#overview"},
+		{http.MethodGet, "/ui", http.StatusMovedPermanently, ""},
+		{http.MethodGet, "/ui/missing.js", http.StatusNotFound, ""},
+		{http.MethodPost, "/ui/", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.expectedStatus {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.expectedStatus, w.Code)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), tt.expectedBody) {
+			t.Errorf("%s %s: expected body containing %q", tt.method, tt.path, tt.expectedBody)
+		}
+		if tt.expectedStatus == http.StatusOK && w.Header().Get("Content-Security-Policy") != contentSecurityPolicy {
+			t.Errorf("%s %s: expected the content security policy, got %q", tt.method, tt.path, w.Header().Get("Content-Security-Policy"))
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Package usage accounts the traffic of tunnels in time buckets for billing.
+package usage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// sampleInterval is how often the traffic counters of tunnels are read. The
+// traffic of a tunnel removed between two samples is not accounted.
+const sampleInterval = 10 * time.Second
+
+// Sample is the current traffic counters of a tunnel
+type Sample struct {
+	TunnelID      string
+	Tenant        string
+	BytesSent     int64
+	BytesReceived int64
+	Requests      int64
+}
+
+// SampleFunc returns the counters of all current tunnels
+type SampleFunc func() []Sample
+
+// Record is the traffic of a tunnel during one bucket
+type Record struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	TunnelID      string    `json:"tunnel_id"`
+	Tenant        string    `json:"tenant,omitempty"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Requests      int64     `json:"requests"`
+}
+
+// Query selects records; empty fields match every record
+type Query struct {
+	Tenant   string
+	TunnelID string
+
+	// Since and Until select the records of buckets starting in
+	// [Since, Until)
+	Since time.Time
+	Until time.Time
+}
+
+func (q *Query) matches(r *Record) bool {
+	return (q.Tenant == "" || r.Tenant == q.Tenant) &&
+		(q.TunnelID == "" || r.TunnelID == q.TunnelID) &&
+		!r.Start.Before(q.Since) &&
+		(q.Until.IsZero() || r.Start.Before(q.Until))
+}
+
+// Accountant samples the traffic counters of tunnels, sums them up per
+// bucket and appends the records of each bucket as JSON lines to a file
+type Accountant struct {
+	path       string
+	bucket     time.Duration
+	sample     SampleFunc
+	webhookURL string
+	httpClient *http.Client
+	logger     *zerolog.Logger
+
+	mu          sync.Mutex
+	file        *os.File
+	last        map[string]Sample
+	current     map[string]*Record
+	bucketStart time.Time
+}
+
+// Open opens the usage file at path, creating it if needed, to account the
+// traffic reported by sample in buckets of the given length
+func Open(path string, bucket time.Duration, sample SampleFunc) (*Accountant, error) {
+	if bucket < sampleInterval {
+		return nil, fmt.Errorf("usage buckets must be at least %s", sampleInterval)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage file: %v", err)
+	}
+	return &Accountant{
+		path:        path,
+		bucket:      bucket,
+		sample:      sample,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		logger:      utils.GetLogger(),
+		file:        file,
+		last:        make(map[string]Sample),
+		current:     make(map[string]*Record),
+		bucketStart: time.Now().UTC().Truncate(bucket),
+	}, nil
+}
+
+// SetWebhook posts the records of each completed bucket as JSON to url
+func (a *Accountant) SetWebhook(url string) {
+	a.webhookURL = url
+}
+
+// Run samples the traffic of tunnels and records each bucket when it ends,
+// until ctx is cancelled
+func (a *Accountant) Run(ctx context.Context) {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			records, err := a.tick(now.UTC())
+			if err != nil {
+				a.logger.Error().Err(err).Msg("Failed to record usage")
+			}
+			if len(records) > 0 && a.webhookURL != "" {
+				if err := a.push(ctx, records); err != nil {
+					a.logger.Warn().
+						Err(err).
+						Int("records", len(records)).
+						Msg("Failed to push usage records to webhook")
+				}
+			}
+		}
+	}
+}
+
+// tick samples the counters at now and, if the bucket ended, records it and
+// returns its records
+func (a *Accountant) tick(now time.Time) ([]Record, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.collect()
+	start := now.Truncate(a.bucket)
+	if !start.After(a.bucketStart) {
+		return nil, nil
+	}
+	return a.flush(a.bucketStart.Add(a.bucket), start)
+}
+
+// collect adds the traffic since the last sample to the current bucket.
+// Must be called with a.mu held.
+func (a *Accountant) collect() {
+	seen := make(map[string]Sample)
+	for _, sample := range a.sample() {
+		seen[sample.TunnelID] = sample
+
+		// Counters start over when a tunnel is recreated
+		delta := sample
+		if last, ok := a.last[sample.TunnelID]; ok && sample.BytesSent >= last.BytesSent &&
+			sample.BytesReceived >= last.BytesReceived && sample.Requests >= last.Requests {
+			delta.BytesSent -= last.BytesSent
+			delta.BytesReceived -= last.BytesReceived
+			delta.Requests -= last.Requests
+		}
+		if delta.BytesSent == 0 && delta.BytesReceived == 0 && delta.Requests == 0 {
+			continue
+		}
+
+		record, ok := a.current[sample.TunnelID]
+		if !ok {
+			record = &Record{TunnelID: sample.TunnelID}
+			a.current[sample.TunnelID] = record
+		}
+		record.Tenant = sample.Tenant
+		record.BytesSent += delta.BytesSent
+		record.BytesReceived += delta.BytesReceived
+		record.Requests += delta.Requests
+	}
+	a.last = seen
+}
+
+// flush records the current bucket as ending at end and starts the next
+// one at next. Must be called with a.mu held.
+func (a *Accountant) flush(end, next time.Time) ([]Record, error) {
+	records := make([]Record, 0, len(a.current))
+	for _, record := range a.current {
+		record.Start, record.End = a.bucketStart, end
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].TunnelID < records[j].TunnelID })
+	a.current = make(map[string]*Record)
+	a.bucketStart = next
+
+	var lines []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := a.file.Write(lines); err != nil {
+		return nil, fmt.Errorf("failed to write usage records: %v", err)
+	}
+	return records, nil
+}
+
+// push posts records to the webhook as {"records": [...]}
+func (a *Accountant) push(ctx context.Context, records []Record) error {
+	body, err := json.Marshal(struct {
+		Records []Record `json:"records"`
+	}{records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Query returns the matching records of completed buckets, oldest first
+func (a *Accountant) Query(q Query) ([]Record, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage file: %v", err)
+	}
+	defer file.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Skip a line torn by a crash mid-write
+			continue
+		}
+		if q.matches(&record) {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %v", err)
+	}
+	return records, nil
+}
+
+// Close records the traffic of the current, unfinished bucket and closes
+// the usage file
+func (a *Accountant) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.collect()
+	now := time.Now().UTC()
+	_, err := a.flush(now, now)
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// csvHeader names the columns WriteCSV writes
+var csvHeader = []string{"start", "end", "tunnel_id", "tenant", "bytes_sent", "bytes_received", "requests"}
+
+// WriteCSV writes records as CSV with a header row
+func WriteCSV(w io.Writer, records []Record) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := writer.Write([]string{
+			record.Start.Format(time.RFC3339),
+			record.End.Format(time.RFC3339),
+			record.TunnelID,
+			record.Tenant,
+			strconv.FormatInt(record.BytesSent, 10),
+			strconv.FormatInt(record.BytesReceived, 10),
+			strconv.FormatInt(record.Requests, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,153 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountant(t *testing.T) {
+	samples := []Sample{
+		{TunnelID: "web", Tenant: "acme", BytesSent: 100, BytesReceived: 10, Requests: 1},
+	}
+	accountant, err := Open(filepath.Join(t.TempDir(), "usage.log"), time.Hour, func() []Sample { return samples })
+	if err != nil {
+		t.Fatalf("Failed to open usage file: %v", err)
+	}
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	accountant.bucketStart = start
+
+	// Counts add up within a bucket
+	if records, err := accountant.tick(start.Add(10 * time.Minute)); err != nil || len(records) != 0 {
+		t.Fatalf("Expected no records before the bucket ends, got %v, %v", records, err)
+	}
+	samples = []Sample{
+		{TunnelID: "web", Tenant: "acme", BytesSent: 300, BytesReceived: 30, Requests: 3},
+		{TunnelID: "api", BytesSent: 50},
+	}
+	records, err := accountant.tick(start.Add(time.Hour + 5*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to record usage: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %+v", records)
+	}
+	web := records[1]
+	if web.TunnelID != "web" || web.Tenant != "acme" || web.BytesSent != 300 || web.Requests != 3 ||
+		!web.Start.Equal(start) || !web.End.Equal(start.Add(time.Hour)) {
+		t.Errorf("Unexpected record %+v", web)
+	}
+
+	// A recreated tunnel's counters start over
+	samples = []Sample{{TunnelID: "web", Tenant: "acme", BytesSent: 20, Requests: 1}}
+	if _, err := accountant.tick(start.Add(2*time.Hour + 5*time.Second)); err != nil {
+		t.Fatalf("Failed to record usage: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    Query
+		expected []int64
+	}{
+		{name: "All records", query: Query{}, expected: []int64{50, 300, 20}},
+		{name: "By tenant", query: Query{Tenant: "acme"}, expected: []int64{300, 20}},
+		{name: "By tunnel", query: Query{TunnelID: "api"}, expected: []int64{50}},
+		{name: "Since", query: Query{Since: start.Add(time.Hour)}, expected: []int64{20}},
+		{name: "Until", query: Query{Until: start.Add(time.Hour)}, expected: []int64{50, 300}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := accountant.Query(tt.query)
+			if err != nil {
+				t.Fatalf("Failed to query usage: %v", err)
+			}
+			var sent []int64
+			for _, record := range records {
+				sent = append(sent, record.BytesSent)
+			}
+			if len(sent) != len(tt.expected) {
+				t.Fatalf("Expected bytes sent %v, got %v", tt.expected, sent)
+			}
+			for i := range sent {
+				if sent[i] != tt.expected[i] {
+					t.Errorf("Expected bytes sent %v, got %v", tt.expected, sent)
+				}
+			}
+		})
+	}
+
+	// Closing records the unfinished bucket
+	samples = []Sample{{TunnelID: "web", Tenant: "acme", BytesSent: 25, Requests: 2}}
+	if err := accountant.Close(); err != nil {
+		t.Fatalf("Failed to close usage file: %v", err)
+	}
+	records, _ = accountant.Query(Query{Since: start.Add(2 * time.Hour)})
+	if len(records) != 1 || records[0].BytesSent != 5 || records[0].Requests != 1 {
+		t.Errorf("Expected the unfinished bucket to be recorded, got %+v", records)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	err := WriteCSV(&buf, []Record{
+		{Start: start, End: start.Add(time.Hour), TunnelID: "web", Tenant: "acme", BytesSent: 300, BytesReceived: 30, Requests: 3},
+	})
+	if err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	expected := "start,end,tunnel_id,tenant,bytes_sent,bytes_received,requests\n" +
+		"2024-01-01T10:00:00Z,2024-01-01T11:00:00Z,web,acme,300,30,3\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var received []Record
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var body struct {
+			Records []Record `json:"records"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Failed to decode webhook body: %v", err)
+		}
+		received = body.Records
+	}))
+	defer webhook.Close()
+
+	accountant, err := Open(filepath.Join(t.TempDir(), "usage.log"), time.Hour, func() []Sample { return nil })
+	if err != nil {
+		t.Fatalf("Failed to open usage file: %v", err)
+	}
+	defer accountant.Close()
+	accountant.SetWebhook(webhook.URL)
+
+	if err := accountant.push(context.Background(), []Record{{TunnelID: "web", BytesSent: 300}}); err != nil {
+		t.Fatalf("Failed to push records: %v", err)
+	}
+	if len(received) != 1 || received[0].TunnelID != "web" {
+		t.Errorf("Expected the webhook to receive the record, got %+v", received)
+	}
+
+	accountant.SetWebhook(webhook.URL + "/broken")
+	if err := accountant.push(context.Background(), received); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Expected a failing webhook to return an error, got %v", err)
+	}
+}
+
+func TestOpenRejectsShortBuckets(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "usage.log"), time.Second, nil); err == nil {
+		t.Error("Expected buckets shorter than the sample interval to be rejected")
+	}
+}
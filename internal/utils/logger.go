@@ -2,13 +2,39 @@
 package utils
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// Subsystems whose log level can be configured independently
+const (
+	ModuleAPI          = "api"
+	ModuleLoadBalancer = "loadbalancer"
+	ModuleTunnel       = "tunnel"
+	ModuleWireGuard    = "wireguard"
+	ModuleKubernetes   = "kubernetes"
+)
+
+// Modules lists the subsystems that support their own log level
+var Modules = []string{ModuleAPI, ModuleLoadBalancer, ModuleTunnel, ModuleWireGuard, ModuleKubernetes}
+
+var (
+	levelsMu     sync.RWMutex
+	defaultLevel = zerolog.InfoLevel
+	moduleLevels = make(map[string]zerolog.Level)
+
+	loggersMu     sync.Mutex
+	output        io.Writer = os.Stderr
+	moduleLoggers           = make(map[string]*zerolog.Logger)
+)
+
 // InitLogger initializes the global logger with the specified log level
 func InitLogger(level string) {
 	// Parse the log level
@@ -18,20 +44,201 @@ func InitLogger(level string) {
 	}
 
 	// Configure zerolog
-	zerolog.SetGlobalLevel(logLevel)
 	zerolog.TimeFieldFormat = time.RFC3339
 
 	// Create a console writer
-	output := zerolog.ConsoleWriter{
+	loggersMu.Lock()
+	output = zerolog.ConsoleWriter{
 		Out:        os.Stdout,
 		TimeFormat: time.RFC3339,
 	}
 
 	// Set global logger
-	log.Logger = zerolog.New(output).With().Timestamp().Caller().Logger()
+	log.Logger = newLogger("")
+
+	// Rebuild loggers handed out before initialization so they use the new output
+	for module, logger := range moduleLoggers {
+		*logger = newLogger(module)
+	}
+	loggersMu.Unlock()
+
+	levelsMu.Lock()
+	defaultLevel = logLevel
+	applyLevelsLocked()
+	levelsMu.Unlock()
 }
 
 // GetLogger returns the global logger instance
 func GetLogger() *zerolog.Logger {
 	return &log.Logger
-} 
\ No newline at end of file
+}
+
+// GetModuleLogger returns the logger for a subsystem. Its level follows the
+// module's own level if one is set, and the global level otherwise.
+func GetModuleLogger(module string) *zerolog.Logger {
+	loggersMu.Lock()
+	defer loggersMu.Unlock()
+
+	logger, exists := moduleLoggers[module]
+	if !exists {
+		l := newLogger(module)
+		logger = &l
+		moduleLoggers[module] = logger
+	}
+	return logger
+}
+
+// SetLevel changes the global log level at runtime. Unknown levels are rejected.
+func SetLevel(level string) error {
+	logLevel, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	defaultLevel = logLevel
+	applyLevelsLocked()
+	return nil
+}
+
+// SetModuleLevel changes the log level of a single subsystem at runtime.
+// An empty level makes the module follow the global level again.
+func SetModuleLevel(module, level string) error {
+	if !IsModule(module) {
+		return fmt.Errorf("unknown log module: %s", module)
+	}
+
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	if level == "" {
+		delete(moduleLevels, module)
+	} else {
+		logLevel, err := zerolog.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		moduleLevels[module] = logLevel
+	}
+	applyLevelsLocked()
+	return nil
+}
+
+// SetModuleLevels replaces all per-module levels. Modules that are not
+// listed follow the global level.
+func SetModuleLevels(levels map[string]zerolog.Level) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	moduleLevels = make(map[string]zerolog.Level, len(levels))
+	for module, level := range levels {
+		moduleLevels[module] = level
+	}
+	applyLevelsLocked()
+}
+
+// Levels returns the global log level and any per-module overrides
+func Levels() (string, map[string]string) {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+
+	modules := make(map[string]string, len(moduleLevels))
+	for module, level := range moduleLevels {
+		modules[module] = level.String()
+	}
+	return defaultLevel.String(), modules
+}
+
+// ParseModuleLevels parses per-module levels in the form
+// "module=level,module=level", e.g. "wireguard=warn,loadbalancer=debug"
+func ParseModuleLevels(spec string) (map[string]zerolog.Level, error) {
+	levels := make(map[string]zerolog.Level)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		module, level, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid module log level %q: expected module=level", entry)
+		}
+		module = strings.TrimSpace(module)
+		if !IsModule(module) {
+			return nil, fmt.Errorf("unknown log module: %s (valid modules: %s)", module, strings.Join(Modules, ", "))
+		}
+		logLevel, err := zerolog.ParseLevel(strings.TrimSpace(level))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level for module %s: %v", module, err)
+		}
+		levels[module] = logLevel
+	}
+	return levels, nil
+}
+
+// IsModule reports whether module is a subsystem with its own log level
+func IsModule(module string) bool {
+	for _, m := range Modules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+// newLogger creates a logger whose output is filtered by the module's level.
+// Callers must hold loggersMu.
+func newLogger(module string) zerolog.Logger {
+	ctx := zerolog.New(levelFilter{module: module, out: output}).With().Timestamp()
+	if module != "" {
+		ctx = ctx.Str("module", module)
+	}
+	return ctx.Caller().Logger()
+}
+
+// applyLevelsLocked lowers zerolog's global level to the most verbose level
+// in use, leaving the per-module filtering to levelFilter. Callers must hold
+// levelsMu.
+func applyLevelsLocked() {
+	lowest := defaultLevel
+	for _, level := range moduleLevels {
+		if level < lowest {
+			lowest = level
+		}
+	}
+	zerolog.SetGlobalLevel(lowest)
+}
+
+// moduleLevel returns the effective level of a module
+func moduleLevel(module string) zerolog.Level {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+
+	if level, exists := moduleLevels[module]; exists {
+		return level
+	}
+	return defaultLevel
+}
+
+// levelFilter drops log events below the level of the module they belong to
+// and redacts private keys from the others
+type levelFilter struct {
+	module string
+	out    io.Writer
+}
+
+func (f levelFilter) Write(p []byte) (int, error) {
+	if _, err := f.out.Write(RedactPrivateKeys(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f levelFilter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level < moduleLevel(f.module) {
+		return len(p), nil
+	}
+	return f.Write(p)
+}
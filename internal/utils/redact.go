@@ -0,0 +1,43 @@
+// Package utils provides utility functions for the easy-tunnel-lb-agent.
+package utils
+
+import (
+	"regexp"
+	"sync/atomic"
+)
+
+// redactedValue replaces private keys in log output
+const redactedValue = "[REDACTED]"
+
+var (
+	// exposePrivateKeys turns off the redaction of private keys
+	exposePrivateKeys atomic.Bool
+
+	// privateKeyField matches JSON fields such as "private_key" or
+	// "server_private_key" with their string value
+	privateKeyField = regexp.MustCompile(`(?i)("[^"]*private_?key[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// pemPrivateKey matches PEM private key blocks, including ones whose
+	// newlines are escaped inside JSON strings
+	pemPrivateKey = regexp.MustCompile(`(?s)-----BEGIN ([A-Z0-9 ]*)PRIVATE KEY-----.*?-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+	// wireGuardPrivateKey matches the PrivateKey line of a wg-quick
+	// configuration
+	wireGuardPrivateKey = regexp.MustCompile(`(PrivateKey\s*=\s*)[A-Za-z0-9+/]+=*`)
+)
+
+// SetExposePrivateKeys turns the redaction of private keys from log output
+// off, for debugging, or back on
+func SetExposePrivateKeys(expose bool) {
+	exposePrivateKeys.Store(expose)
+}
+
+// RedactPrivateKeys replaces the private keys in a log event, whether in
+// fields named like private_key, PEM blocks or wg-quick configurations,
+// unless redaction is turned off
+func RedactPrivateKeys(p []byte) []byte {
+	if exposePrivateKeys.Load() {
+		return p
+	}
+	p = privateKeyField.ReplaceAll(p, []byte(`$1"`+redactedValue+`"`))
+	p = pemPrivateKey.ReplaceAll(p, []byte(`-----BEGIN ${1}PRIVATE KEY-----`+redactedValue+`-----END ${1}PRIVATE KEY-----`))
+	return wireGuardPrivateKey.ReplaceAll(p, []byte(`${1}`+redactedValue))
+}
@@ -0,0 +1,99 @@
+// Package client is a typed client for the easy-tunnel-lb-agent HTTP API.
+//
+// The request and response types and the API methods in client_gen.go are
+// generated from the agent's OpenAPI document; run go generate after
+// changing the API models.
+package client
+
+//go:generate go run ../../cmd/clientgen -o client_gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls the API of one agent
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// New creates a client for the agent at baseURL (e.g. http://agent:8080). If
+// token is set it is sent as a bearer token.
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// WithHTTPClient returns a copy of the client that sends requests with
+// httpClient, e.g. to configure TLS client certificates
+func (c *Client) WithHTTPClient(httpClient *http.Client) *Client {
+	copied := *c
+	copied.httpClient = httpClient
+	return &copied
+}
+
+// APIError is returned for error responses from the agent
+type APIError struct {
+	StatusCode int
+	Response   ErrorResponse
+}
+
+func (e *APIError) Error() string {
+	if e.Response.Details != "" {
+		return fmt.Sprintf("agent API error %d: %s", e.StatusCode, e.Response.Details)
+	}
+	return fmt.Sprintf("agent API error %d: %s", e.StatusCode, e.Response.Error)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, &body)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr.Response)
+		return apiErr
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/api"
+	"github.com/quinnovator/easy-tunnel-lb-agent/internal/tunnel"
+)
+
+func TestClient(t *testing.T) {
+	tunnelManager := tunnel.NewManager(10)
+	handler := api.NewHandler(tunnelManager, "test")
+	tokens, err := api.NewTokenStore([]api.APIToken{{Name: "operator", Token: "secret", Scopes: []string{api.ScopeAdmin}}})
+	if err != nil {
+		t.Fatalf("Failed to create token store: %v", err)
+	}
+	handler.AddAuthenticator(tokens)
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+	c := New(server.URL, "secret")
+
+	created, err := c.CreateTunnel(ctx, &CreateTunnelParams{IdempotencyKey: "create-web"}, &CreateTunnelRequest{
+		TunnelID:   "web",
+		Hostname:   "web.example.com",
+		TargetPort: 8080,
+		Metadata:   map[string]string{"team": "a"},
+	})
+	if err != nil {
+		t.Fatalf("CreateTunnel failed: %v", err)
+	}
+	if created.TunnelID != "web" {
+		t.Errorf("Expected tunnel ID web, got %s", created.TunnelID)
+	}
+
+	if _, err := c.Heartbeat(ctx, "web", &HeartbeatRequest{Health: "healthy"}); err != nil {
+		t.Errorf("Heartbeat failed: %v", err)
+	}
+
+	status, err := c.GetStatus(ctx, nil)
+	if err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if status.NumTunnels != 1 {
+		t.Errorf("Expected 1 tunnel, got %d", status.NumTunnels)
+	}
+
+	// Errors carry the agent's error response
+	_, err = c.GetTunnelStats(ctx, "missing")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+
+	_, err = New(server.URL, "wrong").RemoveTunnel(ctx, &RemoveTunnelRequest{TunnelID: "web"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized error, got %v", err)
+	}
+
+	if _, err := c.RemoveTunnel(ctx, &RemoveTunnelRequest{TunnelID: "web"}); err != nil {
+		t.Errorf("RemoveTunnel failed: %v", err)
+	}
+}